@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// redacted replaces the value of secret configuration fields.
+const redacted = "[REDACTED]"
+
+// requireToken guards an administrative handler with a bearer token. With no
+// token configured the endpoint is disabled rather than left open.
+func requireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.Error(w, "admin endpoints are disabled: ADMIN_TOKEN is not set", http.StatusForbidden)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="aws-node-retag"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// effectiveConfig is the /config response.
+type effectiveConfig struct {
+	// Settings are the values loaded at startup, keyed by Config field name.
+	Settings map[string]any `json:"settings"`
+	// ConfigVersion and TagPolicies describe the tag snapshot in effect.
+	ConfigVersion uint64          `json:"configVersion"`
+	TagPolicies   []policySummary `json:"tagPolicies,omitempty"`
+	Paused        bool            `json:"paused"`
+}
+
+type policySummary struct {
+	Name          string            `json:"name"`
+	Generation    int64             `json:"generation"`
+	Selector      string            `json:"selector"`
+	ResourceTypes []string          `json:"resourceTypes"`
+	Tags          map[string]string `json:"tags"`
+	DryRun        bool              `json:"dryRun,omitempty"`
+}
+
+// redactConfig returns the settings of cfg keyed by field name, with durations
+// in Go notation and fields tagged `redact:"true"` replaced when set.
+func redactConfig(cfg *Config) map[string]any {
+	out := map[string]any{}
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		switch {
+		case field.Tag.Get("redact") == "true":
+			if !value.IsZero() {
+				out[field.Name] = redacted
+			} else {
+				out[field.Name] = ""
+			}
+		case field.Type == reflect.TypeOf(time.Duration(0)):
+			out[field.Name] = time.Duration(value.Int()).String()
+		default:
+			out[field.Name] = value.Interface()
+		}
+	}
+	return out
+}
+
+// configHandler serves GET /config: the resolved configuration with secrets
+// and the values of LOG_REDACT_TAG_KEYS redacted, plus the TagPolicies and
+// pause state currently in effect.
+func (t *Tagger) configHandler(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		settings := redactConfig(cfg)
+		settings["Tags"] = redactTagValues(t.redactKeys, cfg.Tags)
+		settings["RootVolumeTags"] = redactTagValues(t.redactKeys, cfg.RootVolumeTags)
+		settings["DataVolumeTags"] = redactTagValues(t.redactKeys, cfg.DataVolumeTags)
+		snap := t.current()
+		resp := effectiveConfig{
+			Settings:      settings,
+			ConfigVersion: snap.version,
+			Paused:        t.control != nil && t.control.paused.Load(),
+		}
+		for _, p := range snap.policies {
+			resp.TagPolicies = append(resp.TagPolicies, policySummary{
+				Name:          p.name,
+				Generation:    p.generation,
+				Selector:      p.selector.String(),
+				ResourceTypes: p.resourceTypes(),
+				Tags:          redactTagValues(t.redactKeys, p.tags),
+				DryRun:        p.dryRun,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(resp)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequireToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	cases := []struct {
+		name  string
+		token string
+		auth  string
+		want  int
+	}{
+		{"disabled", "", "Bearer anything", http.StatusForbidden},
+		{"missing", "s3cret", "", http.StatusUnauthorized},
+		{"wrong", "s3cret", "Bearer nope", http.StatusUnauthorized},
+		{"basic scheme", "s3cret", "Basic s3cret", http.StatusUnauthorized},
+		{"valid", "s3cret", "Bearer s3cret", http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/config", nil)
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+			rec := httptest.NewRecorder()
+			requireToken(tc.token, ok).ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("status = %d, want %d", rec.Code, tc.want)
+			}
+		})
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	cfg := &Config{
+		Tags:              map[string]string{"Env": "prod"},
+		AdminToken:        "s3cret",
+		LivenessThreshold: 90 * time.Second,
+	}
+	tagger := &Tagger{control: &controlState{}}
+	tagger.snapshot.Store(&tagSnapshot{version: 4, tags: cfg.Tags})
+	tagger.control.paused.Store(true)
+
+	rec := httptest.NewRecorder()
+	tagger.configHandler(cfg).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "s3cret") {
+		t.Fatalf("response leaks the admin token: %s", rec.Body)
+	}
+
+	var got effectiveConfig
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Settings["AdminToken"] != redacted {
+		t.Errorf("AdminToken = %v, want %q", got.Settings["AdminToken"], redacted)
+	}
+	if got.Settings["LivenessThreshold"] != "1m30s" {
+		t.Errorf("LivenessThreshold = %v, want 1m30s", got.Settings["LivenessThreshold"])
+	}
+	if got.ConfigVersion != 4 || !got.Paused {
+		t.Errorf("configVersion = %d, paused = %v", got.ConfigVersion, got.Paused)
+	}
+}
+
+func TestConfigHandlerRedactsTagValues(t *testing.T) {
+	cfg := &Config{
+		Tags:             map[string]string{"Secret": "s3cr3t", "Team": "platform"},
+		DataVolumeTags:   map[string]string{"a/Secret": "s3cr3t"},
+		LogRedactTagKeys: []string{"Secret"},
+		ClusterTagPrefix: "a/",
+	}
+	policy, err := compilePolicy(newTestPolicy("ml", tagPolicySpec{Tags: map[string]string{"Secret": "hunter2", "Team": "ml"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagger := &Tagger{redactKeys: redactedTagKeys(cfg.LogRedactTagKeys, cfg.ClusterTagPrefix)}
+	tagger.snapshot.Store(&tagSnapshot{tags: cfg.Tags, policies: []*compiledPolicy{policy}})
+
+	rec := httptest.NewRecorder()
+	tagger.configHandler(cfg).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if body := rec.Body.String(); strings.Contains(body, "s3cr3t") || strings.Contains(body, "hunter2") {
+		t.Fatalf("response leaks redacted tag values: %s", body)
+	}
+	var got struct {
+		Settings struct {
+			Tags, DataVolumeTags map[string]string
+		}
+		TagPolicies []policySummary
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Settings.Tags["Secret"] != redactedTagValue || got.Settings.Tags["Team"] != "platform" || got.Settings.DataVolumeTags["a/Secret"] != redactedTagValue {
+		t.Errorf("settings = %+v", got.Settings)
+	}
+	if len(got.TagPolicies) != 1 || got.TagPolicies[0].Tags["Secret"] != redactedTagValue || got.TagPolicies[0].Tags["Team"] != "ml" {
+		t.Errorf("tagPolicies = %+v", got.TagPolicies)
+	}
+	if cfg.Tags["Secret"] != "s3cr3t" {
+		t.Error("redaction modified the configuration")
+	}
+}
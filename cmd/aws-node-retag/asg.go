@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	asgtypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/obezpalko/aws-node-retag/internal/state"
+	awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// asgNameTag is set by EC2 Auto Scaling on the instances it launches.
+const asgNameTag = "aws:autoscaling:groupName"
+
+// autoscalingAPI is the subset of the Auto Scaling client used to tag groups.
+type autoscalingAPI interface {
+	CreateOrUpdateTags(ctx context.Context, params *autoscaling.CreateOrUpdateTagsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.CreateOrUpdateTagsOutput, error)
+}
+
+// asgTagger copies the ASG_TAG_KEYS tags of nodes to the Auto Scaling groups
+// that launched them, with PropagateAtLaunch, so replacement instances start
+// out tagged. Each group is updated once per config version.
+type asgTagger struct {
+	cfg  aws.Config
+	keys []string
+
+	clients state.Lazy[string, autoscalingAPI]
+	// newClient is overridable in tests.
+	newClient func(region string) autoscalingAPI
+	// done holds the config version each group, keyed by region and name,
+	// was tagged with; a group being tagged is already claimed, and a failed
+	// tagging releases its claim so the group's next node retries it.
+	done state.Claims[string, uint64]
+}
+
+func newASGTagger(cfg aws.Config, keys []string) *asgTagger {
+	a := &asgTagger{cfg: cfg, keys: keys}
+	a.newClient = func(region string) autoscalingAPI {
+		return autoscaling.NewFromConfig(a.cfg, func(o *autoscaling.Options) { o.Region = region })
+	}
+	return a
+}
+
+// forRegion returns the client for region, creating it on first use.
+func (a *asgTagger) forRegion(region string) autoscalingAPI {
+	return a.clients.Get(region, a.newClient)
+}
+
+// selectTags returns the configured keys of tags.
+func (a *asgTagger) selectTags(tags map[string]string) map[string]string {
+	out := make(map[string]string, len(a.keys))
+	for _, k := range a.keys {
+		if v, ok := tags[k]; ok {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// instanceASG returns the Auto Scaling group that launched inst, or "".
+func instanceASG(inst *ec2types.Instance) string {
+	for _, tag := range inst.Tags {
+		if aws.ToString(tag.Key) == asgNameTag {
+			return aws.ToString(tag.Value)
+		}
+	}
+	return ""
+}
+
+// tagAutoScalingGroup tags the Auto Scaling group of a node's instance with
+// the ASG_TAG_KEYS of the instance's desired tags. Failures are logged and
+// counted but do not fail the node, whose own resources are tagged; the
+// group's next node retries.
+func (t *Tagger) tagAutoScalingGroup(ctx context.Context, d *nodeDecision, inst *ec2types.Instance, instanceTags map[string]string, log *slog.Logger) {
+	if t.asg == nil || !t.features.enabled(featureASGTagging, d.Region) {
+		return
+	}
+	group := instanceASG(inst)
+	if group == "" {
+		return
+	}
+	tags, dropped := t.protected.filter(t.clusterKeys(t.asg.selectTags(instanceTags)))
+	if len(dropped) > 0 {
+		log.Warn("not writing protected tag keys on Auto Scaling group", "autoScalingGroup", group, "keys", dropped)
+	}
+	if len(tags) == 0 {
+		return
+	}
+	key := d.Region + "/" + group
+	if !t.asg.done.Claim(key, d.ConfigVersion) {
+		return
+	}
+	log = log.With("autoScalingGroup", group)
+	if reason := t.writeBlocked(); reason != "" {
+		log.Info(reason+": would tag Auto Scaling group", "tags", tags)
+		t.asg.done.Release(key, d.ConfigVersion)
+		return
+	}
+	if err := t.createASGTags(ctx, d.Region, group, tags); err != nil {
+		t.asg.done.Release(key, d.ConfigVersion)
+		if t.features.denied(featureASGTagging, d.Region, err) {
+			return
+		}
+		log.Warn("failed to tag Auto Scaling group", "error", err)
+		t.metrics.failed(kindAutoScalingGroup)
+		return
+	}
+	log.Info("tagged Auto Scaling group", "tags", len(tags))
+	t.metrics.succeeded(kindAutoScalingGroup)
+}
+
+// createASGTags writes tags on an Auto Scaling group, propagated to the
+// instances it launches.
+func (t *Tagger) createASGTags(ctx context.Context, region, group string, tags map[string]string) (err error) {
+	ctx, span := startSpan(ctx, "AutoScaling.CreateOrUpdateTags",
+		attribute.String("cloud.region", region),
+		attribute.String("aws.autoscaling.group_name", group),
+		attribute.Int("aws.autoscaling.tag_count", len(tags)))
+	defer func() { endSpan(span, err) }()
+
+	in := &autoscaling.CreateOrUpdateTagsInput{Tags: make([]asgtypes.Tag, 0, len(tags))}
+	for _, k := range sortedTagKeys(tags) {
+		in.Tags = append(in.Tags, asgtypes.Tag{
+			ResourceId:        aws.String(group),
+			ResourceType:      aws.String("auto-scaling-group"),
+			Key:               aws.String(k),
+			Value:             aws.String(awstags.Normalize(tags[k])),
+			PropagateAtLaunch: aws.Bool(true),
+		})
+	}
+	if _, err := t.asg.forRegion(region).CreateOrUpdateTags(ctx, in); err != nil {
+		return fmt.Errorf("CreateOrUpdateTags: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakeAutoscaling struct {
+	mu    sync.Mutex
+	calls []*autoscaling.CreateOrUpdateTagsInput
+	err   error
+}
+
+func (f *fakeAutoscaling) CreateOrUpdateTags(_ context.Context, in *autoscaling.CreateOrUpdateTagsInput, _ ...func(*autoscaling.Options)) (*autoscaling.CreateOrUpdateTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, in)
+	return &autoscaling.CreateOrUpdateTagsOutput{}, f.err
+}
+
+func TestTagAutoScalingGroup(t *testing.T) {
+	api := &fakeAutoscaling{}
+	tagger := &Tagger{
+		asg:     newASGTagger(aws.Config{}, []string{"Team", "CostCenter", "Missing"}),
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		metrics: newMetrics(""),
+	}
+	tagger.asg.newClient = func(string) autoscalingAPI { return api }
+	inst := &ec2types.Instance{Tags: []ec2types.Tag{{Key: aws.String(asgNameTag), Value: aws.String("workers-a")}}}
+	tags := map[string]string{"Team": "ml", "CostCenter": "42", "Env": "prod"}
+	d := &nodeDecision{Region: "us-east-1", ConfigVersion: 1}
+	ctx := context.Background()
+
+	tagger.tagAutoScalingGroup(ctx, d, inst, tags, tagger.logger)
+	if len(api.calls) != 1 {
+		t.Fatalf("CreateOrUpdateTags calls = %d, want 1", len(api.calls))
+	}
+	got := api.calls[0].Tags
+	if len(got) != 2 || aws.ToString(got[0].Key) != "CostCenter" || aws.ToString(got[1].Key) != "Team" {
+		t.Fatalf("tags = %+v, want CostCenter and Team", got)
+	}
+	for _, tag := range got {
+		if aws.ToString(tag.ResourceId) != "workers-a" || aws.ToString(tag.ResourceType) != "auto-scaling-group" || !aws.ToBool(tag.PropagateAtLaunch) {
+			t.Errorf("tag = %+v", tag)
+		}
+	}
+
+	// Once per group and config version.
+	tagger.tagAutoScalingGroup(ctx, d, inst, tags, tagger.logger)
+	if len(api.calls) != 1 {
+		t.Errorf("group tagged again at the same config version")
+	}
+	tagger.tagAutoScalingGroup(ctx, &nodeDecision{Region: "us-east-1", ConfigVersion: 2}, inst, tags, tagger.logger)
+	if len(api.calls) != 2 {
+		t.Errorf("group not tagged again after a config change")
+	}
+
+	// Failures are retried by the group's next node.
+	api.err = errors.New("AccessDenied")
+	d3 := &nodeDecision{Region: "us-east-1", ConfigVersion: 3}
+	tagger.tagAutoScalingGroup(ctx, d3, inst, tags, tagger.logger)
+	api.err = nil
+	tagger.tagAutoScalingGroup(ctx, d3, inst, tags, tagger.logger)
+	if len(api.calls) != 4 {
+		t.Errorf("CreateOrUpdateTags calls = %d, want a retry after the failure", len(api.calls))
+	}
+	if got := testutil.ToFloat64(tagger.metrics.failures.WithLabelValues(kindAutoScalingGroup)); got != 1 {
+		t.Errorf("asg failures = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(tagger.metrics.tagged.WithLabelValues(kindAutoScalingGroup)); got != 3 {
+		t.Errorf("asg tagged = %v, want 3", got)
+	}
+
+	// Instances outside an Auto Scaling group and dry-run write nothing.
+	tagger.tagAutoScalingGroup(ctx, &nodeDecision{Region: "us-east-1", ConfigVersion: 4}, &ec2types.Instance{}, tags, tagger.logger)
+	tagger.dryRun = true
+	tagger.tagAutoScalingGroup(ctx, &nodeDecision{Region: "us-east-1", ConfigVersion: 4}, inst, tags, tagger.logger)
+	if len(api.calls) != 4 {
+		t.Errorf("CreateOrUpdateTags calls = %d, want 4", len(api.calls))
+	}
+	if err := tagger.asg.done.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+	if err := tagger.asg.clients.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// instanceAttributes maps the attribute names accepted in INSTANCE_ATTRIBUTE_TAGS
+// to accessors on the DescribeInstances result. An empty return value means the
+// attribute is not set and no tag is derived from it.
+var instanceAttributes = map[string]func(*ec2types.Instance) string{
+	"InstanceType": func(i *ec2types.Instance) string { return string(i.InstanceType) },
+	"Architecture": func(i *ec2types.Instance) string { return string(i.Architecture) },
+	"Hypervisor":   func(i *ec2types.Instance) string { return string(i.Hypervisor) },
+	"Tenancy": func(i *ec2types.Instance) string {
+		if i.Placement == nil {
+			return ""
+		}
+		return string(i.Placement.Tenancy)
+	},
+	"AvailabilityZone": func(i *ec2types.Instance) string {
+		if i.Placement == nil {
+			return ""
+		}
+		return aws.ToString(i.Placement.AvailabilityZone)
+	},
+	// InstanceLifecycle is only set for spot, scheduled and capacity-block instances.
+	"Lifecycle": func(i *ec2types.Instance) string {
+		if i.InstanceLifecycle == "" {
+			return "on-demand"
+		}
+		return string(i.InstanceLifecycle)
+	},
+	"ImageId": func(i *ec2types.Instance) string { return aws.ToString(i.ImageId) },
+}
+
+// validateAttributeTags checks that every attribute in the mapping is supported
+// and that no derived tag key collides with a static tag.
+func validateAttributeTags(mapping, static map[string]string) error {
+	for attr, key := range mapping {
+		if _, ok := instanceAttributes[attr]; !ok {
+			return fmt.Errorf("unsupported instance attribute %q (supported: %s)", attr, strings.Join(supportedAttributes(), ", "))
+		}
+		if key == "" {
+			return fmt.Errorf("instance attribute %q maps to an empty tag key", attr)
+		}
+		if _, ok := static[key]; ok {
+			return fmt.Errorf("instance attribute %q maps to tag key %q, which is already set in TAGS", attr, key)
+		}
+	}
+	return nil
+}
+
+func supportedAttributes() []string {
+	names := make([]string, 0, len(instanceAttributes))
+	for name := range instanceAttributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// attributeTags derives tags from the instance according to mapping
+// (attribute name → tag key). Attributes with no value are omitted.
+func attributeTags(inst *ec2types.Instance, mapping map[string]string) map[string]string {
+	tags := make(map[string]string, len(mapping))
+	for attr, key := range mapping {
+		get, ok := instanceAttributes[attr]
+		if !ok {
+			continue
+		}
+		if v := get(inst); v != "" {
+			tags[key] = v
+		}
+	}
+	return tags
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+func TestAttributeTags(t *testing.T) {
+	inst := &ec2types.Instance{
+		InstanceType: ec2types.InstanceTypeM5Large,
+		Architecture: ec2types.ArchitectureValuesArm64,
+		Hypervisor:   ec2types.HypervisorTypeXen,
+		ImageId:      aws.String("ami-0123"),
+		Placement: &ec2types.Placement{
+			AvailabilityZone: aws.String("us-east-1a"),
+			Tenancy:          ec2types.TenancyDedicated,
+		},
+	}
+
+	cases := []struct {
+		name    string
+		inst    *ec2types.Instance
+		mapping map[string]string
+		want    map[string]string
+	}{
+		{
+			name: "all attributes",
+			inst: inst,
+			mapping: map[string]string{
+				"InstanceType":     "node/instance-type",
+				"Architecture":     "node/arch",
+				"Hypervisor":       "node/hypervisor",
+				"Tenancy":          "node/tenancy",
+				"AvailabilityZone": "node/az",
+				"Lifecycle":        "node/lifecycle",
+				"ImageId":          "node/ami",
+			},
+			want: map[string]string{
+				"node/instance-type": "m5.large",
+				"node/arch":          "arm64",
+				"node/hypervisor":    "xen",
+				"node/tenancy":       "dedicated",
+				"node/az":            "us-east-1a",
+				"node/lifecycle":     "on-demand",
+				"node/ami":           "ami-0123",
+			},
+		},
+		{
+			name:    "spot lifecycle",
+			inst:    &ec2types.Instance{InstanceLifecycle: ec2types.InstanceLifecycleTypeSpot},
+			mapping: map[string]string{"Lifecycle": "lifecycle"},
+			want:    map[string]string{"lifecycle": "spot"},
+		},
+		{
+			name:    "unset attributes are omitted",
+			inst:    &ec2types.Instance{},
+			mapping: map[string]string{"Tenancy": "tenancy", "InstanceType": "type"},
+			want:    map[string]string{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := attributeTags(tc.inst, tc.mapping)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("attributeTags() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateAttributeTags(t *testing.T) {
+	static := map[string]string{"Team": "platform"}
+	cases := []struct {
+		name    string
+		mapping map[string]string
+		wantErr bool
+	}{
+		{name: "valid", mapping: map[string]string{"InstanceType": "InstanceType"}},
+		{name: "unknown attribute", mapping: map[string]string{"CpuCount": "cpus"}, wantErr: true},
+		{name: "empty key", mapping: map[string]string{"InstanceType": ""}, wantErr: true},
+		{name: "collides with TAGS", mapping: map[string]string{"InstanceType": "Team"}, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateAttributeTags(tc.mapping, static)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("validateAttributeTags() err=%v, wantErr=%v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"time"
+
+	awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+	"github.com/parquet-go/parquet-go"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+// cmdAudit is the subcommand that writes one drift report and exits.
+const cmdAudit = "audit"
+
+// auditDriftExitCode is the exit status of the audit command when drift was
+// found; failures to audit some nodes exit with 1.
+const auditDriftExitCode = 3
+
+// Audit report formats accepted in AUDIT_FORMAT.
+const (
+	auditFormatJSON = "json"
+	auditFormatCSV  = "csv"
+	// auditFormatParquet writes one row per finding, audited resource
+	// without findings and node that could not be audited, for Athena and
+	// other query engines reading the reports from S3.
+	auditFormatParquet = "parquet"
+)
+
+// Drift statuses of an auditFinding.
+const (
+	driftMissing  = "missing"
+	driftMismatch = "mismatch"
+)
+
+// Statuses of the CSV and Parquet rows that are not findings.
+const (
+	auditRowCompliant = "compliant"
+	auditRowError     = "error"
+)
+
+// auditFinding is one desired tag that a resource does not carry.
+type auditFinding struct {
+	Node       string `json:"node"`
+	Region     string `json:"region"`
+	Resource   string `json:"resource"`
+	ResourceID string `json:"resourceID"`
+	Status     string `json:"status"`
+	Key        string `json:"key"`
+	Expected   string `json:"expected"`
+	Actual     string `json:"actual,omitempty"`
+}
+
+// auditStale is a node whose status annotation no longer describes the tags
+// its resources would get, e.g. after a configuration change or a volume
+// attachment, without the node having been re-tagged since.
+type auditStale struct {
+	Node     string    `json:"node"`
+	TaggedAt time.Time `json:"taggedAt"`
+	Reason   string    `json:"reason"`
+}
+
+// auditError is a node whose resources could not be audited.
+type auditError struct {
+	Node  string `json:"node"`
+	Error string `json:"error"`
+}
+
+// auditReport compares the tags the controller would write with the tags
+// the instances and volumes actually carry.
+type auditReport struct {
+	// SchemaVersion is auditReportSchemaVersion (see schema.go).
+	SchemaVersion int       `json:"schemaVersion"`
+	GeneratedAt   time.Time `json:"generatedAt"`
+	// Nodes and Resources count what was audited; skipped nodes (e.g. not
+	// on AWS or in a region that is not allowed) are not included.
+	Nodes     int `json:"nodes"`
+	Resources int `json:"resources"`
+	// Drifted counts the resources with at least one finding.
+	Drifted  int            `json:"drifted"`
+	Findings []auditFinding `json:"findings"`
+	// Stale lists the nodes whose status annotation is out of date. Nodes
+	// without one are not included. JSON reports only.
+	Stale  []auditStale `json:"stale,omitempty"`
+	Errors []auditError `json:"errors,omitempty"`
+
+	// audited lists every audited resource, with or without findings.
+	audited []auditedResource
+}
+
+// auditedResource is one resource included in an audit report.
+type auditedResource struct {
+	region, id, node string
+}
+
+// audit compares the desired tags of every node's instance and attached
+// volumes with their current tags. TagPolicies in effect are included; tags
+// of dry-run policies are not expected. Nothing is written.
+func (t *Tagger) audit(ctx context.Context, nodes []*corev1.Node) *auditReport {
+	report := &auditReport{SchemaVersion: auditReportSchemaVersion, GeneratedAt: time.Now().UTC(), Findings: []auditFinding{}}
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	for _, node := range nodes {
+		d := t.resolveNode(ctx, node, true)
+		if d.Action != actionTag {
+			continue
+		}
+		findings, desired, err := t.auditNode(ctx, node, d, quiet)
+		if err != nil {
+			report.Errors = append(report.Errors, auditError{Node: node.Name, Error: err.Error()})
+			continue
+		}
+		report.Nodes++
+		report.Resources += len(desired)
+		for _, id := range sortedTagKeys(desired) {
+			report.audited = append(report.audited, auditedResource{region: d.Region, id: id, node: node.Name})
+		}
+		if status := parseNodeStatus(node.Annotations, t.statusKey()); status != nil {
+			if reason := status.staleReason(d.InstanceID, desired); reason != "" {
+				report.Stale = append(report.Stale, auditStale{Node: node.Name, TaggedAt: status.TaggedAt, Reason: reason})
+			}
+		}
+		drifted := map[string]bool{}
+		for _, f := range findings {
+			drifted[f.ResourceID] = true
+		}
+		report.Drifted += len(drifted)
+		report.Findings = append(report.Findings, findings...)
+	}
+	return report
+}
+
+// auditNode returns the drift findings of one node's resources and the tags
+// desired on each resource audited.
+func (t *Tagger) auditNode(ctx context.Context, node *corev1.Node, d *nodeDecision, log *slog.Logger) ([]auditFinding, map[string]map[string]string, error) {
+	inst, err := t.describeInstance(ctx, d.Region, d.InstanceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	desired := t.nodeResourceTags(node, d, inst, attachedVolumes(inst), log)
+	ids := sortedTagKeys(desired)
+	existing, err := t.describeTags(ctx, d.Region, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var findings []auditFinding
+	for _, id := range ids {
+		for _, c := range awstags.Diff(t.clusterKeys(desired[id]), existing[id]) {
+			f := auditFinding{
+				Node: node.Name, Region: d.Region, Resource: resourceKind(id), ResourceID: id,
+				Key: c.Key, Expected: c.Desired,
+			}
+			switch c.Kind {
+			case awstags.Missing:
+				f.Status = driftMissing
+			case awstags.Mismatch:
+				f.Status, f.Actual = driftMismatch, c.Actual
+			default:
+				continue
+			}
+			findings = append(findings, f)
+		}
+	}
+	return findings, desired, nil
+}
+
+// auditCSVHeader is the first row of CSV reports. Nodes that could not be
+// audited are reported as rows with status "error".
+var auditCSVHeader = []string{"node", "region", "resource", "resourceID", "status", "key", "expected", "actual", "error"}
+
+// encode renders the report in the given format.
+func (r *auditReport) encode(format string) ([]byte, error) {
+	switch format {
+	case auditFormatJSON:
+		data, err := json.MarshalIndent(r, "", "  ")
+		return append(data, '\n'), err
+	case auditFormatParquet:
+		var buf bytes.Buffer
+		err := parquet.Write(&buf, r.parquetRows(), parquet.Compression(&parquet.Snappy))
+		return buf.Bytes(), err
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(auditCSVHeader)
+	for _, f := range r.Findings {
+		w.Write([]string{f.Node, f.Region, f.Resource, f.ResourceID, f.Status, f.Key, f.Expected, f.Actual, ""})
+	}
+	for _, e := range r.Errors {
+		w.Write([]string{e.Node, "", "", "", auditRowError, "", "", "", e.Error})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// auditParquetRow is a row of Parquet reports. Columns are snake_case, as
+// Athena lowercases them, and only ever appended to.
+type auditParquetRow struct {
+	GeneratedAt time.Time `parquet:"generated_at,timestamp(millisecond)"`
+	Node        string    `parquet:"node,dict"`
+	Region      string    `parquet:"region,dict"`
+	Resource    string    `parquet:"resource,dict"`
+	ResourceID  string    `parquet:"resource_id"`
+	// Status is driftMissing, driftMismatch, auditRowCompliant for a
+	// resource without findings or auditRowError for a node that could not
+	// be audited.
+	Status   string `parquet:"status,dict"`
+	Key      string `parquet:"key,dict"`
+	Expected string `parquet:"expected"`
+	Actual   string `parquet:"actual"`
+	Error    string `parquet:"error"`
+}
+
+// parquetRows returns the rows of the report: its findings, its audited
+// resources without findings, then its errors, so that compliance can be
+// computed from the report alone.
+func (r *auditReport) parquetRows() []auditParquetRow {
+	rows := make([]auditParquetRow, 0, len(r.Findings)+len(r.audited)+len(r.Errors))
+	drifted := map[string]bool{}
+	for _, f := range r.Findings {
+		drifted[f.ResourceID] = true
+		rows = append(rows, auditParquetRow{
+			GeneratedAt: r.GeneratedAt, Node: f.Node, Region: f.Region, Resource: f.Resource, ResourceID: f.ResourceID,
+			Status: f.Status, Key: f.Key, Expected: f.Expected, Actual: f.Actual,
+		})
+	}
+	for _, res := range r.audited {
+		if !drifted[res.id] {
+			rows = append(rows, auditParquetRow{
+				GeneratedAt: r.GeneratedAt, Node: res.node, Region: res.region, Resource: resourceKind(res.id), ResourceID: res.id,
+				Status: auditRowCompliant,
+			})
+		}
+	}
+	for _, e := range r.Errors {
+		rows = append(rows, auditParquetRow{GeneratedAt: r.GeneratedAt, Node: e.Node, Status: auditRowError, Error: e.Error})
+	}
+	return rows
+}
+
+// runAudit implements the audit command: it loads the TagPolicies when
+// enabled, audits every node, writes and uploads the report and publishes its
+// AWS Config evaluations. It returns the report so
+// the caller can derive the exit status.
+func (t *Tagger) runAudit(ctx context.Context, cfg *Config, k8sCfg *rest.Config) (*auditReport, error) {
+	if cfg.TagPolicies {
+		dyn, err := dynamic.NewForConfig(k8sCfg)
+		if err != nil {
+			return nil, fmt.Errorf("create dynamic client: %w", err)
+		}
+		if err := t.loadPolicies(ctx, dyn); err != nil {
+			return nil, err
+		}
+	}
+	list, err := t.k8s.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list nodes: %w", err)
+	}
+	nodes := make([]*corev1.Node, len(list.Items))
+	for i := range list.Items {
+		nodes[i] = &list.Items[i]
+	}
+	report := t.audit(ctx, nodes)
+	out := newAuditOutput(cfg)
+	if err := out.write(report); err != nil {
+		return report, err
+	}
+	if err := t.exportAuditReport(ctx, report, out, t.logger); err != nil {
+		return report, err
+	}
+	return report, t.publishEvaluations(ctx, report, t.logger)
+}
+
+// runAudits writes a drift report every interval while the controller runs
+// (AUDIT_INTERVAL), alongside tagging.
+func (t *Tagger) runAudits(ctx context.Context, nodes corelisters.NodeLister, cfg *Config, logger *slog.Logger) {
+	out := newAuditOutput(cfg)
+	ticker := time.NewTicker(cfg.AuditInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if t.rollout.active() {
+			logger.Info("node pool rollout in progress, skipping this audit")
+			continue
+		}
+		list, err := nodes.List(labels.Everything())
+		if err != nil {
+			logger.Error("failed to list nodes from cache", "error", err)
+			continue
+		}
+		report := t.audit(ctx, list)
+		t.metrics.auditDrifted.Set(float64(report.Drifted))
+		if err := out.write(report); err != nil {
+			logger.Error("failed to write audit report", "error", err)
+			continue
+		}
+		logger.Info("audit report written", "nodes", report.Nodes, "resources", report.Resources,
+			"drifted", report.Drifted, "stale", len(report.Stale), "errors", len(report.Errors))
+		if err := t.exportAuditReport(ctx, report, out, logger); err != nil {
+			logger.Error("failed to upload audit report", "error", err)
+		}
+		if err := t.publishEvaluations(ctx, report, logger); err != nil {
+			logger.Error("failed to publish AWS Config evaluations", "error", err)
+		}
+		if t.heartbeat != nil {
+			t.heartbeat.audited(ctx, report)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAudit(t *testing.T) {
+	api := &instanceEC2{taggingEC2{existing: map[string]map[string]string{
+		"i-0123456789abcdef0": {"Env": "prod", "Owner": "someone"},
+		"vol-root":            {"Env": "staging"},
+	}}}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), api)
+	tagger.snapshot.Store(&tagSnapshot{tags: map[string]string{"Env": "prod", "Team": "a"}})
+
+	tagged := taintedNode(map[string]string{annotationKey: annotationValue})
+	fargate := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "fargate-n2"},
+		Spec:       corev1.NodeSpec{ProviderID: "aws:///us-east-1a/fargate-ip-10-0-0-1"},
+	}
+
+	report := tagger.audit(context.Background(), []*corev1.Node{fargate, tagged})
+	// Already tagged nodes are audited too; nodes that are never tagged are not.
+	if report.Nodes != 1 || report.Resources != 2 || report.Drifted != 2 || len(report.Errors) != 0 {
+		t.Fatalf("report = %+v, want 1 node, 2 resources, 2 drifted", report)
+	}
+	want := []auditFinding{
+		{Node: "n1", Region: "us-east-1", Resource: "instance", ResourceID: "i-0123456789abcdef0", Status: driftMissing, Key: "Team", Expected: "a"},
+		{Node: "n1", Region: "us-east-1", Resource: "volume", ResourceID: "vol-root", Status: driftMismatch, Key: "Env", Expected: "prod", Actual: "staging"},
+		{Node: "n1", Region: "us-east-1", Resource: "volume", ResourceID: "vol-root", Status: driftMissing, Key: "Team", Expected: "a"},
+	}
+	if !reflect.DeepEqual(report.Findings, want) {
+		t.Errorf("findings = %+v\nwant %+v", report.Findings, want)
+	}
+	if len(api.createTags) != 0 {
+		t.Errorf("audit wrote tags: %v", api.createTags)
+	}
+
+	data, err := report.encode(auditFormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 || !reflect.DeepEqual(rows[0], auditCSVHeader) {
+		t.Errorf("CSV rows = %v, want the header and 3 findings", rows)
+	}
+}
+
+func TestAuditParquet(t *testing.T) {
+	api := &instanceEC2{taggingEC2{existing: map[string]map[string]string{
+		"i-0123456789abcdef0": {"Env": "prod", "Team": "a"},
+		"vol-root":            {"Env": "staging", "Team": "a"},
+	}}}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), api)
+	tagger.snapshot.Store(&tagSnapshot{tags: map[string]string{"Env": "prod", "Team": "a"}})
+	report := tagger.audit(context.Background(), []*corev1.Node{taintedNode(nil)})
+	report.Errors = append(report.Errors, auditError{Node: "n2", Error: "UnauthorizedOperation"})
+
+	data, err := report.encode(auditFormatParquet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := parquet.Read[auditParquetRow](bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := report.GeneratedAt.Truncate(time.Millisecond)
+	want := []auditParquetRow{
+		{GeneratedAt: at, Node: "n1", Region: "us-east-1", Resource: "volume", ResourceID: "vol-root", Status: driftMismatch, Key: "Env", Expected: "prod", Actual: "staging"},
+		{GeneratedAt: at, Node: "n1", Region: "us-east-1", Resource: "instance", ResourceID: "i-0123456789abcdef0", Status: auditRowCompliant},
+		{GeneratedAt: at, Node: "n2", Status: auditRowError, Error: "UnauthorizedOperation"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("rows = %+v\nwant %+v", rows, want)
+	}
+	for i := range rows {
+		if !rows[i].GeneratedAt.Equal(want[i].GeneratedAt) {
+			t.Errorf("row %d generated_at = %v, want %v", i, rows[i].GeneratedAt, want[i].GeneratedAt)
+		}
+		rows[i].GeneratedAt = want[i].GeneratedAt
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %+v\nwant %+v", rows, want)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// auditExportContentTypes are the Content-Type of uploaded reports by format.
+var auditExportContentTypes = map[string]string{
+	auditFormatJSON:    "application/json",
+	auditFormatCSV:     "text/csv",
+	auditFormatParquet: "application/vnd.apache.parquet",
+}
+
+// auditExportAPI is the subset of the S3 client used to upload reports.
+type auditExportAPI interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+// auditExport uploads every drift report to S3 (AUDIT_S3_URI) under a
+// Hive-style date partition, <prefix>dt=2024-05-01/drift-20240501T120000.000Z.parquet,
+// so that Athena or Steampipe query the reports where they land. Each report
+// is a new object; expiring them is left to the bucket's lifecycle rules.
+type auditExport struct {
+	api    auditExportAPI
+	bucket string
+	// prefix is empty or ends with a slash.
+	prefix string
+	region string
+	// controllerID names the reports of each controller apart when several
+	// export to the same prefix.
+	controllerID string
+}
+
+// parseS3URI splits s3://bucket/prefix into the bucket and the key prefix,
+// which is given a trailing slash.
+func parseS3URI(uri string) (bucket, prefix string, err error) {
+	rest, ok := strings.CutPrefix(uri, "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("%q is not an s3:// URI", uri)
+	}
+	bucket, prefix, _ = strings.Cut(rest, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("%q has no bucket", uri)
+	}
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		prefix += "/"
+	}
+	return bucket, prefix, nil
+}
+
+func newAuditExport(awsCfg aws.Config, cfg *Config) *auditExport {
+	bucket, prefix, _ := parseS3URI(cfg.AuditS3URI) // validated
+	region := cfg.AuditS3Region
+	if region == "" {
+		region = awsCfg.Region
+	}
+	return &auditExport{
+		api:          s3.NewFromConfig(awsCfg, func(o *s3.Options) { o.Region = region }),
+		bucket:       bucket,
+		prefix:       prefix,
+		region:       region,
+		controllerID: cfg.ControllerID,
+	}
+}
+
+// key returns the object key of the report written in format, gzipped when
+// compress is set.
+func (e *auditExport) key(r *auditReport, format string, compress bool) string {
+	at := r.GeneratedAt.UTC()
+	name := "drift-"
+	if e.controllerID != "" {
+		name += e.controllerID + "-"
+	}
+	name += at.Format(auditHistoryTimeFormat) + "." + format
+	if compress {
+		name += ".gz"
+	}
+	return e.prefix + "dt=" + at.Format("2006-01-02") + "/" + name
+}
+
+// exportAuditReport uploads the report, encoded as out writes it, when
+// AUDIT_S3_URI is set.
+func (t *Tagger) exportAuditReport(ctx context.Context, r *auditReport, out *auditOutput, logger *slog.Logger) error {
+	if t.auditExport == nil || !t.features.enabled(featureAuditExport, t.auditExport.region) {
+		return nil
+	}
+	e := t.auditExport
+	key := e.key(r, out.format, out.compress)
+	log := logger.With("bucket", e.bucket, "key", key)
+	if reason := t.writeBlocked(); reason != "" {
+		log.Info(reason + ": would upload the audit report to S3")
+		return nil
+	}
+	data, err := out.encode(r)
+	if err != nil {
+		return err
+	}
+	_, err = e.api.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(e.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(auditExportContentTypes[out.format]),
+	})
+	if err != nil {
+		t.metrics.auditExports.WithLabelValues("failed").Inc()
+		if t.features.denied(featureAuditExport, e.region, err) {
+			return nil
+		}
+		return fmt.Errorf("upload audit report to s3://%s/%s: %w", e.bucket, key, err)
+	}
+	t.metrics.auditExports.WithLabelValues("uploaded").Inc()
+	log.Info("uploaded the audit report to S3", "bytes", len(data))
+	return nil
+}
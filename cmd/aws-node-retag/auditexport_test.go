@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeS3 records PutObject calls with their bodies, failing them with err.
+type fakeS3 struct {
+	calls  []*s3.PutObjectInput
+	bodies [][]byte
+	err    error
+}
+
+func (f *fakeS3) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.calls = append(f.calls, in)
+	body, _ := io.ReadAll(in.Body)
+	f.bodies = append(f.bodies, body)
+	return &s3.PutObjectOutput{}, f.err
+}
+
+func TestParseS3URI(t *testing.T) {
+	for _, tc := range []struct {
+		uri, bucket, prefix string
+		ok                  bool
+	}{
+		{"s3://reports", "reports", "", true},
+		{"s3://reports/", "reports", "", true},
+		{"s3://reports/drift", "reports", "drift/", true},
+		{"s3://reports/tags/drift/", "reports", "tags/drift/", true},
+		{"s3:///drift", "", "", false},
+		{"https://reports.s3.amazonaws.com/drift", "", "", false},
+		{"reports/drift", "", "", false},
+	} {
+		bucket, prefix, err := parseS3URI(tc.uri)
+		if (err == nil) != tc.ok || bucket != tc.bucket || prefix != tc.prefix {
+			t.Errorf("parseS3URI(%q) = %q, %q, %v", tc.uri, bucket, prefix, err)
+		}
+	}
+}
+
+func TestAuditExportKey(t *testing.T) {
+	r := &auditReport{GeneratedAt: time.Date(2026, 10, 15, 23, 30, 5, 0, time.FixedZone("EDT", -4*3600))}
+	for _, tc := range []struct {
+		e        auditExport
+		format   string
+		compress bool
+		want     string
+	}{
+		{auditExport{}, auditFormatParquet, false, "dt=2026-10-16/drift-20261016T033005.000Z.parquet"},
+		{auditExport{prefix: "drift/", controllerID: "blue"}, auditFormatJSON, true, "drift/dt=2026-10-16/drift-blue-20261016T033005.000Z.json.gz"},
+	} {
+		if got := tc.e.key(r, tc.format, tc.compress); got != tc.want {
+			t.Errorf("key(%s, %v) = %q, want %q", tc.format, tc.compress, got, tc.want)
+		}
+	}
+}
+
+func TestExportAuditReport(t *testing.T) {
+	api := &fakeS3{}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), &instanceEC2{})
+	tagger.auditExport = &auditExport{api: api, bucket: "reports", prefix: "drift/"}
+	tagger.features = newFeatureGates(tagger.metrics, tagger.logger)
+	r := &auditReport{GeneratedAt: time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC), Nodes: 3, Findings: []auditFinding{}}
+	out := &auditOutput{format: auditFormatCSV, compress: true, now: time.Now}
+	ctx := context.Background()
+
+	if err := tagger.exportAuditReport(ctx, r, out, tagger.logger); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.calls) != 1 {
+		t.Fatalf("PutObject calls = %d, want 1", len(api.calls))
+	}
+	in := api.calls[0]
+	if aws.ToString(in.Bucket) != "reports" || aws.ToString(in.Key) != "drift/dt=2026-10-15/drift-20261015T120000.000Z.csv.gz" || aws.ToString(in.ContentType) != "text/csv" {
+		t.Errorf("PutObject = s3://%s/%s (%s)", aws.ToString(in.Bucket), aws.ToString(in.Key), aws.ToString(in.ContentType))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(api.bodies[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(zr); err != nil || string(data) != "node,region,resource,resourceID,status,key,expected,actual,error\n" {
+		t.Errorf("body = %q, %v; want the CSV header", data, err)
+	}
+	if got := testutil.ToFloat64(tagger.metrics.auditExports.WithLabelValues("uploaded")); got != 1 {
+		t.Errorf("uploaded = %v, want 1", got)
+	}
+
+	// Dry-run only logs.
+	tagger.dryRun = true
+	if err := tagger.exportAuditReport(ctx, r, out, tagger.logger); err != nil || len(api.calls) != 1 {
+		t.Errorf("uploaded in dry-run: %v, %d calls", err, len(api.calls))
+	}
+
+	// A denied upload disables the export instead of failing the audit.
+	tagger.dryRun = false
+	api.err = &smithy.GenericAPIError{Code: "AccessDenied"}
+	for range 2 {
+		if err := tagger.exportAuditReport(ctx, r, out, tagger.logger); err != nil {
+			t.Errorf("denied upload: %v", err)
+		}
+	}
+	if len(api.calls) != 2 {
+		t.Errorf("PutObject calls = %d, want 2 before the feature is disabled", len(api.calls))
+	}
+	if got := testutil.ToFloat64(tagger.metrics.auditExports.WithLabelValues("failed")); got != 1 {
+		t.Errorf("failed = %v, want 1", got)
+	}
+
+	// Other errors are returned.
+	tagger.features.reset()
+	api.err = &smithy.GenericAPIError{Code: "SlowDown"}
+	if err := tagger.exportAuditReport(ctx, r, out, tagger.logger); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestAuditOutputExportOnly(t *testing.T) {
+	out := newAuditOutput(&Config{AuditS3URI: "s3://reports", AuditFormat: auditFormatParquet})
+	if !out.exportOnly {
+		t.Error("reports written to stdout when only uploaded")
+	}
+	if err := out.write(&auditReport{Findings: []auditFinding{}}); err != nil {
+		t.Fatal(err)
+	}
+	// Writing to a file still works alongside the upload.
+	path := filepath.Join(t.TempDir(), "drift.parquet")
+	out = newAuditOutput(&Config{AuditOutput: path, AuditS3URI: "s3://reports", AuditFormat: auditFormatParquet})
+	if out.exportOnly {
+		t.Error("exportOnly with AUDIT_OUTPUT set")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// auditHistoryTimeFormat is the timestamp in the names of kept reports; it
+// sorts chronologically, and its milliseconds keep reports written within the
+// same second apart.
+const auditHistoryTimeFormat = "20060102T150405.000Z"
+
+// auditOutput is where drift reports are written (AUDIT_OUTPUT), optionally
+// gzip-compressed (AUDIT_COMPRESS). When AUDIT_HISTORY is positive, the
+// previous report is kept before it is replaced, renamed after its
+// modification time (report.json → report-20240501T120000.000Z.json), and the
+// kept reports are pruned by count, age (AUDIT_HISTORY_MAX_AGE) and total
+// size of the report directory's reports (AUDIT_HISTORY_MAX_SIZE), oldest
+// first, so periodic audits never fill the volume.
+type auditOutput struct {
+	path     string
+	format   string
+	compress bool
+	history  int
+	maxAge   time.Duration
+	maxSize  int64
+	now      func() time.Time
+	// exportOnly is set when reports only go to S3 (AUDIT_S3_URI without
+	// AUDIT_OUTPUT; see auditexport.go).
+	exportOnly bool
+}
+
+func newAuditOutput(cfg *Config) *auditOutput {
+	return &auditOutput{
+		path:       cfg.AuditOutput,
+		format:     cfg.AuditFormat,
+		compress:   cfg.AuditCompress,
+		history:    cfg.AuditHistory,
+		maxAge:     cfg.AuditHistoryMaxAge,
+		maxSize:    cfg.AuditHistoryMaxSize,
+		now:        time.Now,
+		exportOnly: cfg.AuditOutput == "" && cfg.AuditS3URI != "",
+	}
+}
+
+// stdout reports whether reports go to stdout.
+func (o *auditOutput) stdout() bool { return o.path == "" || o.path == "-" }
+
+// encode renders the report in the output's format, compressed if set.
+func (o *auditOutput) encode(r *auditReport) ([]byte, error) {
+	data, err := r.encode(o.format)
+	if err != nil {
+		return nil, fmt.Errorf("encode audit report: %w", err)
+	}
+	if !o.compress {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.ModTime = r.GeneratedAt
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("compress audit report: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("compress audit report: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// write writes the report, then prunes the kept reports.
+func (o *auditOutput) write(r *auditReport) error {
+	if o.exportOnly {
+		return nil
+	}
+	data, err := o.encode(r)
+	if err != nil {
+		return err
+	}
+	if o.stdout() {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if o.history > 0 {
+		if err := o.keepPrevious(); err != nil {
+			return fmt.Errorf("keep previous audit report: %w", err)
+		}
+	}
+	if err := writeFileAtomic(o.path, data); err != nil {
+		return err
+	}
+	if o.history > 0 {
+		if err := o.prune(); err != nil {
+			return fmt.Errorf("prune audit reports: %w", err)
+		}
+	}
+	return nil
+}
+
+// splitReportName splits the report file name at its first dot, so
+// report.json.gz keeps .json.gz as its extension.
+func (o *auditOutput) splitReportName() (dir, stem, ext string) {
+	dir, base := filepath.Split(o.path)
+	stem, ext = base, ""
+	if i := strings.IndexByte(base, '.'); i > 0 {
+		stem, ext = base[:i], base[i:]
+	}
+	return dir, stem, ext
+}
+
+// keepPrevious renames the current report, if any, after its modification
+// time. A name already taken, e.g. on a filesystem with coarse modification
+// times, is moved a millisecond later until it is free.
+func (o *auditOutput) keepPrevious() error {
+	info, err := os.Stat(o.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dir, stem, ext := o.splitReportName()
+	at := info.ModTime().UTC().Truncate(time.Millisecond)
+	for {
+		kept := filepath.Join(dir, stem+"-"+at.Format(auditHistoryTimeFormat)+ext)
+		if _, err := os.Lstat(kept); errors.Is(err, fs.ErrNotExist) {
+			return os.Rename(o.path, kept)
+		} else if err != nil {
+			return err
+		}
+		at = at.Add(time.Millisecond)
+	}
+}
+
+// keptReport is a previous report kept next to the current one.
+type keptReport struct {
+	path string
+	time time.Time
+	size int64
+}
+
+// keptReports returns the kept reports, oldest first.
+func (o *auditOutput) keptReports() ([]keptReport, error) {
+	dir, stem, ext := o.splitReportName()
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var kept []keptReport
+	for _, e := range entries {
+		stamp, ok := strings.CutPrefix(e.Name(), stem+"-")
+		if !ok || e.IsDir() {
+			continue
+		}
+		if stamp, ok = strings.CutSuffix(stamp, ext); !ok {
+			continue
+		}
+		t, err := time.Parse(auditHistoryTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		kept = append(kept, keptReport{path: filepath.Join(dir, e.Name()), time: t, size: info.Size()})
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].time.Before(kept[j].time) })
+	return kept, nil
+}
+
+// prune deletes the oldest kept reports beyond the history count, older
+// than maxAge, or while the current and kept reports exceed maxSize.
+func (o *auditOutput) prune() error {
+	kept, err := o.keptReports()
+	if err != nil {
+		return err
+	}
+	total := int64(0)
+	if info, err := os.Stat(o.path); err == nil {
+		total = info.Size()
+	}
+	for _, k := range kept {
+		total += k.size
+	}
+	var errs []error
+	for i, k := range kept {
+		remaining := len(kept) - i
+		expired := o.maxAge > 0 && o.now().Sub(k.time) > o.maxAge
+		oversize := o.maxSize > 0 && total > o.maxSize
+		if remaining <= o.history && !expired && !oversize {
+			break
+		}
+		if err := os.Remove(k.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+			continue
+		}
+		total -= k.size
+	}
+	return errors.Join(errs...)
+}
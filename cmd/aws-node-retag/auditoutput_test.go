@@ -0,0 +1,127 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestAuditOutputCompress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drift.json.gz")
+	out := &auditOutput{path: path, format: auditFormatJSON, compress: true, now: time.Now}
+	if err := out.write(&auditReport{Nodes: 3, Findings: []auditFinding{}}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got auditReport
+	if err := json.Unmarshal(data, &got); err != nil || got.Nodes != 3 {
+		t.Errorf("decompressed report = %+v, %v", got, err)
+	}
+}
+
+func TestAuditOutputHistory(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "drift.json")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	out := &auditOutput{path: path, format: auditFormatJSON, history: 2, now: func() time.Time { return now }}
+
+	// Five reports an hour apart; the file times stand in for write times.
+	for i := 0; i < 5; i++ {
+		if err := out.write(&auditReport{Nodes: i, Findings: []auditFinding{}}); err != nil {
+			t.Fatal(err)
+		}
+		written := now.Add(time.Duration(i-4) * time.Hour)
+		if err := os.Chtimes(path, written, written); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"drift-20240501T100000.000Z.json", "drift-20240501T110000.000Z.json", "drift.json"}
+	if got := dirNames(t, dir); !equalStrings(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+
+	// Age and size limits prune further, oldest first.
+	out.maxAge = 30 * time.Minute
+	if err := out.write(&auditReport{Findings: []auditFinding{}}); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"drift-20240501T120000.000Z.json", "drift.json"}
+	if got := dirNames(t, dir); !equalStrings(got, want) {
+		t.Errorf("files after maxAge = %v, want %v", got, want)
+	}
+	out.maxSize = 1
+	if err := out.write(&auditReport{Findings: []auditFinding{}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := dirNames(t, dir); !equalStrings(got, []string{"drift.json"}) {
+		t.Errorf("files after maxSize = %v, want only the current report", got)
+	}
+}
+
+func TestAuditOutputHistorySameTime(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "drift.json")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	out := &auditOutput{path: path, format: auditFormatJSON, history: 5, now: func() time.Time { return now }}
+
+	// Reports written within the same second, and even with the same file
+	// time, are all kept.
+	for i, written := range []time.Time{now, now.Add(250 * time.Millisecond), now.Add(250 * time.Millisecond), now} {
+		if err := out.write(&auditReport{Nodes: i, Findings: []auditFinding{}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, written, written); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := out.write(&auditReport{Findings: []auditFinding{}}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"drift-20240501T120000.000Z.json", "drift-20240501T120000.001Z.json", "drift-20240501T120000.250Z.json", "drift-20240501T120000.251Z.json", "drift.json"}
+	if got := dirNames(t, dir); !equalStrings(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+}
+
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/obezpalko/aws-node-retag/internal/state"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// otherLabelValue is the label value shared by the series beyond a guarded
+// metric's cap.
+const otherLabelValue = "other"
+
+// defaultMaxSeries is the default METRICS_MAX_SERIES.
+const defaultMaxSeries = 1000
+
+// guardedCounterVec is a counter vector with one high-cardinality label, such
+// as a node name, whose distinct values are capped: the first maxSeries
+// values get series of their own and later ones are aggregated into the
+// "other" series, so a 20k-node cluster does not flood Prometheus. Values
+// already admitted keep their series until forgotten.
+type guardedCounterVec struct {
+	*prometheus.CounterVec
+	name  string
+	label string
+	// capped counts the increments aggregated into "other", by metric name.
+	capped *prometheus.CounterVec
+
+	// admitted holds the values with series of their own.
+	admitted *state.Bounded[string]
+}
+
+func newGuardedCounterVec(opts prometheus.CounterOpts, label string, capped *prometheus.CounterVec) *guardedCounterVec {
+	return &guardedCounterVec{
+		CounterVec: prometheus.NewCounterVec(opts, []string{label}),
+		name:       prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		label:      label,
+		capped:     capped,
+		admitted:   state.NewBounded[string](defaultMaxSeries),
+	}
+}
+
+// admit returns the label value to record v under: v itself, or "other" once
+// maxSeries values are admitted.
+func (g *guardedCounterVec) admit(v string) string {
+	if v != otherLabelValue && g.admitted.Admit(v) {
+		return v
+	}
+	return otherLabelValue
+}
+
+// add adds n to the series of v.
+func (g *guardedCounterVec) add(v string, n float64) {
+	label := g.admit(v)
+	if label == otherLabelValue && v != otherLabelValue {
+		g.capped.WithLabelValues(g.name).Add(n)
+	}
+	g.WithLabelValues(label).Add(n)
+}
+
+func (g *guardedCounterVec) inc(v string) { g.add(v, 1) }
+
+// forget deletes the series of v, e.g. of a deleted node, making room for
+// another value.
+func (g *guardedCounterVec) forget(v string) {
+	g.admitted.Forget(v, func(v string) { g.DeleteLabelValues(v) })
+}
+
+// setMaxSeries changes the cap; values already admitted keep their series.
+func (g *guardedCounterVec) setMaxSeries(n int) {
+	g.admitted.SetMax(n)
+}
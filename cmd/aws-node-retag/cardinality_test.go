@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGuardedCounterVecCapsSeries(t *testing.T) {
+	m := newMetrics("")
+	m.limitSeries(2)
+	m.nodeFailed("a")
+	m.nodeFailed("b")
+	m.nodeFailed("c")
+	m.nodeFailed("d")
+	m.nodeFailed("a")
+
+	for node, want := range map[string]float64{"a": 2, "b": 1, otherLabelValue: 2} {
+		if got := testutil.ToFloat64(m.nodeFailures.WithLabelValues(node)); got != want {
+			t.Errorf("node_failures_total{node=%q} = %v, want %v", node, got, want)
+		}
+	}
+	if n := testutil.CollectAndCount(m.nodeFailures); n != 3 {
+		t.Errorf("node_failures_total has %d series, want 3", n)
+	}
+	if got := testutil.ToFloat64(m.seriesCapped.WithLabelValues(m.nodeFailures.name)); got != 2 {
+		t.Errorf("metric_series_capped_total = %v, want 2", got)
+	}
+
+	// A deleted node makes room for the next one.
+	m.forgetNode("b")
+	m.nodeFailed("e")
+	if got := testutil.ToFloat64(m.nodeFailures.WithLabelValues("e")); got != 1 {
+		t.Errorf("node_failures_total{node=\"e\"} = %v, want 1", got)
+	}
+	if n := testutil.CollectAndCount(m.nodeFailures); n != 3 {
+		t.Errorf("node_failures_total has %d series after forgetting b, want 3", n)
+	}
+}
+
+func TestGuardedCounterVecZeroCap(t *testing.T) {
+	m := newMetrics("")
+	m.limitSeries(0)
+	m.nodeFailed("a")
+	if got := testutil.ToFloat64(m.nodeFailures.WithLabelValues(otherLabelValue)); got != 1 {
+		t.Errorf("node_failures_total{node=\"other\"} = %v, want 1", got)
+	}
+}
+
+func TestRestoreFoldsCappedSeries(t *testing.T) {
+	name := metricsNamespace + "_node_failures_total"
+	m := newMetrics("")
+	m.limitSeries(1)
+	n := m.restore([]counterSample{
+		{Name: name, Labels: map[string]string{"node": "a"}, Value: 3},
+		{Name: name, Labels: map[string]string{"node": "b"}, Value: 2},
+		{Name: name, Labels: map[string]string{"node": otherLabelValue}, Value: 1},
+	})
+	if n != 3 {
+		t.Errorf("restore() = %d, want 3", n)
+	}
+	if got := testutil.ToFloat64(m.nodeFailures.WithLabelValues("a")); got != 3 {
+		t.Errorf("node_failures_total{node=\"a\"} = %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(m.nodeFailures.WithLabelValues(otherLabelValue)); got != 3 {
+		t.Errorf("node_failures_total{node=\"other\"} = %v, want 3", got)
+	}
+	if got := testutil.ToFloat64(m.seriesCapped.WithLabelValues(name)); got != 0 {
+		t.Errorf("metric_series_capped_total = %v, want 0", got)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// checkpointKey is the ConfigMap data key holding the serialized counters.
+const checkpointKey = "counters.json"
+
+// counterSample is the persisted form of one counter series.
+type counterSample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// checkpointStore persists counter samples across restarts.
+type checkpointStore interface {
+	Load(ctx context.Context) ([]counterSample, error)
+	Save(ctx context.Context, samples []counterSample) error
+}
+
+// snapshot returns the current value of every controller counter series.
+func (m *metrics) snapshot() ([]counterSample, error) {
+	families, err := m.registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	var samples []counterSample
+	for _, mf := range families {
+		if mf.GetType() != dto.MetricType_COUNTER || m.counters[mf.GetName()] == nil {
+			continue
+		}
+		for _, metric := range mf.GetMetric() {
+			if !m.owns(metric) {
+				continue
+			}
+			s := counterSample{Name: mf.GetName(), Value: metric.GetCounter().GetValue()}
+			if len(metric.GetLabel()) > 0 {
+				s.Labels = make(map[string]string, len(metric.GetLabel()))
+				for _, lp := range metric.GetLabel() {
+					// The controller and cluster labels are constant, not
+					// labels of the vector.
+					if lp.GetName() != controllerLabel && lp.GetName() != clusterLabel {
+						s.Labels[lp.GetName()] = lp.GetValue()
+					}
+				}
+			}
+			samples = append(samples, s)
+		}
+	}
+	return samples, nil
+}
+
+// owns reports whether a gathered series is one of m's, rather than of
+// another cluster registered with forCluster; those are not checkpointed.
+func (m *metrics) owns(metric *dto.Metric) bool {
+	for _, lp := range metric.GetLabel() {
+		if lp.GetName() == clusterLabel {
+			return lp.GetValue() == m.cluster
+		}
+	}
+	return m.cluster == ""
+}
+
+// restore adds checkpointed values onto the live counters. Samples for unknown
+// metrics or label sets (e.g. after a metric was renamed) are skipped. Samples
+// of capped metrics count against their cap, so a checkpoint taken with a
+// higher METRICS_MAX_SERIES is folded into "other".
+func (m *metrics) restore(samples []counterSample) (restored int) {
+	for _, s := range samples {
+		vec, ok := m.counters[s.Name]
+		if !ok || s.Value <= 0 {
+			continue
+		}
+		if g := m.guarded[s.Name]; g != nil {
+			if v, ok := s.Labels[g.label]; ok && len(s.Labels) == 1 {
+				// Not counted as capped: that counter is restored too.
+				g.WithLabelValues(g.admit(v)).Add(s.Value)
+				restored++
+			}
+			continue
+		}
+		c, err := vec.GetMetricWith(s.Labels)
+		if err != nil {
+			continue
+		}
+		c.Add(s.Value)
+		restored++
+	}
+	return restored
+}
+
+// runCheckpoints saves the counters every interval and once more when ctx is
+// cancelled, so the final values survive a graceful shutdown.
+func (m *metrics) runCheckpoints(ctx context.Context, store checkpointStore, interval time.Duration, logger *slog.Logger) {
+	save := func(ctx context.Context) {
+		samples, err := m.snapshot()
+		if err == nil {
+			err = store.Save(ctx, samples)
+		}
+		if err != nil {
+			logger.Warn("failed to checkpoint metrics", "error", err)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			finalCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			save(finalCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			save(ctx)
+		}
+	}
+}
+
+// configMapCheckpoint stores counters in a ConfigMap, creating it on first save.
+type configMapCheckpoint struct {
+	k8s       kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func (c *configMapCheckpoint) Load(ctx context.Context) ([]counterSample, error) {
+	cm, err := c.k8s.CoreV1().ConfigMaps(c.namespace).Get(ctx, c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeSamples([]byte(cm.Data[checkpointKey]))
+}
+
+func (c *configMapCheckpoint) Save(ctx context.Context, samples []counterSample) error {
+	data, err := json.Marshal(samples)
+	if err != nil {
+		return err
+	}
+	cms := c.k8s.CoreV1().ConfigMaps(c.namespace)
+	cm, err := cms.Get(ctx, c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = cms.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: c.name, Namespace: c.namespace},
+			Data:       map[string]string{checkpointKey: string(data)},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[checkpointKey] = string(data)
+	_, err = cms.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+// updateConfigMapData applies mutate to the data of a ConfigMap, creating it
+// when missing and retrying when another writer updated it concurrently.
+func updateConfigMapData(ctx context.Context, k8s kubernetes.Interface, namespace, name string, mutate func(map[string]string) map[string]string) error {
+	retriable := func(err error) bool { return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) }
+	return retry.OnError(retry.DefaultRetry, retriable, func() error {
+		cms := k8s.CoreV1().ConfigMaps(namespace)
+		cm, err := cms.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			_, err = cms.Create(ctx, &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Data:       mutate(map[string]string{}),
+			}, metav1.CreateOptions{})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data = mutate(cm.Data)
+		_, err = cms.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// fileCheckpoint stores counters in a file, e.g. on a PersistentVolumeClaim mount.
+type fileCheckpoint struct {
+	path string
+}
+
+func (f *fileCheckpoint) Load(context.Context) ([]counterSample, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeSamples(data)
+}
+
+func (f *fileCheckpoint) Save(_ context.Context, samples []counterSample) error {
+	data, err := json.Marshal(samples)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, data)
+}
+
+// writeFileAtomic writes to a temporary file and renames it so a crash never
+// leaves a truncated file behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func decodeSamples(data []byte) ([]counterSample, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var samples []counterSample
+	if err := json.Unmarshal(data, &samples); err != nil {
+		return nil, fmt.Errorf("decode checkpoint: %w", err)
+	}
+	return samples, nil
+}
+
+// podNamespace returns the namespace the controller runs in, from POD_NAMESPACE
+// or the mounted service account. It returns "" when neither is available.
+func podNamespace(getenv func(string) string) string {
+	if ns, ok := lookupEnv(getenv, "POD_NAMESPACE"); ok {
+		return ns
+	}
+	data, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	stores := map[string]checkpointStore{
+		"file":      &fileCheckpoint{path: filepath.Join(t.TempDir(), "counters.json")},
+		"configmap": &configMapCheckpoint{k8s: fake.NewSimpleClientset(), namespace: "kube-system", name: "metrics"},
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			// Loading before the first save is not an error.
+			samples, err := store.Load(ctx)
+			if err != nil || len(samples) != 0 {
+				t.Fatalf("Load() on empty store = %v, %v", samples, err)
+			}
+
+			before := newMetrics("")
+			before.succeeded(kindNode)
+			before.succeeded(kindNode)
+			before.failed(kindPV)
+			before.skip(kindNode, "already_tagged")
+
+			snap, err := before.snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Save(ctx, snap); err != nil {
+				t.Fatalf("Save() err=%v", err)
+			}
+			// A second save must update rather than fail on an existing object.
+			if err := store.Save(ctx, snap); err != nil {
+				t.Fatalf("second Save() err=%v", err)
+			}
+
+			loaded, err := store.Load(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after := newMetrics("")
+			if n := after.restore(loaded); n != 3 {
+				t.Errorf("restore() restored %d series, want 3", n)
+			}
+			after.succeeded(kindNode)
+
+			if got := testutil.ToFloat64(after.tagged.WithLabelValues(kindNode)); got != 3 {
+				t.Errorf("tagged{node} = %v, want 3", got)
+			}
+			if got := testutil.ToFloat64(after.failures.WithLabelValues(kindPV)); got != 1 {
+				t.Errorf("failures{pv} = %v, want 1", got)
+			}
+			if got := testutil.ToFloat64(after.skipped.WithLabelValues(kindNode, "already_tagged")); got != 1 {
+				t.Errorf("skipped{node,already_tagged} = %v, want 1", got)
+			}
+		})
+	}
+}
+
+func TestRestoreSkipsUnknownSeries(t *testing.T) {
+	m := newMetrics("")
+	n := m.restore([]counterSample{
+		{Name: "aws_node_retag_renamed_total", Value: 5},
+		{Name: metricsNamespace + "_tagged_total", Labels: map[string]string{"unknown": "x"}, Value: 2},
+		{Name: metricsNamespace + "_tagged_total", Labels: map[string]string{"kind": kindPV}, Value: 4},
+	})
+	if n != 1 {
+		t.Errorf("restore() = %d, want 1", n)
+	}
+	if got := testutil.ToFloat64(m.tagged.WithLabelValues(kindPV)); got != 4 {
+		t.Errorf("tagged{pv} = %v, want 4", got)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/obezpalko/aws-node-retag/internal/state"
+	"golang.org/x/time/rate"
+)
+
+// ec2API is the subset of the EC2 client used by the controller.
+type ec2API interface {
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	DescribeTags(ctx context.Context, params *ec2.DescribeTagsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeTagsOutput, error)
+	CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error)
+	DescribeVolumes(ctx context.Context, params *ec2.DescribeVolumesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error)
+	DescribeSnapshots(ctx context.Context, params *ec2.DescribeSnapshotsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSnapshotsOutput, error)
+	DeleteTags(ctx context.Context, params *ec2.DeleteTagsInput, optFns ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error)
+	DescribeAddresses(ctx context.Context, params *ec2.DescribeAddressesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error)
+}
+
+// Retry modes accepted in regionOptions.RetryMode.
+const (
+	retryModeStandard = "standard"
+	retryModeAdaptive = "adaptive"
+)
+
+// regionOptions customizes the EC2 client of one region. Zero values keep the
+// SDK defaults (including AWS_MAX_ATTEMPTS / AWS_RETRY_MODE).
+type regionOptions struct {
+	// Endpoint overrides the resolved EC2 endpoint, e.g. a VPC interface endpoint.
+	Endpoint string `json:"endpoint,omitempty"`
+	// MaxAttempts is the SDK retryer's maximum attempts per call.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// RetryMode is "standard" or "adaptive" (client-side rate limiting on throttles).
+	RetryMode string `json:"retryMode,omitempty"`
+	// RetryRateTokens sizes the retry token bucket; -1 disables retry rate limiting.
+	RetryRateTokens int `json:"retryRateTokens,omitempty"`
+	// TPS caps mutating calls (CreateTags, DeleteTags, TagResources) per
+	// second with a client-side token bucket; 0 leaves them unlimited.
+	TPS float64 `json:"tps,omitempty"`
+	// Burst is the size of the TPS token bucket; 0 means TPS rounded up.
+	Burst int `json:"burst,omitempty"`
+	// RetryPolicy overrides retries per error class (see retrypolicy.go).
+	RetryPolicy *retryPolicy `json:"retryPolicy,omitempty"`
+}
+
+func (o regionOptions) validate() error {
+	switch o.RetryMode {
+	case "", retryModeStandard, retryModeAdaptive:
+	default:
+		return fmt.Errorf("retryMode must be %q or %q, got %q", retryModeStandard, retryModeAdaptive, o.RetryMode)
+	}
+	if o.MaxAttempts < 0 {
+		return fmt.Errorf("maxAttempts must not be negative, got %d", o.MaxAttempts)
+	}
+	if o.RetryRateTokens < -1 {
+		return fmt.Errorf("retryRateTokens must be -1 (disabled) or positive, got %d", o.RetryRateTokens)
+	}
+	if o.TPS < 0 {
+		return fmt.Errorf("tps must not be negative, got %g", o.TPS)
+	}
+	if o.Burst < 0 {
+		return fmt.Errorf("burst must not be negative, got %d", o.Burst)
+	}
+	if o.RetryPolicy != nil {
+		if err := o.RetryPolicy.validate(); err != nil {
+			return fmt.Errorf("retryPolicy: %w", err)
+		}
+	}
+	return nil
+}
+
+// withDefaults fills the unset fields of o from d.
+func (o regionOptions) withDefaults(d regionOptions) regionOptions {
+	if o.Endpoint == "" {
+		o.Endpoint = d.Endpoint
+	}
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = d.MaxAttempts
+	}
+	if o.RetryMode == "" {
+		o.RetryMode = d.RetryMode
+	}
+	if o.RetryRateTokens == 0 {
+		o.RetryRateTokens = d.RetryRateTokens
+	}
+	if o.TPS == 0 {
+		o.TPS = d.TPS
+	}
+	if o.Burst == 0 {
+		o.Burst = d.Burst
+	}
+	o.RetryPolicy = o.RetryPolicy.withDefaults(d.RetryPolicy)
+	return o
+}
+
+// limiter returns the token bucket for mutating calls, or nil when unlimited.
+func (o regionOptions) limiter() *rate.Limiter {
+	if o.TPS == 0 {
+		return nil
+	}
+	burst := o.Burst
+	if burst == 0 {
+		burst = int(math.Ceil(o.TPS))
+	}
+	return rate.NewLimiter(rate.Limit(o.TPS), burst)
+}
+
+// retryer builds the SDK retryer for these options, or nil to keep the default.
+func (o regionOptions) retryer() func() aws.Retryer {
+	if o.RetryMode == "" && o.MaxAttempts == 0 && o.RetryRateTokens == 0 && o.RetryPolicy == nil {
+		return nil
+	}
+	standard := func(so *retry.StandardOptions) {
+		if o.MaxAttempts > 0 {
+			so.MaxAttempts = o.MaxAttempts
+		}
+		switch {
+		case o.RetryRateTokens < 0:
+			so.RateLimiter = ratelimit.None
+		case o.RetryRateTokens > 0:
+			so.RateLimiter = ratelimit.NewTokenRateLimit(uint(o.RetryRateTokens))
+		}
+	}
+	base := func() aws.RetryerV2 { return retry.NewStandard(standard) }
+	if o.RetryMode == retryModeAdaptive {
+		base = func() aws.RetryerV2 {
+			return retry.NewAdaptiveMode(func(ao *retry.AdaptiveModeOptions) {
+				ao.StandardOptions = append(ao.StandardOptions, standard)
+			})
+		}
+	}
+	if o.RetryPolicy != nil {
+		return func() aws.Retryer { return &classRetryer{RetryerV2: base(), policy: o.RetryPolicy} }
+	}
+	return func() aws.Retryer { return base() }
+}
+
+// rateLimitedEC2 delays mutating calls to stay within a token bucket, so bulk
+// tagging backs off before EC2 starts rejecting calls with RequestLimitExceeded.
+// Read calls are left to the SDK retryer.
+type rateLimitedEC2 struct {
+	ec2API
+	limiter *rate.Limiter
+}
+
+func (c *rateLimitedEC2) CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, fmt.Errorf("EC2 rate limiter: %w", err)
+	}
+	return c.ec2API.CreateTags(ctx, params, optFns...)
+}
+
+func (c *rateLimitedEC2) DeleteTags(ctx context.Context, params *ec2.DeleteTagsInput, optFns ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, fmt.Errorf("EC2 rate limiter: %w", err)
+	}
+	return c.ec2API.DeleteTags(ctx, params, optFns...)
+}
+
+// ec2Clients builds and memoizes one EC2 client per region, so connections are
+// reused and each region can carry its own endpoint, retry and rate settings.
+type ec2Clients struct {
+	cfg aws.Config
+	// defaults fill the fields a region's options leave unset.
+	defaults regionOptions
+	// options is keyed by region; the "*" entry applies to regions without one.
+	options map[string]regionOptions
+
+	clients state.Lazy[string, ec2API]
+	// limiters holds the EC2_TPS limiter of each region, shared by the EC2
+	// and Resource Groups Tagging API clients writing there with any role:
+	// the clients of assumed roles share their parent's.
+	limiters *state.Lazy[string, *rate.Limiter]
+	// newClient is overridable in tests.
+	newClient func(region string) ec2API
+
+	// roles holds the clients of the roles assumed for TagPolicies with a
+	// roleARN, keyed by role ARN (see policyroles.go).
+	roles state.Lazy[string, *ec2Clients]
+	// newRoleClients is overridable in tests.
+	newRoleClients func(roleARN string) *ec2Clients
+}
+
+func newEC2Clients(cfg aws.Config, defaults regionOptions, options map[string]regionOptions) *ec2Clients {
+	c := &ec2Clients{cfg: cfg, defaults: defaults, options: options, limiters: &state.Lazy[string, *rate.Limiter]{}}
+	c.newClient = c.build
+	c.newRoleClients = c.assume
+	return c
+}
+
+// forRegion returns the client for region, creating it on first use.
+func (c *ec2Clients) forRegion(region string) ec2API {
+	return c.clients.Get(region, c.newClient)
+}
+
+// as returns the clients writing with the credentials of roleARN, creating
+// them on first use; "" returns c itself.
+func (c *ec2Clients) as(roleARN string) *ec2Clients {
+	if roleARN == "" {
+		return c
+	}
+	return c.roles.Get(roleARN, c.newRoleClients)
+}
+
+// assume builds clients with the region options of c that assume roleARN
+// with c's credentials, refreshing the role's credentials before they expire.
+// They share c's rate limiters, so EC2_TPS caps the writes to a region
+// whatever the credentials.
+func (c *ec2Clients) assume(roleARN string) *ec2Clients {
+	cfg := c.cfg.Copy()
+	cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(c.cfg), roleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = roleSessionName
+	}))
+	rc := newEC2Clients(cfg, c.defaults, c.options)
+	rc.limiters = c.limiters
+	return rc
+}
+
+// reset drops the cached clients, including those of assumed roles, so they
+// are rebuilt, e.g. with refreshed credentials, on next use.
+func (c *ec2Clients) reset() {
+	c.clients.Reset()
+	c.roles.Reset()
+}
+
+func (c *ec2Clients) optionsFor(region string) regionOptions {
+	o, ok := c.options[region]
+	if !ok {
+		o = c.options["*"]
+	}
+	return o.withDefaults(c.defaults)
+}
+
+// limiter returns the rate limiter of region, or nil when EC2_TPS leaves it
+// unlimited. Clients built by newEC2Clients have limiters.
+func (c *ec2Clients) limiter(region string) *rate.Limiter {
+	opts := c.optionsFor(region)
+	if opts.TPS == 0 {
+		return nil
+	}
+	return c.limiters.Get(region, func(string) *rate.Limiter { return opts.limiter() })
+}
+
+func (c *ec2Clients) build(region string) ec2API {
+	opts := c.optionsFor(region)
+	client := ec2.NewFromConfig(c.cfg, func(o *ec2.Options) {
+		// The endpoint resolver picks the region's partition from the
+		// region, e.g. ec2.cn-north-1.amazonaws.com.cn in aws-cn.
+		o.Region = region
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+		if r := opts.retryer(); r != nil {
+			o.Retryer = r()
+			o.APIOptions = append(o.APIOptions, addRetryAttempts)
+		}
+	})
+	// Spans are recorded outside the limiter, so waiting for a token shows up
+	// as latency of the call.
+	var api ec2API = client
+	if l := c.limiter(region); l != nil {
+		api = &rateLimitedEC2{ec2API: api, limiter: l}
+	}
+	return &tracedEC2{ec2API: api, region: region}
+}
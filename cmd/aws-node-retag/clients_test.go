@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"golang.org/x/time/rate"
+)
+
+func TestEC2ClientsForRegion(t *testing.T) {
+	clients := newEC2Clients(aws.Config{Region: "us-east-1"}, regionOptions{}, map[string]regionOptions{
+		"us-gov-west-1": {Endpoint: "https://vpce-123.ec2.us-gov-west-1.vpce.amazonaws.com", MaxAttempts: 7, RetryMode: retryModeAdaptive},
+		"*":             {MaxAttempts: 4},
+	})
+
+	gov := clients.forRegion("us-gov-west-1")
+	if again := clients.forRegion("us-gov-west-1"); again != gov {
+		t.Error("forRegion() should memoize the client per region")
+	}
+
+	govOpts := gov.(*tracedEC2).ec2API.(*ec2.Client).Options()
+	if govOpts.Region != "us-gov-west-1" {
+		t.Errorf("Region = %q", govOpts.Region)
+	}
+	if aws.ToString(govOpts.BaseEndpoint) != "https://vpce-123.ec2.us-gov-west-1.vpce.amazonaws.com" {
+		t.Errorf("BaseEndpoint = %q", aws.ToString(govOpts.BaseEndpoint))
+	}
+	if _, ok := govOpts.Retryer.(*retry.AdaptiveMode); !ok {
+		t.Errorf("Retryer = %T, want *retry.AdaptiveMode", govOpts.Retryer)
+	}
+	if n := govOpts.Retryer.MaxAttempts(); n != 7 {
+		t.Errorf("MaxAttempts = %d, want 7", n)
+	}
+
+	east := clients.forRegion("eu-west-1").(*tracedEC2).ec2API.(*ec2.Client).Options()
+	if east.Region != "eu-west-1" || east.BaseEndpoint != nil {
+		t.Errorf("eu-west-1 options = region %q endpoint %v", east.Region, east.BaseEndpoint)
+	}
+	if n := east.Retryer.MaxAttempts(); n != 4 {
+		t.Errorf("wildcard MaxAttempts = %d, want 4", n)
+	}
+}
+
+func TestRegionOptionsValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		opts    regionOptions
+		wantErr bool
+	}{
+		{name: "empty", opts: regionOptions{}},
+		{name: "adaptive", opts: regionOptions{RetryMode: "adaptive", MaxAttempts: 10, RetryRateTokens: -1}},
+		{name: "unknown mode", opts: regionOptions{RetryMode: "legacy"}, wantErr: true},
+		{name: "negative attempts", opts: regionOptions{MaxAttempts: -1}, wantErr: true},
+		{name: "bad tokens", opts: regionOptions{RetryRateTokens: -2}, wantErr: true},
+		{name: "rate limited", opts: regionOptions{TPS: 2.5, Burst: 5}},
+		{name: "negative tps", opts: regionOptions{TPS: -1}, wantErr: true},
+		{name: "negative burst", opts: regionOptions{Burst: -1}, wantErr: true},
+		{name: "retry policy", opts: regionOptions{RetryPolicy: &retryPolicy{Auth: &retryClass{MaxAttempts: 1}, Throttle: &retryClass{MaxAttempts: 10, MaxBackoff: "20s"}}}},
+		{name: "retry policy without attempts", opts: regionOptions{RetryPolicy: &retryPolicy{Throttle: &retryClass{MaxBackoff: "20s"}}}, wantErr: true},
+		{name: "retry policy with bad backoff", opts: regionOptions{RetryPolicy: &retryPolicy{NotFound: &retryClass{MaxAttempts: 3, MaxBackoff: "soon"}}}, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.opts.validate(); (err != nil) != tc.wantErr {
+				t.Fatalf("validate() err=%v, wantErr=%v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestEC2ClientsDefaultsAndRateLimit(t *testing.T) {
+	clients := newEC2Clients(aws.Config{Region: "us-east-1"},
+		regionOptions{MaxAttempts: 6, RetryMode: retryModeAdaptive, TPS: 2.5},
+		map[string]regionOptions{"eu-west-1": {MaxAttempts: 3, TPS: 10, Burst: 20}},
+	)
+
+	east := clients.optionsFor("us-east-1")
+	if east.MaxAttempts != 6 || east.RetryMode != retryModeAdaptive || east.TPS != 2.5 {
+		t.Errorf("us-east-1 options = %+v, want the defaults", east)
+	}
+	eu := clients.optionsFor("eu-west-1")
+	if eu.MaxAttempts != 3 || eu.RetryMode != retryModeAdaptive || eu.TPS != 10 || eu.Burst != 20 {
+		t.Errorf("eu-west-1 options = %+v, want region overrides on top of the defaults", eu)
+	}
+
+	limited, ok := clients.forRegion("us-east-1").(*tracedEC2).ec2API.(*rateLimitedEC2)
+	if !ok {
+		t.Fatalf("forRegion() wraps %T, want *rateLimitedEC2", clients.forRegion("us-east-1").(*tracedEC2).ec2API)
+	}
+	if limited.limiter.Limit() != 2.5 || limited.limiter.Burst() != 3 {
+		t.Errorf("limiter = %v/s burst %d, want 2.5/s burst 3", limited.limiter.Limit(), limited.limiter.Burst())
+	}
+	if n := limited.ec2API.(*ec2.Client).Options().Retryer.MaxAttempts(); n != 6 {
+		t.Errorf("MaxAttempts = %d, want 6", n)
+	}
+
+	if l := (regionOptions{}).limiter(); l != nil {
+		t.Error("limiter() should be nil without TPS")
+	}
+}
+
+func TestEC2ClientsShareLimiterAcrossRoles(t *testing.T) {
+	clients := newEC2Clients(aws.Config{Region: "us-east-1"}, regionOptions{TPS: 5}, nil)
+	limiterOf := func(c *ec2Clients, region string) *rate.Limiter {
+		return c.forRegion(region).(*tracedEC2).ec2API.(*rateLimitedEC2).limiter
+	}
+	own := limiterOf(clients, "eu-west-1")
+	role := clients.as("arn:aws:iam::123456789012:role/team-a")
+	if role == clients {
+		t.Fatal("as() returned the controller's own clients for a role")
+	}
+	if limiterOf(role, "eu-west-1") != own {
+		t.Error("a role's writes to a region should share the region's limiter")
+	}
+	if limiterOf(role, "us-east-1") == own {
+		t.Error("regions should have limiters of their own")
+	}
+	// Rebuilt clients keep the limiters, and their tokens.
+	clients.reset()
+	if limiterOf(clients.as("arn:aws:iam::123456789012:role/team-a"), "eu-west-1") != own {
+		t.Error("a reset should keep the region's limiter")
+	}
+}
+
+func TestEC2ClientsConcurrentUse(t *testing.T) {
+	clients := fakeClients(&taggingEC2{})
+	clients.newRoleClients = func(string) *ec2Clients { return fakeClients(&taggingEC2{}) }
+
+	var wg sync.WaitGroup
+	for i := range 64 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			region := fmt.Sprintf("region-%d", i%4)
+			clients.forRegion(region)
+			clients.as(fmt.Sprintf("arn:aws:iam::123456789012:role/r%d", i%3)).forRegion(region)
+			if i%16 == 0 {
+				clients.reset()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := clients.clients.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+	if err := clients.roles.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
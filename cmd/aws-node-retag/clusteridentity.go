@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Template variables of tag keys and values, written ${name}.
+const (
+	varClusterName = "clusterName"
+	varAccountID   = "accountId"
+	// varOIDCIssuer is the cluster's OIDC issuer without its https:// scheme,
+	// as IAM uses it in the trust policies of IRSA roles.
+	varOIDCIssuer = "oidcIssuer"
+)
+
+var (
+	templateVariables = []string{varClusterName, varAccountID, varOIDCIssuer}
+	templatePattern   = regexp.MustCompile(`\$\{([^}]*)\}`)
+)
+
+// clusterNameLabel is set on the nodes of EKS managed nodegroups.
+const clusterNameLabel = "eks.amazonaws.com/cluster-name"
+
+// clusterNameTags are instance tags naming the cluster, in order of preference.
+var clusterNameTags = []string{"eks:cluster-name", "aws:eks:cluster-name", "alpha.eksctl.io/cluster-name"}
+
+// clusterOwnershipTagPrefix is the key prefix of the tag marking resources
+// as belonging to a cluster, kubernetes.io/cluster/<name>.
+const clusterOwnershipTagPrefix = "kubernetes.io/cluster/"
+
+// stsAPI and eksAPI are the subsets of the STS and EKS clients used to
+// discover the cluster identity.
+type stsAPI interface {
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+type eksAPI interface {
+	DescribeCluster(ctx context.Context, params *eks.DescribeClusterInput, optFns ...func(*eks.Options)) (*eks.DescribeClusterOutput, error)
+}
+
+// clusterIdentity holds the values of the template variables.
+type clusterIdentity struct {
+	ClusterName string
+	AccountID   string
+	OIDCIssuer  string
+}
+
+func (id clusterIdentity) vars() map[string]string {
+	return map[string]string{
+		varClusterName: id.ClusterName,
+		varAccountID:   id.AccountID,
+		varOIDCIssuer:  id.OIDCIssuer,
+	}
+}
+
+// identitySources are where discoverClusterIdentity looks.
+type identitySources struct {
+	// clusterName is CLUSTER_NAME; discovery is skipped when set.
+	clusterName string
+	k8s         kubernetes.Interface
+	ec2         *ec2Clients
+	sts         stsAPI
+	eks         eksAPI
+}
+
+// templateVars returns the sorted names of the variables used in s.
+func templateVars(s string) []string {
+	if !strings.Contains(s, "${") {
+		return nil
+	}
+	var names []string
+	for _, m := range templatePattern.FindAllStringSubmatch(s, -1) {
+		names = append(names, m[1])
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateTemplates checks that the keys and values of tags only use known
+// template variables.
+func validateTemplates(tags map[string]string) error {
+	var errs []error
+	for k, v := range tags {
+		for _, name := range append(templateVars(k), templateVars(v)...) {
+			if !slices.Contains(templateVariables, name) {
+				errs = append(errs, fmt.Errorf("tag %q: unknown template variable ${%s}, expected one of %s", k, name, strings.Join(templateVariables, ", ")))
+			}
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
+
+// expandTemplates returns tags with the variables in keys and values replaced.
+func expandTemplates(tags map[string]string, vars map[string]string) map[string]string {
+	if tags == nil {
+		return nil
+	}
+	expand := func(s string) string {
+		// Most keys and values use no variable.
+		if !strings.Contains(s, "${") {
+			return s
+		}
+		return templatePattern.ReplaceAllStringFunc(s, func(m string) string {
+			return vars[m[2:len(m)-1]]
+		})
+	}
+	out := make(map[string]string, len(tags))
+	for k, v := range tags {
+		out[expand(k)] = expand(v)
+	}
+	return out
+}
+
+// identityVariables returns the template variables cfg needs resolved.
+func (cfg *Config) identityVariables() map[string]bool {
+	need := map[string]bool{}
+	for _, tags := range []map[string]string{cfg.Tags, cfg.RootVolumeTags, cfg.DataVolumeTags} {
+		for k, v := range tags {
+			for _, name := range append(templateVars(k), templateVars(v)...) {
+				need[name] = true
+			}
+		}
+	}
+	if cfg.ClusterOwnershipTag || cfg.VolumeCache {
+		need[varClusterName] = true
+	}
+	return need
+}
+
+// applyIdentity expands the template variables of the tag settings and adds
+// the ownership tag when ClusterOwnershipTag is set, then validates the
+// resulting tags.
+func (cfg *Config) applyIdentity(id clusterIdentity) error {
+	vars := id.vars()
+	cfg.Tags = expandTemplates(cfg.Tags, vars)
+	cfg.RootVolumeTags = expandTemplates(cfg.RootVolumeTags, vars)
+	cfg.DataVolumeTags = expandTemplates(cfg.DataVolumeTags, vars)
+	if cfg.VolumeCache {
+		// The warm volume cache filters by the ownership tag.
+		cfg.ClusterName = id.ClusterName
+	}
+	if cfg.ClusterOwnershipTag {
+		key := clusterOwnershipTagPrefix + id.ClusterName
+		if _, ok := cfg.Tags[key]; !ok {
+			if cfg.Tags == nil {
+				cfg.Tags = map[string]string{}
+			}
+			cfg.Tags[key] = "owned"
+		}
+	}
+	if err := validateTagConfig(cfg); err != nil {
+		return fmt.Errorf("tags violate EC2 tag restrictions:\n%w", err)
+	}
+	return nil
+}
+
+// discoverClusterIdentity resolves the variables in need. The cluster name is
+// CLUSTER_NAME, else the eks.amazonaws.com/cluster-name label of a node, else
+// a cluster name tag of a node's instance; the account is the caller's
+// (sts:GetCallerIdentity) and the OIDC issuer is the cluster's
+// (eks:DescribeCluster).
+func discoverClusterIdentity(ctx context.Context, need map[string]bool, src identitySources) (clusterIdentity, error) {
+	var id clusterIdentity
+	if need[varClusterName] || need[varOIDCIssuer] {
+		name, err := discoverClusterName(ctx, src)
+		if err != nil {
+			return id, err
+		}
+		id.ClusterName = name
+	}
+	if need[varAccountID] {
+		out, err := src.sts.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+		if err != nil {
+			return id, fmt.Errorf("GetCallerIdentity: %w", err)
+		}
+		id.AccountID = aws.ToString(out.Account)
+	}
+	if need[varOIDCIssuer] {
+		out, err := src.eks.DescribeCluster(ctx, &eks.DescribeClusterInput{Name: aws.String(id.ClusterName)})
+		if err != nil {
+			return id, fmt.Errorf("DescribeCluster %s: %w", id.ClusterName, err)
+		}
+		if out.Cluster == nil || out.Cluster.Identity == nil || out.Cluster.Identity.Oidc == nil || aws.ToString(out.Cluster.Identity.Oidc.Issuer) == "" {
+			return id, fmt.Errorf("cluster %s has no OIDC issuer", id.ClusterName)
+		}
+		id.OIDCIssuer = strings.TrimPrefix(aws.ToString(out.Cluster.Identity.Oidc.Issuer), "https://")
+	}
+	return id, nil
+}
+
+func discoverClusterName(ctx context.Context, src identitySources) (string, error) {
+	if src.clusterName != "" {
+		return src.clusterName, nil
+	}
+	nodes, err := src.k8s.CoreV1().Nodes().List(ctx, metav1.ListOptions{Limit: 50})
+	if err != nil {
+		return "", fmt.Errorf("failed to list nodes: %w", err)
+	}
+	for _, node := range nodes.Items {
+		if name := node.Labels[clusterNameLabel]; name != "" {
+			return name, nil
+		}
+	}
+	for _, node := range nodes.Items {
+		info, err := parseProviderID(node.Spec.ProviderID)
+		if err != nil || info.Fargate || info.InstanceID == "" {
+			continue
+		}
+		region, err := regionFromZone(info.Zone)
+		if err != nil {
+			continue
+		}
+		out, err := src.ec2.forRegion(region).DescribeTags(ctx, &ec2.DescribeTagsInput{
+			Filters: []ec2types.Filter{{Name: aws.String("resource-id"), Values: []string{info.InstanceID}}},
+		})
+		if err != nil {
+			return "", fmt.Errorf("DescribeTags %s: %w", info.InstanceID, err)
+		}
+		if name := clusterNameFromTags(out.Tags); name != "" {
+			return name, nil
+		}
+		// Every node of the cluster carries the same tags; one instance decides.
+		break
+	}
+	return "", errors.New("cluster name not found on the nodes or their instances; set CLUSTER_NAME")
+}
+
+// clusterNameFromTags returns the cluster named by an instance's tags: one of
+// clusterNameTags, else the only kubernetes.io/cluster/<name> key.
+func clusterNameFromTags(tags []ec2types.TagDescription) string {
+	byKey := make(map[string]string, len(tags))
+	var owners []string
+	for _, tag := range tags {
+		key := aws.ToString(tag.Key)
+		byKey[key] = aws.ToString(tag.Value)
+		if name, ok := strings.CutPrefix(key, clusterOwnershipTagPrefix); ok && name != "" {
+			owners = append(owners, name)
+		}
+	}
+	for _, key := range clusterNameTags {
+		if name := byKey[key]; name != "" {
+			return name
+		}
+	}
+	if len(owners) == 1 {
+		return owners[0]
+	}
+	return ""
+}
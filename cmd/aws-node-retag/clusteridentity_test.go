@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	ekstypes "github.com/aws/aws-sdk-go-v2/service/eks/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type identityAPIs struct {
+	account string
+	issuer  string
+	calls   []string
+}
+
+func (f *identityAPIs) GetCallerIdentity(context.Context, *sts.GetCallerIdentityInput, ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	f.calls = append(f.calls, "GetCallerIdentity")
+	return &sts.GetCallerIdentityOutput{Account: aws.String(f.account)}, nil
+}
+
+func (f *identityAPIs) DescribeCluster(_ context.Context, in *eks.DescribeClusterInput, _ ...func(*eks.Options)) (*eks.DescribeClusterOutput, error) {
+	f.calls = append(f.calls, "DescribeCluster "+aws.ToString(in.Name))
+	if f.issuer == "" {
+		return nil, errors.New("ResourceNotFoundException")
+	}
+	return &eks.DescribeClusterOutput{Cluster: &ekstypes.Cluster{
+		Identity: &ekstypes.Identity{Oidc: &ekstypes.OIDC{Issuer: aws.String(f.issuer)}},
+	}}, nil
+}
+
+func identityNode(labels map[string]string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "n1", Labels: labels},
+		Spec:       corev1.NodeSpec{ProviderID: "aws:///us-east-1a/i-0123456789abcdef0"},
+	}
+}
+
+func TestDiscoverClusterIdentity(t *testing.T) {
+	all := map[string]bool{varClusterName: true, varAccountID: true, varOIDCIssuer: true}
+	cases := []struct {
+		name     string
+		src      identitySources
+		need     map[string]bool
+		instance map[string]string
+		want     clusterIdentity
+		wantErr  bool
+	}{
+		{
+			name: "configured name",
+			src:  identitySources{clusterName: "prod", k8s: fake.NewSimpleClientset()},
+			need: all,
+			want: clusterIdentity{ClusterName: "prod", AccountID: "123456789012", OIDCIssuer: "oidc.eks.us-east-1.amazonaws.com/id/ABC"},
+		},
+		{
+			name: "node label",
+			src:  identitySources{k8s: fake.NewSimpleClientset(identityNode(map[string]string{clusterNameLabel: "staging"}))},
+			need: map[string]bool{varClusterName: true},
+			want: clusterIdentity{ClusterName: "staging"},
+		},
+		{
+			name:     "instance tag",
+			src:      identitySources{k8s: fake.NewSimpleClientset(identityNode(nil))},
+			need:     map[string]bool{varClusterName: true},
+			instance: map[string]string{"Name": "worker", "eks:cluster-name": "dev"},
+			want:     clusterIdentity{ClusterName: "dev"},
+		},
+		{
+			name:     "instance ownership tag",
+			src:      identitySources{k8s: fake.NewSimpleClientset(identityNode(nil))},
+			need:     map[string]bool{varClusterName: true},
+			instance: map[string]string{"kubernetes.io/cluster/dev": "owned"},
+			want:     clusterIdentity{ClusterName: "dev"},
+		},
+		{
+			name:    "not found",
+			src:     identitySources{k8s: fake.NewSimpleClientset(identityNode(nil))},
+			need:    map[string]bool{varClusterName: true},
+			wantErr: true,
+		},
+		{
+			name: "account only",
+			src:  identitySources{k8s: fake.NewSimpleClientset()},
+			need: map[string]bool{varAccountID: true},
+			want: clusterIdentity{AccountID: "123456789012"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			apis := &identityAPIs{account: "123456789012", issuer: "https://oidc.eks.us-east-1.amazonaws.com/id/ABC"}
+			tc.src.sts, tc.src.eks = apis, apis
+			tc.src.ec2 = fakeClients(&taggingEC2{existing: map[string]map[string]string{"i-0123456789abcdef0": tc.instance}})
+			got, err := discoverClusterIdentity(context.Background(), tc.need, tc.src)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("identity = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyIdentity(t *testing.T) {
+	cfg, err := loadConfig(envMap(map[string]string{
+		"TAGS":                  `{"Account":"${accountId}","Issuer":"${oidcIssuer}"}`,
+		"DATA_VOLUME_TAGS":      `{"${clusterName}/backup":"true"}`,
+		"CLUSTER_OWNERSHIP_TAG": "true",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.applyIdentity(clusterIdentity{ClusterName: "prod", AccountID: "123456789012", OIDCIssuer: "oidc.example/id/ABC"}); err != nil {
+		t.Fatal(err)
+	}
+	wantTags := map[string]string{"Account": "123456789012", "Issuer": "oidc.example/id/ABC", "kubernetes.io/cluster/prod": "owned"}
+	if !reflect.DeepEqual(cfg.Tags, wantTags) {
+		t.Errorf("Tags = %v, want %v", cfg.Tags, wantTags)
+	}
+	if want := map[string]string{"prod/backup": "true"}; !reflect.DeepEqual(cfg.DataVolumeTags, want) {
+		t.Errorf("DataVolumeTags = %v, want %v", cfg.DataVolumeTags, want)
+	}
+
+	// An explicit ownership tag wins.
+	cfg = &Config{Tags: map[string]string{"kubernetes.io/cluster/${clusterName}": "shared"}, ClusterOwnershipTag: true}
+	if err := cfg.applyIdentity(clusterIdentity{ClusterName: "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Tags["kubernetes.io/cluster/prod"] != "shared" {
+		t.Errorf("Tags = %v, want the configured ownership value", cfg.Tags)
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	if err := validateTemplates(map[string]string{"a": "${clusterName}-${accountId}", "${oidcIssuer}": "x", "b": "$clusterName"}); err != nil {
+		t.Errorf("valid templates: %v", err)
+	}
+	if err := validateTemplates(map[string]string{"a": "${region}"}); err == nil {
+		t.Error("expected an error for an unknown variable")
+	}
+}
+
+func BenchmarkExpandTemplates(b *testing.B) {
+	tags := benchmarkTags()
+	tags["kubernetes.io/cluster/${clusterName}"] = "owned"
+	tags["Account"] = "${accountId}"
+	vars := clusterIdentity{ClusterName: "prod-eu", AccountID: "111122223333"}.vars()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = expandTemplates(tags, vars)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+)
+
+// clusterLabel is the constant metric label and log attribute naming the
+// cluster of an object in multi-cluster mode.
+const clusterLabel = "cluster"
+
+// localCluster names the controller's own cluster in multi-cluster mode when
+// CLUSTER_NAME is not set.
+const localCluster = "local"
+
+// clusterTarget is another cluster whose nodes and PVs the controller tags
+// (CLUSTERS): a hub deployment watches each through a kubeconfig context and
+// writes to its AWS account through a role.
+type clusterTarget struct {
+	// Name is the cluster's value of the cluster label and of ${clusterName}
+	// in its tags.
+	Name string `json:"name"`
+	// Kubeconfig is the path of the cluster's kubeconfig, the --kubeconfig
+	// flag or $KUBECONFIG when empty; Context selects one of its contexts,
+	// the current one when empty.
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	Context    string `json:"context,omitempty"`
+	// Tags are merged over TAGS for the cluster.
+	Tags map[string]string `json:"tags,omitempty"`
+	// RoleARN is assumed to tag the cluster's resources; empty writes with
+	// the controller's own credentials.
+	RoleARN string `json:"roleArn,omitempty"`
+}
+
+// localClusterName is the value of the cluster label of the controller's
+// own cluster.
+func (cfg *Config) localClusterName() string {
+	if cfg.ClusterName != "" {
+		return cfg.ClusterName
+	}
+	return localCluster
+}
+
+// forCluster returns the settings of the cluster c: cfg with c's tags merged
+// over TAGS and ${clusterName} resolving to c's name. Call it before the tag
+// templates of cfg are expanded.
+func (cfg *Config) forCluster(c clusterTarget) *Config {
+	spoke := *cfg
+	spoke.Tags = awstags.Merge(cfg.Tags, c.Tags)
+	spoke.ClusterName = c.Name
+	spoke.Clusters = nil
+	return &spoke
+}
+
+// validateClusters checks the CLUSTERS entries of cfg, and their tags as
+// validateTagConfig does for TAGS.
+func validateClusters(cfg *Config) error {
+	seen := map[string]bool{cfg.localClusterName(): true}
+	var errs []error
+	for i, c := range cfg.Clusters {
+		if err := validateControllerID(c.Name); err != nil {
+			errs = append(errs, fmt.Errorf("[%d]: name: %w", i, err))
+			continue
+		}
+		if seen[c.Name] {
+			errs = append(errs, fmt.Errorf("[%s]: the name is used by another cluster", c.Name))
+			continue
+		}
+		seen[c.Name] = true
+		if c.Kubeconfig == "" && c.Context == "" {
+			// Either would be the controller's own cluster.
+			errs = append(errs, fmt.Errorf("[%s]: kubeconfig or context is required", c.Name))
+		}
+		if c.RoleARN != "" {
+			if err := validateRoleARN(c.RoleARN); err != nil {
+				errs = append(errs, fmt.Errorf("[%s]: roleArn: %w", c.Name, err))
+			}
+		}
+		if err := validateTemplates(c.Tags); err != nil {
+			errs = append(errs, fmt.Errorf("[%s]: tags: %w", c.Name, err))
+			continue
+		}
+		if err := validateTagConfig(cfg.forCluster(c)); err != nil {
+			errs = append(errs, fmt.Errorf("[%s]: tags violate EC2 tag restrictions:\n%w", c.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// restConfig loads the client config of the cluster, from its kubeconfig or
+// else flagPath or $KUBECONFIG.
+func (c clusterTarget) restConfig(flagPath string) (*rest.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = flagPath
+	if c.Kubeconfig != "" {
+		rules.ExplicitPath = c.Kubeconfig
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: c.Context}).ClientConfig()
+}
+
+// forCluster returns a Tagger for another cluster with the settings of t,
+// except for the tags and AWS clients of cfg, and with metrics and logs of
+// its own. Policies, notifications, heartbeats and audits stay with t's
+// cluster; the pause switch is shared.
+func (t *Tagger) forCluster(cfg *Config, k8s kubernetes.Interface, recorder record.EventRecorder, clients *ec2Clients, logger *slog.Logger) *Tagger {
+	m := t.metrics.forCluster(cfg.ClusterName)
+	m.limitSeries(cfg.MetricsMaxSeries)
+	spoke := &Tagger{
+		k8s:      k8s,
+		ec2:      clients,
+		dryRun:   t.dryRun,
+		readOnly: t.readOnly,
+		logger:   logger,
+		recorder: recorder,
+		metrics:  m,
+		control:  t.control,
+		// Denied actions depend on the credentials, which may be a role's.
+		features:   newFeatureGates(m, logger),
+		deniedKeys: newDeniedTagKeys(m, logger),
+
+		preserve:           t.preserve,
+		keyPrefix:          t.keyPrefix,
+		shared:             t.shared,
+		managedVolumesOnly: t.managedVolumesOnly,
+		quarantine:         t.quarantine,
+		controllerID:       t.controllerID,
+		legacyMarkers:      t.legacyMarkers,
+		nodeTimeout:        t.nodeTimeout,
+		startupTaint:       t.startupTaint,
+		providerIDFallback: t.providerIDFallback,
+		termination:        t.termination,
+		writes:             t.writes,
+		rollout:            newRolloutState(cfg, m, logger),
+		tasks:              t.tasks,
+		redactKeys:         t.redactKeys,
+		protected:          t.protected,
+		allowedRegions:     t.allowedRegions,
+		partition:          t.partition,
+	}
+	spoke.snapshot.Store(&tagSnapshot{
+		tags:           cfg.Tags,
+		attributeTags:  cfg.InstanceAttributeTags,
+		inventoryTags:  cfg.NodeInventoryTags,
+		rootVolumeTags: cfg.RootVolumeTags,
+		dataVolumeTags: cfg.DataVolumeTags,
+	})
+	if len(cfg.TaggingBackends) > 0 {
+		accountID := cfg.TaggingAccountID
+		if clients != t.ec2 {
+			// TAGGING_ACCOUNT_ID is the controller's account, not the role's.
+			accountID = ""
+		}
+		spoke.backends = newTagBackends(clients, cfg.TaggingBackends, accountID)
+	}
+	if len(cfg.ASGTagKeys) > 0 {
+		spoke.asg = newASGTagger(clients.cfg, cfg.ASGTagKeys)
+	}
+	return spoke
+}
+
+// clusterRun reconciles the nodes and PVs of another cluster with a Tagger,
+// informers and work pool of its own.
+type clusterRun struct {
+	name        string
+	tagger      *Tagger
+	factory     informers.SharedInformerFactory
+	pool        *workPool
+	broadcaster record.EventBroadcaster
+}
+
+// newClusterRun connects to the cluster c and builds its Tagger from hub.
+// cfg holds the settings of c from Config.forCluster, with its tag templates
+// still to be expanded; reconciles run under ctx and, like hub's, report to
+// track.
+func newClusterRun(ctx context.Context, hub *Tagger, cfg *Config, c clusterTarget, kubeconfig string, track func(func()), logger *slog.Logger) (*clusterRun, error) {
+	logger = logger.With(clusterLabel, c.Name)
+	restCfg, err := c.restConfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build k8s config: %w", err)
+	}
+	k8s, err := kubernetes.NewForConfig(restCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create k8s client: %w", err)
+	}
+	clients := hub.ec2.as(c.RoleARN)
+	if need := cfg.identityVariables(); len(need) > 0 {
+		identity, err := discoverClusterIdentity(ctx, need, identitySources{
+			clusterName: cfg.ClusterName,
+			k8s:         k8s,
+			ec2:         clients,
+			sts:         sts.NewFromConfig(clients.cfg),
+			eks:         eks.NewFromConfig(clients.cfg),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover cluster identity: %w", err)
+		}
+		if err := cfg.applyIdentity(identity); err != nil {
+			return nil, err
+		}
+	}
+
+	recorder, broadcaster := newEventRecorder(k8s, controllerName(cfg.ControllerID), cfg.EventBurst, cfg.EventQPS)
+	r := &clusterRun{
+		name:        c.Name,
+		tagger:      hub.forCluster(cfg, k8s, recorder, clients, logger),
+		factory:     informers.NewSharedInformerFactory(k8s, resyncPeriod),
+		pool:        newWorkPool(cfg.Workers, track),
+		broadcaster: broadcaster,
+	}
+	r.tagger.discovery = newVolumeDiscovery(cfg.VolumeDiscovery, cfg.VolumeDiscoveryBulkThreshold, r.pool)
+
+	nodeHandler := r.tagger.nodeEventHandler(ctx, r.pool)
+	nodeHandler.DeleteFunc = r.tagger.nodeDeleteFunc(ctx, r.pool, r.factory.Core().V1().PersistentVolumes().Lister(), cfg.UntagOnNodeDelete)
+	if _, err := r.factory.Core().V1().Nodes().Informer().AddEventHandler(nodeHandler); err != nil {
+		return nil, err
+	}
+	if _, err := r.factory.Core().V1().PersistentVolumes().Informer().AddEventHandler(r.tagger.pvEventHandler(ctx, r.pool)); err != nil {
+		return nil, err
+	}
+	logger.Info("watching cluster", "host", restCfg.Host, "context", c.Context, "roleARN", c.RoleARN, "tags", cfg.Tags)
+	return r, nil
+}
+
+// start runs the pool in the workers stage and the informers in the
+// informers stage. The caches sync in the background: an unreachable cluster
+// must not hold up the others.
+func (r *clusterRun) start(workers, informers *stage) {
+	workers.loop("work pool/"+r.name, r.pool.run)
+	r.factory.Start(informers.ctx.Done())
+	informers.onStop(r.factory.Shutdown)
+	informers.spawn("cache sync/"+r.name, func() {
+		nodes := r.factory.Core().V1().Nodes().Informer()
+		pvs := r.factory.Core().V1().PersistentVolumes().Informer()
+		if cache.WaitForCacheSync(informers.ctx.Done(), nodes.HasSynced, pvs.HasSynced) {
+			r.tagger.logger.Info("cache synced, watching for nodes and persistent volumes")
+		}
+	})
+}
+
+// reconcileAll is Tagger.reconcileAll over the cluster's caches.
+func (r *clusterRun) reconcileAll(ctx context.Context, force bool) {
+	r.tagger.reconcileAll(ctx, r.factory.Core().V1().Nodes().Lister(), r.factory.Core().V1().PersistentVolumes().Lister(), force)
+}
+
+// retagInstance is Tagger.retagInstance over the cluster's caches and pool.
+func (r *clusterRun) retagInstance(ctx context.Context, instanceID string) {
+	r.tagger.retagInstance(ctx, r.pool, r.factory.Core().V1().Nodes().Lister(), instanceID)
+}
+
+// retagAll is Tagger.retagAll over the cluster's caches.
+func (r *clusterRun) retagAll(ctx context.Context) bool {
+	return r.tagger.retagAll(ctx, r.factory.Core().V1().Nodes().Lister(), r.factory.Core().V1().PersistentVolumes().Lister())
+}
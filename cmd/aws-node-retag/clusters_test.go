@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestConfigForCluster(t *testing.T) {
+	cfg := &Config{
+		Tags:        map[string]string{"Team": "platform", "Environment": "prod"},
+		ClusterName: "hub",
+		Clusters:    []clusterTarget{{Name: "spoke", Context: "spoke"}},
+	}
+	spoke := cfg.forCluster(clusterTarget{Name: "spoke", Tags: map[string]string{"Environment": "staging"}})
+	if want := map[string]string{"Team": "platform", "Environment": "staging"}; !reflect.DeepEqual(spoke.Tags, want) {
+		t.Errorf("Tags = %v, want %v", spoke.Tags, want)
+	}
+	if spoke.ClusterName != "spoke" || spoke.Clusters != nil {
+		t.Errorf("ClusterName = %q, Clusters = %v", spoke.ClusterName, spoke.Clusters)
+	}
+	if cfg.Tags["Environment"] != "prod" || cfg.ClusterName != "hub" {
+		t.Errorf("the hub's config changed: %+v", cfg)
+	}
+}
+
+func TestConfigForClusterTemplates(t *testing.T) {
+	cfg := &Config{Tags: map[string]string{"Cluster": "${clusterName}"}, ClusterOwnershipTag: true}
+	spoke := cfg.forCluster(clusterTarget{Name: "spoke"})
+	if err := spoke.applyIdentity(clusterIdentity{ClusterName: spoke.ClusterName}); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"Cluster": "spoke", "kubernetes.io/cluster/spoke": "owned"}; !reflect.DeepEqual(spoke.Tags, want) {
+		t.Errorf("Tags = %v, want %v", spoke.Tags, want)
+	}
+	if cfg.Tags["Cluster"] != "${clusterName}" {
+		t.Errorf("the hub's templates were expanded: %v", cfg.Tags)
+	}
+}
+
+func TestTaggerForCluster(t *testing.T) {
+	const role = "arn:aws:iam::111122223333:role/retag"
+	roleClients := fakeClients(&taggingEC2{})
+	hub := &Tagger{
+		ec2:          fakeClients(&taggingEC2{}),
+		logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		metrics:      newClusterMetrics("", "hub"),
+		control:      &controlState{},
+		controllerID: "blue",
+		startupTaint: "retag",
+	}
+	hub.ec2.newRoleClients = func(string) *ec2Clients { return roleClients }
+	hub.snapshot.Store(&tagSnapshot{tags: map[string]string{"Team": "platform"}})
+
+	cfg := (&Config{Tags: map[string]string{"Team": "platform"}, MetricsMaxSeries: 10}).forCluster(clusterTarget{
+		Name:    "spoke",
+		Tags:    map[string]string{"Environment": "staging"},
+		RoleARN: role,
+	})
+	spoke := hub.forCluster(cfg, fake.NewSimpleClientset(), &record.FakeRecorder{}, hub.ec2.as(role), hub.logger)
+
+	if want := map[string]string{"Team": "platform", "Environment": "staging"}; !reflect.DeepEqual(spoke.current().tags, want) {
+		t.Errorf("tags = %v, want %v", spoke.current().tags, want)
+	}
+	if spoke.ec2 != roleClients {
+		t.Error("the cluster does not write with the role's clients")
+	}
+	if spoke.control != hub.control || spoke.controllerID != "blue" || spoke.startupTaint != "retag" {
+		t.Errorf("settings not shared with the hub: %+v", spoke)
+	}
+
+	// Both clusters' series are served, told apart by the cluster label, but
+	// only the hub's are checkpointed.
+	hub.metrics.succeeded(kindNode)
+	spoke.metrics.succeeded(kindNode)
+	spoke.metrics.succeeded(kindNode)
+	if got := testutil.ToFloat64(spoke.metrics.tagged.WithLabelValues(kindNode)); got != 2 {
+		t.Errorf("spoke tagged = %v, want 2", got)
+	}
+	if n, err := testutil.GatherAndCount(hub.metrics.registry, metricsNamespace+"_tagged_total"); err != nil || n != 2 {
+		t.Errorf("tagged_total series = %d, %v; want one per cluster", n, err)
+	}
+	samples, err := hub.metrics.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range samples {
+		if s.Name == metricsNamespace+"_tagged_total" && (s.Value != 1 || s.Labels[clusterLabel] != "") {
+			t.Errorf("checkpointed %+v, want only the hub's series without the cluster label", s)
+		}
+	}
+}
+
+func TestClusterRestConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	kubeconfig := `apiVersion: v1
+kind: Config
+current-context: spoke-a
+clusters:
+- name: spoke-a
+  cluster: {server: "https://spoke-a.example.com"}
+- name: spoke-b
+  cluster: {server: "https://spoke-b.example.com"}
+users:
+- name: retag
+  user: {token: secret}
+contexts:
+- name: spoke-a
+  context: {cluster: spoke-a, user: retag}
+- name: spoke-b
+  context: {cluster: spoke-b, user: retag}
+`
+	if err := os.WriteFile(path, []byte(kubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		target   clusterTarget
+		flagPath string
+		want     string
+	}{
+		{clusterTarget{Name: "a", Kubeconfig: path}, "", "https://spoke-a.example.com"},
+		{clusterTarget{Name: "b", Kubeconfig: path, Context: "spoke-b"}, "", "https://spoke-b.example.com"},
+		// Without a kubeconfig of its own, the --kubeconfig file's context.
+		{clusterTarget{Name: "b", Context: "spoke-b"}, path, "https://spoke-b.example.com"},
+	} {
+		cfg, err := tc.target.restConfig(tc.flagPath)
+		if err != nil {
+			t.Errorf("%+v: %v", tc.target, err)
+			continue
+		}
+		if cfg.Host != tc.want {
+			t.Errorf("%+v: host = %q, want %q", tc.target, cfg.Host, tc.want)
+		}
+	}
+	if _, err := (clusterTarget{Name: "c", Kubeconfig: path, Context: "missing"}).restConfig(""); err == nil {
+		t.Error("expected an error for an unknown context")
+	}
+}
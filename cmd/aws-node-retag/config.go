@@ -0,0 +1,1064 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Metrics checkpoint modes accepted in METRICS_CHECKPOINT.
+const (
+	checkpointConfigMap = "configmap"
+	checkpointFile      = "file"
+	checkpointOff       = "off"
+)
+
+// regionPattern matches AWS region names such as us-east-1 or us-gov-west-1.
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+
+// accountIDPattern matches AWS account IDs.
+var accountIDPattern = regexp.MustCompile(`^\d{12}$`)
+
+// Config holds the controller settings resolved from the environment.
+// Fields tagged `redact:"true"` hold secrets and are never served or logged.
+type Config struct {
+	Tags   map[string]string
+	DryRun bool
+
+	// ControllerID distinguishes controllers running side by side with
+	// different tag sets: each keeps its own tagged and force annotations
+	// (aws-node-retag.io/tagged-<id>), state ConfigMaps, metric label and log
+	// attribute. Empty for a single controller.
+	ControllerID string
+
+	// ClusterName is the value of the ${clusterName} template variable in
+	// TAGS, ROOT_VOLUME_TAGS and DATA_VOLUME_TAGS; discovered from the nodes
+	// when empty. ClusterOwnershipTag adds kubernetes.io/cluster/<name>=owned
+	// to Tags unless they set that key.
+	ClusterName         string
+	ClusterOwnershipTag bool
+	// Clusters are the other clusters of multi-cluster mode, whose nodes and
+	// PVs are tagged alongside this cluster's (see clusters.go).
+	Clusters []clusterTarget
+	// ReadOnly blocks every write, like DryRun, and also the controller's own
+	// state: TagPolicy status, and the ConfigMaps of metrics checkpoints,
+	// volume sweep positions and config hashes.
+	ReadOnly bool
+
+	// TagPolicies watches TagPolicy objects and merges their tags over Tags for
+	// the nodes and PVs they select. Tags may then be empty.
+	TagPolicies bool
+	// InstallCRDs installs the TagPolicy CRD at startup, or upgrades it when
+	// the controller ships a newer revision, migrating the stored policies to
+	// its storage version (see crds.go). Disabled for CRDs managed by GitOps.
+	InstallCRDs bool
+	// ConfigAuthority selects the tags applied: "env" (default) applies Tags,
+	// RootVolumeTags and DataVolumeTags with the TagPolicies over them, "crd"
+	// the TagPolicies alone. ConfigMigration compares both and lets the
+	// control ConfigMap switch between them at runtime (see
+	// configmigration.go).
+	ConfigAuthority string
+	ConfigMigration bool
+	// TagTTLConfigMap names the ConfigMap in Namespace where the TTL starts of
+	// TagPolicies are kept across restarts (see ttl.go).
+	TagTTLConfigMap string
+	// PolicyConflictResolution decides the value of a key TagPolicies
+	// matching the same object disagree on: "priority" (default), "newest"
+	// or "skip" (see conflicts.go).
+	PolicyConflictResolution string
+
+	// InstanceAttributeTags maps DescribeInstances attributes (e.g. InstanceType)
+	// to tag keys; the attribute values are added to each node's tag set.
+	InstanceAttributeTags map[string]string
+	// NodeInventoryTags maps node status attributes (e.g. OSFamily,
+	// KubeletVersion) to tag keys; the normalized values are added to each
+	// node's tag set (see inventory.go).
+	NodeInventoryTags map[string]string
+
+	// RootVolumeTags and DataVolumeTags are merged over the node's tags for its
+	// root volume (the RootDeviceName mapping) and its other volumes.
+	RootVolumeTags map[string]string
+	DataVolumeTags map[string]string
+
+	// PreserveExisting reads existing tags before writing and leaves values set
+	// by other systems alone, except for keys in PreserveOverwriteKeys ("*"
+	// allows every key). Keys under PreserveProtectedPrefixes are never
+	// overwritten.
+	PreserveExisting          bool
+	PreserveOverwriteKeys     []string
+	PreserveProtectedPrefixes []string
+
+	// SharedInstances makes writes additive only for instances backing nodes
+	// of several clusters: existing values are never overwritten and
+	// differing values are reported as conflicts. It requires ClusterTagPrefix,
+	// which is prepended to every key written.
+	SharedInstances  bool
+	ClusterTagPrefix string
+
+	// UntagOnNodeDelete removes the managed tags from the volumes of retained
+	// (Retain reclaim policy) PVs still attached to a node when it is deleted.
+	UntagOnNodeDelete bool
+
+	// WatchVolumeAttachments tags EBS volumes as soon as a VolumeAttachment
+	// reports them attached, including volumes attached to tagged nodes.
+	// Volumes backing a PV are left to the PV reconcile.
+	WatchVolumeAttachments bool
+
+	// ManagedNodegroupMode selects how nodes of EKS managed nodegroups are
+	// handled: "all" (default) or "volumes-only".
+	ManagedNodegroupMode string
+
+	// ProviderIDFallback looks the instance of a node whose providerID cannot
+	// be parsed up by its private IP or DNS name in the zone of its
+	// topology.kubernetes.io/zone label.
+	ProviderIDFallback bool
+
+	// VolumeDiscovery selects how node instances and their volumes are
+	// described: "auto" (default), "instance" or "bulk" (see discovery.go).
+	// In auto mode a region switches to bulk once
+	// VolumeDiscoveryBulkThreshold nodes are queued in it.
+	VolumeDiscovery              string
+	VolumeDiscoveryBulkThreshold int
+	// VolumeCache describes the volumes carrying the cluster ownership tag
+	// once per region at startup, sparing the reconciles of a cold start
+	// their DescribeVolumes (see volumecache.go).
+	VolumeCache bool
+
+	// TagDedupWindow is how long a successful tag write to a resource stands
+	// in for node reconciles writing the same tags to it; zero only shares
+	// writes in flight (see pipeline.go).
+	TagDedupWindow time.Duration
+
+	// RolloutAware prioritizes the tagging of new nodes and suspends periodic
+	// audits and volume sweeps while nodes carry the rollout annotation, for
+	// at most RolloutMaxDuration (zero: no limit; see rollout.go).
+	RolloutAware       bool
+	RolloutMaxDuration time.Duration
+
+	// ASGTagKeys are the tag keys copied from nodes' instances to their Auto
+	// Scaling groups with PropagateAtLaunch; empty disables it.
+	ASGTagKeys []string
+
+	// ProtectedTagKeys and ProtectedTagPrefixes are tag keys the controller
+	// never writes or deletes, whatever the tag configuration produces.
+	ProtectedTagKeys     []string
+	ProtectedTagPrefixes []string
+
+	// EC2Defaults holds the retry and rate settings applied to every region's
+	// EC2 client unless its EC2RegionOptions entry overrides them.
+	EC2Defaults regionOptions
+	// EC2RegionOptions customizes the per-region EC2 clients (endpoint, retry
+	// and rate settings), keyed by region; "*" applies to regions without an entry.
+	EC2RegionOptions map[string]regionOptions
+	// TaggingBackends selects the API writing the tags of each resource kind
+	// (instance, volume, snapshot, elastic-ip, network-interface, or "*" for
+	// the others): ec2 (default) or resourcegroupstaggingapi.
+	TaggingBackends map[string]string
+	// TaggingAccountID is the account in the ARNs built for the Resource
+	// Groups Tagging API; empty looks up the controller's own.
+	TaggingAccountID string
+
+	// QuarantineIDs and QuarantineTags name resources that are never mutated:
+	// instance/volume IDs, and "key" or "key=value" tags carried by the resource.
+	QuarantineIDs  []string
+	QuarantineTags []string
+
+	// AllowedRegions restricts tagging to these AWS regions. Nodes and PVs that
+	// resolve to any other region are skipped. Empty allows every region.
+	AllowedRegions []string
+
+	// Namespace is the namespace the controller runs in (POD_NAMESPACE or the
+	// service account mount); empty when running out-of-cluster without it.
+	Namespace string
+
+	// ControlConfigMap names the ConfigMap in Namespace whose annotations
+	// control the running controller (e.g. pausing mutations).
+	ControlConfigMap string
+
+	// ConfigDriftCheck publishes a hash of the effective configuration to
+	// ConfigHashConfigMap every ConfigHashInterval under PodName, and reports
+	// when the replicas' hashes differ.
+	ConfigDriftCheck    bool
+	ConfigHashConfigMap string
+	ConfigHashInterval  time.Duration
+	// PodName identifies this replica (POD_NAME, usually from the downward API).
+	PodName string `confighash:"-"`
+
+	// MetricsAddr is the listen address of the Prometheus /metrics server.
+	MetricsAddr string
+	// AdminToken is the bearer token required by the administrative endpoints
+	// on the metrics server (e.g. /config); they are disabled when empty.
+	AdminToken string `redact:"true"`
+	// TagOverrides serves /overrides on the metrics server, where external
+	// systems authenticated with TagOverridesToken submit per-instance tag
+	// overrides, kept in TagOverridesConfigMap (see overrides.go).
+	TagOverrides          bool
+	TagOverridesConfigMap string
+	TagOverridesToken     string `redact:"true"`
+	// MetricsCheckpoint selects where counters are persisted across restarts:
+	// "configmap" (default), "file", or "off".
+	MetricsCheckpoint          string
+	MetricsCheckpointConfigMap string
+	MetricsCheckpointFile      string
+	MetricsCheckpointInterval  time.Duration
+	// MetricsMaxSeries caps the nodes per-node metrics keep a series for;
+	// later nodes are aggregated into node="other".
+	MetricsMaxSeries int
+
+	// HealthProbeAddr is the listen address of the /healthz and /readyz server.
+	HealthProbeAddr string
+	// LivenessThreshold is how long the API heartbeat may go stale, or a single
+	// work item may run, before /healthz starts failing.
+	LivenessThreshold time.Duration
+	// FailFast exits at startup when the IAM preflight fails, instead of
+	// staying unready until it passes (see preflight.go).
+	FailFast bool
+
+	// TracingEndpoint is the OTLP endpoint traces are exported to
+	// (OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT);
+	// tracing is disabled when empty.
+	TracingEndpoint string
+
+	// LogFormat is "json" (default) or "text". LogLevel is the default level
+	// and LogLevels overrides it per component (see logging.go). The values
+	// of the LogRedactTagKeys tags are redacted in logs, in the Events and
+	// conditions of TagPolicy conflicts and in /config. Of the repeated
+	// debug lines of node and PV reconciles, one in LogSampleRate is written
+	// (see logSampler). Logging does not affect the config hash.
+	LogFormat        string                `confighash:"-"`
+	LogLevel         slog.Level            `confighash:"-"`
+	LogLevels        map[string]slog.Level `confighash:"-"`
+	LogRedactTagKeys []string              `confighash:"-"`
+	LogSampleRate    int                   `confighash:"-"`
+
+	// StartupTaint is a taint key that nodes register with and that is removed
+	// once their resources are tagged; empty disables taint removal.
+	StartupTaint string
+	// TerminationTag and TerminationTimeTag are the keys stamped with "true"
+	// and the time on the instance of a node that gets one of the
+	// TerminationTaints (see termination.go); both empty disable it.
+	TerminationTag     string
+	TerminationTimeTag string
+	TerminationTaints  []string
+	// NodeName and TagNodeTimeout configure the tag-node command: the node to
+	// tag (NODE_NAME, usually from the downward API) and how long to retry.
+	NodeName       string `confighash:"-"`
+	TagNodeTimeout time.Duration
+
+	// AuditFormat ("json" or "csv") and AuditOutput (a file path; stdout when
+	// empty) configure the drift reports of the audit command and of periodic
+	// audits, which run every AuditInterval alongside tagging when positive.
+	AuditFormat   string
+	AuditOutput   string
+	AuditInterval time.Duration
+	// AuditCompress gzips reports. AuditHistory previous reports are kept
+	// next to AuditOutput, pruned by AuditHistoryMaxAge and by the total size
+	// of the reports, AuditHistoryMaxSize (0 disables either limit).
+	AuditCompress       bool
+	AuditHistory        int
+	AuditHistoryMaxAge  time.Duration
+	AuditHistoryMaxSize int64
+	// AuditS3URI (s3://bucket/prefix) also uploads every report to S3, in
+	// AuditS3Region (default: the controller's region; see auditexport.go).
+	AuditS3URI    string
+	AuditS3Region string
+	// DecisionLog is the file node reconciles append decision records to, as
+	// JSON lines ("-" for stdout; see decisionlog.go). The file is rotated
+	// once it exceeds DecisionLogMaxSize (0 never rotates it).
+	DecisionLog        string
+	DecisionLogMaxSize int64
+
+	// VolumeSweepInterval, when positive, sweeps every EBS volume carrying
+	// VolumeSweepTag ("key" or "key=value") in VolumeSweepRegions (the AWS
+	// config's region when empty), VolumeSweepPageSize volumes at a time, with
+	// the position of an unfinished sweep kept in VolumeSweepConfigMap.
+	VolumeSweepInterval  time.Duration
+	VolumeSweepTag       string
+	VolumeSweepRegions   []string
+	VolumeSweepPageSize  int
+	VolumeSweepConfigMap string
+
+	// SnapshotTagInterval, when positive, tags the snapshots of volumes that
+	// carry every static tag in SnapshotTagRegions (the AWS config's region
+	// when empty), pacing the describe calls to SnapshotTagTPS pages per
+	// second.
+	SnapshotTagInterval time.Duration
+	SnapshotTagRegions  []string
+	SnapshotTagTPS      float64
+
+	// EventBurst and EventQPS rate-limit the Events recorded per object:
+	// EventBurst at once, then EventQPS per second.
+	EventBurst int
+	EventQPS   float64
+
+	// NotifySNSTopicARN and NotifyWebhookURL are where tagging failure
+	// notifications are sent; notifications are disabled when both are empty.
+	// A notification is sent when a node fails NotifyNodeFailures reconciles in
+	// a row, and when NotifyFailureRate (0 disables) of the node reconciles
+	// within NotifyFailureWindow fail.
+	NotifySNSTopicARN   string
+	NotifyWebhookURL    string `redact:"true"`
+	NotifyNodeFailures  int
+	NotifyFailureRate   float64
+	NotifyFailureWindow time.Duration
+
+	// HeartbeatURL is pinged every HeartbeatInterval while the controller is
+	// healthy and after each periodic audit; empty disables the heartbeat.
+	HeartbeatURL      string `redact:"true"`
+	HeartbeatInterval time.Duration
+
+	// AWSConfigResultTokenFile holds the result token of a custom AWS Config
+	// rule, re-read before each publish; when it is set, or AWSConfigTestMode
+	// is, every audit's per-resource compliance is published to the rule in
+	// AWSConfigRegion (default: the controller's region).
+	AWSConfigResultTokenFile string
+	AWSConfigRegion          string
+	AWSConfigTestMode        bool
+
+	// MigrateLegacyAnnotations converts, at startup, the annotations with which
+	// previous versions or forks marked nodes and PVs tagged: LegacyAnnotations
+	// ("key" or "key=value") and tagged annotations with another value than
+	// the current one.
+	MigrateLegacyAnnotations bool
+	LegacyAnnotations        []string
+
+	// Workers is the number of node, PV and volume attachment events
+	// reconciled at once, shared fairly between regions.
+	Workers int
+	// NodeReconcileTimeout bounds a node reconcile: once it runs out, the
+	// reconcile's AWS and Kubernetes calls are cancelled and the node is
+	// queued again; 0 leaves reconciles unbounded.
+	NodeReconcileTimeout time.Duration `confighash:"-"`
+
+	// ShutdownGracePeriod is how long SIGTERM waits for the queued and
+	// in-flight reconciles to finish before in-flight AWS calls are cancelled
+	// and the rest is dropped; 0 exits right away.
+	ShutdownGracePeriod time.Duration `confighash:"-"`
+}
+
+// loadConfig builds a Config from environment variables read through getenv.
+func loadConfig(getenv func(string) string) (*Config, error) {
+	controllerID, _ := lookupEnv(getenv, "CONTROLLER_ID")
+	if controllerID != "" {
+		if err := validateControllerID(controllerID); err != nil {
+			return nil, fmt.Errorf("CONTROLLER_ID: %w", err)
+		}
+	}
+	// The state ConfigMaps default to names of their own per controller.
+	name := controllerName(controllerID)
+
+	cfg := &Config{
+		ControllerID:                 controllerID,
+		PreserveProtectedPrefixes:    []string{"aws:", "kubernetes.io/"},
+		ManagedNodegroupMode:         nodegroupModeAll,
+		ControlConfigMap:             name + "-control",
+		TagTTLConfigMap:              name + "-tag-ttl",
+		TagOverridesConfigMap:        name + "-tag-overrides",
+		ConfigHashConfigMap:          name + "-config-hashes",
+		ConfigHashInterval:           time.Minute,
+		MetricsAddr:                  ":8080",
+		MetricsCheckpoint:            checkpointConfigMap,
+		MetricsCheckpointConfigMap:   name + "-metrics",
+		MetricsCheckpointInterval:    time.Minute,
+		MetricsMaxSeries:             defaultMaxSeries,
+		HealthProbeAddr:              ":8081",
+		LivenessThreshold:            5 * time.Minute,
+		TagNodeTimeout:               5 * time.Minute,
+		AuditFormat:                  auditFormatJSON,
+		VolumeSweepPageSize:          200,
+		VolumeSweepConfigMap:         name + "-volume-sweep",
+		SnapshotTagTPS:               1,
+		EventBurst:                   25,
+		LogSampleRate:                1,
+		EventQPS:                     1. / 300,
+		NotifyNodeFailures:           1,
+		MigrateLegacyAnnotations:     true,
+		ProviderIDFallback:           true,
+		InstallCRDs:                  true,
+		VolumeDiscovery:              discoveryAuto,
+		VolumeDiscoveryBulkThreshold: 20,
+		TagDedupWindow:               10 * time.Minute,
+		RolloutMaxDuration:           2 * time.Hour,
+		NotifyFailureWindow:          5 * time.Minute,
+		HeartbeatInterval:            5 * time.Minute,
+		DecisionLogMaxSize:           100 << 20,
+		Workers:                      4,
+		NodeReconcileTimeout:         2 * time.Minute,
+		ShutdownGracePeriod:          20 * time.Second,
+	}
+
+	cfg.TagPolicies = getenv("TAG_POLICIES") == "true"
+	if v, ok := lookupEnv(getenv, "INSTALL_CRDS"); ok {
+		cfg.InstallCRDs = v == "true"
+	}
+	cfg.ConfigAuthority = authorityEnv
+	if v, ok := lookupEnv(getenv, "CONFIG_AUTHORITY"); ok {
+		cfg.ConfigAuthority = v
+	}
+	switch cfg.ConfigAuthority {
+	case authorityEnv:
+	case authorityCRD:
+		if !cfg.TagPolicies {
+			return nil, errors.New("CONFIG_AUTHORITY=crd requires TAG_POLICIES=true")
+		}
+	default:
+		return nil, fmt.Errorf("CONFIG_AUTHORITY must be %s or %s, got %q", authorityEnv, authorityCRD, cfg.ConfigAuthority)
+	}
+	cfg.ConfigMigration = getenv("CONFIG_MIGRATION") == "true"
+	if cfg.ConfigMigration && !cfg.TagPolicies {
+		return nil, errors.New("CONFIG_MIGRATION requires TAG_POLICIES=true")
+	}
+	if v, ok := lookupEnv(getenv, "TAG_TTL_CONFIGMAP"); ok {
+		cfg.TagTTLConfigMap = v
+	}
+	cfg.PolicyConflictResolution = resolvePriority
+	if v, ok := lookupEnv(getenv, "POLICY_CONFLICT_RESOLUTION"); ok {
+		cfg.PolicyConflictResolution = v
+	}
+	switch cfg.PolicyConflictResolution {
+	case resolvePriority, resolveNewest, resolveSkip:
+	default:
+		return nil, fmt.Errorf("POLICY_CONFLICT_RESOLUTION must be %q, %q or %q, got %q", resolvePriority, resolveNewest, resolveSkip, cfg.PolicyConflictResolution)
+	}
+	cfg.ClusterName, _ = lookupEnv(getenv, "CLUSTER_NAME")
+	cfg.ClusterOwnershipTag = getenv("CLUSTER_OWNERSHIP_TAG") == "true"
+
+	tagsRaw := getenv("TAGS")
+	if tagsRaw == "" && !cfg.TagPolicies && !cfg.ClusterOwnershipTag {
+		return nil, errors.New(`TAGS environment variable is required (JSON object, e.g. {"Environment":"production"})`)
+	}
+	if tagsRaw != "" {
+		if err := json.Unmarshal([]byte(tagsRaw), &cfg.Tags); err != nil {
+			return nil, fmt.Errorf("failed to parse TAGS %q: %w", tagsRaw, err)
+		}
+	}
+	if len(cfg.Tags) == 0 && !cfg.TagPolicies && !cfg.ClusterOwnershipTag {
+		return nil, errors.New("TAGS must contain at least one key-value pair")
+	}
+
+	cfg.DryRun = getenv("DRY_RUN") == "true"
+	cfg.ReadOnly = getenv("READ_ONLY") == "true"
+
+	if err := envJSON(getenv, "INSTANCE_ATTRIBUTE_TAGS", &cfg.InstanceAttributeTags); err != nil {
+		return nil, err
+	}
+	if err := validateAttributeTags(cfg.InstanceAttributeTags, cfg.Tags); err != nil {
+		return nil, fmt.Errorf("INSTANCE_ATTRIBUTE_TAGS: %w", err)
+	}
+	if err := envJSON(getenv, "NODE_INVENTORY_TAGS", &cfg.NodeInventoryTags); err != nil {
+		return nil, err
+	}
+	if err := validateInventoryTags(cfg.NodeInventoryTags, cfg.Tags, cfg.InstanceAttributeTags); err != nil {
+		return nil, fmt.Errorf("NODE_INVENTORY_TAGS: %w", err)
+	}
+	if err := envJSON(getenv, "ROOT_VOLUME_TAGS", &cfg.RootVolumeTags); err != nil {
+		return nil, err
+	}
+	if err := envJSON(getenv, "DATA_VOLUME_TAGS", &cfg.DataVolumeTags); err != nil {
+		return nil, err
+	}
+	cfg.ClusterTagPrefix, _ = lookupEnv(getenv, "CLUSTER_TAG_PREFIX")
+	if cfg.ClusterTagPrefix != "" {
+		if err := awstags.ValidateKey(cfg.ClusterTagPrefix); err != nil {
+			return nil, fmt.Errorf("CLUSTER_TAG_PREFIX: %w", err)
+		}
+	}
+	if err := validateTemplates(cfg.Tags); err != nil {
+		return nil, fmt.Errorf("TAGS: %w", err)
+	}
+	if err := validateTemplates(cfg.RootVolumeTags); err != nil {
+		return nil, fmt.Errorf("ROOT_VOLUME_TAGS: %w", err)
+	}
+	if err := validateTemplates(cfg.DataVolumeTags); err != nil {
+		return nil, fmt.Errorf("DATA_VOLUME_TAGS: %w", err)
+	}
+	// Templated tags are checked again once expanded, see applyIdentity.
+	if err := validateTagConfig(cfg); err != nil {
+		return nil, fmt.Errorf("tags violate EC2 tag restrictions:\n%w", err)
+	}
+
+	if err := envJSON(getenv, "CLUSTERS", &cfg.Clusters); err != nil {
+		return nil, err
+	}
+	if err := validateClusters(cfg); err != nil {
+		return nil, fmt.Errorf("CLUSTERS: %w", err)
+	}
+
+	cfg.PreserveExisting = getenv("PRESERVE_EXISTING") == "true"
+	cfg.PreserveOverwriteKeys = envList(getenv, "PRESERVE_OVERWRITE_KEYS")
+	if v := envList(getenv, "PRESERVE_PROTECTED_PREFIXES"); v != nil {
+		cfg.PreserveProtectedPrefixes = v
+	}
+
+	cfg.SharedInstances = getenv("SHARED_INSTANCES") == "true"
+	if cfg.SharedInstances {
+		if cfg.ClusterTagPrefix == "" {
+			return nil, errors.New("SHARED_INSTANCES requires CLUSTER_TAG_PREFIX")
+		}
+		if len(cfg.PreserveOverwriteKeys) > 0 {
+			return nil, errors.New("PRESERVE_OVERWRITE_KEYS cannot be used with SHARED_INSTANCES, which never overwrites")
+		}
+	}
+
+	cfg.UntagOnNodeDelete = getenv("UNTAG_ON_NODE_DELETE") == "true"
+	cfg.WatchVolumeAttachments = getenv("WATCH_VOLUME_ATTACHMENTS") == "true"
+
+	if v, ok := lookupEnv(getenv, "MANAGED_NODEGROUP_MODE"); ok {
+		cfg.ManagedNodegroupMode = v
+	}
+	if cfg.ManagedNodegroupMode != nodegroupModeAll && cfg.ManagedNodegroupMode != nodegroupModeVolumesOnly {
+		return nil, fmt.Errorf("MANAGED_NODEGROUP_MODE must be %q or %q, got %q", nodegroupModeAll, nodegroupModeVolumesOnly, cfg.ManagedNodegroupMode)
+	}
+
+	if v, ok := lookupEnv(getenv, "PROVIDER_ID_FALLBACK"); ok {
+		cfg.ProviderIDFallback = v == "true"
+	}
+
+	if v, ok := lookupEnv(getenv, "VOLUME_DISCOVERY"); ok {
+		cfg.VolumeDiscovery = v
+	}
+	switch cfg.VolumeDiscovery {
+	case discoveryAuto, discoveryInstance, discoveryBulk:
+	default:
+		return nil, fmt.Errorf("VOLUME_DISCOVERY must be %q, %q or %q, got %q", discoveryAuto, discoveryInstance, discoveryBulk, cfg.VolumeDiscovery)
+	}
+	if err := envInt(getenv, "VOLUME_DISCOVERY_BULK_THRESHOLD", &cfg.VolumeDiscoveryBulkThreshold); err != nil {
+		return nil, err
+	}
+	if cfg.VolumeDiscoveryBulkThreshold < 2 {
+		return nil, fmt.Errorf("VOLUME_DISCOVERY_BULK_THRESHOLD must be at least 2, got %d", cfg.VolumeDiscoveryBulkThreshold)
+	}
+	cfg.VolumeCache = getenv("VOLUME_CACHE") == "true"
+	if err := envDuration(getenv, "TAG_DEDUP_WINDOW", &cfg.TagDedupWindow); err != nil {
+		return nil, err
+	}
+	if cfg.TagDedupWindow < 0 {
+		return nil, fmt.Errorf("TAG_DEDUP_WINDOW must not be negative, got %s", cfg.TagDedupWindow)
+	}
+	cfg.RolloutAware = getenv("ROLLOUT_AWARE") == "true"
+	if err := envDuration(getenv, "ROLLOUT_MAX_DURATION", &cfg.RolloutMaxDuration); err != nil {
+		return nil, err
+	}
+	if cfg.RolloutMaxDuration < 0 {
+		return nil, fmt.Errorf("ROLLOUT_MAX_DURATION must not be negative, got %s", cfg.RolloutMaxDuration)
+	}
+
+	cfg.ASGTagKeys = envList(getenv, "ASG_TAG_KEYS")
+	for _, k := range cfg.ASGTagKeys {
+		if strings.HasPrefix(k, "aws:") {
+			return nil, fmt.Errorf("ASG_TAG_KEYS: %q: the aws: prefix is reserved", k)
+		}
+	}
+
+	cfg.ProtectedTagKeys = envList(getenv, "PROTECTED_TAG_KEYS")
+	cfg.ProtectedTagPrefixes = envList(getenv, "PROTECTED_TAG_PREFIXES")
+
+	cfg.EC2Defaults.RetryMode, _ = lookupEnv(getenv, "EC2_RETRY_MODE")
+	if err := envInt(getenv, "EC2_MAX_ATTEMPTS", &cfg.EC2Defaults.MaxAttempts); err != nil {
+		return nil, err
+	}
+	if err := envFloat(getenv, "EC2_TPS", &cfg.EC2Defaults.TPS); err != nil {
+		return nil, err
+	}
+	if err := envInt(getenv, "EC2_BURST", &cfg.EC2Defaults.Burst); err != nil {
+		return nil, err
+	}
+	if err := envJSON(getenv, "EC2_RETRY_POLICY", &cfg.EC2Defaults.RetryPolicy); err != nil {
+		return nil, err
+	}
+	if err := cfg.EC2Defaults.validate(); err != nil {
+		return nil, fmt.Errorf("EC2_MAX_ATTEMPTS/EC2_RETRY_MODE/EC2_TPS/EC2_BURST/EC2_RETRY_POLICY: %w", err)
+	}
+
+	if err := envJSON(getenv, "EC2_REGION_OPTIONS", &cfg.EC2RegionOptions); err != nil {
+		return nil, err
+	}
+	for region, o := range cfg.EC2RegionOptions {
+		if region != "*" && !regionPattern.MatchString(region) {
+			return nil, fmt.Errorf("EC2_REGION_OPTIONS: %q is not a valid AWS region name", region)
+		}
+		if err := o.validate(); err != nil {
+			return nil, fmt.Errorf("EC2_REGION_OPTIONS[%s]: %w", region, err)
+		}
+	}
+
+	if err := envJSON(getenv, "TAGGING_BACKENDS", &cfg.TaggingBackends); err != nil {
+		return nil, err
+	}
+	for kind, backend := range cfg.TaggingBackends {
+		if _, ok := arnResourceTypes[kind]; !ok && kind != "*" {
+			return nil, fmt.Errorf("TAGGING_BACKENDS: unknown resource kind %q", kind)
+		}
+		if backend != backendEC2 && backend != backendTaggingAPI {
+			return nil, fmt.Errorf("TAGGING_BACKENDS[%s]: %q must be %q or %q", kind, backend, backendEC2, backendTaggingAPI)
+		}
+	}
+	cfg.TaggingAccountID = getenv("TAGGING_ACCOUNT_ID")
+	if cfg.TaggingAccountID != "" && !accountIDPattern.MatchString(cfg.TaggingAccountID) {
+		return nil, fmt.Errorf("TAGGING_ACCOUNT_ID: %q is not a 12-digit AWS account ID", cfg.TaggingAccountID)
+	}
+
+	cfg.QuarantineIDs = envList(getenv, "QUARANTINE_IDS")
+	cfg.QuarantineTags = envList(getenv, "QUARANTINE_TAGS")
+	if _, err := newQuarantine(cfg.QuarantineIDs, cfg.QuarantineTags); err != nil {
+		return nil, fmt.Errorf("QUARANTINE_IDS/QUARANTINE_TAGS: %w", err)
+	}
+
+	cfg.AllowedRegions = envList(getenv, "ALLOWED_REGIONS")
+	for _, r := range cfg.AllowedRegions {
+		if !regionPattern.MatchString(r) {
+			return nil, fmt.Errorf("ALLOWED_REGIONS: %q is not a valid AWS region name", r)
+		}
+	}
+
+	cfg.Namespace = podNamespace(getenv)
+
+	if v, ok := lookupEnv(getenv, "CONTROL_CONFIGMAP"); ok {
+		cfg.ControlConfigMap = v
+	}
+
+	cfg.ConfigDriftCheck = getenv("CONFIG_DRIFT_CHECK") == "true"
+	if v, ok := lookupEnv(getenv, "CONFIG_HASH_CONFIGMAP"); ok {
+		cfg.ConfigHashConfigMap = v
+	}
+	if err := envDuration(getenv, "CONFIG_HASH_INTERVAL", &cfg.ConfigHashInterval); err != nil {
+		return nil, err
+	}
+	if cfg.ConfigHashInterval <= 0 {
+		return nil, fmt.Errorf("CONFIG_HASH_INTERVAL must be positive, got %s", cfg.ConfigHashInterval)
+	}
+	cfg.PodName, _ = lookupEnv(getenv, "POD_NAME")
+	if v, ok := lookupEnv(getenv, "METRICS_ADDR"); ok {
+		cfg.MetricsAddr = v
+	}
+	cfg.AdminToken, _ = lookupEnv(getenv, "ADMIN_TOKEN")
+	if path, ok := lookupEnv(getenv, "ADMIN_TOKEN_FILE"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("ADMIN_TOKEN_FILE: %w", err)
+		}
+		cfg.AdminToken = strings.TrimSpace(string(data))
+	}
+	cfg.TagOverrides = getenv("TAG_OVERRIDES") == "true"
+	if v, ok := lookupEnv(getenv, "TAG_OVERRIDES_CONFIGMAP"); ok {
+		cfg.TagOverridesConfigMap = v
+	}
+	cfg.TagOverridesToken, _ = lookupEnv(getenv, "TAG_OVERRIDES_TOKEN")
+	if path, ok := lookupEnv(getenv, "TAG_OVERRIDES_TOKEN_FILE"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("TAG_OVERRIDES_TOKEN_FILE: %w", err)
+		}
+		cfg.TagOverridesToken = strings.TrimSpace(string(data))
+	}
+	if cfg.TagOverrides && cfg.TagOverridesToken == "" {
+		return nil, errors.New("TAG_OVERRIDES requires TAG_OVERRIDES_TOKEN or TAG_OVERRIDES_TOKEN_FILE")
+	}
+	if v, ok := lookupEnv(getenv, "METRICS_CHECKPOINT"); ok {
+		cfg.MetricsCheckpoint = v
+	}
+	if v, ok := lookupEnv(getenv, "METRICS_CHECKPOINT_CONFIGMAP"); ok {
+		cfg.MetricsCheckpointConfigMap = v
+	}
+	if v, ok := lookupEnv(getenv, "METRICS_CHECKPOINT_FILE"); ok {
+		cfg.MetricsCheckpointFile = v
+	}
+	if err := envDuration(getenv, "METRICS_CHECKPOINT_INTERVAL", &cfg.MetricsCheckpointInterval); err != nil {
+		return nil, err
+	}
+	switch cfg.MetricsCheckpoint {
+	case checkpointConfigMap, checkpointOff:
+	case checkpointFile:
+		if cfg.MetricsCheckpointFile == "" {
+			return nil, errors.New("METRICS_CHECKPOINT_FILE is required when METRICS_CHECKPOINT=file")
+		}
+	default:
+		return nil, fmt.Errorf("METRICS_CHECKPOINT must be one of configmap, file, off; got %q", cfg.MetricsCheckpoint)
+	}
+	if cfg.MetricsCheckpointInterval <= 0 {
+		return nil, fmt.Errorf("METRICS_CHECKPOINT_INTERVAL must be positive, got %s", cfg.MetricsCheckpointInterval)
+	}
+	if err := envInt(getenv, "METRICS_MAX_SERIES", &cfg.MetricsMaxSeries); err != nil {
+		return nil, err
+	}
+	if cfg.MetricsMaxSeries < 0 {
+		return nil, fmt.Errorf("METRICS_MAX_SERIES must not be negative, got %d", cfg.MetricsMaxSeries)
+	}
+
+	if v, ok := lookupEnv(getenv, "HEALTH_PROBE_ADDR"); ok {
+		cfg.HealthProbeAddr = v
+	}
+	if err := envDuration(getenv, "LIVENESS_THRESHOLD", &cfg.LivenessThreshold); err != nil {
+		return nil, err
+	}
+	if cfg.LivenessThreshold <= 0 {
+		return nil, fmt.Errorf("LIVENESS_THRESHOLD must be positive, got %s", cfg.LivenessThreshold)
+	}
+	cfg.FailFast = getenv("FAIL_FAST") == "true"
+
+	cfg.TracingEndpoint, _ = lookupEnv(getenv, "OTEL_EXPORTER_OTLP_ENDPOINT")
+	if v, ok := lookupEnv(getenv, "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); ok {
+		cfg.TracingEndpoint = v
+	}
+
+	cfg.LogFormat = logFormatJSON
+	if v, ok := lookupEnv(getenv, "LOG_FORMAT"); ok {
+		cfg.LogFormat = v
+	}
+	if cfg.LogFormat != logFormatJSON && cfg.LogFormat != logFormatText {
+		return nil, fmt.Errorf("LOG_FORMAT must be %q or %q, got %q", logFormatJSON, logFormatText, cfg.LogFormat)
+	}
+	if v, ok := lookupEnv(getenv, "LOG_LEVEL"); ok {
+		if err := cfg.LogLevel.UnmarshalText([]byte(v)); err != nil {
+			return nil, fmt.Errorf("LOG_LEVEL: %w", err)
+		}
+	}
+	levels, err := parseLogLevels(envList(getenv, "LOG_LEVELS"))
+	if err != nil {
+		return nil, fmt.Errorf("LOG_LEVELS: %w", err)
+	}
+	cfg.LogLevels = levels
+	cfg.LogRedactTagKeys = envList(getenv, "LOG_REDACT_TAG_KEYS")
+	if err := envInt(getenv, "LOG_SAMPLE_RATE", &cfg.LogSampleRate); err != nil {
+		return nil, err
+	}
+	if cfg.LogSampleRate < 1 {
+		return nil, fmt.Errorf("LOG_SAMPLE_RATE must be at least 1, got %d", cfg.LogSampleRate)
+	}
+
+	cfg.StartupTaint, _ = lookupEnv(getenv, "STARTUP_TAINT")
+	cfg.TerminationTag, _ = lookupEnv(getenv, "TERMINATION_TAG")
+	cfg.TerminationTimeTag, _ = lookupEnv(getenv, "TERMINATION_TIME_TAG")
+	cfg.TerminationTaints = defaultTerminationTaints
+	if taints := envList(getenv, "TERMINATION_TAINTS"); taints != nil {
+		cfg.TerminationTaints = taints
+	}
+	for _, k := range []struct{ name, key string }{{"TERMINATION_TAG", cfg.TerminationTag}, {"TERMINATION_TIME_TAG", cfg.TerminationTimeTag}} {
+		if k.key == "" {
+			continue
+		}
+		if err := awstags.Validate(map[string]string{k.key: ""}); err != nil {
+			return nil, fmt.Errorf("%s: %w", k.name, err)
+		}
+		if _, ok := cfg.Tags[k.key]; ok {
+			return nil, fmt.Errorf("%s: tag key %q is already set in TAGS", k.name, k.key)
+		}
+	}
+	if cfg.TerminationTag != "" && cfg.TerminationTag == cfg.TerminationTimeTag {
+		return nil, errors.New("TERMINATION_TAG and TERMINATION_TIME_TAG must differ")
+	}
+	cfg.NodeName, _ = lookupEnv(getenv, "NODE_NAME")
+	if err := envDuration(getenv, "TAG_NODE_TIMEOUT", &cfg.TagNodeTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.TagNodeTimeout <= 0 {
+		return nil, fmt.Errorf("TAG_NODE_TIMEOUT must be positive, got %s", cfg.TagNodeTimeout)
+	}
+
+	if v, ok := lookupEnv(getenv, "AUDIT_FORMAT"); ok {
+		cfg.AuditFormat = v
+	}
+	switch cfg.AuditFormat {
+	case auditFormatJSON, auditFormatCSV, auditFormatParquet:
+	default:
+		return nil, fmt.Errorf("AUDIT_FORMAT must be %q, %q or %q, got %q", auditFormatJSON, auditFormatCSV, auditFormatParquet, cfg.AuditFormat)
+	}
+	cfg.AuditOutput, _ = lookupEnv(getenv, "AUDIT_OUTPUT")
+	if err := envDuration(getenv, "AUDIT_INTERVAL", &cfg.AuditInterval); err != nil {
+		return nil, err
+	}
+	if cfg.AuditInterval < 0 {
+		return nil, fmt.Errorf("AUDIT_INTERVAL must not be negative, got %s", cfg.AuditInterval)
+	}
+	cfg.AuditCompress = getenv("AUDIT_COMPRESS") == "true"
+	if err := envInt(getenv, "AUDIT_HISTORY", &cfg.AuditHistory); err != nil {
+		return nil, err
+	}
+	if err := envDuration(getenv, "AUDIT_HISTORY_MAX_AGE", &cfg.AuditHistoryMaxAge); err != nil {
+		return nil, err
+	}
+	if v, ok := lookupEnv(getenv, "AUDIT_HISTORY_MAX_SIZE"); ok {
+		q, err := resource.ParseQuantity(v)
+		if err != nil {
+			return nil, fmt.Errorf("AUDIT_HISTORY_MAX_SIZE: %w", err)
+		}
+		cfg.AuditHistoryMaxSize = q.Value()
+	}
+	switch {
+	case cfg.AuditHistory < 0:
+		return nil, fmt.Errorf("AUDIT_HISTORY must not be negative, got %d", cfg.AuditHistory)
+	case cfg.AuditHistoryMaxAge < 0:
+		return nil, fmt.Errorf("AUDIT_HISTORY_MAX_AGE must not be negative, got %s", cfg.AuditHistoryMaxAge)
+	case cfg.AuditHistoryMaxSize < 0:
+		return nil, fmt.Errorf("AUDIT_HISTORY_MAX_SIZE must not be negative, got %d", cfg.AuditHistoryMaxSize)
+	case cfg.AuditHistory > 0 && (cfg.AuditOutput == "" || cfg.AuditOutput == "-"):
+		return nil, errors.New("AUDIT_HISTORY requires AUDIT_OUTPUT to be a file")
+	}
+	cfg.AuditS3URI, _ = lookupEnv(getenv, "AUDIT_S3_URI")
+	cfg.AuditS3Region, _ = lookupEnv(getenv, "AUDIT_S3_REGION")
+	if cfg.AuditS3URI != "" {
+		if _, _, err := parseS3URI(cfg.AuditS3URI); err != nil {
+			return nil, fmt.Errorf("AUDIT_S3_URI: %w", err)
+		}
+	}
+	if cfg.AuditFormat == auditFormatParquet {
+		switch {
+		case cfg.AuditCompress:
+			return nil, errors.New("AUDIT_COMPRESS cannot be used with AUDIT_FORMAT=parquet, which is compressed internally")
+		case cfg.AuditOutput == "-" || (cfg.AuditOutput == "" && cfg.AuditS3URI == ""):
+			return nil, errors.New("AUDIT_FORMAT=parquet requires AUDIT_OUTPUT to be a file or AUDIT_S3_URI")
+		}
+	}
+
+	cfg.DecisionLog, _ = lookupEnv(getenv, "DECISION_LOG")
+	if v, ok := lookupEnv(getenv, "DECISION_LOG_MAX_SIZE"); ok {
+		q, err := resource.ParseQuantity(v)
+		if err != nil {
+			return nil, fmt.Errorf("DECISION_LOG_MAX_SIZE: %w", err)
+		}
+		cfg.DecisionLogMaxSize = q.Value()
+	}
+	if cfg.DecisionLogMaxSize < 0 {
+		return nil, fmt.Errorf("DECISION_LOG_MAX_SIZE must not be negative, got %d", cfg.DecisionLogMaxSize)
+	}
+
+	if err := envDuration(getenv, "VOLUME_SWEEP_INTERVAL", &cfg.VolumeSweepInterval); err != nil {
+		return nil, err
+	}
+	if cfg.VolumeSweepInterval < 0 {
+		return nil, fmt.Errorf("VOLUME_SWEEP_INTERVAL must not be negative, got %s", cfg.VolumeSweepInterval)
+	}
+	cfg.VolumeSweepTag, _ = lookupEnv(getenv, "VOLUME_SWEEP_TAG")
+	if cfg.VolumeSweepInterval > 0 && (cfg.VolumeSweepTag == "" || strings.HasPrefix(cfg.VolumeSweepTag, "=")) {
+		return nil, errors.New(`VOLUME_SWEEP_TAG is required when VOLUME_SWEEP_INTERVAL is set (e.g. "kubernetes.io/cluster/prod=owned")`)
+	}
+	cfg.VolumeSweepRegions = envList(getenv, "VOLUME_SWEEP_REGIONS")
+	for _, r := range cfg.VolumeSweepRegions {
+		if !regionPattern.MatchString(r) {
+			return nil, fmt.Errorf("VOLUME_SWEEP_REGIONS: %q is not a valid AWS region name", r)
+		}
+	}
+	if err := envInt(getenv, "VOLUME_SWEEP_PAGE_SIZE", &cfg.VolumeSweepPageSize); err != nil {
+		return nil, err
+	}
+	if cfg.VolumeSweepPageSize < 5 || cfg.VolumeSweepPageSize > 500 {
+		return nil, fmt.Errorf("VOLUME_SWEEP_PAGE_SIZE must be between 5 and 500, got %d", cfg.VolumeSweepPageSize)
+	}
+	if v, ok := lookupEnv(getenv, "VOLUME_SWEEP_CONFIGMAP"); ok {
+		cfg.VolumeSweepConfigMap = v
+	}
+
+	if err := envDuration(getenv, "SNAPSHOT_TAG_INTERVAL", &cfg.SnapshotTagInterval); err != nil {
+		return nil, err
+	}
+	if cfg.SnapshotTagInterval < 0 {
+		return nil, fmt.Errorf("SNAPSHOT_TAG_INTERVAL must not be negative, got %s", cfg.SnapshotTagInterval)
+	}
+	cfg.SnapshotTagRegions = envList(getenv, "SNAPSHOT_TAG_REGIONS")
+	for _, r := range cfg.SnapshotTagRegions {
+		if !regionPattern.MatchString(r) {
+			return nil, fmt.Errorf("SNAPSHOT_TAG_REGIONS: %q is not a valid AWS region name", r)
+		}
+	}
+	if err := envFloat(getenv, "SNAPSHOT_TAG_TPS", &cfg.SnapshotTagTPS); err != nil {
+		return nil, err
+	}
+	if cfg.SnapshotTagTPS <= 0 {
+		return nil, fmt.Errorf("SNAPSHOT_TAG_TPS must be positive, got %g", cfg.SnapshotTagTPS)
+	}
+
+	if err := envInt(getenv, "EVENT_BURST", &cfg.EventBurst); err != nil {
+		return nil, err
+	}
+	if cfg.EventBurst < 1 {
+		return nil, fmt.Errorf("EVENT_BURST must be at least 1, got %d", cfg.EventBurst)
+	}
+	if err := envFloat(getenv, "EVENT_QPS", &cfg.EventQPS); err != nil {
+		return nil, err
+	}
+	if cfg.EventQPS <= 0 {
+		return nil, fmt.Errorf("EVENT_QPS must be positive, got %g", cfg.EventQPS)
+	}
+
+	cfg.NotifySNSTopicARN, _ = lookupEnv(getenv, "NOTIFY_SNS_TOPIC_ARN")
+	if cfg.NotifySNSTopicARN != "" {
+		if _, err := snsTopicRegion(cfg.NotifySNSTopicARN); err != nil {
+			return nil, fmt.Errorf("NOTIFY_SNS_TOPIC_ARN: %w", err)
+		}
+	}
+	cfg.NotifyWebhookURL, _ = lookupEnv(getenv, "NOTIFY_WEBHOOK_URL")
+	if path, ok := lookupEnv(getenv, "NOTIFY_WEBHOOK_URL_FILE"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("NOTIFY_WEBHOOK_URL_FILE: %w", err)
+		}
+		cfg.NotifyWebhookURL = strings.TrimSpace(string(data))
+	}
+	// The URL often embeds a secret token; keep it out of the error.
+	if cfg.NotifyWebhookURL != "" && !isHTTPURL(cfg.NotifyWebhookURL) {
+		return nil, errors.New("NOTIFY_WEBHOOK_URL must be an http or https URL")
+	}
+	if err := envInt(getenv, "NOTIFY_NODE_FAILURES", &cfg.NotifyNodeFailures); err != nil {
+		return nil, err
+	}
+	if cfg.NotifyNodeFailures < 1 {
+		return nil, fmt.Errorf("NOTIFY_NODE_FAILURES must be at least 1, got %d", cfg.NotifyNodeFailures)
+	}
+	if err := envFloat(getenv, "NOTIFY_FAILURE_RATE", &cfg.NotifyFailureRate); err != nil {
+		return nil, err
+	}
+	if cfg.NotifyFailureRate < 0 || cfg.NotifyFailureRate > 1 {
+		return nil, fmt.Errorf("NOTIFY_FAILURE_RATE must be between 0 and 1, got %g", cfg.NotifyFailureRate)
+	}
+	if err := envDuration(getenv, "NOTIFY_FAILURE_WINDOW", &cfg.NotifyFailureWindow); err != nil {
+		return nil, err
+	}
+	if cfg.NotifyFailureWindow <= 0 {
+		return nil, fmt.Errorf("NOTIFY_FAILURE_WINDOW must be positive, got %s", cfg.NotifyFailureWindow)
+	}
+
+	cfg.HeartbeatURL, _ = lookupEnv(getenv, "HEARTBEAT_URL")
+	if path, ok := lookupEnv(getenv, "HEARTBEAT_URL_FILE"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("HEARTBEAT_URL_FILE: %w", err)
+		}
+		cfg.HeartbeatURL = strings.TrimSpace(string(data))
+	}
+	if cfg.HeartbeatURL != "" && !isHTTPURL(cfg.HeartbeatURL) {
+		return nil, errors.New("HEARTBEAT_URL must be an http or https URL")
+	}
+	if err := envDuration(getenv, "HEARTBEAT_INTERVAL", &cfg.HeartbeatInterval); err != nil {
+		return nil, err
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		return nil, fmt.Errorf("HEARTBEAT_INTERVAL must be positive, got %s", cfg.HeartbeatInterval)
+	}
+
+	cfg.AWSConfigResultTokenFile, _ = lookupEnv(getenv, "AWS_CONFIG_RESULT_TOKEN_FILE")
+	cfg.AWSConfigRegion, _ = lookupEnv(getenv, "AWS_CONFIG_REGION")
+	if cfg.AWSConfigRegion != "" && !regionPattern.MatchString(cfg.AWSConfigRegion) {
+		return nil, fmt.Errorf("AWS_CONFIG_REGION: %q is not a valid AWS region name", cfg.AWSConfigRegion)
+	}
+	cfg.AWSConfigTestMode = getenv("AWS_CONFIG_TEST_MODE") == "true"
+
+	if v, ok := lookupEnv(getenv, "MIGRATE_LEGACY_ANNOTATIONS"); ok {
+		cfg.MigrateLegacyAnnotations = v == "true"
+	}
+	cfg.LegacyAnnotations = envList(getenv, "LEGACY_ANNOTATIONS")
+	if _, err := parseLegacyAnnotations(cfg.LegacyAnnotations); err != nil {
+		return nil, fmt.Errorf("LEGACY_ANNOTATIONS: %w", err)
+	}
+
+	if err := envInt(getenv, "WORKERS", &cfg.Workers); err != nil {
+		return nil, err
+	}
+	if cfg.Workers < 1 {
+		return nil, fmt.Errorf("WORKERS must be at least 1, got %d", cfg.Workers)
+	}
+	if err := envDuration(getenv, "NODE_RECONCILE_TIMEOUT", &cfg.NodeReconcileTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.NodeReconcileTimeout < 0 {
+		return nil, fmt.Errorf("NODE_RECONCILE_TIMEOUT must not be negative, got %s", cfg.NodeReconcileTimeout)
+	}
+	if err := envDuration(getenv, "SHUTDOWN_GRACE_PERIOD", &cfg.ShutdownGracePeriod); err != nil {
+		return nil, err
+	}
+	if cfg.ShutdownGracePeriod < 0 {
+		return nil, fmt.Errorf("SHUTDOWN_GRACE_PERIOD must not be negative, got %s", cfg.ShutdownGracePeriod)
+	}
+
+	return cfg, nil
+}
+
+// isHTTPURL reports whether raw is an absolute http or https URL.
+func isHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// lookupEnv returns the trimmed value of an environment variable and whether it was set.
+func lookupEnv(getenv func(string) string, name string) (string, bool) {
+	v := strings.TrimSpace(getenv(name))
+	return v, v != ""
+}
+
+// envList splits a comma-separated variable into its non-empty, trimmed elements.
+func envList(getenv func(string) string, name string) []string {
+	v, ok := lookupEnv(getenv, name)
+	if !ok {
+		return nil
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// envJSON decodes a JSON-valued variable into dst when the variable is set.
+func envJSON(getenv func(string) string, name string, dst any) error {
+	v, ok := lookupEnv(getenv, name)
+	if !ok {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(v), dst); err != nil {
+		return fmt.Errorf("failed to parse %s %q: %w", name, v, err)
+	}
+	return nil
+}
+
+// envInt parses an integer into dst when the variable is set.
+func envInt(getenv func(string) string, name string, dst *int) error {
+	v, ok := lookupEnv(getenv, name)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, v, err)
+	}
+	*dst = n
+	return nil
+}
+
+// envFloat parses a decimal number into dst when the variable is set.
+func envFloat(getenv func(string) string, name string, dst *float64) error {
+	v, ok := lookupEnv(getenv, name)
+	if !ok {
+		return nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, v, err)
+	}
+	*dst = f
+	return nil
+}
+
+// envDuration parses a Go duration (e.g. "90s") into dst when the variable is set.
+func envDuration(getenv func(string) string, name string, dst *time.Duration) error {
+	v, ok := lookupEnv(getenv, name)
+	if !ok {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, v, err)
+	}
+	*dst = d
+	return nil
+}
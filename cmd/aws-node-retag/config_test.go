@@ -0,0 +1,834 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+)
+
+func envMap(m map[string]string) func(string) string {
+	return func(k string) string { return m[k] }
+}
+
+func TestLoadConfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		env     map[string]string
+		check   func(t *testing.T, cfg *Config)
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			env:  map[string]string{"TAGS": `{"Environment":"production"}`},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Tags["Environment"] != "production" {
+					t.Errorf("Tags = %v", cfg.Tags)
+				}
+				if cfg.DryRun {
+					t.Error("DryRun should default to false")
+				}
+				if cfg.HealthProbeAddr != ":8081" {
+					t.Errorf("HealthProbeAddr = %q, want :8081", cfg.HealthProbeAddr)
+				}
+				if cfg.LivenessThreshold != 5*time.Minute {
+					t.Errorf("LivenessThreshold = %s, want 5m", cfg.LivenessThreshold)
+				}
+			},
+		},
+		{
+			name: "overrides",
+			env: map[string]string{
+				"TAGS":               `{"Team":"platform"}`,
+				"DRY_RUN":            "true",
+				"HEALTH_PROBE_ADDR":  ":9090",
+				"LIVENESS_THRESHOLD": "90s",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if !cfg.DryRun {
+					t.Error("DryRun should be true")
+				}
+				if cfg.HealthProbeAddr != ":9090" {
+					t.Errorf("HealthProbeAddr = %q, want :9090", cfg.HealthProbeAddr)
+				}
+				if cfg.LivenessThreshold != 90*time.Second {
+					t.Errorf("LivenessThreshold = %s, want 90s", cfg.LivenessThreshold)
+				}
+			},
+		},
+		{
+			name: "allowed regions",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "ALLOWED_REGIONS": " us-east-1, eu-west-1 ,,"},
+			check: func(t *testing.T, cfg *Config) {
+				if len(cfg.AllowedRegions) != 2 || cfg.AllowedRegions[0] != "us-east-1" || cfg.AllowedRegions[1] != "eu-west-1" {
+					t.Errorf("AllowedRegions = %q", cfg.AllowedRegions)
+				}
+			},
+		},
+		{
+			name: "ec2 retry and rate defaults",
+			env: map[string]string{
+				"TAGS":             `{"a":"b"}`,
+				"EC2_MAX_ATTEMPTS": "8",
+				"EC2_RETRY_MODE":   "adaptive",
+				"EC2_TPS":          "2.5",
+				"EC2_BURST":        "5",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				want := regionOptions{MaxAttempts: 8, RetryMode: retryModeAdaptive, TPS: 2.5, Burst: 5}
+				if cfg.EC2Defaults != want {
+					t.Errorf("EC2Defaults = %+v, want %+v", cfg.EC2Defaults, want)
+				}
+			},
+		},
+		{
+			name: "read-only",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "READ_ONLY": "true"},
+			check: func(t *testing.T, cfg *Config) {
+				if !cfg.ReadOnly || cfg.DryRun {
+					t.Errorf("ReadOnly = %v, DryRun = %v", cfg.ReadOnly, cfg.DryRun)
+				}
+			},
+		},
+		{
+			name: "shared instances",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "SHARED_INSTANCES": "true", "CLUSTER_TAG_PREFIX": "prod-a/"},
+			check: func(t *testing.T, cfg *Config) {
+				if !cfg.SharedInstances || cfg.ClusterTagPrefix != "prod-a/" {
+					t.Errorf("SharedInstances = %v, ClusterTagPrefix = %q", cfg.SharedInstances, cfg.ClusterTagPrefix)
+				}
+			},
+		},
+		{
+			name:    "shared instances without prefix",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "SHARED_INSTANCES": "true"},
+			wantErr: true,
+		},
+		{
+			name:    "shared instances with overwrite keys",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "SHARED_INSTANCES": "true", "CLUSTER_TAG_PREFIX": "a/", "PRESERVE_OVERWRITE_KEYS": "*"},
+			wantErr: true,
+		},
+		{
+			name:    "reserved cluster tag prefix",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "CLUSTER_TAG_PREFIX": "AWS:team/"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid ec2 tps",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "EC2_TPS": "-1"},
+			wantErr: true,
+		},
+		{
+			name:    "missing tags",
+			env:     map[string]string{},
+			wantErr: true,
+		},
+		{
+			name: "tag policies without tags",
+			env:  map[string]string{"TAG_POLICIES": "true"},
+			check: func(t *testing.T, cfg *Config) {
+				if !cfg.TagPolicies || len(cfg.Tags) != 0 {
+					t.Errorf("TagPolicies = %v, Tags = %v", cfg.TagPolicies, cfg.Tags)
+				}
+			},
+		},
+		{
+			name: "tag-node settings",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "STARTUP_TAINT": "aws-node-retag.io/untagged", "NODE_NAME": "n1", "TAG_NODE_TIMEOUT": "30s"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.StartupTaint != "aws-node-retag.io/untagged" || cfg.NodeName != "n1" || cfg.TagNodeTimeout != 30*time.Second {
+					t.Errorf("StartupTaint = %q, NodeName = %q, TagNodeTimeout = %s", cfg.StartupTaint, cfg.NodeName, cfg.TagNodeTimeout)
+				}
+			},
+		},
+		{
+			name:    "non-positive tag-node timeout",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "TAG_NODE_TIMEOUT": "0s"},
+			wantErr: true,
+		},
+		{
+			name: "config drift settings",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "CONFIG_DRIFT_CHECK": "true", "POD_NAME": "retag-0", "CONFIG_HASH_INTERVAL": "30s"},
+			check: func(t *testing.T, cfg *Config) {
+				if !cfg.ConfigDriftCheck || cfg.PodName != "retag-0" || cfg.ConfigHashInterval != 30*time.Second || cfg.ConfigHashConfigMap != "aws-node-retag-config-hashes" {
+					t.Errorf("ConfigDriftCheck = %v, PodName = %q, ConfigHashInterval = %s, ConfigHashConfigMap = %q",
+						cfg.ConfigDriftCheck, cfg.PodName, cfg.ConfigHashInterval, cfg.ConfigHashConfigMap)
+				}
+			},
+		},
+		{
+			name:    "unknown audit format",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "AUDIT_FORMAT": "xml"},
+			wantErr: true,
+		},
+		{
+			name:    "volume sweep without ownership tag",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "VOLUME_SWEEP_INTERVAL": "24h"},
+			wantErr: true,
+		},
+		{
+			name:    "volume sweep page size too large",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "VOLUME_SWEEP_PAGE_SIZE": "1000"},
+			wantErr: true,
+		},
+		{
+			name: "snapshot tagging settings",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "SNAPSHOT_TAG_INTERVAL": "6h", "SNAPSHOT_TAG_REGIONS": "us-east-1,eu-west-1", "SNAPSHOT_TAG_TPS": "0.5"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.SnapshotTagInterval != 6*time.Hour || len(cfg.SnapshotTagRegions) != 2 || cfg.SnapshotTagTPS != 0.5 {
+					t.Errorf("SnapshotTagInterval = %s, SnapshotTagRegions = %v, SnapshotTagTPS = %g",
+						cfg.SnapshotTagInterval, cfg.SnapshotTagRegions, cfg.SnapshotTagTPS)
+				}
+			},
+		},
+		{
+			name:    "non-positive snapshot tagging rate",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "SNAPSHOT_TAG_TPS": "0"},
+			wantErr: true,
+		},
+		{
+			name: "event rate limits",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "EVENT_BURST": "5", "EVENT_QPS": "0.1"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.EventBurst != 5 || cfg.EventQPS != 0.1 {
+					t.Errorf("EventBurst = %d, EventQPS = %g", cfg.EventBurst, cfg.EventQPS)
+				}
+			},
+		},
+		{
+			name: "notifications",
+			env: map[string]string{
+				"TAGS":                  `{"a":"b"}`,
+				"NOTIFY_SNS_TOPIC_ARN":  "arn:aws:sns:eu-west-1:123456789012:tagging-alerts",
+				"NOTIFY_WEBHOOK_URL":    "https://hooks.slack.com/services/T0/B0/secret",
+				"NOTIFY_NODE_FAILURES":  "3",
+				"NOTIFY_FAILURE_RATE":   "0.5",
+				"NOTIFY_FAILURE_WINDOW": "10m",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.NotifySNSTopicARN == "" || cfg.NotifyWebhookURL == "" {
+					t.Errorf("NotifySNSTopicARN = %q, NotifyWebhookURL = %q", cfg.NotifySNSTopicARN, cfg.NotifyWebhookURL)
+				}
+				if cfg.NotifyNodeFailures != 3 || cfg.NotifyFailureRate != 0.5 || cfg.NotifyFailureWindow != 10*time.Minute {
+					t.Errorf("NotifyNodeFailures = %d, NotifyFailureRate = %g, NotifyFailureWindow = %s", cfg.NotifyNodeFailures, cfg.NotifyFailureRate, cfg.NotifyFailureWindow)
+				}
+			},
+		},
+		{
+			name: "legacy annotations",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "LEGACY_ANNOTATIONS": "old.example.com/tagged, aws-node-retag.io/tagged=yes", "MIGRATE_LEGACY_ANNOTATIONS": "false"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.MigrateLegacyAnnotations || len(cfg.LegacyAnnotations) != 2 {
+					t.Errorf("MigrateLegacyAnnotations = %v, LegacyAnnotations = %v", cfg.MigrateLegacyAnnotations, cfg.LegacyAnnotations)
+				}
+			},
+		},
+		{
+			name:    "invalid legacy annotation key",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "LEGACY_ANNOTATIONS": "bad key"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid SNS topic ARN",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "NOTIFY_SNS_TOPIC_ARN": "tagging-alerts"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid webhook URL",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "NOTIFY_WEBHOOK_URL": "hooks.example.com/secret"},
+			wantErr: true,
+		},
+		{
+			name: "providerID fallback disabled",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "PROVIDER_ID_FALLBACK": "false"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.ProviderIDFallback {
+					t.Error("ProviderIDFallback = true, want false")
+				}
+			},
+		},
+		{
+			name: "volume discovery",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "VOLUME_DISCOVERY": "bulk", "VOLUME_DISCOVERY_BULK_THRESHOLD": "50"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.VolumeDiscovery != discoveryBulk || cfg.VolumeDiscoveryBulkThreshold != 50 {
+					t.Errorf("VolumeDiscovery = %q, VolumeDiscoveryBulkThreshold = %d", cfg.VolumeDiscovery, cfg.VolumeDiscoveryBulkThreshold)
+				}
+			},
+		},
+		{
+			name: "volume cache",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "VOLUME_CACHE": "true"},
+			check: func(t *testing.T, cfg *Config) {
+				if !cfg.VolumeCache || !cfg.identityVariables()[varClusterName] {
+					t.Errorf("VolumeCache = %v, identity variables = %v; want the cluster name discovered", cfg.VolumeCache, cfg.identityVariables())
+				}
+			},
+		},
+		{
+			name:    "invalid volume discovery",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "VOLUME_DISCOVERY": "scan"},
+			wantErr: true,
+		},
+		{
+			name:    "volume discovery threshold too low",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "VOLUME_DISCOVERY_BULK_THRESHOLD": "1"},
+			wantErr: true,
+		},
+		{
+			name: "policy conflict resolution",
+			env:  map[string]string{"TAG_POLICIES": "true", "POLICY_CONFLICT_RESOLUTION": "skip"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.PolicyConflictResolution != resolveSkip {
+					t.Errorf("PolicyConflictResolution = %q, want skip", cfg.PolicyConflictResolution)
+				}
+			},
+		},
+		{
+			name:    "invalid policy conflict resolution",
+			env:     map[string]string{"TAG_POLICIES": "true", "POLICY_CONFLICT_RESOLUTION": "oldest"},
+			wantErr: true,
+		},
+		{
+			name: "tag dedup window",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "TAG_DEDUP_WINDOW": "0s"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.TagDedupWindow != 0 {
+					t.Errorf("TagDedupWindow = %s, want 0s", cfg.TagDedupWindow)
+				}
+			},
+		},
+		{
+			name:    "negative tag dedup window",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "TAG_DEDUP_WINDOW": "-1m"},
+			wantErr: true,
+		},
+		{
+			name: "clusters",
+			env: map[string]string{"TAGS": `{"Team":"platform"}`, "CLUSTERS": `[
+				{"name":"spoke-a","context":"spoke-a","tags":{"Environment":"staging"},"roleArn":"arn:aws:iam::111122223333:role/retag"},
+				{"name":"spoke-b","kubeconfig":"/etc/clusters/spoke-b"}]`},
+			check: func(t *testing.T, cfg *Config) {
+				if len(cfg.Clusters) != 2 || cfg.Clusters[0].Tags["Environment"] != "staging" || cfg.Clusters[1].Kubeconfig != "/etc/clusters/spoke-b" {
+					t.Errorf("Clusters = %+v", cfg.Clusters)
+				}
+			},
+		},
+		{
+			name:    "cluster without kubeconfig or context",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "CLUSTERS": `[{"name":"spoke"}]`},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate cluster name",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "CLUSTERS": `[{"name":"spoke","context":"a"},{"name":"spoke","context":"b"}]`},
+			wantErr: true,
+		},
+		{
+			name:    "cluster named like the local cluster",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "CLUSTER_NAME": "hub", "CLUSTERS": `[{"name":"hub","context":"hub"}]`},
+			wantErr: true,
+		},
+		{
+			name:    "invalid cluster name",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "CLUSTERS": `[{"name":"Spoke A","context":"a"}]`},
+			wantErr: true,
+		},
+		{
+			name:    "invalid cluster role ARN",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "CLUSTERS": `[{"name":"spoke","context":"a","roleArn":"retag"}]`},
+			wantErr: true,
+		},
+		{
+			name:    "invalid cluster tags",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "CLUSTERS": `[{"name":"spoke","context":"a","tags":{"aws:owner":"x"}}]`},
+			wantErr: true,
+		},
+		{
+			name:    "unknown template variable in cluster tags",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "CLUSTERS": `[{"name":"spoke","context":"a","tags":{"Region":"${region}"}}]`},
+			wantErr: true,
+		},
+		{
+			name: "ASG tag keys",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "ASG_TAG_KEYS": "Team, CostCenter"},
+			check: func(t *testing.T, cfg *Config) {
+				if len(cfg.ASGTagKeys) != 2 || cfg.ASGTagKeys[0] != "Team" || cfg.ASGTagKeys[1] != "CostCenter" {
+					t.Errorf("ASGTagKeys = %v", cfg.ASGTagKeys)
+				}
+			},
+		},
+		{
+			name:    "reserved ASG tag key",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "ASG_TAG_KEYS": "aws:autoscaling:groupName"},
+			wantErr: true,
+		},
+		{
+			name: "heartbeat",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "HEARTBEAT_URL": "https://hc-ping.com/uuid", "HEARTBEAT_INTERVAL": "1m"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.HeartbeatURL != "https://hc-ping.com/uuid" || cfg.HeartbeatInterval != time.Minute {
+					t.Errorf("HeartbeatURL = %q, HeartbeatInterval = %s", cfg.HeartbeatURL, cfg.HeartbeatInterval)
+				}
+			},
+		},
+		{
+			name:    "invalid heartbeat URL",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "HEARTBEAT_URL": "hc-ping.com/uuid"},
+			wantErr: true,
+		},
+		{
+			name:    "zero heartbeat interval",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "HEARTBEAT_INTERVAL": "0s"},
+			wantErr: true,
+		},
+		{
+			name: "aws config rule",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "AWS_CONFIG_RESULT_TOKEN_FILE": "/run/config/token", "AWS_CONFIG_REGION": "eu-west-1", "AWS_CONFIG_TEST_MODE": "true"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.AWSConfigResultTokenFile != "/run/config/token" || cfg.AWSConfigRegion != "eu-west-1" || !cfg.AWSConfigTestMode {
+					t.Errorf("AWSConfigResultTokenFile = %q, AWSConfigRegion = %q, AWSConfigTestMode = %v",
+						cfg.AWSConfigResultTokenFile, cfg.AWSConfigRegion, cfg.AWSConfigTestMode)
+				}
+			},
+		},
+		{
+			name:    "invalid aws config region",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "AWS_CONFIG_REGION": "eu-west"},
+			wantErr: true,
+		},
+		{
+			name: "node inventory tags",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "NODE_INVENTORY_TAGS": `{"OSFamily":"node/os-family","KubeletVersion":"node/kubelet"}`},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.NodeInventoryTags["OSFamily"] != "node/os-family" || len(cfg.NodeInventoryTags) != 2 {
+					t.Errorf("NodeInventoryTags = %v", cfg.NodeInventoryTags)
+				}
+			},
+		},
+		{
+			name:    "unsupported node inventory attribute",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "NODE_INVENTORY_TAGS": `{"BootID":"boot"}`},
+			wantErr: true,
+		},
+		{
+			name: "termination tags",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "TERMINATION_TAG": "Terminating", "TERMINATION_TIME_TAG": "TerminatingAt"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.TerminationTag != "Terminating" || cfg.TerminationTimeTag != "TerminatingAt" || !slices.Equal(cfg.TerminationTaints, defaultTerminationTaints) {
+					t.Errorf("TerminationTag = %q, TerminationTimeTag = %q, TerminationTaints = %v", cfg.TerminationTag, cfg.TerminationTimeTag, cfg.TerminationTaints)
+				}
+			},
+		},
+		{
+			name:    "termination tag set in TAGS",
+			env:     map[string]string{"TAGS": `{"Terminating":"false"}`, "TERMINATION_TAG": "Terminating"},
+			wantErr: true,
+		},
+		{
+			name:    "reserved termination time tag",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "TERMINATION_TIME_TAG": "aws:terminating"},
+			wantErr: true,
+		},
+		{
+			name: "tag TTL ConfigMap",
+			env:  map[string]string{"TAG_POLICIES": "true", "TAG_TTL_CONFIGMAP": "ttl"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.TagTTLConfigMap != "ttl" {
+					t.Errorf("TagTTLConfigMap = %q, want ttl", cfg.TagTTLConfigMap)
+				}
+			},
+		},
+		{
+			name: "config migration",
+			env:  map[string]string{"TAG_POLICIES": "true", "CONFIG_MIGRATION": "true", "CONFIG_AUTHORITY": "crd"},
+			check: func(t *testing.T, cfg *Config) {
+				if !cfg.ConfigMigration || cfg.ConfigAuthority != authorityCRD {
+					t.Errorf("ConfigMigration = %v, ConfigAuthority = %q", cfg.ConfigMigration, cfg.ConfigAuthority)
+				}
+			},
+		},
+		{
+			name: "config authority defaults to env",
+			env:  map[string]string{"TAGS": `{"a":"b"}`},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.ConfigAuthority != authorityEnv {
+					t.Errorf("ConfigAuthority = %q, want env", cfg.ConfigAuthority)
+				}
+			},
+		},
+		{
+			name:    "crd authority without TagPolicies",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "CONFIG_AUTHORITY": "crd"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid config authority",
+			env:     map[string]string{"TAG_POLICIES": "true", "CONFIG_AUTHORITY": "both"},
+			wantErr: true,
+		},
+		{
+			name:    "config migration without TagPolicies",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "CONFIG_MIGRATION": "true"},
+			wantErr: true,
+		},
+		{
+			name: "fail fast",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "FAIL_FAST": "true"},
+			check: func(t *testing.T, cfg *Config) {
+				if !cfg.FailFast {
+					t.Error("FailFast should be true")
+				}
+			},
+		},
+		{
+			name: "tag overrides",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "TAG_OVERRIDES": "true", "TAG_OVERRIDES_TOKEN": "s3cret"},
+			check: func(t *testing.T, cfg *Config) {
+				if !cfg.TagOverrides || cfg.TagOverridesToken != "s3cret" || cfg.TagOverridesConfigMap != "aws-node-retag-tag-overrides" {
+					t.Errorf("TagOverrides = %v, TagOverridesToken = %q, TagOverridesConfigMap = %q",
+						cfg.TagOverrides, cfg.TagOverridesToken, cfg.TagOverridesConfigMap)
+				}
+			},
+		},
+		{
+			name:    "tag overrides without a token",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "TAG_OVERRIDES": "true"},
+			wantErr: true,
+		},
+		{
+			name: "tagging backends",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "TAGGING_BACKENDS": `{"elastic-ip":"resourcegroupstaggingapi","*":"ec2"}`, "TAGGING_ACCOUNT_ID": "123456789012"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.TaggingBackends["elastic-ip"] != backendTaggingAPI || cfg.TaggingAccountID != "123456789012" {
+					t.Errorf("TaggingBackends = %v, TaggingAccountID = %q", cfg.TaggingBackends, cfg.TaggingAccountID)
+				}
+			},
+		},
+		{
+			name:    "unknown tagging backend",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "TAGGING_BACKENDS": `{"volume":"tagging"}`},
+			wantErr: true,
+		},
+		{
+			name:    "tagging backend for an unknown resource kind",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "TAGGING_BACKENDS": `{"subnet":"ec2"}`},
+			wantErr: true,
+		},
+		{
+			name:    "invalid tagging account ID",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "TAGGING_ACCOUNT_ID": "12345"},
+			wantErr: true,
+		},
+		{
+			name: "audit history",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "AUDIT_OUTPUT": "/reports/drift.json.gz", "AUDIT_COMPRESS": "true", "AUDIT_HISTORY": "7", "AUDIT_HISTORY_MAX_AGE": "720h", "AUDIT_HISTORY_MAX_SIZE": "500Mi"},
+			check: func(t *testing.T, cfg *Config) {
+				if !cfg.AuditCompress || cfg.AuditHistory != 7 || cfg.AuditHistoryMaxAge != 720*time.Hour || cfg.AuditHistoryMaxSize != 500<<20 {
+					t.Errorf("AuditCompress = %v, AuditHistory = %d, AuditHistoryMaxAge = %s, AuditHistoryMaxSize = %d",
+						cfg.AuditCompress, cfg.AuditHistory, cfg.AuditHistoryMaxAge, cfg.AuditHistoryMaxSize)
+				}
+			},
+		},
+		{
+			name:    "audit history to stdout",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "AUDIT_HISTORY": "3"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid audit history size",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "AUDIT_OUTPUT": "/reports/drift.json", "AUDIT_HISTORY_MAX_SIZE": "lots"},
+			wantErr: true,
+		},
+		{
+			name: "parquet audit uploaded to S3",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "AUDIT_FORMAT": "parquet", "AUDIT_S3_URI": "s3://reports/drift", "AUDIT_S3_REGION": "eu-west-1"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.AuditFormat != auditFormatParquet || cfg.AuditS3URI != "s3://reports/drift" || cfg.AuditS3Region != "eu-west-1" {
+					t.Errorf("AuditFormat = %q, AuditS3URI = %q, AuditS3Region = %q", cfg.AuditFormat, cfg.AuditS3URI, cfg.AuditS3Region)
+				}
+			},
+		},
+		{
+			name:    "parquet audit to stdout",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "AUDIT_FORMAT": "parquet", "AUDIT_OUTPUT": "-"},
+			wantErr: true,
+		},
+		{
+			name:    "compressed parquet audit",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "AUDIT_FORMAT": "parquet", "AUDIT_OUTPUT": "/reports/drift.parquet", "AUDIT_COMPRESS": "true"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid audit S3 URI",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "AUDIT_S3_URI": "reports/drift"},
+			wantErr: true,
+		},
+		{
+			name: "rollout aware",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "ROLLOUT_AWARE": "true", "ROLLOUT_MAX_DURATION": "30m"},
+			check: func(t *testing.T, cfg *Config) {
+				if !cfg.RolloutAware || cfg.RolloutMaxDuration != 30*time.Minute {
+					t.Errorf("RolloutAware = %v, RolloutMaxDuration = %s", cfg.RolloutAware, cfg.RolloutMaxDuration)
+				}
+			},
+		},
+		{
+			name:    "negative rollout max duration",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "ROLLOUT_MAX_DURATION": "-1h"},
+			wantErr: true,
+		},
+		{
+			name: "crd install disabled",
+			env:  map[string]string{"TAG_POLICIES": "true", "INSTALL_CRDS": "false"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.InstallCRDs {
+					t.Error("InstallCRDs with INSTALL_CRDS=false")
+				}
+			},
+		},
+		{
+			name: "log sampling",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "LOG_SAMPLE_RATE": "100"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.LogSampleRate != 100 {
+					t.Errorf("LogSampleRate = %d, want 100", cfg.LogSampleRate)
+				}
+			},
+		},
+		{
+			name: "node reconcile timeout",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "NODE_RECONCILE_TIMEOUT": "30s"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.NodeReconcileTimeout != 30*time.Second {
+					t.Errorf("NodeReconcileTimeout = %s, want 30s", cfg.NodeReconcileTimeout)
+				}
+			},
+		},
+		{
+			name: "decision log",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "DECISION_LOG": "/var/log/decisions.jsonl", "DECISION_LOG_MAX_SIZE": "1Gi"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.DecisionLog != "/var/log/decisions.jsonl" || cfg.DecisionLogMaxSize != 1<<30 {
+					t.Errorf("DecisionLog = %q, DecisionLogMaxSize = %d", cfg.DecisionLog, cfg.DecisionLogMaxSize)
+				}
+			},
+		},
+		{
+			name:    "invalid decision log size",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "DECISION_LOG_MAX_SIZE": "-1"},
+			wantErr: true,
+		},
+		{
+			name: "logging",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "LOG_FORMAT": "text", "LOG_LEVEL": "warn", "LOG_LEVELS": "aws=debug", "LOG_REDACT_TAG_KEYS": "Secret"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.LogFormat != logFormatText || cfg.LogLevel != slog.LevelWarn || cfg.LogLevels[logComponentAWS] != slog.LevelDebug {
+					t.Errorf("LogFormat = %q, LogLevel = %s, LogLevels = %v", cfg.LogFormat, cfg.LogLevel, cfg.LogLevels)
+				}
+				if len(cfg.LogRedactTagKeys) != 1 || cfg.LogRedactTagKeys[0] != "Secret" {
+					t.Errorf("LogRedactTagKeys = %v", cfg.LogRedactTagKeys)
+				}
+			},
+		},
+		{
+			name:    "invalid log format",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "LOG_FORMAT": "xml"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid log level",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "LOG_LEVEL": "loud"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown log component",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "LOG_LEVELS": "ec2=debug"},
+			wantErr: true,
+		},
+		{
+			name: "protected tag keys",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "PROTECTED_TAG_KEYS": "Name", "PROTECTED_TAG_PREFIXES": "kubernetes.io/cluster/, aws:"},
+			check: func(t *testing.T, cfg *Config) {
+				if len(cfg.ProtectedTagKeys) != 1 || cfg.ProtectedTagKeys[0] != "Name" {
+					t.Errorf("ProtectedTagKeys = %v", cfg.ProtectedTagKeys)
+				}
+				if len(cfg.ProtectedTagPrefixes) != 2 || cfg.ProtectedTagPrefixes[0] != "kubernetes.io/cluster/" || cfg.ProtectedTagPrefixes[1] != "aws:" {
+					t.Errorf("ProtectedTagPrefixes = %v", cfg.ProtectedTagPrefixes)
+				}
+			},
+		},
+		{
+			name: "metrics max series",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "METRICS_MAX_SERIES": "50"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.MetricsMaxSeries != 50 {
+					t.Errorf("MetricsMaxSeries = %d, want 50", cfg.MetricsMaxSeries)
+				}
+			},
+		},
+		{
+			name:    "negative metrics max series",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "METRICS_MAX_SERIES": "-1"},
+			wantErr: true,
+		},
+		{
+			name:    "notification failure rate above 1",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "NOTIFY_FAILURE_RATE": "50"},
+			wantErr: true,
+		},
+		{
+			name: "workers",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "WORKERS": "16"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Workers != 16 {
+					t.Errorf("Workers = %d, want 16", cfg.Workers)
+				}
+			},
+		},
+		{
+			name:    "zero workers",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "WORKERS": "0"},
+			wantErr: true,
+		},
+		{
+			name: "shutdown grace period",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "SHUTDOWN_GRACE_PERIOD": "45s"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.ShutdownGracePeriod != 45*time.Second {
+					t.Errorf("ShutdownGracePeriod = %s, want 45s", cfg.ShutdownGracePeriod)
+				}
+			},
+		},
+		{
+			name:    "negative shutdown grace period",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "SHUTDOWN_GRACE_PERIOD": "-1s"},
+			wantErr: true,
+		},
+		{
+			name:    "zero event burst",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "EVENT_BURST": "0"},
+			wantErr: true,
+		},
+		{
+			name:    "negative node reconcile timeout",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "NODE_RECONCILE_TIMEOUT": "-1s"},
+			wantErr: true,
+		},
+		{
+			name:    "non-positive log sample rate",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "LOG_SAMPLE_RATE": "0"},
+			wantErr: true,
+		},
+		{
+			name:    "non-positive config hash interval",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "CONFIG_HASH_INTERVAL": "0s"},
+			wantErr: true,
+		},
+		{
+			name:    "quarantine of an unknown resource type",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "QUARANTINE_IDS": "i-0123,snap-0456"},
+			wantErr: true,
+		},
+		{
+			name:    "allowed region with AZ suffix",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "ALLOWED_REGIONS": "us-east-1a"},
+			wantErr: true,
+		},
+		{
+			name: "managed nodegroup volumes-only",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "MANAGED_NODEGROUP_MODE": "volumes-only"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.ManagedNodegroupMode != nodegroupModeVolumesOnly {
+					t.Errorf("ManagedNodegroupMode = %q", cfg.ManagedNodegroupMode)
+				}
+			},
+		},
+		{
+			name:    "unknown managed nodegroup mode",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "MANAGED_NODEGROUP_MODE": "instances"},
+			wantErr: true,
+		},
+		{
+			name: "cluster identity",
+			env:  map[string]string{"TAGS": `{"kubernetes.io/cluster/${clusterName}":"owned","Account":"${accountId}"}`, "CLUSTER_NAME": "prod"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.ClusterName != "prod" || cfg.ClusterOwnershipTag {
+					t.Errorf("ClusterName = %q, ClusterOwnershipTag = %v", cfg.ClusterName, cfg.ClusterOwnershipTag)
+				}
+				if need := cfg.identityVariables(); !need[varClusterName] || !need[varAccountID] || need[varOIDCIssuer] {
+					t.Errorf("identityVariables = %v", need)
+				}
+			},
+		},
+		{
+			name: "ownership tag without TAGS",
+			env:  map[string]string{"CLUSTER_OWNERSHIP_TAG": "true"},
+			check: func(t *testing.T, cfg *Config) {
+				if !cfg.ClusterOwnershipTag || !cfg.identityVariables()[varClusterName] {
+					t.Errorf("ClusterOwnershipTag = %v", cfg.ClusterOwnershipTag)
+				}
+			},
+		},
+		{
+			name:    "unknown template variable",
+			env:     map[string]string{"TAGS": `{"Cluster":"${cluster}"}`},
+			wantErr: true,
+		},
+		{
+			name: "controller ID",
+			env:  map[string]string{"TAGS": `{"a":"b"}`, "CONTROLLER_ID": "team", "CONTROL_CONFIGMAP": "team-control"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.ControllerID != "team" {
+					t.Errorf("ControllerID = %q", cfg.ControllerID)
+				}
+				if cfg.MetricsCheckpointConfigMap != "aws-node-retag-team-metrics" || cfg.ControlConfigMap != "team-control" {
+					t.Errorf("MetricsCheckpointConfigMap = %q, ControlConfigMap = %q", cfg.MetricsCheckpointConfigMap, cfg.ControlConfigMap)
+				}
+			},
+		},
+		{
+			name:    "invalid controller ID",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "CONTROLLER_ID": "Team_A"},
+			wantErr: true,
+		},
+		{
+			name:    "missing TAGS",
+			env:     map[string]string{},
+			wantErr: true,
+		},
+		{
+			name:    "malformed TAGS",
+			env:     map[string]string{"TAGS": `{"a":`},
+			wantErr: true,
+		},
+		{
+			name:    "empty TAGS object",
+			env:     map[string]string{"TAGS": `{}`},
+			wantErr: true,
+		},
+		{
+			name:    "invalid LIVENESS_THRESHOLD",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "LIVENESS_THRESHOLD": "soon"},
+			wantErr: true,
+		},
+		{
+			name:    "non-positive LIVENESS_THRESHOLD",
+			env:     map[string]string{"TAGS": `{"a":"b"}`, "LIVENESS_THRESHOLD": "0s"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := loadConfig(envMap(tc.env))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("loadConfig() err=%v, wantErr=%v", err, tc.wantErr)
+			}
+			if !tc.wantErr && tc.check != nil {
+				tc.check(t, cfg)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// configHashStaleAfter is how many check intervals a replica's entry survives
+// without being refreshed before it is ignored and pruned.
+const configHashStaleAfter = 3
+
+// configHash identifies the effective configuration of a replica: the
+// settings loaded at startup, except per-replica fields tagged
+// `confighash:"-"`, and the TagPolicies in effect. Secrets only contribute
+// whether they are set, and tag sets their canonical hash, so values that
+// differ only in Unicode composition don't report drift.
+func configHash(cfg *Config, snap *tagSnapshot) string {
+	settings := redactConfig(cfg)
+	typ := reflect.TypeOf(*cfg)
+	for i := 0; i < typ.NumField(); i++ {
+		if field := typ.Field(i); field.Tag.Get("confighash") == "-" {
+			delete(settings, field.Name)
+		}
+	}
+	settings["Tags"] = tagSetHash(cfg.Tags)
+	settings["RootVolumeTags"] = tagSetHash(cfg.RootVolumeTags)
+	settings["DataVolumeTags"] = tagSetHash(cfg.DataVolumeTags)
+	policies := make([]string, 0, len(snap.policies))
+	for _, p := range snap.policies {
+		policies = append(policies, fmt.Sprintf("%s/%d", p.name, p.generation))
+	}
+	// Map keys are marshalled in sorted order, so equal configs hash equally.
+	data, _ := json.Marshal(map[string]any{"settings": settings, "policies": policies})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// replicaConfigHash is the entry a replica publishes under its pod name.
+type replicaConfigHash struct {
+	Hash    string    `json:"hash"`
+	Updated time.Time `json:"updated"`
+}
+
+// configHashes exchanges config hashes between replicas through a ConfigMap
+// with one key per replica.
+type configHashes struct {
+	k8s       kubernetes.Interface
+	namespace string
+	name      string
+	replica   string
+	// staleAfter is how old an entry may be before it no longer counts.
+	staleAfter time.Duration
+	now        func() time.Time
+}
+
+// publish records hash for this replica, prunes stale entries and returns the
+// fresh entries of every replica, including this one.
+func (c *configHashes) publish(ctx context.Context, hash string) (map[string]replicaConfigHash, error) {
+	own := replicaConfigHash{Hash: hash, Updated: c.now().UTC().Truncate(time.Second)}
+	var peers map[string]replicaConfigHash
+	err := updateConfigMapData(ctx, c.k8s, c.namespace, c.name, func(data map[string]string) map[string]string {
+		peers = c.fresh(data)
+		peers[c.replica] = own
+		out := make(map[string]string, len(peers))
+		for name, e := range peers {
+			raw, _ := json.Marshal(e)
+			out[name] = string(raw)
+		}
+		return out
+	})
+	return peers, err
+}
+
+// withdraw removes this replica's entry, so peers stop comparing against a
+// replica that is shutting down.
+func (c *configHashes) withdraw(ctx context.Context) error {
+	return updateConfigMapData(ctx, c.k8s, c.namespace, c.name, func(data map[string]string) map[string]string {
+		delete(data, c.replica)
+		return data
+	})
+}
+
+// fresh decodes the entries updated within staleAfter.
+func (c *configHashes) fresh(data map[string]string) map[string]replicaConfigHash {
+	out := map[string]replicaConfigHash{}
+	cutoff := c.now().Add(-c.staleAfter)
+	for name, raw := range data {
+		var e replicaConfigHash
+		if err := json.Unmarshal([]byte(raw), &e); err != nil || e.Updated.Before(cutoff) {
+			continue
+		}
+		out[name] = e
+	}
+	return out
+}
+
+// divergentReplicas returns, in name order, the replicas whose hash differs
+// from hash.
+func divergentReplicas(peers map[string]replicaConfigHash, hash string) []string {
+	var out []string
+	for name, e := range peers {
+		if e.Hash != hash {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// runConfigDriftChecks publishes this replica's config hash every interval
+// and compares it with the other replicas', so a replica running with a stale
+// ConfigMap or Secret mount is noticed before it takes over. The entry is
+// withdrawn when ctx is cancelled.
+func (t *Tagger) runConfigDriftChecks(ctx context.Context, cfg *Config, hashes *configHashes, interval time.Duration, logger *slog.Logger) {
+	drifting := false
+	check := func() {
+		hash := configHash(cfg, t.current())
+		peers, err := hashes.publish(ctx, hash)
+		if err != nil {
+			logger.Warn("failed to publish config hash", "error", err)
+			return
+		}
+		divergent := divergentReplicas(peers, hash)
+		t.metrics.setConfigDrift(len(peers), len(divergent) > 0)
+		switch {
+		case len(divergent) > 0 && !drifting:
+			logger.Warn("configuration differs from other replicas; check for stale ConfigMap or Secret mounts",
+				"configHash", hash, "divergentReplicas", divergent)
+		case len(divergent) == 0 && drifting:
+			logger.Info("configuration matches all replicas again", "configHash", hash, "replicas", len(peers))
+		}
+		drifting = len(divergent) > 0
+	}
+
+	check()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			finalCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := hashes.withdraw(finalCtx); err != nil {
+				logger.Warn("failed to withdraw config hash", "error", err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+			check()
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestConfigHash(t *testing.T) {
+	base := &Config{Tags: map[string]string{"Team": "a"}, PodName: "retag-0", NodeName: "n1"}
+	snap := &tagSnapshot{}
+	hash := configHash(base, snap)
+
+	sameButReplica := *base
+	sameButReplica.PodName, sameButReplica.NodeName = "retag-1", "n2"
+	if got := configHash(&sameButReplica, snap); got != hash {
+		t.Errorf("per-replica fields changed the hash")
+	}
+
+	changed := *base
+	changed.Tags = map[string]string{"Team": "b"}
+	if got := configHash(&changed, snap); got == hash {
+		t.Errorf("changed tags kept the hash")
+	}
+
+	recomposed := *base
+	recomposed.Tags = map[string]string{"Team": "a", "Name": "cafe\u0301"}
+	composed := *base
+	composed.Tags = map[string]string{"Name": "caf\u00e9", "Team": "a"}
+	if configHash(&recomposed, snap) != configHash(&composed, snap) {
+		t.Errorf("Unicode composition of a tag value changed the hash")
+	}
+
+	withPolicy := snap.withPolicies([]*compiledPolicy{{name: "p", generation: 2}})
+	if got := configHash(base, withPolicy); got == hash {
+		t.Errorf("a TagPolicy kept the hash")
+	}
+	bumped := snap.withPolicies([]*compiledPolicy{{name: "p", generation: 3}})
+	if configHash(base, bumped) == configHash(base, withPolicy) {
+		t.Errorf("a new policy generation kept the hash")
+	}
+}
+
+func TestConfigHashesPublish(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	replica := func(name string) *configHashes {
+		return &configHashes{
+			k8s: client, namespace: "kube-system", name: "hashes", replica: name,
+			staleAfter: 3 * time.Minute, now: func() time.Time { return now },
+		}
+	}
+	a, b := replica("retag-a"), replica("retag-b")
+
+	if _, err := a.publish(ctx, "h1"); err != nil {
+		t.Fatal(err)
+	}
+	peers, err := b.publish(ctx, "h1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || len(divergentReplicas(peers, "h1")) != 0 {
+		t.Fatalf("peers=%v, want two replicas with matching hashes", peers)
+	}
+
+	peers, err = b.publish(ctx, "h2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := divergentReplicas(peers, "h2"); !reflect.DeepEqual(got, []string{"retag-a"}) {
+		t.Errorf("divergentReplicas=%v, want [retag-a]", got)
+	}
+
+	// retag-a stops refreshing its entry: it ages out and is pruned.
+	now = now.Add(5 * time.Minute)
+	peers, err = b.publish(ctx, "h2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := peers["retag-a"]; ok || len(peers) != 1 {
+		t.Errorf("peers=%v, want only retag-b after retag-a went stale", peers)
+	}
+
+	if err := b.withdraw(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cm, err := client.CoreV1().ConfigMaps("kube-system").Get(ctx, "hashes", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.Data) != 0 {
+		t.Errorf("data=%v after withdraw, want empty", cm.Data)
+	}
+}
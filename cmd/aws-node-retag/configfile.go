@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// fileConfig is the schema of the file passed with --config. Every field maps
+// to the environment variable named in its comment, so the file is validated
+// by loadConfig exactly like the environment. Unknown fields are rejected.
+type fileConfig struct {
+	Tags         map[string]string `json:"tags,omitempty"`         // TAGS
+	TagPolicies  *bool             `json:"tagPolicies,omitempty"`  // TAG_POLICIES
+	InstallCRDs  *bool             `json:"installCrds,omitempty"`  // INSTALL_CRDS
+	DryRun       *bool             `json:"dryRun,omitempty"`       // DRY_RUN
+	ReadOnly     *bool             `json:"readOnly,omitempty"`     // READ_ONLY
+	ControllerID string            `json:"controllerId,omitempty"` // CONTROLLER_ID
+
+	InstanceAttributeTags map[string]string `json:"instanceAttributeTags,omitempty"` // INSTANCE_ATTRIBUTE_TAGS
+	NodeInventoryTags     map[string]string `json:"nodeInventoryTags,omitempty"`     // NODE_INVENTORY_TAGS
+	RootVolumeTags        map[string]string `json:"rootVolumeTags,omitempty"`        // ROOT_VOLUME_TAGS
+	DataVolumeTags        map[string]string `json:"dataVolumeTags,omitempty"`        // DATA_VOLUME_TAGS
+
+	ConfigMigration *struct {
+		Enabled   *bool  `json:"enabled,omitempty"`   // CONFIG_MIGRATION
+		Authority string `json:"authority,omitempty"` // CONFIG_AUTHORITY
+	} `json:"configMigration,omitempty"`
+	TagTTLConfigMap          string `json:"tagTtlConfigMap,omitempty"`          // TAG_TTL_CONFIGMAP
+	PolicyConflictResolution string `json:"policyConflictResolution,omitempty"` // POLICY_CONFLICT_RESOLUTION
+
+	Cluster *struct {
+		Name         string `json:"name,omitempty"`         // CLUSTER_NAME
+		OwnershipTag *bool  `json:"ownershipTag,omitempty"` // CLUSTER_OWNERSHIP_TAG
+	} `json:"cluster,omitempty"`
+	Clusters []clusterTarget `json:"clusters,omitempty"` // CLUSTERS
+
+	PreserveExisting *struct {
+		Enabled           *bool    `json:"enabled,omitempty"`           // PRESERVE_EXISTING
+		OverwriteKeys     []string `json:"overwriteKeys,omitempty"`     // PRESERVE_OVERWRITE_KEYS
+		ProtectedPrefixes []string `json:"protectedPrefixes,omitempty"` // PRESERVE_PROTECTED_PREFIXES
+	} `json:"preserveExisting,omitempty"`
+	SharedInstances *struct {
+		Enabled          *bool  `json:"enabled,omitempty"`          // SHARED_INSTANCES
+		ClusterTagPrefix string `json:"clusterTagPrefix,omitempty"` // CLUSTER_TAG_PREFIX
+	} `json:"sharedInstances,omitempty"`
+	UntagOnNodeDelete      *bool  `json:"untagOnNodeDelete,omitempty"`      // UNTAG_ON_NODE_DELETE
+	WatchVolumeAttachments *bool  `json:"watchVolumeAttachments,omitempty"` // WATCH_VOLUME_ATTACHMENTS
+	ManagedNodegroupMode   string `json:"managedNodegroupMode,omitempty"`   // MANAGED_NODEGROUP_MODE
+	ProviderIDFallback     *bool  `json:"providerIdFallback,omitempty"`     // PROVIDER_ID_FALLBACK
+	VolumeDiscovery        *struct {
+		Mode          string `json:"mode,omitempty"`          // VOLUME_DISCOVERY
+		BulkThreshold *int   `json:"bulkThreshold,omitempty"` // VOLUME_DISCOVERY_BULK_THRESHOLD
+		WarmCache     *bool  `json:"warmCache,omitempty"`     // VOLUME_CACHE
+	} `json:"volumeDiscovery,omitempty"`
+	TagDedupWindow string `json:"tagDedupWindow,omitempty"` // TAG_DEDUP_WINDOW
+	Rollout        *struct {
+		Aware       *bool  `json:"aware,omitempty"`       // ROLLOUT_AWARE
+		MaxDuration string `json:"maxDuration,omitempty"` // ROLLOUT_MAX_DURATION
+	} `json:"rollout,omitempty"`
+	ASGTagKeys    []string `json:"asgTagKeys,omitempty"` // ASG_TAG_KEYS
+	ProtectedTags *struct {
+		Keys     []string `json:"keys,omitempty"`     // PROTECTED_TAG_KEYS
+		Prefixes []string `json:"prefixes,omitempty"` // PROTECTED_TAG_PREFIXES
+	} `json:"protectedTags,omitempty"`
+	AllowedRegions []string `json:"allowedRegions,omitempty"` // ALLOWED_REGIONS
+	Quarantine     *struct {
+		IDs  []string `json:"ids,omitempty"`  // QUARANTINE_IDS
+		Tags []string `json:"tags,omitempty"` // QUARANTINE_TAGS
+	} `json:"quarantine,omitempty"`
+	StartupTaint   string `json:"startupTaint,omitempty"`   // STARTUP_TAINT
+	TagNodeTimeout string `json:"tagNodeTimeout,omitempty"` // TAG_NODE_TIMEOUT
+	Termination    *struct {
+		Tag     string   `json:"tag,omitempty"`     // TERMINATION_TAG
+		TimeTag string   `json:"timeTag,omitempty"` // TERMINATION_TIME_TAG
+		Taints  []string `json:"taints,omitempty"`  // TERMINATION_TAINTS
+	} `json:"termination,omitempty"`
+
+	EC2 *struct {
+		MaxAttempts *int         `json:"maxAttempts,omitempty"` // EC2_MAX_ATTEMPTS
+		RetryMode   string       `json:"retryMode,omitempty"`   // EC2_RETRY_MODE
+		TPS         *float64     `json:"tps,omitempty"`         // EC2_TPS
+		Burst       *int         `json:"burst,omitempty"`       // EC2_BURST
+		RetryPolicy *retryPolicy `json:"retryPolicy,omitempty"` // EC2_RETRY_POLICY
+	} `json:"ec2,omitempty"`
+	EC2RegionOptions map[string]regionOptions `json:"ec2RegionOptions,omitempty"` // EC2_REGION_OPTIONS
+	TaggingBackends  map[string]string        `json:"taggingBackends,omitempty"`  // TAGGING_BACKENDS
+	TaggingAccountID string                   `json:"taggingAccountId,omitempty"` // TAGGING_ACCOUNT_ID
+
+	Metrics *struct {
+		Addr       string `json:"addr,omitempty"`      // METRICS_ADDR
+		MaxSeries  *int   `json:"maxSeries,omitempty"` // METRICS_MAX_SERIES
+		Checkpoint *struct {
+			Mode      string `json:"mode,omitempty"`      // METRICS_CHECKPOINT
+			ConfigMap string `json:"configMap,omitempty"` // METRICS_CHECKPOINT_CONFIGMAP
+			File      string `json:"file,omitempty"`      // METRICS_CHECKPOINT_FILE
+			Interval  string `json:"interval,omitempty"`  // METRICS_CHECKPOINT_INTERVAL
+		} `json:"checkpoint,omitempty"`
+	} `json:"metrics,omitempty"`
+	HealthProbe *struct {
+		Addr              string `json:"addr,omitempty"`              // HEALTH_PROBE_ADDR
+		LivenessThreshold string `json:"livenessThreshold,omitempty"` // LIVENESS_THRESHOLD
+	} `json:"healthProbe,omitempty"`
+	FailFast *bool `json:"failFast,omitempty"` // FAIL_FAST
+	Admin    *struct {
+		TokenFile string `json:"tokenFile,omitempty"` // ADMIN_TOKEN_FILE
+	} `json:"admin,omitempty"`
+	TagOverrides *struct {
+		Enabled   *bool  `json:"enabled,omitempty"`   // TAG_OVERRIDES
+		ConfigMap string `json:"configMap,omitempty"` // TAG_OVERRIDES_CONFIGMAP
+		TokenFile string `json:"tokenFile,omitempty"` // TAG_OVERRIDES_TOKEN_FILE
+	} `json:"tagOverrides,omitempty"`
+	Tracing *struct {
+		Endpoint string `json:"endpoint,omitempty"` // OTEL_EXPORTER_OTLP_ENDPOINT
+	} `json:"tracing,omitempty"`
+	Logging *struct {
+		Format        string            `json:"format,omitempty"`        // LOG_FORMAT
+		Level         string            `json:"level,omitempty"`         // LOG_LEVEL
+		Levels        map[string]string `json:"levels,omitempty"`        // LOG_LEVELS
+		RedactTagKeys []string          `json:"redactTagKeys,omitempty"` // LOG_REDACT_TAG_KEYS
+		SampleRate    *int              `json:"sampleRate,omitempty"`    // LOG_SAMPLE_RATE
+	} `json:"logging,omitempty"`
+	Workers *int `json:"workers,omitempty"` // WORKERS
+	Events  *struct {
+		Burst *int     `json:"burst,omitempty"` // EVENT_BURST
+		QPS   *float64 `json:"qps,omitempty"`   // EVENT_QPS
+	} `json:"events,omitempty"`
+	ShutdownGracePeriod  string `json:"shutdownGracePeriod,omitempty"`  // SHUTDOWN_GRACE_PERIOD
+	NodeReconcileTimeout string `json:"nodeReconcileTimeout,omitempty"` // NODE_RECONCILE_TIMEOUT
+
+	ControlConfigMap string `json:"controlConfigMap,omitempty"` // CONTROL_CONFIGMAP
+	ConfigDrift      *struct {
+		Enabled   *bool  `json:"enabled,omitempty"`   // CONFIG_DRIFT_CHECK
+		Interval  string `json:"interval,omitempty"`  // CONFIG_HASH_INTERVAL
+		ConfigMap string `json:"configMap,omitempty"` // CONFIG_HASH_CONFIGMAP
+	} `json:"configDrift,omitempty"`
+	Audit *struct {
+		Format   string `json:"format,omitempty"`   // AUDIT_FORMAT
+		Output   string `json:"output,omitempty"`   // AUDIT_OUTPUT
+		Interval string `json:"interval,omitempty"` // AUDIT_INTERVAL
+		Compress *bool  `json:"compress,omitempty"` // AUDIT_COMPRESS
+		History  *struct {
+			Count   *int   `json:"count,omitempty"`   // AUDIT_HISTORY
+			MaxAge  string `json:"maxAge,omitempty"`  // AUDIT_HISTORY_MAX_AGE
+			MaxSize string `json:"maxSize,omitempty"` // AUDIT_HISTORY_MAX_SIZE
+		} `json:"history,omitempty"`
+		S3 *struct {
+			URI    string `json:"uri,omitempty"`    // AUDIT_S3_URI
+			Region string `json:"region,omitempty"` // AUDIT_S3_REGION
+		} `json:"s3,omitempty"`
+	} `json:"audit,omitempty"`
+	DecisionLog *struct {
+		Path    string `json:"path,omitempty"`    // DECISION_LOG
+		MaxSize string `json:"maxSize,omitempty"` // DECISION_LOG_MAX_SIZE
+	} `json:"decisionLog,omitempty"`
+	VolumeSweep *struct {
+		Interval  string   `json:"interval,omitempty"`  // VOLUME_SWEEP_INTERVAL
+		Tag       string   `json:"tag,omitempty"`       // VOLUME_SWEEP_TAG
+		Regions   []string `json:"regions,omitempty"`   // VOLUME_SWEEP_REGIONS
+		PageSize  *int     `json:"pageSize,omitempty"`  // VOLUME_SWEEP_PAGE_SIZE
+		ConfigMap string   `json:"configMap,omitempty"` // VOLUME_SWEEP_CONFIGMAP
+	} `json:"volumeSweep,omitempty"`
+	LegacyAnnotations *struct {
+		Migrate     *bool    `json:"migrate,omitempty"`     // MIGRATE_LEGACY_ANNOTATIONS
+		Annotations []string `json:"annotations,omitempty"` // LEGACY_ANNOTATIONS
+	} `json:"legacyAnnotations,omitempty"`
+	Notifications *struct {
+		SNSTopicARN    string   `json:"snsTopicArn,omitempty"`    // NOTIFY_SNS_TOPIC_ARN
+		WebhookURLFile string   `json:"webhookUrlFile,omitempty"` // NOTIFY_WEBHOOK_URL_FILE
+		NodeFailures   *int     `json:"nodeFailures,omitempty"`   // NOTIFY_NODE_FAILURES
+		FailureRate    *float64 `json:"failureRate,omitempty"`    // NOTIFY_FAILURE_RATE
+		FailureWindow  string   `json:"failureWindow,omitempty"`  // NOTIFY_FAILURE_WINDOW
+	} `json:"notifications,omitempty"`
+	Heartbeat *struct {
+		URLFile  string `json:"urlFile,omitempty"`  // HEARTBEAT_URL_FILE
+		Interval string `json:"interval,omitempty"` // HEARTBEAT_INTERVAL
+	} `json:"heartbeat,omitempty"`
+	SnapshotTagging *struct {
+		Interval string   `json:"interval,omitempty"` // SNAPSHOT_TAG_INTERVAL
+		Regions  []string `json:"regions,omitempty"`  // SNAPSHOT_TAG_REGIONS
+		TPS      *float64 `json:"tps,omitempty"`      // SNAPSHOT_TAG_TPS
+	} `json:"snapshotTagging,omitempty"`
+	AWSConfig *struct {
+		ResultTokenFile string `json:"resultTokenFile,omitempty"` // AWS_CONFIG_RESULT_TOKEN_FILE
+		Region          string `json:"region,omitempty"`          // AWS_CONFIG_REGION
+		TestMode        *bool  `json:"testMode,omitempty"`        // AWS_CONFIG_TEST_MODE
+	} `json:"awsConfig,omitempty"`
+}
+
+// fileEnv collects the variables set by a fileConfig.
+type fileEnv map[string]string
+
+func (e fileEnv) str(name, v string) {
+	if v != "" {
+		e[name] = v
+	}
+}
+
+func (e fileEnv) bool(name string, v *bool) {
+	if v != nil {
+		e[name] = strconv.FormatBool(*v)
+	}
+}
+
+func (e fileEnv) int(name string, v *int) {
+	if v != nil {
+		e[name] = strconv.Itoa(*v)
+	}
+}
+
+func (e fileEnv) float(name string, v *float64) {
+	if v != nil {
+		e[name] = strconv.FormatFloat(*v, 'g', -1, 64)
+	}
+}
+
+func (e fileEnv) list(name string, v []string) {
+	if len(v) > 0 {
+		e[name] = strings.Join(v, ",")
+	}
+}
+
+func (e fileEnv) json(name string, v any, set bool) {
+	if set {
+		data, _ := json.Marshal(v)
+		e[name] = string(data)
+	}
+}
+
+// env returns the environment variables equivalent to the file.
+func (f *fileConfig) env() fileEnv {
+	e := fileEnv{}
+	e.json("TAGS", f.Tags, len(f.Tags) > 0)
+	e.bool("TAG_POLICIES", f.TagPolicies)
+	e.bool("INSTALL_CRDS", f.InstallCRDs)
+	e.bool("DRY_RUN", f.DryRun)
+	e.bool("READ_ONLY", f.ReadOnly)
+	e.str("CONTROLLER_ID", f.ControllerID)
+	e.json("INSTANCE_ATTRIBUTE_TAGS", f.InstanceAttributeTags, len(f.InstanceAttributeTags) > 0)
+	e.json("NODE_INVENTORY_TAGS", f.NodeInventoryTags, len(f.NodeInventoryTags) > 0)
+	e.json("ROOT_VOLUME_TAGS", f.RootVolumeTags, len(f.RootVolumeTags) > 0)
+	e.json("DATA_VOLUME_TAGS", f.DataVolumeTags, len(f.DataVolumeTags) > 0)
+	if c := f.ConfigMigration; c != nil {
+		e.bool("CONFIG_MIGRATION", c.Enabled)
+		e.str("CONFIG_AUTHORITY", c.Authority)
+	}
+	e.str("TAG_TTL_CONFIGMAP", f.TagTTLConfigMap)
+	e.str("POLICY_CONFLICT_RESOLUTION", f.PolicyConflictResolution)
+	if c := f.Cluster; c != nil {
+		e.str("CLUSTER_NAME", c.Name)
+		e.bool("CLUSTER_OWNERSHIP_TAG", c.OwnershipTag)
+	}
+	e.json("CLUSTERS", f.Clusters, len(f.Clusters) > 0)
+	if p := f.PreserveExisting; p != nil {
+		e.bool("PRESERVE_EXISTING", p.Enabled)
+		e.list("PRESERVE_OVERWRITE_KEYS", p.OverwriteKeys)
+		e.list("PRESERVE_PROTECTED_PREFIXES", p.ProtectedPrefixes)
+	}
+	if sh := f.SharedInstances; sh != nil {
+		e.bool("SHARED_INSTANCES", sh.Enabled)
+		e.str("CLUSTER_TAG_PREFIX", sh.ClusterTagPrefix)
+	}
+	e.bool("UNTAG_ON_NODE_DELETE", f.UntagOnNodeDelete)
+	e.bool("WATCH_VOLUME_ATTACHMENTS", f.WatchVolumeAttachments)
+	e.str("MANAGED_NODEGROUP_MODE", f.ManagedNodegroupMode)
+	e.bool("PROVIDER_ID_FALLBACK", f.ProviderIDFallback)
+	if v := f.VolumeDiscovery; v != nil {
+		e.str("VOLUME_DISCOVERY", v.Mode)
+		e.int("VOLUME_DISCOVERY_BULK_THRESHOLD", v.BulkThreshold)
+		e.bool("VOLUME_CACHE", v.WarmCache)
+	}
+	e.str("TAG_DEDUP_WINDOW", f.TagDedupWindow)
+	if r := f.Rollout; r != nil {
+		e.bool("ROLLOUT_AWARE", r.Aware)
+		e.str("ROLLOUT_MAX_DURATION", r.MaxDuration)
+	}
+	e.list("ASG_TAG_KEYS", f.ASGTagKeys)
+	if p := f.ProtectedTags; p != nil {
+		e.list("PROTECTED_TAG_KEYS", p.Keys)
+		e.list("PROTECTED_TAG_PREFIXES", p.Prefixes)
+	}
+	e.list("ALLOWED_REGIONS", f.AllowedRegions)
+	if q := f.Quarantine; q != nil {
+		e.list("QUARANTINE_IDS", q.IDs)
+		e.list("QUARANTINE_TAGS", q.Tags)
+	}
+	e.str("STARTUP_TAINT", f.StartupTaint)
+	if s := f.Termination; s != nil {
+		e.str("TERMINATION_TAG", s.Tag)
+		e.str("TERMINATION_TIME_TAG", s.TimeTag)
+		e.list("TERMINATION_TAINTS", s.Taints)
+	}
+	e.str("TAG_NODE_TIMEOUT", f.TagNodeTimeout)
+	if c := f.EC2; c != nil {
+		e.int("EC2_MAX_ATTEMPTS", c.MaxAttempts)
+		e.str("EC2_RETRY_MODE", c.RetryMode)
+		e.float("EC2_TPS", c.TPS)
+		e.int("EC2_BURST", c.Burst)
+		e.json("EC2_RETRY_POLICY", c.RetryPolicy, c.RetryPolicy != nil)
+	}
+	e.json("EC2_REGION_OPTIONS", f.EC2RegionOptions, len(f.EC2RegionOptions) > 0)
+	e.json("TAGGING_BACKENDS", f.TaggingBackends, len(f.TaggingBackends) > 0)
+	e.str("TAGGING_ACCOUNT_ID", f.TaggingAccountID)
+	if m := f.Metrics; m != nil {
+		e.str("METRICS_ADDR", m.Addr)
+		e.int("METRICS_MAX_SERIES", m.MaxSeries)
+		if c := m.Checkpoint; c != nil {
+			e.str("METRICS_CHECKPOINT", c.Mode)
+			e.str("METRICS_CHECKPOINT_CONFIGMAP", c.ConfigMap)
+			e.str("METRICS_CHECKPOINT_FILE", c.File)
+			e.str("METRICS_CHECKPOINT_INTERVAL", c.Interval)
+		}
+	}
+	if h := f.HealthProbe; h != nil {
+		e.str("HEALTH_PROBE_ADDR", h.Addr)
+		e.str("LIVENESS_THRESHOLD", h.LivenessThreshold)
+	}
+	e.bool("FAIL_FAST", f.FailFast)
+	if a := f.Admin; a != nil {
+		e.str("ADMIN_TOKEN_FILE", a.TokenFile)
+	}
+	if o := f.TagOverrides; o != nil {
+		e.bool("TAG_OVERRIDES", o.Enabled)
+		e.str("TAG_OVERRIDES_CONFIGMAP", o.ConfigMap)
+		e.str("TAG_OVERRIDES_TOKEN_FILE", o.TokenFile)
+	}
+	if t := f.Tracing; t != nil {
+		e.str("OTEL_EXPORTER_OTLP_ENDPOINT", t.Endpoint)
+	}
+	if l := f.Logging; l != nil {
+		e.str("LOG_FORMAT", l.Format)
+		e.str("LOG_LEVEL", l.Level)
+		e.str("LOG_LEVELS", formatLogLevels(l.Levels))
+		e.list("LOG_REDACT_TAG_KEYS", l.RedactTagKeys)
+		e.int("LOG_SAMPLE_RATE", l.SampleRate)
+	}
+	e.int("WORKERS", f.Workers)
+	if ev := f.Events; ev != nil {
+		e.int("EVENT_BURST", ev.Burst)
+		e.float("EVENT_QPS", ev.QPS)
+	}
+	e.str("SHUTDOWN_GRACE_PERIOD", f.ShutdownGracePeriod)
+	e.str("NODE_RECONCILE_TIMEOUT", f.NodeReconcileTimeout)
+	e.str("CONTROL_CONFIGMAP", f.ControlConfigMap)
+	if d := f.ConfigDrift; d != nil {
+		e.bool("CONFIG_DRIFT_CHECK", d.Enabled)
+		e.str("CONFIG_HASH_INTERVAL", d.Interval)
+		e.str("CONFIG_HASH_CONFIGMAP", d.ConfigMap)
+	}
+	if a := f.Audit; a != nil {
+		e.str("AUDIT_FORMAT", a.Format)
+		e.str("AUDIT_OUTPUT", a.Output)
+		e.str("AUDIT_INTERVAL", a.Interval)
+		e.bool("AUDIT_COMPRESS", a.Compress)
+		if h := a.History; h != nil {
+			e.int("AUDIT_HISTORY", h.Count)
+			e.str("AUDIT_HISTORY_MAX_AGE", h.MaxAge)
+			e.str("AUDIT_HISTORY_MAX_SIZE", h.MaxSize)
+		}
+		if s3 := a.S3; s3 != nil {
+			e.str("AUDIT_S3_URI", s3.URI)
+			e.str("AUDIT_S3_REGION", s3.Region)
+		}
+	}
+	if d := f.DecisionLog; d != nil {
+		e.str("DECISION_LOG", d.Path)
+		e.str("DECISION_LOG_MAX_SIZE", d.MaxSize)
+	}
+	if v := f.VolumeSweep; v != nil {
+		e.str("VOLUME_SWEEP_INTERVAL", v.Interval)
+		e.str("VOLUME_SWEEP_TAG", v.Tag)
+		e.list("VOLUME_SWEEP_REGIONS", v.Regions)
+		e.int("VOLUME_SWEEP_PAGE_SIZE", v.PageSize)
+		e.str("VOLUME_SWEEP_CONFIGMAP", v.ConfigMap)
+	}
+	if l := f.LegacyAnnotations; l != nil {
+		e.bool("MIGRATE_LEGACY_ANNOTATIONS", l.Migrate)
+		e.list("LEGACY_ANNOTATIONS", l.Annotations)
+	}
+	if n := f.Notifications; n != nil {
+		e.str("NOTIFY_SNS_TOPIC_ARN", n.SNSTopicARN)
+		e.str("NOTIFY_WEBHOOK_URL_FILE", n.WebhookURLFile)
+		e.int("NOTIFY_NODE_FAILURES", n.NodeFailures)
+		e.float("NOTIFY_FAILURE_RATE", n.FailureRate)
+		e.str("NOTIFY_FAILURE_WINDOW", n.FailureWindow)
+	}
+	if h := f.Heartbeat; h != nil {
+		e.str("HEARTBEAT_URL_FILE", h.URLFile)
+		e.str("HEARTBEAT_INTERVAL", h.Interval)
+	}
+	if s := f.SnapshotTagging; s != nil {
+		e.str("SNAPSHOT_TAG_INTERVAL", s.Interval)
+		e.list("SNAPSHOT_TAG_REGIONS", s.Regions)
+		e.float("SNAPSHOT_TAG_TPS", s.TPS)
+	}
+	if a := f.AWSConfig; a != nil {
+		e.str("AWS_CONFIG_RESULT_TOKEN_FILE", a.ResultTokenFile)
+		e.str("AWS_CONFIG_REGION", a.Region)
+		e.bool("AWS_CONFIG_TEST_MODE", a.TestMode)
+	}
+	return e
+}
+
+// parseConfigFile decodes a YAML or JSON settings file, rejecting unknown
+// fields and values of the wrong type.
+func parseConfigFile(data []byte) (*fileConfig, error) {
+	var f fileConfig
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// withConfigFile returns a getenv that reads the settings file at path for
+// every variable that is unset or empty in getenv, so the environment
+// overrides the file. An empty path returns getenv unchanged.
+func withConfigFile(getenv func(string) string, path string) (func(string) string, error) {
+	if path == "" {
+		return getenv, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	f, err := parseConfigFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	env := f.env()
+	return func(name string) string {
+		if v := getenv(name); strings.TrimSpace(v) != "" {
+			return v
+		}
+		return env[name]
+	}, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testConfigFile = `
+tags:
+  Environment: production
+  Team: platform
+dryRun: true
+rootVolumeTags:
+  Role: root
+allowedRegions: [us-east-1, eu-west-1]
+ec2:
+  maxAttempts: 8
+  tps: 2.5
+  retryPolicy:
+    throttle: {maxAttempts: 10, maxBackoff: 20s}
+healthProbe:
+  addr: ":9091"
+volumeSweep:
+  interval: 24h
+  tag: kubernetes.io/cluster/prod=owned
+  pageSize: 100
+`
+
+func writeConfigFile(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFromFile(t *testing.T) {
+	getenv, err := withConfigFile(envMap(map[string]string{"DRY_RUN": "false", "HEALTH_PROBE_ADDR": ":9090"}), writeConfigFile(t, testConfigFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(getenv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Tags["Environment"] != "production" || cfg.Tags["Team"] != "platform" || cfg.RootVolumeTags["Role"] != "root" {
+		t.Errorf("Tags = %v, RootVolumeTags = %v", cfg.Tags, cfg.RootVolumeTags)
+	}
+	if len(cfg.AllowedRegions) != 2 || cfg.VolumeSweepInterval != 24*time.Hour || cfg.VolumeSweepPageSize != 100 {
+		t.Errorf("AllowedRegions = %v, VolumeSweepInterval = %s, VolumeSweepPageSize = %d",
+			cfg.AllowedRegions, cfg.VolumeSweepInterval, cfg.VolumeSweepPageSize)
+	}
+	if cfg.EC2Defaults.MaxAttempts != 8 || cfg.EC2Defaults.TPS != 2.5 || cfg.EC2Defaults.RetryPolicy.Throttle.MaxAttempts != 10 {
+		t.Errorf("EC2Defaults = %+v", cfg.EC2Defaults)
+	}
+	// The environment overrides the file.
+	if cfg.DryRun || cfg.HealthProbeAddr != ":9090" {
+		t.Errorf("DryRun = %v, HealthProbeAddr = %q; want the environment's values", cfg.DryRun, cfg.HealthProbeAddr)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	cases := map[string]string{
+		"unknown field":  "tags: {a: b}\ndryRunn: true\n",
+		"wrong type":     "tags: {a: b}\nec2: {maxAttempts: many}\n",
+		"invalid value":  "tags: {a: b}\nvolumeSweep: {pageSize: 1000}\n",
+		"malformed yaml": "tags: [",
+	}
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			getenv, err := withConfigFile(envMap(nil), writeConfigFile(t, data))
+			if err == nil {
+				_, err = loadConfig(getenv)
+			}
+			if err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestLegacyTagsWithoutConfigFile(t *testing.T) {
+	getenv, err := withConfigFile(envMap(map[string]string{"TAGS": `{"a":"b"}`}), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := loadConfig(getenv); err != nil || cfg.Tags["a"] != "b" {
+		t.Errorf("loadConfig() = %v, %v", cfg, err)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Config authorities, see configMigration.
+const (
+	// authorityEnv applies TAGS, ROOT_VOLUME_TAGS and DATA_VOLUME_TAGS with
+	// the TagPolicies merged over them.
+	authorityEnv = "env"
+	// authorityCRD applies the TagPolicies alone.
+	authorityCRD = "crd"
+)
+
+// configAuthorityAnnotation on the control ConfigMap selects the config
+// authority at runtime, overriding CONFIG_AUTHORITY:
+//
+//	kubectl -n kube-system annotate configmap aws-node-retag-control aws-node-retag.io/config-authority=crd
+const configAuthorityAnnotation = "aws-node-retag.io/config-authority"
+
+// configMigrationInterval is how often the differences between the two
+// authorities are computed, logged and exported.
+const configMigrationInterval = 5 * time.Minute
+
+// configMigrationPath serves the latest differences as JSON.
+const configMigrationPath = "/debug/config-migration"
+
+// envTagSources are the tags configured with environment variables (or the
+// settings file), which TagPolicies replace in the crd authority.
+type envTagSources struct {
+	tags           map[string]string
+	rootVolumeTags map[string]string
+	dataVolumeTags map[string]string
+}
+
+// forAuthority returns the sources applied under authority: none for crd.
+func (e envTagSources) forAuthority(authority string) envTagSources {
+	if authority == authorityCRD {
+		return envTagSources{}
+	}
+	return e
+}
+
+// configDifference is a tag on which the two authorities disagree. Env or
+// CRD is empty when that authority does not set the key.
+type configDifference struct {
+	Object   string `json:"object"`
+	Resource string `json:"resource"`
+	Key      string `json:"key"`
+	Env      string `json:"env,omitempty"`
+	CRD      string `json:"crd,omitempty"`
+}
+
+// configMigrationReport is the configMigrationPath response.
+type configMigrationReport struct {
+	Authority         string             `json:"authority"`
+	GeneratedAt       time.Time          `json:"generatedAt"`
+	Nodes             int                `json:"nodes"`
+	PersistentVolumes int                `json:"persistentVolumes"`
+	Differences       []configDifference `json:"differences"`
+}
+
+// configMigration moves a deployment from env-var tags to TagPolicies without
+// a gap in coverage. Both sources are read all along: the one in authority
+// is applied, and the tags each would give every node and PV are compared so
+// the TagPolicies can be completed until they agree with TAGS. Switching the
+// authority then publishes a new snapshot, atomically for every reconcile,
+// and re-tags all nodes. Tags are never removed by the switch, so the tags
+// only TAGS gave stay on the resources tagged so far.
+//
+// The switch applies to this cluster only: the other clusters of
+// multi-cluster mode have no TagPolicies and keep their TAGS.
+type configMigration struct {
+	tagger *Tagger
+	env    envTagSources
+	// fallback is CONFIG_AUTHORITY, in effect while the control ConfigMap
+	// does not set configAuthorityAnnotation.
+	fallback string
+	metrics  *metrics
+	logger   *slog.Logger
+	// onSwitch is called when the authority changes after startup.
+	onSwitch func()
+	now      func() time.Time
+
+	mu        sync.Mutex
+	authority string
+	observed  bool
+	// last is the latest report, served on configMigrationPath; nil until
+	// the first comparison.
+	last *configMigrationReport
+}
+
+func newConfigMigration(t *Tagger, cfg *Config, m *metrics, logger *slog.Logger) *configMigration {
+	c := &configMigration{
+		tagger: t,
+		env: envTagSources{
+			tags:           cfg.Tags,
+			rootVolumeTags: cfg.RootVolumeTags,
+			dataVolumeTags: cfg.DataVolumeTags,
+		},
+		fallback:  cfg.ConfigAuthority,
+		metrics:   m,
+		logger:    logger,
+		onSwitch:  func() {},
+		now:       time.Now,
+		authority: cfg.ConfigAuthority,
+	}
+	m.setConfigAuthority(c.authority)
+	return c
+}
+
+// current returns the authority in effect.
+func (c *configMigration) current() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.authority
+}
+
+// set makes authority the one in effect.
+func (c *configMigration) set(authority string) {
+	c.mu.Lock()
+	was, observed := c.authority, c.observed
+	c.authority, c.observed = authority, true
+	if was != authority {
+		c.tagger.publishTags(c.env.forAuthority(authority))
+		c.metrics.setConfigAuthority(authority)
+	}
+	c.mu.Unlock()
+
+	if was == authority {
+		return
+	}
+	c.logger.Warn("config authority switched", "from", was, "to", authority)
+	// The controller that switched has already re-tagged the nodes; a
+	// restart only picks the annotation up.
+	if observed {
+		c.onSwitch()
+	}
+}
+
+// handler follows configAuthorityAnnotation on the control ConfigMap.
+// Invalid values are logged and leave the authority unchanged.
+func (c *configMigration) handler() cache.ResourceEventHandler {
+	update := func(cm *corev1.ConfigMap) {
+		authority := c.fallback
+		if cm != nil {
+			if v, ok := cm.Annotations[configAuthorityAnnotation]; ok {
+				authority = v
+			}
+		}
+		if authority != authorityEnv && authority != authorityCRD {
+			c.logger.Error("ignoring invalid config authority, expected env or crd", "annotation", configAuthorityAnnotation, "value", authority, "authority", c.current())
+			return
+		}
+		c.set(authority)
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if cm, ok := obj.(*corev1.ConfigMap); ok {
+				update(cm)
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if cm, ok := newObj.(*corev1.ConfigMap); ok {
+				update(cm)
+			}
+		},
+		DeleteFunc: func(interface{}) {
+			update(nil)
+		},
+	}
+}
+
+// report compares the tags each authority gives the nodes' instances and
+// volumes and the bound PVs. Instance attribute, node inventory and override
+// tags apply under both authorities and are left out.
+func (c *configMigration) report(nodes corelisters.NodeLister, pvs corelisters.PersistentVolumeLister) (*configMigrationReport, error) {
+	snap := c.tagger.current()
+	env := c.env
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	report := &configMigrationReport{Authority: c.current(), GeneratedAt: c.now(), Differences: []configDifference{}}
+
+	nodeList, err := nodes.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(nodeList, func(i, j int) bool { return nodeList[i].Name < nodeList[j].Name })
+	for _, node := range nodeList {
+		if info, err := parseProviderID(node.Spec.ProviderID); err == nil && info.Fargate {
+			continue
+		}
+		if _, ok := cutProviderIDScheme(node.Spec.ProviderID); !ok {
+			continue
+		}
+		report.Nodes++
+		object := "node/" + node.Name
+		// The crd authority has no base tags, its volumes no sections.
+		crdInstance, _ := snap.resourceTags(nil, resourceInstance, node.Labels, quiet)
+		crdVolume, _ := snap.resourceTags(nil, resourceVolume, node.Labels, quiet)
+		for _, r := range []struct {
+			resource, policyType string
+			env, crd             map[string]string
+		}{
+			{"instance", resourceInstance, env.tags, crdInstance},
+			{"rootVolume", resourceVolume, awstags.Merge(env.tags, env.rootVolumeTags), crdVolume},
+			{"dataVolume", resourceVolume, awstags.Merge(env.tags, env.dataVolumeTags), crdVolume},
+		} {
+			envTags, _ := snap.resourceTags(r.env, r.policyType, node.Labels, quiet)
+			report.Differences = append(report.Differences, tagDifferences(object, r.resource, envTags, r.crd)...)
+		}
+	}
+
+	pvList, err := pvs.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(pvList, func(i, j int) bool { return pvList[i].Name < pvList[j].Name })
+	for _, pv := range pvList {
+		if pv.Status.Phase != corev1.VolumeBound {
+			continue
+		}
+		report.PersistentVolumes++
+		envTags, _ := snap.resourceTags(env.tags, resourcePersistentVolume, pv.Labels, quiet)
+		crdTags, _ := snap.resourceTags(nil, resourcePersistentVolume, pv.Labels, quiet)
+		report.Differences = append(report.Differences, tagDifferences("pv/"+pv.Name, resourcePersistentVolume, envTags, crdTags)...)
+	}
+	return report, nil
+}
+
+// tagDifferences returns the keys, sorted, on which env and crd disagree.
+func tagDifferences(object, resource string, env, crd map[string]string) []configDifference {
+	var out []configDifference
+	for _, c := range awstags.Diff(env, crd) {
+		out = append(out, configDifference{Object: object, Resource: resource, Key: c.Key, Env: c.Desired, CRD: c.Actual})
+	}
+	return out
+}
+
+// run reports the differences right away and then every interval until
+// ctx is done.
+func (c *configMigration) run(ctx context.Context, nodes corelisters.NodeLister, pvs corelisters.PersistentVolumeLister, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.refresh(nodes, pvs)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh compares the authorities, reports the differences and keeps the
+// report for httpHandler.
+func (c *configMigration) refresh(nodes corelisters.NodeLister, pvs corelisters.PersistentVolumeLister) {
+	report, err := c.report(nodes, pvs)
+	if err != nil {
+		c.logger.Error("failed to compare the config authorities", "error", err)
+		return
+	}
+	c.mu.Lock()
+	c.last = report
+	c.mu.Unlock()
+	c.metrics.configMigrationDifferences.Set(float64(len(report.Differences)))
+	if len(report.Differences) > 0 {
+		c.logger.Warn("TAGS and TagPolicies disagree, see "+configMigrationPath, "authority", report.Authority, "differences", len(report.Differences))
+	} else {
+		c.logger.Info("TAGS and TagPolicies agree", "authority", report.Authority, "nodes", report.Nodes, "persistentVolumes", report.PersistentVolumes)
+	}
+}
+
+// httpHandler serves GET configMigrationPath: the report of the latest
+// comparison, rather than comparing every object again per request.
+func (c *configMigration) httpHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c.mu.Lock()
+		report := c.last
+		c.mu.Unlock()
+		if report == nil {
+			http.Error(w, "no comparison finished yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func testConfigMigration(t *testing.T, authority string) (*configMigration, *Tagger) {
+	t.Helper()
+	cfg := &Config{
+		Tags:            map[string]string{"Env": "prod", "Team": "platform"},
+		RootVolumeTags:  map[string]string{"Backup": "daily"},
+		ConfigAuthority: authority,
+	}
+	tagger := &Tagger{}
+	tagger.snapshot.Store((&tagSnapshot{}).withTags(envTagSources{
+		tags:           cfg.Tags,
+		rootVolumeTags: cfg.RootVolumeTags,
+	}.forAuthority(authority)))
+	p, err := compilePolicy(newTestPolicy("base", tagPolicySpec{Tags: map[string]string{"Env": "prod", "Team": "data"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagger.publishPolicies([]*compiledPolicy{p})
+	c := newConfigMigration(tagger, cfg, newMetrics(""), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	c.now = func() time.Time { return time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC) }
+	return c, tagger
+}
+
+func TestConfigMigrationSwitch(t *testing.T) {
+	c, tagger := testConfigMigration(t, authorityEnv)
+	switches := 0
+	c.onSwitch = func() { switches++ }
+	h := c.handler()
+
+	// The first observation at startup does not re-tag.
+	h.OnAdd(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{configAuthorityAnnotation: authorityEnv}}}, true)
+	if switches != 0 || tagger.current().tags["Team"] != "platform" {
+		t.Fatalf("switches = %d, tags = %v; want TAGS applied", switches, tagger.current().tags)
+	}
+
+	before := tagger.current()
+	h.OnUpdate(nil, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{configAuthorityAnnotation: authorityCRD}}})
+	snap := tagger.current()
+	if snap.tags != nil || snap.rootVolumeTags != nil || len(snap.policies) != 1 || snap.version <= before.version {
+		t.Fatalf("crd snapshot = %+v, want the policies alone in a new version", snap)
+	}
+	if before.tags["Team"] != "platform" {
+		t.Error("the previous snapshot was modified")
+	}
+	if switches != 1 {
+		t.Errorf("switches = %d, want 1", switches)
+	}
+	if got := testutil.ToFloat64(c.metrics.configAuthority.WithLabelValues(authorityCRD)); got != 1 {
+		t.Errorf("config_authority{crd} = %v, want 1", got)
+	}
+
+	// Invalid values leave the authority alone.
+	h.OnUpdate(nil, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{configAuthorityAnnotation: "both"}}})
+	if c.current() != authorityCRD || switches != 1 {
+		t.Errorf("authority = %s after an invalid value, want crd", c.current())
+	}
+
+	// Deleting the ConfigMap falls back to CONFIG_AUTHORITY.
+	h.OnDelete(nil)
+	if c.current() != authorityEnv || tagger.current().tags["Team"] != "platform" || switches != 2 {
+		t.Errorf("authority = %s, tags = %v; want env restored", c.current(), tagger.current().tags)
+	}
+	if got := testutil.ToFloat64(c.metrics.configAuthority.WithLabelValues(authorityCRD)); got != 0 {
+		t.Errorf("config_authority{crd} = %v, want 0", got)
+	}
+}
+
+func TestConfigMigrationReport(t *testing.T) {
+	c, _ := testConfigMigration(t, authorityEnv)
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	_ = nodes.Add(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "n1"}, Spec: corev1.NodeSpec{ProviderID: "aws:///eu-west-1a/i-0123456789abcdef0"}})
+	_ = nodes.Add(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "fargate"}, Spec: corev1.NodeSpec{ProviderID: "aws:///eu-west-1a/abc/fargate-ip-10-0-0-1.ec2.internal"}})
+	_ = nodes.Add(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "kind"}, Spec: corev1.NodeSpec{ProviderID: "kind://docker/kind/kind-control-plane"}})
+	pvs := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	_ = pvs.Add(&corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv-1"}, Status: corev1.PersistentVolumeStatus{Phase: corev1.VolumeBound}})
+	_ = pvs.Add(&corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv-2"}, Status: corev1.PersistentVolumeStatus{Phase: corev1.VolumeAvailable}})
+
+	handler := c.httpHandler()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, configMigrationPath, nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET before the first comparison = %d, want 503", rec.Code)
+	}
+
+	c.refresh(corelisters.NewNodeLister(nodes), corelisters.NewPersistentVolumeLister(pvs))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, configMigrationPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET = %d %s", rec.Code, rec.Body)
+	}
+	var report configMigrationReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Authority != authorityEnv || report.Nodes != 1 || report.PersistentVolumes != 1 {
+		t.Errorf("report = %+v, want 1 node and 1 bound PV under env", report)
+	}
+	// The policy overrides Team under both authorities, so only the root
+	// volume section is missing from the TagPolicies.
+	want := []configDifference{{Object: "node/n1", Resource: "rootVolume", Key: "Backup", Env: "daily"}}
+	if !reflect.DeepEqual(report.Differences, want) {
+		t.Errorf("differences = %+v, want %+v", report.Differences, want)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, configMigrationPath, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST = %d, want 405", rec.Code)
+	}
+}
+
+func TestTagDifferences(t *testing.T) {
+	got := tagDifferences("pv/a", resourcePersistentVolume,
+		map[string]string{"Env": "prod", "Team": "a", "Owner": "x"},
+		map[string]string{"Env": "prod", "Team": "b", "Cost": "cc"})
+	want := []configDifference{
+		{Object: "pv/a", Resource: resourcePersistentVolume, Key: "Cost", CRD: "cc"},
+		{Object: "pv/a", Resource: resourcePersistentVolume, Key: "Owner", Env: "x"},
+		{Object: "pv/a", Resource: resourcePersistentVolume, Key: "Team", Env: "a", CRD: "b"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tagDifferences = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/configservice"
+	configtypes "github.com/aws/aws-sdk-go-v2/service/configservice/types"
+)
+
+const (
+	// configRuleBatch is the most evaluations PutEvaluations accepts at once.
+	configRuleBatch = 100
+	// configRuleAnnotationMax is the longest evaluation annotation accepted.
+	configRuleAnnotationMax = 256
+	// configRuleTestToken is the result token sent in test mode when no token
+	// file is set; test mode only requires one to be present.
+	configRuleTestToken = "test-mode"
+)
+
+// configRuleResourceTypes are the AWS Config resource types of the audited
+// resource kinds.
+var configRuleResourceTypes = map[string]string{
+	"instance": "AWS::EC2::Instance",
+	"volume":   "AWS::EC2::Volume",
+}
+
+// configRuleAPI is the subset of the AWS Config client used to publish
+// evaluations.
+type configRuleAPI interface {
+	PutEvaluations(ctx context.Context, params *configservice.PutEvaluationsInput, optFns ...func(*configservice.Options)) (*configservice.PutEvaluationsOutput, error)
+}
+
+// configRulePublisher publishes the result of every drift audit to a custom
+// AWS Config rule: each audited instance and volume in the rule's region is
+// COMPLIANT, or NON_COMPLIANT with the drifted keys as annotation. The rule
+// is identified by the result token of one of its invocations, read from
+// AWS_CONFIG_RESULT_TOKEN_FILE before every publish so whatever receives the
+// invocations can keep it current.
+type configRulePublisher struct {
+	api       configRuleAPI
+	region    string
+	tokenFile string
+	// testMode validates the evaluations without recording them
+	// (AWS_CONFIG_TEST_MODE).
+	testMode bool
+}
+
+func newConfigRulePublisher(awsCfg aws.Config, cfg *Config) *configRulePublisher {
+	region := cfg.AWSConfigRegion
+	if region == "" {
+		region = awsCfg.Region
+	}
+	return &configRulePublisher{
+		api:       configservice.NewFromConfig(awsCfg, func(o *configservice.Options) { o.Region = region }),
+		region:    region,
+		tokenFile: cfg.AWSConfigResultTokenFile,
+		testMode:  cfg.AWSConfigTestMode,
+	}
+}
+
+// resultToken returns the current result token.
+func (p *configRulePublisher) resultToken() (string, error) {
+	if p.tokenFile == "" {
+		return configRuleTestToken, nil
+	}
+	data, err := os.ReadFile(p.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("read result token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("result token file %s is empty", p.tokenFile)
+	}
+	return token, nil
+}
+
+// evaluations returns the evaluations of the report's resources in the
+// rule's region, in resource ID order, and the number of resources in other
+// regions, which the rule does not cover.
+func (p *configRulePublisher) evaluations(r *auditReport) ([]configtypes.Evaluation, int) {
+	missing, mismatched := map[string][]string{}, map[string][]string{}
+	for _, f := range r.Findings {
+		if f.Status == driftMissing {
+			missing[f.ResourceID] = append(missing[f.ResourceID], f.Key)
+		} else {
+			mismatched[f.ResourceID] = append(mismatched[f.ResourceID], f.Key)
+		}
+	}
+	audited := append([]auditedResource(nil), r.audited...)
+	sort.Slice(audited, func(i, j int) bool { return audited[i].id < audited[j].id })
+
+	var evals []configtypes.Evaluation
+	otherRegions := 0
+	for _, res := range audited {
+		resourceType, ok := configRuleResourceTypes[resourceKind(res.id)]
+		if !ok {
+			continue
+		}
+		if res.region != p.region {
+			otherRegions++
+			continue
+		}
+		e := configtypes.Evaluation{
+			ComplianceResourceId:   aws.String(res.id),
+			ComplianceResourceType: aws.String(resourceType),
+			ComplianceType:         configtypes.ComplianceTypeCompliant,
+			OrderingTimestamp:      aws.Time(r.GeneratedAt),
+		}
+		if len(missing[res.id]) > 0 || len(mismatched[res.id]) > 0 {
+			e.ComplianceType = configtypes.ComplianceTypeNonCompliant
+			e.Annotation = aws.String(driftAnnotation(missing[res.id], mismatched[res.id]))
+		}
+		evals = append(evals, e)
+	}
+	return evals, otherRegions
+}
+
+// driftAnnotation names the drifted keys of a resource, truncated to what an
+// annotation may hold. Tag values are left out.
+func driftAnnotation(missing, mismatched []string) string {
+	var parts []string
+	if len(missing) > 0 {
+		parts = append(parts, "missing tags: "+strings.Join(missing, ", "))
+	}
+	if len(mismatched) > 0 {
+		parts = append(parts, "tags with other values: "+strings.Join(mismatched, ", "))
+	}
+	s := strings.Join(parts, "; ")
+	if len(s) <= configRuleAnnotationMax {
+		return s
+	}
+	const ellipsis = "..."
+	s = s[:configRuleAnnotationMax-len(ellipsis)]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s + ellipsis
+}
+
+// publish sends evals in batches and returns how many were accepted and how
+// many AWS Config rejected.
+func (p *configRulePublisher) publish(ctx context.Context, evals []configtypes.Evaluation) (sent, failed int, err error) {
+	token, err := p.resultToken()
+	if err != nil {
+		return 0, 0, err
+	}
+	for start := 0; start < len(evals); start += configRuleBatch {
+		batch := evals[start:min(start+configRuleBatch, len(evals))]
+		out, err := p.api.PutEvaluations(ctx, &configservice.PutEvaluationsInput{
+			ResultToken: aws.String(token),
+			Evaluations: batch,
+			TestMode:    p.testMode,
+		})
+		if err != nil {
+			return sent, failed, fmt.Errorf("PutEvaluations: %w", err)
+		}
+		failed += len(out.FailedEvaluations)
+		sent += len(batch) - len(out.FailedEvaluations)
+	}
+	return sent, failed, nil
+}
+
+// publishEvaluations publishes the evaluations of an audit report to the
+// AWS Config rule, if one is configured. Dry-run, read-only and pause modes
+// log them instead.
+func (t *Tagger) publishEvaluations(ctx context.Context, r *auditReport, logger *slog.Logger) error {
+	if t.configRule == nil || !t.features.enabled(featureAWSConfig, t.configRule.region) {
+		return nil
+	}
+	evals, otherRegions := t.configRule.evaluations(r)
+	nonCompliant := 0
+	for _, e := range evals {
+		if e.ComplianceType == configtypes.ComplianceTypeNonCompliant {
+			nonCompliant++
+		}
+	}
+	log := logger.With("region", t.configRule.region, "evaluations", len(evals), "nonCompliant", nonCompliant)
+	if otherRegions > 0 {
+		log.Info("not evaluating resources outside the AWS Config rule's region", "resources", otherRegions)
+	}
+	if len(evals) == 0 {
+		return nil
+	}
+	if reason := t.writeBlocked(); reason != "" {
+		log.Info(reason + ": would publish AWS Config evaluations")
+		return nil
+	}
+	sent, failed, err := t.configRule.publish(ctx, evals)
+	t.metrics.configEvaluations.WithLabelValues("sent").Add(float64(sent))
+	t.metrics.configEvaluations.WithLabelValues("failed").Add(float64(len(evals) - sent))
+	if err != nil {
+		if t.features.denied(featureAWSConfig, t.configRule.region, err) {
+			return nil
+		}
+		return fmt.Errorf("publish AWS Config evaluations: %w", err)
+	}
+	if failed > 0 {
+		log.Warn("AWS Config rejected some evaluations", "failed", failed)
+	}
+	log.Info("published AWS Config evaluations", "sent", sent, "testMode", t.configRule.testMode)
+	return nil
+}
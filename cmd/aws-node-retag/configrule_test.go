@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/configservice"
+	configtypes "github.com/aws/aws-sdk-go-v2/service/configservice/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeConfigRule records PutEvaluations calls and rejects the evaluations of
+// the resource IDs in reject.
+type fakeConfigRule struct {
+	calls  []*configservice.PutEvaluationsInput
+	reject map[string]bool
+}
+
+func (f *fakeConfigRule) PutEvaluations(_ context.Context, in *configservice.PutEvaluationsInput, _ ...func(*configservice.Options)) (*configservice.PutEvaluationsOutput, error) {
+	f.calls = append(f.calls, in)
+	out := &configservice.PutEvaluationsOutput{}
+	for _, e := range in.Evaluations {
+		if f.reject[aws.ToString(e.ComplianceResourceId)] {
+			out.FailedEvaluations = append(out.FailedEvaluations, e)
+		}
+	}
+	return out, nil
+}
+
+func TestPublishEvaluations(t *testing.T) {
+	api := &instanceEC2{taggingEC2{existing: map[string]map[string]string{
+		"i-0123456789abcdef0": {"Env": "prod", "Team": "a"},
+		"vol-root":            {"Env": "staging"},
+	}}}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), api)
+	tagger.snapshot.Store(&tagSnapshot{tags: map[string]string{"Env": "prod", "Team": "a"}})
+	report := tagger.audit(context.Background(), []*corev1.Node{taintedNode(nil)})
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("token-1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rule := &fakeConfigRule{}
+	tagger.configRule = &configRulePublisher{api: rule, region: "us-east-1", tokenFile: tokenFile}
+	if err := tagger.publishEvaluations(context.Background(), report, tagger.logger); err != nil {
+		t.Fatal(err)
+	}
+	if len(rule.calls) != 1 {
+		t.Fatalf("PutEvaluations calls = %d, want 1", len(rule.calls))
+	}
+	in := rule.calls[0]
+	if aws.ToString(in.ResultToken) != "token-1" || in.TestMode {
+		t.Errorf("ResultToken = %q, TestMode = %v", aws.ToString(in.ResultToken), in.TestMode)
+	}
+	if len(in.Evaluations) != 2 {
+		t.Fatalf("evaluations = %+v, want the instance and its volume", in.Evaluations)
+	}
+	inst, vol := in.Evaluations[0], in.Evaluations[1]
+	if aws.ToString(inst.ComplianceResourceId) != "i-0123456789abcdef0" || aws.ToString(inst.ComplianceResourceType) != "AWS::EC2::Instance" ||
+		inst.ComplianceType != configtypes.ComplianceTypeCompliant || inst.Annotation != nil {
+		t.Errorf("instance evaluation = %+v", inst)
+	}
+	if aws.ToString(vol.ComplianceResourceId) != "vol-root" || aws.ToString(vol.ComplianceResourceType) != "AWS::EC2::Volume" ||
+		vol.ComplianceType != configtypes.ComplianceTypeNonCompliant ||
+		aws.ToString(vol.Annotation) != "missing tags: Team; tags with other values: Env" {
+		t.Errorf("volume evaluation = %+v, annotation %q", vol, aws.ToString(vol.Annotation))
+	}
+	if !aws.ToTime(vol.OrderingTimestamp).Equal(report.GeneratedAt) {
+		t.Errorf("OrderingTimestamp = %v, want %v", aws.ToTime(vol.OrderingTimestamp), report.GeneratedAt)
+	}
+	if got := testutil.ToFloat64(tagger.metrics.configEvaluations.WithLabelValues("sent")); got != 2 {
+		t.Errorf("sent = %v, want 2", got)
+	}
+
+	// Other regions are not covered by the rule.
+	rule.calls = nil
+	tagger.configRule.region = "eu-west-1"
+	if err := tagger.publishEvaluations(context.Background(), report, tagger.logger); err != nil || len(rule.calls) != 0 {
+		t.Errorf("published resources of another region: %v, %d calls", err, len(rule.calls))
+	}
+
+	// Dry-run only logs.
+	tagger.configRule.region = "us-east-1"
+	tagger.dryRun = true
+	if err := tagger.publishEvaluations(context.Background(), report, tagger.logger); err != nil || len(rule.calls) != 0 {
+		t.Errorf("published in dry-run: %v, %d calls", err, len(rule.calls))
+	}
+
+	// The token is read on every publish.
+	tagger.dryRun = false
+	if err := os.Remove(tokenFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := tagger.publishEvaluations(context.Background(), report, tagger.logger); err == nil {
+		t.Error("expected an error without a result token")
+	}
+}
+
+func TestConfigRulePublishBatches(t *testing.T) {
+	rule := &fakeConfigRule{reject: map[string]bool{"vol-7": true}}
+	p := &configRulePublisher{api: rule, region: "us-east-1", testMode: true}
+	evals := make([]configtypes.Evaluation, 250)
+	for i := range evals {
+		evals[i] = configtypes.Evaluation{ComplianceResourceId: aws.String(fmt.Sprintf("vol-%d", i))}
+	}
+	sent, failed, err := p.publish(context.Background(), evals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 249 || failed != 1 {
+		t.Errorf("sent, failed = %d, %d, want 249, 1", sent, failed)
+	}
+	if len(rule.calls) != 3 || len(rule.calls[0].Evaluations) != configRuleBatch || len(rule.calls[2].Evaluations) != 50 {
+		t.Errorf("PutEvaluations calls = %d, want batches of 100, 100 and 50", len(rule.calls))
+	}
+	for _, in := range rule.calls {
+		if !in.TestMode || aws.ToString(in.ResultToken) != configRuleTestToken {
+			t.Errorf("TestMode = %v, ResultToken = %q", in.TestMode, aws.ToString(in.ResultToken))
+		}
+	}
+}
+
+func TestDriftAnnotation(t *testing.T) {
+	keys := make([]string, 60)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("team.example.com/key-%d", i)
+	}
+	got := driftAnnotation(keys, nil)
+	if len(got) > configRuleAnnotationMax || !strings.HasPrefix(got, "missing tags: team.example.com/key-0, ") || !strings.HasSuffix(got, "...") {
+		t.Errorf("annotation = %q (%d bytes)", got, len(got))
+	}
+	if got := driftAnnotation(nil, []string{"Env"}); got != "tags with other values: Env" {
+		t.Errorf("annotation = %q", got)
+	}
+}
+
+func TestConfigRuleEvaluationsSkipUnknownKinds(t *testing.T) {
+	p := &configRulePublisher{region: "us-east-1"}
+	r := &auditReport{GeneratedAt: time.Now(), audited: []auditedResource{{region: "us-east-1", id: "eni-1"}, {region: "us-east-1", id: "i-1"}}}
+	evals, other := p.evaluations(r)
+	if len(evals) != 1 || aws.ToString(evals[0].ComplianceResourceId) != "i-1" || other != 0 {
+		t.Errorf("evaluations = %+v, other regions = %d", evals, other)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Values of POLICY_CONFLICT_RESOLUTION: how a key set to different values by
+// TagPolicies matching the same resource is resolved.
+const (
+	// resolvePriority applies the value of the policy with the highest
+	// spec.priority, then the last by name.
+	resolvePriority = "priority"
+	// resolveNewest applies the value of the most recently created policy,
+	// then the last by name.
+	resolveNewest = "newest"
+	// resolveSkip writes none of the values; a static tag of the key is
+	// written instead.
+	resolveSkip = "skip"
+)
+
+// conditionConflicted is the TagPolicy status condition set while the policy
+// disagrees with another on the value of a key.
+const conditionConflicted = "Conflicted"
+
+// maxConflictMessages bounds the conflicts listed in the condition message.
+const maxConflictMessages = 5
+
+// policyConflict is a key that TagPolicies matching the same resource set to
+// different values.
+type policyConflict struct {
+	Key string
+	// Policies set the key, in order of precedence (the winner last), and
+	// Values are their values.
+	Policies []string
+	Values   []string
+	// Winner is the policy whose value is written, "" when the key is
+	// skipped.
+	Winner string
+}
+
+// id identifies the conflict across the objects it occurs on.
+func (c policyConflict) id() string {
+	return c.Key + "\x00" + strings.Join(c.Policies, "\x00")
+}
+
+func (c policyConflict) String() string {
+	values := make([]string, len(c.Policies))
+	for i, name := range c.Policies {
+		values[i] = fmt.Sprintf("%q by %s", c.Values[i], name)
+	}
+	outcome := c.Winner + " wins"
+	if c.Winner == "" {
+		outcome = "the key is skipped"
+	}
+	return fmt.Sprintf("tag %s is set to %s; %s", c.Key, strings.Join(values, ", "), outcome)
+}
+
+// redactConflicts returns conflicts with the values of the keys in redact
+// replaced by redactedTagValue.
+func redactConflicts(redact map[string]bool, conflicts []policyConflict) []policyConflict {
+	var out []policyConflict
+	for i, c := range conflicts {
+		if !redact[c.Key] {
+			continue
+		}
+		if out == nil {
+			out = slices.Clone(conflicts)
+		}
+		values := make([]string, len(c.Values))
+		for j := range values {
+			values[j] = redactedTagValue
+		}
+		out[i].Values = values
+	}
+	if out == nil {
+		return conflicts
+	}
+	return out
+}
+
+// precedes reports whether policy a applies before b under resolution, so
+// that b wins a conflict between them.
+func precedes(resolution string, a, b *compiledPolicy) bool {
+	switch resolution {
+	case resolveNewest:
+		if !a.created.Equal(b.created) {
+			return a.created.Before(b.created)
+		}
+	default:
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+	}
+	return a.name < b.name
+}
+
+// resolve returns the policy whose value is written for each key set by the
+// matched policies, which are in order of precedence, and the keys they
+// disagree on. Dry-run policies are left out; skipped keys have no owner.
+func (s *tagSnapshot) resolve(matched []*compiledPolicy) (map[string]*compiledPolicy, []policyConflict) {
+	owners := map[string]*compiledPolicy{}
+	var setters map[string][]*compiledPolicy
+	for _, p := range matched {
+		if p.dryRun {
+			continue
+		}
+		for k := range p.tags {
+			if prev, ok := owners[k]; ok {
+				if setters == nil {
+					setters = map[string][]*compiledPolicy{}
+				}
+				if setters[k] == nil {
+					setters[k] = []*compiledPolicy{prev}
+				}
+				setters[k] = append(setters[k], p)
+			}
+			owners[k] = p
+		}
+	}
+	var conflicts []policyConflict
+	for k, ps := range setters {
+		c := policyConflict{Key: k, Winner: owners[k].name}
+		agree := true
+		for _, p := range ps {
+			c.Policies = append(c.Policies, p.name)
+			c.Values = append(c.Values, p.tags[k])
+			agree = agree && p.tags[k] == ps[0].tags[k]
+		}
+		if agree {
+			continue
+		}
+		if s.resolution == resolveSkip {
+			delete(owners, k)
+			c.Winner = ""
+		}
+		conflicts = append(conflicts, c)
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Key < conflicts[j].Key })
+	return owners, conflicts
+}
+
+// conflicts returns the keys the TagPolicies that apply to each of
+// resourceTypes on an object with objLabels disagree on.
+func (s *tagSnapshot) conflicts(objLabels map[string]string, resourceTypes ...string) []policyConflict {
+	var out []policyConflict
+	seen := map[string]bool{}
+	for _, r := range resourceTypes {
+		_, conflicts := s.resolve(s.matching(r, objLabels))
+		for _, c := range conflicts {
+			if !seen[c.id()] {
+				seen[c.id()] = true
+				out = append(out, c)
+			}
+		}
+	}
+	return out
+}
+
+// recordConflicts replaces the conflicts found on object and returns those
+// not found on any object before, and the number of distinct conflicts.
+func (s *policyStore) recordConflicts(object string, conflicts []policyConflict) ([]policyConflict, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var added []policyConflict
+	for _, c := range conflicts {
+		id := c.id()
+		if s.conflictObjects[id] == 0 {
+			s.conflictSince[id] = s.now().UTC().Truncate(time.Second)
+			added = append(added, c)
+		}
+		s.conflictObjects[id]++
+	}
+	// The previous conflicts are dropped last, so those found again are not
+	// reported as new.
+	s.dropConflicts(object)
+	if len(conflicts) > 0 {
+		s.conflicts[object] = conflicts
+	}
+	return added, len(s.conflictObjects)
+}
+
+// dropConflicts forgets the conflicts found on object. The caller holds s.mu.
+func (s *policyStore) dropConflicts(object string) {
+	for _, c := range s.conflicts[object] {
+		id := c.id()
+		if s.conflictObjects[id]--; s.conflictObjects[id] <= 0 {
+			delete(s.conflictObjects, id)
+			delete(s.conflictSince, id)
+		}
+	}
+	delete(s.conflicts, object)
+}
+
+// forgetObject forgets the conflicts found on a deleted object and returns
+// the number of distinct conflicts left.
+func (s *policyStore) forgetObject(object string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropConflicts(object)
+	return len(s.conflictObjects)
+}
+
+// forgetConflicts forgets the conflicts the named policy is part of, e.g.
+// when it changed; the next reconcile of each object finds them again. The
+// caller holds s.mu.
+func (s *policyStore) forgetConflicts(name string) {
+	for object, conflicts := range s.conflicts {
+		for _, c := range conflicts {
+			if slices.Contains(c.Policies, name) {
+				s.dropConflicts(object)
+				break
+			}
+		}
+	}
+}
+
+// conflictCondition returns the Conflicted condition of the named policy, or
+// nil when it is in no conflict. The caller holds s.mu.
+func (s *policyStore) conflictCondition(name string, generation int64) *metav1.Condition {
+	var since time.Time
+	objects := map[string]int{}
+	byID := map[string]policyConflict{}
+	for _, conflicts := range s.conflicts {
+		for _, c := range conflicts {
+			if !slices.Contains(c.Policies, name) {
+				continue
+			}
+			id := c.id()
+			objects[id]++
+			byID[id] = c
+			if t := s.conflictSince[id]; since.IsZero() || t.Before(since) {
+				since = t
+			}
+		}
+	}
+	if len(byID) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	msgs := make([]string, 0, min(len(ids), maxConflictMessages)+1)
+	for i, id := range ids {
+		if i == maxConflictMessages {
+			msgs = append(msgs, fmt.Sprintf("and %d more", len(ids)-i))
+			break
+		}
+		msgs = append(msgs, fmt.Sprintf("%s (%d objects)", byID[id], objects[id]))
+	}
+	return &metav1.Condition{
+		Type:               conditionConflicted,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: generation,
+		LastTransitionTime: metav1.Time{Time: since},
+		Reason:             "TagConflict",
+		Message:            strings.Join(msgs, "; "),
+	}
+}
+
+// policyRef returns a reference to the named TagPolicy for Events.
+func (s *policyStore) policyRef(name string) *corev1.ObjectReference {
+	ref := &corev1.ObjectReference{APIVersion: tagPolicyGVR.GroupVersion().String(), Kind: "TagPolicy", Name: name}
+	s.mu.RLock()
+	if p := s.policies[name]; p != nil {
+		ref.UID = p.uid
+	}
+	s.mu.RUnlock()
+	return ref
+}
+
+// reportPolicyConflicts records the policy conflicts found on object, and logs and
+// emits an Event on each policy of a conflict not found before. The values of
+// LOG_REDACT_TAG_KEYS are redacted first, so they stay out of the log, the
+// Events and the Conflicted condition alike.
+func (t *Tagger) reportPolicyConflicts(object string, conflicts []policyConflict) {
+	conflicts = redactConflicts(t.redactKeys, conflicts)
+	added, total := t.policies.recordConflicts(object, conflicts)
+	t.metrics.policyConflicts.Set(float64(total))
+	resolution := t.current().resolution
+	for _, c := range added {
+		t.logger.Warn("TagPolicies disagree on a tag", "key", c.Key, "policies", c.Policies, "values", c.Values,
+			"winner", c.Winner, "resolution", resolution, "object", object)
+		for _, name := range c.Policies {
+			t.recorder.Eventf(t.policies.policyRef(name), corev1.EventTypeWarning, reasonPolicyConflict,
+				"On %s, %s (resolution %s)", object, c, resolution)
+		}
+	}
+}
+
+// forgetPolicyConflicts forgets the policy conflicts found on a deleted
+// object, so they no longer hold the Conflicted condition of its policies.
+func (t *Tagger) forgetPolicyConflicts(object string) {
+	if t.policies == nil {
+		return
+	}
+	t.metrics.policyConflicts.Set(float64(t.policies.forgetObject(object)))
+}
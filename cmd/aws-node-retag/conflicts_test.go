@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func conflictingPolicies(t *testing.T) []*compiledPolicy {
+	t.Helper()
+	day := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	var out []*compiledPolicy
+	for i, spec := range []tagPolicySpec{
+		{Tags: map[string]string{"Team": "web", "Env": "prod"}, Priority: 10},
+		{Tags: map[string]string{"Team": "ml", "Env": "prod"}},
+		{Tags: map[string]string{"Owner": "sre"}, DryRun: true},
+	} {
+		p := newTestPolicy([]string{"a-web", "b-ml", "c-dry"}[i], spec)
+		p.CreationTimestamp = metav1.Time{Time: day.Add(time.Duration(i) * time.Hour)}
+		cp, err := compilePolicy(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, cp)
+	}
+	return out
+}
+
+func TestResolveConflicts(t *testing.T) {
+	cases := []struct {
+		resolution string
+		wantTeam   string
+		wantWinner string
+	}{
+		{resolvePriority, "web", "a-web"},
+		{resolveNewest, "ml", "b-ml"},
+		{resolveSkip, "static", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.resolution, func(t *testing.T) {
+			snap := (&tagSnapshot{resolution: tc.resolution}).withPolicies(conflictingPolicies(t))
+			tags, names := snap.resourceTags(map[string]string{"Team": "static"}, resourceInstance, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			if tags["Team"] != tc.wantTeam || tags["Env"] != "prod" {
+				t.Errorf("tags = %v, want Team=%s", tags, tc.wantTeam)
+			}
+			if !reflect.DeepEqual(names, []string{"a-web", "b-ml", "c-dry"}) {
+				t.Errorf("policies = %v, want them in name order", names)
+			}
+			conflicts := snap.conflicts(nil, resourceInstance, resourceVolume)
+			if len(conflicts) != 1 {
+				t.Fatalf("conflicts = %v, want Team alone: policies agreeing on Env and dry runs do not conflict", conflicts)
+			}
+			if c := conflicts[0]; c.Key != "Team" || c.Winner != tc.wantWinner {
+				t.Errorf("conflict = %+v, want winner %q", c, tc.wantWinner)
+			}
+		})
+	}
+}
+
+func TestKeyRolesFollowResolution(t *testing.T) {
+	policies := conflictingPolicies(t)
+	policies[1].roleARN = mlRole
+	if got := (&tagSnapshot{resolution: resolveNewest}).withPolicies(policies).keyRoles(resourceInstance, nil); got["Team"] != mlRole {
+		t.Errorf("keyRoles = %v, want Team written with the newest policy's role", got)
+	}
+	if got := (&tagSnapshot{resolution: resolvePriority}).withPolicies(policies).keyRoles(resourceInstance, nil); got["Team"] != "" {
+		t.Errorf("keyRoles = %v, want Team written with the controller's credentials", got)
+	}
+	if got := (&tagSnapshot{resolution: resolveSkip}).withPolicies(policies).keyRoles(resourceInstance, nil); got["Team"] != "" {
+		t.Errorf("keyRoles = %v, want the skipped Team left out", got)
+	}
+}
+
+func TestPolicyStoreConflicts(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	store := newPolicyStore(func([]*compiledPolicy) {})
+	store.now = func() time.Time { return now }
+	for _, name := range []string{"a-web", "b-ml"} {
+		if _, err := store.set(newTestPolicy(name, tagPolicySpec{Tags: map[string]string{"Team": name}})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := policyConflict{Key: "Team", Policies: []string{"a-web", "b-ml"}, Values: []string{"a-web", "b-ml"}, Winner: "b-ml"}
+
+	added, total := store.recordConflicts("node/n1", []policyConflict{c})
+	if len(added) != 1 || total != 1 {
+		t.Fatalf("first report: added %v, total %d", added, total)
+	}
+	now = now.Add(time.Minute)
+	if added, total = store.recordConflicts("node/n2", []policyConflict{c}); len(added) != 0 || total != 1 {
+		t.Fatalf("second object: added %v, total %d; want the conflict reported once", added, total)
+	}
+
+	st := store.status("a-web", 1, emptyNodeLister())
+	if len(st.Conditions) != 1 {
+		t.Fatalf("conditions = %v, want Conflicted", st.Conditions)
+	}
+	cond := st.Conditions[0]
+	if cond.Type != conditionConflicted || cond.Status != metav1.ConditionTrue || !cond.LastTransitionTime.Time.Equal(now.Add(-time.Minute)) ||
+		!strings.Contains(cond.Message, `tag Team is set to "a-web" by a-web, "b-ml" by b-ml; b-ml wins (2 objects)`) {
+		t.Errorf("condition = %+v", cond)
+	}
+
+	// Reconciles without the conflict clear it.
+	store.recordConflicts("node/n1", nil)
+	if _, total = store.recordConflicts("node/n2", nil); total != 0 {
+		t.Errorf("total = %d after the conflict is gone, want 0", total)
+	}
+	if st := store.status("b-ml", 1, emptyNodeLister()); len(st.Conditions) != 0 {
+		t.Errorf("conditions = %v, want none", st.Conditions)
+	}
+
+	// Changing a policy forgets its conflicts; a resync does not.
+	store.recordConflicts("node/n1", []policyConflict{c})
+	if _, err := store.set(newTestPolicy("a-web", tagPolicySpec{Tags: map[string]string{"Team": "a-web"}})); err != nil {
+		t.Fatal(err)
+	}
+	if st := store.status("b-ml", 1, emptyNodeLister()); len(st.Conditions) != 1 {
+		t.Errorf("conditions = %v after a resync, want Conflicted", st.Conditions)
+	}
+	edited := newTestPolicy("a-web", tagPolicySpec{Tags: map[string]string{"Team": "a-web"}})
+	edited.Generation = 2
+	if _, err := store.set(edited); err != nil {
+		t.Fatal(err)
+	}
+	if st := store.status("b-ml", 1, emptyNodeLister()); len(st.Conditions) != 0 {
+		t.Errorf("conditions = %v after an edit, want none", st.Conditions)
+	}
+}
+
+func TestReportPolicyConflicts(t *testing.T) {
+	tagger := newStartupTagger(nil, nil)
+	recorder := record.NewFakeRecorder(10)
+	tagger.recorder = recorder
+	tagger.policies = newPolicyStore(func([]*compiledPolicy) {})
+	tagger.snapshot.Store(&tagSnapshot{resolution: resolveSkip})
+	c := policyConflict{Key: "Team", Policies: []string{"a-web", "b-ml"}, Values: []string{"web", "ml"}}
+
+	tagger.reportPolicyConflicts("pv/data", []policyConflict{c})
+	tagger.reportPolicyConflicts("pv/data", []policyConflict{c})
+	if got := testutil.ToFloat64(tagger.metrics.policyConflicts); got != 1 {
+		t.Errorf("policy_conflicts = %v, want 1", got)
+	}
+	if len(recorder.Events) != 2 {
+		t.Fatalf("%d events, want one per policy", len(recorder.Events))
+	}
+	want := `Warning PolicyConflict On pv/data, tag Team is set to "web" by a-web, "ml" by b-ml; the key is skipped (resolution skip)`
+	if e := <-recorder.Events; e != want {
+		t.Errorf("event = %q, want %q", e, want)
+	}
+}
+
+func TestPolicyConflictsForgottenOnDelete(t *testing.T) {
+	tagger := newStartupTagger(nil, nil)
+	tagger.recorder = record.NewFakeRecorder(10)
+	tagger.policies = newPolicyStore(func([]*compiledPolicy) {})
+	tagger.snapshot.Store(&tagSnapshot{resolution: resolveSkip})
+	c := policyConflict{Key: "Team", Policies: []string{"a-web", "b-ml"}, Values: []string{"web", "ml"}}
+	tagger.reportPolicyConflicts("node/n1", []policyConflict{c})
+	tagger.reportPolicyConflicts("pv/data", []policyConflict{c})
+
+	tagger.nodeDeleteFunc(context.Background(), newWorkPool(1, func(fn func()) { fn() }), nil, false)(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "n1"}})
+	if got := testutil.ToFloat64(tagger.metrics.policyConflicts); got != 1 {
+		t.Errorf("policy_conflicts = %v after the node was deleted, want 1 left on pv/data", got)
+	}
+	tagger.pvEventHandler(context.Background(), newWorkPool(1, func(fn func()) { fn() })).OnDelete(cache.DeletedFinalStateUnknown{Obj: &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "data"}}})
+	if got := testutil.ToFloat64(tagger.metrics.policyConflicts); got != 0 {
+		t.Errorf("policy_conflicts = %v after the PV was deleted, want 0", got)
+	}
+	if tagger.policies.conflictCondition("a-web", 1) != nil {
+		t.Error("a-web is still Conflicted after both objects were deleted")
+	}
+}
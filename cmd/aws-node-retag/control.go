@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// pausedAnnotation on the control ConfigMap halts all mutations while "true".
+const pausedAnnotation = "aws-node-retag.io/paused"
+
+// controlState holds the runtime switches read from the control ConfigMap.
+// Operators flip them with kubectl, without restarting or scaling the controller:
+//
+//	kubectl -n kube-system annotate configmap aws-node-retag-control aws-node-retag.io/paused=true
+type controlState struct {
+	paused atomic.Bool
+}
+
+// newControlInformerFactory returns an informer factory that only watches the
+// named ConfigMap in namespace.
+func newControlInformerFactory(k8s kubernetes.Interface, namespace, name string) informers.SharedInformerFactory {
+	return informers.NewSharedInformerFactoryWithOptions(k8s, resyncPeriod,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+			o.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+}
+
+// handler keeps the state in sync with the control ConfigMap. onResume is
+// called when mutations are re-enabled so work observed while paused is redone.
+func (c *controlState) handler(m *metrics, onResume func(), logger *slog.Logger) cache.ResourceEventHandler {
+	update := func(cm *corev1.ConfigMap) {
+		paused := cm != nil && cm.Annotations[pausedAnnotation] == "true"
+		was := c.paused.Swap(paused)
+		m.setPaused(paused)
+		switch {
+		case paused && !was:
+			logger.Warn("controller paused: observing only, no AWS tags or annotations will be written")
+		case !paused && was:
+			logger.Info("controller resumed: reconciling all nodes and persistent volumes")
+			onResume()
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if cm, ok := obj.(*corev1.ConfigMap); ok {
+				update(cm)
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if cm, ok := newObj.(*corev1.ConfigMap); ok {
+				update(cm)
+			}
+		},
+		DeleteFunc: func(interface{}) {
+			update(nil)
+		},
+	}
+}
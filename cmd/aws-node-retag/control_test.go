@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestControlStatePauseResume(t *testing.T) {
+	c := &controlState{}
+	resumed := 0
+	h := c.handler(newMetrics(""), func() { resumed++ }, slog.New(slog.NewTextHandler(io.Discard, nil))).(cache.ResourceEventHandlerFuncs)
+
+	cm := func(paused string) *corev1.ConfigMap {
+		obj := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "aws-node-retag-control"}}
+		if paused != "" {
+			obj.Annotations = map[string]string{pausedAnnotation: paused}
+		}
+		return obj
+	}
+
+	h.AddFunc(cm("true"))
+	if !c.paused.Load() {
+		t.Fatal("expected paused after annotation set")
+	}
+	tagger := &Tagger{control: c}
+	if got := tagger.writeBlocked(); got != "paused" {
+		t.Errorf("writeBlocked() = %q, want paused", got)
+	}
+
+	h.UpdateFunc(cm("true"), cm("false"))
+	if c.paused.Load() {
+		t.Fatal("expected resumed after annotation cleared")
+	}
+	if resumed != 1 {
+		t.Errorf("onResume called %d times, want 1", resumed)
+	}
+	if got := tagger.writeBlocked(); got != "" {
+		t.Errorf("writeBlocked() = %q, want empty", got)
+	}
+
+	h.UpdateFunc(cm("false"), cm(""))
+	if resumed != 1 {
+		t.Errorf("onResume called again without a pause in between")
+	}
+
+	h.AddFunc(cm("true"))
+	h.DeleteFunc(cm("true"))
+	if c.paused.Load() || resumed != 2 {
+		t.Errorf("deleting the control ConfigMap should resume (paused=%v, resumed=%d)", c.paused.Load(), resumed)
+	}
+}
+
+func TestPausedReconcileNotCountedAsTagged(t *testing.T) {
+	k8s := fake.NewSimpleClientset(taintedNode(nil))
+	api := &instanceEC2{}
+	tagger := newStartupTagger(k8s, api)
+	tagger.recorder = record.NewFakeRecorder(10)
+	tagger.control = &controlState{}
+	tagger.control.paused.Store(true)
+
+	if err := tagger.tagNode(context.Background(), taintedNode(nil), false); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.createTags) != 0 {
+		t.Fatalf("CreateTags calls = %v while paused, want none", api.createTags)
+	}
+	if got := testutil.ToFloat64(tagger.metrics.tagged.WithLabelValues(kindNode)); got != 0 {
+		t.Errorf("tagged_total{kind=node} = %v while paused, want 0", got)
+	}
+
+	tagger.control.paused.Store(false)
+	if err := tagger.tagNode(context.Background(), taintedNode(nil), false); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(tagger.metrics.tagged.WithLabelValues(kindNode)); got != 1 {
+		t.Errorf("tagged_total{kind=node} = %v after resuming, want 1", got)
+	}
+}
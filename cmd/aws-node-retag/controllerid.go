@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// controllerLabel is the constant metric label and log attribute carrying
+// CONTROLLER_ID.
+const controllerLabel = "controller"
+
+// controllerIDPattern keeps CONTROLLER_ID usable as an annotation name suffix
+// (tagged-<id> fits the 63-character limit) and a metric label value.
+var controllerIDPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,54}[a-z0-9])?$`)
+
+func validateControllerID(id string) error {
+	if !controllerIDPattern.MatchString(id) {
+		return fmt.Errorf("%q must be at most 56 lowercase alphanumeric characters or '-', starting and ending with an alphanumeric character", id)
+	}
+	return nil
+}
+
+// controllerAnnotation returns the annotation key of the controller with the
+// given ID: key itself for the default, unnamed controller, key-<id>
+// otherwise, so controllers with different IDs keep separate markers.
+func controllerAnnotation(key, id string) string {
+	if id == "" {
+		return key
+	}
+	return key + "-" + id
+}
+
+// controllerName names the controller in Events, aws-node-retag-<id> for a
+// controller with an ID.
+func controllerName(id string) string {
+	return controllerAnnotation("aws-node-retag", id)
+}
+
+// taggedKey is the annotation marking nodes and PVs tagged by this controller.
+func (t *Tagger) taggedKey() string {
+	return controllerAnnotation(annotationKey, t.controllerID)
+}
+
+// statusKey is the annotation recording this controller's last tagging of a
+// node.
+func (t *Tagger) statusKey() string {
+	return controllerAnnotation(statusAnnotation, t.controllerID)
+}
+
+// forceKey is the annotation requesting a re-tag from this controller.
+func (t *Tagger) forceKey() string {
+	return controllerAnnotation(forceAnnotation, t.controllerID)
+}
+
+// isTagged reports whether the object's annotations mark it tagged by this
+// controller.
+func (t *Tagger) isTagged(annotations map[string]string) bool {
+	return annotations[t.taggedKey()] == annotationValue
+}
+
+// forceRequested reports whether the object's annotations request a re-tag
+// from this controller.
+func (t *Tagger) forceRequested(annotations map[string]string) bool {
+	return annotations[t.forceKey()] == "true"
+}
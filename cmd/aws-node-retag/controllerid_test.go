@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestValidateControllerID(t *testing.T) {
+	for _, id := range []string{"team", "platform-1", "a", strings.Repeat("a", 56)} {
+		if err := validateControllerID(id); err != nil {
+			t.Errorf("validateControllerID(%q) = %v", id, err)
+		}
+	}
+	for _, id := range []string{"Team", "-team", "team-", "team_a", "team.a", strings.Repeat("a", 57)} {
+		if err := validateControllerID(id); err == nil {
+			t.Errorf("validateControllerID(%q) succeeded, want an error", id)
+		}
+	}
+}
+
+func TestControllerAnnotations(t *testing.T) {
+	if got := (&Tagger{}).taggedKey(); got != "aws-node-retag.io/tagged" {
+		t.Errorf("default taggedKey = %q", got)
+	}
+	tagger := &Tagger{controllerID: "team"}
+	if got := tagger.taggedKey(); got != "aws-node-retag.io/tagged-team" {
+		t.Errorf("taggedKey = %q", got)
+	}
+	if !tagger.forceRequested(map[string]string{"aws-node-retag.io/force-team": "true"}) || tagger.forceRequested(map[string]string{forceAnnotation: "true"}) {
+		t.Error("forceRequested must only honour the controller's own force annotation")
+	}
+}
+
+// TestControllerMetricsCheckpoint checks that the constant controller label
+// is left out of checkpoints, so they restore onto the labelled counters.
+func TestControllerMetricsCheckpoint(t *testing.T) {
+	before := newMetrics("team")
+	before.succeeded(kindNode)
+	samples, err := before.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := newMetrics("team")
+	if n := after.restore(samples); n != 1 {
+		t.Fatalf("restore() = %d, want 1", n)
+	}
+	if got := testutil.ToFloat64(after.tagged.WithLabelValues(kindNode)); got != 1 {
+		t.Errorf("tagged{node} = %v, want 1", got)
+	}
+	want := `
+# HELP aws_node_retag_tagged_total Nodes and PersistentVolumes whose AWS resources were tagged successfully.
+# TYPE aws_node_retag_tagged_total counter
+aws_node_retag_tagged_total{controller="team",kind="node"} 1
+`
+	if err := testutil.GatherAndCompare(after.registry, strings.NewReader(want), metricsNamespace+"_tagged_total"); err != nil {
+		t.Error(err)
+	}
+}
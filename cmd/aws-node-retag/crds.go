@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/yaml"
+)
+
+// crdFiles are the CRDs the controller installs (INSTALL_CRDS), copies of
+// helm/aws-node-retag/crds/ since go:embed cannot reach outside the package.
+//
+//go:embed crds/*.yaml
+var crdFiles embed.FS
+
+// crdRevisionAnnotation counts the changes of a CRD file. An installed CRD
+// is upgraded when its revision is lower than the embedded one, or it has
+// none (installed by an older chart); a higher one belongs to a newer
+// controller and is left alone, so a rollback does not downgrade it.
+const crdRevisionAnnotation = "aws-node-retag.io/crd-revision"
+
+var crdGVR = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+const (
+	// crdEstablishInterval and crdEstablishTimeout bound the wait for an
+	// installed CRD to be served.
+	crdEstablishInterval = time.Second
+	crdEstablishTimeout  = time.Minute
+)
+
+// crdConversion converts a custom resource read in one version of its CRD
+// to the schema of another; its apiVersion is set by the caller.
+type crdConversion func(obj *unstructured.Unstructured) error
+
+// crdConversionKey identifies a conversion by CRD name and versions.
+type crdConversionKey struct {
+	crd, from, to string
+}
+
+// crdConversions holds the conversions of the stored custom resources whose
+// schema differs between versions. A version pair without one, like every
+// pair while TagPolicy has the single version v1alpha1, only changes the
+// apiVersion. A new storage version is added alongside the old ones, which
+// stay served until a release has migrated their objects.
+var crdConversions = map[crdConversionKey]crdConversion{}
+
+// crdInstaller installs and upgrades the embedded CRDs.
+type crdInstaller struct {
+	dyn         dynamic.Interface
+	logger      *slog.Logger
+	conversions map[crdConversionKey]crdConversion
+	interval    time.Duration
+	timeout     time.Duration
+}
+
+func newCRDInstaller(dyn dynamic.Interface, logger *slog.Logger) *crdInstaller {
+	return &crdInstaller{dyn: dyn, logger: logger, conversions: crdConversions, interval: crdEstablishInterval, timeout: crdEstablishTimeout}
+}
+
+// embeddedCRDs parses the embedded CRD files.
+func embeddedCRDs() ([]*unstructured.Unstructured, error) {
+	names, err := crdFiles.ReadDir("crds")
+	if err != nil {
+		return nil, err
+	}
+	var out []*unstructured.Unstructured
+	for _, e := range names {
+		data, err := crdFiles.ReadFile(path.Join("crds", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		crd := &unstructured.Unstructured{}
+		if err := yaml.Unmarshal(data, &crd.Object); err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		out = append(out, crd)
+	}
+	return out, nil
+}
+
+// installAll installs or upgrades every embedded CRD.
+func (c *crdInstaller) installAll(ctx context.Context) error {
+	crds, err := embeddedCRDs()
+	if err != nil {
+		return err
+	}
+	for _, crd := range crds {
+		if err := c.install(ctx, crd); err != nil {
+			return fmt.Errorf("CRD %s: %w", crd.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// install creates want, or replaces the spec of the installed CRD when want
+// is a newer revision, then waits for it to be served and migrates the
+// objects stored in other versions to its storage version.
+func (c *crdInstaller) install(ctx context.Context, want *unstructured.Unstructured) error {
+	crds := c.dyn.Resource(crdGVR)
+	name := want.GetName()
+	revision := crdRevision(want)
+	log := c.logger.With("crd", name, "revision", revision)
+	changed := false
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cur, err := crds.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			if _, err := crds.Create(ctx, want, metav1.CreateOptions{}); err != nil {
+				return err
+			}
+			log.Info("installed CRD")
+			changed = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		installed := crdRevision(cur)
+		switch {
+		case installed > revision:
+			log.Info("installed CRD is newer than the controller's, leaving it", "installedRevision", installed)
+			return nil
+		case installed == revision:
+			return nil
+		}
+		if missing := unservedStoredVersions(cur, want); len(missing) > 0 {
+			return fmt.Errorf("objects are stored in versions %v that revision %d no longer serves; upgrade through a release serving them first", missing, revision)
+		}
+		cur.Object["spec"] = want.Object["spec"]
+		annotations := cur.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		for k, v := range want.GetAnnotations() {
+			annotations[k] = v
+		}
+		cur.SetAnnotations(annotations)
+		if _, err := crds.Update(ctx, cur, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		log.Info("upgraded CRD", "previousRevision", installed)
+		changed = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if changed {
+		if err := c.waitEstablished(ctx, name); err != nil {
+			return err
+		}
+	}
+	return c.migrate(ctx, name)
+}
+
+// waitEstablished waits until the API server serves the CRD.
+func (c *crdInstaller) waitEstablished(ctx context.Context, name string) error {
+	err := wait.PollUntilContextTimeout(ctx, c.interval, c.timeout, true, func(ctx context.Context) (bool, error) {
+		crd, err := c.dyn.Resource(crdGVR).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		conditions, _, _ := unstructured.NestedSlice(crd.Object, "status", "conditions")
+		for _, cond := range conditions {
+			cond, _ := cond.(map[string]any)
+			if cond["type"] == "Established" && cond["status"] == "True" {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("waiting for the CRD to be established: %w", err)
+	}
+	return nil
+}
+
+// migrate rewrites the objects stored in versions other than the storage
+// version of the CRD, converting them, so they are stored in it, and then
+// drops those versions from status.storedVersions, after which a later
+// revision may stop serving them. An object written since it was listed is
+// already stored in the storage version.
+func (c *crdInstaller) migrate(ctx context.Context, name string) error {
+	crd, err := c.dyn.Resource(crdGVR).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	storage := crdStorageVersion(crd)
+	stored, _, _ := unstructured.NestedStringSlice(crd.Object, "status", "storedVersions")
+	if storage == "" || len(stored) == 0 || slices.Equal(stored, []string{storage}) {
+		return nil
+	}
+	group, _, _ := unstructured.NestedString(crd.Object, "spec", "group")
+	plural, _, _ := unstructured.NestedString(crd.Object, "spec", "names", "plural")
+	to := schema.GroupVersionResource{Group: group, Version: storage, Resource: plural}
+	for _, from := range stored {
+		if from == storage {
+			continue
+		}
+		n, err := c.migrateVersion(ctx, name, to.GroupResource().WithVersion(from), to)
+		if err != nil {
+			return fmt.Errorf("migrating %s objects to %s: %w", from, storage, err)
+		}
+		c.logger.Info("migrated stored objects to the CRD's storage version", "crd", name, "from", from, "to", storage, "objects", n)
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		crd, err := c.dyn.Resource(crdGVR).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if err := unstructured.SetNestedStringSlice(crd.Object, []string{storage}, "status", "storedVersions"); err != nil {
+			return err
+		}
+		_, err = c.dyn.Resource(crdGVR).UpdateStatus(ctx, crd, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// migrateVersion rewrites the objects read in from as to, returning their
+// number.
+func (c *crdInstaller) migrateVersion(ctx context.Context, crd string, from, to schema.GroupVersionResource) (int, error) {
+	list, err := c.dyn.Resource(from).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return 0, err
+	}
+	convert := c.conversions[crdConversionKey{crd: crd, from: from.Version, to: to.Version}]
+	for i := range list.Items {
+		obj := &list.Items[i]
+		if convert != nil {
+			if err := convert(obj); err != nil {
+				return 0, fmt.Errorf("%s: %w", obj.GetName(), err)
+			}
+		}
+		obj.SetAPIVersion(to.GroupVersion().String())
+		_, err := c.dyn.Resource(to).Namespace(obj.GetNamespace()).Update(ctx, obj, metav1.UpdateOptions{})
+		if err != nil && !apierrors.IsConflict(err) && !apierrors.IsNotFound(err) {
+			return 0, fmt.Errorf("%s: %w", obj.GetName(), err)
+		}
+	}
+	return len(list.Items), nil
+}
+
+// crdRevision returns the revision annotation of crd, 0 without one.
+func crdRevision(crd *unstructured.Unstructured) int {
+	n, _ := strconv.Atoi(crd.GetAnnotations()[crdRevisionAnnotation])
+	return n
+}
+
+// crdVersions returns the versions of crd with the given flag set.
+func crdVersions(crd *unstructured.Unstructured, flag string) []string {
+	versions, _, _ := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	var out []string
+	for _, v := range versions {
+		v, _ := v.(map[string]any)
+		if set, _ := v[flag].(bool); set {
+			name, _ := v["name"].(string)
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// crdStorageVersion returns the storage version of crd.
+func crdStorageVersion(crd *unstructured.Unstructured) string {
+	if v := crdVersions(crd, "storage"); len(v) == 1 {
+		return v[0]
+	}
+	return ""
+}
+
+// unservedStoredVersions returns the versions objects of cur are stored in
+// that want does not serve, whose objects could no longer be read.
+func unservedStoredVersions(cur, want *unstructured.Unstructured) []string {
+	stored, _, _ := unstructured.NestedStringSlice(cur.Object, "status", "storedVersions")
+	served := crdVersions(want, "served")
+	var out []string
+	for _, v := range stored {
+		if !slices.Contains(served, v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// installCRDs installs the embedded CRDs at startup. A controller without
+// the RBAC to manage CRDs, as when they are managed by GitOps without
+// INSTALL_CRDS=false, logs it and goes on with the installed ones.
+func installCRDs(ctx context.Context, dyn dynamic.Interface, logger *slog.Logger) error {
+	err := newCRDInstaller(dyn, logger).installAll(ctx)
+	if apierrors.IsForbidden(err) {
+		logger.Warn("not allowed to manage CRDs, using the installed ones; set INSTALL_CRDS=false if they are managed elsewhere", "error", err)
+		return nil
+	}
+	return err
+}
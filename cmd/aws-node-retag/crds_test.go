@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestEmbeddedCRDsMatchChart(t *testing.T) {
+	entries, err := crdFiles.ReadDir("crds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chart, err := os.ReadDir(filepath.Join("..", "..", "helm", "aws-node-retag", "crds"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(chart) {
+		t.Errorf("%d embedded CRDs, %d in the chart", len(entries), len(chart))
+	}
+	for _, e := range entries {
+		embedded, _ := crdFiles.ReadFile("crds/" + e.Name())
+		want, err := os.ReadFile(filepath.Join("..", "..", "helm", "aws-node-retag", "crds", e.Name()))
+		if err != nil || !bytes.Equal(embedded, want) {
+			t.Errorf("crds/%s differs from the chart's copy (%v)", e.Name(), err)
+		}
+	}
+	crds, err := embeddedCRDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, crd := range crds {
+		if crdRevision(crd) < 1 || crdStorageVersion(crd) == "" {
+			t.Errorf("%s: revision %d, storage version %q", crd.GetName(), crdRevision(crd), crdStorageVersion(crd))
+		}
+	}
+}
+
+// crdClient returns a fake dynamic client serving objs, where created and
+// updated CRDs are established at once and updates of TagPolicies in
+// versions the fake does not track are recorded in updated.
+func crdClient(updated *[]*unstructured.Unstructured, objs ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		crdGVR:       "CustomResourceDefinitionList",
+		tagPolicyGVR: "TagPolicyList",
+	}, objs...)
+	establish := func(a clienttesting.Action) (bool, runtime.Object, error) {
+		var obj runtime.Object
+		switch a := a.(type) {
+		case clienttesting.CreateAction:
+			obj = a.GetObject()
+		case clienttesting.UpdateAction:
+			obj = a.GetObject()
+		}
+		if u, ok := obj.(*unstructured.Unstructured); ok && a.GetSubresource() == "" {
+			_ = unstructured.SetNestedSlice(u.Object, []any{map[string]any{"type": "Established", "status": "True"}}, "status", "conditions")
+		}
+		return false, nil, nil
+	}
+	dyn.PrependReactor("create", "customresourcedefinitions", establish)
+	dyn.PrependReactor("update", "customresourcedefinitions", establish)
+	dyn.PrependReactor("update", "tagpolicies", func(a clienttesting.Action) (bool, runtime.Object, error) {
+		if a.GetResource() == tagPolicyGVR {
+			return false, nil, nil
+		}
+		obj := a.(clienttesting.UpdateAction).GetObject().(*unstructured.Unstructured)
+		*updated = append(*updated, obj)
+		return true, obj, nil
+	})
+	return dyn
+}
+
+func testCRDInstaller(dyn *dynamicfake.FakeDynamicClient) *crdInstaller {
+	c := newCRDInstaller(dyn, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	c.interval, c.timeout = time.Millisecond, time.Second
+	return c
+}
+
+func embeddedTagPolicyCRD(t *testing.T) *unstructured.Unstructured {
+	t.Helper()
+	crds, err := embeddedCRDs()
+	if err != nil || len(crds) != 1 {
+		t.Fatalf("embedded CRDs = %d, %v", len(crds), err)
+	}
+	return crds[0]
+}
+
+func TestInstallCRDs(t *testing.T) {
+	ctx := context.Background()
+	want := embeddedTagPolicyCRD(t)
+	get := func(dyn *dynamicfake.FakeDynamicClient) *unstructured.Unstructured {
+		crd, err := dyn.Resource(crdGVR).Get(ctx, want.GetName(), metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return crd
+	}
+
+	// Installed when missing.
+	dyn := crdClient(nil)
+	if err := testCRDInstaller(dyn).installAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(dyn); crdRevision(got) != crdRevision(want) {
+		t.Errorf("installed revision = %d, want %d", crdRevision(got), crdRevision(want))
+	}
+
+	// An older CRD, here from a chart without revisions, is upgraded and
+	// keeps its other metadata.
+	old := want.DeepCopy()
+	old.SetAnnotations(nil)
+	old.SetLabels(map[string]string{"app.kubernetes.io/managed-by": "Helm"})
+	unstructured.RemoveNestedField(old.Object, "spec", "names", "shortNames")
+	dyn = crdClient(nil, old)
+	if err := testCRDInstaller(dyn).installAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got := get(dyn)
+	if short, _, _ := unstructured.NestedStringSlice(got.Object, "spec", "names", "shortNames"); crdRevision(got) != crdRevision(want) || len(short) != 1 || got.GetLabels()["app.kubernetes.io/managed-by"] != "Helm" {
+		t.Errorf("upgraded CRD = %v", got.Object)
+	}
+
+	// A newer CRD is left alone.
+	newer := old.DeepCopy()
+	newer.SetAnnotations(map[string]string{crdRevisionAnnotation: strconv.Itoa(crdRevision(want) + 1)})
+	dyn = crdClient(nil, newer)
+	if err := testCRDInstaller(dyn).installAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if short, _, _ := unstructured.NestedStringSlice(get(dyn).Object, "spec", "names", "shortNames"); len(short) != 0 {
+		t.Error("newer CRD downgraded")
+	}
+}
+
+func TestCRDMigration(t *testing.T) {
+	ctx := context.Background()
+	// Revision 2 adds the storage version v1beta1, in which spec.tags is
+	// renamed awsTags, and still serves v1alpha1.
+	want := embeddedTagPolicyCRD(t)
+	want.SetAnnotations(map[string]string{crdRevisionAnnotation: "2"})
+	versions, _, _ := unstructured.NestedSlice(want.Object, "spec", "versions")
+	alpha := versions[0].(map[string]any)
+	beta := runtime.DeepCopyJSONValue(alpha).(map[string]any)
+	alpha["storage"], beta["name"] = false, "v1beta1"
+	_ = unstructured.SetNestedSlice(want.Object, []any{alpha, beta}, "spec", "versions")
+
+	installed := embeddedTagPolicyCRD(t)
+	installed.SetAnnotations(map[string]string{crdRevisionAnnotation: "1"})
+	_ = unstructured.SetNestedStringSlice(installed.Object, []string{"v1alpha1"}, "status", "storedVersions")
+	policy := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "aws-node-retag.io/v1alpha1",
+		"kind":       "TagPolicy",
+		"metadata":   map[string]any{"name": "gpu"},
+		"spec":       map[string]any{"tags": map[string]any{"Team": "ml"}},
+	}}
+	var updated []*unstructured.Unstructured
+	dyn := crdClient(&updated, installed, policy)
+	c := testCRDInstaller(dyn)
+	c.conversions = map[crdConversionKey]crdConversion{
+		{crd: want.GetName(), from: "v1alpha1", to: "v1beta1"}: func(obj *unstructured.Unstructured) error {
+			tags, _, _ := unstructured.NestedMap(obj.Object, "spec", "tags")
+			unstructured.RemoveNestedField(obj.Object, "spec", "tags")
+			return unstructured.SetNestedMap(obj.Object, tags, "spec", "awsTags")
+		},
+	}
+
+	if err := c.install(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	if len(updated) != 1 {
+		t.Fatalf("migrated %d objects, want 1", len(updated))
+	}
+	if team, _, _ := unstructured.NestedString(updated[0].Object, "spec", "awsTags", "Team"); updated[0].GetAPIVersion() != "aws-node-retag.io/v1beta1" || team != "ml" {
+		t.Errorf("migrated object = %v", updated[0].Object)
+	}
+	crd, err := dyn.Resource(crdGVR).Get(ctx, want.GetName(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, _, _ := unstructured.NestedStringSlice(crd.Object, "status", "storedVersions"); len(stored) != 1 || stored[0] != "v1beta1" {
+		t.Errorf("storedVersions = %v, want [v1beta1]", stored)
+	}
+
+	// A revision no longer serving a stored version is refused.
+	_ = unstructured.SetNestedSlice(want.Object, []any{beta}, "spec", "versions")
+	want.SetAnnotations(map[string]string{crdRevisionAnnotation: "3"})
+	dyn = crdClient(&updated, installed)
+	if err := testCRDInstaller(dyn).install(ctx, want); err == nil {
+		t.Error("upgraded to a revision not serving the stored v1alpha1")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// cmdDashboard is the subcommand that prints a Grafana dashboard for the
+// controller's metrics and exits.
+const cmdDashboard = "dashboard"
+
+// dashboardUID is stable so re-importing the dashboard replaces it.
+const dashboardUID = "aws-node-retag"
+
+// dashboardPanel is one graph of the dashboard. Queries reference metrics by
+// the names the metrics type registers, which TestDashboardMetrics checks.
+type dashboardPanel struct {
+	title  string
+	kind   string // "timeseries" or "stat"
+	unit   string
+	legend string
+	exprs  []string
+}
+
+// metricName returns the fully-qualified name of a controller metric.
+func metricName(name string) string {
+	return metricsNamespace + "_" + name
+}
+
+// rateQuery sums the per-second rate of a counter by the given labels.
+func rateQuery(counter, by string) string {
+	return "sum by (" + by + ") (rate(" + metricName(counter) + `{job=~"$job"}[$__rate_interval]))`
+}
+
+var dashboardPanels = []dashboardPanel{
+	{title: "Tagged per second", kind: "timeseries", unit: "ops", legend: "{{kind}}", exprs: []string{rateQuery("tagged_total", "kind")}},
+	{title: "Failures per second", kind: "timeseries", unit: "ops", legend: "{{kind}}", exprs: []string{rateQuery("failures_total", "kind")}},
+	{title: "Skipped per second", kind: "timeseries", unit: "ops", legend: "{{kind}} {{reason}}", exprs: []string{rateQuery("skipped_total", "kind, reason")}},
+	{title: "Untagged per second", kind: "timeseries", unit: "ops", legend: "{{kind}}", exprs: []string{rateQuery("untagged_total", "kind")}},
+	{title: "Quarantined writes per second", kind: "timeseries", unit: "ops", legend: "{{resource}}", exprs: []string{rateQuery("quarantined_total", "resource")}},
+	{title: "Tag conflicts per second", kind: "timeseries", unit: "ops", legend: "{{resource}}", exprs: []string{rateQuery("tag_conflicts_total", "resource")}},
+	{title: "Failure notifications per second", kind: "timeseries", unit: "ops", legend: "{{sink}} {{result}}", exprs: []string{rateQuery("notifications_total", "sink, result")}},
+	{title: "Heartbeats per second", kind: "timeseries", unit: "ops", legend: "{{kind}} {{result}}", exprs: []string{rateQuery("heartbeats_total", "kind, result")}},
+	{title: "AWS Config evaluations per second", kind: "timeseries", unit: "ops", legend: "{{result}}", exprs: []string{rateQuery("config_evaluations_total", "result")}},
+	{title: "Audit reports uploaded to S3 per second", kind: "timeseries", unit: "ops", legend: "{{result}}", exprs: []string{rateQuery("audit_exports_total", "result")}},
+	{title: "Tag overrides per second", kind: "timeseries", unit: "ops", legend: "{{action}}", exprs: []string{rateQuery("tag_overrides_total", "action")}},
+	{title: "Terminating instances tagged per second", kind: "timeseries", unit: "ops", legend: "{{taint}}", exprs: []string{rateQuery("termination_tagged_total", "taint")}},
+	{title: "Deduplicated writes per second", kind: "timeseries", unit: "ops", legend: "{{resource}}", exprs: []string{rateQuery("writes_deduplicated_total", "resource")}},
+	{title: "Tag keys denied by IAM per second", kind: "timeseries", unit: "ops", legend: "{{resource}}", exprs: []string{rateQuery("denied_tag_writes_total", "resource")}},
+	{title: "Background loop panics per second", kind: "timeseries", unit: "ops", legend: "{{loop}}", exprs: []string{rateQuery("loop_panics_total", "loop")}},
+	{title: "Node reconcile timeouts per second", kind: "timeseries", unit: "ops", legend: "{{region}}", exprs: []string{rateQuery("node_reconcile_timeouts_total", "region")}},
+	{title: "Sampled-out log lines per second", kind: "timeseries", unit: "ops", legend: "{{message}}", exprs: []string{rateQuery("log_lines_sampled_total", "message")}},
+	{title: "Instances described per second", kind: "timeseries", unit: "ops", legend: "{{strategy}}", exprs: []string{rateQuery("volume_discovery_total", "strategy")}},
+	{title: "Volume cache lookups per second", kind: "timeseries", unit: "ops", legend: "{{result}}", exprs: []string{rateQuery("volume_cache_total", "result")}},
+	{title: "Top failing nodes", kind: "timeseries", unit: "ops", legend: "{{node}}", exprs: []string{"topk(10, " + rateQuery("node_failures_total", "node") + ")"}},
+	{title: "Capped metric increments per second", kind: "timeseries", unit: "ops", legend: "{{metric}}", exprs: []string{rateQuery("metric_series_capped_total", "metric")}},
+	{title: "Paused", kind: "stat", legend: "paused", exprs: []string{"max(" + metricName("paused") + `{job=~"$job"})`}},
+	{title: "Config drift", kind: "stat", legend: "drift", exprs: []string{
+		"max(" + metricName("config_drift") + `{job=~"$job"})`,
+		"max(" + metricName("config_replicas") + `{job=~"$job"})`,
+	}},
+	{title: "Node pool rollout in progress", kind: "stat", legend: "rollout", exprs: []string{"max(" + metricName("rollout_in_progress") + `{job=~"$job"})`}},
+	{title: "Drifted resources (latest audit)", kind: "stat", legend: "drifted", exprs: []string{"max(" + metricName("audit_drifted_resources") + `{job=~"$job"})`}},
+	{title: "Config authority", kind: "stat", legend: "{{authority}}", exprs: []string{"max by (authority) (" + metricName("config_authority") + `{job=~"$job"}) == 1`}},
+	{title: "Config migration differences", kind: "stat", legend: "differences", exprs: []string{"max(" + metricName("config_migration_differences") + `{job=~"$job"})`}},
+	{title: "TagPolicy conflicts", kind: "stat", legend: "conflicts", exprs: []string{"max(" + metricName("policy_conflicts") + `{job=~"$job"})`}},
+	{title: "Features disabled by missing IAM permissions", kind: "stat", legend: "{{feature}} {{region}}", exprs: []string{"max by (feature, region) (" + metricName("feature_disabled") + `{job=~"$job"})`}},
+	{title: "Tag keys denied by IAM", kind: "stat", legend: "{{key}}", exprs: []string{"max by (key) (" + metricName("denied_tag_keys") + `{job=~"$job"})`}},
+}
+
+// dashboard returns the Grafana dashboard model of dashboardPanels, two
+// panels per row, with datasource and job variables.
+func dashboard() map[string]any {
+	datasource := map[string]any{"type": "prometheus", "uid": "${datasource}"}
+	panels := make([]map[string]any, 0, len(dashboardPanels))
+	for i, p := range dashboardPanels {
+		targets := make([]map[string]any, 0, len(p.exprs))
+		for j, expr := range p.exprs {
+			legend := p.legend
+			if j > 0 {
+				legend = "" // secondary queries use the series name
+			}
+			targets = append(targets, map[string]any{
+				"datasource":   datasource,
+				"expr":         expr,
+				"legendFormat": legend,
+				"refId":        string(rune('A' + j)),
+			})
+		}
+		panels = append(panels, map[string]any{
+			"id":          i + 1,
+			"type":        p.kind,
+			"title":       p.title,
+			"datasource":  datasource,
+			"gridPos":     map[string]int{"h": 8, "w": 12, "x": 12 * (i % 2), "y": 8 * (i / 2)},
+			"fieldConfig": map[string]any{"defaults": map[string]any{"unit": p.unit}, "overrides": []any{}},
+			"targets":     targets,
+		})
+	}
+	return map[string]any{
+		"uid":           dashboardUID,
+		"title":         "aws-node-retag",
+		"tags":          []string{"aws-node-retag"},
+		"schemaVersion": 39,
+		"editable":      true,
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"refresh":       "1m",
+		"templating": map[string]any{"list": []map[string]any{
+			{"name": "datasource", "type": "datasource", "query": "prometheus", "label": "Data source"},
+			{
+				"name": "job", "type": "query", "label": "Job", "datasource": datasource,
+				"query": "label_values(" + metricName("tagged_total") + ", job)", "refresh": 2,
+				"includeAll": true, "multi": true, "current": map[string]any{"text": "All", "value": "$__all"},
+			},
+		}},
+		"panels": panels,
+	}
+}
+
+// writeDashboard writes the dashboard JSON, ready for import into Grafana or
+// for a Grafana sidecar ConfigMap, to w.
+func writeDashboard(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dashboard())
+}
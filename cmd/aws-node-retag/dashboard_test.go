@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestDashboardMetrics keeps the dashboard in lockstep with the metrics: every
+// queried metric must be registered and every controller metric queried.
+func TestDashboardMetrics(t *testing.T) {
+	m := newMetrics("")
+	collectors := []prometheus.Collector{m.paused, m.configDrift, m.configReplicas, m.auditDrifted, m.rolloutInProgress, m.featureDisabled, m.deniedTagKeys, m.configAuthority, m.configMigrationDifferences, m.policyConflicts}
+	for _, c := range m.counters {
+		collectors = append(collectors, c)
+	}
+	fqName := regexp.MustCompile(`fqName: "([^"]+)"`)
+	registered := map[string]bool{}
+	for _, c := range collectors {
+		ch := make(chan *prometheus.Desc, 1)
+		go func() { c.Describe(ch); close(ch) }()
+		for d := range ch {
+			registered[fqName.FindStringSubmatch(d.String())[1]] = true
+		}
+	}
+
+	queried := map[string]bool{}
+	name := regexp.MustCompile(metricsNamespace + `_\w+`)
+	for _, p := range dashboardPanels {
+		for _, expr := range p.exprs {
+			for _, n := range name.FindAllString(expr, -1) {
+				queried[n] = true
+				if !registered[n] {
+					t.Errorf("panel %q queries unregistered metric %s", p.title, n)
+				}
+			}
+		}
+	}
+	for n := range registered {
+		if !queried[n] {
+			t.Errorf("metric %s has no dashboard panel", n)
+		}
+	}
+}
+
+func TestWriteDashboard(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeDashboard(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		UID    string `json:"uid"`
+		Panels []struct {
+			Targets []struct {
+				Expr string `json:"expr"`
+			} `json:"targets"`
+		} `json:"panels"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("dashboard is not valid JSON: %v", err)
+	}
+	if got.UID != dashboardUID || len(got.Panels) != len(dashboardPanels) {
+		t.Errorf("uid = %q, %d panels; want %q, %d", got.UID, len(got.Panels), dashboardUID, len(dashboardPanels))
+	}
+	if expr := got.Panels[0].Targets[0].Expr; expr != dashboardPanels[0].exprs[0] {
+		t.Errorf("first query = %q", expr)
+	}
+}
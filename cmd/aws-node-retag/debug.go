@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// explanation is the /debug/explain response.
+type explanation struct {
+	*nodeDecision
+	// Tags maps each resource to the tags that would be written for a "tag"
+	// decision. Without describe=true resources are not resolved and the
+	// entries are keyed by resource type instead, without instance attribute tags.
+	Tags  map[string]map[string]string `json:"tags,omitempty"`
+	Error string                       `json:"error,omitempty"`
+}
+
+// explainHandler serves GET /debug/explain?node=<name>[&describe=true][&force=true],
+// showing every check the controller would run for the node, every TagPolicy
+// and whether it selects the node, and the outcome. With describe=true it also
+// calls ec2:DescribeInstances (read-only) to resolve the full tag set of the
+// instance and each attached volume; force=true evaluates the node as if it
+// were not tagged yet. The instance of a node whose providerID cannot be
+// parsed is looked up as a reconcile would. Nothing is ever written.
+func (t *Tagger) explainHandler(nodes corelisters.NodeLister) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.URL.Query().Get("node")
+		if name == "" {
+			http.Error(w, "missing ?node= parameter", http.StatusBadRequest)
+			return
+		}
+		node, err := nodes.Get(name)
+		if apierrors.IsNotFound(err) {
+			http.Error(w, "node not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Force so that already-tagged nodes show what a re-tag would write.
+		resp := explanation{nodeDecision: t.resolveNode(r.Context(), node, r.URL.Query().Get("force") == "true")}
+		if resp.Action == actionTag {
+			quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+			if r.URL.Query().Get("describe") == "true" {
+				inst, err := t.describeInstance(r.Context(), resp.Region, resp.InstanceID)
+				if err != nil {
+					resp.Error = err.Error()
+				} else {
+					resp.Tags = t.nodeResourceTags(node, resp.nodeDecision, inst, attachedVolumes(inst), quiet)
+				}
+			} else {
+				resp.Tags = map[string]map[string]string{}
+				snap := resp.snapshot
+				resp.Tags[resourceVolume], _ = snap.resourceTags(snap.tags, resourceVolume, node.Labels, quiet)
+				if !resp.VolumesOnly {
+					resp.Tags[resourceInstance], _ = snap.resourceTags(snap.tags, resourceInstance, node.Labels, quiet)
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(resp)
+	}
+}
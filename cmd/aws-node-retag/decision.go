@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Node decision actions.
+const (
+	actionTag   = "tag"   // tag the instance and/or its volumes
+	actionSkip  = "skip"  // intentionally not tagged
+	actionWait  = "wait"  // not tagged yet; a later update will retry
+	actionError = "error" // cannot be tagged as-is
+)
+
+// traceStep records the result of one check while evaluating a node.
+type traceStep struct {
+	Check  string `json:"check"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// nodeDecision is the outcome of evaluating a node before any AWS call, along
+// with the trace of checks that led to it. It drives handleNode and is served
+// verbatim by the /debug/explain endpoint.
+type nodeDecision struct {
+	Node   string `json:"node"`
+	Action string `json:"action"`
+	// Reason is a short machine-readable cause for skip/wait/error actions; it
+	// doubles as the "reason" metric label.
+	Reason      string      `json:"reason,omitempty"`
+	Detail      string      `json:"detail,omitempty"`
+	InstanceID  string      `json:"instanceID,omitempty"`
+	Region      string      `json:"region,omitempty"`
+	Nodegroup   string      `json:"nodegroup,omitempty"`
+	VolumesOnly bool        `json:"volumesOnly,omitempty"`
+	Steps       []traceStep `json:"steps"`
+	// ConfigVersion identifies the tag snapshot the decision was made with.
+	ConfigVersion uint64 `json:"configVersion"`
+	// Policies lists every TagPolicy and whether it selects the node.
+	Policies []policyMatch `json:"policies,omitempty"`
+
+	// lookup is set when the instance ID is to be looked up by address, the
+	// providerID not being parseable (see instancelookup.go).
+	lookup *instanceLookup
+	// err is the error of the lookup that turned the decision into an error.
+	err error
+
+	// snapshot is used for the whole reconcile so that every resource of the
+	// node is tagged from the same configuration.
+	snapshot *tagSnapshot
+	// force is set when the re-tag was forced, so that earlier writes of the
+	// same tags are not reused (see applyDeduplicated).
+	force bool
+}
+
+// policyMatch is the result of matching one TagPolicy against a node.
+type policyMatch struct {
+	Name          string   `json:"name"`
+	Matched       bool     `json:"matched"`
+	Selector      string   `json:"selector"`
+	ResourceTypes []string `json:"resourceTypes"`
+	DryRun        bool     `json:"dryRun,omitempty"`
+}
+
+// matchedPolicies returns the names of the policies that select the node.
+func (d *nodeDecision) matchedPolicies() []string {
+	var names []string
+	for _, p := range d.Policies {
+		if p.Matched {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+// resourceTypes returns the TagPolicy resource types the node's reconcile
+// tags.
+func (d *nodeDecision) resourceTypes() []string {
+	if d.VolumesOnly {
+		return []string{resourceVolume}
+	}
+	return []string{resourceInstance, resourceVolume}
+}
+
+func (d *nodeDecision) pass(check, detail string) {
+	d.Steps = append(d.Steps, traceStep{Check: check, Passed: true, Detail: detail})
+}
+
+// stop records a failed check and finalizes the decision.
+func (d *nodeDecision) stop(check, action, reason, detail string) *nodeDecision {
+	d.Steps = append(d.Steps, traceStep{Check: check, Detail: detail})
+	d.Action, d.Reason, d.Detail = action, reason, detail
+	return d
+}
+
+// decideNode evaluates whether and how the node should be tagged. It reads only
+// the node object and controller configuration, never AWS, so the instance ID
+// of a node tagged through the providerID fallback is left to resolveNode.
+// With force, nodes already carrying the tagged annotation are tagged again.
+func (t *Tagger) decideNode(node *corev1.Node, force bool) *nodeDecision {
+	snap := t.current()
+	d := &nodeDecision{Node: node.Name, ConfigVersion: snap.version, snapshot: snap}
+	d.force = force || t.forceRequested(node.Annotations)
+
+	switch {
+	case !t.isTagged(node.Annotations):
+		d.pass("annotation", "not tagged yet")
+	case force:
+		d.pass("annotation", "already tagged, re-tagging")
+	case t.forceRequested(node.Annotations):
+		d.pass("annotation", fmt.Sprintf("already tagged, re-tagging requested by %s", t.forceKey()))
+	default:
+		return d.stop("annotation", actionSkip, "already_tagged", fmt.Sprintf("%s=%s is set", t.taggedKey(), annotationValue))
+	}
+
+	providerID := node.Spec.ProviderID
+	if providerID == "" {
+		return d.stop("providerID", actionWait, "no_provider_id", "spec.providerID is not set yet")
+	}
+	if _, ok := cutProviderIDScheme(providerID); !ok {
+		return d.stop("providerID", actionSkip, "not_aws", fmt.Sprintf("%q is not an AWS providerID", providerID))
+	}
+	info, err := parseProviderID(providerID)
+	if err != nil {
+		if d.lookup = t.instanceLookupFor(node); d.lookup == nil {
+			return d.stop("providerID", actionError, "invalid_provider_id", err.Error())
+		}
+		d.pass("providerID", fmt.Sprintf("%s; looking the instance up by address in zone %s", err, d.lookup.zone))
+		info = providerInfo{Zone: d.lookup.zone}
+	} else {
+		d.pass("providerID", providerID)
+	}
+
+	if info.Fargate {
+		return d.stop("fargate", actionSkip, "fargate", "Fargate nodes have no EC2 instance")
+	}
+	d.InstanceID = info.InstanceID
+
+	region, err := regionFromZone(info.Zone)
+	if err != nil {
+		return d.stop("region", actionError, "invalid_zone", err.Error())
+	}
+	d.Region = region
+	d.pass("region", region)
+
+	if !t.regionAllowed(region) {
+		return d.stop("allowedRegions", actionSkip, "region_not_allowed", fmt.Sprintf("region %s is not in the allowed region list", region))
+	}
+	d.pass("allowedRegions", region)
+
+	if !t.inPartition(region) {
+		return d.stop("partition", actionSkip, "partition_mismatch",
+			fmt.Sprintf("region %s is in partition %s, the controller's credentials are for %s", region, partitionForRegion(region), t.partition))
+	}
+
+	if ng := managedNodegroup(node); ng != "" {
+		d.Nodegroup = ng
+		d.VolumesOnly = t.managedVolumesOnly
+		if d.VolumesOnly {
+			d.pass("nodegroup", fmt.Sprintf("managed nodegroup %s: EKS tags the instance, tagging volumes only", ng))
+		} else {
+			d.pass("nodegroup", fmt.Sprintf("managed nodegroup %s", ng))
+		}
+	}
+
+	if t.policies != nil {
+		matched := 0
+		for _, p := range snap.policies {
+			m := policyMatch{
+				Name:          p.name,
+				Matched:       (p.resources[resourceInstance] || p.resources[resourceVolume]) && p.selector.Matches(labels.Set(node.Labels)),
+				Selector:      p.selector.String(),
+				ResourceTypes: p.resourceTypes(),
+				DryRun:        p.dryRun,
+			}
+			if m.Matched {
+				matched++
+			}
+			d.Policies = append(d.Policies, m)
+		}
+		detail := fmt.Sprintf("%d of %d TagPolicies select the node", matched, len(d.Policies))
+		if matched == 0 && len(snap.tags) == 0 && len(snap.attributeTags) == 0 && len(snap.inventoryTags) == 0 {
+			return d.stop("policies", actionSkip, "no_matching_policy", detail+" and TAGS is empty")
+		}
+		d.pass("policies", detail)
+	}
+
+	d.Action = actionTag
+	return d
+}
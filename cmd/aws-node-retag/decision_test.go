@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDecideNode(t *testing.T) {
+	node := func(providerID string, annotations, labels map[string]string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "n1", Annotations: annotations, Labels: labels},
+			Spec:       corev1.NodeSpec{ProviderID: providerID},
+		}
+	}
+	const pid = "aws:///us-east-1a/i-0123456789abcdef0"
+
+	tests := []struct {
+		name       string
+		tagger     *Tagger
+		node       *corev1.Node
+		wantAction string
+		wantReason string
+		wantSteps  int
+	}{
+		{"tag", &Tagger{}, node(pid, nil, nil), actionTag, "", 4},
+		{"already tagged", &Tagger{}, node(pid, map[string]string{annotationKey: annotationValue}, nil), actionSkip, "already_tagged", 1},
+		{"no providerID", &Tagger{}, node("", nil, nil), actionWait, "no_provider_id", 2},
+		{"not aws", &Tagger{}, node("gce://p/z/n", nil, nil), actionSkip, "not_aws", 2},
+		{"invalid providerID", &Tagger{}, node("aws:///us-east-1a/bogus", nil, nil), actionError, "invalid_provider_id", 2},
+		{"fargate", &Tagger{}, node("aws:///us-east-1a/fargate-ip-10-0-0-1.ec2.internal", nil, nil), actionSkip, "fargate", 3},
+		{"region not allowed", &Tagger{allowedRegions: map[string]bool{"eu-west-1": true}}, node(pid, nil, nil), actionSkip, "region_not_allowed", 4},
+		{"no matching policy", &Tagger{policies: newPolicyStore(func([]*compiledPolicy) {})}, node(pid, nil, nil), actionSkip, "no_matching_policy", 5},
+		{"partition mismatch", &Tagger{partition: partitionChina}, node(pid, nil, nil), actionSkip, "partition_mismatch", 5},
+		{"china partition", &Tagger{partition: partitionChina}, node("aws-cn:///cn-north-1a/i-0123456789abcdef0", nil, nil), actionTag, "", 4},
+		{"managed nodegroup", &Tagger{managedVolumesOnly: true}, node(pid, nil, map[string]string{eksNodegroupLabel: "ng-1"}), actionTag, "", 5},
+		{"tagged by another controller", &Tagger{controllerID: "team"}, node(pid, map[string]string{annotationKey: annotationValue}, nil), actionTag, "", 4},
+		{"tagged by this controller", &Tagger{controllerID: "team"}, node(pid, map[string]string{annotationKey + "-team": annotationValue}, nil), actionSkip, "already_tagged", 1},
+		{"force for another controller", &Tagger{}, node(pid, map[string]string{annotationKey: annotationValue, forceAnnotation + "-team": "true"}, nil), actionSkip, "already_tagged", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := tt.tagger.decideNode(tt.node, false)
+			if d.Action != tt.wantAction || d.Reason != tt.wantReason {
+				t.Errorf("decision = %s/%s, want %s/%s", d.Action, d.Reason, tt.wantAction, tt.wantReason)
+			}
+			if len(d.Steps) != tt.wantSteps {
+				t.Errorf("got %d trace steps, want %d: %+v", len(d.Steps), tt.wantSteps, d.Steps)
+			}
+			if last := d.Steps[len(d.Steps)-1]; last.Passed != (tt.wantAction == actionTag) {
+				t.Errorf("last step %+v: Passed = %v", last, last.Passed)
+			}
+		})
+	}
+
+	d := (&Tagger{managedVolumesOnly: true}).decideNode(node(pid, nil, map[string]string{eksNodegroupLabel: "ng-1"}), false)
+	if !d.VolumesOnly || d.Nodegroup != "ng-1" || d.InstanceID != "i-0123456789abcdef0" || d.Region != "us-east-1" {
+		t.Errorf("unexpected decision %+v", d)
+	}
+}
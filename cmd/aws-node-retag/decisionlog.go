@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// decisionRecord is one line of the decision log (DECISION_LOG): the inputs
+// of a node reconcile that tagged resources and the tags it decided on, in a
+// stable form that policy-as-code tooling can evaluate offline, e.g. CEL
+// expressions over input and output. Every field is always present, maps and
+// lists being empty rather than null, so expressions need no has() checks.
+type decisionRecord struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	Time          time.Time `json:"time"`
+	// Controller is CONTROLLER_ID, "" for a single controller.
+	Controller    string         `json:"controller"`
+	ConfigVersion uint64         `json:"configVersion"`
+	Input         decisionInput  `json:"input"`
+	Output        decisionOutput `json:"output"`
+}
+
+type decisionInput struct {
+	Node decisionNode `json:"node"`
+	// Tags are the static tags (TAGS) before templates and policies.
+	Tags map[string]string `json:"tags"`
+	// Policies are all TagPolicies in order of precedence, the last one
+	// setting a key winning a conflict under ConflictResolution.
+	Policies           []decisionPolicy `json:"policies"`
+	ConflictResolution string           `json:"conflictResolution"`
+}
+
+type decisionNode struct {
+	Name        string            `json:"name"`
+	Labels      map[string]string `json:"labels"`
+	ProviderID  string            `json:"providerId"`
+	InstanceID  string            `json:"instanceId"`
+	Region      string            `json:"region"`
+	Nodegroup   string            `json:"nodegroup"`
+	VolumesOnly bool              `json:"volumesOnly"`
+}
+
+type decisionPolicy struct {
+	Name          string            `json:"name"`
+	Selector      string            `json:"selector"`
+	ResourceTypes []string          `json:"resourceTypes"`
+	Priority      int32             `json:"priority"`
+	DryRun        bool              `json:"dryRun"`
+	Tags          map[string]string `json:"tags"`
+	// Matched reports whether the policy selects the node.
+	Matched bool `json:"matched"`
+}
+
+type decisionOutput struct {
+	Action string `json:"action"`
+	// Resources are the instance (unless only volumes are tagged) and the
+	// volumes, by ID, with the tags decided on.
+	Resources []decisionResource `json:"resources"`
+	// Policies are the names of the matched policies.
+	Policies  []string           `json:"policies"`
+	Conflicts []decisionConflict `json:"conflicts"`
+	// Error is the failure to write the tags, "" when they were written.
+	Error string `json:"error"`
+}
+
+type decisionResource struct {
+	ID   string            `json:"id"`
+	Type string            `json:"type"`
+	Tags map[string]string `json:"tags"`
+}
+
+type decisionConflict struct {
+	Key      string   `json:"key"`
+	Policies []string `json:"policies"`
+	Values   []string `json:"values"`
+	Winner   string   `json:"winner"`
+}
+
+// newDecisionRecord returns the record of the reconcile of node decided by d
+// that computed perResource, err being the failure to write them.
+func newDecisionRecord(node *corev1.Node, d *nodeDecision, perResource map[string]map[string]string, controllerID string, now time.Time, err error) *decisionRecord {
+	snap := d.snapshot
+	r := &decisionRecord{
+		SchemaVersion: decisionRecordSchemaVersion,
+		Time:          now.UTC().Truncate(time.Second),
+		Controller:    controllerID,
+		ConfigVersion: d.ConfigVersion,
+		Input: decisionInput{
+			Node: decisionNode{
+				Name:        node.Name,
+				Labels:      orEmpty(node.Labels),
+				ProviderID:  node.Spec.ProviderID,
+				InstanceID:  d.InstanceID,
+				Region:      d.Region,
+				Nodegroup:   d.Nodegroup,
+				VolumesOnly: d.VolumesOnly,
+			},
+			Tags:               orEmpty(snap.tags),
+			Policies:           make([]decisionPolicy, 0, len(snap.policies)),
+			ConflictResolution: snap.resolution,
+		},
+		Output: decisionOutput{
+			Action:    d.Action,
+			Resources: make([]decisionResource, 0, len(perResource)),
+			Policies:  d.matchedPolicies(),
+			Conflicts: []decisionConflict{},
+		},
+	}
+	// d.Policies holds the matches of snap.policies, in the same order.
+	for i, p := range snap.policies {
+		dp := decisionPolicy{
+			Name:          p.name,
+			Selector:      p.selector.String(),
+			ResourceTypes: append([]string{}, p.resourceTypes()...),
+			Priority:      p.priority,
+			DryRun:        p.dryRun,
+			Tags:          orEmpty(p.tags),
+		}
+		if i < len(d.Policies) {
+			dp.Matched = d.Policies[i].Matched
+		}
+		r.Input.Policies = append(r.Input.Policies, dp)
+	}
+	if r.Output.Policies == nil {
+		r.Output.Policies = []string{}
+	}
+	for _, id := range sortedTagKeys(perResource) {
+		typ := resourceVolume
+		if id == d.InstanceID {
+			typ = resourceInstance
+		}
+		r.Output.Resources = append(r.Output.Resources, decisionResource{ID: id, Type: typ, Tags: orEmpty(perResource[id])})
+	}
+	for _, c := range snap.conflicts(node.Labels, d.resourceTypes()...) {
+		r.Output.Conflicts = append(r.Output.Conflicts, decisionConflict{Key: c.Key, Policies: c.Policies, Values: c.Values, Winner: c.Winner})
+	}
+	if err != nil {
+		r.Output.Error = err.Error()
+	}
+	return r
+}
+
+// orEmpty returns m, or an empty map when it is nil.
+func orEmpty(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
+
+// decisionLog appends decision records as JSON lines to DECISION_LOG, or to
+// stdout for "-". A file larger than maxSize is renamed with a .1 suffix,
+// replacing the previous one, before the next record is written.
+type decisionLog struct {
+	path    string
+	maxSize int64
+
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+	size int64
+}
+
+// newDecisionLog returns the log of cfg, or nil when DECISION_LOG is unset.
+func newDecisionLog(cfg *Config) *decisionLog {
+	if cfg.DecisionLog == "" {
+		return nil
+	}
+	l := &decisionLog{path: cfg.DecisionLog, maxSize: cfg.DecisionLogMaxSize}
+	if l.path == "-" {
+		l.w = os.Stdout
+	}
+	return l
+}
+
+// write appends r.
+func (l *decisionLog) write(r *decisionRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("encode decision record: %w", err)
+	}
+	line = append(line, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.w == nil || (l.file != nil && l.maxSize > 0 && l.size >= l.maxSize) {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	n, err := l.w.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+// open opens the log file for appending, first rotating it when full. The
+// caller holds l.mu.
+func (l *decisionLog) open() error {
+	if l.file != nil {
+		l.file.Close()
+		l.file, l.w = nil, nil
+	}
+	if fi, err := os.Stat(l.path); err == nil && l.maxSize > 0 && fi.Size() >= l.maxSize {
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return fmt.Errorf("rotate decision log: %w", err)
+		}
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("open decision log: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open decision log: %w", err)
+	}
+	l.file, l.w, l.size = f, f, fi.Size()
+	return nil
+}
+
+// Close closes the log file.
+func (l *decisionLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file, l.w = nil, nil
+	return err
+}
+
+// recordDecision appends the record of a node reconcile to the decision log,
+// if any; a failure is logged, never failing the reconcile.
+func (t *Tagger) recordDecision(node *corev1.Node, d *nodeDecision, perResource map[string]map[string]string, err error) {
+	if t.decisions == nil {
+		return
+	}
+	if werr := t.decisions.write(newDecisionRecord(node, d, perResource, t.controllerID, time.Now(), err)); werr != nil {
+		t.logger.Warn("failed to write decision record", "node", node.Name, "error", werr)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNewDecisionRecord(t *testing.T) {
+	snap := (&tagSnapshot{tags: map[string]string{"Env": "prod"}, resolution: resolvePriority}).withPolicies(conflictingPolicies(t))
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "n1"},
+		Spec:       corev1.NodeSpec{ProviderID: "aws:///us-east-1a/i-1"},
+	}
+	d := &nodeDecision{Action: actionTag, InstanceID: "i-1", Region: "us-east-1", snapshot: snap, ConfigVersion: snap.version}
+	for _, p := range snap.policies {
+		d.Policies = append(d.Policies, policyMatch{Name: p.name, Matched: p.name != "c-dry"})
+	}
+	perResource := map[string]map[string]string{"i-1": {"Team": "web"}, "vol-1": nil}
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+
+	r := newDecisionRecord(node, d, perResource, "blue", now, errors.New("UnauthorizedOperation"))
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "null") {
+		t.Errorf("record %s has nulls, want empty maps and lists", data)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["time"] != "2026-10-15T10:00:00Z" || got["controller"] != "blue" {
+		t.Errorf("header = %v", got)
+	}
+
+	if names := []string{r.Input.Policies[0].Name, r.Input.Policies[1].Name, r.Input.Policies[2].Name}; !reflect.DeepEqual(names, []string{"b-ml", "c-dry", "a-web"}) {
+		t.Errorf("policies = %v, want them in order of precedence", names)
+	}
+	if p := r.Input.Policies[2]; !p.Matched || p.Priority != 10 || p.Tags["Team"] != "web" || !reflect.DeepEqual(p.ResourceTypes, []string{resourceInstance, resourceVolume, resourcePersistentVolume}) {
+		t.Errorf("policy = %+v", p)
+	}
+	want := []decisionResource{
+		{ID: "i-1", Type: resourceInstance, Tags: map[string]string{"Team": "web"}},
+		{ID: "vol-1", Type: resourceVolume, Tags: map[string]string{}},
+	}
+	if !reflect.DeepEqual(r.Output.Resources, want) {
+		t.Errorf("resources = %+v, want %+v", r.Output.Resources, want)
+	}
+	if len(r.Output.Conflicts) != 1 || r.Output.Conflicts[0].Key != "Team" || r.Output.Conflicts[0].Winner != "a-web" {
+		t.Errorf("conflicts = %+v", r.Output.Conflicts)
+	}
+	if r.Output.Error != "UnauthorizedOperation" {
+		t.Errorf("error = %q", r.Output.Error)
+	}
+}
+
+func TestDecisionLogRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.jsonl")
+	l := newDecisionLog(&Config{DecisionLog: path, DecisionLogMaxSize: 1})
+	defer l.Close()
+	for _, node := range []string{"n1", "n2", "n3"} {
+		r := &decisionRecord{Input: decisionInput{Node: decisionNode{Name: node}}}
+		if err := l.write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for file, node := range map[string]string{path: "n3", path + ".1": "n2"} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"name":"`+node+`"`) {
+			t.Errorf("%s = %q, want the record of %s alone", filepath.Base(file), data, node)
+		}
+	}
+}
+
+func TestTagNodeRecordsDecision(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.jsonl")
+	k8s := fake.NewSimpleClientset(taintedNode(nil))
+	tagger := newStartupTagger(k8s, &instanceEC2{})
+	tagger.decisions = newDecisionLog(&Config{DecisionLog: path})
+	defer tagger.decisions.Close()
+
+	tagger.handleNode(context.Background(), taintedNode(nil))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r decisionRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatalf("record %q: %v", data, err)
+	}
+	if r.Input.Node.Name != "n1" || r.Output.Action != actionTag || len(r.Output.Resources) != 2 || r.Output.Resources[0].Tags["Env"] != "prod" {
+		t.Errorf("record = %+v", r)
+	}
+}
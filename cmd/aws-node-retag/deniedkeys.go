@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// deniedTagKeys are the tag keys the IAM policy of a role does not let the
+// controller write, e.g. through an aws:TagKeys condition on ec2:CreateTags
+// or a permissions boundary. Such a policy denies a whole CreateTags call
+// carrying one of them, so when a call with several keys is denied the keys
+// are written again in halves to find the denied ones, and those are then
+// left out of every write with the role, with one warning each and
+// aws_node_retag_denied_tag_keys set to 1, until a full re-tag (SIGHUP,
+// /admin/retag), e.g. once the policy is fixed. A nil *deniedTagKeys denies
+// nothing.
+type deniedTagKeys struct {
+	metrics *metrics
+	logger  *slog.Logger
+
+	mu sync.Mutex
+	// keys holds the denied keys, as written (with CLUSTER_TAG_PREFIX), by
+	// role ARN, "" for the controller's own credentials.
+	keys map[string]map[string]bool
+	// callDenied holds the roles whose writes were denied whatever their
+	// keys, which are not split again until one succeeds.
+	callDenied map[string]bool
+}
+
+func newDeniedTagKeys(m *metrics, logger *slog.Logger) *deniedTagKeys {
+	return &deniedTagKeys{metrics: m, logger: logger, keys: map[string]map[string]bool{}, callDenied: map[string]bool{}}
+}
+
+// denied reports whether key may not be written as roleARN.
+func (d *deniedTagKeys) denied(roleARN, key string) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.keys[roleARN][key]
+}
+
+// filter returns tags without the keys denied to roleARN, and the sorted keys
+// it dropped. tags is returned as is when nothing is dropped.
+func (d *deniedTagKeys) filter(roleARN string, tags map[string]string) (map[string]string, []string) {
+	if d == nil {
+		return tags, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	denied := d.keys[roleARN]
+	var dropped []string
+	for k := range tags {
+		if denied[k] {
+			dropped = append(dropped, k)
+		}
+	}
+	if len(dropped) == 0 {
+		return tags, nil
+	}
+	sort.Strings(dropped)
+	out := make(map[string]string, len(tags)-len(dropped))
+	for k, v := range tags {
+		if !denied[k] {
+			out[k] = v
+		}
+	}
+	return out, dropped
+}
+
+// learn records keys as denied to roleARN, err being the denied call.
+func (d *deniedTagKeys) learn(roleARN string, keys []string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.keys[roleARN] == nil {
+		d.keys[roleARN] = map[string]bool{}
+	}
+	for _, k := range keys {
+		if d.keys[roleARN][k] {
+			continue
+		}
+		d.keys[roleARN][k] = true
+		d.metrics.deniedTagKeys.WithLabelValues(k).Set(1)
+		d.logger.Warn("IAM policy denies writing tag key, not writing it until the next full re-tag",
+			"key", k, "roleARN", roleARN, "error", eventError(err))
+	}
+}
+
+// splittable reports whether a denied write as roleARN is split by key.
+func (d *deniedTagKeys) splittable(roleARN string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.callDenied[roleARN]
+}
+
+// setCallDenied records whether the last write as roleARN was denied
+// whatever its keys.
+func (d *deniedTagKeys) setCallDenied(roleARN string, denied bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if denied {
+		d.callDenied[roleARN] = true
+	} else {
+		delete(d.callDenied, roleARN)
+	}
+}
+
+// reset forgets every denied key.
+func (d *deniedTagKeys) reset() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, keys := range d.keys {
+		for k := range keys {
+			d.metrics.deniedTagKeys.DeleteLabelValues(k)
+		}
+	}
+	d.keys = map[string]map[string]bool{}
+	d.callDenied = map[string]bool{}
+}
+
+// nodeDeniedKeys returns the sorted keys of perResource that were not
+// written because they are denied to the role writing them.
+func (t *Tagger) nodeDeniedKeys(perResource map[string]map[string]string, rolesFor func(id string) map[string]string) []string {
+	if t.deniedKeys == nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	for id, tags := range perResource {
+		roles := rolesFor(id)
+		for k := range tags {
+			if t.deniedKeys.denied(roles[k], t.clusterKey(k)) {
+				seen[k] = true
+			}
+		}
+	}
+	return sortedTagKeys(seen)
+}
+
+// createTagsSplitting writes tags with b and, when the call is denied and
+// carries several keys, writes them again in halves to find the keys the
+// IAM policy denies: the other keys are written and the denied ones learned.
+// The call's error is returned when every key is denied on its own, i.e.
+// the write itself is.
+func (t *Tagger) createTagsSplitting(ctx context.Context, b tagBackend, roleARN, region string, resourceIDs []string, tags map[string]string) error {
+	err := b.createTags(ctx, roleARN, region, resourceIDs, tags)
+	d := t.deniedKeys
+	if d == nil {
+		return err
+	}
+	if err == nil {
+		d.setCallDenied(roleARN, false)
+		return nil
+	}
+	if len(tags) < 2 || !isPermissionDenied(err) || !d.splittable(roleARN) {
+		return err
+	}
+	denied, perr := t.probeDeniedKeys(ctx, b, roleARN, region, resourceIDs, sortedTagKeys(tags), tags)
+	if perr != nil {
+		return perr
+	}
+	if len(denied) == len(tags) {
+		d.setCallDenied(roleARN, true)
+		return err
+	}
+	d.learn(roleARN, denied, err)
+	t.countDeniedKeys(resourceIDs, denied)
+	return nil
+}
+
+// probeDeniedKeys writes the tags of keys, which were denied together, in
+// halves and splits the denied halves further; it returns the keys denied on
+// their own.
+func (t *Tagger) probeDeniedKeys(ctx context.Context, b tagBackend, roleARN, region string, resourceIDs, keys []string, tags map[string]string) ([]string, error) {
+	if len(keys) == 1 {
+		return keys, nil
+	}
+	var denied []string
+	mid := len(keys) / 2
+	for _, half := range [][]string{keys[:mid], keys[mid:]} {
+		subset := make(map[string]string, len(half))
+		for _, k := range half {
+			subset[k] = tags[k]
+		}
+		err := b.createTags(ctx, roleARN, region, resourceIDs, subset)
+		if err == nil {
+			continue
+		}
+		if !isPermissionDenied(err) {
+			return nil, err
+		}
+		d, err := t.probeDeniedKeys(ctx, b, roleARN, region, resourceIDs, half, tags)
+		if err != nil {
+			return nil, err
+		}
+		denied = append(denied, d...)
+	}
+	return denied, nil
+}
+
+// countDeniedKeys counts the denied keys not written to each resource.
+func (t *Tagger) countDeniedKeys(resourceIDs, keys []string) {
+	for _, id := range resourceIDs {
+		t.metrics.deniedTagWrites.WithLabelValues(resourceKind(id)).Add(float64(len(keys)))
+	}
+}
+
+// deniedKeysError is returned for a write whose keys are all denied.
+func deniedKeysError(keys []string) error {
+	return fmt.Errorf("tag keys %s denied by IAM", strings.Join(keys, ", "))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// boundaryEC2 denies the CreateTags calls carrying one of the keys in denied,
+// as an aws:TagKeys condition does, or every call with denyAll; it records
+// the calls that succeed.
+type boundaryEC2 struct {
+	instanceEC2
+	denied   map[string]bool
+	denyAll  bool
+	attempts int
+}
+
+func (f *boundaryEC2) CreateTags(ctx context.Context, in *ec2.CreateTagsInput, opts ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	f.attempts++
+	for _, tag := range in.Tags {
+		if f.denyAll || f.denied[aws.ToString(tag.Key)] {
+			return nil, &smithy.GenericAPIError{Code: "UnauthorizedOperation", Message: "You are not authorized to perform this operation."}
+		}
+	}
+	return f.instanceEC2.CreateTags(ctx, in, opts...)
+}
+
+// writtenKeys returns the sorted keys of the successful CreateTags calls.
+func (f *boundaryEC2) writtenKeys() []string {
+	keys := map[string]bool{}
+	for _, in := range f.createTags {
+		for _, tag := range in.Tags {
+			keys[aws.ToString(tag.Key)] = true
+		}
+	}
+	return sortedTagKeys(keys)
+}
+
+func deniedKeysTagger(api ec2API) *Tagger {
+	tagger := newStartupTagger(fake.NewSimpleClientset(taintedNode(nil)), api)
+	tagger.snapshot.Store(&tagSnapshot{tags: map[string]string{"Env": "prod", "Team": "web", "CostCenter": "42", "Owner": "ops"}})
+	tagger.deniedKeys = newDeniedTagKeys(tagger.metrics, tagger.logger)
+	tagger.recorder = record.NewFakeRecorder(10)
+	return tagger
+}
+
+func TestDeniedTagKeysSplit(t *testing.T) {
+	api := &boundaryEC2{denied: map[string]bool{"CostCenter": true}}
+	tagger := deniedKeysTagger(api)
+	ctx := context.Background()
+
+	tagger.handleNode(ctx, taintedNode(nil))
+	if got := api.writtenKeys(); !reflect.DeepEqual(got, []string{"Env", "Owner", "Team"}) {
+		t.Errorf("written keys = %v, want every key but CostCenter", got)
+	}
+	node, err := tagger.k8s.CoreV1().Nodes().Get(ctx, "n1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status nodeStatus
+	if err := json.Unmarshal([]byte(node.Annotations[statusAnnotation]), &status); err != nil {
+		t.Fatalf("status annotation: %v", err)
+	}
+	if node.Annotations[annotationKey] != annotationValue || !reflect.DeepEqual(status.DeniedKeys, []string{"CostCenter"}) {
+		t.Errorf("annotations = %v, want the node tagged with CostCenter denied", node.Annotations)
+	}
+	if event := <-tagger.recorder.(*record.FakeRecorder).Events; !strings.Contains(event, reasonTagKeysDenied) || !strings.Contains(event, "CostCenter") {
+		t.Errorf("event = %q", event)
+	}
+	if got := testutil.ToFloat64(tagger.metrics.deniedTagKeys.WithLabelValues("CostCenter")); got != 1 {
+		t.Errorf("denied_tag_keys{CostCenter} = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(tagger.metrics.deniedTagWrites.WithLabelValues(resourceVolume)); got != 1 {
+		t.Errorf("denied volume writes = %v, want 1", got)
+	}
+
+	// Later writes leave the denied key out without probing.
+	attempts := api.attempts
+	if err := tagger.applyTags(ctx, "us-east-1", []string{"i-0123456789abcdef0"}, map[string]string{"Env": "prod", "CostCenter": "42"}); err != nil {
+		t.Fatal(err)
+	}
+	if api.attempts != attempts+1 {
+		t.Errorf("CreateTags attempts = %d, want one more than %d", api.attempts, attempts)
+	}
+	if err := tagger.applyTags(ctx, "us-east-1", []string{"i-0123456789abcdef0"}, map[string]string{"CostCenter": "42"}); err == nil || !strings.Contains(err.Error(), "CostCenter") {
+		t.Errorf("writing only denied keys = %v, want an error naming them", err)
+	}
+
+	// A full re-tag forgets the denied keys.
+	tagger.deniedKeys.reset()
+	if tagger.deniedKeys.denied("", "CostCenter") {
+		t.Error("CostCenter still denied after reset")
+	}
+	if got := testutil.CollectAndCount(tagger.metrics.deniedTagKeys); got != 0 {
+		t.Errorf("denied_tag_keys series = %d after reset, want 0", got)
+	}
+}
+
+func TestDeniedTagKeysWholeCall(t *testing.T) {
+	api := &boundaryEC2{denyAll: true}
+	tagger := deniedKeysTagger(api)
+	ctx := context.Background()
+	tags := map[string]string{"Env": "prod", "Team": "web", "CostCenter": "42", "Owner": "ops"}
+
+	// Denied whatever the keys: the call fails as before and nothing is learned.
+	if err := tagger.applyTags(ctx, "us-east-1", []string{"i-0123456789abcdef0"}, tags); !isPermissionDenied(err) {
+		t.Fatalf("applyTags = %v, want the denied call's error", err)
+	}
+	if tagger.deniedKeys.denied("", "Env") {
+		t.Error("Env learned as denied when the whole call is")
+	}
+	// Further denied writes are not split until one succeeds.
+	attempts := api.attempts
+	if err := tagger.applyTags(ctx, "us-east-1", []string{"i-0123456789abcdef0"}, tags); !isPermissionDenied(err) || api.attempts != attempts+1 {
+		t.Errorf("applyTags = %v after %d attempts, want a single denied attempt", err, api.attempts-attempts)
+	}
+	api.denyAll = false
+	if err := tagger.applyTags(ctx, "us-east-1", []string{"i-0123456789abcdef0"}, tags); err != nil {
+		t.Fatal(err)
+	}
+	if !tagger.deniedKeys.splittable("") {
+		t.Error("writes not split again after a successful one")
+	}
+}
+
+func TestDeniedTagKeysPerRole(t *testing.T) {
+	d := newDeniedTagKeys(newMetrics(""), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	d.learn("arn:aws:iam::111122223333:role/finance", []string{"CostCenter"}, &smithy.GenericAPIError{Code: "AccessDenied"})
+	tags := map[string]string{"Env": "prod", "CostCenter": "42"}
+	if got, dropped := d.filter("", tags); len(got) != 2 || dropped != nil {
+		t.Errorf("filter with the controller's credentials = %v, %v; want nothing dropped", got, dropped)
+	}
+	got, dropped := d.filter("arn:aws:iam::111122223333:role/finance", tags)
+	if !reflect.DeepEqual(got, map[string]string{"Env": "prod"}) || !reflect.DeepEqual(dropped, []string{"CostCenter"}) {
+		t.Errorf("filter with the role = %v, %v", got, dropped)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// Volume discovery strategies (VOLUME_DISCOVERY).
+const (
+	// discoveryAuto describes a node's instance on its own, or in bulk when
+	// its region has a backlog of at least VOLUME_DISCOVERY_BULK_THRESHOLD
+	// nodes queued.
+	discoveryAuto = "auto"
+	// discoveryInstance always calls DescribeInstances for the one instance
+	// and takes its volumes from the block device mappings.
+	discoveryInstance = "instance"
+	// discoveryBulk always describes the instances queued in the region
+	// together, finding their volumes with DescribeVolumes filtered by
+	// attachment.
+	discoveryBulk = "bulk"
+)
+
+// discoveryBatch is the most instances described by one bulk round: EC2's
+// limit on the values of a filter.
+const discoveryBatch = 200
+
+// discoveryTTL is how long an instance described in bulk waits for its
+// reconcile; once expired it is described again.
+const discoveryTTL = time.Minute
+
+// backlog reports the instances of the node reconciles queued in a region;
+// the work pool implements it.
+type backlog interface {
+	queuedInstances(region string) []string
+}
+
+// discovered is an instance described in a bulk round with the volumes
+// attached to it. ready is closed once the round finished; inst is nil when
+// the round failed or did not find the instance.
+type discovered struct {
+	ready     chan struct{}
+	started   time.Time
+	inst      *ec2types.Instance
+	volumeIDs []string
+}
+
+// volumeDiscovery chooses how the instance and volumes of a node are
+// described: one DescribeInstances per node keeps a single event fast, while
+// a cold start of thousands of nodes is better served by a few bulk calls
+// per region covering the queued nodes too.
+type volumeDiscovery struct {
+	mode      string
+	threshold int
+	backlog   backlog
+	now       func() time.Time
+
+	mu sync.Mutex
+	// found holds the instances of bulk rounds not yet reconciled, keyed by
+	// region and instance ID.
+	found map[[2]string]*discovered
+}
+
+func newVolumeDiscovery(mode string, threshold int, b backlog) *volumeDiscovery {
+	return &volumeDiscovery{mode: mode, threshold: threshold, backlog: b, now: time.Now, found: map[[2]string]*discovered{}}
+}
+
+// lookup returns the bulk entry of the instance, or nil to describe it on
+// its own. round is non-nil when the caller starts a bulk round and must
+// describe its instances, the entry's included.
+func (v *volumeDiscovery) lookup(region, instanceID string) (e *discovered, round map[string]*discovered) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := v.now()
+	key := [2]string{region, instanceID}
+	if e, ok := v.found[key]; ok {
+		delete(v.found, key)
+		if now.Sub(e.started) < discoveryTTL {
+			return e, nil
+		}
+	}
+	if v.mode == discoveryInstance || v.backlog == nil {
+		return nil, nil
+	}
+	queued := v.backlog.queuedInstances(region)
+	if v.mode == discoveryAuto && len(queued)+1 < v.threshold {
+		return nil, nil
+	}
+
+	// Entries of nodes deleted before their reconcile would stay forever.
+	for k, prev := range v.found {
+		if now.Sub(prev.started) >= discoveryTTL {
+			delete(v.found, k)
+		}
+	}
+	e = &discovered{ready: make(chan struct{}), started: now}
+	round = map[string]*discovered{instanceID: e}
+	for _, id := range queued {
+		if len(round) == discoveryBatch {
+			break
+		}
+		k := [2]string{region, id}
+		if _, ok := v.found[k]; ok {
+			continue
+		}
+		if _, ok := round[id]; ok {
+			continue
+		}
+		round[id] = &discovered{ready: e.ready, started: now}
+		v.found[k] = round[id]
+	}
+	return e, round
+}
+
+// discoverInstance returns the node's instance and the IDs of its attached
+// EBS volumes, with the strategy chosen by t.discovery.
+func (t *Tagger) discoverInstance(ctx context.Context, region, instanceID string) (*ec2types.Instance, []string, error) {
+	if t.discovery != nil {
+		e, round := t.discovery.lookup(region, instanceID)
+		if round != nil {
+			t.describeRound(ctx, region, round)
+		}
+		if e != nil {
+			select {
+			case <-e.ready:
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+			if e.inst != nil {
+				t.metrics.discovered(discoveryBulk)
+				return e.inst, e.volumeIDs, nil
+			}
+		}
+	}
+	inst, err := t.describeInstance(ctx, region, instanceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.metrics.discovered(discoveryInstance)
+	if cached, ok := t.cachedVolumes(ctx, region, instanceID); ok {
+		return inst, withCachedVolumes(inst, cached), nil
+	}
+	return inst, attachedVolumes(inst), nil
+}
+
+// describeRound describes the instances of a bulk round and releases their
+// reconciles. Instances it misses are described on their own.
+func (t *Tagger) describeRound(ctx context.Context, region string, round map[string]*discovered) {
+	ids := make([]string, 0, len(round))
+	for id := range round {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	instances, volumes, err := t.describeBulk(ctx, region, ids)
+	if err != nil {
+		t.logger.Warn("bulk instance discovery failed, describing instances one by one", "region", region, "instances", len(ids), "error", err)
+	} else {
+		t.logger.Debug("described instances in bulk", "region", region, "instances", len(ids), "found", len(instances))
+	}
+	for id, e := range round {
+		e.inst, e.volumeIDs = instances[id], volumes[id]
+	}
+	// Every entry of the round shares the channel.
+	close(round[ids[0]].ready)
+}
+
+// describeBulk describes the instances with DescribeInstances filtered by
+// instance ID, which unlike InstanceIds does not fail on a terminated
+// instance, and finds their volumes, including those still attaching, in the
+// warm volume cache or else with DescribeVolumes filtered by attachment.
+func (t *Tagger) describeBulk(ctx context.Context, region string, ids []string) (map[string]*ec2types.Instance, map[string][]string, error) {
+	api := t.ec2.forRegion(region)
+	instances := make(map[string]*ec2types.Instance, len(ids))
+	p := ec2.NewDescribeInstancesPaginator(api, &ec2.DescribeInstancesInput{
+		Filters: []ec2types.Filter{{Name: aws.String("instance-id"), Values: ids}},
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("DescribeInstances: %w", err)
+		}
+		for _, r := range out.Reservations {
+			for i := range r.Instances {
+				instances[aws.ToString(r.Instances[i].InstanceId)] = &r.Instances[i]
+			}
+		}
+	}
+
+	volumes := make(map[string][]string, len(instances))
+	misses := make([]string, 0, len(instances))
+	for _, id := range ids {
+		if instances[id] == nil {
+			continue
+		}
+		if cached, ok := t.cachedVolumes(ctx, region, id); ok {
+			volumes[id] = withCachedVolumes(instances[id], cached)
+		} else {
+			misses = append(misses, id)
+		}
+	}
+	if len(misses) == 0 {
+		return instances, volumes, nil
+	}
+	vp := ec2.NewDescribeVolumesPaginator(api, &ec2.DescribeVolumesInput{
+		Filters: []ec2types.Filter{{Name: aws.String("attachment.instance-id"), Values: misses}},
+	})
+	for vp.HasMorePages() {
+		out, err := vp.NextPage(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("DescribeVolumes: %w", err)
+		}
+		for _, vol := range out.Volumes {
+			for _, a := range vol.Attachments {
+				if a.State != ec2types.VolumeAttachmentStateAttached && a.State != ec2types.VolumeAttachmentStateAttaching {
+					continue
+				}
+				if id := aws.ToString(a.InstanceId); instances[id] != nil && slices.Contains(misses, id) {
+					volumes[id] = append(volumes[id], aws.ToString(vol.VolumeId))
+				}
+			}
+		}
+	}
+	return instances, volumes, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// discoveryEC2 knows the instances in running; each has a root volume in its
+// block device mappings and a data volume still attaching.
+type discoveryEC2 struct {
+	ec2API
+	running map[string]bool
+
+	mu sync.Mutex
+	// single and bulk record the instance IDs of each DescribeInstances
+	// call by InstanceIds and by filter; volumes those of DescribeVolumes.
+	single, bulk, volumes [][]string
+}
+
+func (f *discoveryEC2) instance(id string) ec2types.Instance {
+	return ec2types.Instance{
+		InstanceId: aws.String(id),
+		BlockDeviceMappings: []ec2types.InstanceBlockDeviceMapping{{
+			Ebs: &ec2types.EbsInstanceBlockDevice{VolumeId: aws.String("vol-" + id + "-root")},
+		}},
+	}
+}
+
+func (f *discoveryEC2) DescribeInstances(_ context.Context, in *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := in.InstanceIds
+	if len(in.Filters) > 0 {
+		ids = in.Filters[0].Values
+		f.bulk = append(f.bulk, ids)
+	} else {
+		f.single = append(f.single, ids)
+	}
+	var r ec2types.Reservation
+	for _, id := range ids {
+		if f.running[id] {
+			r.Instances = append(r.Instances, f.instance(id))
+		} else if len(in.Filters) == 0 {
+			return nil, fmt.Errorf("InvalidInstanceID.NotFound: %s", id)
+		}
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []ec2types.Reservation{r}}, nil
+}
+
+func (f *discoveryEC2) DescribeVolumes(_ context.Context, in *ec2.DescribeVolumesInput, _ ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ids := in.Filters[0].Values
+	f.volumes = append(f.volumes, ids)
+	out := &ec2.DescribeVolumesOutput{}
+	for _, id := range ids {
+		if !f.running[id] {
+			continue
+		}
+		out.Volumes = append(out.Volumes,
+			ec2types.Volume{VolumeId: aws.String("vol-" + id + "-root"), Attachments: []ec2types.VolumeAttachment{{InstanceId: aws.String(id), State: ec2types.VolumeAttachmentStateAttached}}},
+			ec2types.Volume{VolumeId: aws.String("vol-" + id + "-data"), Attachments: []ec2types.VolumeAttachment{{InstanceId: aws.String(id), State: ec2types.VolumeAttachmentStateAttaching}}},
+			ec2types.Volume{VolumeId: aws.String("vol-" + id + "-old"), Attachments: []ec2types.VolumeAttachment{{InstanceId: aws.String(id), State: ec2types.VolumeAttachmentStateDetached}}},
+		)
+	}
+	return out, nil
+}
+
+// fakeBacklog is the queued instances per region.
+type fakeBacklog struct {
+	mu     sync.Mutex
+	queued map[string][]string
+}
+
+// start takes the instance off the queue, as a worker picking it up does.
+func (b *fakeBacklog) start(region, id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queued[region]
+	for i := range q {
+		if q[i] == id {
+			b.queued[region] = append(q[:i:i], q[i+1:]...)
+			return
+		}
+	}
+}
+
+func (b *fakeBacklog) queuedInstances(region string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.queued[region]
+}
+
+func discoveryTagger(api ec2API, mode string, b backlog) *Tagger {
+	return &Tagger{
+		ec2:       fakeClients(api),
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		metrics:   newMetrics(""),
+		discovery: newVolumeDiscovery(mode, 3, b),
+	}
+}
+
+func TestDiscoverInstanceAuto(t *testing.T) {
+	api := &discoveryEC2{running: map[string]bool{"i-a": true, "i-b": true, "i-c": true}}
+	b := &fakeBacklog{queued: map[string][]string{"us-east-1": {"i-b", "i-gone"}}}
+	tagger := discoveryTagger(api, discoveryAuto, b)
+	ctx := context.Background()
+
+	// Below the threshold: on its own, volumes from the block device mappings.
+	inst, volumes, err := tagger.discoverInstance(ctx, "eu-west-1", "i-c")
+	if err != nil || aws.ToString(inst.InstanceId) != "i-c" || !reflect.DeepEqual(volumes, []string{"vol-i-c-root"}) {
+		t.Fatalf("discoverInstance(i-c) = %v, %v, %v", inst, volumes, err)
+	}
+	if len(api.single) != 1 || len(api.bulk) != 0 {
+		t.Fatalf("single = %v, bulk = %v, want one single call", api.single, api.bulk)
+	}
+
+	// A backlog of three: the queued instances are described along.
+	_, volumes, err = tagger.discoverInstance(ctx, "us-east-1", "i-a")
+	if err != nil || !reflect.DeepEqual(volumes, []string{"vol-i-a-root", "vol-i-a-data"}) {
+		t.Fatalf("discoverInstance(i-a) = %v, %v; want the attached and attaching volumes", volumes, err)
+	}
+	if len(api.bulk) != 1 || !reflect.DeepEqual(api.bulk[0], []string{"i-a", "i-b", "i-gone"}) || len(api.volumes) != 1 {
+		t.Fatalf("bulk = %v, volumes = %v", api.bulk, api.volumes)
+	}
+	b.queued = nil
+	if _, volumes, err = tagger.discoverInstance(ctx, "us-east-1", "i-b"); err != nil || len(volumes) != 2 {
+		t.Errorf("discoverInstance(i-b) = %v, %v", volumes, err)
+	}
+	if len(api.single) != 1 || len(api.bulk) != 1 {
+		t.Errorf("i-b described again: single = %v, bulk = %v", api.single, api.bulk)
+	}
+
+	// Missed by the round: described on its own, which reports it missing.
+	if _, _, err = tagger.discoverInstance(ctx, "us-east-1", "i-gone"); err == nil {
+		t.Error("expected an error for a missing instance")
+	}
+	if len(api.single) != 2 {
+		t.Errorf("single = %v, want i-gone described on its own", api.single)
+	}
+
+	if got := testutil.ToFloat64(tagger.metrics.volumeDiscovery.WithLabelValues(discoveryBulk)); got != 2 {
+		t.Errorf("bulk discoveries = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(tagger.metrics.volumeDiscovery.WithLabelValues(discoveryInstance)); got != 1 {
+		t.Errorf("instance discoveries = %v, want 1", got)
+	}
+}
+
+func TestDiscoverInstanceExpired(t *testing.T) {
+	api := &discoveryEC2{running: map[string]bool{"i-a": true, "i-b": true}}
+	b := &fakeBacklog{queued: map[string][]string{"us-east-1": {"i-b"}}}
+	tagger := discoveryTagger(api, discoveryBulk, b)
+	now := time.Now()
+	tagger.discovery.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	if _, _, err := tagger.discoverInstance(ctx, "us-east-1", "i-a"); err != nil {
+		t.Fatal(err)
+	}
+	b.queued = nil
+	now = now.Add(discoveryTTL)
+	// The bulk mode ignores the threshold, so i-b is described in a round of
+	// its own.
+	if _, _, err := tagger.discoverInstance(ctx, "us-east-1", "i-b"); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.bulk) != 2 || !reflect.DeepEqual(api.bulk[1], []string{"i-b"}) {
+		t.Errorf("bulk = %v, want i-b described again once expired", api.bulk)
+	}
+}
+
+func TestDiscoverInstanceModeInstance(t *testing.T) {
+	api := &discoveryEC2{running: map[string]bool{"i-a": true}}
+	b := &fakeBacklog{queued: map[string][]string{"us-east-1": {"i-1", "i-2", "i-3", "i-4"}}}
+	tagger := discoveryTagger(api, discoveryInstance, b)
+	if _, _, err := tagger.discoverInstance(context.Background(), "us-east-1", "i-a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.bulk) != 0 || len(api.single) != 1 {
+		t.Errorf("single = %v, bulk = %v, want no bulk round", api.single, api.bulk)
+	}
+}
+
+func TestDiscoverInstanceConcurrent(t *testing.T) {
+	ids := make([]string, 40)
+	running := map[string]bool{}
+	for i := range ids {
+		ids[i] = fmt.Sprintf("i-%02d", i)
+		running[ids[i]] = true
+	}
+	api := &discoveryEC2{running: running}
+	b := &fakeBacklog{queued: map[string][]string{"us-east-1": append([]string(nil), ids...)}}
+	tagger := discoveryTagger(api, discoveryAuto, b)
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.start("us-east-1", id)
+			if _, volumes, err := tagger.discoverInstance(context.Background(), "us-east-1", id); err != nil || len(volumes) == 0 {
+				t.Errorf("discoverInstance(%s) = %v, %v", id, volumes, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every instance is described once, whichever worker's round covers it.
+	described := map[string]int{}
+	for _, call := range append(api.bulk, api.single...) {
+		for _, id := range call {
+			described[id]++
+		}
+	}
+	for _, id := range ids {
+		if described[id] != 1 {
+			t.Errorf("%s described %d times", id, described[id])
+		}
+	}
+}
@@ -0,0 +1,307 @@
+//go:build e2e
+
+// End-to-end tests: the controller's informers, worker pool and tagging path
+// run against a fake API server and LocalStack's EC2 API. Start LocalStack
+// and run them with
+//
+//	docker run --rm -d -p 4566:4566 localstack/localstack
+//	go test -tags e2e -run E2E ./cmd/aws-node-retag
+//
+// LOCALSTACK_ENDPOINT overrides the default http://localhost:4566.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+const e2eRegion = "us-east-1"
+
+// e2eTimeout bounds each wait, including the SDK's retry backoff.
+const e2eTimeout = time.Minute
+
+var e2eTags = map[string]string{"Team": "e2e", "Environment": "test"}
+
+// throttler fails the first calls of an EC2 operation with
+// RequestLimitExceeded. It sits after the SDK's retry middleware, so every
+// attempt of a call passes it.
+type throttler struct {
+	mu        sync.Mutex
+	operation string
+	remaining int
+	throttled int
+}
+
+// set throttles the next n calls of operation.
+func (th *throttler) set(operation string, n int) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	th.operation, th.remaining = operation, n
+}
+
+func (th *throttler) count() int {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	return th.throttled
+}
+
+func (th *throttler) HandleFinalize(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+	th.mu.Lock()
+	throttle := th.remaining > 0 && awsmiddleware.GetOperationName(ctx) == th.operation
+	if throttle {
+		th.remaining--
+		th.throttled++
+	}
+	th.mu.Unlock()
+	if throttle {
+		return middleware.FinalizeOutput{}, middleware.Metadata{}, &smithy.GenericAPIError{Code: "RequestLimitExceeded", Message: "Request limit exceeded."}
+	}
+	return next.HandleFinalize(ctx, in)
+}
+
+func (th *throttler) ID() string { return "e2eThrottle" }
+
+// e2eEnv is a controller watching a fake API server through informers and
+// tagging in LocalStack.
+type e2eEnv struct {
+	k8s      *fake.Clientset
+	ec2      *ec2.Client
+	tagger   *Tagger
+	nodes    corelisters.NodeLister
+	throttle *throttler
+}
+
+// newE2EEnv starts the controller; EC2 calls are retried up to maxAttempts
+// times by the SDK.
+func newE2EEnv(t *testing.T, maxAttempts int) *e2eEnv {
+	t.Helper()
+	endpoint := os.Getenv("LOCALSTACK_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "http://localhost:4566"
+	}
+	th := &throttler{}
+	cfg := aws.Config{
+		Region:      e2eRegion,
+		Credentials: credentials.NewStaticCredentialsProvider("test", "test", ""),
+		APIOptions: []func(*middleware.Stack) error{func(s *middleware.Stack) error {
+			return s.Finalize.Add(th, middleware.After)
+		}},
+	}
+	direct := ec2.NewFromConfig(aws.Config{Region: e2eRegion, Credentials: cfg.Credentials}, func(o *ec2.Options) {
+		o.BaseEndpoint = aws.String(endpoint)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := direct.DescribeRegions(ctx, &ec2.DescribeRegionsInput{}); err != nil {
+		t.Fatalf("EC2 at %s is not reachable, is LocalStack running? %v", endpoint, err)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if testing.Verbose() {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+	k8s := fake.NewSimpleClientset()
+	m := newMetrics("")
+	tagger := &Tagger{
+		k8s:      k8s,
+		ec2:      newEC2Clients(cfg, regionOptions{Endpoint: endpoint, MaxAttempts: maxAttempts}, nil),
+		logger:   logger,
+		recorder: &record.FakeRecorder{},
+		metrics:  m,
+		control:  &controlState{},
+		features: newFeatureGates(m, logger),
+	}
+	tagger.snapshot.Store(&tagSnapshot{tags: e2eTags})
+
+	runCtx, stop := context.WithCancel(context.Background())
+	pool := newWorkPool(2, func(fn func()) { fn() })
+	poolDone := make(chan struct{})
+	go func() { pool.run(runCtx); close(poolDone) }()
+	t.Cleanup(func() { stop(); <-poolDone })
+
+	factory := informers.NewSharedInformerFactory(k8s, 0)
+	informer := factory.Core().V1().Nodes().Informer()
+	if _, err := informer.AddEventHandler(tagger.nodeEventHandler(runCtx, pool)); err != nil {
+		t.Fatal(err)
+	}
+	factory.Start(runCtx.Done())
+	if !cache.WaitForCacheSync(runCtx.Done(), informer.HasSynced) {
+		t.Fatal("informer did not sync")
+	}
+	return &e2eEnv{k8s: k8s, ec2: direct, tagger: tagger, nodes: factory.Core().V1().Nodes().Lister(), throttle: th}
+}
+
+// launchInstance runs an instance in LocalStack and returns it.
+func (e *e2eEnv) launchInstance(t *testing.T) ec2types.Instance {
+	t.Helper()
+	ctx := context.Background()
+	images, err := e.ec2.DescribeImages(ctx, &ec2.DescribeImagesInput{})
+	if err != nil || len(images.Images) == 0 {
+		t.Fatalf("no image to launch: %v", err)
+	}
+	out, err := e.ec2.RunInstances(ctx, &ec2.RunInstancesInput{
+		ImageId:      images.Images[0].ImageId,
+		InstanceType: ec2types.InstanceTypeT3Micro,
+		MinCount:     aws.Int32(1),
+		MaxCount:     aws.Int32(1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst := out.Instances[0]
+	t.Cleanup(func() {
+		_, _ = e.ec2.TerminateInstances(context.Background(), &ec2.TerminateInstancesInput{InstanceIds: []string{aws.ToString(inst.InstanceId)}})
+	})
+	return inst
+}
+
+// createNode registers inst as a node, as the kubelet and the cloud
+// controller manager do.
+func (e *e2eEnv) createNode(t *testing.T, name string, inst ec2types.Instance) {
+	t.Helper()
+	zone := aws.ToString(inst.Placement.AvailabilityZone)
+	if zone == "" {
+		zone = e2eRegion + "a"
+	}
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.NodeSpec{ProviderID: fmt.Sprintf("aws:///%s/%s", zone, aws.ToString(inst.InstanceId))},
+	}
+	if _, err := e.k8s.CoreV1().Nodes().Create(context.Background(), node, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitTagged waits until the node carries the tagged annotation.
+func (e *e2eEnv) waitTagged(t *testing.T, name string) *corev1.Node {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), e2eTimeout)
+	defer cancel()
+	var node *corev1.Node
+	err := waitFor(ctx, func() bool {
+		n, err := e.nodes.Get(name)
+		node = n
+		return err == nil && e.tagger.isTagged(n.Annotations)
+	})
+	if err != nil {
+		t.Fatalf("node %s was not tagged: %v", name, err)
+	}
+	return node
+}
+
+// tags returns the tags of an EC2 resource as LocalStack stores them.
+func (e *e2eEnv) tags(t *testing.T, id string) map[string]string {
+	t.Helper()
+	out, err := e.ec2.DescribeTags(context.Background(), &ec2.DescribeTagsInput{
+		Filters: []ec2types.Filter{{Name: aws.String("resource-id"), Values: []string{id}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := map[string]string{}
+	for _, tag := range out.Tags {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return tags
+}
+
+// assertTagged checks that the instance and its volumes carry e2eTags.
+func (e *e2eEnv) assertTagged(t *testing.T, inst ec2types.Instance) {
+	t.Helper()
+	ids := []string{aws.ToString(inst.InstanceId)}
+	for _, bdm := range inst.BlockDeviceMappings {
+		if bdm.Ebs != nil {
+			ids = append(ids, aws.ToString(bdm.Ebs.VolumeId))
+		}
+	}
+	for _, id := range ids {
+		got := e.tags(t, id)
+		for k, v := range e2eTags {
+			if got[k] != v {
+				t.Errorf("%s: tag %s = %q, want %q", id, k, got[k], v)
+			}
+		}
+	}
+}
+
+func TestE2ETagsNewNode(t *testing.T) {
+	e := newE2EEnv(t, 3)
+	inst := e.launchInstance(t)
+	e.createNode(t, "e2e-new", inst)
+
+	node := e.waitTagged(t, "e2e-new")
+	e.assertTagged(t, inst)
+
+	status := parseNodeStatus(node.Annotations, e.tagger.statusKey())
+	if status == nil || status.InstanceID != aws.ToString(inst.InstanceId) || status.Region != e2eRegion {
+		t.Errorf("status annotation = %+v", status)
+	}
+}
+
+func TestE2EThrottledCreateTagsRetried(t *testing.T) {
+	e := newE2EEnv(t, 5)
+	inst := e.launchInstance(t)
+	e.throttle.set("CreateTags", 2)
+	e.createNode(t, "e2e-throttled", inst)
+
+	e.waitTagged(t, "e2e-throttled")
+	e.assertTagged(t, inst)
+	if n := e.throttle.count(); n != 2 {
+		t.Errorf("throttled calls = %d, want 2 retried by the SDK", n)
+	}
+	if got := testutil.ToFloat64(e.tagger.metrics.failures.WithLabelValues(kindNode)); got != 0 {
+		t.Errorf("node failures = %v, want 0", got)
+	}
+}
+
+func TestE2EThrottlingExhaustsRetries(t *testing.T) {
+	e := newE2EEnv(t, 2)
+	inst := e.launchInstance(t)
+	e.throttle.set("CreateTags", 1000)
+	e.createNode(t, "e2e-exhausted", inst)
+
+	ctx, cancel := context.WithTimeout(context.Background(), e2eTimeout)
+	defer cancel()
+	err := waitFor(ctx, func() bool {
+		return testutil.ToFloat64(e.tagger.metrics.failures.WithLabelValues(kindNode)) > 0
+	})
+	if err != nil {
+		t.Fatalf("tagging did not fail under throttling: %v", err)
+	}
+	if node, _ := e.nodes.Get("e2e-exhausted"); node != nil && e.tagger.isTagged(node.Annotations) {
+		t.Fatal("node annotated although CreateTags failed")
+	}
+
+	// Once the throttling stops, a forced re-tag succeeds.
+	e.throttle.set("CreateTags", 0)
+	patch, _ := json.Marshal(map[string]any{"metadata": map[string]any{"annotations": map[string]string{e.tagger.forceKey(): "true"}}})
+	if _, err := e.k8s.CoreV1().Nodes().Patch(context.Background(), "e2e-exhausted", types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	e.waitTagged(t, "e2e-exhausted")
+	e.assertTagged(t, inst)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	smithy "github.com/aws/smithy-go"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Event reasons emitted on Node, PersistentVolume and TagPolicy objects.
+const (
+	reasonRegionNotAllowed = "RegionNotAllowed"
+	reasonUntagged         = "Untagged"
+	reasonTaggingFailed    = "TaggingFailed"
+	// reasonTagOverride records that an external system's tag override was
+	// applied to the node's instance.
+	reasonTagOverride = "TagOverride"
+	// reasonTerminationTagged records that the instance of a node about to be
+	// terminated was stamped with the termination tags.
+	reasonTerminationTagged = "TerminationTagged"
+	// reasonTagKeysDenied records that tag keys of a node were not written
+	// because IAM denies them (see deniedkeys.go).
+	reasonTagKeysDenied = "TagKeysDenied"
+	// reasonPolicyConflict, on a TagPolicy, records that it and other
+	// policies set a tag to different values on the same object.
+	reasonPolicyConflict = "PolicyConflict"
+)
+
+// newEventRecorder returns a recorder that publishes Kubernetes Events through
+// the API server as component. Call the returned broadcaster's Shutdown to flush on exit.
+//
+// Identical events on the same object are merged into one Event whose count
+// and last timestamp are updated, and each object may emit burst events, then
+// qps events per second; events beyond that are dropped.
+func newEventRecorder(k8s kubernetes.Interface, component string, burst int, qps float64) (record.EventRecorder, record.EventBroadcaster) {
+	broadcaster := record.NewBroadcaster(record.WithCorrelatorOptions(record.CorrelatorOptions{
+		BurstSize: burst,
+		QPS:       float32(qps),
+	}))
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: k8s.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component})
+	return recorder, broadcaster
+}
+
+// eventError describes err for an Event message. AWS errors are reduced to
+// their code and message, leaving out the request ID that differs on every
+// attempt, so repeated failures produce identical events that are aggregated.
+func eventError(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return fmt.Sprintf("%s: %s", apiErr.ErrorCode(), apiErr.ErrorMessage())
+	}
+	return err.Error()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEventError(t *testing.T) {
+	// The SDK wraps API errors with the operation and a per-request ID.
+	wrapped := fmt.Errorf("operation error EC2: CreateTags, https response error StatusCode: 400, RequestID: 1234: %w",
+		apiError("UnauthorizedOperation"))
+	if got, want := eventError(wrapped), "UnauthorizedOperation: test"; got != want {
+		t.Errorf("eventError(API error) = %q, want %q", got, want)
+	}
+	if got := eventError(errors.New("connection reset")); got != "connection reset" {
+		t.Errorf("eventError(non-API error) = %q", got)
+	}
+}
+
+func TestEventRecorderAggregatesRepeatedFailures(t *testing.T) {
+	k8s := fake.NewSimpleClientset()
+	recorder, broadcaster := newEventRecorder(k8s, controllerName(""), 25, 1./300)
+	defer broadcaster.Shutdown()
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "n1", UID: "uid-1"}}
+
+	for i := 0; i < 3; i++ {
+		err := fmt.Errorf("RequestID: %d: %w", i, apiError("UnauthorizedOperation"))
+		recorder.Eventf(node, corev1.EventTypeWarning, reasonTaggingFailed, "Tagging instance i-1 failed: %s", eventError(err))
+	}
+
+	var events []corev1.Event
+	err := wait.PollUntilContextTimeout(context.Background(), 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		list, err := k8s.CoreV1().Events("").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return false, err
+		}
+		events = list.Items
+		return len(events) == 1 && events[0].Count == 3, nil
+	})
+	if err != nil {
+		t.Fatalf("events = %+v, want one event with count 3", events)
+	}
+	if e := events[0]; e.Reason != reasonTaggingFailed || e.FirstTimestamp.IsZero() || e.LastTimestamp.Before(&e.FirstTimestamp) {
+		t.Errorf("event = %+v", e)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+
+	smithy "github.com/aws/smithy-go"
+)
+
+// Optional features that are disabled, rather than failing on every node,
+// when the controller's role lacks their IAM actions.
+const (
+	featureASGTagging       = "asgTagging"
+	featureSnapshotTagging  = "snapshotTagging"
+	featureVolumeSweep      = "volumeSweep"
+	featureUntagOnDelete    = "untagOnNodeDelete"
+	featureSNSNotifications = "snsNotifications"
+	featureAWSConfig        = "awsConfig"
+	featureAuditExport      = "auditExport"
+)
+
+// featureActions are the IAM actions each optional feature needs.
+var featureActions = map[string][]string{
+	featureASGTagging:       {"autoscaling:CreateOrUpdateTags"},
+	featureSnapshotTagging:  {"ec2:DescribeSnapshots", "ec2:CreateTags"},
+	featureVolumeSweep:      {"ec2:DescribeVolumes", "ec2:CreateTags"},
+	featureUntagOnDelete:    {"ec2:DescribeVolumes", "ec2:DeleteTags"},
+	featureSNSNotifications: {"sns:Publish"},
+	featureAWSConfig:        {"config:PutEvaluations"},
+	featureAuditExport:      {"s3:PutObject"},
+}
+
+// permissionDeniedCodes are the error codes of calls the role is not allowed
+// to make, as returned by EC2, Auto Scaling, SNS, AWS Config and S3. Credential
+// failures are not included: they affect every feature alike.
+var permissionDeniedCodes = map[string]bool{
+	"UnauthorizedOperation": true,
+	"AccessDenied":          true,
+	"AccessDeniedException": true,
+	"AuthorizationError":    true,
+}
+
+// isPermissionDenied reports whether err is a denied AWS call.
+func isPermissionDenied(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && permissionDeniedCodes[apiErr.ErrorCode()]
+}
+
+// featureGates turns off optional features whose IAM actions are denied: the
+// first denied call in a region disables the feature there with one warning
+// naming the missing actions and sets aws_node_retag_feature_disabled, so a
+// partially granted policy does not fill the logs with a failure per node.
+// Denials are tracked per region, since policies (e.g. SCPs or
+// aws:RequestedRegion conditions) may deny a feature in some regions only.
+// A full re-tag (SIGHUP, /admin/retag) enables them again, e.g. once the
+// policy is fixed. A nil *featureGates enables every feature.
+type featureGates struct {
+	metrics *metrics
+	logger  *slog.Logger
+
+	mu       sync.Mutex
+	disabled map[featureRegion]bool
+}
+
+// featureRegion is a feature in one region.
+type featureRegion struct{ feature, region string }
+
+func newFeatureGates(m *metrics, logger *slog.Logger) *featureGates {
+	return &featureGates{metrics: m, logger: logger, disabled: map[featureRegion]bool{}}
+}
+
+// enabled reports whether feature may run in region.
+func (g *featureGates) enabled(feature, region string) bool {
+	if g == nil {
+		return true
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return !g.disabled[featureRegion{feature, region}]
+}
+
+// denied reports whether err is a denied call, disabling feature in region
+// if so.
+func (g *featureGates) denied(feature, region string, err error) bool {
+	if g == nil || !isPermissionDenied(err) {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := featureRegion{feature, region}
+	if g.disabled[key] {
+		return true
+	}
+	g.disabled[key] = true
+	g.metrics.featureDisabled.WithLabelValues(feature, region).Set(1)
+	g.logger.Warn("IAM permission missing, disabling feature in the region until the next full re-tag",
+		"feature", feature, "region", region, "requires", strings.Join(featureActions[feature], ", "), "error", err)
+	return true
+}
+
+// reset enables every feature again.
+func (g *featureGates) reset() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for key := range g.disabled {
+		g.metrics.featureDisabled.WithLabelValues(key.feature, key.region).Set(0)
+	}
+	g.disabled = map[featureRegion]bool{}
+}
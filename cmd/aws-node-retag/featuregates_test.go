@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	smithy "github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestIsPermissionDenied(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&smithy.GenericAPIError{Code: "UnauthorizedOperation"}, true},
+		{fmt.Errorf("CreateOrUpdateTags: %w", &smithy.GenericAPIError{Code: "AccessDenied"}), true},
+		{&smithy.GenericAPIError{Code: "AuthorizationError"}, true},
+		{&smithy.GenericAPIError{Code: "ExpiredToken"}, false},
+		{&smithy.GenericAPIError{Code: "Throttling"}, false},
+		{errors.New("AccessDenied"), false},
+		{nil, false},
+	} {
+		if got := isPermissionDenied(tc.err); got != tc.want {
+			t.Errorf("isPermissionDenied(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestFeatureGates(t *testing.T) {
+	var logs bytes.Buffer
+	m := newMetrics("")
+	g := newFeatureGates(m, slog.New(slog.NewTextHandler(&logs, nil)))
+	denied := &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized to perform: config:PutEvaluations"}
+
+	if g.denied(featureAWSConfig, "us-east-1", errors.New("connection reset")) || !g.enabled(featureAWSConfig, "us-east-1") {
+		t.Fatal("feature disabled by an error that is not a permission denial")
+	}
+	for range 3 {
+		if !g.denied(featureAWSConfig, "us-east-1", denied) {
+			t.Fatal("permission denial not recognized")
+		}
+	}
+	if g.enabled(featureAWSConfig, "us-east-1") || !g.enabled(featureASGTagging, "us-east-1") {
+		t.Error("only the denied feature should be disabled")
+	}
+	if !g.enabled(featureAWSConfig, "eu-west-1") {
+		t.Error("a denial in one region should not disable the feature in another")
+	}
+	if n := strings.Count(logs.String(), "IAM permission missing"); n != 1 {
+		t.Errorf("warnings = %d, want 1:\n%s", n, logs.String())
+	}
+	if !strings.Contains(logs.String(), "requires=config:PutEvaluations") {
+		t.Errorf("warning does not name the missing action:\n%s", logs.String())
+	}
+	if got := testutil.ToFloat64(m.featureDisabled.WithLabelValues(featureAWSConfig, "us-east-1")); got != 1 {
+		t.Errorf("feature_disabled = %v, want 1", got)
+	}
+
+	g.reset()
+	if !g.enabled(featureAWSConfig, "us-east-1") {
+		t.Error("feature still disabled after reset")
+	}
+	if got := testutil.ToFloat64(m.featureDisabled.WithLabelValues(featureAWSConfig, "us-east-1")); got != 0 {
+		t.Errorf("feature_disabled = %v after reset, want 0", got)
+	}
+
+	var none *featureGates
+	if !none.enabled(featureAWSConfig, "us-east-1") || none.denied(featureAWSConfig, "us-east-1", denied) {
+		t.Error("a nil featureGates should enable every feature")
+	}
+}
+
+func TestAutoScalingGroupDisabledWhenDenied(t *testing.T) {
+	api := &fakeAutoscaling{err: &smithy.GenericAPIError{Code: "AccessDenied"}}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := newMetrics("")
+	tagger := &Tagger{
+		asg:      newASGTagger(aws.Config{}, []string{"Team"}),
+		logger:   logger,
+		metrics:  m,
+		features: newFeatureGates(m, logger),
+	}
+	tagger.asg.newClient = func(string) autoscalingAPI { return api }
+	inst := &ec2types.Instance{Tags: []ec2types.Tag{{Key: aws.String(asgNameTag), Value: aws.String("workers-a")}}}
+	tags := map[string]string{"Team": "ml"}
+
+	for v := range uint64(3) {
+		tagger.tagAutoScalingGroup(context.Background(), &nodeDecision{Region: "us-east-1", ConfigVersion: v}, inst, tags, logger)
+	}
+	if len(api.calls) != 1 {
+		t.Errorf("CreateOrUpdateTags calls = %d, want 1 before the feature is disabled", len(api.calls))
+	}
+	if got := testutil.ToFloat64(m.failures.WithLabelValues(kindAutoScalingGroup)); got != 0 {
+		t.Errorf("asg failures = %v, want 0: a denied feature is not a node failure", got)
+	}
+
+	// Groups in other regions are still tagged.
+	tagger.tagAutoScalingGroup(context.Background(), &nodeDecision{Region: "eu-west-1", ConfigVersion: 3}, inst, tags, logger)
+	if len(api.calls) != 2 {
+		t.Errorf("CreateOrUpdateTags calls = %d, want 2 with a group in another region", len(api.calls))
+	}
+
+	// A full re-tag enables it again.
+	api.err = nil
+	tagger.features.reset()
+	tagger.tagAutoScalingGroup(context.Background(), &nodeDecision{Region: "us-east-1", ConfigVersion: 9}, inst, tags, logger)
+	if len(api.calls) != 3 {
+		t.Errorf("CreateOrUpdateTags calls = %d after reset, want 3", len(api.calls))
+	}
+}
+
+func TestSNSSinkDisabledWhenDenied(t *testing.T) {
+	api := &deniedSNS{}
+	n := newTestNotifier(1, 0)
+	features := newFeatureGates(n.metrics, n.logger)
+	n.sinks = []notificationSink{&snsSink{api: api, topicARN: "arn:aws:sns:us-east-1:123456789012:alerts", region: "us-east-1", features: features}}
+	for _, node := range []string{"node-a", "node-b", "node-c"} {
+		n.nodeResult(node, &nodeDecision{InstanceID: "i-0abc"}, errors.New("boom"))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n.run(ctx)
+	if api.calls != 1 {
+		t.Errorf("Publish calls = %d, want 1", api.calls)
+	}
+	if got := testutil.ToFloat64(n.metrics.notifications.WithLabelValues("sns", "dropped")); got != 3 {
+		t.Errorf("dropped = %v, want 3", got)
+	}
+}
+
+// deniedSNS rejects every publish as SNS does without sns:Publish.
+type deniedSNS struct{ calls int }
+
+func (f *deniedSNS) Publish(context.Context, *sns.PublishInput, ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	f.calls++
+	return nil, &smithy.GenericAPIError{Code: "AuthorizationError", Message: "not authorized to perform: SNS:Publish"}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/obezpalko/aws-node-retag/internal/state"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// health tracks the state behind the /healthz and /readyz probes.
+//
+// Readiness requires the informer caches to be synced, the AWS credential
+// chain to resolve and the IAM preflight to have passed. Liveness fails when the periodic list heartbeat against the
+// API server goes stale, or when a single work item has been running for longer
+// than the threshold — both signs of a wedged controller.
+type health struct {
+	threshold time.Duration
+	now       func() time.Time
+
+	synced        atomic.Bool
+	lastHeartbeat atomic.Int64 // unix nanos of the last successful list
+
+	mu     sync.Mutex
+	awsErr error
+	// preflightErr is the error of the last IAM preflight, until one passes
+	// (see preflight.go).
+	preflightErr error
+	// inFlight holds the start time of each running work item; workers run
+	// several at once.
+	inFlight state.InFlight
+}
+
+func newHealth(threshold time.Duration) *health {
+	h := &health{threshold: threshold, now: time.Now}
+	// Count startup as a heartbeat so the pod isn't killed before the first probe loop.
+	h.lastHeartbeat.Store(h.now().UnixNano())
+	return h
+}
+
+// track runs fn as a unit of work, recording its start so a hung call is detected.
+func (h *health) track(fn func()) {
+	defer h.inFlight.Start(h.now())()
+	fn()
+}
+
+// oldestInFlight returns the start time of the longest-running work item,
+// the zero time when idle.
+func (h *health) oldestInFlight() time.Time {
+	return h.inFlight.Oldest()
+}
+
+func (h *health) setAWSError(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.awsErr = err
+}
+
+func (h *health) setPreflightError(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.preflightErr = err
+}
+
+// live returns nil when the controller is making progress.
+func (h *health) live() error {
+	now := h.now()
+	if last := time.Unix(0, h.lastHeartbeat.Load()); now.Sub(last) > h.threshold {
+		return fmt.Errorf("no successful API heartbeat since %s", last.UTC().Format(time.RFC3339))
+	}
+	if started := h.oldestInFlight(); !started.IsZero() && now.Sub(started) > h.threshold {
+		return fmt.Errorf("work item running since %s", started.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// ready returns nil when the controller can serve events.
+func (h *health) ready() error {
+	if !h.synced.Load() {
+		return fmt.Errorf("informer caches not synced")
+	}
+	h.mu.Lock()
+	awsErr, preflightErr := h.awsErr, h.preflightErr
+	h.mu.Unlock()
+	if awsErr != nil {
+		return fmt.Errorf("AWS credentials: %w", awsErr)
+	}
+	if preflightErr != nil {
+		return fmt.Errorf("IAM preflight: %w", preflightErr)
+	}
+	return h.live()
+}
+
+// run refreshes the heartbeat and the AWS credential check until ctx is done.
+func (h *health) run(ctx context.Context, k8s kubernetes.Interface, creds aws.CredentialsProvider, logger *slog.Logger) {
+	interval := h.threshold / 4
+	if interval > 30*time.Second {
+		interval = 30 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		h.probe(ctx, k8s, creds, logger)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *health) probe(ctx context.Context, k8s kubernetes.Interface, creds aws.CredentialsProvider, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if _, err := k8s.CoreV1().Nodes().List(ctx, metav1.ListOptions{Limit: 1}); err != nil {
+		logger.Warn("API heartbeat failed", "error", err)
+	} else {
+		h.lastHeartbeat.Store(h.now().UnixNano())
+	}
+
+	if creds == nil {
+		h.setAWSError(fmt.Errorf("no credentials provider configured"))
+		return
+	}
+	// Retrieve is served from the SDK credentials cache until the credentials near expiry.
+	_, err := creds.Retrieve(ctx)
+	if err != nil {
+		logger.Warn("AWS credential check failed", "error", err)
+	}
+	h.setAWSError(err)
+}
+
+// handler serves /healthz and /readyz.
+func (h *health) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", probeHandler(h.live))
+	mux.HandleFunc("/readyz", probeHandler(h.ready))
+	return mux
+}
+
+func probeHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHealthLiveAndReady(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	h := newHealth(time.Minute)
+	h.now = func() time.Time { return now }
+	h.lastHeartbeat.Store(start.UnixNano())
+
+	if err := h.live(); err != nil {
+		t.Fatalf("live() on fresh heartbeat: %v", err)
+	}
+	if err := h.ready(); err == nil {
+		t.Fatal("ready() before cache sync should fail")
+	}
+
+	h.synced.Store(true)
+	if err := h.ready(); err != nil {
+		t.Fatalf("ready() after sync: %v", err)
+	}
+
+	h.setAWSError(errors.New("expired token"))
+	if err := h.ready(); err == nil {
+		t.Fatal("ready() with AWS credential error should fail")
+	}
+	h.setAWSError(nil)
+
+	// A work item that outlives the threshold marks the controller as wedged.
+	stuck, release := make(chan struct{}), make(chan struct{})
+	go h.track(func() { close(stuck); <-release })
+	<-stuck
+	now = start.Add(2 * time.Minute)
+	h.lastHeartbeat.Store(now.UnixNano())
+	h.track(func() {}) // a quick item alongside does not hide the stuck one
+	if err := h.live(); err == nil {
+		t.Fatal("live() with a stuck work item should fail")
+	}
+	close(release)
+	for !h.oldestInFlight().IsZero() {
+		time.Sleep(time.Millisecond)
+	}
+	if err := h.live(); err != nil {
+		t.Fatalf("live() after work item finished: %v", err)
+	}
+
+	// A stale heartbeat fails liveness.
+	now = now.Add(2 * time.Minute)
+	if err := h.live(); err == nil {
+		t.Fatal("live() with stale heartbeat should fail")
+	}
+}
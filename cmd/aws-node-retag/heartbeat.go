@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Heartbeat kinds.
+const (
+	// heartbeatReconcile is sent every HEARTBEAT_INTERVAL while the
+	// controller is healthy.
+	heartbeatReconcile = "reconcile"
+	// heartbeatAudit is sent after each periodic audit report is written.
+	heartbeatAudit = "audit"
+)
+
+// heartbeatTimeout bounds one ping.
+const heartbeatTimeout = 10 * time.Second
+
+// heartbeatPing is the JSON document POSTed to the heartbeat URL; services
+// such as healthchecks.io keep it as the body of the ping.
+type heartbeatPing struct {
+	// SchemaVersion is heartbeatSchemaVersion (see schema.go).
+	SchemaVersion int       `json:"schemaVersion"`
+	Kind          string    `json:"kind"`
+	Time          time.Time `json:"time"`
+	Controller    string    `json:"controller,omitempty"`
+
+	// Reconcile counts the node reconciles of a reconcile heartbeat; Audit
+	// summarizes the report of an audit heartbeat.
+	Reconcile *heartbeatReconcileSummary `json:"reconcile,omitempty"`
+	Audit     *heartbeatAuditSummary     `json:"audit,omitempty"`
+}
+
+type heartbeatReconcileSummary struct {
+	// Since is the start of the counted period: the previous successful
+	// reconcile ping, or the start of the controller.
+	Since    time.Time `json:"since"`
+	Nodes    int       `json:"nodes"`
+	Failures int       `json:"failures"`
+}
+
+type heartbeatAuditSummary struct {
+	Nodes     int `json:"nodes"`
+	Resources int `json:"resources"`
+	Drifted   int `json:"drifted"`
+	Errors    int `json:"errors"`
+}
+
+// heartbeat pings an external URL (HEARTBEAT_URL, e.g. a healthchecks.io
+// check) after each successful reconcile cycle and audit, so a controller
+// that stopped working is noticed by the missing pings even without
+// in-cluster monitoring. A reconcile cycle is successful when the probes
+// report the controller ready and not every node reconcile of the cycle
+// failed; otherwise the ping is skipped and its counts carry over.
+type heartbeat struct {
+	client     *http.Client
+	url        string
+	interval   time.Duration
+	controller string
+	// ready is the readiness probe check.
+	ready func() error
+
+	logger  *slog.Logger
+	metrics *metrics
+	now     func() time.Time
+
+	mu sync.Mutex
+	// since, reconciles and failures count the node reconciles since the
+	// last successful reconcile ping.
+	since      time.Time
+	reconciles int
+	failures   int
+}
+
+func newHeartbeat(cfg *Config, client *http.Client, ready func() error, m *metrics, logger *slog.Logger) *heartbeat {
+	return &heartbeat{
+		client:     client,
+		url:        cfg.HeartbeatURL,
+		interval:   cfg.HeartbeatInterval,
+		controller: cfg.ControllerID,
+		ready:      ready,
+		logger:     logger,
+		metrics:    m,
+		now:        time.Now,
+		since:      time.Now().UTC(),
+	}
+}
+
+// nodeResult counts a node reconcile; err is nil when the node was tagged.
+func (h *heartbeat) nodeResult(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reconciles++
+	if err != nil {
+		h.failures++
+	}
+}
+
+// run sends a reconcile heartbeat every interval until ctx is done.
+func (h *heartbeat) run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		h.cycle(ctx)
+	}
+}
+
+// cycle sends the reconcile heartbeat of one interval unless the cycle
+// failed.
+func (h *heartbeat) cycle(ctx context.Context) {
+	if err := h.ready(); err != nil {
+		h.logger.Warn("skipping heartbeat: controller not ready", "error", err)
+		h.metrics.heartbeats.WithLabelValues(heartbeatReconcile, "skipped").Inc()
+		return
+	}
+	h.mu.Lock()
+	counts := &heartbeatReconcileSummary{Since: h.since, Nodes: h.reconciles, Failures: h.failures}
+	h.mu.Unlock()
+	if counts.Failures > 0 && counts.Failures == counts.Nodes {
+		h.logger.Warn("skipping heartbeat: every node reconcile failed", "since", counts.Since, "failures", counts.Failures)
+		h.metrics.heartbeats.WithLabelValues(heartbeatReconcile, "skipped").Inc()
+		return
+	}
+	ping := &heartbeatPing{SchemaVersion: heartbeatSchemaVersion, Kind: heartbeatReconcile, Time: h.now().UTC(), Controller: h.controller, Reconcile: counts}
+	if !h.send(ctx, ping) {
+		return
+	}
+	// Reconciles counted while the ping was in flight go to the next one.
+	h.mu.Lock()
+	h.since = ping.Time
+	h.reconciles -= counts.Nodes
+	h.failures -= counts.Failures
+	h.mu.Unlock()
+}
+
+// audited sends the heartbeat of a written audit report.
+func (h *heartbeat) audited(ctx context.Context, report *auditReport) {
+	h.send(ctx, &heartbeatPing{
+		SchemaVersion: heartbeatSchemaVersion,
+		Kind:          heartbeatAudit,
+		Time:          h.now().UTC(),
+		Controller:    h.controller,
+		Audit: &heartbeatAuditSummary{
+			Nodes:     report.Nodes,
+			Resources: report.Resources,
+			Drifted:   report.Drifted,
+			Errors:    len(report.Errors),
+		},
+	})
+}
+
+// send POSTs a ping and reports whether it was delivered.
+func (h *heartbeat) send(ctx context.Context, ping *heartbeatPing) bool {
+	ctx, cancel := context.WithTimeout(ctx, heartbeatTimeout)
+	defer cancel()
+	if err := postJSON(ctx, h.client, h.url, ping); err != nil {
+		h.logger.Warn("failed to send heartbeat", "kind", ping.Kind, "error", err)
+		h.metrics.heartbeats.WithLabelValues(ping.Kind, "failed").Inc()
+		return false
+	}
+	h.logger.Debug("sent heartbeat", "kind", ping.Kind)
+	h.metrics.heartbeats.WithLabelValues(ping.Kind, "sent").Inc()
+	return true
+}
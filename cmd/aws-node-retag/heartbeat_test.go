@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// heartbeatServer records the pings POSTed to it.
+type heartbeatServer struct {
+	*httptest.Server
+	mu    sync.Mutex
+	pings []heartbeatPing
+}
+
+func newHeartbeatServer(t *testing.T) *heartbeatServer {
+	s := &heartbeatServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ping heartbeatPing
+		if err := json.NewDecoder(r.Body).Decode(&ping); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.pings = append(s.pings, ping)
+		s.mu.Unlock()
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *heartbeatServer) received() []heartbeatPing {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]heartbeatPing(nil), s.pings...)
+}
+
+func newTestHeartbeat(url string, ready func() error) *heartbeat {
+	cfg := &Config{HeartbeatURL: url, HeartbeatInterval: time.Minute, ControllerID: "gpu"}
+	return newHeartbeat(cfg, http.DefaultClient, ready, newMetrics(""), slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestHeartbeatCycle(t *testing.T) {
+	srv := newHeartbeatServer(t)
+	var notReady error
+	h := newTestHeartbeat(srv.URL, func() error { return notReady })
+	ctx := context.Background()
+
+	h.nodeResult(nil)
+	h.nodeResult(errors.New("boom"))
+	h.cycle(ctx)
+	pings := srv.received()
+	if len(pings) != 1 {
+		t.Fatalf("pings = %d, want 1", len(pings))
+	}
+	if p := pings[0]; p.Kind != heartbeatReconcile || p.Controller != "gpu" || p.Reconcile == nil ||
+		p.Reconcile.Nodes != 2 || p.Reconcile.Failures != 1 {
+		t.Errorf("ping = %+v", p)
+	}
+
+	// The counts restart after a delivered ping; an idle cycle still pings.
+	h.cycle(ctx)
+	if pings := srv.received(); len(pings) != 2 || pings[1].Reconcile.Nodes != 0 || !pings[1].Reconcile.Since.Equal(pings[0].Time) {
+		t.Errorf("second ping = %+v", pings[1:])
+	}
+
+	// Failed cycles are not reported, and their counts carry over.
+	h.nodeResult(errors.New("boom"))
+	h.cycle(ctx)
+	notReady = errors.New("informer caches not synced")
+	h.nodeResult(nil)
+	h.cycle(ctx)
+	if got := len(srv.received()); got != 2 {
+		t.Errorf("pings after failed cycles = %d, want 2", got)
+	}
+	if got := testutil.ToFloat64(h.metrics.heartbeats.WithLabelValues(heartbeatReconcile, "skipped")); got != 2 {
+		t.Errorf("skipped heartbeats = %v, want 2", got)
+	}
+	notReady = nil
+	h.cycle(ctx)
+	if pings := srv.received(); len(pings) != 3 || pings[2].Reconcile.Nodes != 2 || pings[2].Reconcile.Failures != 1 {
+		t.Errorf("ping after recovery = %+v", pings[2:])
+	}
+}
+
+func TestHeartbeatAudit(t *testing.T) {
+	srv := newHeartbeatServer(t)
+	h := newTestHeartbeat(srv.URL, func() error { return nil })
+	h.audited(context.Background(), &auditReport{Nodes: 3, Resources: 7, Drifted: 1, Errors: []auditError{{}}})
+	pings := srv.received()
+	if len(pings) != 1 || pings[0].Kind != heartbeatAudit || pings[0].Reconcile != nil ||
+		*pings[0].Audit != (heartbeatAuditSummary{Nodes: 3, Resources: 7, Drifted: 1, Errors: 1}) {
+		t.Errorf("pings = %+v", pings)
+	}
+}
+
+func TestHeartbeatSendFailure(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	h := newTestHeartbeat(srv.URL, func() error { return nil })
+	h.nodeResult(nil)
+	h.cycle(context.Background())
+	if got := testutil.ToFloat64(h.metrics.heartbeats.WithLabelValues(heartbeatReconcile, "failed")); got != 1 {
+		t.Errorf("failed heartbeats = %v, want 1", got)
+	}
+	if h.reconciles != 1 {
+		t.Errorf("reconciles after a failed ping = %d, want 1", h.reconciles)
+	}
+}
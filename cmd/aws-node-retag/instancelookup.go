@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// instanceLookup is how a node whose providerID cannot be parsed is matched
+// to its instance (PROVIDER_ID_FALLBACK): by private IP or private DNS name
+// within the zone of its topology label.
+type instanceLookup struct {
+	zone     string
+	ips      []string
+	dnsNames []string
+}
+
+// instanceLookupFor returns the lookup of a node, or nil when the fallback is
+// disabled or the node has no zone label or address to match.
+func (t *Tagger) instanceLookupFor(node *corev1.Node) *instanceLookup {
+	if !t.providerIDFallback {
+		return nil
+	}
+	zone := node.Labels[corev1.LabelTopologyZone]
+	if !isZoneName(zone) {
+		return nil
+	}
+	l := &instanceLookup{zone: zone}
+	for _, a := range node.Status.Addresses {
+		switch a.Type {
+		case corev1.NodeInternalIP:
+			l.ips = append(l.ips, a.Address)
+		case corev1.NodeInternalDNS, corev1.NodeHostName:
+			l.dnsNames = append(l.dnsNames, a.Address)
+		}
+	}
+	// Nodes are usually named after the instance's private DNS name.
+	if strings.Contains(node.Name, ".") {
+		l.dnsNames = append(l.dnsNames, node.Name)
+	}
+	slices.Sort(l.dnsNames)
+	l.dnsNames = slices.Compact(l.dnsNames)
+	if len(l.ips) == 0 && len(l.dnsNames) == 0 {
+		return nil
+	}
+	return l
+}
+
+// resolveNode is decideNode followed, for nodes whose providerID cannot be
+// parsed, by the lookup of their instance ID in EC2. A failed lookup turns the
+// decision into an error.
+func (t *Tagger) resolveNode(ctx context.Context, node *corev1.Node, force bool) *nodeDecision {
+	d := t.decideNode(node, force)
+	if d.Action != actionTag || d.lookup == nil {
+		return d
+	}
+	id, by, err := t.lookupInstance(ctx, d.Region, d.lookup)
+	if err != nil {
+		d.err = err
+		return d.stop("instanceLookup", actionError, "instance_lookup_failed", err.Error())
+	}
+	d.InstanceID = id
+	d.pass("instanceLookup", fmt.Sprintf("%s by %s", id, by))
+	return d
+}
+
+// lookupInstance finds the only pending or running instance in l's zone with
+// one of its private IPs, or else one of its private DNS names, and returns
+// its ID and the filter that matched.
+func (t *Tagger) lookupInstance(ctx context.Context, region string, l *instanceLookup) (string, string, error) {
+	for _, f := range []struct {
+		name   string
+		values []string
+	}{
+		{"private-ip-address", l.ips},
+		{"private-dns-name", l.dnsNames},
+	} {
+		if len(f.values) == 0 {
+			continue
+		}
+		out, err := t.ec2.forRegion(region).DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+			Filters: []ec2types.Filter{
+				{Name: aws.String(f.name), Values: f.values},
+				{Name: aws.String("availability-zone"), Values: []string{l.zone}},
+				{Name: aws.String("instance-state-name"), Values: []string{"pending", "running"}},
+			},
+		})
+		if err != nil {
+			return "", "", fmt.Errorf("DescribeInstances: %w", err)
+		}
+		var ids []string
+		for _, r := range out.Reservations {
+			for _, inst := range r.Instances {
+				ids = append(ids, aws.ToString(inst.InstanceId))
+			}
+		}
+		switch len(ids) {
+		case 0:
+			continue
+		case 1:
+			return ids[0], f.name, nil
+		default:
+			// E.g. peered VPCs with overlapping CIDRs: tagging the wrong
+			// instance is worse than not tagging.
+			slices.Sort(ids)
+			return "", "", fmt.Errorf("%s %s matches several instances in %s: %s", f.name, strings.Join(f.values, ","), l.zone, strings.Join(ids, ", "))
+		}
+	}
+	return "", "", fmt.Errorf("no running instance in %s has private IP %v or private DNS name %v", l.zone, l.ips, l.dnsNames)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// addressEC2 answers DescribeInstances filtered by private IP or DNS name
+// from a fleet of instances in us-east-1a.
+type addressEC2 struct {
+	instanceEC2
+	fleet map[string][2]string // instance ID -> private IP, private DNS name
+}
+
+func (f *addressEC2) DescribeInstances(ctx context.Context, in *ec2.DescribeInstancesInput, opts ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	if len(in.Filters) == 0 {
+		return f.instanceEC2.DescribeInstances(ctx, in, opts...)
+	}
+	filter := in.Filters[0]
+	field := 0
+	if aws.ToString(filter.Name) == "private-dns-name" {
+		field = 1
+	}
+	var instances []ec2types.Instance
+	for id, addr := range f.fleet {
+		if slices.Contains(filter.Values, addr[field]) && slices.Contains(in.Filters[1].Values, "us-east-1a") {
+			instances = append(instances, ec2types.Instance{InstanceId: aws.String(id)})
+		}
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []ec2types.Reservation{{Instances: instances}}}, nil
+}
+
+func malformedNode(name, zone string, addresses ...corev1.NodeAddress) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{corev1.LabelTopologyZone: zone}},
+		Spec:       corev1.NodeSpec{ProviderID: "aws:///us-east-1a/"},
+		Status:     corev1.NodeStatus{Addresses: addresses},
+	}
+}
+
+func TestResolveNode(t *testing.T) {
+	api := &addressEC2{fleet: map[string][2]string{
+		"i-0000000000000000a": {"10.0.0.1", "ip-10-0-0-1.ec2.internal"},
+		"i-0000000000000000b": {"10.0.0.2", "ip-10-0-0-2.ec2.internal"},
+		"i-0000000000000000c": {"10.0.0.2", "ip-10-0-0-2.other.internal"},
+	}}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), api)
+	tagger.providerIDFallback = true
+	ctx := context.Background()
+	internalIP := func(ip string) corev1.NodeAddress {
+		return corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: ip}
+	}
+
+	tests := []struct {
+		name       string
+		node       *corev1.Node
+		wantAction string
+		wantID     string
+		wantDetail string
+	}{
+		{"by private IP", malformedNode("n1", "us-east-1a", internalIP("10.0.0.1")), actionTag, "i-0000000000000000a", ""},
+		{"by node name", malformedNode("ip-10-0-0-1.ec2.internal", "us-east-1a"), actionTag, "i-0000000000000000a", ""},
+		{"IP unknown, DNS name matches", malformedNode("ip-10-0-0-1.ec2.internal", "us-east-1a", internalIP("10.9.9.9")), actionTag, "i-0000000000000000a", ""},
+		{"ambiguous IP", malformedNode("n2", "us-east-1a", internalIP("10.0.0.2")), actionError, "", "several instances"},
+		{"no match", malformedNode("n3", "us-east-1a", internalIP("10.9.9.9")), actionError, "", "no running instance"},
+		{"no zone label", malformedNode("n4", "", internalIP("10.0.0.1")), actionError, "", "no instance ID"},
+		{"no address", malformedNode("n5", "us-east-1a"), actionError, "", "no instance ID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := tagger.resolveNode(ctx, tt.node, false)
+			if d.Action != tt.wantAction || d.InstanceID != tt.wantID || !strings.Contains(d.Detail, tt.wantDetail) {
+				t.Errorf("decision = %s %q (%s), want %s %q (%s)", d.Action, d.InstanceID, d.Detail, tt.wantAction, tt.wantID, tt.wantDetail)
+			}
+			if tt.wantAction == actionTag && d.Region != "us-east-1" {
+				t.Errorf("region = %q", d.Region)
+			}
+		})
+	}
+
+	tagger.providerIDFallback = false
+	if d := tagger.resolveNode(ctx, malformedNode("n1", "us-east-1a", internalIP("10.0.0.1")), false); d.Reason != "invalid_provider_id" {
+		t.Errorf("fallback disabled: reason = %q, want invalid_provider_id", d.Reason)
+	}
+}
+
+func TestTagNodeWithProviderIDFallback(t *testing.T) {
+	node := malformedNode("n1", "us-east-1a", corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "10.0.0.1"})
+	api := &addressEC2{fleet: map[string][2]string{"i-0000000000000000a": {"10.0.0.1", ""}}}
+	k8s := fake.NewSimpleClientset(node)
+	tagger := newStartupTagger(k8s, api)
+	tagger.providerIDFallback = true
+
+	tagger.tagNode(context.Background(), node, false)
+	if len(api.createTags) != 1 || !slices.Contains(api.createTags[0].Resources, "i-0000000000000000a") {
+		t.Fatalf("CreateTags = %+v, want the looked up instance", api.createTags)
+	}
+	got, err := k8s.CoreV1().Nodes().Get(context.Background(), "n1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tagger.isTagged(got.Annotations) {
+		t.Error("node not annotated")
+	}
+}
+
+func TestExplainLooksUpInstance(t *testing.T) {
+	node := malformedNode("n1", "us-east-1a", corev1.NodeAddress{Type: corev1.NodeInternalIP, Address: "10.0.0.1"})
+	api := &addressEC2{fleet: map[string][2]string{"i-0000000000000000a": {"10.0.0.1", ""}}}
+	tagger := newStartupTagger(fake.NewSimpleClientset(node), api)
+	tagger.providerIDFallback = true
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := nodes.Add(node); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	tagger.explainHandler(corelisters.NewNodeLister(nodes)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/explain?node=n1", nil))
+	var resp struct {
+		Action     string `json:"action"`
+		InstanceID string `json:"instanceID"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Action != actionTag || resp.InstanceID != "i-0000000000000000a" {
+		t.Errorf("explanation = %+v, want the looked up instance tagged", resp)
+	}
+	if len(api.createTags) != 0 {
+		t.Error("explain wrote tags")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// OS image families derived from a node's status.nodeInfo.osImage.
+const (
+	osFamilyBottlerocket = "bottlerocket"
+	osFamilyAL2023       = "al2023"
+	osFamilyAL2          = "al2"
+	osFamilyUbuntu       = "ubuntu"
+	osFamilyWindows      = "windows"
+	osFamilyOther        = "other"
+)
+
+// versionPattern matches the first dotted version number in an OS image or
+// kubelet version string.
+var versionPattern = regexp.MustCompile(`\d+(\.\d+)*`)
+
+// nodeInventoryAttributes maps the attribute names accepted in
+// NODE_INVENTORY_TAGS to accessors on the node's status.nodeInfo. Values are
+// normalized so that nodes of the same release get the same tag whatever the
+// distribution's formatting, e.g. kubelet versions lose their "v" prefix and
+// build suffix. An empty return value means no tag is derived.
+var nodeInventoryAttributes = map[string]func(corev1.NodeSystemInfo) string{
+	"OSFamily":  func(i corev1.NodeSystemInfo) string { return osFamily(i) },
+	"OSVersion": func(i corev1.NodeSystemInfo) string { return versionPattern.FindString(i.OSImage) },
+	"OperatingSystem": func(i corev1.NodeSystemInfo) string {
+		return strings.ToLower(i.OperatingSystem)
+	},
+	"Architecture":   func(i corev1.NodeSystemInfo) string { return strings.ToLower(i.Architecture) },
+	"KubeletVersion": func(i corev1.NodeSystemInfo) string { return kubeletVersion(i.KubeletVersion) },
+	// KubeletMinorVersion groups nodes by Kubernetes minor release, the unit of
+	// EKS upgrades.
+	"KubeletMinorVersion": func(i corev1.NodeSystemInfo) string {
+		v := strings.SplitN(kubeletVersion(i.KubeletVersion), ".", 3)
+		if len(v) < 2 {
+			return ""
+		}
+		return v[0] + "." + v[1]
+	},
+	"KernelVersion": func(i corev1.NodeSystemInfo) string { return i.KernelVersion },
+}
+
+// osFamily classifies the node's OS image: "Bottlerocket OS 1.19.2
+// (aws-k8s-1.29)" is bottlerocket, "Amazon Linux 2023.3.20240219" al2023,
+// "Amazon Linux 2" al2, "Ubuntu 22.04.3 LTS" ubuntu, and any Windows node
+// windows. Other images are "other".
+func osFamily(info corev1.NodeSystemInfo) string {
+	image := strings.ToLower(strings.TrimSpace(info.OSImage))
+	switch {
+	case strings.EqualFold(info.OperatingSystem, "windows") || strings.HasPrefix(image, "windows"):
+		return osFamilyWindows
+	case image == "":
+		return ""
+	case strings.HasPrefix(image, "bottlerocket"):
+		return osFamilyBottlerocket
+	case strings.HasPrefix(image, "amazon linux 2023"):
+		return osFamilyAL2023
+	case strings.HasPrefix(image, "amazon linux 2"):
+		return osFamilyAL2
+	case strings.HasPrefix(image, "ubuntu"):
+		return osFamilyUbuntu
+	default:
+		return osFamilyOther
+	}
+}
+
+// kubeletVersion returns the major.minor.patch of a kubelet version such as
+// "v1.29.3-eks-ae9a62a", or "" when it has none.
+func kubeletVersion(v string) string {
+	parts := strings.SplitN(versionPattern.FindString(v), ".", 4)
+	if len(parts) < 3 {
+		return strings.Join(parts, ".")
+	}
+	return strings.Join(parts[:3], ".")
+}
+
+// validateInventoryTags checks that every attribute in the mapping is
+// supported and that no derived tag key collides with a static or instance
+// attribute tag.
+func validateInventoryTags(mapping, static, instanceAttributes map[string]string) error {
+	attributeKeys := make(map[string]string, len(instanceAttributes))
+	for attr, key := range instanceAttributes {
+		attributeKeys[key] = attr
+	}
+	for attr, key := range mapping {
+		if _, ok := nodeInventoryAttributes[attr]; !ok {
+			return fmt.Errorf("unsupported node inventory attribute %q (supported: %s)", attr, strings.Join(supportedInventoryAttributes(), ", "))
+		}
+		if key == "" {
+			return fmt.Errorf("node inventory attribute %q maps to an empty tag key", attr)
+		}
+		if _, ok := static[key]; ok {
+			return fmt.Errorf("node inventory attribute %q maps to tag key %q, which is already set in TAGS", attr, key)
+		}
+		if other, ok := attributeKeys[key]; ok {
+			return fmt.Errorf("node inventory attribute %q maps to tag key %q, which INSTANCE_ATTRIBUTE_TAGS derives from %s", attr, key, other)
+		}
+	}
+	return nil
+}
+
+func supportedInventoryAttributes() []string {
+	names := make([]string, 0, len(nodeInventoryAttributes))
+	for name := range nodeInventoryAttributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// inventoryTags derives tags from the node's status according to mapping
+// (attribute name → tag key). Attributes with no value are omitted.
+func inventoryTags(node *corev1.Node, mapping map[string]string) map[string]string {
+	tags := make(map[string]string, len(mapping))
+	if node == nil {
+		return tags
+	}
+	for attr, key := range mapping {
+		get, ok := nodeInventoryAttributes[attr]
+		if !ok {
+			continue
+		}
+		if v := get(node.Status.NodeInfo); v != "" {
+			tags[key] = v
+		}
+	}
+	return tags
+}
+
+// inventoryChanged reports whether the node's inventory tags differ between
+// two versions of the node, e.g. after an in-place OS update, which a node's
+// tags must follow for upgrade tracking.
+func (t *Tagger) inventoryChanged(oldNode, newNode *corev1.Node) bool {
+	mapping := t.current().inventoryTags
+	if len(mapping) == 0 {
+		return false
+	}
+	return !maps.Equal(inventoryTags(oldNode, mapping), inventoryTags(newNode, mapping))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var allInventoryAttributes = map[string]string{
+	"OSFamily":            "node/os-family",
+	"OSVersion":           "node/os-version",
+	"OperatingSystem":     "node/os",
+	"Architecture":        "node/arch",
+	"KubeletVersion":      "node/kubelet-version",
+	"KubeletMinorVersion": "node/kubernetes-version",
+	"KernelVersion":       "node/kernel",
+}
+
+func inventoryNode(info corev1.NodeSystemInfo) *corev1.Node {
+	return &corev1.Node{Status: corev1.NodeStatus{NodeInfo: info}}
+}
+
+func TestInventoryTags(t *testing.T) {
+	cases := []struct {
+		name string
+		info corev1.NodeSystemInfo
+		want map[string]string
+	}{
+		{
+			name: "bottlerocket",
+			info: corev1.NodeSystemInfo{OSImage: "Bottlerocket OS 1.19.2 (aws-k8s-1.29)", OperatingSystem: "linux", Architecture: "arm64", KubeletVersion: "v1.29.1-eks-61c0bbb", KernelVersion: "6.1.77"},
+			want: map[string]string{
+				"node/os-family": "bottlerocket", "node/os-version": "1.19.2", "node/os": "linux", "node/arch": "arm64",
+				"node/kubelet-version": "1.29.1", "node/kubernetes-version": "1.29", "node/kernel": "6.1.77",
+			},
+		},
+		{
+			name: "al2023",
+			info: corev1.NodeSystemInfo{OSImage: "Amazon Linux 2023.3.20240219", OperatingSystem: "linux", Architecture: "amd64", KubeletVersion: "v1.30.0-eks-036c24b"},
+			want: map[string]string{
+				"node/os-family": "al2023", "node/os-version": "2023.3.20240219", "node/os": "linux", "node/arch": "amd64",
+				"node/kubelet-version": "1.30.0", "node/kubernetes-version": "1.30",
+			},
+		},
+		{
+			name: "al2",
+			info: corev1.NodeSystemInfo{OSImage: "Amazon Linux 2", KubeletVersion: "v1.28.5-eks-5e0fdde"},
+			want: map[string]string{"node/os-family": "al2", "node/os-version": "2", "node/kubelet-version": "1.28.5", "node/kubernetes-version": "1.28"},
+		},
+		{
+			name: "ubuntu",
+			info: corev1.NodeSystemInfo{OSImage: "Ubuntu 22.04.3 LTS", KubeletVersion: "v1.29.0"},
+			want: map[string]string{"node/os-family": "ubuntu", "node/os-version": "22.04.3", "node/kubelet-version": "1.29.0", "node/kubernetes-version": "1.29"},
+		},
+		{
+			name: "windows",
+			info: corev1.NodeSystemInfo{OSImage: "Windows Server 2022 Datacenter", OperatingSystem: "Windows", Architecture: "AMD64"},
+			want: map[string]string{"node/os-family": "windows", "node/os-version": "2022", "node/os": "windows", "node/arch": "amd64"},
+		},
+		{
+			name: "other",
+			info: corev1.NodeSystemInfo{OSImage: "Flatcar Container Linux by Kinvolk 3815.2.0"},
+			want: map[string]string{"node/os-family": "other", "node/os-version": "3815.2.0"},
+		},
+		{
+			name: "unreported",
+			info: corev1.NodeSystemInfo{},
+			want: map[string]string{},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := inventoryTags(inventoryNode(tc.info), allInventoryAttributes); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("inventoryTags() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateInventoryTags(t *testing.T) {
+	static := map[string]string{"Team": "platform"}
+	attributes := map[string]string{"InstanceType": "node/instance-type"}
+	cases := []struct {
+		name    string
+		mapping map[string]string
+		wantErr bool
+	}{
+		{name: "valid", mapping: map[string]string{"OSFamily": "node/os-family"}},
+		{name: "unknown attribute", mapping: map[string]string{"BootID": "boot"}, wantErr: true},
+		{name: "empty key", mapping: map[string]string{"OSFamily": ""}, wantErr: true},
+		{name: "collides with TAGS", mapping: map[string]string{"OSFamily": "Team"}, wantErr: true},
+		{name: "collides with an attribute tag", mapping: map[string]string{"Architecture": "node/instance-type"}, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateInventoryTags(tc.mapping, static, attributes)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("validateInventoryTags() err=%v, wantErr=%v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestInventoryChanged(t *testing.T) {
+	tagger := &Tagger{}
+	before := inventoryNode(corev1.NodeSystemInfo{OSImage: "Bottlerocket OS 1.19.2 (aws-k8s-1.29)", KubeletVersion: "v1.29.1-eks-61c0bbb", BootID: "a"})
+	updated := inventoryNode(corev1.NodeSystemInfo{OSImage: "Bottlerocket OS 1.20.0 (aws-k8s-1.29)", KubeletVersion: "v1.29.1-eks-61c0bbb", BootID: "b"})
+	rebooted := inventoryNode(corev1.NodeSystemInfo{OSImage: "Bottlerocket OS 1.19.2 (aws-k8s-1.29)", KubeletVersion: "v1.29.1-eks-61c0bbb", BootID: "b"})
+
+	if tagger.inventoryChanged(before, updated) {
+		t.Error("changed without NODE_INVENTORY_TAGS")
+	}
+	tagger.snapshot.Store(&tagSnapshot{inventoryTags: map[string]string{"OSVersion": "node/os-version"}})
+	if !tagger.inventoryChanged(before, updated) {
+		t.Error("an OS update is not a change")
+	}
+	if tagger.inventoryChanged(before, rebooted) {
+		t.Error("a reboot is a change")
+	}
+}
+
+func TestNodeTagsInventory(t *testing.T) {
+	snap := &tagSnapshot{
+		tags:          map[string]string{"Team": "platform"},
+		attributeTags: map[string]string{"InstanceType": "node/instance-type"},
+		inventoryTags: map[string]string{"OSFamily": "node/os-family"},
+	}
+	node := inventoryNode(corev1.NodeSystemInfo{OSImage: "Amazon Linux 2023.3.20240219"})
+	got := snap.nodeTags(node, &ec2types.Instance{InstanceType: ec2types.InstanceTypeM5Large})
+	want := map[string]string{"Team": "platform", "node/instance-type": "m5.large", "node/os-family": "al2023"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("nodeTags() = %v, want %v", got, want)
+	}
+}
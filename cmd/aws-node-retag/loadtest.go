@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// cmdLoadtest is the subcommand that runs the node reconcile path against
+// simulated Kubernetes and EC2 backends and reports throughput and latency.
+const cmdLoadtest = "loadtest"
+
+// loadtestRegions are the regions simulated nodes are spread over.
+var loadtestRegions = []string{"us-east-1", "us-west-2", "eu-west-1", "eu-central-1", "ap-southeast-1", "ap-northeast-1", "sa-east-1", "ca-central-1"}
+
+// loadtestOptions are the flags of the loadtest command.
+type loadtestOptions struct {
+	nodes   int
+	rate    float64
+	latency time.Duration
+	regions int
+	volumes int
+	workers int
+	churn   float64
+	timeout time.Duration
+}
+
+func parseLoadtestFlags(args []string, output io.Writer) (*loadtestOptions, error) {
+	o := &loadtestOptions{}
+	fs := flag.NewFlagSet(cmdLoadtest, flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.IntVar(&o.nodes, "nodes", 1000, "number of nodes to create")
+	fs.Float64Var(&o.rate, "rate", 0, "nodes created per second; 0 creates them all at once, like a scale-up burst")
+	fs.DurationVar(&o.latency, "latency", 50*time.Millisecond, "mean latency of a simulated EC2 call (uniform within ±50%)")
+	fs.IntVar(&o.regions, "regions", 1, fmt.Sprintf("number of regions the nodes are spread over (at most %d)", len(loadtestRegions)))
+	fs.IntVar(&o.volumes, "volumes", 2, "EBS volumes attached to each instance")
+	fs.IntVar(&o.workers, "workers", 4, "reconcile workers, as WORKERS")
+	fs.Float64Var(&o.churn, "churn", 0, "fraction of nodes replaced once tagged: deleted and re-created under a new name")
+	fs.DurationVar(&o.timeout, "timeout", 30*time.Minute, "give up when the nodes are not all tagged by then")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	switch {
+	case fs.NArg() > 0:
+		return nil, fmt.Errorf("unexpected arguments: %q", fs.Args())
+	case o.nodes < 1:
+		return nil, errors.New("-nodes must be at least 1")
+	case o.rate < 0:
+		return nil, errors.New("-rate must not be negative")
+	case o.regions < 1 || o.regions > len(loadtestRegions):
+		return nil, fmt.Errorf("-regions must be between 1 and %d", len(loadtestRegions))
+	case o.volumes < 0:
+		return nil, errors.New("-volumes must not be negative")
+	case o.workers < 1:
+		return nil, errors.New("-workers must be at least 1")
+	case o.churn < 0 || o.churn > 1:
+		return nil, errors.New("-churn must be between 0 and 1")
+	}
+	return o, nil
+}
+
+// simulatedEC2 answers the EC2 calls of a node reconcile after a random
+// delay around latency, for instances that exist for any ID.
+type simulatedEC2 struct {
+	ec2API
+	latency time.Duration
+	volumes int
+
+	describeInstances atomic.Int64
+	createTags        atomic.Int64
+}
+
+func (s *simulatedEC2) wait(ctx context.Context) error {
+	d := time.Duration(float64(s.latency) * (0.5 + rand.Float64()))
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *simulatedEC2) DescribeInstances(ctx context.Context, in *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	s.describeInstances.Add(1)
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeInstancesOutput{}
+	for _, id := range in.InstanceIds {
+		inst := ec2types.Instance{InstanceId: aws.String(id), RootDeviceName: aws.String("/dev/xvda")}
+		for i := range s.volumes {
+			inst.BlockDeviceMappings = append(inst.BlockDeviceMappings, ec2types.InstanceBlockDeviceMapping{
+				DeviceName: aws.String(fmt.Sprintf("/dev/xvd%c", 'a'+i)),
+				Ebs:        &ec2types.EbsInstanceBlockDevice{VolumeId: aws.String(fmt.Sprintf("vol-%s%d", strings.TrimPrefix(id, "i-"), i))},
+			})
+		}
+		out.Reservations = append(out.Reservations, ec2types.Reservation{Instances: []ec2types.Instance{inst}})
+	}
+	return out, nil
+}
+
+func (s *simulatedEC2) CreateTags(ctx context.Context, _ *ec2.CreateTagsInput, _ ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	s.createTags.Add(1)
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+// durations collects samples from concurrent workers.
+type durations struct {
+	mu      sync.Mutex
+	samples []time.Duration
+}
+
+func (d *durations) add(v time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.samples = append(d.samples, v)
+}
+
+// summary formats the 50th, 90th and 99th percentiles and the maximum.
+func (d *durations) summary() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.samples) == 0 {
+		return "no samples"
+	}
+	sort.Slice(d.samples, func(i, j int) bool { return d.samples[i] < d.samples[j] })
+	at := func(p float64) time.Duration {
+		return d.samples[int(p*float64(len(d.samples)-1))].Round(time.Millisecond)
+	}
+	return fmt.Sprintf("p50=%s\tp90=%s\tp99=%s\tmax=%s", at(.5), at(.9), at(.99), at(1))
+}
+
+// runLoadtest creates nodes in a fake API server at the configured rate,
+// reconciles them with the controller's node handler, worker pool and
+// tagging path against simulated EC2, waits until every node is tagged and
+// writes a report to out. Nothing outside the process is contacted.
+func runLoadtest(args []string, out io.Writer) error {
+	o, err := parseLoadtestFlags(args, out)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+
+	k8s := fake.NewSimpleClientset()
+	sim := &simulatedEC2{latency: o.latency, volumes: o.volumes}
+	tagger := &Tagger{
+		k8s:      k8s,
+		ec2:      &ec2Clients{newClient: func(string) ec2API { return sim }},
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		recorder: &record.FakeRecorder{},
+		metrics:  newMetrics(""),
+	}
+	tagger.snapshot.Store(&tagSnapshot{tags: map[string]string{"loadtest": "true"}})
+
+	var waits, reconciles durations
+	pool := newWorkPool(o.workers, func(fn func()) {
+		start := time.Now()
+		fn()
+		reconciles.add(time.Since(start))
+	})
+	pool.observeWait = waits.add
+	poolDone := make(chan struct{})
+	go func() { pool.run(ctx); close(poolDone) }()
+	defer func() { cancel(); <-poolDone }()
+
+	createNode := func(name string, i int) error {
+		region := loadtestRegions[i%o.regions]
+		node := &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{corev1.LabelTopologyRegion: region}},
+			Spec:       corev1.NodeSpec{ProviderID: fmt.Sprintf("aws:///%sa/i-%017x", region, i)},
+		}
+		_, err := k8s.CoreV1().Nodes().Create(ctx, node, metav1.CreateOptions{})
+		return err
+	}
+	nodeName := func(i int) string { return fmt.Sprintf("loadtest-%05d", i) }
+
+	// A burst is created before the informer starts and arrives with its
+	// initial list; the fake API server's watch cannot buffer that many events.
+	if o.rate == 0 {
+		for i := range o.nodes {
+			if err := createNode(nodeName(i), i); err != nil {
+				return err
+			}
+		}
+	}
+
+	factory := informers.NewSharedInformerFactory(k8s, 0)
+	nodeInformer := factory.Core().V1().Nodes().Informer()
+	if _, err := nodeInformer.AddEventHandler(tagger.nodeEventHandler(ctx, pool)); err != nil {
+		return err
+	}
+	start := time.Now()
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), nodeInformer.HasSynced) {
+		return errors.New("fake informer did not sync")
+	}
+	lister := factory.Core().V1().Nodes().Lister()
+	tagged := func(name string) bool {
+		node, err := lister.Get(name)
+		return err == nil && tagger.isTagged(node.Annotations)
+	}
+
+	if o.rate > 0 {
+		for i := range o.nodes {
+			time.Sleep(time.Until(start.Add(time.Duration(float64(i) / o.rate * float64(time.Second)))))
+			if err := createNode(nodeName(i), i); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Replace the first nodes once they are tagged, as instance refreshes do.
+	replaced := int(o.churn * float64(o.nodes))
+	for i := range replaced {
+		name := nodeName(i)
+		if err := waitFor(ctx, func() bool { return tagged(name) }); err != nil {
+			return fmt.Errorf("node %s was not tagged: %w", name, err)
+		}
+		if err := k8s.CoreV1().Nodes().Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+			return err
+		}
+		if err := createNode(fmt.Sprintf("loadtest-replacement-%05d", i), o.nodes+i); err != nil {
+			return err
+		}
+	}
+
+	err = waitFor(ctx, func() bool {
+		nodes, err := lister.List(labels.Everything())
+		if err != nil || len(nodes) != o.nodes {
+			return false
+		}
+		for _, n := range nodes {
+			if !tagger.isTagged(n.Annotations) {
+				return false
+			}
+		}
+		return true
+	})
+	elapsed := time.Since(start)
+	if err != nil {
+		return fmt.Errorf("nodes were not all tagged within %s: %w", o.timeout, err)
+	}
+
+	total := o.nodes + replaced
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "nodes\t%d tagged (%d replaced), regions=%d workers=%d latency=%s\n", total, replaced, o.regions, o.workers, o.latency)
+	fmt.Fprintf(w, "elapsed\t%s\n", elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "throughput\t%.1f nodes/s\n", float64(total)/elapsed.Seconds())
+	fmt.Fprintf(w, "queue wait\t%s\n", waits.summary())
+	fmt.Fprintf(w, "reconcile\t%s\n", reconciles.summary())
+	fmt.Fprintf(w, "EC2 calls\tDescribeInstances=%d\tCreateTags=%d\n", sim.describeInstances.Load(), sim.createTags.Load())
+	return w.Flush()
+}
+
+// waitFor polls cond until it holds or ctx is done.
+func waitFor(ctx context.Context, cond func() bool) error {
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for !cond() {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunLoadtest(t *testing.T) {
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-nodes", "40", "-latency", "1ms", "-regions", "3", "-churn", "0.25"}, "50 tagged (10 replaced)"},
+		{[]string{"-nodes", "20", "-latency", "1ms", "-rate", "1000"}, "20 tagged (0 replaced)"},
+	}
+	for _, tc := range cases {
+		var out bytes.Buffer
+		if err := runLoadtest(tc.args, &out); err != nil {
+			t.Fatalf("runLoadtest(%q): %v", tc.args, err)
+		}
+		for _, want := range []string{tc.want, "throughput", "queue wait", "p99=", "CreateTags="} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("runLoadtest(%q) report lacks %q:\n%s", tc.args, want, out.String())
+			}
+		}
+	}
+}
+
+func TestParseLoadtestFlags(t *testing.T) {
+	for _, args := range [][]string{
+		{"-nodes", "0"},
+		{"-regions", "99"},
+		{"-churn", "1.5"},
+		{"-workers", "0"},
+		{"extra"},
+	} {
+		if _, err := parseLoadtestFlags(args, &bytes.Buffer{}); err == nil {
+			t.Errorf("parseLoadtestFlags(%q) accepted invalid flags", args)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Log formats accepted in LOG_FORMAT.
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+// logComponentKey is the attribute naming the component a log line comes
+// from; LOG_LEVELS sets the level of each component. Lines without it, such
+// as those of node and PV reconciles, use LOG_LEVEL.
+const logComponentKey = "component"
+
+// Log components.
+const (
+	// logComponentAWS logs every AWS API call attempt at debug level.
+	logComponentAWS             = "aws"
+	logComponentAudit           = "audit"
+	logComponentCheckpoint      = "checkpoint"
+	logComponentConfigDrift     = "configdrift"
+	logComponentConfigMigration = "configmigration"
+	logComponentHealth          = "health"
+	logComponentHeartbeat       = "heartbeat"
+	logComponentNotify          = "notify"
+	logComponentOverrides       = "overrides"
+	logComponentPolicies        = "policies"
+	logComponentPreflight       = "preflight"
+	logComponentSnapshots       = "snapshots"
+	logComponentSupervisor      = "supervisor"
+	logComponentVolumeSweep     = "volumesweep"
+)
+
+var logComponents = []string{
+	logComponentAWS, logComponentAudit, logComponentCheckpoint, logComponentConfigDrift, logComponentConfigMigration,
+	logComponentHealth, logComponentHeartbeat, logComponentNotify, logComponentOverrides, logComponentPolicies, logComponentPreflight, logComponentSnapshots, logComponentSupervisor,
+	logComponentVolumeSweep,
+}
+
+// redactedTagValue replaces the values of LOG_REDACT_TAG_KEYS in logs.
+const redactedTagValue = "[REDACTED]"
+
+// parseLogLevels parses LOG_LEVELS entries of the form component=level.
+func parseLogLevels(entries []string) (map[string]slog.Level, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	levels := make(map[string]slog.Level, len(entries))
+	for _, e := range entries {
+		component, value, ok := strings.Cut(e, "=")
+		component = strings.TrimSpace(component)
+		if !ok || component == "" {
+			return nil, fmt.Errorf("%q: expected component=level", e)
+		}
+		if !slices.Contains(logComponents, component) {
+			return nil, fmt.Errorf("%q: unknown component %q, expected one of %s", e, component, strings.Join(logComponents, ", "))
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(strings.TrimSpace(value))); err != nil {
+			return nil, fmt.Errorf("%q: %w", e, err)
+		}
+		levels[component] = level
+	}
+	return levels, nil
+}
+
+// newLogger returns the logger configured by LOG_FORMAT, LOG_LEVEL,
+// LOG_LEVELS and LOG_REDACT_TAG_KEYS, writing to w. The debug lines of node
+// and PV reconciles go through sampler unless it is nil.
+func newLogger(w io.Writer, cfg *Config, sampler *logSampler) *slog.Logger {
+	// The inner handler lets everything through; componentHandler filters.
+	lowest := cfg.LogLevel
+	for _, l := range cfg.LogLevels {
+		lowest = min(lowest, l)
+	}
+	opts := &slog.HandlerOptions{Level: lowest, ReplaceAttr: tagRedactor(cfg.LogRedactTagKeys, cfg.ClusterTagPrefix)}
+	var inner slog.Handler
+	if cfg.LogFormat == logFormatText {
+		inner = slog.NewTextHandler(w, opts)
+	} else {
+		inner = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(&componentHandler{inner: inner, level: cfg.LogLevel, levels: cfg.LogLevels, sampler: sampler})
+}
+
+// componentHandler applies the level of the component a logger was created
+// for with With(logComponentKey, name), or the default level, and samples
+// the debug lines of loggers without a component.
+type componentHandler struct {
+	inner   slog.Handler
+	level   slog.Level
+	levels  map[string]slog.Level
+	sampler *logSampler
+	// component is the last component set with WithAttrs, if any.
+	component string
+}
+
+func (h *componentHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	threshold := h.level
+	if l, ok := h.levels[h.component]; ok {
+		threshold = l
+	}
+	return level >= threshold && h.inner.Enabled(ctx, level)
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.sampler != nil && h.component == "" && r.Level < slog.LevelInfo {
+		write, dropped := h.sampler.sample(r.Message)
+		if !write {
+			return nil
+		}
+		if dropped > 0 {
+			r = r.Clone()
+			r.AddAttrs(slog.Uint64(sampledOutKey, dropped))
+		}
+	}
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	next := *h
+	next.inner = h.inner.WithAttrs(attrs)
+	for _, a := range attrs {
+		if a.Key == logComponentKey {
+			next.component = a.Value.String()
+		}
+	}
+	return &next
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	next := *h
+	next.inner = h.inner.WithGroup(name)
+	return &next
+}
+
+// logSampleRateAnnotation on the control ConfigMap overrides LOG_SAMPLE_RATE
+// while set:
+//
+//	kubectl -n kube-system annotate configmap aws-node-retag-control aws-node-retag.io/log-sample-rate=100
+const logSampleRateAnnotation = "aws-node-retag.io/log-sample-rate"
+
+// sampledOutKey is the attribute of a sampled log line counting the lines
+// with the same message left out since the previous one written.
+const sampledOutKey = "sampledOut"
+
+// logSampler thins out the debug lines of node and PV reconciles, which
+// repeat for every object on every resync ("skipping node", "PV already
+// tagged, skipping"): of each message, the first line is written and then
+// one in rate, carrying the number left out in between. The lines left out
+// are counted in aws_node_retag_log_lines_sampled_total{message}. A rate of
+// 1 writes every line.
+type logSampler struct {
+	// fallback is LOG_SAMPLE_RATE, in effect while the control ConfigMap
+	// does not set logSampleRateAnnotation.
+	fallback int
+	rate     atomic.Int64
+	// metrics is set once the collectors exist; lines left out before are
+	// not counted.
+	metrics atomic.Pointer[metrics]
+
+	mu sync.Mutex
+	// dropped is the number of lines left out per message since the last
+	// one written; a message is absent until its first line.
+	dropped map[string]uint64
+}
+
+func newLogSampler(rate int) *logSampler {
+	s := &logSampler{fallback: rate, dropped: map[string]uint64{}}
+	s.rate.Store(int64(rate))
+	return s
+}
+
+// sample reports whether to write a line with message msg and, if so, how
+// many lines with the same message were left out before it.
+func (s *logSampler) sample(msg string) (write bool, dropped uint64) {
+	rate := uint64(max(s.rate.Load(), 1))
+	s.mu.Lock()
+	n, seen := s.dropped[msg]
+	if !seen || n+1 >= rate {
+		s.dropped[msg] = 0
+		s.mu.Unlock()
+		return true, n
+	}
+	s.dropped[msg] = n + 1
+	s.mu.Unlock()
+	if m := s.metrics.Load(); m != nil {
+		m.logLinesSampled.WithLabelValues(msg).Inc()
+	}
+	return false, 0
+}
+
+// handler follows logSampleRateAnnotation on the control ConfigMap. Invalid
+// values are logged and leave the rate unchanged.
+func (s *logSampler) handler(logger *slog.Logger) cache.ResourceEventHandler {
+	update := func(cm *corev1.ConfigMap) {
+		rate := s.fallback
+		if cm != nil {
+			if v, ok := cm.Annotations[logSampleRateAnnotation]; ok {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 1 {
+					logger.Error("ignoring invalid log sample rate, expected a positive integer", "annotation", logSampleRateAnnotation, "value", v, "rate", s.rate.Load())
+					return
+				}
+				rate = n
+			}
+		}
+		if was := s.rate.Swap(int64(rate)); was != int64(rate) {
+			logger.Info("log sample rate changed", "rate", rate, "previous", was)
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if cm, ok := obj.(*corev1.ConfigMap); ok {
+				update(cm)
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if cm, ok := newObj.(*corev1.ConfigMap); ok {
+				update(cm)
+			}
+		},
+		DeleteFunc: func(interface{}) {
+			update(nil)
+		},
+	}
+}
+
+// loggedTagValue is the value of one tag, logged as a string unless its key
+// is redacted.
+type loggedTagValue struct {
+	key, value string
+}
+
+// tagRedactor returns the ReplaceAttr function that renders loggedTagValues
+// and replaces the values of the keys in redact, with or without the cluster
+// tag prefix, in logged tag sets (map[string]string and map[string]*string)
+// and loggedTagValues.
+func tagRedactor(redact []string, prefix string) func([]string, slog.Attr) slog.Attr {
+	keys := redactedTagKeys(redact, prefix)
+	return func(_ []string, a slog.Attr) slog.Attr {
+		if a.Value.Kind() != slog.KindAny {
+			return a
+		}
+		switch v := a.Value.Any().(type) {
+		case loggedTagValue:
+			if keys[v.key] {
+				return slog.String(a.Key, redactedTagValue)
+			}
+			return slog.String(a.Key, v.value)
+		case map[string]string:
+			if redactsAny(keys, v) {
+				return slog.Any(a.Key, redactTagValues(keys, v))
+			}
+		case map[string]*string:
+			if redactsAny(keys, v) {
+				out := make(map[string]*string, len(v))
+				for k, val := range v {
+					if keys[k] && val != nil {
+						r := redactedTagValue
+						val = &r
+					}
+					out[k] = val
+				}
+				return slog.Any(a.Key, out)
+			}
+		}
+		return a
+	}
+}
+
+// redactedTagKeys returns the set of the keys in redact, with and without the
+// cluster tag prefix.
+func redactedTagKeys(redact []string, prefix string) map[string]bool {
+	keys := make(map[string]bool, 2*len(redact))
+	for _, k := range redact {
+		keys[k] = true
+		keys[prefix+k] = true
+	}
+	return keys
+}
+
+// redactTagValues returns tags with the values of the keys in redact
+// replaced by redactedTagValue; tags itself when it has none of them.
+func redactTagValues(redact map[string]bool, tags map[string]string) map[string]string {
+	if !redactsAny(redact, tags) {
+		return tags
+	}
+	out := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if redact[k] {
+			v = redactedTagValue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+func redactsAny[V any](keys map[string]bool, tags map[string]V) bool {
+	for k := range tags {
+		if keys[k] {
+			return true
+		}
+	}
+	return false
+}
+
+// awsLogging returns an SDK API option logging the metadata of every AWS API
+// call attempt at debug level: service, operation, region, HTTP status,
+// request ID, duration and error. Tag keys and values are not logged.
+func awsLogging(logger *slog.Logger) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		// After the retry middleware, so every attempt is logged.
+		return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("AWSNodeRetagLogging",
+			func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+				if !logger.Enabled(ctx, slog.LevelDebug) {
+					return next.HandleFinalize(ctx, in)
+				}
+				start := time.Now()
+				out, md, err := next.HandleFinalize(ctx, in)
+				attrs := []any{
+					"service", awsmiddleware.GetServiceID(ctx),
+					"operation", awsmiddleware.GetOperationName(ctx),
+					"region", awsmiddleware.GetRegion(ctx),
+					"duration", time.Since(start),
+				}
+				if resp, ok := awsmiddleware.GetRawResponse(md).(*smithyhttp.Response); ok {
+					attrs = append(attrs, "statusCode", resp.StatusCode)
+				}
+				if id, ok := awsmiddleware.GetRequestIDMetadata(md); ok {
+					attrs = append(attrs, "requestID", id)
+				}
+				if err != nil {
+					attrs = append(attrs, "error", err)
+				}
+				logger.DebugContext(ctx, "AWS API call", attrs...)
+				return out, md, err
+			}), middleware.After)
+	}
+}
+
+// formatLogLevels renders levels as LOG_LEVELS, in component order.
+func formatLogLevels(levels map[string]string) string {
+	components := make([]string, 0, len(levels))
+	for c := range levels {
+		components = append(components, c)
+	}
+	sort.Strings(components)
+	entries := make([]string, len(components))
+	for i, c := range components {
+		entries[i] = c + "=" + levels[c]
+	}
+	return strings.Join(entries, ",")
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestParseLogLevels(t *testing.T) {
+	levels, err := parseLogLevels([]string{"aws=debug", " audit = WARN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 2 || levels[logComponentAWS] != slog.LevelDebug || levels[logComponentAudit] != slog.LevelWarn {
+		t.Errorf("parseLogLevels = %v", levels)
+	}
+	for _, bad := range []string{"aws", "ec2=debug", "aws=loud"} {
+		if _, err := parseLogLevels([]string{bad}); err == nil {
+			t.Errorf("parseLogLevels(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestNewLoggerComponentLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, &Config{
+		LogFormat: logFormatText,
+		LogLevel:  slog.LevelWarn,
+		LogLevels: map[string]slog.Level{logComponentAWS: slog.LevelDebug},
+	}, nil)
+	logger.Info("default info")
+	logger.Warn("default warn")
+	aws := logger.With(logComponentKey, logComponentAWS)
+	aws.Debug("aws debug")
+	aws.With("region", "us-east-1").Debug("aws debug with attrs")
+	logger.With(logComponentKey, logComponentAudit).Info("audit info")
+
+	out := buf.String()
+	for _, want := range []string{"default warn", "aws debug", "aws debug with attrs", "component=aws"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log output lacks %q:\n%s", want, out)
+		}
+	}
+	for _, unwanted := range []string{"default info", "audit info"} {
+		if strings.Contains(out, unwanted) {
+			t.Errorf("log output contains %q:\n%s", unwanted, out)
+		}
+	}
+}
+
+func TestNewLoggerRedactsTagValues(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, &Config{
+		LogFormat:        logFormatJSON,
+		LogRedactTagKeys: []string{"Secret"},
+		ClusterTagPrefix: "a/",
+	}, nil)
+	logger.Info("tags",
+		"tags", map[string]string{"Secret": "s3cr3t", "Team": "platform"},
+		"remove", map[string]*string{"a/Secret": aws.String("s3cr3t")},
+		"existing", loggedTagValue{"a/Secret", "s3cr3t"},
+		"desired", loggedTagValue{"Team", "platform"},
+	)
+	if strings.Contains(buf.String(), "s3cr3t") {
+		t.Fatalf("redacted value logged: %s", buf.String())
+	}
+	var line struct {
+		Tags     map[string]string
+		Remove   map[string]string
+		Existing string
+		Desired  string
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line.Tags["Secret"] != redactedTagValue || line.Tags["Team"] != "platform" ||
+		line.Remove["a/Secret"] != redactedTagValue || line.Existing != redactedTagValue || line.Desired != "platform" {
+		t.Errorf("logged %+v", line)
+	}
+}
+
+// cannedHTTP answers every request with an empty DescribeTags response.
+type cannedHTTP struct{}
+
+func (cannedHTTP) Do(*http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"X-Amzn-Requestid": []string{"req-1"}},
+		Body:       io.NopCloser(strings.NewReader(`<DescribeTagsResponse><requestId>req-1</requestId><tagSet/></DescribeTagsResponse>`)),
+	}, nil
+}
+
+func TestPolicyConflictsRedactTagValues(t *testing.T) {
+	var buf bytes.Buffer
+	cfg := &Config{LogFormat: logFormatJSON, LogRedactTagKeys: []string{"Secret"}, ClusterTagPrefix: "a/"}
+	tagger := newStartupTagger(nil, nil)
+	tagger.logger = newLogger(&buf, cfg, nil)
+	tagger.redactKeys = redactedTagKeys(cfg.LogRedactTagKeys, cfg.ClusterTagPrefix)
+	recorder := record.NewFakeRecorder(10)
+	tagger.recorder = recorder
+	tagger.policies = newPolicyStore(func([]*compiledPolicy) {})
+	tagger.snapshot.Store(&tagSnapshot{resolution: resolveSkip})
+
+	tagger.reportPolicyConflicts("pv/data", []policyConflict{
+		{Key: "a/Secret", Policies: []string{"a-web", "b-ml"}, Values: []string{"s3cr3t", "hunter2"}},
+		{Key: "Team", Policies: []string{"a-web", "b-ml"}, Values: []string{"web", "ml"}},
+	})
+	close(recorder.Events)
+	var events []string
+	for e := range recorder.Events {
+		events = append(events, e)
+	}
+	status := tagger.policies.status("a-web", 1, emptyNodeLister())
+	for _, out := range append(events, buf.String(), fmt.Sprint(status.Conditions)) {
+		if strings.Contains(out, "s3cr3t") || strings.Contains(out, "hunter2") {
+			t.Errorf("redacted value reported: %s", out)
+		}
+	}
+	if !strings.Contains(buf.String(), `"values":["web","ml"]`) {
+		t.Errorf("values of other keys not logged:\n%s", buf.String())
+	}
+	want := `Warning PolicyConflict On pv/data, tag a/Secret is set to "[REDACTED]" by a-web, "[REDACTED]" by b-ml; the key is skipped (resolution skip)`
+	if len(events) != 4 || events[0] != want {
+		t.Errorf("events = %q, want 4 starting with %q", events, want)
+	}
+}
+
+func TestAWSLogging(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newLogger(&buf, &Config{LogFormat: logFormatJSON, LogLevels: map[string]slog.Level{logComponentAWS: slog.LevelDebug}}, nil)
+	client := ec2.New(ec2.Options{
+		Region:      "us-east-1",
+		HTTPClient:  cannedHTTP{},
+		Credentials: aws.AnonymousCredentials{},
+		APIOptions:  []func(*middleware.Stack) error{awsLogging(logger.With(logComponentKey, logComponentAWS))},
+	})
+	if _, err := client.DescribeTags(context.Background(), &ec2.DescribeTagsInput{}); err != nil {
+		t.Fatal(err)
+	}
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("%v: %s", err, buf.String())
+	}
+	for k, want := range map[string]any{"msg": "AWS API call", "component": "aws", "service": "EC2", "operation": "DescribeTags", "region": "us-east-1", "statusCode": float64(200), "requestID": "req-1"} {
+		if line[k] != want {
+			t.Errorf("%s = %v, want %v", k, line[k], want)
+		}
+	}
+
+	// Nothing is logged above debug.
+	buf.Reset()
+	quiet := newLogger(&buf, &Config{LogFormat: logFormatJSON}, nil)
+	client = ec2.New(ec2.Options{
+		Region: "us-east-1", HTTPClient: cannedHTTP{}, Credentials: aws.AnonymousCredentials{},
+		APIOptions: []func(*middleware.Stack) error{awsLogging(quiet.With(logComponentKey, logComponentAWS))},
+	})
+	if _, err := client.DescribeTags(context.Background(), &ec2.DescribeTagsInput{}); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("logged at info level: %s", buf.String())
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	var buf bytes.Buffer
+	sampler := newLogSampler(3)
+	m := newMetrics("")
+	sampler.metrics.Store(m)
+	logger := newLogger(&buf, &Config{LogFormat: logFormatJSON, LogLevel: slog.LevelDebug}, sampler)
+	for i := 0; i < 7; i++ {
+		logger.With("node", fmt.Sprint(i)).Debug("skipping node")
+		logger.Info("tagging node")
+		logger.With(logComponentKey, logComponentAudit).Debug("audited node")
+	}
+	logger.Debug("PV already tagged, skipping")
+
+	counts := map[string]int{}
+	var sampledOut []any
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var line map[string]any
+		if err := json.Unmarshal([]byte(l), &line); err != nil {
+			t.Fatal(err)
+		}
+		counts[line["msg"].(string)]++
+		if line["msg"] == "skipping node" {
+			sampledOut = append(sampledOut, line[sampledOutKey])
+		}
+	}
+	// The first line of each message, then one in three; info and component
+	// lines are never sampled.
+	want := map[string]int{"skipping node": 3, "tagging node": 7, "audited node": 7, "PV already tagged, skipping": 1}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("lines per message = %v, want %v", counts, want)
+	}
+	if !reflect.DeepEqual(sampledOut, []any{nil, float64(2), float64(2)}) {
+		t.Errorf("sampledOut = %v, want [<nil> 2 2]", sampledOut)
+	}
+	if got := testutil.ToFloat64(m.logLinesSampled.WithLabelValues("skipping node")); got != 4 {
+		t.Errorf("log_lines_sampled_total{skipping node} = %v, want 4", got)
+	}
+
+	// Lowering the rate to 1 writes the next line, with the count left out
+	// before it, and every line after it.
+	buf.Reset()
+	logger.Debug("skipping node")
+	sampler.rate.Store(1)
+	logger.Debug("skipping node")
+	logger.Debug("skipping node")
+	if got := strings.Count(buf.String(), `"sampledOut":1`); got != 1 || strings.Count(buf.String(), "\n") != 2 {
+		t.Errorf("after rate 1:\n%s", buf.String())
+	}
+}
+
+func TestLogSamplerHandler(t *testing.T) {
+	sampler := newLogSampler(10)
+	h := sampler.handler(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	cm := func(rate string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{logSampleRateAnnotation: rate}}}
+	}
+	h.OnAdd(&corev1.ConfigMap{}, true)
+	if got := sampler.rate.Load(); got != 10 {
+		t.Errorf("rate without annotation = %d, want LOG_SAMPLE_RATE", got)
+	}
+	h.OnUpdate(nil, cm("100"))
+	if got := sampler.rate.Load(); got != 100 {
+		t.Errorf("rate = %d, want 100", got)
+	}
+	for _, bad := range []string{"0", "-1", "often"} {
+		h.OnUpdate(nil, cm(bad))
+		if got := sampler.rate.Load(); got != 100 {
+			t.Errorf("rate after %q = %d, want 100 kept", bad, got)
+		}
+	}
+	h.OnDelete(cm("100"))
+	if got := sampler.rate.Load(); got != 10 {
+		t.Errorf("rate after delete = %d, want LOG_SAMPLE_RATE", got)
+	}
+}
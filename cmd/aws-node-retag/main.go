@@ -4,11 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -16,297 +19,1325 @@ import (
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	smithy "github.com/aws/smithy-go"
+	awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+	"go.opentelemetry.io/otel/attribute"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
+	// annotationKey marks tagged nodes and PVs, and forceAnnotation set to
+	// "true" on a node or PV makes the controller tag it again; it is removed
+	// once the object is tagged. A controller with a CONTROLLER_ID uses both
+	// suffixed with -<id> (see controllerid.go).
 	annotationKey   = "aws-node-retag.io/tagged"
 	annotationValue = "true"
+	forceAnnotation = "aws-node-retag.io/force"
 	resyncPeriod    = 12 * time.Hour
 )
 
 type Tagger struct {
 	k8s    kubernetes.Interface
-	ec2    *ec2.Client
-	tags   map[string]string
+	ec2    *ec2Clients
 	dryRun bool
-	logger *slog.Logger
+	// readOnly blocks writes like dryRun (READ_ONLY).
+	readOnly bool
+
+	// snapshot holds the tag sources in effect (see snapshot.go).
+	snapshot atomic.Pointer[tagSnapshot]
+	// preserve is non-nil in PRESERVE_EXISTING mode (see preserve.go).
+	preserve *preservePolicy
+	// keyPrefix is prepended to every key written (CLUSTER_TAG_PREFIX); shared
+	// reports tag conflicts in SHARED_INSTANCES mode (see sharedinstances.go).
+	keyPrefix string
+	shared    bool
+	// managedVolumesOnly skips instance tagging for EKS managed nodegroup nodes.
+	managedVolumesOnly bool
+	// control carries runtime switches from the control ConfigMap (see control.go).
+	control *controlState
+	// policies tracks the TagPolicy objects and their status; nil unless
+	// TAG_POLICIES is enabled (see policy.go).
+	policies *policyStore
+
+	logger   *slog.Logger
+	recorder record.EventRecorder
+	metrics  *metrics
+	// redactKeys are the LOG_REDACT_TAG_KEYS, with and without the cluster
+	// tag prefix, whose values are also kept out of Events and statuses.
+	redactKeys map[string]bool
+
+	// quarantine lists resources never to mutate; nil when empty (see quarantine.go).
+	quarantine *quarantine
+	// notifier sends tagging failure notifications; nil unless a sink is
+	// configured (see notify.go).
+	notifier *notifier
+	// heartbeat pings HEARTBEAT_URL; nil when it is not set (see heartbeat.go).
+	heartbeat *heartbeat
+	// decisions records node reconciles for offline policy evaluation; nil
+	// when DECISION_LOG is not set (see decisionlog.go).
+	decisions *decisionLog
+	// configRule publishes audit results to an AWS Config rule; nil unless
+	// one is configured (see configrule.go).
+	configRule *configRulePublisher
+	// auditExport uploads audit reports to S3; nil unless AUDIT_S3_URI is
+	// set (see auditexport.go).
+	auditExport *auditExport
+	// features disables optional features whose IAM actions are denied
+	// (see featuregates.go).
+	features *featureGates
+	// deniedKeys are the tag keys IAM does not let the controller write
+	// (see deniedkeys.go).
+	deniedKeys *deniedTagKeys
+
+	// controllerID is CONTROLLER_ID; it suffixes the tagged and force
+	// annotations (see controllerid.go).
+	controllerID string
+	// asg tags the Auto Scaling groups of nodes; nil unless ASG_TAG_KEYS is
+	// set (see asg.go).
+	asg *asgTagger
+	// legacyMarkers are the LEGACY_ANNOTATIONS migrated at startup (see migrate.go).
+	legacyMarkers []legacyMarker
+
+	// nodeTimeout is NODE_RECONCILE_TIMEOUT, the budget of a node reconcile
+	// queued by nodeEventHandler; 0 leaves it unbounded.
+	nodeTimeout time.Duration
+
+	// startupTaint is the taint key removed from nodes once they are tagged;
+	// empty disables it (see startup.go).
+	startupTaint string
+
+	// providerIDFallback looks the instance of a node whose providerID cannot
+	// be parsed up by address (see instancelookup.go).
+	providerIDFallback bool
+
+	// protected are the tag keys never written or deleted; nil when none
+	// are (see protectedkeys.go).
+	protected *protectedKeys
+
+	// allowedRegions is nil when every region is allowed.
+	allowedRegions map[string]bool
+	// partition is the partition of the AWS config's region, whose
+	// credentials cannot reach regions of other partitions (see partition.go).
+	partition string
+
+	// backends selects the tagging backend of each resource kind
+	// (TAGGING_BACKENDS, see tagbackend.go); nil writes everything with
+	// ec2:CreateTags.
+	backends map[string]tagBackend
+
+	// discovery describes instances in bulk during a backlog; nil describes
+	// each on its own (VOLUME_DISCOVERY, see discovery.go).
+	discovery *volumeDiscovery
+	// volumeCache holds the volumes of the cluster's instances described at
+	// startup; nil without VOLUME_CACHE (see volumecache.go).
+	volumeCache *volumeCache
+
+	// overrides are the tag overrides submitted by external systems, merged
+	// over the tags of their instance; nil without TAG_OVERRIDES.
+	overrides *overrideStore
+
+	// termination stamps the instances of terminating nodes; nil unless
+	// TERMINATION_TAG or TERMINATION_TIME_TAG is set (see termination.go).
+	termination *terminationTags
+
+	// writes deduplicates the tag writes of node reconciles by resource ID;
+	// nil writes every resource (see pipeline.go).
+	writes *tagWrites
+
+	// rollout tracks node pool rolling upgrades; nil unless ROLLOUT_AWARE
+	// is set (see rollout.go).
+	rollout *rolloutState
+
+	// tasks runs the re-tags started in the background; nil in tests (see
+	// supervisor.go).
+	tasks *stage
+
+	// retagging is set while a full re-tag (SIGHUP, /admin/retag) runs.
+	retagging atomic.Bool
 }
 
 func main() {
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	kubeconfig := flag.String("kubeconfig", "", "path to a kubeconfig file for out-of-cluster use (defaults to $KUBECONFIG, then in-cluster config)")
+	configFile := flag.String("config", "", "path to a YAML or JSON settings file; environment variables override its settings")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [%s|%s|%s|%s|%s [loadtest flags]]\n", os.Args[0], cmdTagNode, cmdAudit, cmdReplay, cmdDashboard, cmdLoadtest)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
-	tagsRaw := os.Getenv("TAGS")
-	if tagsRaw == "" {
-		logger.Error(`TAGS environment variable is required (JSON object, e.g. {"Environment":"production"})`)
-		os.Exit(1)
+	command := flag.Arg(0)
+	if command == cmdLoadtest {
+		// The load test runs against simulated backends and takes its own flags.
+		if err := runLoadtest(flag.Args()[1:], os.Stdout); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return
+			}
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.NArg() > 1 || (command != "" && command != cmdTagNode && command != cmdAudit && command != cmdReplay && command != cmdDashboard) {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if command == cmdDashboard {
+		// The dashboard only depends on the metric names, not on the configuration.
+		if err := writeDashboard(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
-	var tags map[string]string
-	if err := json.Unmarshal([]byte(tagsRaw), &tags); err != nil {
-		logger.Error("failed to parse TAGS", "error", err, "value", tagsRaw)
+
+	// The audit and replay commands may write their report to stdout, so they
+	// log to stderr.
+	logOutput := os.Stdout
+	if command == cmdAudit || command == cmdReplay {
+		logOutput = os.Stderr
+	}
+	// Until the configuration is loaded, log JSON at the default level.
+	logger := slog.New(slog.NewJSONHandler(logOutput, nil))
+
+	getenv, err := withConfigFile(os.Getenv, *configFile)
+	if err != nil {
+		logger.Error("invalid configuration", "error", err)
 		os.Exit(1)
 	}
-	if len(tags) == 0 {
-		logger.Error("TAGS must contain at least one key-value pair")
+	cfg, err := loadConfig(getenv)
+	if err != nil {
+		logger.Error("invalid configuration", "error", err)
 		os.Exit(1)
 	}
-	logger.Info("loaded tags", "tags", tags)
+	// Replays never write, whatever the configuration.
+	if command == cmdReplay {
+		cfg.DryRun = true
+	}
+	sampler := newLogSampler(cfg.LogSampleRate)
+	logger = newLogger(logOutput, cfg, sampler)
+	if cfg.ControllerID != "" {
+		logger = logger.With(controllerLabel, cfg.ControllerID)
+	}
+	logger.Info("loaded tags", "tags", cfg.Tags, "tagPolicies", cfg.TagPolicies)
+	// The commands work on the controller's own cluster only.
+	if command != "" && len(cfg.Clusters) > 0 {
+		logger.Warn("CLUSTERS is ignored by the " + command + " command")
+		cfg.Clusters = nil
+	}
 
-	dryRun := os.Getenv("DRY_RUN") == "true"
-	if dryRun {
+	if cfg.ReadOnly {
+		logger.Info("read-only mode enabled — no AWS tags, Kubernetes objects or controller state will be written")
+	} else if cfg.DryRun {
 		logger.Info("dry-run mode enabled — no AWS tags or node annotations will be written")
 	}
 
-	k8sCfg, err := rest.InClusterConfig()
+	k8sCfg, err := buildKubeConfig(*kubeconfig, os.Getenv("KUBECONFIG"))
 	if err != nil {
-		logger.Error("failed to build in-cluster k8s config", "error", err)
+		logger.Error("failed to build k8s config", "error", err)
 		os.Exit(1)
 	}
+	logger.Info("connected to Kubernetes API", "host", k8sCfg.Host)
 	k8sClient, err := kubernetes.NewForConfig(k8sCfg)
 	if err != nil {
 		logger.Error("failed to create k8s client", "error", err)
 		os.Exit(1)
 	}
 
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
 	if err != nil {
 		logger.Error("failed to load AWS config", "error", err)
 		os.Exit(1)
 	}
-	ec2Client := ec2.NewFromConfig(awsCfg)
+	awsCfg.APIOptions = append(awsCfg.APIOptions, awsLogging(logger.With(logComponentKey, logComponentAWS)))
+	ec2Client := newEC2Clients(awsCfg, cfg.EC2Defaults, cfg.EC2RegionOptions)
+
+	// In multi-cluster mode the other clusters log and report metrics under
+	// their names, and this one under CLUSTER_NAME or "local". Their tag
+	// templates are expanded with identities of their own.
+	clusterLogger := logger
+	clusterCfgs := make([]*Config, len(cfg.Clusters))
+	for i, c := range cfg.Clusters {
+		clusterCfgs[i] = cfg.forCluster(c)
+	}
+	var hubCluster string
+	if len(cfg.Clusters) > 0 {
+		hubCluster = cfg.localClusterName()
+		logger = logger.With(clusterLabel, hubCluster)
+	}
+
+	if need := cfg.identityVariables(); len(need) > 0 {
+		identity, err := discoverClusterIdentity(ctx, need, identitySources{
+			clusterName: cfg.ClusterName,
+			k8s:         k8sClient,
+			ec2:         ec2Client,
+			sts:         sts.NewFromConfig(awsCfg),
+			eks:         eks.NewFromConfig(awsCfg),
+		})
+		if err != nil {
+			logger.Error("failed to discover cluster identity", "error", err)
+			os.Exit(1)
+		}
+		if err := cfg.applyIdentity(identity); err != nil {
+			logger.Error("invalid configuration", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("resolved tag templates from the cluster identity", "clusterName", identity.ClusterName, "accountId", identity.AccountID, "oidcIssuer", identity.OIDCIssuer, "tags", cfg.Tags)
+	}
+
+	shutdownTracing, err := setupTracing(ctx, cfg)
+	if err != nil {
+		logger.Error("failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	flushTraces := func() {
+		flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer flushCancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			logger.Warn("failed to flush traces", "error", err)
+		}
+	}
+	defer flushTraces()
+	if cfg.TracingEndpoint != "" {
+		logger.Info("exporting traces over OTLP", "endpoint", cfg.TracingEndpoint)
+	}
+
+	m := newClusterMetrics(cfg.ControllerID, hubCluster)
+	m.limitSeries(cfg.MetricsMaxSeries)
+	sampler.metrics.Store(m)
+	// The goroutines of the controller run in stages (see supervisor.go),
+	// stopped on shutdown in this order: the informers and background loops
+	// stop taking work, the work pools finish theirs, the final metrics
+	// checkpoint and pending notifications are flushed, so they include the
+	// drain's results, and the HTTP servers stop last.
+	sup := newSupervisor(m, logger.With(logComponentKey, logComponentSupervisor))
+	servers := sup.stage(context.Background(), "servers")
+	flush := sup.stage(context.Background(), "flush")
+	background := sup.stage(ctx, "background")
+	if store := newCheckpointStore(cfg, k8sClient, logger.With(logComponentKey, logComponentCheckpoint)); store != nil {
+		samples, err := store.Load(ctx)
+		if err != nil {
+			logger.Warn("failed to load metrics checkpoint, counters start from zero", "error", err)
+		} else {
+			logger.Info("restored metrics checkpoint", "series", m.restore(samples))
+		}
+		if cfg.ReadOnly && cfg.MetricsCheckpoint == checkpointConfigMap {
+			logger.Info("read-only: metrics checkpoints are restored but not saved")
+		} else {
+			flush.loop("metrics checkpoints", func(ctx context.Context) {
+				m.runCheckpoints(ctx, store, cfg.MetricsCheckpointInterval, logger.With(logComponentKey, logComponentCheckpoint))
+			})
+		}
+	}
+
+	recorder, broadcaster := newEventRecorder(k8sClient, controllerName(cfg.ControllerID), cfg.EventBurst, cfg.EventQPS)
+	defer broadcaster.Shutdown()
 
 	tagger := &Tagger{
-		k8s:    k8sClient,
-		ec2:    ec2Client,
-		tags:   tags,
-		dryRun: dryRun,
-		logger: logger,
+		k8s:        k8sClient,
+		ec2:        ec2Client,
+		dryRun:     cfg.DryRun,
+		readOnly:   cfg.ReadOnly,
+		logger:     logger,
+		recorder:   recorder,
+		metrics:    m,
+		control:    &controlState{},
+		features:   newFeatureGates(m, logger),
+		deniedKeys: newDeniedTagKeys(m, logger),
+		redactKeys: redactedTagKeys(cfg.LogRedactTagKeys, cfg.ClusterTagPrefix),
+
+		controllerID: cfg.ControllerID,
+
+		nodeTimeout:        cfg.NodeReconcileTimeout,
+		startupTaint:       cfg.StartupTaint,
+		managedVolumesOnly: cfg.ManagedNodegroupMode == nodegroupModeVolumesOnly,
+		providerIDFallback: cfg.ProviderIDFallback,
+		termination:        newTerminationTags(cfg),
+		writes:             newTagWrites(cfg.TagDedupWindow),
+		rollout:            newRolloutState(cfg, m, logger),
+		tasks:              background,
+	}
+	tagger.snapshot.Store((&tagSnapshot{attributeTags: cfg.InstanceAttributeTags, inventoryTags: cfg.NodeInventoryTags, resolution: cfg.PolicyConflictResolution}).withTags(envTagSources{
+		tags:           cfg.Tags,
+		rootVolumeTags: cfg.RootVolumeTags,
+		dataVolumeTags: cfg.DataVolumeTags,
+	}.forAuthority(cfg.ConfigAuthority)))
+	if cfg.ConfigAuthority == authorityCRD {
+		logger.Info("config authority is crd: TAGS, ROOT_VOLUME_TAGS and DATA_VOLUME_TAGS are not applied")
+	}
+	if cfg.PreserveExisting {
+		tagger.preserve = &preservePolicy{
+			overwrite:         make(map[string]bool, len(cfg.PreserveOverwriteKeys)),
+			protectedPrefixes: cfg.PreserveProtectedPrefixes,
+		}
+		for _, k := range cfg.PreserveOverwriteKeys {
+			tagger.preserve.overwrite[k] = true
+		}
+		logger.Info("preserving existing tag values", "overwriteKeys", cfg.PreserveOverwriteKeys, "protectedPrefixes", cfg.PreserveProtectedPrefixes)
+	}
+	tagger.keyPrefix = cfg.ClusterTagPrefix
+	if cfg.SharedInstances {
+		// Additive only: existing values are never overwritten.
+		tagger.shared = true
+		tagger.preserve = &preservePolicy{protectedPrefixes: cfg.PreserveProtectedPrefixes}
+		logger.Info("shared instances: writing additively under the cluster tag prefix", "prefix", cfg.ClusterTagPrefix)
+	}
+	if cfg.UntagOnNodeDelete {
+		logger.Info("managed tags will be removed from retained volumes of deleted nodes")
+	}
+	if cfg.WatchVolumeAttachments {
+		logger.Info("volumes will be tagged as soon as they are attached")
+	}
+	tagger.protected = newProtectedKeys(cfg.ProtectedTagKeys, cfg.ProtectedTagPrefixes)
+	if tagger.protected != nil {
+		logger.Info("protecting tag keys", "keys", cfg.ProtectedTagKeys, "prefixes", cfg.ProtectedTagPrefixes)
+	}
+	if len(cfg.TaggingBackends) > 0 {
+		tagger.backends = newTagBackends(ec2Client, cfg.TaggingBackends, cfg.TaggingAccountID)
+		logger.Info("selected tagging backends", "backends", cfg.TaggingBackends)
+	}
+	if len(cfg.ASGTagKeys) > 0 {
+		tagger.asg = newASGTagger(awsCfg, cfg.ASGTagKeys)
+		logger.Info("tagging the Auto Scaling groups of nodes", "keys", cfg.ASGTagKeys)
+	}
+	if tagger.legacyMarkers, err = parseLegacyAnnotations(cfg.LegacyAnnotations); err != nil {
+		// Validated in loadConfig.
+		logger.Error("invalid legacy annotations", "error", err)
+		os.Exit(1)
+	}
+	if tagger.quarantine, err = newQuarantine(cfg.QuarantineIDs, cfg.QuarantineTags); err != nil {
+		// Validated in loadConfig.
+		logger.Error("invalid quarantine", "error", err)
+		os.Exit(1)
+	}
+	if tagger.quarantine != nil {
+		logger.Info("quarantined resources will never be modified", "ids", cfg.QuarantineIDs, "tags", cfg.QuarantineTags)
+	}
+	if len(cfg.AllowedRegions) > 0 {
+		tagger.allowedRegions = make(map[string]bool, len(cfg.AllowedRegions))
+		for _, r := range cfg.AllowedRegions {
+			tagger.allowedRegions[r] = true
+		}
+		logger.Info("restricting tagging to allowed regions", "regions", cfg.AllowedRegions)
+	}
+	if awsCfg.Region != "" {
+		tagger.partition = partitionForRegion(awsCfg.Region)
+		logger.Info("resolved AWS partition", "region", awsCfg.Region, "partition", tagger.partition)
+	}
+
+	if cfg.AWSConfigResultTokenFile != "" || cfg.AWSConfigTestMode {
+		tagger.configRule = newConfigRulePublisher(awsCfg, cfg)
+		logger.Info("publishing audit results to AWS Config", "region", tagger.configRule.region, "testMode", cfg.AWSConfigTestMode)
+		if command == "" && cfg.AuditInterval <= 0 {
+			logger.Warn("AWS Config evaluations are published after each audit, but AUDIT_INTERVAL is not set")
+		}
+	}
+
+	if cfg.AuditS3URI != "" {
+		tagger.auditExport = newAuditExport(awsCfg, cfg)
+		logger.Info("uploading audit reports to S3", "bucket", tagger.auditExport.bucket, "prefix", tagger.auditExport.prefix, "region", tagger.auditExport.region, "format", cfg.AuditFormat)
+		if command == "" && cfg.AuditInterval <= 0 {
+			logger.Warn("audit reports are uploaded to S3 after each audit, but AUDIT_INTERVAL is not set")
+		}
+	}
+
+	if command == cmdTagNode {
+		if err := tagger.runTagNode(ctx, cfg, k8sCfg); err != nil {
+			logger.Error("tag-node failed", "error", err)
+			broadcaster.Shutdown()
+			flushTraces()
+			os.Exit(1)
+		}
+		return
+	}
+
+	if command == cmdAudit {
+		report, err := tagger.runAudit(ctx, cfg, k8sCfg)
+		broadcaster.Shutdown()
+		flushTraces()
+		switch {
+		case err != nil:
+			logger.Error("audit failed", "error", err)
+			os.Exit(1)
+		case len(report.Errors) > 0:
+			logger.Error("audit incomplete: some nodes could not be audited", "errors", len(report.Errors), "drifted", report.Drifted)
+			os.Exit(1)
+		case report.Drifted > 0:
+			logger.Warn("tag drift found", "nodes", report.Nodes, "resources", report.Resources, "drifted", report.Drifted)
+			os.Exit(auditDriftExitCode)
+		}
+		logger.Info("no tag drift found", "nodes", report.Nodes, "resources", report.Resources)
+		return
+	}
+
+	if command == cmdReplay {
+		report, err := tagger.runReplay(ctx, cfg, k8sCfg, os.Stdin, os.Stdout)
+		broadcaster.Shutdown()
+		flushTraces()
+		switch {
+		case err != nil:
+			logger.Error("replay failed", "error", err)
+			os.Exit(1)
+		case len(report.Mismatches) > 0:
+			logger.Warn("replayed decisions differ from the audit log", "nodes", report.Nodes, "events", report.Events, "mismatches", len(report.Mismatches))
+			os.Exit(replayMismatchExitCode)
+		}
+		logger.Info("replayed decisions match the audit log", "nodes", report.Nodes, "events", report.Events, "skipped", report.Skipped, "invalid", report.Invalid)
+		return
+	}
+
+	var sinks []notificationSink
+	if cfg.NotifySNSTopicARN != "" {
+		region, _ := snsTopicRegion(cfg.NotifySNSTopicARN) // validated
+		sinks = append(sinks, &snsSink{
+			api:      sns.NewFromConfig(awsCfg, func(o *sns.Options) { o.Region = region }),
+			topicARN: cfg.NotifySNSTopicARN,
+			region:   region,
+			features: tagger.features,
+		})
+	}
+	if cfg.NotifyWebhookURL != "" {
+		sinks = append(sinks, &webhookSink{client: &http.Client{}, url: cfg.NotifyWebhookURL})
+	}
+	if len(sinks) > 0 {
+		tagger.notifier = newNotifier(cfg, sinks, m, logger.With(logComponentKey, logComponentNotify))
+		flush.loop("notifications", tagger.notifier.run)
+		logger.Info("sending tagging failure notifications", "sns", cfg.NotifySNSTopicARN, "webhook", cfg.NotifyWebhookURL != "",
+			"nodeFailures", cfg.NotifyNodeFailures, "failureRate", cfg.NotifyFailureRate, "window", cfg.NotifyFailureWindow)
+	}
+
+	probes := newHealth(cfg.LivenessThreshold)
+	background.loop("health probes", func(ctx context.Context) {
+		probes.run(ctx, k8sClient, awsCfg.Credentials, logger.With(logComponentKey, logComponentHealth))
+	})
+	servers.serve("health probe", cfg.HealthProbeAddr, probes.handler(), logger)
+
+	if awsCfg.Region == "" {
+		logger.Warn("IAM preflight skipped: no AWS region is configured")
+	} else {
+		preflightTags := make(map[string]string, len(cfg.Tags))
+		for k, v := range cfg.Tags {
+			preflightTags[cfg.ClusterTagPrefix+k] = v
+		}
+		p := &iamPreflight{
+			sts:    sts.NewFromConfig(awsCfg),
+			ec2:    ec2Client.forRegion(awsCfg.Region),
+			k8s:    k8sClient,
+			region: awsCfg.Region,
+			tags:   preflightTags,
+			writes: !cfg.DryRun && !cfg.ReadOnly,
+		}
+		preflightLogger := logger.With(logComponentKey, logComponentPreflight)
+		if cfg.FailFast {
+			report, err := p.run(ctx)
+			if err != nil {
+				preflightLogger.Error("IAM preflight failed", "error", err, "arn", report.ARN)
+				os.Exit(1)
+			}
+			logPreflight(report, preflightLogger)
+		} else {
+			probes.setPreflightError(errPreflightPending)
+			background.spawn("IAM preflight", func() { runPreflight(ctx, p, probes, preflightLogger) })
+		}
+	}
+
+	if cfg.HeartbeatURL != "" {
+		tagger.heartbeat = newHeartbeat(cfg, &http.Client{}, probes.ready, m, logger.With(logComponentKey, logComponentHeartbeat))
+		background.loop("heartbeat", tagger.heartbeat.run)
+		logger.Info("pinging heartbeat URL", "interval", cfg.HeartbeatInterval)
+	}
+	if tagger.decisions = newDecisionLog(cfg); tagger.decisions != nil {
+		defer tagger.decisions.Close()
+		logger.Info("writing decision records", "path", cfg.DecisionLog, "maxSize", cfg.DecisionLogMaxSize)
 	}
 
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", m.handler())
+	servers.serve("metrics", cfg.MetricsAddr, metricsMux, logger)
+
 	factory := informers.NewSharedInformerFactory(k8sClient, resyncPeriod)
+	metricsMux.Handle("/debug/explain", requireToken(cfg.AdminToken, tagger.explainHandler(factory.Core().V1().Nodes().Lister())))
+	metricsMux.Handle("/config", requireToken(cfg.AdminToken, tagger.configHandler(cfg)))
+	metricsMux.Handle("/admin/retag", requireToken(cfg.AdminToken,
+		tagger.retagHandler(ctx, factory.Core().V1().Nodes().Lister(), factory.Core().V1().PersistentVolumes().Lister())))
 	nodeInformer := factory.Core().V1().Nodes().Informer()
 
-	nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			node, ok := obj.(*corev1.Node)
-			if !ok {
-				return
+	// Events are reconciled by the pool's workers, not on the informer
+	// goroutines, under workCtx: it outlives ctx on shutdown so the queued and
+	// in-flight reconciles can finish within SHUTDOWN_GRACE_PERIOD. A
+	// panicking reconcile is recovered and the worker goes on.
+	workers := sup.stage(context.Background(), "workers")
+	workCtx := workers.ctx
+	track := func(fn func()) {
+		probes.track(func() { sup.protect("workers", fn) })
+	}
+	pool := newWorkPool(cfg.Workers, track)
+	workers.loop("work pool", pool.run)
+	logger.Info("reconciling events concurrently", "workers", cfg.Workers)
+	tagger.discovery = newVolumeDiscovery(cfg.VolumeDiscovery, cfg.VolumeDiscoveryBulkThreshold, pool)
+	tagger.volumeCache = newVolumeCache(cfg)
+
+	clusters := make([]*clusterRun, 0, len(cfg.Clusters))
+	for i, c := range cfg.Clusters {
+		r, err := newClusterRun(workCtx, tagger, clusterCfgs[i], c, *kubeconfig, track, clusterLogger)
+		if err != nil {
+			logger.Error("failed to set up cluster", "name", c.Name, "error", err)
+			os.Exit(1)
+		}
+		clusters = append(clusters, r)
+	}
+
+	nodeHandler := tagger.nodeEventHandler(workCtx, pool)
+	nodeHandler.DeleteFunc = tagger.nodeDeleteFunc(workCtx, pool, factory.Core().V1().PersistentVolumes().Lister(), cfg.UntagOnNodeDelete)
+	nodeInformer.AddEventHandler(nodeHandler)
+
+	pvInformer := factory.Core().V1().PersistentVolumes().Informer()
+	pvInformer.AddEventHandler(tagger.pvEventHandler(workCtx, pool))
+
+	if cfg.WatchVolumeAttachments {
+		nodeLister := factory.Core().V1().Nodes().Lister()
+		pvLister := factory.Core().V1().PersistentVolumes().Lister()
+		factory.Storage().V1().VolumeAttachments().Informer().AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+			AddFunc: func(obj interface{}, isInInitialList bool) {
+				va, ok := obj.(*storagev1.VolumeAttachment)
+				// Volumes attached before startup are covered by their
+				// node and PV; re-tagging all of them would flood EC2.
+				if !ok || isInInitialList || !va.Status.Attached {
+					return
+				}
+				pool.add(workItem{key: "volumeattachment/" + va.Name, fn: func() { tagger.handleVolumeAttachment(workCtx, va, nodeLister, pvLister) }})
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldVA, ok1 := oldObj.(*storagev1.VolumeAttachment)
+				newVA, ok2 := newObj.(*storagev1.VolumeAttachment)
+				if !ok1 || !ok2 {
+					return
+				}
+				if !oldVA.Status.Attached && newVA.Status.Attached {
+					pool.add(workItem{key: "volumeattachment/" + newVA.Name, fn: func() { tagger.handleVolumeAttachment(workCtx, newVA, nodeLister, pvLister) }})
+				}
+			},
+		})
+	}
+
+	informers := sup.stage(context.Background(), "informers")
+	stopCh := informers.ctx.Done()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+
+	var migration *configMigration
+	if cfg.ConfigMigration {
+		migration = newConfigMigration(tagger, cfg, m, logger.With(logComponentKey, logComponentConfigMigration))
+		migration.onSwitch = func() {
+			background.spawn("config authority switch", func() {
+				tagger.reconcileAll(ctx, factory.Core().V1().Nodes().Lister(), factory.Core().V1().PersistentVolumes().Lister(), true)
+			})
+		}
+	}
+
+	// The pause switch must be known before the first node event is handled.
+	if cfg.Namespace == "" {
+		logger.Warn("pause control disabled: POD_NAMESPACE is not set")
+		if migration != nil {
+			logger.Warn("config authority switch disabled: POD_NAMESPACE is not set", "authority", cfg.ConfigAuthority)
+		}
+	} else {
+		controlFactory := newControlInformerFactory(k8sClient, cfg.Namespace, cfg.ControlConfigMap)
+		controlInformer := controlFactory.Core().V1().ConfigMaps().Informer()
+		controlInformer.AddEventHandler(tagger.control.handler(m, func() {
+			background.spawn("resume", func() {
+				tagger.reconcileAll(ctx, factory.Core().V1().Nodes().Lister(), factory.Core().V1().PersistentVolumes().Lister(), false)
+			})
+			for _, r := range clusters {
+				background.spawn("resume", func() { r.reconcileAll(ctx, false) })
 			}
-			tagger.handleNode(ctx, node)
-		},
-		UpdateFunc: func(oldObj, newObj interface{}) {
-			oldNode, ok1 := oldObj.(*corev1.Node)
-			newNode, ok2 := newObj.(*corev1.Node)
-			if !ok1 || !ok2 {
-				return
+		}, logger))
+		if migration != nil {
+			controlInformer.AddEventHandler(migration.handler())
+		}
+		controlInformer.AddEventHandler(sampler.handler(logger))
+		controlFactory.Start(stopCh)
+		informers.onStop(controlFactory.Shutdown)
+		if !cache.WaitForCacheSync(stopCh, controlInformer.HasSynced) {
+			logger.Error("timed out waiting for control ConfigMap cache sync")
+			informers.stop()
+			os.Exit(1)
+		}
+		logger.Info("watching control ConfigMap", "namespace", cfg.Namespace, "name", cfg.ControlConfigMap)
+	}
+
+	// Like the pause switch, policies must be known before nodes are handled.
+	if cfg.TagPolicies {
+		dyn, err := dynamic.NewForConfig(k8sCfg)
+		if err != nil {
+			logger.Error("failed to create dynamic client", "error", err)
+			os.Exit(1)
+		}
+		switch {
+		case !cfg.InstallCRDs:
+		case cfg.ReadOnly:
+			logger.Info("read-only: not installing CRDs")
+		default:
+			if err := installCRDs(ctx, dyn, logger); err != nil {
+				logger.Error("failed to install CRDs", "error", err)
+				os.Exit(1)
 			}
-			// Only act when ProviderID transitions from empty to set.
-			// This handles the case where cloud-controller-manager sets the
-			// ProviderID after the node first appears in the API.
-			if oldNode.Spec.ProviderID == "" && newNode.Spec.ProviderID != "" {
-				tagger.handleNode(ctx, newNode)
+		}
+		// Fail fast rather than waiting forever on a cache sync that cannot succeed.
+		if _, err := dyn.Resource(tagPolicyGVR).List(ctx, metav1.ListOptions{Limit: 1}); err != nil {
+			logger.Error("cannot list TagPolicies; is the CRD installed?", "error", err)
+			os.Exit(1)
+		}
+		tagger.policies = newPolicyStore(tagger.publishPolicies)
+		tagger.policies.onClose = func(p *compiledPolicy) {
+			background.spawn("policy untag", func() {
+				tagger.untagPolicy(ctx, p, factory.Core().V1().Nodes().Lister(), factory.Core().V1().PersistentVolumes().Lister())
+			})
+		}
+		var ttl *ttlState
+		switch {
+		case cfg.ReadOnly:
+			logger.Info("read-only: TagPolicy TTLs are not persisted")
+		case cfg.Namespace == "":
+			logger.Warn("TagPolicy TTLs are not persisted: POD_NAMESPACE is not set")
+		default:
+			ttl = &ttlState{k8s: k8sClient, namespace: cfg.Namespace, name: cfg.TagTTLConfigMap}
+		}
+		if starts, err := ttl.load(ctx); err != nil {
+			logger.Warn("failed to restore TagPolicy TTLs; policies with a TTL start a new one", "configMap", cfg.TagTTLConfigMap, "error", err)
+		} else {
+			tagger.policies.restoreTTLs(starts)
+		}
+		tagger.policies.saveTTL = func(changed map[string]*ttlStart) {
+			if err := ttl.save(ctx, changed); err != nil {
+				logger.Warn("failed to persist TagPolicy TTLs", "configMap", cfg.TagTTLConfigMap, "error", err)
 			}
-		},
-	})
+		}
+		policyFactory := dynamicinformer.NewDynamicSharedInformerFactory(dyn, resyncPeriod)
+		policyInformer := policyFactory.ForResource(tagPolicyGVR).Informer()
+		policyInformer.AddEventHandler(tagger.policies.handler(func(p *compiledPolicy) {
+			background.spawn("policy retag", func() {
+				tagger.retagPolicy(ctx, p, factory.Core().V1().Nodes().Lister(), factory.Core().V1().PersistentVolumes().Lister())
+			})
+		}, logger.With(logComponentKey, logComponentPolicies)))
+		policyFactory.Start(stopCh)
+		informers.onStop(policyFactory.Shutdown)
+		if !cache.WaitForCacheSync(stopCh, policyInformer.HasSynced) {
+			logger.Error("timed out waiting for TagPolicy cache sync")
+			informers.stop()
+			os.Exit(1)
+		}
+		tagger.policies.pruneTTLs()
+		logger.Info("watching TagPolicies", "count", len(tagger.current().policies))
+		if cfg.ReadOnly {
+			logger.Info("read-only: TagPolicy status is not updated")
+		} else {
+			background.loop("policy status", func(ctx context.Context) {
+				tagger.policies.runStatusUpdates(ctx, dyn, policyInformer.GetStore(), factory.Core().V1().Nodes().Lister(), logger.With(logComponentKey, logComponentPolicies))
+			})
+		}
+		background.loop("policy schedules", func(ctx context.Context) {
+			tagger.policies.runSchedules(ctx, func(p *compiledPolicy) {
+				tagger.retagPolicy(ctx, p, factory.Core().V1().Nodes().Lister(), factory.Core().V1().PersistentVolumes().Lister())
+			}, logger.With(logComponentKey, logComponentPolicies))
+		})
+	}
 
-	pvInformer := factory.Core().V1().PersistentVolumes().Informer()
-	pvInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			pv, ok := obj.(*corev1.PersistentVolume)
-			if !ok {
+	if migration != nil {
+		metricsMux.Handle(configMigrationPath, requireToken(cfg.AdminToken, migration.httpHandler()))
+		background.loop("config migration", func(ctx context.Context) {
+			// The first comparison runs once the caches hold every object.
+			if !cache.WaitForCacheSync(ctx.Done(), nodeInformer.HasSynced, pvInformer.HasSynced) {
 				return
 			}
-			// Only handle Bound PVs — skip Released/Available/Failed volumes,
-			// whose backing EBS volumes may no longer exist.
-			if pv.Status.Phase != corev1.VolumeBound {
-				return
+			migration.run(ctx, factory.Core().V1().Nodes().Lister(), factory.Core().V1().PersistentVolumes().Lister(), configMigrationInterval)
+		})
+		logger.Info("comparing TAGS with TagPolicies", "authority", migration.current(), "path", configMigrationPath)
+	}
+
+	// Overrides too must be known before nodes are handled.
+	if cfg.TagOverrides {
+		if cfg.Namespace == "" {
+			logger.Warn("tag overrides disabled: POD_NAMESPACE is not set")
+		} else {
+			overrides := newOverrideStore(k8sClient, cfg, m, logger.With(logComponentKey, logComponentOverrides))
+			tagger.overrides = overrides
+			// Overrides are by instance ID, whichever cluster runs it.
+			for _, r := range clusters {
+				r.tagger.overrides = overrides
 			}
-			tagger.handlePV(ctx, pv)
-		},
-		UpdateFunc: func(oldObj, newObj interface{}) {
-			oldPV, ok1 := oldObj.(*corev1.PersistentVolume)
-			newPV, ok2 := newObj.(*corev1.PersistentVolume)
-			if !ok1 || !ok2 {
-				return
+			overrides.onChange = func(instanceID string) {
+				tagger.retagInstance(workCtx, pool, factory.Core().V1().Nodes().Lister(), instanceID)
+				for _, r := range clusters {
+					r.retagInstance(workCtx, instanceID)
+				}
 			}
-			// Fire when PV transitions to Bound (dynamic provisioning completes).
-			if oldPV.Status.Phase != corev1.VolumeBound && newPV.Status.Phase == corev1.VolumeBound {
-				tagger.handlePV(ctx, newPV)
+			overrideFactory := newControlInformerFactory(k8sClient, cfg.Namespace, cfg.TagOverridesConfigMap)
+			overrideInformer := overrideFactory.Core().V1().ConfigMaps().Informer()
+			overrideInformer.AddEventHandler(overrides.handler())
+			overrideFactory.Start(stopCh)
+			informers.onStop(overrideFactory.Shutdown)
+			if !cache.WaitForCacheSync(stopCh, overrideInformer.HasSynced) {
+				logger.Error("timed out waiting for tag overrides ConfigMap cache sync")
+				informers.stop()
+				os.Exit(1)
 			}
-		},
-	})
+			overridesHandler := requireToken(cfg.TagOverridesToken, overrides.httpHandler())
+			metricsMux.Handle(strings.TrimSuffix(overridesPath, "/"), overridesHandler)
+			metricsMux.Handle(overridesPath, overridesHandler)
+			logger.Info("accepting tag overrides", "path", overridesPath, "namespace", cfg.Namespace, "configMap", cfg.TagOverridesConfigMap)
+		}
+	}
 
-	stopCh := make(chan struct{})
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	if cfg.ConfigDriftCheck {
+		switch {
+		case cfg.ReadOnly:
+			logger.Warn("config drift check disabled: it publishes to a ConfigMap, which read-only mode blocks")
+		case cfg.Namespace == "" || cfg.PodName == "":
+			logger.Warn("config drift check disabled: POD_NAMESPACE and POD_NAME must be set")
+		default:
+			hashes := &configHashes{
+				k8s:        k8sClient,
+				namespace:  cfg.Namespace,
+				name:       cfg.ConfigHashConfigMap,
+				replica:    cfg.PodName,
+				staleAfter: configHashStaleAfter * cfg.ConfigHashInterval,
+				now:        time.Now,
+			}
+			background.loop("config drift", func(ctx context.Context) {
+				tagger.runConfigDriftChecks(ctx, cfg, hashes, cfg.ConfigHashInterval, logger.With(logComponentKey, logComponentConfigDrift))
+			})
+		}
+	}
+
+	if cfg.VolumeSweepInterval > 0 {
+		regions := cfg.VolumeSweepRegions
+		if len(regions) == 0 {
+			regions = []string{awsCfg.Region}
+		}
+		var cursor *sweepCursor
+		switch {
+		case cfg.ReadOnly:
+			logger.Info("read-only: volume sweep position is not persisted")
+		case cfg.Namespace == "":
+			logger.Warn("volume sweep position is not persisted: POD_NAMESPACE is not set")
+		default:
+			cursor = &sweepCursor{k8s: k8sClient, namespace: cfg.Namespace, name: cfg.VolumeSweepConfigMap}
+		}
+		logger.Info("sweeping volumes by ownership tag", "tag", cfg.VolumeSweepTag, "regions", regions, "interval", cfg.VolumeSweepInterval)
+		background.loop("volume sweeps", func(ctx context.Context) {
+			tagger.runVolumeSweeps(ctx, cfg, regions, cursor, logger.With(logComponentKey, logComponentVolumeSweep))
+		})
+	}
+
+	if cfg.SnapshotTagInterval > 0 {
+		regions := cfg.SnapshotTagRegions
+		if len(regions) == 0 {
+			regions = []string{awsCfg.Region}
+		}
+		logger.Info("tagging snapshots of tagged volumes", "regions", regions, "interval", cfg.SnapshotTagInterval)
+		background.loop("snapshot tagging", func(ctx context.Context) {
+			tagger.runSnapshotTagging(ctx, cfg, regions, logger.With(logComponentKey, logComponentSnapshots))
+		})
+	}
+
+	if cfg.AuditInterval > 0 {
+		background.loop("audits", func(ctx context.Context) {
+			tagger.runAudits(ctx, factory.Core().V1().Nodes().Lister(), cfg, logger.With(logComponentKey, logComponentAudit))
+		})
+	}
+
+	// Legacy markers are converted before the informers decide on the objects.
+	if cfg.MigrateLegacyAnnotations {
+		if err := tagger.migrateLegacyAnnotations(ctx, cfg.Workers); err != nil {
+			logger.Warn("failed to migrate legacy annotations, leaving the objects to the regular reconcile", "error", err)
+		}
+	}
 
 	factory.Start(stopCh)
+	informers.onStop(factory.Shutdown)
 	logger.Info("waiting for cache sync")
 	if !cache.WaitForCacheSync(stopCh, nodeInformer.HasSynced, pvInformer.HasSynced) {
 		logger.Error("timed out waiting for cache sync")
-		close(stopCh)
+		informers.stop()
 		os.Exit(1)
 	}
+	probes.synced.Store(true)
 	logger.Info("cache synced, watching for nodes and persistent volumes")
+	if tagger.volumeCache != nil {
+		// Reconciles queued meanwhile wait for the cache.
+		nodes, _ := factory.Core().V1().Nodes().Lister().List(labels.Everything())
+		background.spawn("volume cache", func() { tagger.warmVolumeCache(ctx, nodes) })
+	}
+	for _, r := range clusters {
+		r.start(workers, informers)
+	}
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	background.loop("SIGHUP", func(ctx context.Context) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hupCh:
+			}
+			logger.Info("received SIGHUP")
+			if !tagger.retagAll(ctx, factory.Core().V1().Nodes().Lister(), factory.Core().V1().PersistentVolumes().Lister()) {
+				logger.Warn("a full re-tag is already in progress, ignoring SIGHUP")
+			}
+			for _, r := range clusters {
+				if !r.retagAll(ctx) {
+					r.tagger.logger.Warn("a full re-tag is already in progress, ignoring SIGHUP")
+				}
+			}
+		}
+	})
 
 	<-sigCh
-	logger.Info("shutting down")
-	close(stopCh)
+	signal.Stop(hupCh)
+	logger.Info("shutting down", "gracePeriod", cfg.ShutdownGracePeriod)
+	// No new work: the informers and background loops stop, and the pool only
+	// finishes what it has.
+	informers.stop()
+	cancel()
+	graceCtx, graceCancel := context.WithTimeout(context.Background(), cfg.ShutdownGracePeriod)
+	if left := pool.drain(graceCtx); left > 0 {
+		logger.Warn("shutdown grace period expired, cancelling in-flight reconciles", "items", left)
+	}
+	for _, r := range clusters {
+		if left := r.pool.drain(graceCtx); left > 0 {
+			r.tagger.logger.Warn("shutdown grace period expired, cancelling in-flight reconciles", "items", left)
+		}
+	}
+	graceCancel()
+	workers.stop()
+	for _, r := range clusters {
+		r.broadcaster.Shutdown()
+	}
+	flush.stop()
+	servers.stop()
+	background.stop()
 }
 
-// handleNode tags the EC2 instance and its EBS volumes for a given node.
-// It is idempotent: nodes that already carry the tagged annotation are skipped.
-func (t *Tagger) handleNode(ctx context.Context, node *corev1.Node) {
-	log := t.logger.With("node", node.Name)
-
-	if node.Annotations[annotationKey] == annotationValue {
-		log.Debug("node already tagged, skipping")
+// reconcileAll re-runs the handlers for every cached node and bound PV; with
+// force, objects already carrying the tagged annotation are tagged again.
+func (t *Tagger) reconcileAll(ctx context.Context, nodes corelisters.NodeLister, pvs corelisters.PersistentVolumeLister, force bool) {
+	nodeList, err := nodes.List(labels.Everything())
+	if err != nil {
+		t.logger.Error("failed to list nodes from cache", "error", err)
 		return
 	}
+	for _, node := range nodeList {
+		t.tagNode(ctx, node, force)
+	}
 
-	if node.Spec.ProviderID == "" {
-		log.Info("providerID not yet set, will retry on UpdateFunc")
+	pvList, err := pvs.List(labels.Everything())
+	if err != nil {
+		t.logger.Error("failed to list persistent volumes from cache", "error", err)
 		return
 	}
+	for _, pv := range pvList {
+		if pv.Status.Phase == corev1.VolumeBound {
+			t.tagPV(ctx, pv, force)
+		}
+	}
+}
 
-	if !strings.HasPrefix(node.Spec.ProviderID, "aws://") {
-		log.Warn("not an AWS node, skipping", "providerID", node.Spec.ProviderID)
-		return
+// writeBlocked returns why mutations are currently disabled, or "" when they
+// are allowed. Blocked writes are logged as "<reason>: would ...".
+func (t *Tagger) writeBlocked() string {
+	switch {
+	case t.readOnly:
+		return "read-only"
+	case t.dryRun:
+		return "dry-run"
+	case t.control != nil && t.control.paused.Load():
+		return "paused"
 	}
+	return ""
+}
 
-	instanceID, err := parseInstanceID(node.Spec.ProviderID)
-	if err != nil {
-		log.Error("failed to parse instance ID", "providerID", node.Spec.ProviderID, "error", err)
-		return
+// newCheckpointStore returns the configured metrics checkpoint store, or nil
+// when checkpointing is disabled or cannot work in this environment.
+func newCheckpointStore(cfg *Config, k8s kubernetes.Interface, logger *slog.Logger) checkpointStore {
+	switch cfg.MetricsCheckpoint {
+	case checkpointFile:
+		return &fileCheckpoint{path: cfg.MetricsCheckpointFile}
+	case checkpointConfigMap:
+		if cfg.Namespace == "" {
+			logger.Warn("metrics checkpoint disabled: POD_NAMESPACE is not set")
+			return nil
+		}
+		return &configMapCheckpoint{k8s: k8s, namespace: cfg.Namespace, name: cfg.MetricsCheckpointConfigMap}
 	}
+	return nil
+}
 
-	region, err := parseRegion(node.Spec.ProviderID)
-	if err != nil {
-		log.Error("failed to parse region", "providerID", node.Spec.ProviderID, "error", err)
+// buildKubeConfig returns the in-cluster config unless a kubeconfig is given,
+// either explicitly via the flag or through the KUBECONFIG environment variable
+// (which may list several files, merged as kubectl does).
+func buildKubeConfig(flagPath, envPath string) (*rest.Config, error) {
+	if flagPath == "" && envPath == "" {
+		return rest.InClusterConfig()
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = flagPath
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+}
+
+// handleNode tags the EC2 instance and its EBS volumes for a given node.
+// It is idempotent: nodes that already carry the tagged annotation are skipped.
+func (t *Tagger) handleNode(ctx context.Context, node *corev1.Node) error {
+	return t.tagNode(ctx, node, false)
+}
+
+// tagNode tags the node's instance and volumes; with force it also re-tags
+// nodes that already carry the tagged annotation. It returns the error that
+// failed the reconcile, if any.
+func (t *Tagger) tagNode(ctx context.Context, node *corev1.Node, force bool) (err error) {
+	log := t.logger.With("node", node.Name)
+
+	ctx, span := startSpan(ctx, "reconcile node", attribute.String("k8s.node.name", node.Name), attribute.Bool("force", force))
+	defer func() { endSpan(span, err) }()
+
+	d := t.resolveNode(ctx, node, force)
+	span.SetAttributes(
+		attribute.String("decision.action", d.Action),
+		attribute.String("decision.reason", d.Reason),
+		attribute.String("aws.ec2.instance_id", d.InstanceID),
+		attribute.Int64("config.version", int64(d.ConfigVersion)),
+	)
+	switch d.Action {
+	case actionWait:
+		log.Info("providerID not yet set, will retry on UpdateFunc")
+		return
+	case actionError:
+		log.Error("cannot tag node", "reason", d.Reason, "providerID", node.Spec.ProviderID, "error", d.Detail)
+		t.metrics.failed(kindNode)
+		t.metrics.nodeFailed(node.Name)
+		err = d.err
+		return
+	case actionSkip:
+		switch d.Reason {
+		case "region_not_allowed":
+			log.Warn("region not in allowed list, skipping", "instanceID", d.InstanceID, "region", d.Region)
+			t.recorder.Eventf(node, corev1.EventTypeWarning, reasonRegionNotAllowed,
+				"Region %s (from providerID %s) is not in the allowed region list; instance %s was not tagged", d.Region, node.Spec.ProviderID, d.InstanceID)
+		case "partition_mismatch":
+			log.Warn("region is in another partition than the controller's credentials, skipping", "instanceID", d.InstanceID, "region", d.Region, "partition", t.partition)
+		case "not_aws":
+			log.Warn("not an AWS node, skipping", "providerID", node.Spec.ProviderID)
+		case "already_tagged":
+			// The taint may be left over from a restart between annotating
+			// the node and removing the taint.
+			if err = t.removeStartupTaint(ctx, node, log); err != nil {
+				log.Error("failed to remove startup taint", "error", err)
+				t.metrics.failed(kindNode)
+				t.metrics.nodeFailed(node.Name)
+				return
+			}
+			log.Debug("skipping node", "reason", d.Reason, "detail", d.Detail)
+		default:
+			log.Debug("skipping node", "reason", d.Reason, "detail", d.Detail)
+		}
+		t.metrics.skip(kindNode, d.Reason)
 		return
 	}
 
-	log = log.With("instanceID", instanceID, "region", region)
+	log = log.With("instanceID", d.InstanceID, "region", d.Region)
 	log.Info("tagging node")
 
-	volumeIDs, err := t.listAttachedVolumes(ctx, region, instanceID)
+	err = t.tagInstance(ctx, node, d, log)
+	if err != nil {
+		t.recorder.Eventf(node, corev1.EventTypeWarning, reasonTaggingFailed,
+			"Tagging instance %s failed: %s", d.InstanceID, eventError(err))
+	}
+	if t.policies != nil {
+		t.policies.record(d.matchedPolicies(), "node/"+node.Name, err)
+		t.reportPolicyConflicts("node/"+node.Name, d.snapshot.conflicts(node.Labels, d.resourceTypes()...))
+	}
+	if t.notifier != nil {
+		t.notifier.nodeResult(node.Name, d, err)
+	}
+	if t.heartbeat != nil {
+		t.heartbeat.nodeResult(err)
+	}
+	if err == nil {
+		if err = t.removeStartupTaint(ctx, node, log); err != nil {
+			log.Error("failed to remove startup taint (node was tagged)", "error", err)
+		}
+	}
 	if err != nil {
-		log.Error("failed to list attached volumes", "error", err)
+		t.metrics.failed(kindNode)
+		t.metrics.nodeFailed(node.Name)
 		return
 	}
+	if t.writeBlocked() == "" {
+		t.metrics.succeeded(kindNode)
+	}
+	return nil
+}
 
-	resources := append([]string{instanceID}, volumeIDs...)
+// tagInstance applies the tags for a node decided to be tagged, then annotates it.
+func (t *Tagger) tagInstance(ctx context.Context, node *corev1.Node, d *nodeDecision, log *slog.Logger) error {
+	inst, volumeIDs, err := t.discoverInstance(ctx, d.Region, d.InstanceID)
+	if err != nil {
+		log.Error("failed to describe instance", "error", err)
+		return err
+	}
 
-	if err := t.applyTags(ctx, region, resources); err != nil {
+	if d.VolumesOnly {
+		// EKS propagates the nodegroup's launch template tags to the instance.
+		log.Info("managed nodegroup node, tagging volumes only", "nodegroup", d.Nodegroup)
+	}
+	instanceRoles := d.snapshot.keyRoles(resourceInstance, node.Labels)
+	volumeRoles := d.snapshot.keyRoles(resourceVolume, node.Labels)
+	rolesFor := func(id string) map[string]string {
+		if id == d.InstanceID {
+			return instanceRoles
+		}
+		return volumeRoles
+	}
+	perResource := t.nodeResourceTags(node, d, inst, volumeIDs, log)
+	shared, err := t.applyDeduplicated(ctx, d, perResource, rolesFor)
+	t.recordDecision(node, d, perResource, err)
+	if err != nil {
 		log.Error("failed to apply tags", "error", err)
-		return
+		return err
+	}
+	if len(shared) > 0 {
+		log.Debug("resources tagged by another reconcile", "resources", shared)
+	}
+	if !d.VolumesOnly {
+		if err := t.tagNetworkResources(ctx, d, inst, perResource[d.InstanceID], instanceRoles, log); err != nil {
+			log.Error("failed to tag network resources", "error", err)
+			return err
+		}
+		t.tagAutoScalingGroup(ctx, d, inst, perResource[d.InstanceID], log)
 	}
 
-	if err := t.annotateNode(ctx, node.Name); err != nil {
+	status := newNodeStatus(d, perResource, time.Now())
+	status.Deduplicated = shared
+	if status.DeniedKeys = t.nodeDeniedKeys(perResource, rolesFor); len(status.DeniedKeys) > 0 {
+		log.Warn("tag keys denied by IAM were not written", "keys", status.DeniedKeys)
+		if t.writeBlocked() == "" {
+			t.recorder.Eventf(node, corev1.EventTypeWarning, reasonTagKeysDenied,
+				"Tag keys %s were not written to instance %s and its volumes: denied by IAM", strings.Join(status.DeniedKeys, ", "), d.InstanceID)
+		}
+	}
+	if err := t.annotateNode(ctx, node.Name, status); err != nil {
 		log.Error("failed to annotate node (tags were applied)", "error", err)
-		return
+		return err
 	}
 
+	if o, ok := t.overrides.get(d.InstanceID); ok {
+		log.Info("applied tag override", "source", o.Source, "reference", o.Reference, "submitted", o.Submitted)
+		if t.writeBlocked() == "" {
+			t.recorder.Eventf(node, corev1.EventTypeNormal, reasonTagOverride,
+				"Applied the tag override of %s (reference %q, submitted %s) to instance %s", o.Source, o.Reference, o.Submitted.Format(time.RFC3339), d.InstanceID)
+		}
+	}
 	log.Info("node tagged successfully", "volumes", len(volumeIDs))
+	return nil
 }
 
-// parseInstanceID extracts the EC2 instance ID from a node ProviderID.
-// Expected format: aws:///us-east-1a/i-0123456789abcdef0
-func parseInstanceID(providerID string) (string, error) {
-	parts := strings.Split(providerID, "/")
-	id := parts[len(parts)-1]
-	if !strings.HasPrefix(id, "i-") {
-		return "", fmt.Errorf("expected instance ID starting with 'i-', got %q (providerID: %s)", id, providerID)
+// nodeResourceTags returns the tags to write per resource ID: the instance
+// (unless only volumes are tagged) and each attached volume. The root volume
+// and the data volumes get their own tag sections, and TagPolicies may give
+// the instance and its volumes different tag sets.
+func (t *Tagger) nodeResourceTags(node *corev1.Node, d *nodeDecision, inst *ec2types.Instance, volumeIDs []string, log *slog.Logger) map[string]map[string]string {
+	snap := d.snapshot
+	base := snap.nodeTags(node, inst)
+	perResource := make(map[string]map[string]string, len(volumeIDs)+1)
+	if !d.VolumesOnly {
+		perResource[d.InstanceID], _ = snap.resourceTags(base, resourceInstance, node.Labels, log)
 	}
-	return id, nil
-}
-
-// parseRegion derives the AWS region from a node ProviderID.
-// Expected format: aws:///us-east-1a/i-xxx → strips the trailing AZ letter.
-func parseRegion(providerID string) (string, error) {
-	parts := strings.Split(providerID, "/")
-	if len(parts) < 2 {
-		return "", fmt.Errorf("unexpected providerID format: %s", providerID)
+	rootID := rootVolumeID(inst)
+	var rootTags, dataTags map[string]string
+	for _, id := range volumeIDs {
+		if id == rootID {
+			if rootTags == nil {
+				rootTags, _ = snap.resourceTags(awstags.Merge(base, snap.rootVolumeTags), resourceVolume, node.Labels, log)
+			}
+			perResource[id] = rootTags
+			continue
+		}
+		if dataTags == nil {
+			dataTags, _ = snap.resourceTags(awstags.Merge(base, snap.dataVolumeTags), resourceVolume, node.Labels, log)
+		}
+		perResource[id] = dataTags
 	}
-	az := parts[len(parts)-2]
-	if len(az) < 2 {
-		return "", fmt.Errorf("AZ too short to derive region: %q (providerID: %s)", az, providerID)
+	if o, ok := t.overrides.get(d.InstanceID); ok {
+		for id, tags := range perResource {
+			perResource[id] = awstags.Merge(tags, o.Tags)
+		}
 	}
-	return az[:len(az)-1], nil
+	return perResource
+}
+
+// regionAllowed reports whether resources in region may be tagged.
+func (t *Tagger) regionAllowed(region string) bool {
+	return t.allowedRegions == nil || t.allowedRegions[region]
 }
 
-// listAttachedVolumes returns the EBS volume IDs attached to the given instance.
-func (t *Tagger) listAttachedVolumes(ctx context.Context, region, instanceID string) ([]string, error) {
-	out, err := t.ec2.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+// describeInstance returns the EC2 instance with the given ID.
+func (t *Tagger) describeInstance(ctx context.Context, region, instanceID string) (*ec2types.Instance, error) {
+	out, err := t.ec2.forRegion(region).DescribeInstances(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: []string{instanceID},
-	}, func(o *ec2.Options) {
-		o.Region = region
 	})
 	if err != nil {
 		return nil, fmt.Errorf("DescribeInstances: %w", err)
 	}
 
-	var volumeIDs []string
 	for _, r := range out.Reservations {
-		for _, inst := range r.Instances {
-			for _, bdm := range inst.BlockDeviceMappings {
-				if bdm.Ebs != nil && bdm.Ebs.VolumeId != nil {
-					volumeIDs = append(volumeIDs, *bdm.Ebs.VolumeId)
-				}
+		for i := range r.Instances {
+			if aws.ToString(r.Instances[i].InstanceId) == instanceID {
+				return &r.Instances[i], nil
 			}
 		}
 	}
-	return volumeIDs, nil
+	return nil, fmt.Errorf("DescribeInstances: instance %s not found", instanceID)
 }
 
-// applyTags calls ec2:CreateTags on the given resource IDs (instance + volumes).
-func (t *Tagger) applyTags(ctx context.Context, region string, resourceIDs []string) error {
-	ec2Tags := make([]ec2types.Tag, 0, len(t.tags))
-	for k, v := range t.tags {
-		ec2Tags = append(ec2Tags, ec2types.Tag{
-			Key:   aws.String(k),
-			Value: aws.String(v),
-		})
+// rootVolumeID returns the ID of the EBS volume mapped to the instance's root
+// device, or "" when it is not an EBS volume or cannot be identified.
+func rootVolumeID(inst *ec2types.Instance) string {
+	root := aws.ToString(inst.RootDeviceName)
+	if root == "" {
+		return ""
+	}
+	for _, bdm := range inst.BlockDeviceMappings {
+		if aws.ToString(bdm.DeviceName) == root && bdm.Ebs != nil {
+			return aws.ToString(bdm.Ebs.VolumeId)
+		}
 	}
+	return ""
+}
 
-	if t.dryRun {
-		t.logger.Info("dry-run: would apply tags", "resources", resourceIDs, "tags", t.tags)
-		return nil
+// attachedVolumes returns the EBS volume IDs attached to the instance.
+func attachedVolumes(inst *ec2types.Instance) []string {
+	var volumeIDs []string
+	for _, bdm := range inst.BlockDeviceMappings {
+		if bdm.Ebs != nil && bdm.Ebs.VolumeId != nil {
+			volumeIDs = append(volumeIDs, *bdm.Ebs.VolumeId)
+		}
 	}
+	return volumeIDs
+}
 
-	_, err := t.ec2.CreateTags(ctx, &ec2.CreateTagsInput{
-		Resources: resourceIDs,
-		Tags:      ec2Tags,
-	}, func(o *ec2.Options) {
-		o.Region = region
-	})
+// applyTags tags the given resource IDs (instance + volumes). In preserve mode
+// existing tags are read first and only missing or overwritable keys are written.
+// Keys are written under the cluster tag prefix, if any.
+func (t *Tagger) applyTags(ctx context.Context, region string, resourceIDs []string, tags map[string]string) error {
+	return t.applyTagsAs(ctx, "", region, resourceIDs, tags)
+}
+
+// applyTagsAs is applyTags writing with the credentials of roleARN, or the
+// controller's own when empty. Existing tags are read with the controller's.
+func (t *Tagger) applyTagsAs(ctx context.Context, roleARN, region string, resourceIDs []string, tags map[string]string) error {
+	tags = t.clusterKeys(tags)
+	resourceIDs, err := t.unquarantined(ctx, region, resourceIDs)
+	if err != nil || len(resourceIDs) == 0 {
+		return err
+	}
+	if t.preserve == nil {
+		return t.createTags(ctx, roleARN, region, resourceIDs, tags)
+	}
+
+	groups, err := t.planPreserving(ctx, region, resourceIDs, tags)
 	if err != nil {
-		return fmt.Errorf("CreateTags: %w", err)
+		return err
+	}
+	if len(groups) == 0 {
+		t.logger.Debug("all tags already present, nothing to apply", "resources", resourceIDs)
+	}
+	for _, g := range groups {
+		if err := t.createTags(ctx, roleARN, region, g.resourceIDs, g.tags); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// annotateNode patches the node with the idempotency annotation.
-func (t *Tagger) annotateNode(ctx context.Context, nodeName string) error {
-	if t.dryRun {
-		t.logger.Info("dry-run: would annotate node", "node", nodeName, "annotation", annotationKey)
+// createTags writes tags to the given resource IDs with the backend of each
+// resource's kind (ec2:CreateTags by default), as roleARN when set. Protected
+// keys are dropped with a warning, and keys denied by IAM are dropped too
+// (see deniedkeys.go).
+func (t *Tagger) createTags(ctx context.Context, roleARN, region string, resourceIDs []string, tags map[string]string) error {
+	tags, dropped := t.protected.filter(tags)
+	if len(dropped) > 0 {
+		t.logger.Warn("not writing protected tag keys", "resources", resourceIDs, "keys", dropped)
+		if len(tags) == 0 {
+			return nil
+		}
+	}
+	tags, denied := t.deniedKeys.filter(roleARN, tags)
+	if len(denied) > 0 {
+		t.logger.Debug("not writing tag keys denied by IAM", "resources", resourceIDs, "keys", denied, "roleARN", roleARN)
+		t.countDeniedKeys(resourceIDs, denied)
+		if len(tags) == 0 {
+			return deniedKeysError(denied)
+		}
+	}
+	if reason := t.writeBlocked(); reason != "" {
+		t.logger.Info(reason+": would apply tags", "resources", resourceIDs, "tags", tags, "roleARN", roleARN)
 		return nil
 	}
 
-	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, annotationKey, annotationValue)
-	_, err := t.k8s.CoreV1().Nodes().Patch(
+	for _, g := range t.groupByBackend(resourceIDs) {
+		if err := t.createTagsSplitting(ctx, g.backend, roleARN, region, g.resourceIDs, tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// annotateNode patches the node with the idempotency annotation and status,
+// and clears a pending force annotation.
+func (t *Tagger) annotateNode(ctx context.Context, nodeName string, status *nodeStatus) (err error) {
+	ctx, span := startSpan(ctx, "patch node", attribute.String("k8s.node.name", nodeName))
+	defer func() { endSpan(span, err) }()
+
+	if reason := t.writeBlocked(); reason != "" {
+		t.logger.Info(reason+": would annotate node", "node", nodeName, "annotation", t.taggedKey())
+		return nil
+	}
+
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]any{"metadata": map[string]any{"annotations": map[string]any{
+		t.taggedKey(): annotationValue,
+		t.statusKey(): string(statusJSON),
+		t.forceKey():  nil,
+	}}})
+	if err != nil {
+		return err
+	}
+	_, err = t.k8s.CoreV1().Nodes().Patch(
 		ctx,
 		nodeName,
 		types.MergePatchType,
-		[]byte(patch),
+		patch,
 		metav1.PatchOptions{},
 	)
 	return err
@@ -314,38 +1345,75 @@ func (t *Tagger) annotateNode(ctx context.Context, nodeName string) error {
 
 // handlePV tags the EBS volume backing a PersistentVolume.
 // It is idempotent: PVs that already carry the tagged annotation are skipped.
-func (t *Tagger) handlePV(ctx context.Context, pv *corev1.PersistentVolume) {
+func (t *Tagger) handlePV(ctx context.Context, pv *corev1.PersistentVolume) error {
+	return t.tagPV(ctx, pv, false)
+}
+
+// tagPV tags the PV's EBS volume; with force it also re-tags PVs that already
+// carry the tagged annotation. It returns the error that failed the
+// reconcile, if any.
+func (t *Tagger) tagPV(ctx context.Context, pv *corev1.PersistentVolume, force bool) (err error) {
 	log := t.logger.With("pv", pv.Name)
 
-	if pv.Annotations[annotationKey] == annotationValue {
+	ctx, span := startSpan(ctx, "reconcile pv", attribute.String("k8s.persistentvolume.name", pv.Name), attribute.Bool("force", force))
+	defer func() { endSpan(span, err) }()
+
+	if !force && !t.forceRequested(pv.Annotations) && t.isTagged(pv.Annotations) {
 		log.Debug("PV already tagged, skipping")
+		t.metrics.skip(kindPV, "already_tagged")
 		return
 	}
 
-	var volumeID string
-	switch {
-	case pv.Spec.CSI != nil && pv.Spec.CSI.Driver == "ebs.csi.aws.com":
-		volumeID = pv.Spec.CSI.VolumeHandle
-	case pv.Spec.AWSElasticBlockStore != nil:
-		volumeID = pv.Spec.AWSElasticBlockStore.VolumeID
-	default:
+	volumeID := ebsVolumeID(pv)
+	if volumeID == "" {
 		log.Debug("PV is not EBS-backed, skipping")
+		t.metrics.skip(kindPV, "not_ebs")
 		return
 	}
 
 	region, err := parseRegionFromPV(pv)
 	if err != nil {
 		log.Error("failed to determine region from PV", "error", err)
+		t.metrics.failed(kindPV)
 		return
 	}
 
 	log = log.With("volumeID", volumeID, "region", region)
+
+	if !t.regionAllowed(region) {
+		log.Warn("region not in allowed list, skipping")
+		t.recorder.Eventf(pv, corev1.EventTypeWarning, reasonRegionNotAllowed,
+			"Region %s is not in the allowed region list; volume %s was not tagged", region, volumeID)
+		t.metrics.skip(kindPV, "region_not_allowed")
+		return
+	}
+	if !t.inPartition(region) {
+		log.Warn("region is in another partition than the controller's credentials, skipping", "partition", partitionForRegion(region))
+		t.metrics.skip(kindPV, "partition_mismatch")
+		return
+	}
+
+	snap := t.current()
+	tags, policies := snap.resourceTags(snap.tags, resourcePersistentVolume, pv.Labels, log)
+	roles := snap.keyRoles(resourcePersistentVolume, pv.Labels)
+	if len(tags) == 0 {
+		log.Debug("no TagPolicy selects the PV and TAGS is empty, skipping")
+		t.metrics.skip(kindPV, "no_matching_policy")
+		return
+	}
+	if t.policies != nil {
+		defer func() {
+			t.policies.record(policies, "pv/"+pv.Name, err)
+			t.reportPolicyConflicts("pv/"+pv.Name, snap.conflicts(pv.Labels, resourcePersistentVolume))
+		}()
+	}
+
 	log.Info("tagging PV")
 
 	const maxAttempts = 5
 	backoff := 5 * time.Second
 	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		err = t.applyTags(ctx, region, []string{volumeID})
+		err = t.applyTagsByRole(ctx, region, []string{volumeID}, tags, roles)
 		if err == nil {
 			break
 		}
@@ -353,6 +1421,7 @@ func (t *Tagger) handlePV(ctx context.Context, pv *corev1.PersistentVolume) {
 			log.Warn("volume not yet visible in EC2 API, retrying", "attempt", attempt, "backoff", backoff)
 			select {
 			case <-ctx.Done():
+				err = ctx.Err()
 				return
 			case <-time.After(backoff):
 			}
@@ -360,19 +1429,44 @@ func (t *Tagger) handlePV(ctx context.Context, pv *corev1.PersistentVolume) {
 			continue
 		}
 		log.Error("failed to apply tags", "error", err)
+		t.recorder.Eventf(pv, corev1.EventTypeWarning, reasonTaggingFailed,
+			"Tagging volume %s failed: %s", volumeID, eventError(err))
+		t.metrics.failed(kindPV)
 		return
 	}
 	if err != nil {
 		log.Error("failed to apply tags after retries", "error", err)
+		t.recorder.Eventf(pv, corev1.EventTypeWarning, reasonTaggingFailed,
+			"Tagging volume %s failed: %s", volumeID, eventError(err))
+		t.metrics.failed(kindPV)
 		return
 	}
 
-	if err := t.annotatePV(ctx, pv.Name); err != nil {
+	if err = t.annotatePV(ctx, pv.Name); err != nil {
 		log.Error("failed to annotate PV (tags were applied)", "error", err)
+		t.metrics.failed(kindPV)
 		return
 	}
 
+	if t.writeBlocked() == "" {
+		t.metrics.succeeded(kindPV)
+	}
 	log.Info("PV tagged successfully")
+	return nil
+}
+
+// ebsVolumeID returns the EBS volume ID backing the PV (CSI ebs.csi.aws.com or
+// in-tree awsElasticBlockStore), or "" when the PV is not EBS-backed.
+func ebsVolumeID(pv *corev1.PersistentVolume) string {
+	switch {
+	case pv.Spec.CSI != nil && pv.Spec.CSI.Driver == "ebs.csi.aws.com":
+		return pv.Spec.CSI.VolumeHandle
+	case pv.Spec.AWSElasticBlockStore != nil:
+		// The in-tree plugin also accepts the aws://<zone>/<volume-id> form.
+		id := pv.Spec.AWSElasticBlockStore.VolumeID
+		return id[strings.LastIndex(id, "/")+1:]
+	}
+	return ""
 }
 
 // parseRegionFromPV derives the AWS region from the PV's node affinity topology labels.
@@ -393,10 +1487,7 @@ func parseRegionFromPV(pv *corev1.PersistentVolume) (string, error) {
 			case "topology.kubernetes.io/region":
 				return val, nil
 			case "topology.kubernetes.io/zone", "topology.ebs.csi.aws.com/zone":
-				if len(val) < 2 {
-					return "", fmt.Errorf("AZ value too short: %q", val)
-				}
-				return val[:len(val)-1], nil
+				return regionFromZone(val)
 			}
 		}
 	}
@@ -411,15 +1502,19 @@ func isVolumeNotFound(err error) bool {
 	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidVolume.NotFound"
 }
 
-// annotatePV patches the PersistentVolume with the idempotency annotation.
-func (t *Tagger) annotatePV(ctx context.Context, pvName string) error {
-	if t.dryRun {
-		t.logger.Info("dry-run: would annotate PV", "pv", pvName, "annotation", annotationKey)
+// annotatePV patches the PersistentVolume with the idempotency annotation and
+// clears a pending force annotation.
+func (t *Tagger) annotatePV(ctx context.Context, pvName string) (err error) {
+	ctx, span := startSpan(ctx, "patch pv", attribute.String("k8s.persistentvolume.name", pvName))
+	defer func() { endSpan(span, err) }()
+
+	if reason := t.writeBlocked(); reason != "" {
+		t.logger.Info(reason+": would annotate PV", "pv", pvName, "annotation", t.taggedKey())
 		return nil
 	}
 
-	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, annotationKey, annotationValue)
-	_, err := t.k8s.CoreV1().PersistentVolumes().Patch(
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q,%q:null}}}`, t.taggedKey(), annotationValue, t.forceKey())
+	_, err = t.k8s.CoreV1().PersistentVolumes().Patch(
 		ctx,
 		pvName,
 		types.MergePatchType,
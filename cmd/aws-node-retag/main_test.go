@@ -1,8 +1,15 @@
 package main
 
 import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -186,3 +193,81 @@ func TestParseRegion(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildKubeConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config")
+	kubeconfig := `apiVersion: v1
+kind: Config
+clusters:
+- name: remote
+  cluster:
+    server: https://remote.example.com:6443
+contexts:
+- name: remote
+  context:
+    cluster: remote
+    user: dev
+current-context: remote
+users:
+- name: dev
+  user:
+    token: abc
+`
+	if err := os.WriteFile(path, []byte(kubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name, flagPath, envPath string
+	}{
+		{name: "flag", flagPath: path},
+		{name: "KUBECONFIG env", envPath: path},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("KUBECONFIG", tc.envPath)
+			cfg, err := buildKubeConfig(tc.flagPath, tc.envPath)
+			if err != nil {
+				t.Fatalf("buildKubeConfig() err=%v", err)
+			}
+			if cfg.Host != "https://remote.example.com:6443" {
+				t.Errorf("Host = %q", cfg.Host)
+			}
+		})
+	}
+
+	t.Run("in-cluster outside a pod", func(t *testing.T) {
+		t.Setenv("KUBERNETES_SERVICE_HOST", "")
+		if _, err := buildKubeConfig("", ""); err == nil {
+			t.Error("expected in-cluster config to fail outside a pod")
+		}
+	})
+}
+
+func TestNodeResourceTagsRootAndDataVolumes(t *testing.T) {
+	inst := &ec2types.Instance{
+		RootDeviceName: aws.String("/dev/xvda"),
+		BlockDeviceMappings: []ec2types.InstanceBlockDeviceMapping{
+			{DeviceName: aws.String("/dev/xvda"), Ebs: &ec2types.EbsInstanceBlockDevice{VolumeId: aws.String("vol-root")}},
+			{DeviceName: aws.String("/dev/xvdb"), Ebs: &ec2types.EbsInstanceBlockDevice{VolumeId: aws.String("vol-data")}},
+		},
+	}
+	if got := rootVolumeID(inst); got != "vol-root" {
+		t.Fatalf("rootVolumeID = %q, want vol-root", got)
+	}
+
+	d := &nodeDecision{InstanceID: "i-1", snapshot: &tagSnapshot{
+		tags:           map[string]string{"Env": "prod", "Backup": "daily"},
+		rootVolumeTags: map[string]string{"Backup": "none"},
+		dataVolumeTags: map[string]string{"Snapshot": "true"},
+	}}
+	got := (&Tagger{}).nodeResourceTags(&corev1.Node{}, d, inst, attachedVolumes(inst), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	want := map[string]map[string]string{
+		"i-1":      {"Env": "prod", "Backup": "daily"},
+		"vol-root": {"Env": "prod", "Backup": "none"},
+		"vol-data": {"Env": "prod", "Backup": "daily", "Snapshot": "true"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("nodeResourceTags = %v, want %v", got, want)
+	}
+}
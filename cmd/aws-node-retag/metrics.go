@@ -0,0 +1,441 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "aws_node_retag"
+
+// Resource kinds used as the "kind" metric label.
+const (
+	kindNode = "node"
+	kindPV   = "pv"
+	// kindVolume counts EBS volumes tagged by the volume sweep and on
+	// attachment, which work on volumes rather than Kubernetes objects.
+	kindVolume = "volume"
+	// kindSnapshot counts EBS snapshots tagged by the snapshot reconciler.
+	kindSnapshot = "snapshot"
+	// kindAutoScalingGroup counts Auto Scaling groups tagged for
+	// ASG_TAG_KEYS.
+	kindAutoScalingGroup = "asg"
+)
+
+// metrics holds the controller's Prometheus collectors on a private registry.
+type metrics struct {
+	registry *prometheus.Registry
+	// controllerID and cluster are the values of the constant labels
+	// controller and cluster, empty when not set.
+	controllerID, cluster string
+
+	tagged      *prometheus.CounterVec
+	failures    *prometheus.CounterVec
+	skipped     *prometheus.CounterVec
+	untagged    *prometheus.CounterVec
+	quarantined *prometheus.CounterVec
+	conflicts   *prometheus.CounterVec
+	// notifications counts failure notifications by sink and result.
+	notifications *prometheus.CounterVec
+	// heartbeats counts heartbeat pings by kind and result.
+	heartbeats *prometheus.CounterVec
+	// configEvaluations counts AWS Config evaluations by result.
+	configEvaluations *prometheus.CounterVec
+	// auditExports counts audit reports uploaded to S3 by result.
+	auditExports *prometheus.CounterVec
+	// nodeFailures counts failed reconciles per node, capped at
+	// METRICS_MAX_SERIES nodes; seriesCapped counts the increments of capped
+	// metrics aggregated into their "other" series.
+	nodeFailures *guardedCounterVec
+	seriesCapped *prometheus.CounterVec
+	paused       prometheus.Gauge
+	// configDrift and configReplicas report the config hash comparison
+	// between replicas.
+	configDrift    prometheus.Gauge
+	configReplicas prometheus.Gauge
+	// auditDrifted is the number of drifted resources in the latest
+	// periodic audit.
+	auditDrifted prometheus.Gauge
+	// rolloutInProgress is 1 during a node pool rollout (see rollout.go).
+	rolloutInProgress prometheus.Gauge
+	// featureDisabled is 1 for the optional features disabled by missing
+	// IAM permissions, by region (see featuregates.go).
+	featureDisabled *prometheus.GaugeVec
+	// deniedTagKeys is 1 for the tag keys IAM denies, and deniedTagWrites
+	// counts the keys not written to resources because of it (see
+	// deniedkeys.go).
+	deniedTagKeys   *prometheus.GaugeVec
+	deniedTagWrites *prometheus.CounterVec
+	// loopPanics counts the panics recovered in background goroutines, by
+	// loop (see supervisor.go).
+	loopPanics *prometheus.CounterVec
+	// nodeReconcileTimeouts counts the node, termination and PV reconciles
+	// cancelled by NODE_RECONCILE_TIMEOUT, by region (see workers.go).
+	nodeReconcileTimeouts *prometheus.CounterVec
+	// logLinesSampled counts the debug lines left out by log sampling, by
+	// message (see logging.go).
+	logLinesSampled *prometheus.CounterVec
+	// volumeDiscovery counts node instances described by strategy (see
+	// discovery.go).
+	volumeDiscovery *prometheus.CounterVec
+	// volumeCache counts the lookups of the warm volume cache by result
+	// (see volumecache.go).
+	volumeCache *prometheus.CounterVec
+	// tagOverrides counts changes to the tag overrides by action (see
+	// overrides.go).
+	tagOverrides *prometheus.CounterVec
+	// terminationTagged counts the instances stamped as terminating, by the
+	// taint that announced it (see termination.go).
+	terminationTagged *prometheus.CounterVec
+	// deduplicated counts the resources a node reconcile left to another
+	// reconcile writing the same tags, by resource (see pipeline.go).
+	deduplicated *prometheus.CounterVec
+	// configAuthority is 1 for the config authority in effect and
+	// configMigrationDifferences the tags on which the authorities disagree
+	// (see configmigration.go).
+	configAuthority            *prometheus.GaugeVec
+	configMigrationDifferences prometheus.Gauge
+	// policyConflicts is the number of distinct TagPolicy conflicts found
+	// in the latest reconcile of each object (see conflicts.go).
+	policyConflicts prometheus.Gauge
+
+	// counters indexes every CounterVec by its fully-qualified name so that
+	// checkpointed values can be restored onto the matching collector; the
+	// capped ones are also indexed in guarded.
+	counters map[string]*prometheus.CounterVec
+	guarded  map[string]*guardedCounterVec
+}
+
+// newMetrics creates the collectors. A controllerID is added to every
+// controller metric as the constant label controller.
+func newMetrics(controllerID string) *metrics {
+	return newClusterMetrics(controllerID, "")
+}
+
+// newClusterMetrics creates the collectors of the controller's own cluster;
+// in multi-cluster mode (CLUSTERS) its series carry the constant label
+// cluster, like those of the other clusters (see forCluster).
+func newClusterMetrics(controllerID, cluster string) *metrics {
+	m := newCollectors(controllerID, cluster)
+	m.registry = prometheus.NewRegistry()
+	m.register()
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// forCluster creates the collectors of another cluster of multi-cluster mode
+// on m's registry, their series told apart by the cluster label.
+func (m *metrics) forCluster(cluster string) *metrics {
+	c := newCollectors(m.controllerID, cluster)
+	c.registry = m.registry
+	c.register()
+	return c
+}
+
+func newCollectors(controllerID, cluster string) *metrics {
+	constLabels := prometheus.Labels{}
+	if controllerID != "" {
+		constLabels[controllerLabel] = controllerID
+	}
+	if cluster != "" {
+		constLabels[clusterLabel] = cluster
+	}
+	m := &metrics{
+		controllerID: controllerID,
+		cluster:      cluster,
+		tagged: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "tagged_total",
+			Help:        "Nodes and PersistentVolumes whose AWS resources were tagged successfully.",
+			ConstLabels: constLabels,
+		}, []string{"kind"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "failures_total",
+			Help:        "Nodes and PersistentVolumes that could not be tagged or annotated.",
+			ConstLabels: constLabels,
+		}, []string{"kind"}),
+		skipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "skipped_total",
+			Help:        "Nodes and PersistentVolumes skipped without tagging, by reason.",
+			ConstLabels: constLabels,
+		}, []string{"kind", "reason"}),
+		untagged: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "untagged_total",
+			Help:        "Retained PersistentVolumes whose managed tags were removed after their node was deleted.",
+			ConstLabels: constLabels,
+		}, []string{"kind"}),
+		quarantined: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "quarantined_total",
+			Help:        "Writes skipped because the target resource is quarantined, by resource kind.",
+			ConstLabels: constLabels,
+		}, []string{"resource"}),
+		conflicts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "tag_conflicts_total",
+			Help:        "Tags not written in shared-instance mode because the key carries another value, by resource kind.",
+			ConstLabels: constLabels,
+		}, []string{"resource"}),
+		notifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "notifications_total",
+			Help:        "Tagging failure notifications by sink and result (sent, failed, dropped).",
+			ConstLabels: constLabels,
+		}, []string{"sink", "result"}),
+		heartbeats: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "heartbeats_total",
+			Help:        "Heartbeat URL pings by kind (reconcile, audit) and result (sent, failed, skipped).",
+			ConstLabels: constLabels,
+		}, []string{"kind", "result"}),
+		configEvaluations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "config_evaluations_total",
+			Help:        "Audit results published to the AWS Config rule, by result (sent, failed).",
+			ConstLabels: constLabels,
+		}, []string{"result"}),
+		auditExports: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "audit_exports_total",
+			Help:        "Audit reports uploaded to AUDIT_S3_URI, by result (uploaded, failed).",
+			ConstLabels: constLabels,
+		}, []string{"result"}),
+		seriesCapped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "metric_series_capped_total",
+			Help:        "Increments of per-node metrics recorded under node=\"other\" because the metric reached METRICS_MAX_SERIES nodes, by metric.",
+			ConstLabels: constLabels,
+		}, []string{"metric"}),
+		paused: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "paused",
+			Help:        "1 while mutations are paused via the control ConfigMap.",
+			ConstLabels: constLabels,
+		}),
+		configDrift: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "config_drift",
+			Help:        "1 while another replica reports a different effective configuration hash.",
+			ConstLabels: constLabels,
+		}),
+		configReplicas: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "config_replicas",
+			Help:        "Replicas, including this one, that recently published a configuration hash.",
+			ConstLabels: constLabels,
+		}),
+		auditDrifted: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "audit_drifted_resources",
+			Help:        "Instances and volumes missing desired tags in the latest periodic audit.",
+			ConstLabels: constLabels,
+		}),
+		rolloutInProgress: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "rollout_in_progress",
+			Help:        "1 while nodes carry the rollout annotation and new nodes are tagged first.",
+			ConstLabels: constLabels,
+		}),
+		featureDisabled: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "feature_disabled",
+			Help:        "1 while an optional feature is disabled because its IAM actions are denied, by feature and region.",
+			ConstLabels: constLabels,
+		}, []string{"feature", "region"}),
+		deniedTagKeys: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "denied_tag_keys",
+			Help:        "1 while a tag key is not written because IAM denies it, by key.",
+			ConstLabels: constLabels,
+		}, []string{"key"}),
+		deniedTagWrites: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "denied_tag_writes_total",
+			Help:        "Tag keys not written to a resource because IAM denies them, by resource (instance, volume).",
+			ConstLabels: constLabels,
+		}, []string{"resource"}),
+		loopPanics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "loop_panics_total",
+			Help:        "Panics recovered in background goroutines, by loop; loops are restarted after a backoff.",
+			ConstLabels: constLabels,
+		}, []string{"loop"}),
+		nodeReconcileTimeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "node_reconcile_timeouts_total",
+			Help:        "Node, termination and PV reconciles cancelled after NODE_RECONCILE_TIMEOUT and queued again, by region.",
+			ConstLabels: constLabels,
+		}, []string{"region"}),
+		logLinesSampled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "log_lines_sampled_total",
+			Help:        "Debug log lines of node and PV reconciles left out by LOG_SAMPLE_RATE, by message.",
+			ConstLabels: constLabels,
+		}, []string{"message"}),
+		volumeDiscovery: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "volume_discovery_total",
+			Help:        "Node instances and their volumes described, by strategy (instance, bulk).",
+			ConstLabels: constLabels,
+		}, []string{"strategy"}),
+		volumeCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "volume_cache_total",
+			Help:        "Lookups of instances in the warm volume cache built at startup, by result (hit, miss).",
+			ConstLabels: constLabels,
+		}, []string{"result"}),
+		tagOverrides: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "tag_overrides_total",
+			Help:        "Tag overrides submitted by external systems, by action (set, delete, rejected).",
+			ConstLabels: constLabels,
+		}, []string{"action"}),
+		terminationTagged: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "termination_tagged_total",
+			Help:        "Instances of terminating nodes tagged, by the taint that announced the termination.",
+			ConstLabels: constLabels,
+		}, []string{"taint"}),
+		deduplicated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "writes_deduplicated_total",
+			Help:        "Resources whose tags a node reconcile left to another reconcile writing the same tags, by resource (instance, volume).",
+			ConstLabels: constLabels,
+		}, []string{"resource"}),
+		configAuthority: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "config_authority",
+			Help:        "1 for the config authority in effect (env, crd) while CONFIG_MIGRATION is enabled.",
+			ConstLabels: constLabels,
+		}, []string{"authority"}),
+		configMigrationDifferences: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "config_migration_differences",
+			Help:        "Tags on which the env-var and TagPolicy configuration disagree, in the latest comparison.",
+			ConstLabels: constLabels,
+		}),
+		policyConflicts: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "policy_conflicts",
+			Help:        "Keys TagPolicies matching the same object set to different values, per set of policies, in the latest reconcile of each object.",
+			ConstLabels: constLabels,
+		}),
+	}
+
+	m.nodeFailures = newGuardedCounterVec(prometheus.CounterOpts{
+		Namespace:   metricsNamespace,
+		Name:        "node_failures_total",
+		Help:        "Failed reconciles per node; nodes beyond METRICS_MAX_SERIES are counted as node=\"other\".",
+		ConstLabels: constLabels,
+	}, "node", m.seriesCapped)
+	m.guarded = map[string]*guardedCounterVec{m.nodeFailures.name: m.nodeFailures}
+
+	m.counters = map[string]*prometheus.CounterVec{
+		metricsNamespace + "_tagged_total":                  m.tagged,
+		metricsNamespace + "_failures_total":                m.failures,
+		metricsNamespace + "_skipped_total":                 m.skipped,
+		metricsNamespace + "_untagged_total":                m.untagged,
+		metricsNamespace + "_quarantined_total":             m.quarantined,
+		metricsNamespace + "_tag_conflicts_total":           m.conflicts,
+		metricsNamespace + "_notifications_total":           m.notifications,
+		metricsNamespace + "_heartbeats_total":              m.heartbeats,
+		metricsNamespace + "_config_evaluations_total":      m.configEvaluations,
+		metricsNamespace + "_audit_exports_total":           m.auditExports,
+		metricsNamespace + "_node_failures_total":           m.nodeFailures.CounterVec,
+		metricsNamespace + "_metric_series_capped_total":    m.seriesCapped,
+		metricsNamespace + "_volume_discovery_total":        m.volumeDiscovery,
+		metricsNamespace + "_volume_cache_total":            m.volumeCache,
+		metricsNamespace + "_tag_overrides_total":           m.tagOverrides,
+		metricsNamespace + "_termination_tagged_total":      m.terminationTagged,
+		metricsNamespace + "_writes_deduplicated_total":     m.deduplicated,
+		metricsNamespace + "_denied_tag_writes_total":       m.deniedTagWrites,
+		metricsNamespace + "_loop_panics_total":             m.loopPanics,
+		metricsNamespace + "_node_reconcile_timeouts_total": m.nodeReconcileTimeouts,
+		metricsNamespace + "_log_lines_sampled_total":       m.logLinesSampled,
+	}
+	return m
+}
+
+// register adds the controller collectors to m.registry.
+func (m *metrics) register() {
+	for _, c := range m.counters {
+		m.registry.MustRegister(c)
+	}
+	m.registry.MustRegister(
+		m.paused,
+		m.configDrift,
+		m.configReplicas,
+		m.auditDrifted,
+		m.rolloutInProgress,
+		m.featureDisabled,
+		m.deniedTagKeys,
+		m.configAuthority,
+		m.configMigrationDifferences,
+		m.policyConflicts,
+	)
+}
+
+func (m *metrics) succeeded(kind string) { m.tagged.WithLabelValues(kind).Inc() }
+
+func (m *metrics) failed(kind string) { m.failures.WithLabelValues(kind).Inc() }
+
+func (m *metrics) skip(kind, reason string) { m.skipped.WithLabelValues(kind, reason).Inc() }
+
+func (m *metrics) discovered(strategy string) { m.volumeDiscovery.WithLabelValues(strategy).Inc() }
+
+func (m *metrics) tagOverride(action string) { m.tagOverrides.WithLabelValues(action).Inc() }
+
+// nodeFailed counts a failed reconcile of the named node.
+func (m *metrics) nodeFailed(node string) { m.nodeFailures.inc(node) }
+
+// forgetNode deletes the per-node series of a deleted node.
+func (m *metrics) forgetNode(node string) { m.nodeFailures.forget(node) }
+
+// limitSeries sets the number of nodes per-node metrics keep series for
+// (METRICS_MAX_SERIES).
+func (m *metrics) limitSeries(n int) {
+	for _, g := range m.guarded {
+		g.setMaxSeries(n)
+	}
+}
+
+func (m *metrics) setPaused(paused bool) {
+	if paused {
+		m.paused.Set(1)
+	} else {
+		m.paused.Set(0)
+	}
+}
+
+// setConfigAuthority marks authority as the one in effect.
+func (m *metrics) setConfigAuthority(authority string) {
+	for _, a := range []string{authorityEnv, authorityCRD} {
+		if a == authority {
+			m.configAuthority.WithLabelValues(a).Set(1)
+		} else {
+			m.configAuthority.WithLabelValues(a).Set(0)
+		}
+	}
+}
+
+func (m *metrics) setConfigDrift(replicas int, drift bool) {
+	m.configReplicas.Set(float64(replicas))
+	if drift {
+		m.configDrift.Set(1)
+	} else {
+		m.configDrift.Set(0)
+	}
+}
+
+// handler serves the registry in the Prometheus exposition format.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
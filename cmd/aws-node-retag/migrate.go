@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// legacyMarker is an annotation that marked objects as tagged in a previous
+// version or a fork of the controller (LEGACY_ANNOTATIONS). An empty value
+// matches any value.
+type legacyMarker struct {
+	key   string
+	value string
+}
+
+// parseLegacyAnnotations parses "key" or "key=value" entries.
+func parseLegacyAnnotations(entries []string) ([]legacyMarker, error) {
+	markers := make([]legacyMarker, 0, len(entries))
+	for _, e := range entries {
+		key, value, _ := strings.Cut(e, "=")
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("%q: invalid annotation key: %s", e, strings.Join(errs, "; "))
+		}
+		markers = append(markers, legacyMarker{key: key, value: value})
+	}
+	return markers, nil
+}
+
+// legacyAnnotations returns the sorted keys of the legacy markers on an
+// object, and whether the object's tagged annotation carries a value other
+// than the current one, as written by older releases or forks. The tagged
+// and force annotations of this controller are never legacy markers.
+func (t *Tagger) legacyAnnotations(annotations map[string]string) (keys []string, staleValue bool) {
+	for _, m := range t.legacyMarkers {
+		if m.key == t.taggedKey() || m.key == t.forceKey() {
+			continue
+		}
+		if v, ok := annotations[m.key]; ok && (m.value == "" || v == m.value) {
+			keys = append(keys, m.key)
+		}
+	}
+	sort.Strings(keys)
+	keys = slices.Compact(keys)
+	v, ok := annotations[t.taggedKey()]
+	return keys, ok && v != annotationValue
+}
+
+// migrateLegacyAnnotations converts the legacy markers of every node and PV
+// to the current tagged annotation before the informers start. An object is
+// only marked tagged once its resources are verified to carry the desired
+// tags (DescribeTags); otherwise the legacy marker is dropped and the object
+// is tagged by the regular reconcile. Objects already carrying the current
+// annotation just lose their legacy markers. Objects are migrated by workers
+// at once; failures are logged and leave the object to the regular reconcile.
+func (t *Tagger) migrateLegacyAnnotations(ctx context.Context, workers int) error {
+	nodes, err := t.k8s.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list nodes: %w", err)
+	}
+	pvs, err := t.k8s.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list persistent volumes: %w", err)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		sem   = make(chan struct{}, workers)
+		mu    sync.Mutex
+		found int
+	)
+	run := func(fn func() bool) {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			if fn() {
+				mu.Lock()
+				found++
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		run(func() bool { return t.migrateNode(ctx, node) })
+	}
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		run(func() bool { return t.migratePV(ctx, pv) })
+	}
+	wg.Wait()
+	if found > 0 {
+		t.logger.Info("finished migrating legacy annotations", "objects", found)
+	}
+	return nil
+}
+
+// migrateNode migrates the legacy markers of a node and reports whether it
+// had any.
+func (t *Tagger) migrateNode(ctx context.Context, node *corev1.Node) bool {
+	legacy, stale := t.legacyAnnotations(node.Annotations)
+	if len(legacy) == 0 && !stale {
+		return false
+	}
+	log := t.logger.With("node", node.Name, "legacyAnnotations", legacy)
+
+	verified := false
+	if !t.isTagged(node.Annotations) {
+		d := t.resolveNode(ctx, node, true)
+		if d.Action == actionTag {
+			findings, _, err := t.auditNode(ctx, node, d, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			if err != nil {
+				log.Warn("failed to verify the tags of a node with legacy annotations, leaving it to the regular reconcile", "error", err)
+				return true
+			}
+			verified = len(findings) == 0
+			if !verified {
+				log.Info("node with legacy annotations is missing tags, it will be re-tagged", "findings", len(findings))
+			}
+		}
+	}
+	patch := t.migrationPatch(node.Annotations, legacy, stale, verified)
+	if err := t.patchMigration(ctx, "node", node.Name, patch, log); err != nil {
+		log.Warn("failed to migrate legacy annotations", "error", err)
+	}
+	return true
+}
+
+// migratePV migrates the legacy markers of a PV and reports whether it had
+// any. Only bound PVs are verified and marked tagged.
+func (t *Tagger) migratePV(ctx context.Context, pv *corev1.PersistentVolume) bool {
+	legacy, stale := t.legacyAnnotations(pv.Annotations)
+	if len(legacy) == 0 && !stale {
+		return false
+	}
+	log := t.logger.With("pv", pv.Name, "legacyAnnotations", legacy)
+
+	verified := false
+	volumeID := ebsVolumeID(pv)
+	region, regionErr := parseRegionFromPV(pv)
+	if !t.isTagged(pv.Annotations) && pv.Status.Phase == corev1.VolumeBound && volumeID != "" && regionErr == nil &&
+		t.regionAllowed(region) && t.inPartition(region) {
+		snap := t.current()
+		tags, _ := snap.resourceTags(snap.tags, resourcePersistentVolume, pv.Labels, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if len(tags) > 0 {
+			existing, err := t.describeTags(ctx, region, []string{volumeID})
+			if err != nil {
+				log.Warn("failed to verify the tags of a PV with legacy annotations, leaving it to the regular reconcile", "error", err)
+				return true
+			}
+			verified = true
+			for _, c := range awstags.Diff(t.clusterKeys(tags), existing[volumeID]) {
+				if c.Kind != awstags.Extra {
+					verified = false
+					break
+				}
+			}
+			if !verified {
+				log.Info("PV with legacy annotations is missing tags, it will be re-tagged", "volumeID", volumeID)
+			}
+		}
+	}
+	patch := t.migrationPatch(pv.Annotations, legacy, stale, verified)
+	if err := t.patchMigration(ctx, "pv", pv.Name, patch, log); err != nil {
+		log.Warn("failed to migrate legacy annotations", "error", err)
+	}
+	return true
+}
+
+// migrationPatch returns the annotation patch of a migrated object: the
+// legacy markers are removed, and the tagged annotation is set when the tags
+// were verified or removed when it carries a stale value.
+func (t *Tagger) migrationPatch(annotations map[string]string, legacy []string, stale, verified bool) map[string]any {
+	patch := make(map[string]any, len(legacy)+1)
+	for _, k := range legacy {
+		patch[k] = nil
+	}
+	switch {
+	case t.isTagged(annotations):
+	case verified:
+		patch[t.taggedKey()] = annotationValue
+	case stale:
+		patch[t.taggedKey()] = nil
+	}
+	return patch
+}
+
+// patchMigration applies an annotation patch to a node or PV.
+func (t *Tagger) patchMigration(ctx context.Context, kind, name string, annotations map[string]any, log *slog.Logger) (err error) {
+	attr := attribute.String("k8s.node.name", name)
+	if kind == "pv" {
+		attr = attribute.String("k8s.persistentvolume.name", name)
+	}
+	ctx, span := startSpan(ctx, "patch "+kind, attr)
+	defer func() { endSpan(span, err) }()
+
+	if reason := t.writeBlocked(); reason != "" {
+		log.Info(reason+": would migrate legacy annotations", "patch", annotations)
+		return nil
+	}
+	patch, err := json.Marshal(map[string]any{"metadata": map[string]any{"annotations": annotations}})
+	if err != nil {
+		return err
+	}
+	if kind == "node" {
+		_, err = t.k8s.CoreV1().Nodes().Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	} else {
+		_, err = t.k8s.CoreV1().PersistentVolumes().Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	}
+	if err == nil {
+		log.Info("migrated legacy annotations", "patch", annotations)
+	}
+	return err
+}
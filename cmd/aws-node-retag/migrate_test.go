@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseLegacyAnnotations(t *testing.T) {
+	got, err := parseLegacyAnnotations([]string{"old.example.com/tagged", "aws-node-retag.io/tagged=yes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []legacyMarker{{key: "old.example.com/tagged"}, {key: "aws-node-retag.io/tagged", value: "yes"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLegacyAnnotations = %v, want %v", got, want)
+	}
+	if _, err := parseLegacyAnnotations([]string{"not a key=x"}); err == nil {
+		t.Error("expected an error for an invalid annotation key")
+	}
+}
+
+func TestLegacyAnnotations(t *testing.T) {
+	tagger := &Tagger{legacyMarkers: []legacyMarker{
+		{key: "old.example.com/tagged"},
+		{key: "fork.example.com/state", value: "done"},
+		{key: annotationKey, value: "yes"},
+	}}
+	keys, stale := tagger.legacyAnnotations(map[string]string{
+		"old.example.com/tagged": "1",
+		"fork.example.com/state": "pending",
+		annotationKey:            "yes",
+	})
+	if !reflect.DeepEqual(keys, []string{"old.example.com/tagged"}) || !stale {
+		t.Errorf("legacyAnnotations = %v, %v; want [old.example.com/tagged], true", keys, stale)
+	}
+	if keys, stale := tagger.legacyAnnotations(map[string]string{annotationKey: annotationValue}); keys != nil || stale {
+		t.Errorf("current annotation reported as legacy: %v, %v", keys, stale)
+	}
+}
+
+func TestMigrateLegacyAnnotations(t *testing.T) {
+	const legacyKey = "old.example.com/tagged"
+	node := func(name, instanceID string, annotations map[string]string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations},
+			Spec:       corev1.NodeSpec{ProviderID: "aws:///us-east-1a/" + instanceID},
+		}
+	}
+	pv := makePVWithAffinity("pv1", []corev1.NodeSelectorTerm{{
+		MatchExpressions: []corev1.NodeSelectorRequirement{{
+			Key: corev1.LabelTopologyRegion, Operator: corev1.NodeSelectorOpIn, Values: []string{"us-east-1"},
+		}},
+	}})
+	pv.Annotations = map[string]string{legacyKey: "true"}
+	pv.Spec.CSI = &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: "vol-data"}
+	pv.Status.Phase = corev1.VolumeBound
+
+	k8s := fake.NewSimpleClientset(
+		node("verified", "i-0000000000000000a", map[string]string{legacyKey: "true"}),
+		node("drifted", "i-0000000000000000b", map[string]string{annotationKey: "yes"}),
+		node("current", "i-0000000000000000c", map[string]string{annotationKey: annotationValue, legacyKey: "true"}),
+		node("untouched", "i-0000000000000000d", nil),
+		pv,
+	)
+	api := &instanceEC2{taggingEC2{existing: map[string]map[string]string{
+		"i-0000000000000000a": {"Env": "prod"},
+		"vol-root":            {"Env": "prod"},
+		"vol-data":            {"Env": "prod"},
+	}}}
+	tagger := newStartupTagger(k8s, api)
+	tagger.legacyMarkers = []legacyMarker{{key: legacyKey}}
+
+	if err := tagger.migrateLegacyAnnotations(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	wantNodes := map[string]map[string]string{
+		"verified":  {annotationKey: annotationValue},
+		"drifted":   nil,
+		"current":   {annotationKey: annotationValue},
+		"untouched": nil,
+	}
+	for name, want := range wantNodes {
+		n, err := k8s.CoreV1().Nodes().Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(n.Annotations) != len(want) || (len(want) > 0 && !reflect.DeepEqual(n.Annotations, want)) {
+			t.Errorf("node %s annotations = %v, want %v", name, n.Annotations, want)
+		}
+	}
+	got, err := k8s.CoreV1().PersistentVolumes().Get(context.Background(), "pv1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Annotations, map[string]string{annotationKey: annotationValue}) {
+		t.Errorf("pv annotations = %v", got.Annotations)
+	}
+	if len(api.createTags) != 0 {
+		t.Errorf("migration wrote tags: %v", api.createTags)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import corev1 "k8s.io/api/core/v1"
+
+// eksNodegroupLabel is set by EKS on nodes launched by a managed nodegroup.
+const eksNodegroupLabel = "eks.amazonaws.com/nodegroup"
+
+// Managed nodegroup handling modes accepted in MANAGED_NODEGROUP_MODE.
+const (
+	// nodegroupModeAll tags the instance and its volumes for every node.
+	nodegroupModeAll = "all"
+	// nodegroupModeVolumesOnly leaves instance tags of managed nodegroup nodes
+	// to EKS (launch template tag propagation) and only tags their volumes.
+	nodegroupModeVolumesOnly = "volumes-only"
+)
+
+// managedNodegroup returns the EKS managed nodegroup the node belongs to, or
+// "" for self-managed nodes (including Karpenter and Fargate).
+func managedNodegroup(node *corev1.Node) string {
+	return node.Labels[eksNodegroupLabel]
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"sort"
+	"time"
+)
+
+// statusAnnotation records on a tagged node when it was tagged and what was
+// covered, as JSON (see nodeStatus), next to the tagged annotation.
+const statusAnnotation = "aws-node-retag.io/status"
+
+// Reasons an audit reports a node's status annotation as stale.
+const (
+	staleInstance  = "instance_changed"
+	staleTags      = "tags_changed"
+	staleResources = "resources_changed"
+)
+
+// nodeStatus is the value of the status annotation.
+type nodeStatus struct {
+	TaggedAt   time.Time `json:"taggedAt"`
+	InstanceID string    `json:"instanceID"`
+	Region     string    `json:"region"`
+	// TagSetHash identifies the tag sets written to the resources, see
+	// resourceTagsHash.
+	TagSetHash string `json:"tagSetHash"`
+	// Resources are the IDs of the instance (unless only volumes are tagged)
+	// and volumes tagged, in order.
+	Resources []string `json:"resources"`
+	// Deduplicated are the resources among them whose tags another reconcile
+	// wrote, in order (see applyDeduplicated).
+	Deduplicated []string `json:"deduplicated,omitempty"`
+	// DeniedKeys are the tag keys not written because IAM denies them, in
+	// order (see deniedkeys.go).
+	DeniedKeys []string `json:"deniedKeys,omitempty"`
+}
+
+func newNodeStatus(d *nodeDecision, perResource map[string]map[string]string, now time.Time) *nodeStatus {
+	return &nodeStatus{
+		TaggedAt:   now.UTC().Truncate(time.Second),
+		InstanceID: d.InstanceID,
+		Region:     d.Region,
+		TagSetHash: resourceTagsHash(perResource),
+		Resources:  sortedTagKeys(perResource),
+	}
+}
+
+// parseNodeStatus returns the status recorded in annotations under key, or
+// nil when there is none or it cannot be read, e.g. on nodes tagged by
+// earlier versions.
+func parseNodeStatus(annotations map[string]string, key string) *nodeStatus {
+	v, ok := annotations[key]
+	if !ok {
+		return nil
+	}
+	var s nodeStatus
+	if err := json.Unmarshal([]byte(v), &s); err != nil {
+		return nil
+	}
+	return &s
+}
+
+// resourceTagsHash returns the hex SHA-256 of the distinct tag sets in
+// perResource, in canonical form. It does not depend on the resource IDs, so
+// a volume attached later with the same tags leaves it unchanged.
+func resourceTagsHash(perResource map[string]map[string]string) string {
+	sets := make([]string, 0, len(perResource))
+	for _, tags := range perResource {
+		sets = append(sets, canonicalTags(tags))
+	}
+	sort.Strings(sets)
+	data, _ := json.Marshal(slices.Compact(sets))
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// staleReason compares the status with the tags the node's resources would
+// get now and returns why it no longer describes them, or "".
+func (s *nodeStatus) staleReason(instanceID string, perResource map[string]map[string]string) string {
+	switch {
+	case s.InstanceID != instanceID:
+		return staleInstance
+	case s.TagSetHash != resourceTagsHash(perResource):
+		return staleTags
+	case !slices.Equal(s.Resources, sortedTagKeys(perResource)):
+		return staleResources
+	}
+	return ""
+}
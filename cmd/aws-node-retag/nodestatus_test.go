@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNodeStatusAnnotation(t *testing.T) {
+	node := taintedNode(nil)
+	k8s := fake.NewSimpleClientset(node)
+	api := &instanceEC2{taggingEC2{}}
+	tagger := newStartupTagger(k8s, api)
+
+	d := tagger.resolveNode(context.Background(), node, false)
+	if err := tagger.tagInstance(context.Background(), node, d, tagger.logger); err != nil {
+		t.Fatal(err)
+	}
+	got, err := k8s.CoreV1().Nodes().Get(context.Background(), "n1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := parseNodeStatus(got.Annotations, statusAnnotation)
+	if status == nil {
+		t.Fatalf("no status annotation: %v", got.Annotations)
+	}
+	if status.InstanceID != "i-0123456789abcdef0" || status.Region != "us-east-1" || status.TaggedAt.IsZero() ||
+		!reflect.DeepEqual(status.Resources, []string{"i-0123456789abcdef0", "vol-root"}) {
+		t.Errorf("status = %+v", status)
+	}
+
+	// The status is current until the desired tags change.
+	api.existing = map[string]map[string]string{"i-0123456789abcdef0": {"Env": "prod"}, "vol-root": {"Env": "prod"}}
+	if report := tagger.audit(context.Background(), []*corev1.Node{got}); len(report.Stale) != 0 {
+		t.Errorf("stale = %+v, want none", report.Stale)
+	}
+	tagger.snapshot.Store(&tagSnapshot{tags: map[string]string{"Env": "staging"}})
+	report := tagger.audit(context.Background(), []*corev1.Node{got})
+	if len(report.Stale) != 1 || report.Stale[0].Reason != staleTags || !report.Stale[0].TaggedAt.Equal(status.TaggedAt) {
+		t.Errorf("stale = %+v, want n1 with changed tags", report.Stale)
+	}
+}
+
+func TestNodeStatusStaleReason(t *testing.T) {
+	tags := map[string]string{"Env": "prod"}
+	perResource := map[string]map[string]string{"i-1": tags, "vol-1": tags}
+	s := newNodeStatus(&nodeDecision{InstanceID: "i-1"}, perResource, time.Now())
+
+	if got := s.staleReason("i-2", perResource); got != staleInstance {
+		t.Errorf("replaced instance: %q", got)
+	}
+	// Another volume with the same tags keeps the hash but not the resources.
+	perResource["vol-2"] = tags
+	if got := s.staleReason("i-1", perResource); got != staleResources {
+		t.Errorf("attached volume: %q", got)
+	}
+	if resourceTagsHash(perResource) != s.TagSetHash {
+		t.Error("hash depends on the resource IDs")
+	}
+	delete(perResource, "vol-2")
+	if got := s.staleReason("i-1", perResource); got != "" {
+		t.Errorf("unchanged: %q", got)
+	}
+
+	if parseNodeStatus(map[string]string{statusAnnotation: "true"}, statusAnnotation) != nil {
+		t.Error("parsed a status that is not JSON")
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	smithy "github.com/aws/smithy-go"
+)
+
+// Notification kinds.
+const (
+	// notifyNodeFailed is sent when a node failed NOTIFY_NODE_FAILURES
+	// reconciles in a row.
+	notifyNodeFailed = "nodeFailed"
+	// notifyFailureRate is sent when the share of failed node reconciles
+	// within NOTIFY_FAILURE_WINDOW reaches NOTIFY_FAILURE_RATE.
+	notifyFailureRate = "failureRate"
+)
+
+const (
+	// notifyMinReconciles is the number of node reconciles a window needs
+	// before its failure rate is considered, so one failure after a quiet
+	// period is not a 100% failure rate.
+	notifyMinReconciles = 10
+	// notifyQueueSize bounds the notifications waiting to be sent; further
+	// ones are dropped rather than blocking reconciles.
+	notifyQueueSize = 100
+	// notifyTimeout bounds the delivery of one notification to one sink.
+	notifyTimeout = 10 * time.Second
+)
+
+// snsTopicARNPattern matches SNS topic ARNs and captures their region.
+var snsTopicARNPattern = regexp.MustCompile(`^arn:aws(?:-cn|-us-gov)?:sns:([a-z0-9-]+):\d{12}:[\w-]{1,256}(\.fifo)?$`)
+
+// snsTopicRegion returns the region of an SNS topic ARN.
+func snsTopicRegion(arn string) (string, error) {
+	m := snsTopicARNPattern.FindStringSubmatch(arn)
+	if m == nil {
+		return "", fmt.Errorf("%q is not an SNS topic ARN (arn:<partition>:sns:<region>:<account>:<topic>)", arn)
+	}
+	return m[1], nil
+}
+
+// notification is the JSON document sent to every sink.
+type notification struct {
+	// SchemaVersion is notificationSchemaVersion (see schema.go).
+	SchemaVersion int       `json:"schemaVersion"`
+	Kind          string    `json:"kind"`
+	Time          time.Time `json:"time"`
+	Controller    string    `json:"controller,omitempty"`
+	// Text summarizes the notification, so the document can be posted
+	// as is to a Slack or Mattermost incoming webhook.
+	Text string `json:"text"`
+
+	// Node, InstanceID, Region and the error describe the failed node: the
+	// node of a nodeFailed notification, the latest failure of a failureRate one.
+	Node       string `json:"node,omitempty"`
+	InstanceID string `json:"instanceID,omitempty"`
+	Region     string `json:"region,omitempty"`
+	ErrorCode  string `json:"errorCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+	// Failures is the number of consecutive failed reconciles of Node.
+	Failures int `json:"failures,omitempty"`
+
+	// FailureRate is the share of Reconciles that failed within Window.
+	FailureRate float64 `json:"failureRate,omitempty"`
+	Reconciles  int     `json:"reconciles,omitempty"`
+	Window      string  `json:"window,omitempty"`
+}
+
+// notificationSink delivers notifications to one destination.
+type notificationSink interface {
+	name() string
+	send(ctx context.Context, n *notification) error
+}
+
+// errSinkDisabled is returned by a sink turned off for missing permissions;
+// its notifications are counted as dropped.
+var errSinkDisabled = errors.New("notification sink disabled")
+
+// snsAPI is the subset of the SNS client used to publish notifications.
+type snsAPI interface {
+	Publish(ctx context.Context, params *sns.PublishInput, optFns ...func(*sns.Options)) (*sns.PublishOutput, error)
+}
+
+// snsSink publishes the notification document to an SNS topic, with the
+// summary as the subject read by email subscribers.
+type snsSink struct {
+	api      snsAPI
+	topicARN string
+	// region is the topic's region.
+	region string
+	// features disables the sink when sns:Publish is denied.
+	features *featureGates
+}
+
+func (s *snsSink) name() string { return "sns" }
+
+func (s *snsSink) send(ctx context.Context, n *notification) error {
+	if !s.features.enabled(featureSNSNotifications, s.region) {
+		return errSinkDisabled
+	}
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	_, err = s.api.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(s.topicARN),
+		Subject:  aws.String(snsSubject(n.Text)),
+		Message:  aws.String(string(body)),
+	})
+	if s.features.denied(featureSNSNotifications, s.region, err) {
+		return errSinkDisabled
+	}
+	return err
+}
+
+// snsSubject fits text into an SNS subject: printable ASCII, at most 100
+// characters.
+func snsSubject(text string) string {
+	b := make([]byte, 0, 100)
+	for _, r := range text {
+		if len(b) == cap(b) {
+			break
+		}
+		if r < 0x20 || r > 0x7e {
+			r = '?'
+		}
+		b = append(b, byte(r))
+	}
+	return string(b)
+}
+
+// webhookSink POSTs the notification document as JSON to a URL.
+type webhookSink struct {
+	client *http.Client
+	url    string
+}
+
+func (w *webhookSink) name() string { return "webhook" }
+
+func (w *webhookSink) send(ctx context.Context, n *notification) error {
+	return postJSON(ctx, w.client, w.url, n)
+}
+
+// postJSON POSTs v as JSON to url and fails unless the response is 2xx.
+func postJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		// The URL may embed a secret token; keep it out of the logs.
+		var urlErr *neturl.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// notifier tracks node reconcile outcomes and sends a notification to every
+// sink when a node keeps failing or the failure rate crosses a threshold,
+// so broken IAM permissions do not fail silently in the logs. Notifications
+// are sent in the background by run; reconciles never wait for them.
+type notifier struct {
+	sinks      []notificationSink
+	controller string
+	// nodeFailures is NOTIFY_NODE_FAILURES; rate and window are
+	// NOTIFY_FAILURE_RATE (0 disables) and NOTIFY_FAILURE_WINDOW.
+	nodeFailures int
+	rate         float64
+	window       time.Duration
+
+	logger  *slog.Logger
+	metrics *metrics
+	now     func() time.Time
+	queue   chan *notification
+
+	mu sync.Mutex
+	// failures counts the consecutive failed reconciles of each node until it
+	// is tagged.
+	failures map[string]int
+	// outcomes are the node reconciles within the window, oldest first.
+	outcomes []reconcileOutcome
+	// alerting is set once a failureRate notification is sent and cleared
+	// when the rate drops below the threshold again.
+	alerting bool
+}
+
+type reconcileOutcome struct {
+	at     time.Time
+	failed bool
+}
+
+func newNotifier(cfg *Config, sinks []notificationSink, m *metrics, logger *slog.Logger) *notifier {
+	return &notifier{
+		sinks:        sinks,
+		controller:   cfg.ControllerID,
+		nodeFailures: cfg.NotifyNodeFailures,
+		rate:         cfg.NotifyFailureRate,
+		window:       cfg.NotifyFailureWindow,
+		logger:       logger,
+		metrics:      m,
+		now:          time.Now,
+		queue:        make(chan *notification, notifyQueueSize),
+		failures:     map[string]int{},
+	}
+}
+
+// forgetNode drops the failure streak of a deleted node.
+func (n *notifier) forgetNode(node string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.failures, node)
+}
+
+// nodeResult records the outcome of tagging the node decided by d; err is
+// nil when it was tagged.
+func (n *notifier) nodeResult(node string, d *nodeDecision, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.now()
+
+	var sent []*notification
+	if err == nil {
+		delete(n.failures, node)
+	} else {
+		n.failures[node]++
+		if n.failures[node] == n.nodeFailures {
+			text := fmt.Sprintf("%s: tagging node %s (%s) failed: %s", controllerName(n.controller), node, d.InstanceID, eventError(err))
+			if n.nodeFailures > 1 {
+				text = fmt.Sprintf("%s: tagging node %s (%s) failed %d times in a row: %s", controllerName(n.controller), node, d.InstanceID, n.nodeFailures, eventError(err))
+			}
+			sent = append(sent, n.failed(notifyNodeFailed, node, d, err, now, text))
+		}
+	}
+
+	if n.rate > 0 {
+		n.outcomes = append(n.outcomes, reconcileOutcome{at: now, failed: err != nil})
+		i := 0
+		for i < len(n.outcomes) && now.Sub(n.outcomes[i].at) > n.window {
+			i++
+		}
+		n.outcomes = n.outcomes[i:]
+		failed := 0
+		for _, o := range n.outcomes {
+			if o.failed {
+				failed++
+			}
+		}
+		rate := float64(failed) / float64(len(n.outcomes))
+		switch {
+		case len(n.outcomes) < notifyMinReconciles:
+		case rate >= n.rate && !n.alerting && err != nil:
+			n.alerting = true
+			msg := n.failed(notifyFailureRate, node, d, err, now,
+				fmt.Sprintf("%s: %d of %d node reconciles failed in the last %s; latest: node %s (%s): %s", controllerName(n.controller), failed, len(n.outcomes), n.window, node, d.InstanceID, eventError(err)))
+			msg.FailureRate, msg.Reconciles, msg.Window = rate, len(n.outcomes), n.window.String()
+			sent = append(sent, msg)
+		case rate < n.rate && n.alerting:
+			n.alerting = false
+			n.logger.Info("node reconcile failure rate back below the notification threshold", "failureRate", rate, "threshold", n.rate)
+		}
+	}
+
+	for _, msg := range sent {
+		select {
+		case n.queue <- msg:
+		default:
+			n.logger.Warn("notification queue full, dropping notification", "kind", msg.Kind, "node", node)
+			for _, s := range n.sinks {
+				n.metrics.notifications.WithLabelValues(s.name(), "dropped").Inc()
+			}
+		}
+	}
+}
+
+func (n *notifier) failed(kind, node string, d *nodeDecision, err error, now time.Time, text string) *notification {
+	msg := &notification{
+		SchemaVersion: notificationSchemaVersion,
+		Kind:          kind,
+		Time:          now.UTC(),
+		Controller:    n.controller,
+		Text:          text,
+		Node:          node,
+		InstanceID:    d.InstanceID,
+		Region:        d.Region,
+		Error:         eventError(err),
+		Failures:      n.failures[node],
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		msg.ErrorCode = apiErr.ErrorCode()
+	}
+	return msg
+}
+
+// run sends queued notifications to every sink until ctx is done, then
+// sends those still queued, all within notifyTimeout, so failures from the
+// shutdown drain are not lost.
+func (n *notifier) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			for {
+				select {
+				case msg := <-n.queue:
+					n.deliver(flushCtx, msg)
+				default:
+					return
+				}
+			}
+		case msg := <-n.queue:
+			n.deliver(ctx, msg)
+		}
+	}
+}
+
+// deliver sends msg to every sink.
+func (n *notifier) deliver(ctx context.Context, msg *notification) {
+	for _, s := range n.sinks {
+		sendCtx, cancel := context.WithTimeout(ctx, notifyTimeout)
+		err := s.send(sendCtx, msg)
+		cancel()
+		if errors.Is(err, errSinkDisabled) {
+			n.metrics.notifications.WithLabelValues(s.name(), "dropped").Inc()
+			continue
+		}
+		if err != nil {
+			n.logger.Warn("failed to send notification", "sink", s.name(), "kind", msg.Kind, "error", err)
+			n.metrics.notifications.WithLabelValues(s.name(), "failed").Inc()
+			continue
+		}
+		n.logger.Info("sent notification", "sink", s.name(), "kind", msg.Kind, "node", msg.Node)
+		n.metrics.notifications.WithLabelValues(s.name(), "sent").Inc()
+	}
+}
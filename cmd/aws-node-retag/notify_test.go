@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	smithy "github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestNotifier(nodeFailures int, rate float64) *notifier {
+	cfg := &Config{NotifyNodeFailures: nodeFailures, NotifyFailureRate: rate, NotifyFailureWindow: time.Minute}
+	return newNotifier(cfg, nil, newMetrics(""), slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// queued drains the notifications waiting to be sent.
+func queued(n *notifier) []*notification {
+	var out []*notification
+	for {
+		select {
+		case msg := <-n.queue:
+			out = append(out, msg)
+		default:
+			return out
+		}
+	}
+}
+
+func TestNotifierForgetsDeletedNodes(t *testing.T) {
+	n := newTestNotifier(2, 0)
+	tagger := newStartupTagger(nil, nil)
+	tagger.notifier = n
+	d := &nodeDecision{InstanceID: "i-0abc", Region: "us-east-1"}
+
+	n.nodeResult("node-a", d, errors.New("throttled"))
+	tagger.nodeDeleteFunc(context.Background(), newWorkPool(1, func(fn func()) { fn() }), nil, false)(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}})
+	if len(n.failures) != 0 {
+		t.Errorf("failures = %v after the node was deleted, want none", n.failures)
+	}
+	// A node registered again under the name starts a new streak.
+	n.nodeResult("node-a", d, errors.New("throttled"))
+	if got := queued(n); len(got) != 0 {
+		t.Errorf("notified after the first failure of a new streak: %v", got)
+	}
+}
+
+func TestSNSTopicRegion(t *testing.T) {
+	region, err := snsTopicRegion("arn:aws:sns:eu-west-1:123456789012:alerts")
+	if err != nil || region != "eu-west-1" {
+		t.Errorf("snsTopicRegion = %q, %v", region, err)
+	}
+	if _, err := snsTopicRegion("arn:aws:sqs:eu-west-1:123456789012:alerts"); err == nil {
+		t.Error("expected an error for an SQS queue ARN")
+	}
+}
+
+func TestNotifierNodeFailures(t *testing.T) {
+	n := newTestNotifier(2, 0)
+	d := &nodeDecision{InstanceID: "i-0abc", Region: "us-east-1"}
+	denied := &smithy.GenericAPIError{Code: "UnauthorizedOperation", Message: "not authorized to perform ec2:CreateTags"}
+
+	n.nodeResult("node-a", d, denied)
+	if got := queued(n); len(got) != 0 {
+		t.Fatalf("notified after the first failure: %v", got)
+	}
+	n.nodeResult("node-a", d, denied)
+	got := queued(n)
+	if len(got) != 1 {
+		t.Fatalf("notifications after two failures = %d, want 1", len(got))
+	}
+	msg := got[0]
+	if msg.Kind != notifyNodeFailed || msg.Node != "node-a" || msg.InstanceID != "i-0abc" || msg.Region != "us-east-1" ||
+		msg.ErrorCode != "UnauthorizedOperation" || msg.Failures != 2 || !strings.Contains(msg.Text, "2 times in a row") {
+		t.Errorf("notification = %+v", msg)
+	}
+
+	// Once per streak: further failures are quiet until the node is tagged.
+	n.nodeResult("node-a", d, denied)
+	if got := queued(n); len(got) != 0 {
+		t.Errorf("notified again during the same streak: %v", got)
+	}
+	n.nodeResult("node-a", d, nil)
+	n.nodeResult("node-a", d, denied)
+	n.nodeResult("node-a", d, denied)
+	if got := queued(n); len(got) != 1 {
+		t.Errorf("notifications after a new streak = %d, want 1", len(got))
+	}
+}
+
+func TestNotifierFailureRate(t *testing.T) {
+	n := newTestNotifier(100, 0.5)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	n.now = func() time.Time { return now }
+	d := &nodeDecision{InstanceID: "i-0abc"}
+	failure := errors.New("boom")
+
+	for range notifyMinReconciles / 2 {
+		n.nodeResult("ok", d, nil)
+	}
+	for range notifyMinReconciles/2 - 1 {
+		n.nodeResult("bad", d, failure)
+	}
+	if got := queued(n); len(got) != 0 {
+		t.Fatalf("notified below the minimum number of reconciles: %v", got)
+	}
+	n.nodeResult("bad", d, failure)
+	got := queued(n)
+	if len(got) != 1 || got[0].Kind != notifyFailureRate || got[0].FailureRate != 0.5 || got[0].Reconciles != notifyMinReconciles {
+		t.Fatalf("notifications = %+v, want one failureRate at 0.5", got)
+	}
+
+	// Once until the rate recovers.
+	n.nodeResult("bad", d, failure)
+	if got := queued(n); len(got) != 0 {
+		t.Errorf("notified again while alerting: %v", got)
+	}
+	for range 2 * notifyMinReconciles {
+		n.nodeResult("ok", d, nil)
+	}
+	n.nodeResult("bad", d, failure)
+	if got := queued(n); len(got) != 0 {
+		t.Errorf("notified below the threshold: %v", got)
+	}
+
+	// Reconciles older than the window no longer count.
+	now = now.Add(2 * time.Minute)
+	for range notifyMinReconciles {
+		n.nodeResult("bad", d, failure)
+	}
+	if got := queued(n); len(got) != 1 {
+		t.Errorf("notifications after the window moved = %d, want 1", len(got))
+	}
+}
+
+type fakeSNS struct {
+	published []*sns.PublishInput
+}
+
+func (f *fakeSNS) Publish(_ context.Context, in *sns.PublishInput, _ ...func(*sns.Options)) (*sns.PublishOutput, error) {
+	f.published = append(f.published, in)
+	return &sns.PublishOutput{}, nil
+}
+
+func TestNotificationSinks(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []notification
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		var n notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, n)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	api := &fakeSNS{}
+	n := newTestNotifier(1, 0)
+	n.sinks = []notificationSink{
+		&snsSink{api: api, topicARN: "arn:aws:sns:us-east-1:123456789012:alerts"},
+		&webhookSink{client: srv.Client(), url: srv.URL},
+		&webhookSink{client: srv.Client(), url: srv.URL + "/missing"},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	done := make(chan struct{})
+	go func() { n.run(ctx); close(done) }()
+
+	n.nodeResult("node-a", &nodeDecision{InstanceID: "i-0abc"}, errors.New("boom"))
+	if err := waitFor(ctx, func() bool {
+		return testutil.ToFloat64(n.metrics.notifications.WithLabelValues("webhook", "sent"))+
+			testutil.ToFloat64(n.metrics.notifications.WithLabelValues("webhook", "failed")) == 2
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	<-done
+
+	if len(api.published) != 1 || !strings.HasPrefix(aws.ToString(api.published[0].Subject), "aws-node-retag: tagging node node-a") {
+		t.Errorf("SNS publishes = %v", api.published)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 || received[0].Node != "node-a" || received[0].Error != "boom" {
+		t.Errorf("webhook received %+v", received)
+	}
+	if got := testutil.ToFloat64(n.metrics.notifications.WithLabelValues("webhook", "failed")); got != 1 {
+		t.Errorf("webhook failed = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(n.metrics.notifications.WithLabelValues("sns", "sent")); got != 1 {
+		t.Errorf("sns sent = %v, want 1", got)
+	}
+}
+
+func TestNotifierFlushesOnStop(t *testing.T) {
+	api := &fakeSNS{}
+	n := newTestNotifier(1, 0)
+	n.sinks = []notificationSink{&snsSink{api: api, topicARN: "arn:aws:sns:us-east-1:123456789012:alerts"}}
+	n.nodeResult("node-a", &nodeDecision{InstanceID: "i-0abc"}, errors.New("boom"))
+	n.nodeResult("node-b", &nodeDecision{InstanceID: "i-0def"}, errors.New("boom"))
+
+	// Stopped before it sent anything: the queued notifications still go out.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n.run(ctx)
+	if len(api.published) != 2 {
+		t.Errorf("SNS publishes = %d, want 2", len(api.published))
+	}
+	if got := queued(n); len(got) != 0 {
+		t.Errorf("notifications left in the queue: %v", got)
+	}
+}
+
+func TestSNSSubject(t *testing.T) {
+	got := snsSubject("tagging failed: ✗ " + strings.Repeat("x", 200))
+	if len(got) != 100 || strings.ContainsRune(got, '✗') {
+		t.Errorf("snsSubject = %q (%d)", got, len(got))
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// overridesPath is the endpoint, on the metrics server, where external
+// systems submit tag overrides: PUT or DELETE /overrides/<instance-id>, and
+// GET /overrides to list them.
+const overridesPath = "/overrides/"
+
+// maxOverrideBody bounds the request body of a submitted override.
+const maxOverrideBody = 64 << 10
+
+// Override actions, the "action" label of tag_overrides_total.
+const (
+	overrideSet      = "set"
+	overrideDelete   = "delete"
+	overrideRejected = "rejected"
+)
+
+// tagOverride is a tag set an external system, such as a CMDB or a ticketing
+// system, submitted for an instance. It is merged over the tags of the
+// instance and its volumes, after TagPolicies.
+type tagOverride struct {
+	Tags map[string]string `json:"tags"`
+	// Source names the submitting system and Reference its record of the
+	// change, e.g. a ticket ID; both are kept for the audit trail.
+	Source    string    `json:"source"`
+	Reference string    `json:"reference,omitempty"`
+	Submitted time.Time `json:"submitted"`
+}
+
+// overrideStore holds the tag overrides by instance ID. They are kept in a
+// ConfigMap (TAG_OVERRIDES_CONFIGMAP), written by the endpoint and read back
+// through an informer, so they survive restarts and may also be edited with
+// kubectl.
+type overrideStore struct {
+	k8s       kubernetes.Interface
+	namespace string
+	name      string
+	// keyPrefix is CLUSTER_TAG_PREFIX, which the keys are written under.
+	keyPrefix string
+	readOnly  bool
+	metrics   *metrics
+	logger    *slog.Logger
+	now       func() time.Time
+	// onChange is called with the instance whose override was set, changed
+	// or deleted, to reconcile its node.
+	onChange func(instanceID string)
+
+	mu         sync.RWMutex
+	byInstance map[string]tagOverride
+}
+
+func newOverrideStore(k8s kubernetes.Interface, cfg *Config, m *metrics, logger *slog.Logger) *overrideStore {
+	return &overrideStore{
+		k8s:        k8s,
+		namespace:  cfg.Namespace,
+		name:       cfg.TagOverridesConfigMap,
+		keyPrefix:  cfg.ClusterTagPrefix,
+		readOnly:   cfg.ReadOnly,
+		metrics:    m,
+		logger:     logger,
+		now:        time.Now,
+		byInstance: map[string]tagOverride{},
+	}
+}
+
+// get returns the override of the instance; a nil store has none.
+func (s *overrideStore) get(instanceID string) (tagOverride, bool) {
+	if s == nil {
+		return tagOverride{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o, ok := s.byInstance[instanceID]
+	return o, ok
+}
+
+// validate checks an override as submitted.
+func (o tagOverride) validate(keyPrefix string) error {
+	if len(o.Tags) == 0 {
+		return errors.New("tags must contain at least one key-value pair")
+	}
+	if strings.TrimSpace(o.Source) == "" {
+		return errors.New("source is required")
+	}
+	prefixed := make(map[string]string, len(o.Tags))
+	for k, v := range o.Tags {
+		prefixed[keyPrefix+k] = v
+	}
+	return awstags.Validate(prefixed)
+}
+
+// handler keeps the store in sync with the ConfigMap. Entries that do not
+// parse or validate are logged and ignored.
+func (s *overrideStore) handler() cache.ResourceEventHandler {
+	update := func(cm *corev1.ConfigMap) {
+		next := map[string]tagOverride{}
+		if cm != nil {
+			for id, raw := range cm.Data {
+				var o tagOverride
+				if err := json.Unmarshal([]byte(raw), &o); err != nil {
+					s.logger.Error("ignoring invalid tag override", "instanceID", id, "error", err)
+					continue
+				}
+				if err := o.validate(s.keyPrefix); err != nil {
+					s.logger.Error("ignoring invalid tag override", "instanceID", id, "error", err)
+					continue
+				}
+				next[id] = o
+			}
+		}
+		s.mu.Lock()
+		prev := s.byInstance
+		s.byInstance = next
+		s.mu.Unlock()
+
+		var changed []string
+		for id, o := range next {
+			if p, ok := prev[id]; !ok || !maps.Equal(p.Tags, o.Tags) {
+				changed = append(changed, id)
+			}
+		}
+		for id := range prev {
+			if _, ok := next[id]; !ok {
+				changed = append(changed, id)
+			}
+		}
+		sort.Strings(changed)
+		for _, id := range changed {
+			if s.onChange != nil {
+				s.onChange(id)
+			}
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if cm, ok := obj.(*corev1.ConfigMap); ok {
+				update(cm)
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if cm, ok := newObj.(*corev1.ConfigMap); ok {
+				update(cm)
+			}
+		},
+		DeleteFunc: func(interface{}) {
+			update(nil)
+		},
+	}
+}
+
+// httpHandler serves the overrides endpoint. Every accepted change is
+// logged with the submitting source, its reference and the client address.
+func (s *overrideStore) httpHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, overridesPath)
+		if id == "" || r.URL.Path == strings.TrimSuffix(overridesPath, "/") {
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			s.mu.RLock()
+			resp := maps.Clone(s.byInstance)
+			s.mu.RUnlock()
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		if !isInstanceID(id) {
+			http.Error(w, fmt.Sprintf("%q is not an EC2 instance ID", id), http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			o, ok := s.get(id)
+			if !ok {
+				http.Error(w, "no override for "+id, http.StatusNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, o)
+		case http.MethodPut:
+			s.put(w, r, id)
+		case http.MethodDelete:
+			s.delete(w, r, id)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func (s *overrideStore) put(w http.ResponseWriter, r *http.Request, id string) {
+	var o tagOverride
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxOverrideBody))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&o)
+	if err == nil {
+		err = o.validate(s.keyPrefix)
+	}
+	if err != nil {
+		s.reject(w, r, id, http.StatusBadRequest, err)
+		return
+	}
+	if s.readOnly {
+		s.reject(w, r, id, http.StatusForbidden, errors.New("read-only: tag overrides cannot be changed"))
+		return
+	}
+	o.Submitted = s.now().UTC()
+	raw, err := json.Marshal(o)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	prev, _ := s.get(id)
+	err = updateConfigMapData(r.Context(), s.k8s, s.namespace, s.name, func(data map[string]string) map[string]string {
+		data[id] = string(raw)
+		return data
+	})
+	if err != nil {
+		s.logger.Error("failed to store tag override", "instanceID", id, "source", o.Source, "error", err)
+		http.Error(w, "failed to store the override: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.metrics.tagOverride(overrideSet)
+	s.logger.Info("tag override set", "instanceID", id, "source", o.Source, "reference", o.Reference,
+		"remoteAddr", r.RemoteAddr, "tags", o.Tags, "previousTags", prev.Tags)
+	writeJSON(w, http.StatusAccepted, o)
+}
+
+// delete removes the override of the instance. The keys it set keep their
+// values until other tags overwrite them. ?source= names the system removing
+// it, for the audit trail.
+func (s *overrideStore) delete(w http.ResponseWriter, r *http.Request, id string) {
+	source := r.URL.Query().Get("source")
+	if strings.TrimSpace(source) == "" {
+		s.reject(w, r, id, http.StatusBadRequest, errors.New("missing ?source= parameter"))
+		return
+	}
+	if s.readOnly {
+		s.reject(w, r, id, http.StatusForbidden, errors.New("read-only: tag overrides cannot be changed"))
+		return
+	}
+	prev, ok := s.get(id)
+	if !ok {
+		http.Error(w, "no override for "+id, http.StatusNotFound)
+		return
+	}
+	err := updateConfigMapData(r.Context(), s.k8s, s.namespace, s.name, func(data map[string]string) map[string]string {
+		delete(data, id)
+		return data
+	})
+	if err != nil {
+		s.logger.Error("failed to delete tag override", "instanceID", id, "source", source, "error", err)
+		http.Error(w, "failed to delete the override: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.metrics.tagOverride(overrideDelete)
+	s.logger.Info("tag override deleted", "instanceID", id, "source", source, "reference", r.URL.Query().Get("reference"),
+		"remoteAddr", r.RemoteAddr, "previousTags", prev.Tags, "previousSource", prev.Source)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *overrideStore) reject(w http.ResponseWriter, r *http.Request, id string, status int, err error) {
+	s.metrics.tagOverride(overrideRejected)
+	s.logger.Warn("tag override rejected", "instanceID", id, "method", r.Method, "remoteAddr", r.RemoteAddr, "error", err)
+	http.Error(w, err.Error(), status)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+// retagInstance queues a forced re-tag of the node of the instance from the
+// cache, if any, so a changed override is applied right away. It runs on pool
+// like any node reconcile, under ctx and the NODE_RECONCILE_TIMEOUT budget.
+func (t *Tagger) retagInstance(ctx context.Context, pool *workPool, nodes corelisters.NodeLister, instanceID string) {
+	list, err := nodes.List(labels.Everything())
+	if err != nil {
+		t.logger.Error("failed to list nodes from cache", "error", err)
+		return
+	}
+	for _, node := range list {
+		if nodeInstanceHint(node) == instanceID {
+			pool.add(t.nodeItem(ctx, pool, node, false, func(ctx context.Context) error { return t.tagNode(ctx, node, true) }))
+			return
+		}
+	}
+}
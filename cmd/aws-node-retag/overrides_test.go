@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func testOverrideStore(readOnly bool) *overrideStore {
+	s := newOverrideStore(fake.NewSimpleClientset(), &Config{
+		Namespace:             "kube-system",
+		TagOverridesConfigMap: "retag-tag-overrides",
+		ReadOnly:              readOnly,
+	}, newMetrics(""), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.now = func() time.Time { return time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC) }
+	return s
+}
+
+func serveOverride(s *overrideStore, method, target, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.httpHandler().ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+// syncOverrides feeds the store's ConfigMap back through its handler, as the
+// informer does.
+func syncOverrides(t *testing.T, s *overrideStore) {
+	t.Helper()
+	cm, err := s.k8s.CoreV1().ConfigMaps(s.namespace).Get(context.Background(), s.name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.handler().OnUpdate(nil, cm)
+}
+
+func TestOverrideEndpoint(t *testing.T) {
+	s := testOverrideStore(false)
+	var changed []string
+	s.onChange = func(id string) { changed = append(changed, id) }
+
+	rec := serveOverride(s, http.MethodPut, "/overrides/i-0123456789abcdef1", `{"tags":{"CostCenter":"cc-4711"},"source":"cmdb","reference":"CHG001"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("PUT = %d %s", rec.Code, rec.Body)
+	}
+	syncOverrides(t, s)
+	o, ok := s.get("i-0123456789abcdef1")
+	if !ok || o.Source != "cmdb" || o.Reference != "CHG001" || !o.Submitted.Equal(s.now()) || o.Tags["CostCenter"] != "cc-4711" {
+		t.Fatalf("get = %+v, %v", o, ok)
+	}
+	if !reflect.DeepEqual(changed, []string{"i-0123456789abcdef1"}) {
+		t.Errorf("changed = %v, want [i-0123456789abcdef1]", changed)
+	}
+
+	rec = serveOverride(s, http.MethodGet, "/overrides", "")
+	var all map[string]tagOverride
+	if err := json.Unmarshal(rec.Body.Bytes(), &all); err != nil || len(all) != 1 {
+		t.Errorf("GET /overrides = %s, %v", rec.Body, err)
+	}
+	if rec := serveOverride(s, http.MethodGet, "/overrides/i-0123456789abcdef1", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET = %d", rec.Code)
+	}
+
+	// Syncing the same content again reconciles nothing.
+	syncOverrides(t, s)
+	if len(changed) != 1 {
+		t.Errorf("changed = %v, want no reconcile without a change", changed)
+	}
+
+	if rec := serveOverride(s, http.MethodDelete, "/overrides/i-0123456789abcdef1", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("DELETE without source = %d, want 400", rec.Code)
+	}
+	if rec := serveOverride(s, http.MethodDelete, "/overrides/i-0123456789abcdef1?source=cmdb", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE = %d %s", rec.Code, rec.Body)
+	}
+	syncOverrides(t, s)
+	if _, ok := s.get("i-0123456789abcdef1"); ok {
+		t.Error("the override is still in effect after its deletion")
+	}
+	if !reflect.DeepEqual(changed, []string{"i-0123456789abcdef1", "i-0123456789abcdef1"}) {
+		t.Errorf("changed = %v, want the deletion reconciled", changed)
+	}
+	if rec := serveOverride(s, http.MethodDelete, "/overrides/i-0123456789abcdef1?source=cmdb", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("second DELETE = %d, want 404", rec.Code)
+	}
+
+	if got := testutil.ToFloat64(s.metrics.tagOverrides.WithLabelValues(overrideSet)); got != 1 {
+		t.Errorf("set = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.tagOverrides.WithLabelValues(overrideDelete)); got != 1 {
+		t.Errorf("delete = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(s.metrics.tagOverrides.WithLabelValues(overrideRejected)); got != 1 {
+		t.Errorf("rejected = %v, want 1", got)
+	}
+}
+
+func TestOverrideEndpointRejects(t *testing.T) {
+	s := testOverrideStore(false)
+	for _, tc := range []struct {
+		name, method, target, body string
+		want                       int
+	}{
+		{"not an instance", http.MethodPut, "/overrides/vol-1", `{"tags":{"a":"b"},"source":"cmdb"}`, http.StatusBadRequest},
+		{"no tags", http.MethodPut, "/overrides/i-0123456789abcdef0", `{"source":"cmdb"}`, http.StatusBadRequest},
+		{"no source", http.MethodPut, "/overrides/i-0123456789abcdef0", `{"tags":{"a":"b"}}`, http.StatusBadRequest},
+		{"reserved key", http.MethodPut, "/overrides/i-0123456789abcdef0", `{"tags":{"aws:x":"b"},"source":"cmdb"}`, http.StatusBadRequest},
+		{"unknown field", http.MethodPut, "/overrides/i-0123456789abcdef0", `{"tags":{"a":"b"},"source":"cmdb","ttl":"1h"}`, http.StatusBadRequest},
+		{"missing", http.MethodGet, "/overrides/i-0123456789abcdef0", "", http.StatusNotFound},
+		{"method", http.MethodPost, "/overrides/i-0123456789abcdef0", "", http.StatusMethodNotAllowed},
+		{"list method", http.MethodPost, "/overrides", "", http.StatusMethodNotAllowed},
+	} {
+		if rec := serveOverride(s, tc.method, tc.target, tc.body); rec.Code != tc.want {
+			t.Errorf("%s: %s %s = %d, want %d", tc.name, tc.method, tc.target, rec.Code, tc.want)
+		}
+	}
+
+	ro := testOverrideStore(true)
+	if rec := serveOverride(ro, http.MethodPut, "/overrides/i-0123456789abcdef0", `{"tags":{"a":"b"},"source":"cmdb"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("read-only PUT = %d, want 403", rec.Code)
+	}
+	if _, err := ro.k8s.CoreV1().ConfigMaps(ro.namespace).Get(context.Background(), ro.name, metav1.GetOptions{}); err == nil {
+		t.Error("read-only mode wrote the ConfigMap")
+	}
+}
+
+func TestOverrideStoreIgnoresInvalidEntries(t *testing.T) {
+	s := testOverrideStore(false)
+	s.handler().OnAdd(&corev1.ConfigMap{Data: map[string]string{
+		"i-good": `{"tags":{"Owner":"team-a"},"source":"kubectl"}`,
+		"i-json": `{"tags":`,
+		"i-tags": `{"tags":{},"source":"kubectl"}`,
+	}}, true)
+	if _, ok := s.get("i-good"); !ok {
+		t.Error("valid entry ignored")
+	}
+	for _, id := range []string{"i-json", "i-tags"} {
+		if _, ok := s.get(id); ok {
+			t.Errorf("invalid entry %s loaded", id)
+		}
+	}
+}
+
+func TestNodeResourceTagsOverride(t *testing.T) {
+	inst := &ec2types.Instance{
+		BlockDeviceMappings: []ec2types.InstanceBlockDeviceMapping{
+			{Ebs: &ec2types.EbsInstanceBlockDevice{VolumeId: aws.String("vol-1")}},
+		},
+	}
+	s := testOverrideStore(false)
+	s.byInstance["i-1"] = tagOverride{Tags: map[string]string{"Owner": "team-b"}, Source: "cmdb"}
+	d := &nodeDecision{InstanceID: "i-1", snapshot: &tagSnapshot{tags: map[string]string{"Env": "prod", "Owner": "team-a"}}}
+
+	got := (&Tagger{overrides: s}).nodeResourceTags(&corev1.Node{}, d, inst, attachedVolumes(inst), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	want := map[string]map[string]string{
+		"i-1":   {"Env": "prod", "Owner": "team-b"},
+		"vol-1": {"Env": "prod", "Owner": "team-b"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("nodeResourceTags = %v, want %v", got, want)
+	}
+}
+
+func TestRetagInstanceQueued(t *testing.T) {
+	node := taintedNode(map[string]string{annotationKey: annotationValue})
+	api := &instanceEC2{}
+	tagger := newStartupTagger(fake.NewSimpleClientset(node), api)
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := nodes.Add(node); err != nil {
+		t.Fatal(err)
+	}
+	// No workers run: the item is taken with get.
+	p := newWorkPool(1, func(fn func()) { fn() })
+
+	tagger.retagInstance(context.Background(), p, corelisters.NewNodeLister(nodes), "i-0123456789abcdef0")
+	if len(api.createTags) != 0 {
+		t.Fatal("the re-tag ran on the caller instead of the pool")
+	}
+	item, _ := p.get()
+	if item.key != "node/"+node.Name {
+		t.Fatalf("queued %q, want the node's reconcile", item.key)
+	}
+	item.fn()
+	p.done(item)
+	if len(api.createTags) != 1 {
+		t.Errorf("CreateTags calls = %d, want the tagged node forced", len(api.createTags))
+	}
+
+	tagger.retagInstance(context.Background(), p, corelisters.NewNodeLister(nodes), "i-0fedcba9876543210")
+	if len(p.queued) != 0 {
+		t.Errorf("queued %v for an instance without a node", p.queued)
+	}
+}
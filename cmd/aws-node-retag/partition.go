@@ -0,0 +1,44 @@
+package main
+
+import "strings"
+
+// AWS partitions. Credentials are only valid in their own partition, and
+// each partition has its own endpoints and ARN prefix (arn:<partition>:...).
+const (
+	partitionAWS      = "aws"
+	partitionChina    = "aws-cn"
+	partitionGovCloud = "aws-us-gov"
+)
+
+// providerIDSchemes are the providerID prefixes of AWS nodes. EKS uses aws://
+// in every partition; some distributions name the partition instead.
+var providerIDSchemes = []string{"aws://", "aws-cn://", "aws-us-gov://"}
+
+// cutProviderIDScheme strips the AWS scheme from providerID and reports
+// whether it had one.
+func cutProviderIDScheme(providerID string) (string, bool) {
+	for _, scheme := range providerIDSchemes {
+		if rest, ok := strings.CutPrefix(providerID, scheme); ok {
+			return rest, true
+		}
+	}
+	return "", false
+}
+
+// partitionForRegion returns the partition of region: cn-north-1 is in
+// aws-cn, us-gov-west-1 in aws-us-gov and every other region in aws.
+func partitionForRegion(region string) string {
+	switch {
+	case strings.HasPrefix(region, "cn-"):
+		return partitionChina
+	case strings.HasPrefix(region, "us-gov-"):
+		return partitionGovCloud
+	}
+	return partitionAWS
+}
+
+// inPartition reports whether the controller's credentials can reach region.
+// It is always true when the controller's partition is unknown.
+func (t *Tagger) inPartition(region string) bool {
+	return t.partition == "" || partitionForRegion(region) == t.partition
+}
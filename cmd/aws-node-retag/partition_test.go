@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+)
+
+func TestPartitionForRegion(t *testing.T) {
+	cases := map[string]string{
+		"us-east-1":      partitionAWS,
+		"eu-west-1":      partitionAWS,
+		"cn-north-1":     partitionChina,
+		"cn-northwest-1": partitionChina,
+		"us-gov-west-1":  partitionGovCloud,
+		"us-gov-east-1":  partitionGovCloud,
+	}
+	for region, want := range cases {
+		if got := partitionForRegion(region); got != want {
+			t.Errorf("partitionForRegion(%s) = %s, want %s", region, got, want)
+		}
+	}
+}
+
+func TestPartitionEndpoints(t *testing.T) {
+	cases := map[string]string{
+		"cn-north-1":    "ec2.cn-north-1.amazonaws.com.cn",
+		"us-gov-west-1": "ec2.us-gov-west-1.amazonaws.com",
+	}
+	for region, want := range cases {
+		ep, err := ec2.NewDefaultEndpointResolverV2().ResolveEndpoint(context.Background(), ec2.EndpointParameters{Region: aws.String(region)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if host := ep.URI.Host; !strings.EqualFold(host, want) {
+			t.Errorf("endpoint of %s = %s, want %s", region, host, want)
+		}
+	}
+}
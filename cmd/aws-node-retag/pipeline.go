@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/obezpalko/aws-node-retag/internal/state"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// tagWrites deduplicates the tag writes of node reconciles by resource ID, so
+// that the instance and each volume of a node are independent tasks: a volume
+// reattached to a re-created node, or described by two reconciles racing on
+// the same instance, is written once and the other reconciles use the result.
+type tagWrites struct {
+	results state.Results[string, string]
+	// window is how long a successful write stands in for the same tags;
+	// zero only shares writes in flight.
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	nextSweep time.Time
+}
+
+// writesSweepInterval is the least time between two sweeps of the writes.
+const writesSweepInterval = time.Minute
+
+func newTagWrites(window time.Duration) *tagWrites {
+	return &tagWrites{window: window, now: time.Now}
+}
+
+// reset forgets every write, e.g. for a full re-tag.
+func (w *tagWrites) reset() {
+	if w != nil {
+		w.results.Reset()
+	}
+}
+
+// sweep drops the writes that no longer stand in for any, at most once per
+// window and at most once a minute, so the writes of resources that are not
+// tagged again are not kept forever.
+func (w *tagWrites) sweep(now time.Time) {
+	w.mu.Lock()
+	if now.Before(w.nextSweep) {
+		w.mu.Unlock()
+		return
+	}
+	w.nextSweep = now.Add(max(w.window, writesSweepInterval))
+	w.mu.Unlock()
+	w.results.Sweep(now, w.window)
+}
+
+// forget drops the writes of resourceIDs, e.g. of a deleted node or PV.
+func (w *tagWrites) forget(resourceIDs ...string) {
+	if w == nil {
+		return
+	}
+	for _, id := range resourceIDs {
+		w.results.Forget(id)
+	}
+}
+
+// forgetNodeWrites forgets the writes of a deleted node's instance and of
+// the resources its status lists.
+func (t *Tagger) forgetNodeWrites(node *corev1.Node) {
+	if info, err := parseProviderID(node.Spec.ProviderID); err == nil && info.InstanceID != "" {
+		t.writes.forget(info.InstanceID)
+	}
+	if status := parseNodeStatus(node.Annotations, t.statusKey()); status != nil {
+		t.writes.forget(status.Resources...)
+	}
+}
+
+// resourceVersion identifies the write of tags to a resource, the keys of
+// TagPolicies with a roleARN included with their role: the same tags written
+// with other credentials are another write.
+func resourceVersion(tags, roles map[string]string) string {
+	var byRole map[string]string
+	for k := range tags {
+		if role, ok := roles[k]; ok {
+			if byRole == nil {
+				byRole = map[string]string{}
+			}
+			byRole[k] = role
+		}
+	}
+	if byRole == nil {
+		return tagSetHash(tags)
+	}
+	return tagSetHash(tags) + "/" + tagSetHash(byRole)
+}
+
+// applyDeduplicated is applyPerResource for a node reconcile, skipping the
+// resources whose tags another reconcile is writing or wrote within the
+// window; it waits for those writes and returns their resource IDs, in
+// order. A forced reconcile only shares the writes in flight. Dry runs and
+// blocked writes are not deduplicated, so they log every resource.
+func (t *Tagger) applyDeduplicated(ctx context.Context, d *nodeDecision, perResource map[string]map[string]string, rolesFor func(id string) map[string]string) ([]string, error) {
+	w := t.writes
+	if w == nil || t.writeBlocked() != "" {
+		return nil, t.applyPerResource(ctx, d.Region, perResource, rolesFor)
+	}
+	maxAge := w.window
+	if d.force {
+		maxAge = 0
+	}
+	now := w.now()
+	w.sweep(now)
+	owned := map[string]*state.Task[string]{}
+	shared := map[string]*state.Task[string]{}
+	for id, tags := range perResource {
+		task, owner := w.results.Start(id, resourceVersion(tags, rolesFor(id)), now, maxAge)
+		if owner {
+			owned[id] = task
+		} else {
+			shared[id] = task
+		}
+	}
+
+	mine := make(map[string]map[string]string, len(owned))
+	for id := range owned {
+		mine[id] = perResource[id]
+	}
+	err := t.applyPerResource(ctx, d.Region, mine, rolesFor)
+	for id, task := range owned {
+		w.results.Finish(id, task, err, w.now())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ids := slices.Sorted(maps.Keys(shared))
+	for _, id := range ids {
+		if err := shared[id].Wait(ctx); err != nil {
+			return nil, fmt.Errorf("%s, written by another reconcile: %w", id, err)
+		}
+		t.metrics.deduplicated.WithLabelValues(resourceKind(id)).Inc()
+	}
+	return ids, nil
+}
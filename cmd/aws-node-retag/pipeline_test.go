@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// recreatedNode is a node whose instance got the volume of taintedNode's
+// instance reattached, as instanceEC2 reports vol-root for every instance.
+func recreatedNode() *corev1.Node {
+	node := taintedNode(nil)
+	node.Name = "n2"
+	node.Spec.ProviderID = "aws:///us-east-1a/i-0fedcba9876543210"
+	return node
+}
+
+func newPipelineTagger(k8s *fake.Clientset, api ec2API, now *time.Time) *Tagger {
+	tagger := newStartupTagger(k8s, api)
+	tagger.recorder = record.NewFakeRecorder(10)
+	tagger.writes = newTagWrites(10 * time.Minute)
+	tagger.writes.now = func() time.Time { return *now }
+	return tagger
+}
+
+func TestApplyDeduplicatedSharedVolume(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	k8s := fake.NewSimpleClientset(taintedNode(nil), recreatedNode())
+	api := &instanceEC2{}
+	tagger := newPipelineTagger(k8s, api, &now)
+	ctx := context.Background()
+
+	tagger.tagNode(ctx, taintedNode(nil), false)
+	tagger.tagNode(ctx, recreatedNode(), false)
+	if len(api.createTags) != 2 {
+		t.Fatalf("CreateTags calls = %d, want 2", len(api.createTags))
+	}
+	if got := api.createTags[1].Resources; !reflect.DeepEqual(got, []string{"i-0fedcba9876543210"}) {
+		t.Errorf("second reconcile wrote %v, want its instance alone", got)
+	}
+	if got := testutil.ToFloat64(tagger.metrics.deduplicated.WithLabelValues("volume")); got != 1 {
+		t.Errorf("writes_deduplicated_total{resource=volume} = %v, want 1", got)
+	}
+	node, err := k8s.CoreV1().Nodes().Get(ctx, "n2", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := parseNodeStatus(node.Annotations, tagger.statusKey())
+	if status == nil || !reflect.DeepEqual(status.Resources, []string{"i-0fedcba9876543210", "vol-root"}) || !reflect.DeepEqual(status.Deduplicated, []string{"vol-root"}) {
+		t.Errorf("status = %+v, want both resources with vol-root deduplicated", status)
+	}
+
+	// A forced re-tag writes the volume again.
+	tagger.tagNode(ctx, recreatedNode(), true)
+	if got := api.createTags[len(api.createTags)-1].Resources; len(got) != 2 {
+		t.Errorf("forced reconcile wrote %v, want the instance and the volume", got)
+	}
+
+	// Past the window the volume is written again too.
+	now = now.Add(11 * time.Minute)
+	calls := len(api.createTags)
+	tagger.tagNode(ctx, taintedNode(nil), true)
+	tagger.tagNode(ctx, recreatedNode(), false)
+	if len(api.createTags) != calls+2 {
+		t.Fatalf("CreateTags calls = %d, want %d", len(api.createTags), calls+2)
+	}
+}
+
+func TestApplyDeduplicatedNewTags(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	api := &instanceEC2{}
+	tagger := newPipelineTagger(fake.NewSimpleClientset(taintedNode(nil), recreatedNode()), api, &now)
+	ctx := context.Background()
+
+	tagger.tagNode(ctx, taintedNode(nil), false)
+	tagger.snapshot.Store(&tagSnapshot{tags: map[string]string{"Env": "staging"}})
+	tagger.tagNode(ctx, recreatedNode(), false)
+	if got := api.createTags[len(api.createTags)-1].Resources; len(got) != 2 {
+		t.Errorf("reconcile with other tags wrote %v, want the instance and the volume", got)
+	}
+}
+
+func TestApplyDeduplicatedBlocked(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	api := &instanceEC2{}
+	tagger := newPipelineTagger(fake.NewSimpleClientset(), api, &now)
+	tagger.dryRun = true
+	d := &nodeDecision{Region: "us-east-1"}
+	perResource := map[string]map[string]string{"vol-root": {"Env": "prod"}}
+	noRoles := func(string) map[string]string { return nil }
+
+	for range 2 {
+		shared, err := tagger.applyDeduplicated(context.Background(), d, perResource, noRoles)
+		if err != nil || len(shared) != 0 {
+			t.Fatalf("applyDeduplicated = %v, %v; want every resource handled in a dry run", shared, err)
+		}
+	}
+	if n := tagger.writes.results.Len(); n != 0 {
+		t.Errorf("%d writes recorded in a dry run, want none", n)
+	}
+}
+
+func TestTagWritesForgotten(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	k8s := fake.NewSimpleClientset(taintedNode(nil), recreatedNode())
+	api := &instanceEC2{}
+	tagger := newPipelineTagger(k8s, api, &now)
+	ctx := context.Background()
+
+	tagger.tagNode(ctx, taintedNode(nil), false)
+	if n := tagger.writes.results.Len(); n != 2 {
+		t.Fatalf("%d writes recorded, want the instance and its volume", n)
+	}
+	node, err := k8s.CoreV1().Nodes().Get(ctx, "n1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagger.nodeDeleteFunc(ctx, newWorkPool(1, func(fn func()) { fn() }), nil, false)(node)
+	if n := tagger.writes.results.Len(); n != 0 {
+		t.Errorf("%d writes kept after the node was deleted, want none", n)
+	}
+
+	// Writes older than the window are swept by a later reconcile.
+	tagger.tagNode(ctx, taintedNode(nil), true)
+	now = now.Add(11 * time.Minute)
+	tagger.tagNode(ctx, recreatedNode(), true)
+	if n := tagger.writes.results.Len(); n != 2 {
+		t.Errorf("%d writes kept, want only those of n2", n)
+	}
+
+	tagger.pvEventHandler(ctx, newWorkPool(1, func(fn func()) { fn() })).OnDelete(&corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{
+		PersistentVolumeSource: corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: "vol-root"}},
+	}})
+	if n := tagger.writes.results.Len(); n != 1 {
+		t.Errorf("%d writes kept after the PV of vol-root was deleted, want the instance's", n)
+	}
+}
+
+func TestResourceVersion(t *testing.T) {
+	tags := map[string]string{"Team": "web", "Env": "prod"}
+	if resourceVersion(tags, nil) != resourceVersion(tags, map[string]string{"Other": "arn:aws:iam::111122223333:role/a"}) {
+		t.Error("roles of keys not written changed the version")
+	}
+	if resourceVersion(tags, nil) == resourceVersion(tags, map[string]string{"Team": "arn:aws:iam::111122223333:role/a"}) {
+		t.Error("writing a key with a role did not change the version")
+	}
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// tagPolicyGVR identifies the cluster-scoped TagPolicy custom resource
+// (helm/aws-node-retag/crds/tagpolicies.yaml).
+var tagPolicyGVR = schema.GroupVersionResource{Group: "aws-node-retag.io", Version: "v1alpha1", Resource: "tagpolicies"}
+
+// Resource types a TagPolicy can target; an empty list targets all of them.
+const (
+	resourceInstance         = "instance"
+	resourceVolume           = "volume" // EBS volumes attached to the node's instance
+	resourcePersistentVolume = "persistentVolume"
+)
+
+const (
+	// policyStatusInterval is how often changed TagPolicy statuses are written.
+	policyStatusInterval = 30 * time.Second
+	// maxPolicyErrors bounds the number of entries in status.errors.
+	maxPolicyErrors = 10
+)
+
+// tagPolicy is the TagPolicy custom resource.
+type tagPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   tagPolicySpec   `json:"spec"`
+	Status tagPolicyStatus `json:"status,omitempty"`
+}
+
+type tagPolicySpec struct {
+	// NodeSelector selects the nodes (and, for persistentVolume, the PVs) the
+	// policy applies to by label. Empty selects everything.
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+	// Tags are the AWS tags to apply.
+	Tags map[string]string `json:"tags"`
+	// ResourceTypes limits the policy to instance, volume and/or persistentVolume.
+	ResourceTypes []string `json:"resourceTypes,omitempty"`
+	// DryRun logs the policy's tags without writing them.
+	DryRun bool `json:"dryRun,omitempty"`
+	// Schedule limits the policy to time windows (see schedule.go).
+	Schedule *tagScheduleSpec `json:"schedule,omitempty"`
+	// RoleARN is an IAM role assumed to write and remove the policy's tags,
+	// so IAM rather than the controller limits what the policy can tag
+	// (see policyroles.go). Empty uses the controller's credentials.
+	RoleARN string `json:"roleARN,omitempty"`
+	// TTL, e.g. "72h", expires the policy that long after the controller
+	// first saw its current generation; its tags are then removed as when a
+	// schedule window closes (see ttl.go).
+	TTL string `json:"ttl,omitempty"`
+	// Priority decides which policy's value is written when policies
+	// matching the same resource set a key to different values: the highest
+	// wins under POLICY_CONFLICT_RESOLUTION=priority (see conflicts.go).
+	Priority int32 `json:"priority,omitempty"`
+}
+
+type tagPolicyStatus struct {
+	ObservedGeneration int64        `json:"observedGeneration,omitempty"`
+	NodesMatched       int          `json:"nodesMatched"`
+	LastReconcileTime  *metav1.Time `json:"lastReconcileTime,omitempty"`
+	// Active reports whether a scheduled policy's window is open and a TTL
+	// policy has not expired; it is omitted for other policies.
+	Active *bool `json:"active,omitempty"`
+	// ExpiresAt is when a policy with a TTL expires.
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+	// Errors holds the latest error per object, or the validation error of an
+	// invalid policy. It is never omitted so a merge patch clears old errors.
+	Errors []string `json:"errors"`
+	// Conditions holds the Conflicted condition while the policy disagrees
+	// with another on a key; never omitted, like Errors.
+	Conditions []metav1.Condition `json:"conditions"`
+}
+
+// compiledPolicy is a validated TagPolicy ready for matching.
+type compiledPolicy struct {
+	name       string
+	generation int64
+	selector   labels.Selector
+	tags       map[string]string
+	resources  map[string]bool
+	dryRun     bool
+	// schedule is nil for policies that always apply.
+	schedule *policySchedule
+	roleARN  string
+	// ttl is zero for policies that do not expire.
+	ttl time.Duration
+	// priority and created order the policy in a conflict, uid refers to it
+	// in Events.
+	priority int32
+	created  time.Time
+	uid      types.UID
+}
+
+// compilePolicy validates the policy spec and parses its selector.
+func compilePolicy(p *tagPolicy) (*compiledPolicy, error) {
+	if len(p.Spec.Tags) == 0 {
+		return nil, fmt.Errorf("spec.tags must contain at least one key-value pair")
+	}
+	if err := awstags.Validate(p.Spec.Tags); err != nil {
+		return nil, fmt.Errorf("spec.tags: %w", err)
+	}
+	selector := labels.Everything()
+	if p.Spec.NodeSelector != nil {
+		var err error
+		if selector, err = metav1.LabelSelectorAsSelector(p.Spec.NodeSelector); err != nil {
+			return nil, fmt.Errorf("spec.nodeSelector: %w", err)
+		}
+	}
+	resources := map[string]bool{}
+	for _, r := range p.Spec.ResourceTypes {
+		switch r {
+		case resourceInstance, resourceVolume, resourcePersistentVolume:
+			resources[r] = true
+		default:
+			return nil, fmt.Errorf("spec.resourceTypes: unknown resource type %q (want %s, %s or %s)", r, resourceInstance, resourceVolume, resourcePersistentVolume)
+		}
+	}
+	if len(resources) == 0 {
+		resources = map[string]bool{resourceInstance: true, resourceVolume: true, resourcePersistentVolume: true}
+	}
+	if p.Spec.RoleARN != "" {
+		if err := validateRoleARN(p.Spec.RoleARN); err != nil {
+			return nil, fmt.Errorf("spec.roleARN: %w", err)
+		}
+	}
+	var schedule *policySchedule
+	if p.Spec.Schedule != nil {
+		var err error
+		if schedule, err = compileSchedule(p.Spec.Schedule); err != nil {
+			return nil, fmt.Errorf("spec.schedule: %w", err)
+		}
+	}
+	var ttl time.Duration
+	if p.Spec.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(p.Spec.TTL); err != nil {
+			return nil, fmt.Errorf("spec.ttl: %w", err)
+		}
+		if ttl <= 0 {
+			return nil, fmt.Errorf("spec.ttl must be positive, got %s", ttl)
+		}
+	}
+	return &compiledPolicy{
+		name:       p.Name,
+		generation: p.Generation,
+		selector:   selector,
+		tags:       p.Spec.Tags,
+		resources:  resources,
+		dryRun:     p.Spec.DryRun,
+		schedule:   schedule,
+		roleARN:    p.Spec.RoleARN,
+		ttl:        ttl,
+		priority:   p.Spec.Priority,
+		created:    p.CreationTimestamp.Time,
+		uid:        p.UID,
+	}, nil
+}
+
+// resourceTypes returns the targeted resource types in a stable order.
+func (p *compiledPolicy) resourceTypes() []string {
+	var out []string
+	for _, r := range []string{resourceInstance, resourceVolume, resourcePersistentVolume} {
+		if p.resources[r] {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// policyProgress is what the controller observed for one policy since start.
+type policyProgress struct {
+	lastReconcile time.Time
+	// errors maps an object name to its latest error.
+	errors map[string]string
+	// written is the status last written to the API, nil before the first write.
+	written *tagPolicyStatus
+}
+
+// policyStore holds the TagPolicies known to the controller and the progress
+// reported in their status. Every change is published to the tagger as a new
+// snapshot (see snapshot.go); the store itself is not read while tagging.
+type policyStore struct {
+	now func() time.Time
+	// publish receives the valid policies whose schedule is active and whose
+	// TTL has not expired, in name order, after every change.
+	publish func([]*compiledPolicy)
+	// onClose, if set, is called for a published policy whose schedule window
+	// closed or whose TTL expired, with the policy as it was published.
+	onClose func(*compiledPolicy)
+	// saveTTL, if set, persists the changed TTL starts (nil for a removed
+	// one), see ttl.go.
+	saveTTL func(map[string]*ttlStart)
+
+	mu       sync.RWMutex
+	policies map[string]*compiledPolicy
+	// invalid maps the name of a policy that failed validation to the error.
+	invalid  map[string]string
+	progress map[string]*policyProgress
+	// open holds the published policies by name.
+	open map[string]*compiledPolicy
+	// ttlStarts holds the start of the TTL of each policy with one, and
+	// ttlDirty the names of those changed since the last flush.
+	ttlStarts map[string]ttlStart
+	ttlDirty  map[string]bool
+	ttlSaveMu sync.Mutex
+	// conflicts holds the policy conflicts found in the latest reconcile of
+	// each object; conflictObjects counts the objects of each conflict by
+	// ID and conflictSince is when it was first found (see conflicts.go).
+	conflicts       map[string][]policyConflict
+	conflictObjects map[string]int
+	conflictSince   map[string]time.Time
+}
+
+func newPolicyStore(publish func([]*compiledPolicy)) *policyStore {
+	return &policyStore{
+		now:      time.Now,
+		publish:  publish,
+		policies: map[string]*compiledPolicy{},
+		invalid:  map[string]string{},
+		progress: map[string]*policyProgress{},
+		open:     map[string]*compiledPolicy{},
+
+		ttlStarts: map[string]ttlStart{},
+		ttlDirty:  map[string]bool{},
+
+		conflicts:       map[string][]policyConflict{},
+		conflictObjects: map[string]int{},
+		conflictSince:   map[string]time.Time{},
+	}
+}
+
+// set adds or replaces a policy. It returns the compiled policy, or nil and
+// the validation error when the policy is invalid and therefore ignored.
+// A policy whose schedule window is closed by the change is handed to
+// onClose; a policy that became active is not reported, the caller re-tags it.
+func (s *policyStore) set(p *tagPolicy) (*compiledPolicy, error) {
+	cp, err := compilePolicy(p)
+	s.mu.Lock()
+	if s.progress[p.Name] == nil {
+		s.progress[p.Name] = &policyProgress{errors: map[string]string{}}
+	}
+	if old := s.policies[p.Name]; old == nil || err != nil || old.generation != cp.generation {
+		s.forgetConflicts(p.Name)
+	}
+	if err != nil {
+		delete(s.policies, p.Name)
+		s.invalid[p.Name] = err.Error()
+	} else {
+		delete(s.invalid, p.Name)
+		s.policies[p.Name] = cp
+		s.trackTTL(cp)
+	}
+	_, closed := s.refresh()
+	s.mu.Unlock()
+	s.flushTTLs()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range closed {
+		if s.onClose != nil {
+			s.onClose(c)
+		}
+	}
+	return cp, nil
+}
+
+// remove forgets a deleted policy. Tags it applied are left in place.
+func (s *policyStore) remove(name string) {
+	s.mu.Lock()
+	delete(s.policies, name)
+	delete(s.invalid, name)
+	delete(s.progress, name)
+	delete(s.open, name)
+	s.forgetConflicts(name)
+	if _, ok := s.ttlStarts[name]; ok {
+		delete(s.ttlStarts, name)
+		s.ttlDirty[name] = true
+	}
+	s.refresh()
+	s.mu.Unlock()
+	s.flushTTLs()
+}
+
+// refresh publishes the policies active now and returns those whose schedule
+// window opened or closed, or whose TTL expired, since the last publish.
+// Policies that were deleted or became invalid are not reported as closed.
+// The caller holds s.mu.
+func (s *policyStore) refresh() (opened, closed []*compiledPolicy) {
+	now := s.now()
+	active := make([]*compiledPolicy, 0, len(s.policies))
+	open := make(map[string]*compiledPolicy, len(s.policies))
+	for _, p := range s.sorted() {
+		if (p.schedule != nil && !p.schedule.active(now)) || s.expired(p, now) {
+			continue
+		}
+		active = append(active, p)
+		open[p.name] = p
+		if s.open[p.name] == nil {
+			opened = append(opened, p)
+		}
+	}
+	for name, p := range s.open {
+		if cur := s.policies[name]; open[name] == nil && cur != nil && (cur.schedule != nil || cur.ttl > 0) {
+			closed = append(closed, p)
+		}
+	}
+	sort.Slice(closed, func(i, j int) bool { return closed[i].name < closed[j].name })
+	s.open = open
+	s.publish(active)
+	return opened, closed
+}
+
+// sorted returns the valid policies ordered by name. The caller holds s.mu.
+func (s *policyStore) sorted() []*compiledPolicy {
+	out := make([]*compiledPolicy, 0, len(s.policies))
+	for _, p := range s.policies {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
+
+// resetProgress forgets the per-object errors and conflicts recorded so far;
+// a fresh reconcile repopulates them.
+func (s *policyStore) resetProgress() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pr := range s.progress {
+		pr.errors = map[string]string{}
+	}
+	clear(s.conflicts)
+	clear(s.conflictObjects)
+	clear(s.conflictSince)
+}
+
+// record notes that an object matched by the named policies was processed,
+// with err the outcome.
+func (s *policyStore) record(policies []string, object string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now().UTC().Truncate(time.Second)
+	for _, name := range policies {
+		pr := s.progress[name]
+		if pr == nil {
+			continue
+		}
+		pr.lastReconcile = now
+		if err != nil {
+			pr.errors[object] = fmt.Sprintf("%s: %v", object, err)
+		} else {
+			delete(pr.errors, object)
+		}
+	}
+}
+
+// status computes the current status of the named policy; nodesMatched counts
+// the nodes its selector currently selects.
+func (s *policyStore) status(name string, generation int64, nodes corelisters.NodeLister) tagPolicyStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	st := tagPolicyStatus{ObservedGeneration: generation, Errors: []string{}, Conditions: []metav1.Condition{}}
+	if msg, ok := s.invalid[name]; ok {
+		st.Errors = append(st.Errors, "invalid policy: "+msg)
+		return st
+	}
+	if p := s.policies[name]; p != nil {
+		if matched, err := nodes.List(p.selector); err == nil {
+			st.NodesMatched = len(matched)
+		}
+		if p.schedule != nil || p.ttl > 0 {
+			active := s.open[name] != nil
+			st.Active = &active
+		}
+		if start, ok := s.ttlStarts[name]; ok && p.ttl > 0 && start.Generation == p.generation {
+			st.ExpiresAt = &metav1.Time{Time: start.expiresAt(p.ttl)}
+		}
+		if c := s.conflictCondition(name, generation); c != nil {
+			st.Conditions = append(st.Conditions, *c)
+		}
+	}
+	if pr := s.progress[name]; pr != nil {
+		if !pr.lastReconcile.IsZero() {
+			st.LastReconcileTime = &metav1.Time{Time: pr.lastReconcile}
+		}
+		for _, e := range pr.errors {
+			st.Errors = append(st.Errors, e)
+		}
+	}
+	sort.Strings(st.Errors)
+	if len(st.Errors) > maxPolicyErrors {
+		st.Errors = st.Errors[:maxPolicyErrors]
+	}
+	return st
+}
+
+// runStatusUpdates writes the status of every policy whose status changed,
+// every policyStatusInterval until ctx is done.
+func (s *policyStore) runStatusUpdates(ctx context.Context, dyn dynamic.Interface, policies cache.Store, nodes corelisters.NodeLister, logger *slog.Logger) {
+	ticker := time.NewTicker(policyStatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, obj := range policies.List() {
+			p, err := policyFromObject(obj)
+			if err != nil {
+				continue
+			}
+			st := s.status(p.Name, p.Generation, nodes)
+			if !s.statusChanged(p.Name, st) {
+				continue
+			}
+			if err := patchPolicyStatus(ctx, dyn, p.Name, st); err != nil {
+				logger.Warn("failed to update TagPolicy status", "policy", p.Name, "error", err)
+				continue
+			}
+			s.markWritten(p.Name, st)
+		}
+	}
+}
+
+func (s *policyStore) statusChanged(name string, st tagPolicyStatus) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pr := s.progress[name]
+	return pr == nil || pr.written == nil || !reflect.DeepEqual(*pr.written, st)
+}
+
+func (s *policyStore) markWritten(name string, st tagPolicyStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pr := s.progress[name]; pr != nil {
+		pr.written = &st
+	}
+}
+
+func patchPolicyStatus(ctx context.Context, dyn dynamic.Interface, name string, st tagPolicyStatus) error {
+	patch, err := json.Marshal(map[string]any{"status": st})
+	if err != nil {
+		return err
+	}
+	_, err = dyn.Resource(tagPolicyGVR).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{}, "status")
+	return err
+}
+
+// policyFromObject converts an informer object into a tagPolicy.
+func policyFromObject(obj interface{}) (*tagPolicy, error) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object type %T", obj)
+	}
+	var p tagPolicy
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &p); err != nil {
+		return nil, fmt.Errorf("decode TagPolicy %s: %w", u.GetName(), err)
+	}
+	return &p, nil
+}
+
+// handler keeps the store in sync with the TagPolicy informer. onChange is
+// called for policies added or whose spec changed after the initial list, so
+// already-tagged objects pick up the new tags.
+func (s *policyStore) handler(onChange func(*compiledPolicy), logger *slog.Logger) cache.ResourceEventHandler {
+	apply := func(obj interface{}, notify bool) {
+		p, err := policyFromObject(obj)
+		if err != nil {
+			logger.Error("ignoring TagPolicy", "error", err)
+			return
+		}
+		cp, err := s.set(p)
+		if err != nil {
+			logger.Error("invalid TagPolicy, ignoring it", "policy", p.Name, "error", err)
+			return
+		}
+		logger.Info("loaded TagPolicy", "policy", cp.name, "selector", cp.selector.String(),
+			"resourceTypes", strings.Join(cp.resourceTypes(), ","), "tags", cp.tags, "dryRun", cp.dryRun, "scheduled", cp.schedule != nil, "ttl", cp.ttl)
+		if notify {
+			onChange(cp)
+		}
+	}
+	return cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			apply(obj, !isInInitialList)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldU, ok1 := oldObj.(*unstructured.Unstructured)
+			newU, ok2 := newObj.(*unstructured.Unstructured)
+			if !ok1 || !ok2 || oldU.GetGeneration() == newU.GetGeneration() {
+				// Status-only update or resync.
+				return
+			}
+			apply(newObj, true)
+		},
+		DeleteFunc: func(obj interface{}) {
+			p, err := policyFromObject(obj)
+			if err != nil {
+				return
+			}
+			s.remove(p.Name)
+			logger.Info("removed TagPolicy; tags already applied are left in place", "policy", p.Name)
+		},
+	}
+}
+
+// retagPolicy re-tags every cached node and bound PV the policy selects,
+// including those already carrying the tagged annotation.
+func (t *Tagger) retagPolicy(ctx context.Context, p *compiledPolicy, nodes corelisters.NodeLister, pvs corelisters.PersistentVolumeLister) {
+	t.logger.Info("TagPolicy changed, re-tagging selected objects", "policy", p.name)
+	if p.resources[resourceInstance] || p.resources[resourceVolume] {
+		nodeList, err := nodes.List(p.selector)
+		if err != nil {
+			t.logger.Error("failed to list nodes from cache", "error", err)
+			return
+		}
+		for _, node := range nodeList {
+			t.tagNode(ctx, node, true)
+		}
+	}
+	if p.resources[resourcePersistentVolume] {
+		pvList, err := pvs.List(p.selector)
+		if err != nil {
+			t.logger.Error("failed to list persistent volumes from cache", "error", err)
+			return
+		}
+		for _, pv := range pvList {
+			if pv.Status.Phase == corev1.VolumeBound {
+				t.tagPV(ctx, pv, true)
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newTestPolicy(name string, spec tagPolicySpec) *tagPolicy {
+	return &tagPolicy{ObjectMeta: metav1.ObjectMeta{Name: name, Generation: 1}, Spec: spec}
+}
+
+func TestCompilePolicy(t *testing.T) {
+	cases := []struct {
+		name    string
+		spec    tagPolicySpec
+		wantErr bool
+	}{
+		{"defaults", tagPolicySpec{Tags: map[string]string{"a": "b"}}, false},
+		{"no tags", tagPolicySpec{}, true},
+		{"reserved tag key", tagPolicySpec{Tags: map[string]string{"aws:team": "b"}}, true},
+		{"bad resource type", tagPolicySpec{Tags: map[string]string{"a": "b"}, ResourceTypes: []string{"snapshot"}}, true},
+		{"role ARN", tagPolicySpec{Tags: map[string]string{"a": "b"}, RoleARN: "arn:aws:iam::123456789012:role/team"}, false},
+		{"bad role ARN", tagPolicySpec{Tags: map[string]string{"a": "b"}, RoleARN: "team"}, true},
+		{"ttl", tagPolicySpec{Tags: map[string]string{"a": "b"}, TTL: "72h"}, false},
+		{"bad ttl", tagPolicySpec{Tags: map[string]string{"a": "b"}, TTL: "3 days"}, true},
+		{"negative ttl", tagPolicySpec{Tags: map[string]string{"a": "b"}, TTL: "-1h"}, true},
+		{"bad selector", tagPolicySpec{
+			Tags: map[string]string{"a": "b"},
+			NodeSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "k", Operator: "Bogus"},
+			}},
+		}, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := compilePolicy(newTestPolicy("p", tc.spec))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err == nil && len(p.resourceTypes()) != 3 {
+				t.Errorf("resourceTypes = %v, want all three by default", p.resourceTypes())
+			}
+		})
+	}
+}
+
+func TestResourceTags(t *testing.T) {
+	tagger := &Tagger{}
+	store := newPolicyStore(tagger.publishPolicies)
+	gpu := &metav1.LabelSelector{MatchLabels: map[string]string{"gpu": "true"}}
+	for _, p := range []*tagPolicy{
+		newTestPolicy("a-all", tagPolicySpec{Tags: map[string]string{"Team": "platform", "Env": "prod"}}),
+		newTestPolicy("b-gpu", tagPolicySpec{NodeSelector: gpu, Tags: map[string]string{"Team": "ml"}, ResourceTypes: []string{resourceInstance}}),
+		newTestPolicy("c-dry", tagPolicySpec{Tags: map[string]string{"Cost": "x"}, DryRun: true}),
+	} {
+		if _, err := store.set(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap := tagger.current()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	base := map[string]string{"Env": "dev", "Owner": "ops"}
+
+	tags, names := snap.resourceTags(base, resourceInstance, map[string]string{"gpu": "true"}, log)
+	want := map[string]string{"Env": "prod", "Owner": "ops", "Team": "ml"}
+	if len(tags) != len(want) {
+		t.Fatalf("instance tags = %v, want %v", tags, want)
+	}
+	for k, v := range want {
+		if tags[k] != v {
+			t.Errorf("instance tags[%s] = %q, want %q", k, tags[k], v)
+		}
+	}
+	if len(names) != 3 || names[0] != "a-all" || names[1] != "b-gpu" || names[2] != "c-dry" {
+		t.Errorf("matched policies = %v", names)
+	}
+
+	tags, _ = snap.resourceTags(base, resourceVolume, map[string]string{"gpu": "true"}, log)
+	if tags["Team"] != "platform" {
+		t.Errorf("volume Team = %q, want platform (b-gpu targets instances only)", tags["Team"])
+	}
+	if base["Env"] != "dev" {
+		t.Error("base tags were modified")
+	}
+}
+
+func TestPolicyStatus(t *testing.T) {
+	nodes := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for name, lbls := range map[string]map[string]string{"n1": {"gpu": "true"}, "n2": {"gpu": "true"}, "n3": nil} {
+		_ = nodes.Add(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: lbls}})
+	}
+	lister := corelisters.NewNodeLister(nodes)
+
+	store := newPolicyStore(func([]*compiledPolicy) {})
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	gpu := &metav1.LabelSelector{MatchLabels: map[string]string{"gpu": "true"}}
+	if _, err := store.set(newTestPolicy("gpu", tagPolicySpec{NodeSelector: gpu, Tags: map[string]string{"a": "b"}})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.set(newTestPolicy("broken", tagPolicySpec{})); err == nil {
+		t.Fatal("expected validation error")
+	}
+
+	store.record([]string{"gpu"}, "node/n1", context.DeadlineExceeded)
+	st := store.status("gpu", 1, lister)
+	if st.NodesMatched != 2 || len(st.Errors) != 1 || !st.LastReconcileTime.Time.Equal(now) {
+		t.Errorf("status = %+v", st)
+	}
+	store.record([]string{"gpu"}, "node/n1", nil)
+	if st := store.status("gpu", 1, lister); len(st.Errors) != 0 {
+		t.Errorf("errors not cleared after success: %v", st.Errors)
+	}
+	if st := store.status("broken", 1, lister); len(st.Errors) != 1 || st.NodesMatched != 0 {
+		t.Errorf("invalid policy status = %+v", st)
+	}
+
+	dyn := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{tagPolicyGVR: "TagPolicyList"},
+		&unstructured.Unstructured{Object: map[string]any{
+			"apiVersion": "aws-node-retag.io/v1alpha1",
+			"kind":       "TagPolicy",
+			"metadata":   map[string]any{"name": "gpu"},
+		}})
+	if err := patchPolicyStatus(context.Background(), dyn, "gpu", st); err != nil {
+		t.Fatalf("patchPolicyStatus: %v", err)
+	}
+	got, err := dyn.Resource(tagPolicyGVR).Get(context.Background(), "gpu", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _, _ := unstructured.NestedInt64(got.Object, "status", "nodesMatched"); n != 2 {
+		t.Errorf("patched status.nodesMatched = %d, want 2", n)
+	}
+}
+
+func TestPolicyFromObject(t *testing.T) {
+	u := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "aws-node-retag.io/v1alpha1",
+		"kind":       "TagPolicy",
+		"metadata":   map[string]any{"name": "p", "generation": int64(3)},
+		"spec": map[string]any{
+			"nodeSelector":  map[string]any{"matchLabels": map[string]any{"pool": "batch"}},
+			"tags":          map[string]any{"Team": "batch"},
+			"resourceTypes": []any{"volume"},
+			"dryRun":        true,
+		},
+	}}
+	for _, obj := range []interface{}{u, cache.DeletedFinalStateUnknown{Key: "p", Obj: u}} {
+		p, err := policyFromObject(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Name != "p" || p.Generation != 3 || p.Spec.Tags["Team"] != "batch" || !p.Spec.DryRun ||
+			p.Spec.NodeSelector.MatchLabels["pool"] != "batch" || p.Spec.ResourceTypes[0] != resourceVolume {
+			t.Errorf("decoded policy = %+v", p)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+)
+
+// roleSessionName names the sessions of the roles assumed for TagPolicies,
+// as they appear in CloudTrail.
+const roleSessionName = "aws-node-retag"
+
+// roleARNPattern matches IAM role ARNs in every partition.
+var roleARNPattern = regexp.MustCompile(`^arn:aws(-cn|-us-gov)?:iam::\d{12}:role/[\w+=,.@/-]{1,512}$`)
+
+func validateRoleARN(arn string) error {
+	if !roleARNPattern.MatchString(arn) {
+		return fmt.Errorf("%q is not an IAM role ARN (arn:<partition>:iam::<account>:role/<name>)", arn)
+	}
+	return nil
+}
+
+// keyRoles returns the role writing each key whose value comes from a
+// TagPolicy with a roleARN, for resourceType on an object with objLabels.
+// A key belongs to the policy resourceTags takes its value from; keys of
+// other policies and of the static tags are left out and written with the
+// controller's own credentials. Nil when no policy with a roleARN applies.
+func (s *tagSnapshot) keyRoles(resourceType string, objLabels map[string]string) map[string]string {
+	matched := s.matching(resourceType, objLabels)
+	if !slices.ContainsFunc(matched, func(p *compiledPolicy) bool { return p.roleARN != "" && !p.dryRun }) {
+		return nil
+	}
+	owners, _ := s.resolve(matched)
+	var roles map[string]string
+	for k, p := range owners {
+		if p.roleARN != "" {
+			if roles == nil {
+				roles = map[string]string{}
+			}
+			roles[k] = p.roleARN
+		}
+	}
+	return roles
+}
+
+// splitByRole splits tags by the role in roles writing each key; keys
+// without a role go to "", the controller's own credentials.
+func splitByRole[V any](tags map[string]V, roles map[string]string) map[string]map[string]V {
+	out := map[string]map[string]V{}
+	for k, v := range tags {
+		role := roles[k]
+		if out[role] == nil {
+			out[role] = map[string]V{}
+		}
+		out[role][k] = v
+	}
+	return out
+}
+
+// sortedRoles returns the roles of a split in order, the controller's own
+// credentials ("") first.
+func sortedRoles[V any](split map[string]V) []string {
+	roles := make([]string, 0, len(split))
+	for role := range split {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// applyPerResource applies the tags of each resource, writing the keys of
+// TagPolicies with a roleARN with that role's credentials (rolesFor returns
+// the keyRoles of a resource), so IAM decides what the policy may tag.
+// Resources sharing the same tags are written in one call per role.
+func (t *Tagger) applyPerResource(ctx context.Context, region string, perResource map[string]map[string]string, rolesFor func(id string) map[string]string) error {
+	byRole := map[string]map[string]map[string]string{}
+	for id, tags := range perResource {
+		for role, subset := range splitByRole(tags, rolesFor(id)) {
+			if byRole[role] == nil {
+				byRole[role] = map[string]map[string]string{}
+			}
+			byRole[role][id] = subset
+		}
+	}
+	for _, role := range sortedRoles(byRole) {
+		for _, g := range groupByTags(byRole[role]) {
+			if err := t.applyTagsAs(ctx, role, region, g.resourceIDs, g.tags); err != nil {
+				if role != "" {
+					return fmt.Errorf("as %s: %w", role, err)
+				}
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyTagsByRole is applyPerResource for resources sharing the same tags and
+// key roles.
+func (t *Tagger) applyTagsByRole(ctx context.Context, region string, resourceIDs []string, tags, roles map[string]string) error {
+	perResource := make(map[string]map[string]string, len(resourceIDs))
+	for _, id := range resourceIDs {
+		perResource[id] = tags
+	}
+	return t.applyPerResource(ctx, region, perResource, func(string) map[string]string { return roles })
+}
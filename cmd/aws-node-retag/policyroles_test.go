@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	mlRole   = "arn:aws:iam::123456789012:role/ml-tagger"
+	dataRole = "arn:aws:iam::123456789012:role/data-tagger"
+)
+
+func TestValidateRoleARN(t *testing.T) {
+	for _, arn := range []string{mlRole, "arn:aws-cn:iam::123456789012:role/path/to/role", "arn:aws-us-gov:iam::123456789012:role/a+b=c,d.e@f-g"} {
+		if err := validateRoleARN(arn); err != nil {
+			t.Errorf("validateRoleARN(%q) = %v", arn, err)
+		}
+	}
+	for _, arn := range []string{"", "ml-tagger", "arn:aws:iam::1234:role/x", "arn:aws:iam::123456789012:user/x", "arn:aws:iam::123456789012:role/"} {
+		if err := validateRoleARN(arn); err == nil {
+			t.Errorf("validateRoleARN(%q) = nil, want an error", arn)
+		}
+	}
+}
+
+func TestKeyRoles(t *testing.T) {
+	policy := func(name, role string, dryRun bool, tags map[string]string) *compiledPolicy {
+		return &compiledPolicy{
+			name:      name,
+			selector:  labels.Everything(),
+			tags:      tags,
+			resources: map[string]bool{resourceInstance: true},
+			dryRun:    dryRun,
+			roleARN:   role,
+		}
+	}
+
+	snap := &tagSnapshot{policies: []*compiledPolicy{
+		policy("a-ml", mlRole, false, map[string]string{"Team": "ml", "CostCenter": "42"}),
+		policy("b-data", dataRole, false, map[string]string{"Dataset": "images"}),
+		policy("c-plain", "", false, map[string]string{"CostCenter": "7"}),
+		policy("d-dry", dataRole, true, map[string]string{"Team": "data"}),
+	}}
+	want := map[string]string{"Team": mlRole, "Dataset": dataRole}
+	if got := snap.keyRoles(resourceInstance, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("keyRoles = %v, want %v", got, want)
+	}
+	if got := snap.keyRoles(resourceVolume, nil); got != nil {
+		t.Errorf("keyRoles for an unmatched resource type = %v, want nil", got)
+	}
+
+	plain := &tagSnapshot{policies: []*compiledPolicy{policy("a", "", false, map[string]string{"Team": "ml"})}}
+	if got := plain.keyRoles(resourceInstance, nil); got != nil {
+		t.Errorf("keyRoles without roles = %v, want nil", got)
+	}
+}
+
+func TestSplitByRole(t *testing.T) {
+	got := splitByRole(map[string]string{"Env": "prod", "Team": "ml", "Dataset": "images"}, map[string]string{"Team": mlRole, "Dataset": dataRole})
+	want := map[string]map[string]string{
+		"":       {"Env": "prod"},
+		mlRole:   {"Team": "ml"},
+		dataRole: {"Dataset": "images"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitByRole = %v, want %v", got, want)
+	}
+	if roles := sortedRoles(got); !reflect.DeepEqual(roles, []string{"", dataRole, mlRole}) {
+		t.Errorf("sortedRoles = %v", roles)
+	}
+}
+
+func TestApplyPerResourceAssumesRoles(t *testing.T) {
+	own := &taggingEC2{}
+	assumed := map[string]*taggingEC2{}
+	clients := fakeClients(own)
+	clients.newRoleClients = func(role string) *ec2Clients {
+		api := &taggingEC2{}
+		assumed[role] = api
+		return fakeClients(api)
+	}
+	tagger := &Tagger{
+		ec2:     clients,
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		metrics: newMetrics(""),
+	}
+
+	perResource := map[string]map[string]string{
+		"i-1":   {"Env": "prod", "Team": "ml"},
+		"vol-1": {"Env": "prod", "Team": "ml"},
+		"vol-2": {"Env": "prod", "Team": "ml"},
+	}
+	rolesFor := func(id string) map[string]string {
+		if id == "i-1" {
+			return map[string]string{"Team": mlRole}
+		}
+		return nil
+	}
+	if err := tagger.applyPerResource(context.Background(), "us-east-1", perResource, rolesFor); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(own.createTags) != 2 {
+		t.Fatalf("controller CreateTags calls = %d, want 2", len(own.createTags))
+	}
+	for _, in := range own.createTags {
+		if reflect.DeepEqual(in.Resources, []string{"i-1"}) && len(in.Tags) != 1 {
+			t.Errorf("controller wrote %d tags on the instance, want only Env", len(in.Tags))
+		}
+	}
+	ml := assumed[mlRole]
+	if ml == nil || len(ml.createTags) != 1 || !reflect.DeepEqual(ml.createTags[0].Resources, []string{"i-1"}) {
+		t.Fatalf("role CreateTags calls = %v, want one for [i-1]", ml)
+	}
+	if len(assumed) != 1 {
+		t.Errorf("assumed roles = %v, want only %s", assumed, mlRole)
+	}
+
+	// The role's clients are cached.
+	if err := tagger.applyTagsByRole(context.Background(), "us-east-1", []string{"vol-3"}, map[string]string{"Team": "ml"}, map[string]string{"Team": mlRole}); err != nil {
+		t.Fatal(err)
+	}
+	if assumed[mlRole] != ml || len(ml.createTags) != 2 {
+		t.Errorf("role clients were not reused: %d calls", len(ml.createTags))
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	smithy "github.com/aws/smithy-go"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// preflightInterval is how often a failed IAM preflight is run again when
+// FAIL_FAST is not set.
+const preflightInterval = time.Minute
+
+// preflightNodes bounds the nodes listed to find an instance in the home
+// region for the CreateTags check.
+const preflightNodes = 100
+
+// preflightTag is written, with DryRun, when the controller has no static
+// tags of its own, e.g. with only TagPolicies.
+const preflightTag = "aws-node-retag.io/preflight"
+
+// dryRunOperation is the error code of a DryRun call that would have been
+// allowed.
+const dryRunOperation = "DryRunOperation"
+
+// errPreflightPending keeps the controller unready until the first preflight
+// finished.
+var errPreflightPending = errors.New("not run yet")
+
+// preflightReport is the outcome of a successful IAM preflight.
+type preflightReport struct {
+	Account string
+	ARN     string
+	// Checked lists the EC2 actions confirmed with DryRun calls, Skipped
+	// those that could not be checked.
+	Checked []string
+	Skipped []string
+}
+
+// iamPreflight checks at startup that the controller's credentials resolve
+// and allow the calls every reconcile makes, so a misconfigured role, e.g. an
+// IRSA annotation naming the wrong role, shows up at once instead of as a
+// CreateTags failure per node hours later.
+type iamPreflight struct {
+	sts stsAPI
+	ec2 ec2API
+	k8s kubernetes.Interface
+	// region is the controller's home region, where the EC2 calls are made.
+	region string
+	// tags are written by the CreateTags check; writes is false in dry-run
+	// and read-only mode, which need no CreateTags.
+	tags   map[string]string
+	writes bool
+}
+
+// run performs sts:GetCallerIdentity, then ec2:DescribeInstances and, when
+// the controller writes tags, ec2:CreateTags with DryRun. CreateTags needs an
+// instance: that of a node in the home region, without which it is skipped.
+func (p *iamPreflight) run(ctx context.Context) (preflightReport, error) {
+	var report preflightReport
+	id, err := p.sts.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return report, fmt.Errorf("sts:GetCallerIdentity: %w", err)
+	}
+	report.Account, report.ARN = aws.ToString(id.Account), aws.ToString(id.Arn)
+
+	_, err = p.ec2.DescribeInstances(ctx, &ec2.DescribeInstancesInput{DryRun: aws.Bool(true), MaxResults: aws.Int32(5)})
+	if err := dryRunResult("ec2:DescribeInstances", err); err != nil {
+		return report, err
+	}
+	report.Checked = append(report.Checked, "ec2:DescribeInstances")
+
+	if !p.writes {
+		return report, nil
+	}
+	instanceID, err := p.instanceInRegion(ctx)
+	if err != nil {
+		return report, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	if instanceID == "" {
+		report.Skipped = append(report.Skipped, "ec2:CreateTags")
+		return report, nil
+	}
+	_, err = p.ec2.CreateTags(ctx, &ec2.CreateTagsInput{
+		DryRun:    aws.Bool(true),
+		Resources: []string{instanceID},
+		Tags:      preflightTags(p.tags),
+	})
+	if err := dryRunResult("ec2:CreateTags", err); err != nil {
+		return report, err
+	}
+	report.Checked = append(report.Checked, "ec2:CreateTags")
+	return report, nil
+}
+
+// instanceInRegion returns the instance of a node in the home region, "" if
+// none of the first nodes runs there.
+func (p *iamPreflight) instanceInRegion(ctx context.Context) (string, error) {
+	nodes, err := p.k8s.CoreV1().Nodes().List(ctx, metav1.ListOptions{Limit: preflightNodes})
+	if err != nil {
+		return "", err
+	}
+	for _, node := range nodes.Items {
+		info, err := parseProviderID(node.Spec.ProviderID)
+		if err != nil || info.Fargate || info.InstanceID == "" {
+			continue
+		}
+		if region, err := regionFromZone(info.Zone); err == nil && region == p.region {
+			return info.InstanceID, nil
+		}
+	}
+	return "", nil
+}
+
+// dryRunResult returns nil when err is the DryRunOperation answer of an
+// allowed call.
+func dryRunResult(action string, err error) error {
+	var apiErr smithy.APIError
+	if err == nil || errors.As(err, &apiErr) && apiErr.ErrorCode() == dryRunOperation {
+		return nil
+	}
+	if isPermissionDenied(err) {
+		return fmt.Errorf("%s is denied: %w", action, err)
+	}
+	return fmt.Errorf("%s: %w", action, err)
+}
+
+func preflightTags(tags map[string]string) []ec2types.Tag {
+	if len(tags) == 0 {
+		return []ec2types.Tag{{Key: aws.String(preflightTag), Value: aws.String("true")}}
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]ec2types.Tag, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, ec2types.Tag{Key: aws.String(k), Value: aws.String(tags[k])})
+	}
+	return out
+}
+
+// runPreflight runs the preflight until it succeeds, every preflightInterval
+// until ctx is done, keeping the controller unready meanwhile.
+func runPreflight(ctx context.Context, p *iamPreflight, h *health, logger *slog.Logger) {
+	ticker := time.NewTicker(preflightInterval)
+	defer ticker.Stop()
+	for {
+		report, err := p.run(ctx)
+		h.setPreflightError(err)
+		if err == nil {
+			logPreflight(report, logger)
+			return
+		}
+		logger.Error("IAM preflight failed, the controller stays unready until it passes", "error", err, "arn", report.ARN, "retryIn", preflightInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func logPreflight(report preflightReport, logger *slog.Logger) {
+	logger.Info("IAM preflight passed", "account", report.Account, "arn", report.ARN, "checked", report.Checked)
+	if len(report.Skipped) > 0 {
+		logger.Warn("IAM preflight could not check some actions: no node runs in the home region yet", "skipped", report.Skipped)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	smithy "github.com/aws/smithy-go"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// preflightAPIs answers the preflight's calls: DryRun calls fail with the
+// code set for their action, DryRunOperation by default.
+type preflightAPIs struct {
+	ec2API
+	identityErr error
+	denied      map[string]string
+	createTags  []*ec2.CreateTagsInput
+}
+
+func (f *preflightAPIs) GetCallerIdentity(context.Context, *sts.GetCallerIdentityInput, ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	if f.identityErr != nil {
+		return nil, f.identityErr
+	}
+	return &sts.GetCallerIdentityOutput{Account: aws.String("111122223333"), Arn: aws.String("arn:aws:sts::111122223333:assumed-role/retag/pod")}, nil
+}
+
+func (f *preflightAPIs) dryRun(action string) error {
+	code := dryRunOperation
+	if c, ok := f.denied[action]; ok {
+		code = c
+	}
+	return &smithy.GenericAPIError{Code: code}
+}
+
+func (f *preflightAPIs) DescribeInstances(_ context.Context, in *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	if !aws.ToBool(in.DryRun) {
+		return nil, errors.New("not a DryRun call")
+	}
+	return nil, f.dryRun("DescribeInstances")
+}
+
+func (f *preflightAPIs) CreateTags(_ context.Context, in *ec2.CreateTagsInput, _ ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	if !aws.ToBool(in.DryRun) {
+		return nil, errors.New("not a DryRun call")
+	}
+	f.createTags = append(f.createTags, in)
+	return nil, f.dryRun("CreateTags")
+}
+
+func preflightNode(name, providerID string) *corev1.Node {
+	return &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: corev1.NodeSpec{ProviderID: providerID}}
+}
+
+func TestIAMPreflight(t *testing.T) {
+	nodes := []*corev1.Node{
+		preflightNode("fargate", "aws:///eu-west-1a/abc/fargate-ip-10-0-0-1.ec2.internal"),
+		preflightNode("other-region", "aws:///us-east-1a/i-0aaaaaaaaaaaaaaaa"),
+		preflightNode("home", "aws:///eu-west-1b/i-0bbbbbbbbbbbbbbbb"),
+	}
+	newPreflight := func(api *preflightAPIs, writes bool, nodes ...*corev1.Node) *iamPreflight {
+		k8s := fake.NewSimpleClientset()
+		for _, n := range nodes {
+			if _, err := k8s.CoreV1().Nodes().Create(context.Background(), n, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &iamPreflight{sts: api, ec2: api, k8s: k8s, region: "eu-west-1", tags: map[string]string{"Team": "platform"}, writes: writes}
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		api := &preflightAPIs{}
+		report, err := newPreflight(api, true, nodes...).run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Account != "111122223333" || !strings.HasSuffix(report.ARN, "retag/pod") {
+			t.Errorf("identity = %q, %q", report.Account, report.ARN)
+		}
+		if want := []string{"ec2:DescribeInstances", "ec2:CreateTags"}; !reflect.DeepEqual(report.Checked, want) || len(report.Skipped) > 0 {
+			t.Errorf("checked = %v, skipped = %v", report.Checked, report.Skipped)
+		}
+		if len(api.createTags) != 1 || api.createTags[0].Resources[0] != "i-0bbbbbbbbbbbbbbbb" || aws.ToString(api.createTags[0].Tags[0].Key) != "Team" {
+			t.Errorf("CreateTags = %+v, want the home region's instance with TAGS", api.createTags)
+		}
+	})
+
+	t.Run("no node in the home region", func(t *testing.T) {
+		report, err := newPreflight(&preflightAPIs{}, true, nodes[:2]...).run(context.Background())
+		if err != nil || !reflect.DeepEqual(report.Skipped, []string{"ec2:CreateTags"}) {
+			t.Errorf("report = %+v, %v; want CreateTags skipped", report, err)
+		}
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		api := &preflightAPIs{denied: map[string]string{"CreateTags": "UnauthorizedOperation"}}
+		if _, err := newPreflight(api, false, nodes...).run(context.Background()); err != nil || len(api.createTags) > 0 {
+			t.Errorf("err = %v, CreateTags = %v; want no CreateTags check", err, api.createTags)
+		}
+	})
+
+	for _, tc := range []struct {
+		name string
+		api  *preflightAPIs
+		want string
+	}{
+		{"no credentials", &preflightAPIs{identityErr: errors.New("no EC2 IMDS role found")}, "sts:GetCallerIdentity"},
+		{"describe denied", &preflightAPIs{denied: map[string]string{"DescribeInstances": "UnauthorizedOperation"}}, "ec2:DescribeInstances is denied"},
+		{"create denied", &preflightAPIs{denied: map[string]string{"CreateTags": "UnauthorizedOperation"}}, "ec2:CreateTags is denied"},
+		{"other error", &preflightAPIs{denied: map[string]string{"DescribeInstances": "RequestExpired"}}, "ec2:DescribeInstances: "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newPreflight(tc.api, true, nodes...).run(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("err = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunPreflightReadiness(t *testing.T) {
+	api := &preflightAPIs{denied: map[string]string{"DescribeInstances": "UnauthorizedOperation"}}
+	p := &iamPreflight{sts: api, ec2: api, k8s: fake.NewSimpleClientset(), region: "eu-west-1"}
+	h := newHealth(time.Minute)
+	h.synced.Store(true)
+	h.setPreflightError(errPreflightPending)
+	if err := h.ready(); err == nil || !strings.Contains(err.Error(), "IAM preflight") {
+		t.Fatalf("ready() = %v, want unready before the preflight ran", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	runPreflight(ctx, p, h, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := h.ready(); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("ready() = %v, want the preflight error", err)
+	}
+
+	api.denied = nil
+	runPreflight(context.Background(), p, h, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := h.ready(); err != nil {
+		t.Errorf("ready() = %v after the preflight passed", err)
+	}
+}
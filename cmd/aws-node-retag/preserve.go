@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+)
+
+// describeTagsBatch bounds the number of resource IDs per DescribeTags filter.
+const describeTagsBatch = 200
+
+// preservePolicy decides which desired tags may be written over tags that
+// already exist on a resource (PRESERVE_EXISTING mode).
+type preservePolicy struct {
+	// overwrite lists keys whose existing value may be replaced; "*" allows all.
+	overwrite map[string]bool
+	// protectedPrefixes are never overwritten, even when allowed by overwrite.
+	protectedPrefixes []string
+}
+
+func (p *preservePolicy) mayOverwrite(key string) bool {
+	for _, prefix := range p.protectedPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return false
+		}
+	}
+	return p.overwrite["*"] || p.overwrite[key]
+}
+
+// filter returns the subset of desired that should be written given the
+// resource's existing tags: absent keys, and keys whose value differs and may
+// be overwritten. Keys already carrying the desired value are dropped.
+func (p *preservePolicy) filter(desired, existing map[string]string) map[string]string {
+	out := make(map[string]string, len(desired))
+	for _, c := range awstags.Diff(desired, existing) {
+		if c.Kind == awstags.Missing || c.Kind == awstags.Mismatch && p.mayOverwrite(c.Key) {
+			out[c.Key] = desired[c.Key]
+		}
+	}
+	return out
+}
+
+// tagGroup is a set of resources that receive the same tags in one CreateTags call.
+type tagGroup struct {
+	resourceIDs []string
+	tags        map[string]string
+}
+
+// groupByTags collapses per-resource tag sets into groups sharing identical
+// tags. Resources with nothing to apply are omitted. Output order is stable.
+func groupByTags(perResource map[string]map[string]string) []tagGroup {
+	index := map[string]int{}
+	var groups []tagGroup
+
+	ids := make([]string, 0, len(perResource))
+	for id := range perResource {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		tags := perResource[id]
+		if len(tags) == 0 {
+			continue
+		}
+		key := tagSetKey(tags)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, tagGroup{tags: tags})
+		}
+		groups[i].resourceIDs = append(groups[i].resourceIDs, id)
+	}
+	return groups
+}
+
+// tagSetKey returns a string identifying the tag set independent of map order.
+func tagSetKey(tags map[string]string) string { return canonicalTags(tags) }
+
+// describeTags returns the existing tags of each resource, keyed by resource ID.
+func (t *Tagger) describeTags(ctx context.Context, region string, resourceIDs []string) (map[string]map[string]string, error) {
+	existing := make(map[string]map[string]string, len(resourceIDs))
+	for start := 0; start < len(resourceIDs); start += describeTagsBatch {
+		end := min(start+describeTagsBatch, len(resourceIDs))
+		p := ec2.NewDescribeTagsPaginator(t.ec2.forRegion(region), &ec2.DescribeTagsInput{
+			Filters: []ec2types.Filter{{
+				Name:   aws.String("resource-id"),
+				Values: resourceIDs[start:end],
+			}},
+		})
+		for p.HasMorePages() {
+			page, err := p.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("DescribeTags: %w", err)
+			}
+			for _, td := range page.Tags {
+				id := aws.ToString(td.ResourceId)
+				if existing[id] == nil {
+					existing[id] = map[string]string{}
+				}
+				existing[id][aws.ToString(td.Key)] = aws.ToString(td.Value)
+			}
+		}
+	}
+	return existing, nil
+}
+
+// planPreserving computes the CreateTags calls needed to apply tags to the
+// resources without clobbering values set by other systems.
+func (t *Tagger) planPreserving(ctx context.Context, region string, resourceIDs []string, tags map[string]string) ([]tagGroup, error) {
+	existing, err := t.describeTags(ctx, region, resourceIDs)
+	if err != nil {
+		return nil, err
+	}
+	perResource := make(map[string]map[string]string, len(resourceIDs))
+	for _, id := range resourceIDs {
+		perResource[id] = t.preserve.filter(tags, existing[id])
+		if t.shared {
+			t.reportConflicts(id, tags, existing[id])
+		}
+	}
+	return groupByTags(perResource), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPreservePolicyFilter(t *testing.T) {
+	desired := map[string]string{
+		"Team":                    "platform",
+		"CostCenter":              "eng-123",
+		"Environment":             "production",
+		"kubernetes.io/cluster/a": "owned",
+	}
+	existing := map[string]string{
+		"Team":                    "data", // set by Terraform
+		"Environment":             "production",
+		"kubernetes.io/cluster/a": "shared",
+	}
+
+	cases := []struct {
+		name   string
+		policy preservePolicy
+		want   map[string]string
+	}{
+		{
+			name:   "only absent keys by default",
+			policy: preservePolicy{protectedPrefixes: []string{"aws:", "kubernetes.io/"}},
+			want:   map[string]string{"CostCenter": "eng-123"},
+		},
+		{
+			name: "allow-listed key is overwritten",
+			policy: preservePolicy{
+				overwrite:         map[string]bool{"Team": true},
+				protectedPrefixes: []string{"aws:", "kubernetes.io/"},
+			},
+			want: map[string]string{"CostCenter": "eng-123", "Team": "platform"},
+		},
+		{
+			name: "wildcard never overwrites protected prefixes",
+			policy: preservePolicy{
+				overwrite:         map[string]bool{"*": true},
+				protectedPrefixes: []string{"aws:", "kubernetes.io/"},
+			},
+			want: map[string]string{"CostCenter": "eng-123", "Team": "platform"},
+		},
+		{
+			name:   "wildcard without protected prefixes",
+			policy: preservePolicy{overwrite: map[string]bool{"*": true}},
+			want: map[string]string{
+				"CostCenter":              "eng-123",
+				"Team":                    "platform",
+				"kubernetes.io/cluster/a": "owned",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := tc.policy.filter(desired, existing)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("filter() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGroupByTags(t *testing.T) {
+	got := groupByTags(map[string]map[string]string{
+		"vol-2": {"a": "1", "b": "2"},
+		"i-1":   {"b": "2", "a": "1"},
+		"vol-3": {"a": "1"},
+		"vol-4": {},
+	})
+	want := []tagGroup{
+		{resourceIDs: []string{"i-1", "vol-2"}, tags: map[string]string{"a": "1", "b": "2"}},
+		{resourceIDs: []string{"vol-3"}, tags: map[string]string{"a": "1"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("groupByTags() = %+v, want %+v", got, want)
+	}
+}
+
+func BenchmarkPreserveFilter(b *testing.B) {
+	desired := benchmarkTags()
+	existing := benchmarkTags()
+	existing["Team"] = "data"
+	delete(existing, "CostCenter")
+	p := &preservePolicy{overwrite: map[string]bool{"*": true}, protectedPrefixes: []string{"aws:", "kubernetes.io/"}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = p.filter(desired, existing)
+	}
+}
+
+func BenchmarkGroupByTags(b *testing.B) {
+	instance, volume := benchmarkTags(), benchmarkTags()
+	volume["Backup"] = "daily"
+	perResource := map[string]map[string]string{
+		"i-0123456789abcdef0": instance, "vol-0123456789abcdef0": volume,
+		"vol-0123456789abcdef1": volume, "vol-0123456789abcdef2": volume,
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = groupByTags(perResource)
+	}
+}
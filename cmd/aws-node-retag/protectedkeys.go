@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// protectedKeys are tag keys the controller never writes or deletes
+// (PROTECTED_TAG_KEYS, PROTECTED_TAG_PREFIXES), whatever the tag
+// configuration, policies and templates produce. They are filtered out of
+// every CreateTags, DeleteTags and CreateOrUpdateTags call, after the cluster
+// tag prefix is applied.
+type protectedKeys struct {
+	keys     map[string]bool
+	prefixes []string
+}
+
+// newProtectedKeys returns nil when nothing is protected.
+func newProtectedKeys(keys, prefixes []string) *protectedKeys {
+	if len(keys) == 0 && len(prefixes) == 0 {
+		return nil
+	}
+	p := &protectedKeys{keys: make(map[string]bool, len(keys)), prefixes: prefixes}
+	for _, k := range keys {
+		p.keys[k] = true
+	}
+	return p
+}
+
+// protects reports whether key must not be written or deleted.
+func (p *protectedKeys) protects(key string) bool {
+	if p == nil {
+		return false
+	}
+	if p.keys[key] {
+		return true
+	}
+	for _, prefix := range p.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns tags without the protected keys, and the sorted keys it
+// dropped. tags is returned as is when nothing is dropped.
+func (p *protectedKeys) filter(tags map[string]string) (map[string]string, []string) {
+	var dropped []string
+	for k := range tags {
+		if p.protects(k) {
+			dropped = append(dropped, k)
+		}
+	}
+	if len(dropped) == 0 {
+		return tags, nil
+	}
+	sort.Strings(dropped)
+	out := make(map[string]string, len(tags)-len(dropped))
+	for k, v := range tags {
+		if !p.protects(k) {
+			out[k] = v
+		}
+	}
+	return out, dropped
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestProtectedKeysFilter(t *testing.T) {
+	if p := newProtectedKeys(nil, nil); p != nil {
+		t.Fatalf("newProtectedKeys(nil, nil) = %v, want nil", p)
+	}
+	var none *protectedKeys
+	tags := map[string]string{"Name": "web"}
+	if got, dropped := none.filter(tags); !reflect.DeepEqual(got, tags) || dropped != nil {
+		t.Errorf("nil filter = %v, %v", got, dropped)
+	}
+
+	p := newProtectedKeys([]string{"Name"}, []string{"kubernetes.io/cluster/"})
+	got, dropped := p.filter(map[string]string{
+		"Name":                      "web",
+		"Names":                     "x",
+		"kubernetes.io/cluster/dev": "owned",
+		"Team":                      "platform",
+	})
+	if want := map[string]string{"Names": "x", "Team": "platform"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("filter = %v, want %v", got, want)
+	}
+	if want := []string{"Name", "kubernetes.io/cluster/dev"}; !reflect.DeepEqual(dropped, want) {
+		t.Errorf("dropped = %v, want %v", dropped, want)
+	}
+}
+
+func TestCreateTagsDropsProtectedKeys(t *testing.T) {
+	api := &taggingEC2{}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), api)
+	tagger.protected = newProtectedKeys([]string{"Name"}, []string{"a/kubernetes.io/"})
+	tagger.keyPrefix = "a/"
+
+	tags := map[string]string{"Name": "web", "kubernetes.io/cluster/dev": "owned", "Team": "platform"}
+	if err := tagger.applyTags(context.Background(), "us-east-1", []string{"i-1"}, tags); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.createTags) != 1 {
+		t.Fatalf("CreateTags calls = %d, want 1", len(api.createTags))
+	}
+	got := map[string]string{}
+	for _, tag := range api.createTags[0].Tags {
+		got[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	// Name is not protected once prefixed; the prefixed cluster key is.
+	if want := map[string]string{"a/Name": "web", "a/Team": "platform"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("written tags = %v, want %v", got, want)
+	}
+
+	// A call left without keys is not made.
+	if err := tagger.applyTags(context.Background(), "us-east-1", []string{"i-1"}, map[string]string{"kubernetes.io/role": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.createTags) != 1 {
+		t.Errorf("CreateTags calls = %d, want 1", len(api.createTags))
+	}
+}
+
+func TestDeleteTagsSkipsProtectedKeys(t *testing.T) {
+	api := &fakeEC2{}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), api)
+	tagger.protected = newProtectedKeys([]string{"Name"}, nil)
+
+	tags := map[string]*string{"Name": aws.String("web"), "Team": nil}
+	if err := tagger.deleteTags(context.Background(), "", "us-east-1", "vol-1", tags); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.deleteTags) != 1 || len(api.deleteTags[0].Tags) != 1 || aws.ToString(api.deleteTags[0].Tags[0].Key) != "Team" {
+		t.Errorf("DeleteTags calls = %+v, want only key Team", api.deleteTags)
+	}
+
+	if err := tagger.deleteTags(context.Background(), "", "us-east-1", "vol-1", map[string]*string{"Name": nil}); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.deleteTags) != 1 {
+		t.Errorf("DeleteTags calls = %d, want 1", len(api.deleteTags))
+	}
+}
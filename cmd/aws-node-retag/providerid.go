@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The providerID of every node is parsed on each resync, so the matchers
+// below scan bytes instead of running regular expressions and parsing does
+// not allocate. providerid_test.go checks them against the equivalent
+// patterns.
+
+// isInstanceID reports whether s is an EC2 instance ID: "i-" and 8 or 17
+// lowercase hex characters.
+func isInstanceID(s string) bool {
+	if len(s) != 10 && len(s) != 19 || !strings.HasPrefix(s, "i-") {
+		return false
+	}
+	for i := 2; i < len(s); i++ {
+		if c := s[i]; !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// scanZone matches s against ^[a-z]{2}(-[a-z]+)+-\d+[a-z0-9-]*$, the shape
+// of availability zones, Local Zones and Wavelength Zones: us-east-1a,
+// us-west-2-lax-1a, us-east-1-wl1-bos-wlz-1. It returns the length of the
+// region prefix (^[a-z]{2}(-[a-z]+)+-\d+), 0 if there is none, and whether
+// the whole of s is zone-shaped.
+func scanZone(s string) (regionLen int, zone bool) {
+	isLower := func(c byte) bool { return 'a' <= c && c <= 'z' }
+	isDigit := func(c byte) bool { return '0' <= c && c <= '9' }
+	if len(s) < 2 || !isLower(s[0]) || !isLower(s[1]) {
+		return 0, false
+	}
+	i, groups := 2, 0
+	for {
+		if i >= len(s) || s[i] != '-' {
+			return 0, false
+		}
+		i++
+		start := i
+		for i < len(s) && isLower(s[i]) {
+			i++
+		}
+		if i > start {
+			groups++
+			continue
+		}
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		if i == start || groups == 0 {
+			return 0, false
+		}
+		break
+	}
+	regionLen = i
+	for ; i < len(s); i++ {
+		if c := s[i]; !isLower(c) && !isDigit(c) && c != '-' {
+			return regionLen, false
+		}
+	}
+	return regionLen, true
+}
+
+// isZoneName reports whether s is shaped like a zone name (see scanZone).
+func isZoneName(s string) bool {
+	_, zone := scanZone(s)
+	return zone
+}
+
+// providerInfo is what the controller needs from a node's spec.providerID.
+type providerInfo struct {
+	Zone       string
+	InstanceID string
+	// Fargate is set for Fargate pods-as-nodes, which have no EC2 instance.
+	Fargate bool
+}
+
+// parseProviderID parses an AWS providerID. The canonical form is
+// aws:///<az>/<instance-id>, but variants are accepted:
+//
+//	aws:///us-east-1a/i-0123456789abcdef0                 (standard)
+//	aws:///us-east-1a/i-0123456789abcdef0/<extra>         (Outposts, some Karpenter builds)
+//	aws:///123456789012/us-east-1a/i-0123456789abcdef0    (account segment)
+//	aws://us-east-1a/i-0123456789abcdef0                  (host form)
+//	aws:///us-east-1a/<hash>/fargate-ip-10-0-0-1.ec2.internal (Fargate)
+//	aws-cn:///cn-north-1a/i-0123456789abcdef0             (partition scheme)
+//
+// The instance ID is the first segment that looks like one, and the zone is
+// the nearest zone-shaped segment before it.
+func parseProviderID(providerID string) (providerInfo, error) {
+	rest, ok := cutProviderIDScheme(providerID)
+	if !ok {
+		return providerInfo{}, fmt.Errorf("not an AWS providerID: %q", providerID)
+	}
+
+	// The zone is the last zone segment before the instance ID or, without
+	// one, the last zone segment.
+	var info providerInfo
+	for rest != "" {
+		var s string
+		s, rest, _ = strings.Cut(rest, "/")
+		if s == "" {
+			continue
+		}
+		if strings.HasPrefix(s, "fargate-") {
+			info.Fargate = true
+		}
+		switch {
+		case info.InstanceID != "":
+		case isInstanceID(s):
+			info.InstanceID = s
+		case isZoneName(s):
+			info.Zone = s
+		}
+	}
+
+	if info.Fargate {
+		return info, nil
+	}
+	if info.InstanceID == "" {
+		return info, fmt.Errorf("no instance ID (i-...) found in providerID %q", providerID)
+	}
+	if info.Zone == "" {
+		return info, fmt.Errorf("no availability zone found in providerID %q", providerID)
+	}
+	return info, nil
+}
+
+// regionFromZone derives the region from an availability, Local or Wavelength
+// zone name: us-east-1a → us-east-1, us-west-2-lax-1a → us-west-2.
+func regionFromZone(zone string) (string, error) {
+	n, _ := scanZone(zone)
+	region := zone[:n]
+	if region == "" || region == zone {
+		return "", fmt.Errorf("cannot derive region from zone %q", zone)
+	}
+	return region, nil
+}
+
+// parseInstanceID extracts the EC2 instance ID from a node ProviderID.
+// Expected format: aws:///us-east-1a/i-0123456789abcdef0
+func parseInstanceID(providerID string) (string, error) {
+	info, err := parseProviderID(providerID)
+	if err != nil {
+		return "", err
+	}
+	if info.InstanceID == "" {
+		return "", fmt.Errorf("no instance ID in providerID %q", providerID)
+	}
+	return info.InstanceID, nil
+}
+
+// parseRegion derives the AWS region from a node ProviderID.
+// Expected format: aws:///us-east-1a/i-xxx → strips the trailing AZ letter.
+func parseRegion(providerID string) (string, error) {
+	info, err := parseProviderID(providerID)
+	if err != nil {
+		return "", err
+	}
+	return regionFromZone(info.Zone)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestParseProviderID(t *testing.T) {
+	cases := []struct {
+		name       string
+		providerID string
+		want       providerInfo
+		wantErr    bool
+	}{
+		{
+			name:       "standard",
+			providerID: "aws:///us-east-1a/i-0abc123def456789a",
+			want:       providerInfo{Zone: "us-east-1a", InstanceID: "i-0abc123def456789a"},
+		},
+		{
+			name:       "china partition scheme",
+			providerID: "aws-cn:///cn-north-1a/i-0abc123def456789a",
+			want:       providerInfo{Zone: "cn-north-1a", InstanceID: "i-0abc123def456789a"},
+		},
+		{
+			name:       "govcloud zone",
+			providerID: "aws:///us-gov-west-1a/i-0abc123def456789a",
+			want:       providerInfo{Zone: "us-gov-west-1a", InstanceID: "i-0abc123def456789a"},
+		},
+		{
+			name:       "short instance ID",
+			providerID: "aws:///eu-west-1b/i-0abc1234",
+			want:       providerInfo{Zone: "eu-west-1b", InstanceID: "i-0abc1234"},
+		},
+		{
+			name:       "outposts trailing segment",
+			providerID: "aws:///us-west-2a/i-0abc123def456789a/op-0123456789abcdef0",
+			want:       providerInfo{Zone: "us-west-2a", InstanceID: "i-0abc123def456789a"},
+		},
+		{
+			name:       "account segment",
+			providerID: "aws:///123456789012/ap-southeast-2c/i-0abc123def456789a",
+			want:       providerInfo{Zone: "ap-southeast-2c", InstanceID: "i-0abc123def456789a"},
+		},
+		{
+			name:       "host form with two slashes",
+			providerID: "aws://us-east-1a/i-0abc123def456789a",
+			want:       providerInfo{Zone: "us-east-1a", InstanceID: "i-0abc123def456789a"},
+		},
+		{
+			name:       "local zone",
+			providerID: "aws:///us-west-2-lax-1a/i-0abc123def456789a",
+			want:       providerInfo{Zone: "us-west-2-lax-1a", InstanceID: "i-0abc123def456789a"},
+		},
+		{
+			name:       "fargate",
+			providerID: "aws:///us-east-2b/e4e8d1b4cb-5b2c1a9a0e8a4b0f/fargate-ip-192-168-106-86.us-east-2.compute.internal",
+			want:       providerInfo{Zone: "us-east-2b", Fargate: true},
+		},
+		{
+			name:       "missing zone",
+			providerID: "aws:///i-0abc123def456789a",
+			wantErr:    true,
+		},
+		{
+			name:       "not an instance",
+			providerID: "aws:///us-east-1a/invalid",
+			wantErr:    true,
+		},
+		{
+			name:       "other cloud",
+			providerID: "gce://project/us-central1-a/vm",
+			wantErr:    true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseProviderID(tc.providerID)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseProviderID(%q) err=%v, wantErr=%v", tc.providerID, err, tc.wantErr)
+			}
+			if !tc.wantErr && got != tc.want {
+				t.Errorf("parseProviderID(%q) = %+v, want %+v", tc.providerID, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRegionFromZone(t *testing.T) {
+	cases := []struct {
+		zone    string
+		want    string
+		wantErr bool
+	}{
+		{zone: "us-east-1a", want: "us-east-1"},
+		{zone: "us-west-2-lax-1a", want: "us-west-2"},
+		{zone: "us-east-1-wl1-bos-wlz-1", want: "us-east-1"},
+		{zone: "us-gov-west-1a", want: "us-gov-west-1"},
+		{zone: "us-east-1", wantErr: true},
+		{zone: "a", wantErr: true},
+		{zone: "", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.zone, func(t *testing.T) {
+			got, err := regionFromZone(tc.zone)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("regionFromZone(%q) err=%v, wantErr=%v", tc.zone, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("regionFromZone(%q) = %q, want %q", tc.zone, got, tc.want)
+			}
+		})
+	}
+}
+
+// The patterns the byte matchers replace, kept as their specification.
+var (
+	zonePattern       = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+[a-z0-9-]*$`)
+	zoneRegionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+`)
+	instanceIDPattern = regexp.MustCompile(`^i-[0-9a-f]{8}([0-9a-f]{9})?$`)
+)
+
+func TestMatchersAgreeWithPatterns(t *testing.T) {
+	inputs := []string{
+		"", "a", "us", "us-", "us-east", "us-east-", "us-east-1", "us-east-1a", "us-east-1-", "us-west-2-lax-1a",
+		"us-east-1-wl1-bos-wlz-1", "us-gov-west-1a", "cn-north-1a", "US-east-1a", "u1-east-1a", "us-1a", "us--east-1a",
+		"us-east1a", "us-east-1a_", "us-east-1a/", "us-east-1A", "use-east-1a", "us-eas-t-1a", "123456789012",
+		"fargate-ip-10-0-0-1.ec2.internal", "i-0123abcd", "i-0123456789abcdef0", "i-0123456789ABCDEF0", "i-0123456789abcdef",
+		"i-0123abcd0", "i-0123456789abcdef0a", "i-", "x-0123abcd", "i-0123abcg",
+	}
+	for _, s := range inputs {
+		regionLen, zone := scanZone(s)
+		if want := zonePattern.MatchString(s); zone != want {
+			t.Errorf("isZoneName(%q) = %v, want %v", s, zone, want)
+		}
+		if want := zoneRegionPattern.FindString(s); s[:regionLen] != want {
+			t.Errorf("scanZone(%q) region = %q, want %q", s, s[:regionLen], want)
+		}
+		if want := instanceIDPattern.MatchString(s); isInstanceID(s) != want {
+			t.Errorf("isInstanceID(%q) = %v, want %v", s, !want, want)
+		}
+	}
+}
+
+func TestParseProviderIDDoesNotAllocate(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = parseProviderID("aws:///123456789012/us-west-2-lax-1a/i-0123456789abcdef0/extra")
+		_, _ = regionFromZone("us-west-2-lax-1a")
+	})
+	if allocs != 0 {
+		t.Errorf("parseProviderID allocates %v times per call", allocs)
+	}
+}
+
+func BenchmarkParseProviderID(b *testing.B) {
+	for _, bc := range []struct{ name, providerID string }{
+		{"standard", "aws:///us-east-1a/i-0123456789abcdef0"},
+		{"account segment", "aws:///123456789012/us-west-2-lax-1a/i-0123456789abcdef0/extra"},
+		{"fargate", "aws:///eu-west-1a/abc/fargate-ip-10-0-0-1.ec2.internal"},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				info, _ := parseProviderID(bc.providerID)
+				_, _ = regionFromZone(info.Zone)
+			}
+		})
+	}
+}
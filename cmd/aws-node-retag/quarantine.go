@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// quarantine lists AWS resources the controller must never mutate, whatever
+// TAGS or TagPolicies say — e.g. instances held for forensics.
+type quarantine struct {
+	// ids holds quarantined instance and volume IDs.
+	ids map[string]bool
+	// tags quarantines resources carrying a tag key; a non-empty value must
+	// also match.
+	tags map[string]string
+}
+
+// newQuarantine builds the quarantine from resource IDs and "key" or
+// "key=value" tag selectors. It returns nil when both are empty.
+func newQuarantine(ids, tagSelectors []string) (*quarantine, error) {
+	if len(ids) == 0 && len(tagSelectors) == 0 {
+		return nil, nil
+	}
+	q := &quarantine{ids: map[string]bool{}, tags: map[string]string{}}
+	for _, id := range ids {
+		if !strings.HasPrefix(id, "i-") && !strings.HasPrefix(id, "vol-") {
+			return nil, fmt.Errorf("%q is not an instance (i-) or volume (vol-) ID", id)
+		}
+		q.ids[id] = true
+	}
+	for _, sel := range tagSelectors {
+		key, value, _ := strings.Cut(sel, "=")
+		if key == "" {
+			return nil, fmt.Errorf("tag selector %q has an empty key", sel)
+		}
+		q.tags[key] = value
+	}
+	return q, nil
+}
+
+// matchesTags reports whether a resource with the given tags is quarantined.
+func (q *quarantine) matchesTags(tags map[string]string) (string, bool) {
+	for k, want := range q.tags {
+		if got, ok := tags[k]; ok && (want == "" || got == want) {
+			if want == "" {
+				return k, true
+			}
+			return k + "=" + want, true
+		}
+	}
+	return "", false
+}
+
+// resourceKind names the kind of an EC2 resource ID for metrics and
+// TAGGING_BACKENDS.
+func resourceKind(id string) string {
+	switch {
+	case strings.HasPrefix(id, "i-"):
+		return "instance"
+	case strings.HasPrefix(id, "vol-"):
+		return "volume"
+	case strings.HasPrefix(id, "snap-"):
+		return "snapshot"
+	case strings.HasPrefix(id, "eipalloc-"):
+		return "elastic-ip"
+	case strings.HasPrefix(id, "eni-"):
+		return "network-interface"
+	}
+	return "other"
+}
+
+// unquarantined returns the resource IDs that may be mutated. Quarantined IDs
+// are dropped, and when tag selectors are configured the resources' current
+// tags are read to drop those carrying a quarantine tag.
+func (t *Tagger) unquarantined(ctx context.Context, region string, resourceIDs []string) ([]string, error) {
+	if t.quarantine == nil {
+		return resourceIDs, nil
+	}
+	var existing map[string]map[string]string
+	if len(t.quarantine.tags) > 0 {
+		var err error
+		if existing, err = t.describeTags(ctx, region, resourceIDs); err != nil {
+			return nil, fmt.Errorf("quarantine check: %w", err)
+		}
+	}
+	allowed := make([]string, 0, len(resourceIDs))
+	for _, id := range resourceIDs {
+		reason := ""
+		if t.quarantine.ids[id] {
+			reason = "resource ID"
+		} else if sel, ok := t.quarantine.matchesTags(existing[id]); ok {
+			reason = "tag " + sel
+		}
+		if reason == "" {
+			allowed = append(allowed, id)
+			continue
+		}
+		t.logger.Warn("resource is quarantined, leaving it untouched", "resource", id, "matched", reason)
+		t.metrics.quarantined.WithLabelValues(resourceKind(id)).Inc()
+	}
+	return allowed, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// taggingEC2 serves canned existing tags and records CreateTags calls.
+type taggingEC2 struct {
+	ec2API
+	existing   map[string]map[string]string
+	createTags []*ec2.CreateTagsInput
+}
+
+func (f *taggingEC2) DescribeTags(_ context.Context, in *ec2.DescribeTagsInput, _ ...func(*ec2.Options)) (*ec2.DescribeTagsOutput, error) {
+	out := &ec2.DescribeTagsOutput{}
+	for _, id := range in.Filters[0].Values {
+		for k, v := range f.existing[id] {
+			out.Tags = append(out.Tags, ec2types.TagDescription{ResourceId: aws.String(id), Key: aws.String(k), Value: aws.String(v)})
+		}
+	}
+	return out, nil
+}
+
+func (f *taggingEC2) CreateTags(_ context.Context, in *ec2.CreateTagsInput, _ ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	f.createTags = append(f.createTags, in)
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func TestNewQuarantine(t *testing.T) {
+	q, err := newQuarantine(nil, nil)
+	if err != nil || q != nil {
+		t.Fatalf("empty quarantine = %v, %v; want nil, nil", q, err)
+	}
+	if _, err := newQuarantine([]string{"eni-0123"}, nil); err == nil {
+		t.Error("expected an error for a non-instance, non-volume ID")
+	}
+	if _, err := newQuarantine(nil, []string{"=true"}); err == nil {
+		t.Error("expected an error for an empty tag key")
+	}
+
+	q, err = newQuarantine(nil, []string{"LegalHold", "Owner=security"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		tags map[string]string
+		want bool
+	}{
+		{map[string]string{"LegalHold": "anything"}, true},
+		{map[string]string{"Owner": "security"}, true},
+		{map[string]string{"Owner": "platform"}, false},
+		{nil, false},
+	} {
+		if _, got := q.matchesTags(tc.tags); got != tc.want {
+			t.Errorf("matchesTags(%v) = %v, want %v", tc.tags, got, tc.want)
+		}
+	}
+}
+
+func TestApplyTagsSkipsQuarantined(t *testing.T) {
+	api := &taggingEC2{existing: map[string]map[string]string{
+		"vol-held": {"LegalHold": "true"},
+	}}
+	q, err := newQuarantine([]string{"i-held"}, []string{"LegalHold=true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagger := &Tagger{
+		ec2:        fakeClients(api),
+		quarantine: q,
+		logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		metrics:    newMetrics(""),
+	}
+
+	err = tagger.applyTags(context.Background(), "us-east-1", []string{"i-held", "vol-held", "vol-free"}, map[string]string{"Env": "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(api.createTags) != 1 || !reflect.DeepEqual(api.createTags[0].Resources, []string{"vol-free"}) {
+		t.Fatalf("CreateTags calls = %v, want one for [vol-free]", api.createTags)
+	}
+
+	api.createTags = nil
+	if err := tagger.applyTags(context.Background(), "us-east-1", []string{"i-held"}, map[string]string{"Env": "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.createTags) != 0 {
+		t.Errorf("quarantined instance was tagged: %v", api.createTags)
+	}
+}
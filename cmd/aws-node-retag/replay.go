@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// cmdReplay is the subcommand that replays a Kubernetes API audit log
+// through the node decisions of this version of the controller.
+const cmdReplay = "replay"
+
+// replayMismatchExitCode is the exit status of the replay command when a node
+// would be tagged differently than the log shows.
+const replayMismatchExitCode = 3
+
+// replayMaxLine is the longest audit log line read; events with large node
+// objects exceed bufio.Scanner's default.
+const replayMaxLine = 16 << 20
+
+// k8sAuditEvent is the subset of an audit.k8s.io/v1 Event read by replay.
+type k8sAuditEvent struct {
+	Stage string `json:"stage"`
+	Verb  string `json:"verb"`
+	// ObjectRef is unset for non-resource requests.
+	ObjectRef *struct {
+		Resource    string `json:"resource"`
+		Name        string `json:"name"`
+		Subresource string `json:"subresource"`
+	} `json:"objectRef"`
+	// ResponseObject is only logged at the RequestResponse level.
+	ResponseObject json.RawMessage `json:"responseObject"`
+	StageTimestamp time.Time       `json:"stageTimestamp"`
+}
+
+// replayMismatch is a node tagged in the log that this version would not
+// tag, or the other way around.
+type replayMismatch struct {
+	Node string `json:"node"`
+	// Historical reports whether the node was tagged in the log.
+	Historical bool `json:"historical"`
+	// Action, Reason and Detail are those of the decision on the node's last
+	// state before it was tagged in the log, or on its last state otherwise.
+	Action string    `json:"action"`
+	Reason string    `json:"reason,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// replayReport summarizes a replay.
+type replayReport struct {
+	// Events counts the node states replayed; Skipped the log entries that
+	// carry none, e.g. other resources, earlier stages or events logged below
+	// the RequestResponse level, and Invalid the lines that are not events.
+	Events  int `json:"events"`
+	Skipped int `json:"skipped"`
+	Invalid int `json:"invalid"`
+	// Nodes counts the nodes compared. Nodes already tagged in their first
+	// replayed state are not: the log does not show how they were tagged.
+	Nodes int `json:"nodes"`
+	// Decisions counts the decisions made, by "action/reason".
+	Decisions  map[string]int   `json:"decisions"`
+	Mismatches []replayMismatch `json:"mismatches"`
+}
+
+// replayNode is what replay tracks per node.
+type replayNode struct {
+	name string
+	// ignored is set for nodes already tagged when first seen.
+	ignored bool
+	// historical is set once the log shows the node tagged, and tagged once
+	// a decision would have tagged it.
+	historical, tagged bool
+	last               *nodeDecision
+	at                 time.Time
+}
+
+// replay reads a Kubernetes API audit log, one JSON event per line as the
+// log backend writes it, and runs every node state it contains through
+// decideNode in order. A node is tagged in the log when a state first carries
+// the tagged annotation; the report lists the nodes for which this version
+// decides differently. Nothing is written: decisions do not call AWS, and the
+// states replayed are those of the log, including its controller's writes.
+func (t *Tagger) replay(r io.Reader) (*replayReport, error) {
+	report := &replayReport{Decisions: map[string]int{}, Mismatches: []replayMismatch{}}
+	// current maps names to the nodes that have them now; a deleted node's
+	// name may be reused by a new node.
+	current := map[string]*replayNode{}
+	var all []*replayNode
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, replayMaxLine)
+	for sc.Scan() {
+		line := sc.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var ev k8sAuditEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			report.Invalid++
+			continue
+		}
+		if ev.ObjectRef != nil && ev.ObjectRef.Resource == "nodes" && ev.ObjectRef.Subresource == "" &&
+			ev.Verb == "delete" && ev.Stage == "ResponseComplete" {
+			delete(current, ev.ObjectRef.Name)
+			report.Skipped++
+			continue
+		}
+		node, ok := replayedNode(&ev)
+		if !ok {
+			report.Skipped++
+			continue
+		}
+		report.Events++
+		n := current[node.Name]
+		if n == nil {
+			n = &replayNode{name: node.Name, ignored: t.isTagged(node.Annotations)}
+			current[node.Name] = n
+			all = append(all, n)
+		}
+		if n.ignored || n.historical {
+			continue
+		}
+		if t.isTagged(node.Annotations) {
+			n.historical, n.at = true, ev.StageTimestamp
+			continue
+		}
+		d := t.decideNode(node, false)
+		report.Decisions[d.Action+"/"+d.Reason]++
+		if !n.tagged {
+			n.last, n.at = d, ev.StageTimestamp
+		}
+		if d.Action == actionTag {
+			n.tagged = true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return report, fmt.Errorf("read audit log: %w", err)
+	}
+
+	sort.SliceStable(all, func(i, j int) bool { return all[i].name < all[j].name })
+	for _, n := range all {
+		if n.ignored {
+			continue
+		}
+		report.Nodes++
+		if n.historical == n.tagged {
+			continue
+		}
+		m := replayMismatch{Node: n.name, Historical: n.historical, Time: n.at}
+		if n.last != nil {
+			m.Action, m.Reason, m.Detail = n.last.Action, n.last.Reason, n.last.Detail
+		}
+		report.Mismatches = append(report.Mismatches, m)
+	}
+	return report, nil
+}
+
+// replayedNode returns the node state an audit event records, if any.
+func replayedNode(ev *k8sAuditEvent) (*corev1.Node, bool) {
+	if ev.Stage != "ResponseComplete" || ev.ObjectRef == nil || ev.ObjectRef.Resource != "nodes" || len(ev.ResponseObject) == 0 {
+		return nil, false
+	}
+	switch ev.Verb {
+	case "create", "update", "patch":
+	default:
+		return nil, false
+	}
+	var node corev1.Node
+	// Failed requests respond with a Status instead.
+	if err := json.Unmarshal(ev.ResponseObject, &node); err != nil || node.Kind != "Node" || node.Name == "" {
+		return nil, false
+	}
+	return &node, true
+}
+
+// runReplay implements the replay command: it loads the TagPolicies when
+// enabled, then replays the audit log read from r and writes the report to w.
+func (t *Tagger) runReplay(ctx context.Context, cfg *Config, k8sCfg *rest.Config, r io.Reader, w io.Writer) (*replayReport, error) {
+	if cfg.TagPolicies {
+		dyn, err := dynamic.NewForConfig(k8sCfg)
+		if err != nil {
+			return nil, fmt.Errorf("create dynamic client: %w", err)
+		}
+		if err := t.loadPolicies(ctx, dyn); err != nil {
+			return nil, err
+		}
+	}
+	report, err := t.replay(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return report, err
+}
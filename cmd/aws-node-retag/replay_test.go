@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// auditLogLine returns the audit event of a request on a node, with the node
+// as response object.
+func auditLogLine(t *testing.T, verb string, node *corev1.Node) string {
+	t.Helper()
+	node.TypeMeta = metav1.TypeMeta{Kind: "Node", APIVersion: "v1"}
+	obj, err := json.Marshal(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := map[string]any{
+		"kind": "Event", "apiVersion": "audit.k8s.io/v1", "level": "RequestResponse",
+		"stage": "ResponseComplete", "verb": verb, "stageTimestamp": "2024-05-01T12:00:00.000000Z",
+		"objectRef":      map[string]string{"resource": "nodes", "name": node.Name, "apiVersion": "v1"},
+		"responseObject": json.RawMessage(obj),
+	}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(line)
+}
+
+func replayNodeState(name, providerID string, annotations map[string]string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations},
+		Spec:       corev1.NodeSpec{ProviderID: providerID},
+	}
+}
+
+func TestReplay(t *testing.T) {
+	tagged := map[string]string{annotationKey: annotationValue}
+	log := strings.Join([]string{
+		// Tagged once its providerID is set, in the log and by this version.
+		auditLogLine(t, "create", replayNodeState("a", "", nil)),
+		auditLogLine(t, "patch", replayNodeState("a", "aws:///us-east-1a/i-0aaaaaaaaaaaaaaaa", nil)),
+		auditLogLine(t, "patch", replayNodeState("a", "aws:///us-east-1a/i-0aaaaaaaaaaaaaaaa", tagged)),
+		// Tagged in the log, but in a region this version does not allow.
+		auditLogLine(t, "create", replayNodeState("b", "aws:///eu-west-1a/i-0bbbbbbbbbbbbbbbb", nil)),
+		auditLogLine(t, "patch", replayNodeState("b", "aws:///eu-west-1a/i-0bbbbbbbbbbbbbbbb", tagged)),
+		// Never tagged in the log.
+		auditLogLine(t, "create", replayNodeState("c", "aws:///us-east-1b/i-0cccccccccccccccc", nil)),
+		// Already tagged before the log starts: not compared.
+		auditLogLine(t, "update", replayNodeState("d", "aws:///us-east-1a/i-0dddddddddddddddd", tagged)),
+		`{"kind":"Event","stage":"ResponseComplete","verb":"get","objectRef":{"resource":"pods","name":"p"}}`,
+		"not json",
+		"",
+	}, "\n")
+
+	tagger := &Tagger{logger: slog.New(slog.NewTextHandler(io.Discard, nil)), allowedRegions: map[string]bool{"us-east-1": true}}
+	tagger.snapshot.Store(&tagSnapshot{tags: map[string]string{"Env": "prod"}})
+	report, err := tagger.replay(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Events != 7 || report.Skipped != 1 || report.Invalid != 1 || report.Nodes != 3 {
+		t.Errorf("report = %+v, want 7 events, 1 skipped, 1 invalid, 3 nodes", report)
+	}
+	if len(report.Mismatches) != 2 {
+		t.Fatalf("mismatches = %+v, want b and c", report.Mismatches)
+	}
+	if m := report.Mismatches[0]; m.Node != "b" || !m.Historical || m.Reason != "region_not_allowed" {
+		t.Errorf("mismatch = %+v, want b tagged in the log and skipped now", m)
+	}
+	if m := report.Mismatches[1]; m.Node != "c" || m.Historical || m.Action != actionTag {
+		t.Errorf("mismatch = %+v, want c tagged now only", m)
+	}
+	if report.Decisions["wait/no_provider_id"] != 1 || report.Decisions["tag/"] != 2 {
+		t.Errorf("decisions = %v", report.Decisions)
+	}
+}
+
+func TestReplayReusedName(t *testing.T) {
+	tagged := map[string]string{annotationKey: annotationValue}
+	log := strings.Join([]string{
+		auditLogLine(t, "update", replayNodeState("a", "aws:///us-east-1a/i-0aaaaaaaaaaaaaaaa", tagged)),
+		`{"kind":"Event","stage":"ResponseComplete","verb":"delete","objectRef":{"resource":"nodes","name":"a"}}`,
+		// A new node with the same name is compared.
+		auditLogLine(t, "create", replayNodeState("a", "aws:///us-east-1a/i-0eeeeeeeeeeeeeeee", nil)),
+	}, "\n")
+	tagger := &Tagger{logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	tagger.snapshot.Store(&tagSnapshot{tags: map[string]string{"Env": "prod"}})
+	var out bytes.Buffer
+	report, err := tagger.runReplay(context.Background(), &Config{}, nil, strings.NewReader(log), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Nodes != 1 || len(report.Mismatches) != 1 || report.Mismatches[0].Historical {
+		t.Errorf("report = %+v, want the second node a tagged now only", report)
+	}
+	var decoded replayReport
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || len(decoded.Mismatches) != 1 {
+		t.Errorf("written report = %s (%v)", out.String(), err)
+	}
+}
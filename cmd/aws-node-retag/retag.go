@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// retagAll clears the controller's in-memory state (cached EC2 clients,
+// tagged Auto Scaling groups, per-policy error history and denied tag keys) and re-tags every node and bound PV, including
+// those already annotated. It runs in the background and returns false when a
+// full re-tag is already in progress.
+func (t *Tagger) retagAll(ctx context.Context, nodes corelisters.NodeLister, pvs corelisters.PersistentVolumeLister) bool {
+	if !t.retagging.CompareAndSwap(false, true) {
+		return false
+	}
+	t.ec2.reset()
+	t.resetBackends()
+	if t.asg != nil {
+		t.asg.done.Reset()
+	}
+	if t.policies != nil {
+		t.policies.resetProgress()
+	}
+	t.features.reset()
+	t.deniedKeys.reset()
+	t.writes.reset()
+	t.tasks.spawn("retag", func() {
+		defer t.retagging.Store(false)
+		t.logger.Info("re-tagging all nodes and persistent volumes")
+		t.reconcileAll(ctx, nodes, pvs, true)
+		t.logger.Info("finished re-tagging all nodes and persistent volumes")
+	})
+	return true
+}
+
+// retagHandler serves POST /admin/retag, re-tagging every node and bound PV,
+// or only the node named by ?node=<name>.
+func (t *Tagger) retagHandler(ctx context.Context, nodes corelisters.NodeLister, pvs corelisters.PersistentVolumeLister) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if name := r.URL.Query().Get("node"); name != "" {
+			node, err := nodes.Get(name)
+			if apierrors.IsNotFound(err) {
+				http.Error(w, "node not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			t.tasks.spawn("retag", func() { t.tagNode(ctx, node, true) })
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, "re-tagging node %s\n", name)
+			return
+		}
+		if !t.retagAll(ctx, nodes, pvs) {
+			http.Error(w, "a full re-tag is already in progress", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, "re-tagging all nodes and persistent volumes")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestForceAnnotation(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "n1", Annotations: map[string]string{
+			annotationKey:   annotationValue,
+			forceAnnotation: "true",
+		}},
+		Spec: corev1.NodeSpec{ProviderID: "aws:///us-east-1a/i-0123456789abcdef0"},
+	}
+	k8s := fake.NewSimpleClientset(node)
+	tagger := &Tagger{k8s: k8s, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	if d := tagger.decideNode(node, false); d.Action != actionTag {
+		t.Errorf("decision = %s/%s, want tag for a force-annotated node", d.Action, d.Reason)
+	}
+
+	if err := tagger.annotateNode(context.Background(), "n1", &nodeStatus{InstanceID: "i-0abc"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := k8s.CoreV1().Nodes().Get(context.Background(), "n1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.Annotations[forceAnnotation]; ok {
+		t.Error("force annotation should be cleared once the node is tagged")
+	}
+	if got.Annotations[annotationKey] != annotationValue {
+		t.Errorf("tagged annotation = %q", got.Annotations[annotationKey])
+	}
+	if d := tagger.decideNode(got, false); d.Reason != "already_tagged" {
+		t.Errorf("decision after clearing = %s/%s, want skip/already_tagged", d.Action, d.Reason)
+	}
+}
+
+func TestRetagHandler(t *testing.T) {
+	tagger := &Tagger{
+		ec2:     fakeClients(nil),
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		metrics: newMetrics(""),
+	}
+	empty := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	h := tagger.retagHandler(context.Background(), corelisters.NewNodeLister(empty), corelisters.NewPersistentVolumeLister(empty))
+
+	serve := func(method, target string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec.Code
+	}
+
+	if code := serve(http.MethodGet, "/admin/retag"); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want 405", code)
+	}
+	if code := serve(http.MethodPost, "/admin/retag?node=missing"); code != http.StatusNotFound {
+		t.Errorf("unknown node status = %d, want 404", code)
+	}
+
+	tagger.retagging.Store(true)
+	if code := serve(http.MethodPost, "/admin/retag"); code != http.StatusConflict {
+		t.Errorf("status while re-tagging = %d, want 409", code)
+	}
+	tagger.retagging.Store(false)
+	if code := serve(http.MethodPost, "/admin/retag"); code != http.StatusAccepted {
+		t.Errorf("status = %d, want 202", code)
+	}
+}
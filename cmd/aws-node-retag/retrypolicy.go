@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	smithy "github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// Error classes a retryPolicy distinguishes.
+const (
+	errorClassThrottle = "throttle"
+	errorClassAuth     = "auth"
+	errorClassNotFound = "notFound"
+	errorClassUnknown  = "unknown"
+)
+
+// authErrorCodes are the EC2 and STS error codes of calls that were not
+// authenticated or not authorized. Retrying them only helps while a freshly
+// created role or policy propagates.
+var authErrorCodes = map[string]bool{
+	"AuthFailure":           true,
+	"UnauthorizedOperation": true,
+	"InvalidClientTokenId":  true,
+	"SignatureDoesNotMatch": true,
+	"ExpiredToken":          true,
+	"RequestExpired":        true,
+	"AccessDenied":          true,
+	"AccessDeniedException": true,
+	"OptInRequired":         true,
+}
+
+// classifyError returns the error class of a failed EC2 call.
+func classifyError(err error) string {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return errorClassUnknown
+	}
+	code := apiErr.ErrorCode()
+	switch {
+	case retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) == aws.TrueTernary:
+		return errorClassThrottle
+	case authErrorCodes[code]:
+		return errorClassAuth
+	case strings.HasSuffix(code, ".NotFound"):
+		return errorClassNotFound
+	}
+	return errorClassUnknown
+}
+
+// retryClass overrides the retry behaviour for one error class.
+type retryClass struct {
+	// MaxAttempts is the total number of attempts for errors of the class;
+	// 1 never retries them.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// MaxBackoff caps the exponential backoff with jitter between attempts,
+	// e.g. "20s"; the SDK's backoff is used when empty.
+	MaxBackoff string `json:"maxBackoff,omitempty"`
+}
+
+// retryPolicy overrides retries per error class. Classes left unset keep the
+// client's retryer: throttling and transient errors are retried up to its
+// maximum attempts, auth and not-found errors (e.g. an instance that is not
+// yet visible to the EC2 API) are not retried.
+type retryPolicy struct {
+	Throttle *retryClass `json:"throttle,omitempty"`
+	Auth     *retryClass `json:"auth,omitempty"`
+	NotFound *retryClass `json:"notFound,omitempty"`
+	Unknown  *retryClass `json:"unknown,omitempty"`
+}
+
+func (p *retryPolicy) forClass(class string) *retryClass {
+	switch class {
+	case errorClassThrottle:
+		return p.Throttle
+	case errorClassAuth:
+		return p.Auth
+	case errorClassNotFound:
+		return p.NotFound
+	}
+	return p.Unknown
+}
+
+func (p *retryPolicy) validate() error {
+	for _, class := range []string{errorClassThrottle, errorClassAuth, errorClassNotFound, errorClassUnknown} {
+		c := p.forClass(class)
+		if c == nil {
+			continue
+		}
+		if c.MaxAttempts < 1 {
+			return fmt.Errorf("%s.maxAttempts must be at least 1, got %d", class, c.MaxAttempts)
+		}
+		if c.MaxBackoff != "" {
+			if d, err := time.ParseDuration(c.MaxBackoff); err != nil || d <= 0 {
+				return fmt.Errorf("%s.maxBackoff must be a positive duration, got %q", class, c.MaxBackoff)
+			}
+		}
+	}
+	return nil
+}
+
+// withDefaults fills the classes p leaves unset from d. Either may be nil.
+func (p *retryPolicy) withDefaults(d *retryPolicy) *retryPolicy {
+	if p == nil {
+		return d
+	}
+	if d == nil {
+		return p
+	}
+	merged := *p
+	for _, f := range []struct{ dst, src **retryClass }{
+		{&merged.Throttle, &d.Throttle},
+		{&merged.Auth, &d.Auth},
+		{&merged.NotFound, &d.NotFound},
+		{&merged.Unknown, &d.Unknown},
+	} {
+		if *f.dst == nil {
+			*f.dst = *f.src
+		}
+	}
+	return &merged
+}
+
+// maxAttempts returns the largest attempt count of any class, or 0.
+func (p *retryPolicy) maxAttempts() int {
+	n := 0
+	for _, c := range []*retryClass{p.Throttle, p.Auth, p.NotFound, p.Unknown} {
+		if c != nil && c.MaxAttempts > n {
+			n = c.MaxAttempts
+		}
+	}
+	return n
+}
+
+// classRetryer applies a retryPolicy on top of the client's retryer, which
+// still provides retry tokens, rate limiting and the defaults of unset classes.
+// Clients using it need addRetryAttempts, so no retry token is taken for an
+// error whose class has run out of attempts.
+type classRetryer struct {
+	aws.RetryerV2
+	policy *retryPolicy
+}
+
+// retryAttemptsKey is the context key of a request's *retryAttempts.
+type retryAttemptsKey struct{}
+
+// retryAttempts counts the attempts of one request. The SDK tells only
+// RetryDelay the attempt number, after the retry token is taken.
+type retryAttempts struct{ n int }
+
+// addRetryAttempts is an API option counting the attempts of each request
+// for classRetryer.
+func addRetryAttempts(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("RetryAttempts",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			return next.HandleInitialize(context.WithValue(ctx, retryAttemptsKey{}, &retryAttempts{}), in)
+		}), middleware.After)
+}
+
+// MaxAttempts is the largest limit of any class, so the SDK keeps retrying
+// up to the limit of the error's class.
+func (r *classRetryer) MaxAttempts() int {
+	return max(r.RetryerV2.MaxAttempts(), r.policy.maxAttempts())
+}
+
+// limit returns the number of attempts allowed for err.
+func (r *classRetryer) limit(err error) int {
+	if c := r.policy.forClass(classifyError(err)); c != nil {
+		return c.MaxAttempts
+	}
+	return r.RetryerV2.MaxAttempts()
+}
+
+// IsErrorRetryable makes auth and not-found errors retryable when their class
+// allows more than one attempt. Other errors are retried only when the
+// client's retryer considers them transient, so e.g. validation errors in the
+// unknown class are never retried.
+func (r *classRetryer) IsErrorRetryable(err error) bool {
+	class := classifyError(err)
+	c := r.policy.forClass(class)
+	if c == nil {
+		return r.RetryerV2.IsErrorRetryable(err)
+	}
+	if c.MaxAttempts <= 1 {
+		return false
+	}
+	return class == errorClassAuth || class == errorClassNotFound || r.RetryerV2.IsErrorRetryable(err)
+}
+
+// GetAttemptToken counts the attempt of the request.
+func (r *classRetryer) GetAttemptToken(ctx context.Context) (func(error) error, error) {
+	if a, ok := ctx.Value(retryAttemptsKey{}).(*retryAttempts); ok {
+		a.n++
+	}
+	return r.RetryerV2.GetAttemptToken(ctx)
+}
+
+// GetRetryToken takes no retry quota once the error's class has run out of
+// attempts: RetryDelay then stops the request, and the SDK never releases
+// the token of a retry it does not make.
+func (r *classRetryer) GetRetryToken(ctx context.Context, opErr error) (func(error) error, error) {
+	if a, ok := ctx.Value(retryAttemptsKey{}).(*retryAttempts); ok && a.n >= r.limit(opErr) {
+		return func(error) error { return nil }, nil
+	}
+	return r.RetryerV2.GetRetryToken(ctx, opErr)
+}
+
+func (r *classRetryer) RetryDelay(attempt int, err error) (time.Duration, error) {
+	if attempt >= r.limit(err) {
+		return 0, &retry.MaxAttemptsError{Attempt: attempt, Err: err}
+	}
+	c := r.policy.forClass(classifyError(err))
+	if c == nil || c.MaxBackoff == "" {
+		return r.RetryerV2.RetryDelay(attempt, err)
+	}
+	maxBackoff, _ := time.ParseDuration(c.MaxBackoff) // validated
+	return retry.NewExponentialJitterBackoff(maxBackoff).BackoffDelay(attempt, err)
+}
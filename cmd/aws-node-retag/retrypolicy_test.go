@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	smithy "github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+func apiError(code string) error {
+	return &smithy.GenericAPIError{Code: code, Message: "test"}
+}
+
+func TestClassifyError(t *testing.T) {
+	cases := map[string]string{
+		"RequestLimitExceeded":       errorClassThrottle,
+		"UnauthorizedOperation":      errorClassAuth,
+		"AuthFailure":                errorClassAuth,
+		"InvalidInstanceID.NotFound": errorClassNotFound,
+		"InvalidVolume.NotFound":     errorClassNotFound,
+		"InternalError":              errorClassUnknown,
+	}
+	for code, want := range cases {
+		if got := classifyError(apiError(code)); got != want {
+			t.Errorf("classifyError(%s) = %s, want %s", code, got, want)
+		}
+	}
+	if got := classifyError(errors.New("connection reset")); got != errorClassUnknown {
+		t.Errorf("classifyError(non-API error) = %s, want %s", got, errorClassUnknown)
+	}
+}
+
+func TestClassRetryer(t *testing.T) {
+	r := regionOptions{
+		MaxAttempts: 3,
+		RetryPolicy: &retryPolicy{
+			Throttle: &retryClass{MaxAttempts: 10, MaxBackoff: "1s"},
+			Auth:     &retryClass{MaxAttempts: 1},
+			NotFound: &retryClass{MaxAttempts: 4},
+		},
+	}.retryer()()
+
+	if n := r.MaxAttempts(); n != 10 {
+		t.Errorf("MaxAttempts = %d, want the largest class limit 10", n)
+	}
+
+	throttle := apiError("RequestLimitExceeded")
+	if !r.IsErrorRetryable(throttle) {
+		t.Error("throttling should be retryable")
+	}
+	if d, err := r.RetryDelay(5, throttle); err != nil || d > time.Second {
+		t.Errorf("RetryDelay(5, throttle) = %s, %v; want at most 1s", d, err)
+	}
+	if _, err := r.RetryDelay(10, throttle); !errors.As(err, new(*retry.MaxAttemptsError)) {
+		t.Errorf("RetryDelay(10, throttle) err = %v, want MaxAttemptsError", err)
+	}
+
+	if r.IsErrorRetryable(apiError("UnauthorizedOperation")) {
+		t.Error("auth errors should never be retried with maxAttempts 1")
+	}
+
+	notFound := apiError("InvalidInstanceID.NotFound")
+	if !r.IsErrorRetryable(notFound) {
+		t.Error("not-found errors should be retryable with maxAttempts 4")
+	}
+	if _, err := r.RetryDelay(3, notFound); err != nil {
+		t.Errorf("RetryDelay(3, notFound) err = %v, want a retry", err)
+	}
+	if _, err := r.RetryDelay(4, notFound); err == nil {
+		t.Error("RetryDelay(4, notFound) should stop retrying")
+	}
+
+	// Unset classes keep the client's limit and retryability.
+	internal := apiError("InternalError")
+	if _, err := r.RetryDelay(3, internal); err == nil {
+		t.Error("RetryDelay(3, unknown) should stop at the client's 3 attempts")
+	}
+	if r.IsErrorRetryable(apiError("InvalidParameterValue")) {
+		t.Error("validation errors should not be retried")
+	}
+}
+
+func TestRetryPolicyWithDefaults(t *testing.T) {
+	d := &retryPolicy{Throttle: &retryClass{MaxAttempts: 10}, Auth: &retryClass{MaxAttempts: 1}}
+	p := (&retryPolicy{Throttle: &retryClass{MaxAttempts: 20}}).withDefaults(d)
+	if p.Throttle.MaxAttempts != 20 || p.Auth != d.Auth || p.NotFound != nil {
+		t.Errorf("merged policy = %+v", p)
+	}
+	if (*retryPolicy)(nil).withDefaults(d) != d {
+		t.Error("nil policy should use the defaults")
+	}
+}
+
+// erroringHTTP fails every EC2 call with code, counting the calls.
+type erroringHTTP struct {
+	code  string
+	calls *int
+}
+
+func (h erroringHTTP) Do(*http.Request) (*http.Response, error) {
+	*h.calls++
+	return &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Body: io.NopCloser(strings.NewReader(`<Response><Errors><Error><Code>` + h.code +
+			`</Code><Message>test</Message></Error></Errors><RequestID>req-1</RequestID></Response>`)),
+	}, nil
+}
+
+func TestClassRetryerQuota(t *testing.T) {
+	for _, code := range []string{"UnauthorizedOperation", "InvalidInstanceID.NotFound"} {
+		t.Run(code, func(t *testing.T) {
+			quota := ratelimit.NewTokenRateLimit(500)
+			retryer := &classRetryer{
+				RetryerV2: retry.NewStandard(func(o *retry.StandardOptions) {
+					o.MaxAttempts = 5
+					o.RateLimiter = quota
+					o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+				}),
+				policy: &retryPolicy{Auth: &retryClass{MaxAttempts: 2, MaxBackoff: "1ms"}, NotFound: &retryClass{MaxAttempts: 2, MaxBackoff: "1ms"}},
+			}
+			calls := 0
+			client := ec2.New(ec2.Options{
+				Region: "us-east-1", HTTPClient: erroringHTTP{code: code, calls: &calls}, Credentials: aws.AnonymousCredentials{},
+				Retryer: retryer, APIOptions: []func(*middleware.Stack) error{addRetryAttempts},
+			})
+			if _, err := client.DescribeInstances(context.Background(), &ec2.DescribeInstancesInput{}); err == nil {
+				t.Fatal("DescribeInstances succeeded")
+			}
+			if calls != 2 {
+				t.Errorf("attempts = %d, want the class's 2", calls)
+			}
+			// The one retry made costs a token; running out of the class's
+			// attempts costs none.
+			if got, want := quota.Remaining(), uint(500-retry.DefaultRetryCost); got != want {
+				t.Errorf("retry quota = %d, want %d", got, want)
+			}
+		})
+	}
+}
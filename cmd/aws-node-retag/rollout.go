@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// rolloutAnnotation set to "true" on a node marks it as being replaced by a
+// node pool rolling upgrade. Upgrade tooling sets it on the nodes of the pool
+// before surging new ones and the rollout ends once those nodes are deleted
+// or the annotation is removed:
+//
+//	kubectl annotate nodes -l eks.amazonaws.com/nodegroup=ng-1 aws-node-retag.io/rollout-in-progress=true
+const rolloutAnnotation = "aws-node-retag.io/rollout-in-progress"
+
+// rolloutState tracks the nodes carrying the rollout annotation
+// (ROLLOUT_AWARE). While any does, for at most ROLLOUT_MAX_DURATION, the
+// reconciles of untagged nodes run ahead of the other queued work of their
+// region and periodic audits and volume sweeps skip their rounds, leaving
+// the EC2 API rate to the surge nodes. A nil *rolloutState is never active.
+type rolloutState struct {
+	maxDuration time.Duration
+	metrics     *metrics
+	logger      *slog.Logger
+	// now is overridable in tests.
+	now func() time.Time
+
+	mu sync.Mutex
+	// nodes are the names of the annotated nodes.
+	nodes map[string]bool
+	// since is when the first of them was seen.
+	since time.Time
+	// expired is set once the rollout outlasted maxDuration.
+	expired bool
+}
+
+// newRolloutState returns nil unless ROLLOUT_AWARE is set.
+func newRolloutState(cfg *Config, m *metrics, logger *slog.Logger) *rolloutState {
+	if !cfg.RolloutAware {
+		return nil
+	}
+	return &rolloutState{maxDuration: cfg.RolloutMaxDuration, metrics: m, logger: logger, now: time.Now, nodes: map[string]bool{}}
+}
+
+// observe records whether node carries the rollout annotation.
+func (r *rolloutState) observe(node *corev1.Node) {
+	if r == nil {
+		return
+	}
+	r.set(node.Name, node.Annotations[rolloutAnnotation] == "true")
+}
+
+// forget drops a deleted node.
+func (r *rolloutState) forget(name string) {
+	if r == nil {
+		return
+	}
+	r.set(name, false)
+}
+
+func (r *rolloutState) set(name string, annotated bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if annotated == r.nodes[name] {
+		return
+	}
+	if !annotated {
+		delete(r.nodes, name)
+		if len(r.nodes) == 0 {
+			if !r.expired {
+				r.logger.Info("node pool rollout finished, resuming audits and volume sweeps", "duration", r.now().Sub(r.since).Round(time.Second))
+			}
+			r.expired = false
+			r.metrics.rolloutInProgress.Set(0)
+		}
+		return
+	}
+	if len(r.nodes) == 0 {
+		r.since = r.now()
+		r.logger.Info("node pool rollout in progress: tagging new nodes first, suspending audits and volume sweeps",
+			"annotation", rolloutAnnotation, "maxDuration", r.maxDuration)
+		r.metrics.rolloutInProgress.Set(1)
+	}
+	r.nodes[name] = true
+}
+
+// active reports whether a rollout is in progress.
+func (r *rolloutState) active() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.nodes) == 0 || r.expired {
+		return false
+	}
+	if r.maxDuration > 0 && r.now().Sub(r.since) >= r.maxDuration {
+		r.expired = true
+		r.metrics.rolloutInProgress.Set(0)
+		r.logger.Warn("node pool rollout outlasted ROLLOUT_MAX_DURATION, resuming normal operation; remove the annotation from the remaining nodes",
+			"annotation", rolloutAnnotation, "nodes", len(r.nodes), "maxDuration", r.maxDuration)
+		return false
+	}
+	return true
+}
+
+// urgent reports whether the reconcile of node runs ahead of other work: it
+// is not tagged yet and a rollout is in progress.
+func (t *Tagger) urgent(node *corev1.Node) bool {
+	return !t.isTagged(node.Annotations) && t.rollout.active()
+}
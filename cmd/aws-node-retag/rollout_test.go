@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func rolloutNode(name string, annotations map[string]string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations},
+		Spec:       corev1.NodeSpec{ProviderID: "aws:///us-east-1a/i-0123456789abcdef0"},
+	}
+}
+
+func TestRolloutState(t *testing.T) {
+	m := newMetrics("")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	if r := newRolloutState(&Config{}, m, logger); r != nil || r.active() {
+		t.Fatal("rollout state without ROLLOUT_AWARE")
+	}
+	r := newRolloutState(&Config{RolloutAware: true, RolloutMaxDuration: time.Hour}, m, logger)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	old := map[string]string{rolloutAnnotation: "true"}
+
+	r.observe(rolloutNode("old-1", old))
+	r.observe(rolloutNode("old-2", old))
+	r.observe(rolloutNode("new-1", nil))
+	if !r.active() || testutil.ToFloat64(m.rolloutInProgress) != 1 {
+		t.Fatal("rollout not active with annotated nodes")
+	}
+	// The rollout lasts until the last annotated node is deleted or loses
+	// the annotation.
+	r.forget("old-1")
+	if !r.active() {
+		t.Error("rollout ended with an annotated node left")
+	}
+	r.observe(rolloutNode("old-2", map[string]string{rolloutAnnotation: "false"}))
+	if r.active() || testutil.ToFloat64(m.rolloutInProgress) != 0 {
+		t.Error("rollout still active without annotated nodes")
+	}
+
+	// A rollout outlasting ROLLOUT_MAX_DURATION is ignored until it ends.
+	r.observe(rolloutNode("old-3", old))
+	now = now.Add(time.Hour)
+	if r.active() || testutil.ToFloat64(m.rolloutInProgress) != 0 {
+		t.Error("rollout active past ROLLOUT_MAX_DURATION")
+	}
+	r.forget("old-3")
+	r.observe(rolloutNode("old-4", old))
+	if !r.active() {
+		t.Error("new rollout not active after an expired one ended")
+	}
+}
+
+func TestRolloutQueuesNewNodesFirst(t *testing.T) {
+	tagger := newStartupTagger(fake.NewSimpleClientset(), &instanceEC2{})
+	tagger.rollout = newRolloutState(&Config{RolloutAware: true}, tagger.metrics, tagger.logger)
+	// No workers run, so every item stays queued.
+	p := newWorkPool(1, func(fn func()) { fn() })
+	h := tagger.nodeEventHandler(context.Background(), p)
+
+	h.AddFunc(rolloutNode("before", nil))
+	h.AddFunc(rolloutNode("old", map[string]string{rolloutAnnotation: "true", annotationKey: annotationValue}))
+	h.AddFunc(rolloutNode("surge", nil))
+	if got := p.queues["us-east-1"]; len(got) != 3 || got[0] != "node/surge" {
+		t.Errorf("queue = %v, want the surge node first", got)
+	}
+
+	h.DeleteFunc = tagger.nodeDeleteFunc(context.Background(), p, nil, false)
+	h.DeleteFunc(rolloutNode("old", nil))
+	if tagger.rollout.active() {
+		t.Error("rollout active after the annotated node was deleted")
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+	"github.com/robfig/cron/v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// policyScheduleInterval is how often TagPolicy schedules are re-evaluated.
+const policyScheduleInterval = 30 * time.Second
+
+// tagScheduleSpec limits a TagPolicy to time windows. Outside its windows the
+// policy contributes no tags, and the tags it wrote are removed when a window
+// closes.
+type tagScheduleSpec struct {
+	// Cron opens a window at every time matching the standard five-field
+	// expression, e.g. "0 2 * * 0" for Sundays at 02:00.
+	Cron string `json:"cron,omitempty"`
+	// Duration is how long each cron window stays open, e.g. "4h".
+	Duration string `json:"duration,omitempty"`
+	// TimeZone is the IANA time zone cron is evaluated in; UTC by default.
+	TimeZone string `json:"timeZone,omitempty"`
+	// NotBefore and NotAfter bound the policy to an absolute period, e.g. for
+	// a temporary campaign tag. Either may be omitted.
+	NotBefore *metav1.Time `json:"notBefore,omitempty"`
+	NotAfter  *metav1.Time `json:"notAfter,omitempty"`
+}
+
+// policySchedule is a validated tagScheduleSpec.
+type policySchedule struct {
+	cron      cron.Schedule
+	duration  time.Duration
+	location  *time.Location
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+func compileSchedule(spec *tagScheduleSpec) (*policySchedule, error) {
+	s := &policySchedule{location: time.UTC}
+	if spec.NotBefore != nil {
+		s.notBefore = spec.NotBefore.Time
+	}
+	if spec.NotAfter != nil {
+		s.notAfter = spec.NotAfter.Time
+	}
+	if !s.notBefore.IsZero() && !s.notAfter.IsZero() && !s.notBefore.Before(s.notAfter) {
+		return nil, fmt.Errorf("notBefore must be before notAfter")
+	}
+	if spec.TimeZone != "" {
+		loc, err := time.LoadLocation(spec.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("timeZone: %w", err)
+		}
+		s.location = loc
+	}
+	switch {
+	case spec.Cron == "" && spec.Duration != "":
+		return nil, fmt.Errorf("duration requires cron")
+	case spec.Cron == "":
+		if s.notBefore.IsZero() && s.notAfter.IsZero() {
+			return nil, fmt.Errorf("set cron and duration, notBefore or notAfter")
+		}
+		return s, nil
+	case spec.Duration == "":
+		return nil, fmt.Errorf("cron requires duration")
+	}
+	var err error
+	if s.cron, err = cron.ParseStandard(spec.Cron); err != nil {
+		return nil, fmt.Errorf("cron: %w", err)
+	}
+	if s.duration, err = time.ParseDuration(spec.Duration); err != nil {
+		return nil, fmt.Errorf("duration: %w", err)
+	}
+	if s.duration <= 0 {
+		return nil, fmt.Errorf("duration must be positive, got %s", s.duration)
+	}
+	return s, nil
+}
+
+// active reports whether now falls within one of the schedule's windows.
+func (s *policySchedule) active(now time.Time) bool {
+	if !s.notBefore.IsZero() && now.Before(s.notBefore) {
+		return false
+	}
+	if !s.notAfter.IsZero() && !now.Before(s.notAfter) {
+		return false
+	}
+	if s.cron == nil {
+		return true
+	}
+	// A window is open if the schedule fired within the last duration.
+	return !s.cron.Next(now.Add(-s.duration).In(s.location)).After(now)
+}
+
+// runSchedules re-evaluates the policy schedules and TTLs every
+// policyScheduleInterval until ctx is done. onOpen is called for each policy
+// whose window opened, so its tags are applied; policies whose window closed
+// or whose TTL expired go to s.onClose.
+func (s *policyStore) runSchedules(ctx context.Context, onOpen func(*compiledPolicy), logger *slog.Logger) {
+	ticker := time.NewTicker(policyScheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		opened, closed, expired := s.tick()
+		for _, p := range opened {
+			logger.Info("TagPolicy schedule window opened", "policy", p.name)
+			onOpen(p)
+		}
+		for _, p := range closed {
+			if expired[p.name] {
+				logger.Info("TagPolicy TTL expired", "policy", p.name, "ttl", p.ttl)
+			} else {
+				logger.Info("TagPolicy schedule window closed", "policy", p.name)
+			}
+			if s.onClose != nil {
+				s.onClose(p)
+			}
+		}
+	}
+}
+
+// tick refreshes the published policies. Besides the policies refresh
+// reports, closed holds those that expired while the controller was down,
+// whose tags are still to be removed; they are only reported here, once the
+// node cache has had time to sync. expired names the closed policies whose
+// TTL ran out.
+func (s *policyStore) tick() (opened, closed []*compiledPolicy, expired map[string]bool) {
+	s.mu.Lock()
+	opened, closed = s.refresh()
+	expired = map[string]bool{}
+	for _, p := range s.expiredUnhandled(s.now()) {
+		expired[p.name] = true
+		if !slices.ContainsFunc(closed, func(c *compiledPolicy) bool { return c.name == p.name }) {
+			closed = append(closed, p)
+		}
+	}
+	s.mu.Unlock()
+	s.flushTTLs()
+	return opened, closed, expired
+}
+
+// untagPolicy removes the tags of a policy whose window closed or whose TTL
+// expired from the resources of the nodes and bound PVs it selects. A tag is
+// kept when the resource still gets the same value from TAGS or another
+// policy, and is only removed while it carries the value the policy wrote.
+func (t *Tagger) untagPolicy(ctx context.Context, p *compiledPolicy, nodes corelisters.NodeLister, pvs corelisters.PersistentVolumeLister) {
+	if p.dryRun {
+		return
+	}
+	log := t.logger.With("policy", p.name)
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	if p.resources[resourceInstance] || p.resources[resourceVolume] {
+		nodeList, err := nodes.List(p.selector)
+		if err != nil {
+			log.Error("failed to list nodes from cache", "error", err)
+			return
+		}
+		for _, node := range nodeList {
+			if !t.isTagged(node.Annotations) {
+				continue
+			}
+			d := t.resolveNode(ctx, node, true)
+			if d.Action != actionTag {
+				continue
+			}
+			nodeLog := log.With("node", node.Name, "instanceID", d.InstanceID)
+			inst, err := t.describeInstance(ctx, d.Region, d.InstanceID)
+			if err != nil {
+				nodeLog.Error("failed to describe instance", "error", err)
+				t.metrics.failed(kindNode)
+				continue
+			}
+			volumeIDs := attachedVolumes(inst)
+			desired := t.nodeResourceTags(node, d, inst, volumeIDs, quiet)
+			var ids []string
+			if p.resources[resourceInstance] {
+				ids = append(ids, d.InstanceID)
+			}
+			if p.resources[resourceVolume] {
+				ids = append(ids, volumeIDs...)
+			}
+			if err := t.removePolicyTags(ctx, d.Region, p, ids, desired); err != nil {
+				nodeLog.Error("failed to remove TagPolicy tags", "error", err)
+				t.metrics.failed(kindNode)
+				continue
+			}
+			t.metrics.untagged.WithLabelValues(kindNode).Inc()
+		}
+	}
+
+	if p.resources[resourcePersistentVolume] {
+		pvList, err := pvs.List(p.selector)
+		if err != nil {
+			log.Error("failed to list persistent volumes from cache", "error", err)
+			return
+		}
+		snap := t.current()
+		for _, pv := range pvList {
+			volumeID := ebsVolumeID(pv)
+			if pv.Status.Phase != corev1.VolumeBound || !t.isTagged(pv.Annotations) || volumeID == "" {
+				continue
+			}
+			region, err := parseRegionFromPV(pv)
+			if err != nil || !t.regionAllowed(region) {
+				continue
+			}
+			tags, _ := snap.resourceTags(snap.tags, resourcePersistentVolume, pv.Labels, quiet)
+			desired := map[string]map[string]string{volumeID: tags}
+			if err := t.removePolicyTags(ctx, region, p, []string{volumeID}, desired); err != nil {
+				log.Error("failed to remove TagPolicy tags", "pv", pv.Name, "error", err)
+				t.metrics.failed(kindPV)
+				continue
+			}
+			t.metrics.untagged.WithLabelValues(kindPV).Inc()
+		}
+	}
+}
+
+// removePolicyTags deletes the policy's tags from each resource, except the
+// keys that desired (per resource ID) still assigns the same value. Resources
+// absent from desired are not managed by the controller and are left alone.
+func (t *Tagger) removePolicyTags(ctx context.Context, region string, p *compiledPolicy, resourceIDs []string, desired map[string]map[string]string) error {
+	for _, id := range resourceIDs {
+		want, ok := desired[id]
+		if !ok {
+			continue
+		}
+		remove := map[string]*string{}
+		for k, v := range p.tags {
+			if w, ok := want[k]; !ok || !awstags.SameValue(w, v) {
+				remove[k] = aws.String(v)
+			}
+		}
+		if len(remove) == 0 {
+			continue
+		}
+		if err := t.deleteTags(ctx, p.roleARN, region, id, remove); err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(remove))
+		for k := range remove {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		t.logger.Info("removed the tags of an inactive TagPolicy", "policy", p.name, "resource", id, "keys", keys)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCompileSchedule(t *testing.T) {
+	at := func(s string) *metav1.Time {
+		ts, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &metav1.Time{Time: ts}
+	}
+	cases := []struct {
+		name    string
+		spec    tagScheduleSpec
+		wantErr bool
+	}{
+		{"cron window", tagScheduleSpec{Cron: "0 2 * * 0", Duration: "4h", TimeZone: "Europe/Berlin"}, false},
+		{"campaign", tagScheduleSpec{NotBefore: at("2026-11-01T00:00:00Z"), NotAfter: at("2026-12-01T00:00:00Z")}, false},
+		{"empty", tagScheduleSpec{}, true},
+		{"cron without duration", tagScheduleSpec{Cron: "0 2 * * 0"}, true},
+		{"duration without cron", tagScheduleSpec{Duration: "1h"}, true},
+		{"bad cron", tagScheduleSpec{Cron: "every sunday", Duration: "1h"}, true},
+		{"bad zone", tagScheduleSpec{Cron: "0 2 * * 0", Duration: "1h", TimeZone: "Mars/Olympus"}, true},
+		{"reversed period", tagScheduleSpec{NotBefore: at("2026-12-01T00:00:00Z"), NotAfter: at("2026-11-01T00:00:00Z")}, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := compileSchedule(&tc.spec)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	s, err := compileSchedule(&tagScheduleSpec{
+		Cron:      "0 2 * * 0", // Sundays 02:00 UTC
+		Duration:  "2h",
+		NotBefore: &metav1.Time{Time: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		now  time.Time
+		want bool
+	}{
+		{time.Date(2026, 10, 18, 1, 59, 0, 0, time.UTC), false},
+		{time.Date(2026, 10, 18, 2, 0, 0, 0, time.UTC), true},
+		{time.Date(2026, 10, 18, 3, 59, 0, 0, time.UTC), true},
+		{time.Date(2026, 10, 18, 4, 0, 0, 0, time.UTC), false},
+		{time.Date(2026, 10, 19, 2, 30, 0, 0, time.UTC), false}, // Monday
+		{time.Date(2026, 9, 27, 2, 30, 0, 0, time.UTC), false},  // before notBefore
+	} {
+		if got := s.active(tc.now); got != tc.want {
+			t.Errorf("active(%s) = %v, want %v", tc.now, got, tc.want)
+		}
+	}
+}
+
+func TestPolicyStoreScheduleTransitions(t *testing.T) {
+	var published []*compiledPolicy
+	store := newPolicyStore(func(p []*compiledPolicy) { published = p })
+	now := time.Date(2026, 10, 18, 1, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	var closedNames []string
+	store.onClose = func(p *compiledPolicy) { closedNames = append(closedNames, p.name) }
+
+	spec := tagPolicySpec{
+		Tags:     map[string]string{"PatchWindow": "sunday-2am"},
+		Schedule: &tagScheduleSpec{Cron: "0 2 * * 0", Duration: "2h"},
+	}
+	if _, err := store.set(newTestPolicy("patch", spec)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.set(newTestPolicy("static", tagPolicySpec{Tags: map[string]string{"a": "b"}})); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 1 || published[0].name != "static" {
+		t.Fatalf("published before the window = %v, want only the unscheduled policy", published)
+	}
+
+	now = now.Add(90 * time.Minute)
+	store.mu.Lock()
+	opened, closed := store.refresh()
+	store.mu.Unlock()
+	if len(opened) != 1 || opened[0].name != "patch" || len(closed) != 0 || len(published) != 2 {
+		t.Fatalf("window opening: opened %v, closed %v, published %d", opened, closed, len(published))
+	}
+
+	now = now.Add(3 * time.Hour)
+	store.mu.Lock()
+	opened, closed = store.refresh()
+	store.mu.Unlock()
+	if len(opened) != 0 || len(closed) != 1 || closed[0].name != "patch" || len(published) != 1 {
+		t.Fatalf("window closing: opened %v, closed %v, published %d", opened, closed, len(published))
+	}
+
+	// Deleting a policy leaves its tags in place, it is not reported as closed.
+	store.remove("static")
+	if len(closedNames) != 0 {
+		t.Errorf("onClose called for %v", closedNames)
+	}
+}
+
+func TestRemovePolicyTags(t *testing.T) {
+	api := &fakeEC2{}
+	tagger := &Tagger{
+		ec2:     fakeClients(api),
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		metrics: newMetrics(""),
+	}
+	p := &compiledPolicy{name: "campaign", tags: map[string]string{"Campaign": "fall", "Env": "prod"}}
+	desired := map[string]map[string]string{
+		"i-1":   {"Env": "prod"},
+		"vol-1": {"Env": "prod"},
+	}
+	// vol-2 is not managed by the controller and must not be touched.
+	if err := tagger.removePolicyTags(context.Background(), "us-east-1", p, []string{"i-1", "vol-1", "vol-2"}, desired); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.deleteTags) != 2 {
+		t.Fatalf("DeleteTags called %d times, want 2", len(api.deleteTags))
+	}
+	for _, in := range api.deleteTags {
+		if len(in.Tags) != 1 || aws.ToString(in.Tags[0].Key) != "Campaign" || aws.ToString(in.Tags[0].Value) != "fall" {
+			t.Errorf("DeleteTags(%v) tags = %v, want only Campaign=fall", in.Resources, in.Tags)
+		}
+	}
+}
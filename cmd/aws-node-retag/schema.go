@@ -0,0 +1,17 @@
+package main
+
+// Schema versions of the JSON documents the controller hands to other
+// systems: drift reports, failure notifications, heartbeat pings and decision
+// records. Each document carries its version in schemaVersion and is
+// described by schemas/<document>.v<version>.json at the root of the
+// repository.
+//
+// Within a version the documents only ever gain optional fields, so a
+// consumer written against it keeps working. Removing or renaming a field,
+// or changing its type or meaning, takes a new version.
+const (
+	auditReportSchemaVersion    = 1
+	notificationSchemaVersion   = 1
+	heartbeatSchemaVersion      = 1
+	decisionRecordSchemaVersion = 1
+)
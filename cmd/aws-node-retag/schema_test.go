@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// jsonSchema is the subset of JSON Schema used by schemas/.
+type jsonSchema struct {
+	Type       string                 `json:"type"`
+	Const      any                    `json:"const"`
+	Enum       []any                  `json:"enum"`
+	Required   []string               `json:"required"`
+	Properties map[string]*jsonSchema `json:"properties"`
+	// AdditionalProperties describes the values of maps.
+	AdditionalProperties *jsonSchema `json:"additionalProperties"`
+	Items                *jsonSchema `json:"items"`
+}
+
+func loadSchema(t *testing.T, name string) *jsonSchema {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("..", "..", "schemas", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s jsonSchema
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return &s
+}
+
+// check reports where v, a decoded JSON document, does not conform to s.
+// Properties missing from the schema are reported too, so a field added to
+// a document must be added to its schema.
+func (s *jsonSchema) check(path string, v any) []string {
+	var errs []string
+	if s.Const != nil && fmt.Sprint(s.Const) != fmt.Sprint(v) {
+		errs = append(errs, fmt.Sprintf("%s: %v, want %v", path, v, s.Const))
+	}
+	if len(s.Enum) > 0 && !slices.Contains(s.Enum, v) {
+		errs = append(errs, fmt.Sprintf("%s: %v is not one of %v", path, v, s.Enum))
+	}
+	var ok bool
+	switch s.Type {
+	case "object":
+		var obj map[string]any
+		if obj, ok = v.(map[string]any); ok {
+			for _, k := range s.Required {
+				if _, found := obj[k]; !found {
+					errs = append(errs, fmt.Sprintf("%s: missing required %q", path, k))
+				}
+			}
+			keys := make([]string, 0, len(obj))
+			for k := range obj {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				prop, known := s.Properties[k]
+				if !known {
+					prop, known = s.AdditionalProperties, s.AdditionalProperties != nil
+				}
+				if !known {
+					errs = append(errs, fmt.Sprintf("%s.%s: not in the schema", path, k))
+					continue
+				}
+				errs = append(errs, prop.check(path+"."+k, obj[k])...)
+			}
+		}
+	case "array":
+		var items []any
+		if items, ok = v.([]any); ok && s.Items != nil {
+			for i, item := range items {
+				errs = append(errs, s.Items.check(fmt.Sprintf("%s[%d]", path, i), item)...)
+			}
+		}
+	case "string":
+		_, ok = v.(string)
+	case "number":
+		_, ok = v.(float64)
+	case "integer":
+		var f float64
+		f, ok = v.(float64)
+		ok = ok && f == float64(int64(f))
+	default:
+		ok = true
+	}
+	if !ok {
+		errs = append(errs, fmt.Sprintf("%s: %v is not of type %s", path, v, s.Type))
+	}
+	return errs
+}
+
+// checkDocument encodes doc and checks it against the schema.
+func checkDocument(t *testing.T, schema string, doc any) {
+	t.Helper()
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range loadSchema(t, schema).check("$", v) {
+		t.Errorf("%s: %s", schema, e)
+	}
+}
+
+func TestPayloadSchemas(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// Every field is set, so that each is checked against the schema.
+	checkDocument(t, "audit-report.v1.json", &auditReport{
+		SchemaVersion: auditReportSchemaVersion,
+		GeneratedAt:   now,
+		Nodes:         1,
+		Resources:     2,
+		Drifted:       1,
+		Findings: []auditFinding{{
+			Node: "node-a", Region: "eu-west-1", Resource: "volume", ResourceID: "vol-1",
+			Status: driftMismatch, Key: "Team", Expected: "platform", Actual: "data",
+		}},
+		Stale:  []auditStale{{Node: "node-a", TaggedAt: now, Reason: "tags changed"}},
+		Errors: []auditError{{Node: "node-b", Error: "DescribeInstances: throttled"}},
+	})
+	checkDocument(t, "notification.v1.json", &notification{
+		SchemaVersion: notificationSchemaVersion,
+		Kind:          notifyFailureRate,
+		Time:          now,
+		Controller:    "blue",
+		Text:          "30% of node reconciles failed",
+		Node:          "node-a",
+		InstanceID:    "i-0123456789abcdef0",
+		Region:        "eu-west-1",
+		ErrorCode:     "UnauthorizedOperation",
+		Error:         "CreateTags: denied",
+		Failures:      3,
+		FailureRate:   0.3,
+		Reconciles:    10,
+		Window:        "10m0s",
+	})
+	record := newDecisionRecord(
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a", Labels: map[string]string{"team": "web"}}},
+		&nodeDecision{Action: actionTag, InstanceID: "i-0123456789abcdef0", Region: "eu-west-1", Nodegroup: "ng-1",
+			Policies: []policyMatch{{Name: "web", Matched: true}},
+			snapshot: (&tagSnapshot{tags: map[string]string{"Env": "prod"}, resolution: resolvePriority}).withPolicies(conflictingPolicies(t))},
+		map[string]map[string]string{"i-0123456789abcdef0": {"Team": "web"}, "vol-1": {"Team": "web"}}, "blue", now, errors.New("CreateTags: denied"))
+	checkDocument(t, "decision-record.v1.json", record)
+	checkDocument(t, "heartbeat.v1.json", &heartbeatPing{
+		SchemaVersion: heartbeatSchemaVersion,
+		Kind:          heartbeatReconcile,
+		Time:          now,
+		Controller:    "blue",
+		Reconcile:     &heartbeatReconcileSummary{Since: now, Nodes: 4, Failures: 1},
+		Audit:         &heartbeatAuditSummary{Nodes: 4, Resources: 9, Drifted: 1, Errors: 0},
+	})
+
+	// Optional fields left empty are omitted, not sent as null.
+	checkDocument(t, "notification.v1.json", &notification{SchemaVersion: notificationSchemaVersion, Kind: notifyNodeFailed, Time: now, Text: "node-a failed"})
+	checkDocument(t, "audit-report.v1.json", &auditReport{SchemaVersion: auditReportSchemaVersion, GeneratedAt: now, Findings: []auditFinding{}})
+}
+
+func TestSchemaCheckRejects(t *testing.T) {
+	s := loadSchema(t, "heartbeat.v1.json")
+	for _, doc := range []string{
+		`{"schemaVersion":2,"kind":"audit","time":"2026-05-01T12:00:00Z"}`,
+		`{"schemaVersion":1,"kind":"other","time":"2026-05-01T12:00:00Z"}`,
+		`{"schemaVersion":1,"kind":"audit"}`,
+		`{"schemaVersion":1,"kind":"audit","time":"2026-05-01T12:00:00Z","extra":true}`,
+		`{"schemaVersion":1,"kind":"audit","time":"2026-05-01T12:00:00Z","audit":{"nodes":1.5,"resources":1,"drifted":0,"errors":0}}`,
+	} {
+		var v any
+		if err := json.Unmarshal([]byte(doc), &v); err != nil {
+			t.Fatal(err)
+		}
+		if errs := s.check("$", v); len(errs) == 0 {
+			t.Errorf("%s: no error", doc)
+		}
+	}
+}
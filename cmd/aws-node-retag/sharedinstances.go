@@ -0,0 +1,50 @@
+package main
+
+import awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+
+// Shared instances (SHARED_INSTANCES): one instance may back nodes of several
+// clusters, e.g. with virtual-kubelet or shared capacity, each cluster running
+// its own controller. To keep the controllers from undoing each other's
+// writes, every key is written under the cluster's CLUSTER_TAG_PREFIX, writes
+// are additive only (an existing value is never replaced) and a key already
+// carrying another value is reported as a conflict.
+
+// clusterKey returns key under the cluster tag prefix.
+func (t *Tagger) clusterKey(key string) string {
+	return t.keyPrefix + key
+}
+
+// clusterKeys returns tags with every key under the cluster tag prefix. The
+// map is returned as is when there is no prefix.
+func (t *Tagger) clusterKeys(tags map[string]string) map[string]string {
+	if t.keyPrefix == "" {
+		return tags
+	}
+	out := make(map[string]string, len(tags))
+	for k, v := range tags {
+		out[t.clusterKey(k)] = v
+	}
+	return out
+}
+
+// conflictingKeys returns, in order, the keys of desired that exist with
+// another value in existing.
+func conflictingKeys(desired, existing map[string]string) []string {
+	var keys []string
+	for _, c := range awstags.Diff(desired, existing) {
+		if c.Kind == awstags.Mismatch {
+			keys = append(keys, c.Key)
+		}
+	}
+	return keys
+}
+
+// reportConflicts counts and logs the desired tags of resourceID left alone
+// because another writer set the key to a different value.
+func (t *Tagger) reportConflicts(resourceID string, desired, existing map[string]string) {
+	for _, k := range conflictingKeys(desired, existing) {
+		t.metrics.conflicts.WithLabelValues(resourceKind(resourceID)).Inc()
+		t.logger.Warn("tag conflict: key already set to another value, leaving it",
+			"resource", resourceID, "key", k, "existing", loggedTagValue{k, existing[k]}, "desired", loggedTagValue{k, desired[k]})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestApplyTagsSharedInstance(t *testing.T) {
+	// Cluster b already tagged the instance; a third party set a/Team.
+	api := &taggingEC2{existing: map[string]map[string]string{
+		"i-1": {"b/Env": "staging", "a/Team": "data", "a/Env": "prod"},
+	}}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), api)
+	tagger.keyPrefix = "a/"
+	tagger.shared = true
+	tagger.preserve = &preservePolicy{}
+
+	tags := map[string]string{"Env": "prod", "Team": "platform", "CostCenter": "eng"}
+	if err := tagger.applyTags(context.Background(), "us-east-1", []string{"i-1"}, tags); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.createTags) != 1 {
+		t.Fatalf("CreateTags calls = %d, want 1", len(api.createTags))
+	}
+	got := map[string]string{}
+	for _, tag := range api.createTags[0].Tags {
+		got[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	if want := map[string]string{"a/CostCenter": "eng"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("written tags = %v, want %v", got, want)
+	}
+	if n := testutil.ToFloat64(tagger.metrics.conflicts.WithLabelValues("instance")); n != 1 {
+		t.Errorf("tag_conflicts_total{resource=instance} = %g, want 1", n)
+	}
+}
+
+func TestDeleteTagsClusterPrefix(t *testing.T) {
+	api := &fakeEC2{}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), api)
+	tagger.keyPrefix = "a/"
+
+	if err := tagger.deleteTags(context.Background(), "", "us-east-1", "vol-1", map[string]*string{"Env": aws.String("prod")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.deleteTags) != 1 || aws.ToString(api.deleteTags[0].Tags[0].Key) != "a/Env" {
+		t.Errorf("DeleteTags calls = %+v, want key a/Env", api.deleteTags)
+	}
+}
+
+func TestConflictingKeys(t *testing.T) {
+	got := conflictingKeys(
+		map[string]string{"a": "1", "b": "2", "c": "3"},
+		map[string]string{"a": "1", "b": "x", "c": "y", "d": "4"},
+	)
+	if want := []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("conflictingKeys() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"sort"
+
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// tagSnapshot is an immutable view of every input that determines the tags of
+// a resource: static tags, instance attribute tags and TagPolicies. A change
+// publishes a new snapshot instead of modifying the current one, and each
+// reconcile reads the snapshot once, so a node's instance and volumes are
+// always tagged from the same view even while policies change concurrently.
+//
+// Neither the snapshot nor the maps it holds may be modified once published.
+type tagSnapshot struct {
+	// version increases with every published snapshot.
+	version uint64
+
+	tags          map[string]string
+	attributeTags map[string]string
+	// inventoryTags maps node status attributes to tag keys (see
+	// inventory.go).
+	inventoryTags map[string]string
+	// rootVolumeTags and dataVolumeTags are merged over the node's tags for
+	// its root volume and its other volumes.
+	rootVolumeTags map[string]string
+	dataVolumeTags map[string]string
+	// policies are the valid TagPolicies in order of precedence: the last
+	// one setting a key wins a conflict (see conflicts.go).
+	policies []*compiledPolicy
+	// resolution is the POLICY_CONFLICT_RESOLUTION.
+	resolution string
+}
+
+// withPolicies returns a copy of the snapshot using the given policies,
+// ordered by precedence.
+func (s *tagSnapshot) withPolicies(policies []*compiledPolicy) *tagSnapshot {
+	next := *s
+	next.version++
+	next.policies = slices.Clone(policies)
+	sort.SliceStable(next.policies, func(i, j int) bool { return precedes(s.resolution, next.policies[i], next.policies[j]) })
+	return &next
+}
+
+// withTags returns a copy of the snapshot using the given env-var tags.
+func (s *tagSnapshot) withTags(src envTagSources) *tagSnapshot {
+	next := *s
+	next.version++
+	next.tags, next.rootVolumeTags, next.dataVolumeTags = src.tags, src.rootVolumeTags, src.dataVolumeTags
+	return &next
+}
+
+// current returns the snapshot in effect.
+func (t *Tagger) current() *tagSnapshot {
+	if s := t.snapshot.Load(); s != nil {
+		return s
+	}
+	return &tagSnapshot{}
+}
+
+// publishPolicies atomically replaces the snapshot's policies.
+func (t *Tagger) publishPolicies(policies []*compiledPolicy) {
+	t.publish(func(s *tagSnapshot) *tagSnapshot { return s.withPolicies(policies) })
+}
+
+// publishTags atomically replaces the snapshot's env-var tags (see
+// configMigration).
+func (t *Tagger) publishTags(src envTagSources) {
+	t.publish(func(s *tagSnapshot) *tagSnapshot { return s.withTags(src) })
+}
+
+// publish replaces the current snapshot with next(current), retrying when
+// another change was published concurrently.
+func (t *Tagger) publish(next func(*tagSnapshot) *tagSnapshot) {
+	for {
+		old := t.snapshot.Load()
+		cur := old
+		if cur == nil {
+			cur = &tagSnapshot{}
+		}
+		if t.snapshot.CompareAndSwap(old, next(cur)) {
+			return
+		}
+	}
+}
+
+// matching returns the policies, in order of precedence, that apply to resourceType
+// on an object with the given labels.
+func (s *tagSnapshot) matching(resourceType string, objLabels map[string]string) []*compiledPolicy {
+	var out []*compiledPolicy
+	for _, p := range s.policies {
+		if p.resources[resourceType] && p.selector.Matches(labels.Set(objLabels)) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// nodeTags returns the static tags merged with the tags derived from the
+// instance's attributes and the node's inventory.
+func (s *tagSnapshot) nodeTags(node *corev1.Node, inst *ec2types.Instance) map[string]string {
+	tags := make(map[string]string, len(s.tags)+len(s.attributeTags)+len(s.inventoryTags))
+	for k, v := range attributeTags(inst, s.attributeTags) {
+		tags[k] = v
+	}
+	for k, v := range inventoryTags(node, s.inventoryTags) {
+		tags[k] = v
+	}
+	for k, v := range s.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// resourceTags returns base merged with the tags of the policies that apply to
+// resourceType on an object with objLabels, and the names of those policies.
+// Policies override base, and conflicts between them are resolved by
+// precedence or skipped (see resolve).
+// Tags of dry-run policies are logged instead of returned. The result may be
+// base itself and must not be modified.
+func (s *tagSnapshot) resourceTags(base map[string]string, resourceType string, objLabels map[string]string, log *slog.Logger) (map[string]string, []string) {
+	matched := s.matching(resourceType, objLabels)
+	if len(matched) == 0 {
+		return base, nil
+	}
+	tags := make(map[string]string, len(base))
+	for k, v := range base {
+		tags[k] = v
+	}
+	names := make([]string, 0, len(matched))
+	for _, p := range matched {
+		names = append(names, p.name)
+		if p.dryRun {
+			log.Info("dry-run policy: would apply tags", "policy", p.name, "resourceType", resourceType, "tags", p.tags)
+		}
+	}
+	owners, _ := s.resolve(matched)
+	for k, p := range owners {
+		tags[k] = p.tags[k]
+	}
+	sort.Strings(names)
+	return tags, names
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSnapshotIsolation(t *testing.T) {
+	tagger := &Tagger{policies: newPolicyStore(nil)}
+	tagger.policies.publish = tagger.publishPolicies
+	tagger.snapshot.Store(&tagSnapshot{tags: map[string]string{"Env": "prod"}})
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "n1"},
+		Spec:       corev1.NodeSpec{ProviderID: "aws:///us-east-1a/i-0123456789abcdef0"},
+	}
+	before := tagger.decideNode(node, false)
+
+	if _, err := tagger.policies.set(newTestPolicy("team", tagPolicySpec{Tags: map[string]string{"Team": "a"}})); err != nil {
+		t.Fatal(err)
+	}
+	after := tagger.decideNode(node, false)
+
+	if after.ConfigVersion != before.ConfigVersion+1 {
+		t.Errorf("ConfigVersion = %d, want %d", after.ConfigVersion, before.ConfigVersion+1)
+	}
+	if len(before.snapshot.policies) != 0 || len(after.snapshot.policies) != 1 {
+		t.Errorf("policies before/after = %d/%d, want 0/1", len(before.snapshot.policies), len(after.snapshot.policies))
+	}
+	if after.snapshot.tags["Env"] != "prod" {
+		t.Errorf("static tags lost on publish: %v", after.snapshot.tags)
+	}
+
+	tagger.policies.remove("team")
+	if got := tagger.current(); len(got.policies) != 0 || got.version != after.ConfigVersion+1 {
+		t.Errorf("after remove: version %d, %d policies", got.version, len(got.policies))
+	}
+}
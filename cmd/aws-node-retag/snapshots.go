@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"golang.org/x/time/rate"
+)
+
+// snapshotFilterValues is the most values EC2 accepts in one filter, so the
+// volume-id filter of DescribeSnapshots is sent in batches of this size.
+const snapshotFilterValues = 200
+
+// snapshotPageSize is the MaxResults of each DescribeVolumes and
+// DescribeSnapshots page.
+const snapshotPageSize = 500
+
+// tagSnapshots tags the snapshots owned by the account whose source volume
+// carries every static tag with the static tags. Each DescribeVolumes and
+// DescribeSnapshots page waits for a token from limiter; CreateTags calls are
+// limited by the client as usual.
+func (t *Tagger) tagSnapshots(ctx context.Context, region string, limiter *rate.Limiter, log *slog.Logger) error {
+	tags := t.current().tags
+	if len(tags) == 0 {
+		return nil
+	}
+	api := t.ec2.forRegion(region)
+
+	written := t.clusterKeys(tags)
+	filters := make([]ec2types.Filter, 0, len(written))
+	for k, v := range written {
+		filters = append(filters, ec2types.Filter{Name: aws.String("tag:" + k), Values: []string{v}})
+	}
+	sort.Slice(filters, func(i, j int) bool { return *filters[i].Name < *filters[j].Name })
+
+	var volumeIDs []string
+	volumes := ec2.NewDescribeVolumesPaginator(api, &ec2.DescribeVolumesInput{
+		Filters:    filters,
+		MaxResults: aws.Int32(snapshotPageSize),
+	})
+	for volumes.HasMorePages() {
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+		page, err := volumes.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("DescribeVolumes: %w", err)
+		}
+		for _, v := range page.Volumes {
+			volumeIDs = append(volumeIDs, aws.ToString(v.VolumeId))
+		}
+	}
+
+	var seen, tagged int
+	for start := 0; start < len(volumeIDs); start += snapshotFilterValues {
+		batch := volumeIDs[start:min(start+snapshotFilterValues, len(volumeIDs))]
+		snapshots := ec2.NewDescribeSnapshotsPaginator(api, &ec2.DescribeSnapshotsInput{
+			OwnerIds:   []string{"self"},
+			Filters:    []ec2types.Filter{{Name: aws.String("volume-id"), Values: batch}},
+			MaxResults: aws.Int32(snapshotPageSize),
+		})
+		for snapshots.HasMorePages() {
+			if err := limiter.Wait(ctx); err != nil {
+				return err
+			}
+			page, err := snapshots.NextPage(ctx)
+			if err != nil {
+				return fmt.Errorf("DescribeSnapshots: %w", err)
+			}
+			var ids []string
+			for _, s := range page.Snapshots {
+				if !hasTags(s.Tags, written) {
+					ids = append(ids, aws.ToString(s.SnapshotId))
+				}
+			}
+			seen += len(page.Snapshots)
+			if len(ids) == 0 {
+				continue
+			}
+			if err := t.applyTags(ctx, region, ids, tags); err != nil {
+				return err
+			}
+			tagged += len(ids)
+			t.metrics.tagged.WithLabelValues(kindSnapshot).Add(float64(len(ids)))
+		}
+	}
+	log.Info("snapshot tagging complete", "volumes", len(volumeIDs), "snapshots", seen, "tagged", tagged)
+	return nil
+}
+
+// runSnapshotTagging tags the snapshots of managed volumes in each region
+// every interval, starting right away.
+func (t *Tagger) runSnapshotTagging(ctx context.Context, cfg *Config, regions []string, logger *slog.Logger) {
+	limiter := rate.NewLimiter(rate.Limit(cfg.SnapshotTagTPS), 1)
+	run := func() {
+		if len(t.current().tags) == 0 {
+			logger.Warn("TAGS is empty, no snapshots to tag")
+			return
+		}
+		for _, region := range regions {
+			log := logger.With("region", region)
+			if !t.regionAllowed(region) {
+				log.Warn("region not in allowed list, not tagging its snapshots")
+				continue
+			}
+			if !t.features.enabled(featureSnapshotTagging, region) {
+				continue
+			}
+			if err := t.tagSnapshots(ctx, region, limiter, log); err != nil && ctx.Err() == nil {
+				if t.features.denied(featureSnapshotTagging, region, err) {
+					continue
+				}
+				log.Error("snapshot tagging failed", "error", err)
+				t.metrics.failed(kindSnapshot)
+			}
+		}
+	}
+
+	run()
+	ticker := time.NewTicker(cfg.SnapshotTagInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			run()
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// snapshotsEC2 serves the tagged volumes and their snapshots, one snapshot
+// per page, using the index of the next snapshot as the pagination token.
+type snapshotsEC2 struct {
+	taggingEC2
+	volumes      []string
+	snapshots    []ec2types.Snapshot
+	volumeFilter []ec2types.Filter
+	pages        int
+}
+
+func (f *snapshotsEC2) DescribeVolumes(_ context.Context, in *ec2.DescribeVolumesInput, _ ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error) {
+	f.volumeFilter = in.Filters
+	out := &ec2.DescribeVolumesOutput{}
+	for _, id := range f.volumes {
+		out.Volumes = append(out.Volumes, ec2types.Volume{VolumeId: aws.String(id)})
+	}
+	return out, nil
+}
+
+func (f *snapshotsEC2) DescribeSnapshots(_ context.Context, in *ec2.DescribeSnapshotsInput, _ ...func(*ec2.Options)) (*ec2.DescribeSnapshotsOutput, error) {
+	f.pages++
+	wanted := map[string]bool{}
+	for _, id := range in.Filters[0].Values {
+		wanted[id] = true
+	}
+	start, _ := strconv.Atoi(aws.ToString(in.NextToken))
+	out := &ec2.DescribeSnapshotsOutput{}
+	for i := start; i < len(f.snapshots); i++ {
+		if !wanted[aws.ToString(f.snapshots[i].VolumeId)] {
+			continue
+		}
+		out.Snapshots = []ec2types.Snapshot{f.snapshots[i]}
+		if i+1 < len(f.snapshots) {
+			out.NextToken = aws.String(strconv.Itoa(i + 1))
+		}
+		break
+	}
+	return out, nil
+}
+
+func TestTagSnapshots(t *testing.T) {
+	snapshot := func(id, volume string, tags ...ec2types.Tag) ec2types.Snapshot {
+		return ec2types.Snapshot{SnapshotId: aws.String(id), VolumeId: aws.String(volume), Tags: tags}
+	}
+	api := &snapshotsEC2{
+		volumes: []string{"vol-1", "vol-2"},
+		snapshots: []ec2types.Snapshot{
+			snapshot("snap-1", "vol-1"),
+			snapshot("snap-2", "vol-1", ec2types.Tag{Key: aws.String("Env"), Value: aws.String("prod")}),
+			snapshot("snap-3", "vol-2"),
+			snapshot("snap-4", "vol-unmanaged"),
+		},
+	}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), api)
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	if err := tagger.tagSnapshots(context.Background(), "us-east-1", rate.NewLimiter(rate.Inf, 1), log); err != nil {
+		t.Fatal(err)
+	}
+	if f := api.volumeFilter; len(f) != 1 || aws.ToString(f[0].Name) != "tag:Env" || f[0].Values[0] != "prod" {
+		t.Errorf("volume filters = %+v, want tag:Env=prod", f)
+	}
+	var ids []string
+	for _, in := range api.createTags {
+		ids = append(ids, in.Resources...)
+	}
+	if len(ids) != 2 || ids[0] != "snap-1" || ids[1] != "snap-3" {
+		t.Errorf("tagged %v, want snap-1 and snap-3", ids)
+	}
+	if api.pages < 3 {
+		t.Errorf("DescribeSnapshots called %d times, want every page", api.pages)
+	}
+}
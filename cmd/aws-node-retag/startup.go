@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+)
+
+// cmdTagNode is the subcommand that tags a single node and exits, for use as
+// a DaemonSet init container.
+const cmdTagNode = "tag-node"
+
+// tagNodeInterval is how often the tag-node command retries.
+const tagNodeInterval = 5 * time.Second
+
+// hasStartupTaint reports whether the node carries the configured startup taint.
+func (t *Tagger) hasStartupTaint(node *corev1.Node) bool {
+	if t.startupTaint == "" {
+		return false
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == t.startupTaint {
+			return true
+		}
+	}
+	return false
+}
+
+// removeStartupTaint removes the startup taint (STARTUP_TAINT) from a node
+// whose resources are tagged, letting workloads schedule on it. Nodes
+// register with the taint (kubelet --register-with-taints), so nothing runs
+// on them before they are tagged.
+func (t *Tagger) removeStartupTaint(ctx context.Context, node *corev1.Node, log *slog.Logger) (err error) {
+	if !t.hasStartupTaint(node) {
+		return nil
+	}
+	ctx, span := startSpan(ctx, "remove startup taint", attribute.String("k8s.node.name", node.Name))
+	defer func() { endSpan(span, err) }()
+
+	if reason := t.writeBlocked(); reason != "" {
+		log.Info(reason+": would remove startup taint", "taint", t.startupTaint)
+		return nil
+	}
+
+	nodes := t.k8s.CoreV1().Nodes()
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cur, err := nodes.Get(ctx, node.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		taints := make([]corev1.Taint, 0, len(cur.Spec.Taints))
+		for _, taint := range cur.Spec.Taints {
+			if taint.Key != t.startupTaint {
+				taints = append(taints, taint)
+			}
+		}
+		if len(taints) == len(cur.Spec.Taints) {
+			return nil
+		}
+		// The resourceVersion makes the patch fail with a conflict if the
+		// taints changed since they were read.
+		patch, err := json.Marshal(map[string]any{
+			"metadata": map[string]any{"resourceVersion": cur.ResourceVersion},
+			"spec":     map[string]any{"taints": taints},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = nodes.Patch(ctx, node.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("remove startup taint %s: %w", t.startupTaint, err)
+	}
+	log.Info("removed startup taint", "taint", t.startupTaint)
+	return nil
+}
+
+// runTagNode implements the tag-node command: it tags the instance and volumes
+// of the node named by NODE_NAME, removes its startup taint and returns.
+// Transient failures are retried until TAG_NODE_TIMEOUT. A node that is not
+// to be tagged (e.g. not on AWS) returns without error and keeps its taint.
+func (t *Tagger) runTagNode(ctx context.Context, cfg *Config, k8sCfg *rest.Config) error {
+	if cfg.NodeName == "" {
+		return fmt.Errorf("%s requires NODE_NAME", cmdTagNode)
+	}
+	if cfg.TagPolicies {
+		dyn, err := dynamic.NewForConfig(k8sCfg)
+		if err != nil {
+			return fmt.Errorf("create dynamic client: %w", err)
+		}
+		if err := t.loadPolicies(ctx, dyn); err != nil {
+			return err
+		}
+	}
+	return t.tagLocalNode(ctx, cfg.NodeName, tagNodeInterval, cfg.TagNodeTimeout)
+}
+
+// loadPolicies lists the TagPolicies once and publishes the valid ones whose
+// schedule, if any, is active. A policy with a TTL is left out once the
+// expiresAt the controller reported for its generation has passed.
+func (t *Tagger) loadPolicies(ctx context.Context, dyn dynamic.Interface) error {
+	list, err := dyn.Resource(tagPolicyGVR).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("list TagPolicies: %w", err)
+	}
+	var compiled []*compiledPolicy
+	for i := range list.Items {
+		p, err := policyFromObject(&list.Items[i])
+		if err == nil {
+			var c *compiledPolicy
+			if c, err = compilePolicy(p); err == nil {
+				now := time.Now()
+				if (c.schedule == nil || c.schedule.active(now)) && !reportedExpired(p, now) {
+					compiled = append(compiled, c)
+				}
+				continue
+			}
+		}
+		t.logger.Warn("ignoring invalid TagPolicy", "policy", list.Items[i].GetName(), "error", err)
+	}
+	sort.Slice(compiled, func(i, j int) bool { return compiled[i].name < compiled[j].name })
+	t.publishPolicies(compiled)
+	return nil
+}
+
+// reportedExpired reports whether the status of a policy with a TTL says its
+// current generation expired before now.
+func reportedExpired(p *tagPolicy, now time.Time) bool {
+	st := p.Status
+	return p.Spec.TTL != "" && st.ExpiresAt != nil && st.ObservedGeneration == p.Generation && !now.Before(st.ExpiresAt.Time)
+}
+
+// tagLocalNode polls the node until it is tagged or will not be tagged.
+func (t *Tagger) tagLocalNode(ctx context.Context, nodeName string, interval, timeout time.Duration) error {
+	log := t.logger.With("node", nodeName)
+	ctx, span := startSpan(ctx, "tag-node", attribute.String("k8s.node.name", nodeName))
+	var lastErr error
+	err := wait.PollUntilContextTimeout(ctx, interval, timeout, true, func(ctx context.Context) (bool, error) {
+		node, err := t.k8s.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			lastErr = err
+			log.Warn("failed to get node, retrying", "error", err)
+			return false, nil
+		}
+
+		d := t.resolveNode(ctx, node, false)
+		switch d.Action {
+		case actionWait:
+			log.Info("providerID not yet set, waiting")
+			return false, nil
+		case actionError:
+			if d.Reason == "instance_lookup_failed" {
+				// The instance may not be visible in EC2 yet.
+				lastErr = errors.New(d.Detail)
+				log.Warn("failed to look the instance up by address, retrying", "error", d.Detail)
+				return false, nil
+			}
+			return false, fmt.Errorf("cannot tag node: %s: %s", d.Reason, d.Detail)
+		case actionSkip:
+			if d.Reason != "already_tagged" {
+				log.Warn("node will not be tagged, leaving any startup taint in place", "reason", d.Reason, "detail", d.Detail)
+				return true, nil
+			}
+		case actionTag:
+			log = log.With("instanceID", d.InstanceID, "region", d.Region)
+			if lastErr = t.tagInstance(ctx, node, d, log); lastErr != nil {
+				t.metrics.failed(kindNode)
+				return false, nil
+			}
+			if t.writeBlocked() == "" {
+				t.metrics.succeeded(kindNode)
+			}
+		}
+
+		if lastErr = t.removeStartupTaint(ctx, node, log); lastErr != nil {
+			log.Warn("failed to remove startup taint, retrying", "error", lastErr)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil && lastErr != nil && wait.Interrupted(err) {
+		err = fmt.Errorf("node %s not tagged within %s: %w", nodeName, timeout, lastErr)
+	}
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testStartupTaint = "aws-node-retag.io/untagged"
+
+// instanceEC2 serves a single instance with one attached volume.
+type instanceEC2 struct {
+	taggingEC2
+}
+
+func (f *instanceEC2) DescribeInstances(_ context.Context, in *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	return &ec2.DescribeInstancesOutput{Reservations: []ec2types.Reservation{{Instances: []ec2types.Instance{{
+		InstanceId: aws.String(in.InstanceIds[0]),
+		BlockDeviceMappings: []ec2types.InstanceBlockDeviceMapping{{
+			Ebs: &ec2types.EbsInstanceBlockDevice{VolumeId: aws.String("vol-root")},
+		}},
+	}}}}}, nil
+}
+
+func taintedNode(annotations map[string]string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "n1", Annotations: annotations},
+		Spec: corev1.NodeSpec{
+			ProviderID: "aws:///us-east-1a/i-0123456789abcdef0",
+			Taints: []corev1.Taint{
+				{Key: testStartupTaint, Effect: corev1.TaintEffectNoSchedule},
+				{Key: "dedicated", Value: "gpu", Effect: corev1.TaintEffectNoSchedule},
+			},
+		},
+	}
+}
+
+func newStartupTagger(k8s *fake.Clientset, api ec2API) *Tagger {
+	tagger := &Tagger{
+		k8s:          k8s,
+		ec2:          fakeClients(api),
+		startupTaint: testStartupTaint,
+		logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		metrics:      newMetrics(""),
+	}
+	tagger.snapshot.Store(&tagSnapshot{tags: map[string]string{"Env": "prod"}})
+	return tagger
+}
+
+func TestTagLocalNode(t *testing.T) {
+	k8s := fake.NewSimpleClientset(taintedNode(nil))
+	api := &instanceEC2{}
+	tagger := newStartupTagger(k8s, api)
+
+	if err := tagger.tagLocalNode(context.Background(), "n1", time.Millisecond, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.createTags) != 1 || len(api.createTags[0].Resources) != 2 {
+		t.Fatalf("CreateTags calls = %v, want one for the instance and its volume", api.createTags)
+	}
+
+	node, err := k8s.CoreV1().Nodes().Get(context.Background(), "n1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Annotations[annotationKey] != annotationValue {
+		t.Error("node was not annotated")
+	}
+	if len(node.Spec.Taints) != 1 || node.Spec.Taints[0].Key != "dedicated" {
+		t.Errorf("taints = %v, want only the unrelated taint", node.Spec.Taints)
+	}
+}
+
+func TestTagLocalNodeAlreadyTagged(t *testing.T) {
+	k8s := fake.NewSimpleClientset(taintedNode(map[string]string{annotationKey: annotationValue}))
+	api := &instanceEC2{}
+	tagger := newStartupTagger(k8s, api)
+
+	if err := tagger.tagLocalNode(context.Background(), "n1", time.Millisecond, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.createTags) != 0 {
+		t.Errorf("already-tagged node was tagged again: %v", api.createTags)
+	}
+	node, err := k8s.CoreV1().Nodes().Get(context.Background(), "n1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tagger.hasStartupTaint(node) {
+		t.Error("startup taint was not removed from the already-tagged node")
+	}
+}
+
+func TestTagLocalNodeTimesOutWithoutProviderID(t *testing.T) {
+	node := taintedNode(nil)
+	node.Spec.ProviderID = ""
+	tagger := newStartupTagger(fake.NewSimpleClientset(node), &instanceEC2{})
+
+	if err := tagger.tagLocalNode(context.Background(), "n1", time.Millisecond, 20*time.Millisecond); err == nil {
+		t.Fatal("expected a timeout while the providerID is unset")
+	}
+}
+
+func TestTagNodeReadOnly(t *testing.T) {
+	k8s := fake.NewSimpleClientset(taintedNode(nil))
+	api := &instanceEC2{}
+	tagger := newStartupTagger(k8s, api)
+	tagger.readOnly = true
+
+	node, _ := k8s.CoreV1().Nodes().Get(context.Background(), "n1", metav1.GetOptions{})
+	tagger.tagNode(context.Background(), node, true)
+	if len(api.createTags) != 0 {
+		t.Errorf("CreateTags calls in read-only mode: %v", api.createTags)
+	}
+	for _, a := range k8s.Actions() {
+		if a.GetVerb() != "get" && a.GetVerb() != "list" && a.GetVerb() != "watch" {
+			t.Errorf("Kubernetes write in read-only mode: %s %s", a.GetVerb(), a.GetResource().Resource)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	// loopMinBackoff and loopMaxBackoff bound the delay before a crashed
+	// loop is restarted; it doubles with every crash and starts over once
+	// the loop ran for loopMaxBackoff.
+	loopMinBackoff = time.Second
+	loopMaxBackoff = time.Minute
+	// serverShutdownTimeout bounds the wait for in-flight HTTP requests.
+	serverShutdownTimeout = 5 * time.Second
+)
+
+// supervisor owns the goroutines of the controller. They run in stages,
+// started in order during startup and stopped in a fixed order on shutdown
+// (see main), so that, e.g., the work pools finish their items before the
+// final metrics checkpoint and the HTTP servers stop last. A panicking
+// goroutine is logged with its stack and counted in
+// aws_node_retag_loop_panics_total{loop}; loops are restarted after a
+// backoff instead of taking the controller down.
+type supervisor struct {
+	metrics *metrics
+	logger  *slog.Logger
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+func newSupervisor(m *metrics, logger *slog.Logger) *supervisor {
+	return &supervisor{metrics: m, logger: logger, minBackoff: loopMinBackoff, maxBackoff: loopMaxBackoff}
+}
+
+// stage is a group of goroutines stopped together. Its context is
+// cancelled by stop or with its parent.
+type stage struct {
+	sup  *supervisor
+	name string
+	ctx  context.Context
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	// stops run on stop, last registered first, before waiting for the
+	// goroutines.
+	stops []func()
+}
+
+// stage returns a new stage under parent.
+func (s *supervisor) stage(parent context.Context, name string) *stage {
+	ctx, cancel := context.WithCancel(parent)
+	return &stage{sup: s, name: name, ctx: ctx, cancel: cancel}
+}
+
+// protect runs fn, recovering and counting a panic as one of loop. It
+// reports whether fn panicked.
+func (s *supervisor) protect(loop string, fn func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			s.metrics.loopPanics.WithLabelValues(loop).Inc()
+			s.logger.Error("recovered from panic", "loop", loop, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+		}
+	}()
+	fn()
+	return false
+}
+
+// loop runs fn until it returns, restarting it after a backoff when it
+// panics, unless the stage is stopped meanwhile.
+func (st *stage) loop(name string, fn func(ctx context.Context)) {
+	st.wg.Add(1)
+	go func() {
+		defer st.wg.Done()
+		s := st.sup
+		backoff := s.minBackoff
+		for {
+			started := time.Now()
+			if !s.protect(name, func() { fn(st.ctx) }) {
+				return
+			}
+			if time.Since(started) >= s.maxBackoff {
+				backoff = s.minBackoff
+			}
+			s.logger.Warn("restarting loop after panic", "loop", name, "stage", st.name, "backoff", backoff)
+			select {
+			case <-st.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, s.maxBackoff)
+		}
+	}()
+}
+
+// spawn runs fn once in the background, recovering a panic. A nil stage, as
+// in tests, runs it as a plain goroutine.
+func (st *stage) spawn(name string, fn func()) {
+	if st == nil {
+		go fn()
+		return
+	}
+	st.wg.Add(1)
+	go func() {
+		defer st.wg.Done()
+		st.sup.protect(name, fn)
+	}()
+}
+
+// onStop registers fn to run on stop, e.g. to shut an informer factory down.
+func (st *stage) onStop(fn func()) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.stops = append(st.stops, fn)
+}
+
+// serve runs an HTTP server on addr until the stage stops, then lets the
+// requests in flight finish for up to serverShutdownTimeout.
+func (st *stage) serve(name, addr string, handler http.Handler, logger *slog.Logger) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	st.loop(name+" server", func(ctx context.Context) {
+		errCh := make(chan error, 1)
+		go func() { errCh <- srv.ListenAndServe() }()
+		select {
+		case err := <-errCh:
+			if !errors.Is(err, http.ErrServerClosed) {
+				logger.Error(name+" server failed", "error", err)
+			}
+			return
+		case <-ctx.Done():
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("http server shutdown", "addr", addr, "error", err)
+		}
+	})
+	logger.Info("serving "+name, "addr", addr)
+}
+
+// stop cancels the stage, runs its stop functions and waits for its
+// goroutines.
+func (st *stage) stop() {
+	st.cancel()
+	st.mu.Lock()
+	stops := st.stops
+	st.stops = nil
+	st.mu.Unlock()
+	for i := len(stops) - 1; i >= 0; i-- {
+		stops[i]()
+	}
+	st.wg.Wait()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func testSupervisor() *supervisor {
+	s := newSupervisor(newMetrics(""), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	s.minBackoff, s.maxBackoff = time.Millisecond, 10*time.Millisecond
+	return s
+}
+
+func TestSupervisorRestartsPanickingLoop(t *testing.T) {
+	s := testSupervisor()
+	st := s.stage(context.Background(), "background")
+	var runs atomic.Int32
+	running := make(chan struct{})
+	st.loop("audits", func(ctx context.Context) {
+		if runs.Add(1) < 3 {
+			panic("boom")
+		}
+		close(running)
+		<-ctx.Done()
+	})
+	select {
+	case <-running:
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop not restarted after panics")
+	}
+	if got := testutil.ToFloat64(s.metrics.loopPanics.WithLabelValues("audits")); got != 2 {
+		t.Errorf("loop_panics_total{audits} = %v, want 2", got)
+	}
+	st.stop()
+	if runs.Load() != 3 {
+		t.Errorf("runs = %d, want 3", runs.Load())
+	}
+}
+
+func TestSupervisorLoopNotRestartedAfterStop(t *testing.T) {
+	s := testSupervisor()
+	s.minBackoff = time.Hour
+	st := s.stage(context.Background(), "background")
+	var runs atomic.Int32
+	panicked := make(chan struct{})
+	st.loop("heartbeat", func(ctx context.Context) {
+		runs.Add(1)
+		close(panicked)
+		panic("boom")
+	})
+	<-panicked
+	// stop does not wait out the backoff.
+	st.stop()
+	if runs.Load() != 1 {
+		t.Errorf("runs = %d, want 1", runs.Load())
+	}
+}
+
+func TestStageStop(t *testing.T) {
+	s := testSupervisor()
+	parent, cancel := context.WithCancel(context.Background())
+	st := s.stage(parent, "informers")
+	var order []string
+	st.onStop(func() { order = append(order, "first") })
+	st.onStop(func() { order = append(order, "second") })
+	var spawned atomic.Bool
+	done := make(chan struct{})
+	st.spawn("resume", func() {
+		<-st.ctx.Done()
+		spawned.Store(true)
+		close(done)
+	})
+	st.spawn("retag", func() { panic("boom") })
+
+	// Cancelling the parent cancels the stage; stop waits for its goroutines.
+	cancel()
+	<-done
+	st.stop()
+	if !spawned.Load() || !slices.Equal(order, []string{"second", "first"}) {
+		t.Errorf("spawned = %v, stop order = %v", spawned.Load(), order)
+	}
+	if got := testutil.ToFloat64(s.metrics.loopPanics.WithLabelValues("retag")); got != 1 {
+		t.Errorf("loop_panics_total{retag} = %v, want 1", got)
+	}
+
+	// A nil stage runs plain goroutines.
+	ran := make(chan struct{})
+	(*stage)(nil).spawn("retag", func() { close(ran) })
+	<-ran
+}
+
+func TestSupervisorProtectsWorkers(t *testing.T) {
+	s := testSupervisor()
+	p := newWorkPool(1, func(fn func()) { s.protect("workers", fn) })
+	ctx, cancel := context.WithCancel(context.Background())
+	st := s.stage(ctx, "workers")
+	st.loop("work pool", p.run)
+	done := make(chan struct{})
+	p.add(workItem{key: "node/a", fn: func() { panic("boom") }})
+	p.add(workItem{key: "node/b", fn: func() { close(done) }})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker stopped after a panicking item")
+	}
+	cancel()
+	st.stop()
+	if got := testutil.ToFloat64(s.metrics.loopPanics.WithLabelValues("workers")); got != 1 {
+		t.Errorf("loop_panics_total{workers} = %v, want 1", got)
+	}
+}
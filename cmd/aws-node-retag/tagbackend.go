@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/obezpalko/aws-node-retag/internal/state"
+	awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+	"golang.org/x/time/rate"
+)
+
+// Tagging backends accepted in TAGGING_BACKENDS.
+const (
+	backendEC2        = "ec2"
+	backendTaggingAPI = "resourcegroupstaggingapi"
+)
+
+// taggingAPIBatch is the most ARNs TagResources accepts at once.
+const taggingAPIBatch = 20
+
+// arnResourceTypes are the resource types in the ARNs of the resource kinds
+// TAGGING_BACKENDS can select; "*" selects every other kind.
+var arnResourceTypes = map[string]string{
+	"instance":          "instance",
+	"volume":            "volume",
+	"snapshot":          "snapshot",
+	"elastic-ip":        "elastic-ip",
+	"network-interface": "network-interface",
+}
+
+// tagBackend writes tags to EC2 resources.
+type tagBackend interface {
+	// createTags writes tags to resourceIDs, all in region, with the
+	// credentials of roleARN, or the controller's own when empty.
+	createTags(ctx context.Context, roleARN, region string, resourceIDs []string, tags map[string]string) error
+}
+
+// ec2Backend writes tags with ec2:CreateTags, the default backend.
+type ec2Backend struct {
+	clients *ec2Clients
+}
+
+func (b *ec2Backend) createTags(ctx context.Context, roleARN, region string, resourceIDs []string, tags map[string]string) error {
+	ec2Tags := make([]ec2types.Tag, 0, len(tags))
+	for _, k := range sortedTagKeys(tags) {
+		ec2Tags = append(ec2Tags, ec2types.Tag{
+			Key:   aws.String(k),
+			Value: aws.String(awstags.Normalize(tags[k])),
+		})
+	}
+	_, err := b.clients.as(roleARN).forRegion(region).CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: resourceIDs,
+		Tags:      ec2Tags,
+	})
+	if err != nil {
+		return fmt.Errorf("CreateTags: %w", err)
+	}
+	return nil
+}
+
+// taggingAPI is the subset of the Resource Groups Tagging API client used to
+// write tags.
+type taggingAPI interface {
+	TagResources(ctx context.Context, params *resourcegroupstaggingapi.TagResourcesInput, optFns ...func(*resourcegroupstaggingapi.Options)) (*resourcegroupstaggingapi.TagResourcesOutput, error)
+}
+
+// taggingAPIBackend writes tags with the Resource Groups Tagging API
+// (tag:TagResources), which addresses resources by ARN. The ARNs are built
+// from the region, its partition and the account: TAGGING_ACCOUNT_ID, or else
+// the account of the controller's credentials, looked up once.
+type taggingAPIBackend struct {
+	// clients provides the AWS configuration of each role.
+	clients *ec2Clients
+	sts     stsAPI
+
+	mu        sync.Mutex
+	accountID string
+	// apis is keyed by role ARN and region.
+	apis state.Lazy[[2]string, taggingAPI]
+	// newAPI is overridable in tests.
+	newAPI func(cfg aws.Config, region string, retryer func() aws.Retryer) taggingAPI
+}
+
+func newTaggingAPIBackend(clients *ec2Clients, accountID string) *taggingAPIBackend {
+	return &taggingAPIBackend{
+		clients:   clients,
+		sts:       sts.NewFromConfig(clients.cfg),
+		accountID: accountID,
+		newAPI: func(cfg aws.Config, region string, retryer func() aws.Retryer) taggingAPI {
+			return resourcegroupstaggingapi.NewFromConfig(cfg, func(o *resourcegroupstaggingapi.Options) {
+				o.Region = region
+				if retryer != nil {
+					o.Retryer = retryer()
+					o.APIOptions = append(o.APIOptions, addRetryAttempts)
+				}
+			})
+		},
+	}
+}
+
+// api returns the client of roleARN in region, creating it on first use. It
+// shares the region's EC2_TPS limiter and retry settings with the EC2 clients
+// (the region's endpoint is EC2's own), and its calls are traced.
+func (b *taggingAPIBackend) api(roleARN, region string) taggingAPI {
+	return b.apis.Get([2]string{roleARN, region}, func([2]string) taggingAPI {
+		clients := b.clients.as(roleARN)
+		api := b.newAPI(clients.cfg, region, clients.optionsFor(region).retryer())
+		if l := clients.limiter(region); l != nil {
+			api = &rateLimitedTaggingAPI{taggingAPI: api, limiter: l}
+		}
+		return &tracedTaggingAPI{taggingAPI: api, region: region}
+	})
+}
+
+// reset drops the cached clients, so they are rebuilt from the reset EC2
+// clients, e.g. with refreshed credentials, on next use.
+func (b *taggingAPIBackend) reset() {
+	b.apis.Reset()
+}
+
+// rateLimitedTaggingAPI is rateLimitedEC2 for TagResources.
+type rateLimitedTaggingAPI struct {
+	taggingAPI
+	limiter *rate.Limiter
+}
+
+func (c *rateLimitedTaggingAPI) TagResources(ctx context.Context, params *resourcegroupstaggingapi.TagResourcesInput, optFns ...func(*resourcegroupstaggingapi.Options)) (*resourcegroupstaggingapi.TagResourcesOutput, error) {
+	if err := c.limiter.Wait(ctx); err != nil {
+		return nil, fmt.Errorf("EC2 rate limiter: %w", err)
+	}
+	return c.taggingAPI.TagResources(ctx, params, optFns...)
+}
+
+// account returns the account in the resources' ARNs.
+func (b *taggingAPIBackend) account(ctx context.Context) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.accountID != "" {
+		return b.accountID, nil
+	}
+	out, err := b.sts.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("GetCallerIdentity: %w", err)
+	}
+	b.accountID = aws.ToString(out.Account)
+	return b.accountID, nil
+}
+
+// resourceARN returns the ARN of an EC2 resource. Snapshot ARNs have no
+// account.
+func resourceARN(region, accountID, id string) (string, error) {
+	kind := resourceKind(id)
+	resourceType, ok := arnResourceTypes[kind]
+	if !ok {
+		return "", fmt.Errorf("no ARN known for resource %s", id)
+	}
+	if kind == "snapshot" {
+		accountID = ""
+	}
+	return fmt.Sprintf("arn:%s:ec2:%s:%s:%s/%s", partitionForRegion(region), region, accountID, resourceType, id), nil
+}
+
+func (b *taggingAPIBackend) createTags(ctx context.Context, roleARN, region string, resourceIDs []string, tags map[string]string) error {
+	accountID, err := b.account(ctx)
+	if err != nil {
+		return err
+	}
+	arns := make([]string, len(resourceIDs))
+	for i, id := range resourceIDs {
+		if arns[i], err = resourceARN(region, accountID, id); err != nil {
+			return err
+		}
+	}
+	values := awstags.Sanitize(tags)
+	api := b.api(roleARN, region)
+	for start := 0; start < len(arns); start += taggingAPIBatch {
+		out, err := api.TagResources(ctx, &resourcegroupstaggingapi.TagResourcesInput{
+			ResourceARNList: arns[start:min(start+taggingAPIBatch, len(arns))],
+			Tags:            values,
+		})
+		if err != nil {
+			return fmt.Errorf("TagResources: %w", err)
+		}
+		// TagResources succeeds with the resources it could not tag listed.
+		if len(out.FailedResourcesMap) > 0 {
+			failed := make([]string, 0, len(out.FailedResourcesMap))
+			for arn, f := range out.FailedResourcesMap {
+				failed = append(failed, fmt.Sprintf("%s: %s %s", arn, f.ErrorCode, aws.ToString(f.ErrorMessage)))
+			}
+			sort.Strings(failed)
+			return fmt.Errorf("TagResources: %s", strings.Join(failed, "; "))
+		}
+	}
+	return nil
+}
+
+// backendGroup is a set of resources written by the same backend.
+type backendGroup struct {
+	backend     tagBackend
+	resourceIDs []string
+}
+
+// newTagBackends returns the backend of each resource kind set in
+// TAGGING_BACKENDS; "*" is always set, to ec2 unless configured otherwise.
+func newTagBackends(clients *ec2Clients, selected map[string]string, accountID string) map[string]tagBackend {
+	defaultBackend := &ec2Backend{clients: clients}
+	var taggingAPI *taggingAPIBackend
+	backends := map[string]tagBackend{"*": defaultBackend}
+	for kind, name := range selected {
+		if name != backendTaggingAPI {
+			backends[kind] = defaultBackend
+			continue
+		}
+		if taggingAPI == nil {
+			taggingAPI = newTaggingAPIBackend(clients, accountID)
+		}
+		backends[kind] = taggingAPI
+	}
+	return backends
+}
+
+// groupByBackend splits resourceIDs by the backend selected for their kind,
+// in order of first appearance. Without TAGGING_BACKENDS every resource is
+// written with ec2:CreateTags.
+func (t *Tagger) groupByBackend(resourceIDs []string) []backendGroup {
+	if len(t.backends) == 0 {
+		return []backendGroup{{backend: &ec2Backend{clients: t.ec2}, resourceIDs: resourceIDs}}
+	}
+	var groups []backendGroup
+	index := map[tagBackend]int{}
+	for _, id := range resourceIDs {
+		b, ok := t.backends[resourceKind(id)]
+		if !ok {
+			b = t.backends["*"]
+		}
+		i, ok := index[b]
+		if !ok {
+			i = len(groups)
+			index[b] = i
+			groups = append(groups, backendGroup{backend: b})
+		}
+		groups[i].resourceIDs = append(groups[i].resourceIDs, id)
+	}
+	return groups
+}
+
+// resetBackends drops the clients cached by the backends, for a full re-tag.
+func (t *Tagger) resetBackends() {
+	for _, b := range t.backends {
+		if b, ok := b.(*taggingAPIBackend); ok {
+			b.reset()
+		}
+	}
+}
+
+// networkResourceIDs returns the network interfaces attached to inst and the
+// elastic IPs associated with them, for the kinds TAGGING_BACKENDS names;
+// neither kind is discovered otherwise. Elastic IPs are looked up with
+// DescribeAddresses.
+func (t *Tagger) networkResourceIDs(ctx context.Context, region string, inst *ec2types.Instance) ([]string, error) {
+	_, enis := t.backends["network-interface"]
+	_, eips := t.backends["elastic-ip"]
+	if !enis && !eips {
+		return nil, nil
+	}
+	var ids, eniIDs []string
+	for _, ni := range inst.NetworkInterfaces {
+		if id := aws.ToString(ni.NetworkInterfaceId); id != "" {
+			eniIDs = append(eniIDs, id)
+		}
+	}
+	if enis {
+		ids = append(ids, eniIDs...)
+	}
+	if !eips || len(eniIDs) == 0 {
+		return ids, nil
+	}
+	out, err := t.ec2.forRegion(region).DescribeAddresses(ctx, &ec2.DescribeAddressesInput{
+		Filters: []ec2types.Filter{{Name: aws.String("network-interface-id"), Values: eniIDs}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("DescribeAddresses: %w", err)
+	}
+	for _, a := range out.Addresses {
+		if id := aws.ToString(a.AllocationId); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// tagNetworkResources tags the network interfaces and elastic IPs of a
+// node's instance with the instance's tags. They are not part of the node's
+// status, so the audit and the schedule leave them alone.
+func (t *Tagger) tagNetworkResources(ctx context.Context, d *nodeDecision, inst *ec2types.Instance, instanceTags, roles map[string]string, log *slog.Logger) error {
+	ids, err := t.networkResourceIDs(ctx, d.Region, inst)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	if err := t.applyTagsByRole(ctx, d.Region, ids, instanceTags, roles); err != nil {
+		return err
+	}
+	log.Debug("tagged network resources", "resources", ids)
+	return nil
+}
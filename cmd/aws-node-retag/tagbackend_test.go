@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	taggingtypes "github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi/types"
+)
+
+// fakeTaggingAPI records TagResources calls and fails the ARNs in failed.
+type fakeTaggingAPI struct {
+	calls  []*resourcegroupstaggingapi.TagResourcesInput
+	failed map[string]bool
+}
+
+func (f *fakeTaggingAPI) TagResources(_ context.Context, in *resourcegroupstaggingapi.TagResourcesInput, _ ...func(*resourcegroupstaggingapi.Options)) (*resourcegroupstaggingapi.TagResourcesOutput, error) {
+	f.calls = append(f.calls, in)
+	out := &resourcegroupstaggingapi.TagResourcesOutput{FailedResourcesMap: map[string]taggingtypes.FailureInfo{}}
+	for _, arn := range in.ResourceARNList {
+		if f.failed[arn] {
+			out.FailedResourcesMap[arn] = taggingtypes.FailureInfo{ErrorCode: taggingtypes.ErrorCodeInvalidParameterException, ErrorMessage: aws.String("not taggable")}
+		}
+	}
+	return out, nil
+}
+
+func TestResourceARN(t *testing.T) {
+	for _, tc := range []struct {
+		region, id, want string
+	}{
+		{"us-east-1", "i-0abc", "arn:aws:ec2:us-east-1:123456789012:instance/i-0abc"},
+		{"eu-west-1", "vol-0abc", "arn:aws:ec2:eu-west-1:123456789012:volume/vol-0abc"},
+		{"cn-north-1", "eipalloc-0abc", "arn:aws-cn:ec2:cn-north-1:123456789012:elastic-ip/eipalloc-0abc"},
+		{"us-gov-west-1", "eni-0abc", "arn:aws-us-gov:ec2:us-gov-west-1:123456789012:network-interface/eni-0abc"},
+		{"us-east-1", "snap-0abc", "arn:aws:ec2:us-east-1::snapshot/snap-0abc"},
+	} {
+		got, err := resourceARN(tc.region, "123456789012", tc.id)
+		if err != nil || got != tc.want {
+			t.Errorf("resourceARN(%s, %s) = %q, %v; want %q", tc.region, tc.id, got, err, tc.want)
+		}
+	}
+	if _, err := resourceARN("us-east-1", "123456789012", "subnet-0abc"); err == nil {
+		t.Error("expected an error for a resource without a known ARN")
+	}
+}
+
+func TestTaggingBackends(t *testing.T) {
+	ec2 := &taggingEC2{}
+	clients := fakeClients(ec2)
+	clients.cfg = aws.Config{Region: "us-east-1"}
+	tagger := &Tagger{ec2: clients, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	tagger.backends = newTagBackends(clients, map[string]string{"volume": backendTaggingAPI, "elastic-ip": backendTaggingAPI}, "")
+
+	sts := &identityAPIs{account: "123456789012"}
+	api := &fakeTaggingAPI{}
+	backend := tagger.backends["volume"].(*taggingAPIBackend)
+	backend.sts = sts
+	backend.newAPI = func(_ aws.Config, region string, _ func() aws.Retryer) taggingAPI {
+		if region != "eu-west-1" {
+			t.Errorf("TagResources client for region %s", region)
+		}
+		return api
+	}
+
+	volumes := make([]string, 25)
+	for i := range volumes {
+		volumes[i] = fmt.Sprintf("vol-%d", i)
+	}
+	ids := append([]string{"i-0abc"}, volumes...)
+	tags := map[string]string{"Team": "a"}
+	for range 2 {
+		if err := tagger.createTags(context.Background(), "", "eu-west-1", ids, tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Instances still use CreateTags; volumes go to TagResources, 20 at a time.
+	if len(ec2.createTags) != 2 || !reflect.DeepEqual(ec2.createTags[0].Resources, []string{"i-0abc"}) {
+		t.Errorf("CreateTags calls = %+v", ec2.createTags)
+	}
+	if len(api.calls) != 4 || len(api.calls[0].ResourceARNList) != taggingAPIBatch || len(api.calls[1].ResourceARNList) != 5 {
+		t.Fatalf("TagResources calls = %d, want batches of 20 and 5 per write", len(api.calls))
+	}
+	if arn := api.calls[0].ResourceARNList[0]; arn != "arn:aws:ec2:eu-west-1:123456789012:volume/vol-0" {
+		t.Errorf("ARN = %s", arn)
+	}
+	if !reflect.DeepEqual(api.calls[0].Tags, tags) {
+		t.Errorf("tags = %v", api.calls[0].Tags)
+	}
+	if len(sts.calls) != 1 {
+		t.Errorf("GetCallerIdentity calls = %d, want 1", len(sts.calls))
+	}
+	if tagger.backends["elastic-ip"] != tagger.backends["volume"] {
+		t.Error("kinds on the same backend should share it")
+	}
+
+	api.failed = map[string]bool{"arn:aws:ec2:eu-west-1:123456789012:volume/vol-3": true}
+	err := tagger.createTags(context.Background(), "", "eu-west-1", volumes[:5], tags)
+	if err == nil || !strings.Contains(err.Error(), "volume/vol-3: InvalidParameterException not taggable") {
+		t.Errorf("err = %v, want the failed resource", err)
+	}
+}
+
+func TestGroupByBackendDefault(t *testing.T) {
+	tagger := &Tagger{ec2: fakeClients(&taggingEC2{})}
+	groups := tagger.groupByBackend([]string{"i-1", "vol-1", "snap-1"})
+	if len(groups) != 1 || len(groups[0].resourceIDs) != 3 {
+		t.Errorf("groups = %+v, want every resource on ec2:CreateTags", groups)
+	}
+	if _, ok := groups[0].backend.(*ec2Backend); !ok {
+		t.Errorf("backend = %T", groups[0].backend)
+	}
+}
+
+func TestTaggingAPIClient(t *testing.T) {
+	clients := newEC2Clients(aws.Config{Region: "us-east-1"}, regionOptions{}, map[string]regionOptions{
+		"eu-west-1": {TPS: 2, MaxAttempts: 4},
+	})
+	backend := newTaggingAPIBackend(clients, "123456789012")
+	var retryers int
+	backend.newAPI = func(_ aws.Config, _ string, retryer func() aws.Retryer) taggingAPI {
+		if retryer != nil {
+			retryers++
+		}
+		return &fakeTaggingAPI{}
+	}
+
+	eu := backend.api("", "eu-west-1").(*tracedTaggingAPI)
+	limited, ok := eu.taggingAPI.(*rateLimitedTaggingAPI)
+	if !ok {
+		t.Fatalf("eu-west-1 client = %T, want it rate limited", eu.taggingAPI)
+	}
+	if limited.limiter != clients.forRegion("eu-west-1").(*tracedEC2).ec2API.(*rateLimitedEC2).limiter {
+		t.Error("TagResources and CreateTags should share the region's limiter")
+	}
+	if retryers != 1 {
+		t.Errorf("clients built with the region's retryer = %d, want 1", retryers)
+	}
+	if us := backend.api("", "us-east-1").(*tracedTaggingAPI); us.region != "us-east-1" {
+		t.Errorf("region = %q", us.region)
+	} else if _, ok := us.taggingAPI.(*rateLimitedTaggingAPI); ok {
+		t.Error("us-east-1 has no EC2_TPS and should not be rate limited")
+	}
+
+	if backend.api("", "eu-west-1") != eu {
+		t.Error("api() should memoize the client per role and region")
+	}
+	tagger := &Tagger{backends: map[string]tagBackend{"volume": backend}}
+	tagger.resetBackends()
+	if backend.api("", "eu-west-1") == eu {
+		t.Error("a full re-tag should rebuild the clients")
+	}
+}
+
+// addressesEC2 serves DescribeAddresses from the allocation IDs of each
+// network interface.
+type addressesEC2 struct {
+	ec2API
+	allocations map[string]string
+	calls       int
+}
+
+func (f *addressesEC2) DescribeAddresses(_ context.Context, in *ec2.DescribeAddressesInput, _ ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error) {
+	f.calls++
+	out := &ec2.DescribeAddressesOutput{}
+	for _, eni := range in.Filters[0].Values {
+		if id, ok := f.allocations[eni]; ok {
+			out.Addresses = append(out.Addresses, ec2types.Address{AllocationId: aws.String(id), NetworkInterfaceId: aws.String(eni)})
+		}
+	}
+	return out, nil
+}
+
+func TestNetworkResourceIDs(t *testing.T) {
+	inst := &ec2types.Instance{NetworkInterfaces: []ec2types.InstanceNetworkInterface{
+		{NetworkInterfaceId: aws.String("eni-1")},
+		{NetworkInterfaceId: aws.String("eni-2")},
+	}}
+	for _, tc := range []struct {
+		name     string
+		selected map[string]string
+		want     []string
+		calls    int
+	}{
+		{name: "not selected", selected: map[string]string{"volume": backendTaggingAPI}},
+		{name: "network interfaces", selected: map[string]string{"network-interface": backendEC2}, want: []string{"eni-1", "eni-2"}},
+		{name: "elastic ips", selected: map[string]string{"elastic-ip": backendTaggingAPI}, want: []string{"eipalloc-2"}, calls: 1},
+		{name: "both", selected: map[string]string{"elastic-ip": backendTaggingAPI, "network-interface": backendTaggingAPI}, want: []string{"eni-1", "eni-2", "eipalloc-2"}, calls: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			api := &addressesEC2{allocations: map[string]string{"eni-2": "eipalloc-2"}}
+			clients := fakeClients(api)
+			tagger := &Tagger{ec2: clients, backends: newTagBackends(clients, tc.selected, "123456789012")}
+			got, err := tagger.networkResourceIDs(context.Background(), "us-east-1", inst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("networkResourceIDs = %v, want %v", got, tc.want)
+			}
+			if api.calls != tc.calls {
+				t.Errorf("DescribeAddresses calls = %d, want %d", api.calls, tc.calls)
+			}
+		})
+	}
+}
+
+func TestTagNetworkResources(t *testing.T) {
+	writes := &taggingEC2{}
+	clients := fakeClients(&addressesEC2{ec2API: writes, allocations: map[string]string{"eni-1": "eipalloc-1"}})
+	tagger := &Tagger{ec2: clients, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	tagger.backends = newTagBackends(clients, map[string]string{"elastic-ip": backendEC2, "network-interface": backendEC2}, "")
+	inst := &ec2types.Instance{NetworkInterfaces: []ec2types.InstanceNetworkInterface{{NetworkInterfaceId: aws.String("eni-1")}}}
+	d := &nodeDecision{InstanceID: "i-1", Region: "us-east-1"}
+	if err := tagger.tagNetworkResources(context.Background(), d, inst, map[string]string{"Team": "a"}, nil, tagger.logger); err != nil {
+		t.Fatal(err)
+	}
+	if len(writes.createTags) != 1 || !reflect.DeepEqual(writes.createTags[0].Resources, []string{"eipalloc-1", "eni-1"}) {
+		t.Fatalf("CreateTags calls = %+v, want the interface and its elastic IP", writes.createTags)
+	}
+	if tags := writes.createTags[0].Tags; len(tags) != 1 || aws.ToString(tags[0].Key) != "Team" {
+		t.Errorf("tags = %+v, want the instance's", tags)
+	}
+}
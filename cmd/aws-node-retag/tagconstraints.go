@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+)
+
+// validateTagConfig checks the tag sets the controller writes from cfg: the
+// instance's (TAGS plus the attribute tags) and the root and data volumes'
+// (the same, merged with ROOT_VOLUME_TAGS and DATA_VOLUME_TAGS), with keys
+// under CLUSTER_TAG_PREFIX. Attribute tag values depend on the instance and
+// only their keys are checked.
+func validateTagConfig(cfg *Config) error {
+	base := make(map[string]string, len(cfg.Tags)+len(cfg.InstanceAttributeTags)+len(cfg.NodeInventoryTags))
+	for _, key := range cfg.InstanceAttributeTags {
+		base[key] = ""
+	}
+	for _, key := range cfg.NodeInventoryTags {
+		base[key] = ""
+	}
+	for k, v := range cfg.Tags {
+		base[k] = v
+	}
+	prefixed := func(tags map[string]string) map[string]string {
+		out := make(map[string]string, len(tags))
+		for k, v := range tags {
+			out[cfg.ClusterTagPrefix+k] = v
+		}
+		return out
+	}
+	sets := []struct {
+		name string
+		tags map[string]string
+	}{
+		{"TAGS/INSTANCE_ATTRIBUTE_TAGS", prefixed(base)},
+		{"ROOT_VOLUME_TAGS", prefixed(awstags.Merge(base, cfg.RootVolumeTags))},
+		{"DATA_VOLUME_TAGS", prefixed(awstags.Merge(base, cfg.DataVolumeTags))},
+	}
+
+	var errs []error
+	seen := map[string]bool{}
+	for _, set := range sets {
+		err := awstags.Validate(set.tags)
+		if err == nil {
+			continue
+		}
+		// Volume sets contain the instance set, so report each violation once.
+		for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+			if !seen[e.Error()] {
+				seen[e.Error()] = true
+				errs = append(errs, fmt.Errorf("%s: %w", set.name, e))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateTagConfig(t *testing.T) {
+	cfg := &Config{
+		Tags:                  map[string]string{"aws:team": "a"},
+		InstanceAttributeTags: map[string]string{"InstanceType": "aws:type"},
+		RootVolumeTags:        map[string]string{"Disk": strings.Repeat("v", 257)},
+	}
+	err := validateTagConfig(cfg)
+	if err == nil {
+		t.Fatal("validateTagConfig() = nil, want an error")
+	}
+	msg := err.Error()
+	// The reserved keys appear in every set but are reported once each.
+	if n := strings.Count(msg, "reserved"); n != 2 {
+		t.Errorf("reserved-prefix violations reported %d times, want 2:\n%s", n, msg)
+	}
+	if !strings.Contains(msg, "ROOT_VOLUME_TAGS: value of tag \"Disk\"") {
+		t.Errorf("root volume violation missing:\n%s", msg)
+	}
+
+	if err := validateTagConfig(&Config{Tags: map[string]string{"Team": "a"}}); err != nil {
+		t.Errorf("validateTagConfig() = %v for a valid config", err)
+	}
+}
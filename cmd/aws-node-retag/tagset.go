@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"unicode/utf8"
+
+	awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+)
+
+// Tag sets are Go maps, iterated in random order. Whatever compares, hashes
+// or serializes them goes through the canonical form below instead, so map
+// order never shows up as drift, changes a hash or causes a re-tag. Values
+// are normalized and compared by pkg/tags.
+
+// sortedTagKeys returns the keys of tags in order.
+func sortedTagKeys[V any](tags map[string]V) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// canonicalTags serializes tags as a JSON array of [key, value] pairs in key
+// order, with normalized values. Equal tag sets always serialize to the same
+// string.
+func canonicalTags(tags map[string]string) string {
+	keys := sortedTagKeys(tags)
+	n := 2
+	for _, k := range keys {
+		n += len(k) + len(tags[k]) + 8
+	}
+	buf := make([]byte, 0, n)
+	buf = append(buf, '[')
+	for i, k := range keys {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, '[')
+		buf = appendJSONString(buf, k)
+		buf = append(buf, ',')
+		buf = appendJSONString(buf, awstags.Normalize(tags[k]))
+		buf = append(buf, ']')
+	}
+	buf = append(buf, ']')
+	return string(buf)
+}
+
+// appendJSONString appends s as a JSON string escaped exactly like
+// encoding/json does, which canonicalTags used before: the hashes of tag sets
+// must not change across versions.
+func appendJSONString(buf []byte, s string) []byte {
+	const hexDigits = "0123456789abcdef"
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			buf = append(buf, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				buf = append(buf, '\\', c)
+			case '\b':
+				buf = append(buf, '\\', 'b')
+			case '\f':
+				buf = append(buf, '\\', 'f')
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			default:
+				buf = append(buf, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf = append(buf, s[start:i]...)
+			buf = utf8.AppendRune(buf, utf8.RuneError)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, '\\', 'u', '2', '0', '2', hexDigits[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
+}
+
+// tagSetHash returns the hex SHA-256 of the canonical serialization of tags.
+func tagSetHash(tags map[string]string) string {
+	sum := sha256.Sum256([]byte(canonicalTags(tags)))
+	return hex.EncodeToString(sum[:])
+}
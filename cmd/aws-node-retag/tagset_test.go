@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	composed   = "caf\u00e9"  // é as one code point
+	decomposed = "cafe\u0301" // e followed by a combining acute accent
+)
+
+func TestCanonicalTags(t *testing.T) {
+	a := map[string]string{}
+	b := map[string]string{}
+	keys := []string{"Team", "Env", "CostCenter", "Owner", "Project", "App"}
+	for i, k := range keys {
+		a[k] = "v" + k
+		b[keys[len(keys)-1-i]] = "v" + keys[len(keys)-1-i]
+	}
+	a["Name"], b["Name"] = composed, decomposed
+
+	want := canonicalTags(a)
+	for i := 0; i < 20; i++ {
+		if got := canonicalTags(b); got != want {
+			t.Fatalf("canonicalTags = %s, want %s", got, want)
+		}
+	}
+	if want != `[["App","vApp"],["CostCenter","vCostCenter"],["Env","vEnv"],["Name","café"],["Owner","vOwner"],["Project","vProject"],["Team","vTeam"]]` {
+		t.Errorf("canonicalTags = %s", want)
+	}
+	if tagSetHash(a) != tagSetHash(b) {
+		t.Error("equal tag sets hash differently")
+	}
+	if tagSetHash(a) == tagSetHash(map[string]string{"Name": composed}) {
+		t.Error("different tag sets hash equally")
+	}
+	if got := awstags.Normalize("a\xffb"); got != "a\uFFFDb" {
+		t.Errorf("awstags.Normalize(invalid UTF-8) = %q", got)
+	}
+}
+
+func TestPreserveFilterNormalizedValues(t *testing.T) {
+	p := &preservePolicy{overwrite: map[string]bool{"*": true}}
+	if got := p.filter(map[string]string{"Name": composed}, map[string]string{"Name": decomposed}); len(got) != 0 {
+		t.Errorf("filter = %v, want nothing to write", got)
+	}
+	if got := conflictingKeys(map[string]string{"Name": composed}, map[string]string{"Name": decomposed}); len(got) != 0 {
+		t.Errorf("conflictingKeys = %v, want none", got)
+	}
+}
+
+func TestCreateTagsCanonicalOrder(t *testing.T) {
+	api := &taggingEC2{}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), api)
+	tags := map[string]string{"c": "3", "a": "1", "b": decomposed, "d": "4"}
+	if err := tagger.createTags(context.Background(), "", "us-east-1", []string{"i-1"}, tags); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, tag := range api.createTags[0].Tags {
+		got = append(got, aws.ToString(tag.Key)+"="+aws.ToString(tag.Value))
+	}
+	want := []string{"a=1", "b=" + composed, "c=3", "d=4"}
+	if len(got) != len(want) {
+		t.Fatalf("tags = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("tags = %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+// canonicalTags once serialized with encoding/json; stored hashes depend on
+// its output staying the same.
+func TestCanonicalTagsMatchesJSON(t *testing.T) {
+	values := []string{"", "plain", `quote" and \ backslash`, "<tag> & more", "tab\tnew\nline\rcr\bbs\fff", "\x00\x01\x1f\x7f",
+		"line\u2028para\u2029", composed, decomposed, "emoji \U0001F680", "invalid \xff\xfe utf-8"}
+	for i, v := range values {
+		tags := map[string]string{"k" + strconv.Itoa(i): v, v: "key"}
+		pairs := [][2]string{}
+		for _, k := range sortedTagKeys(tags) {
+			pairs = append(pairs, [2]string{k, awstags.Normalize(tags[k])})
+		}
+		want, _ := json.Marshal(pairs)
+		if got := canonicalTags(tags); got != string(want) {
+			t.Errorf("canonicalTags(%q) = %s, want %s", v, got, want)
+		}
+	}
+}
+
+func TestNormalizeTagValueDoesNotCopy(t *testing.T) {
+	for _, v := range []string{"platform", composed} {
+		if allocs := testing.AllocsPerRun(100, func() { _ = awstags.Normalize(v) }); allocs != 0 {
+			t.Errorf("awstags.Normalize(%q) allocates %v times", v, allocs)
+		}
+	}
+}
+
+// benchmarkTags is a typical node tag set: static, attribute and policy tags.
+func benchmarkTags() map[string]string {
+	return map[string]string{
+		"Environment": "production", "Team": "platform", "CostCenter": "cc-4711", "Owner": "sre@example.com",
+		"kubernetes.io/cluster/prod-eu": "owned", "node/instance-type": "m6i.2xlarge", "node/arch": "amd64",
+		"node/os-family": "bottlerocket", "node/kubernetes-version": "1.29", "Name": composed,
+	}
+}
+
+func BenchmarkCanonicalTags(b *testing.B) {
+	tags := benchmarkTags()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = canonicalTags(tags)
+	}
+}
+
+func BenchmarkTagSetHash(b *testing.B) {
+	tags := benchmarkTags()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = tagSetHash(tags)
+	}
+}
+
+func BenchmarkDiff(b *testing.B) {
+	desired := benchmarkTags()
+	// The instance has drifted: a changed value, a value in another Unicode
+	// form, a missing key and a key of its own.
+	existing := benchmarkTags()
+	existing["Team"] = "data"
+	existing["Name"] = decomposed
+	delete(existing, "CostCenter")
+	existing["aws:autoscaling:groupName"] = "workers-a"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = awstags.Diff(desired, existing)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// defaultTerminationTaints are the taints AWS Node Termination Handler puts
+// on a node it is about to drain for a spot interruption, an EC2 scheduled
+// event or an Auto Scaling lifecycle termination (with taintNode enabled).
+// Rebalance recommendations are left out: the instance may keep running.
+var defaultTerminationTaints = []string{
+	"aws-node-termination-handler/spot-itn",
+	"aws-node-termination-handler/scheduled-maintenance",
+	"aws-node-termination-handler/asg-lifecycle-termination",
+}
+
+// terminationTags stamps the instance of a node about to be terminated, so
+// that cost and lifecycle analyses can tell interrupted instances apart after
+// they are gone.
+type terminationTags struct {
+	// tag is set to "true" and timeTag to the time the taint was seen
+	// (RFC 3339, UTC); either may be empty.
+	tag     string
+	timeTag string
+	taints  map[string]bool
+	now     func() time.Time
+}
+
+func newTerminationTags(cfg *Config) *terminationTags {
+	if cfg.TerminationTag == "" && cfg.TerminationTimeTag == "" {
+		return nil
+	}
+	taints := make(map[string]bool, len(cfg.TerminationTaints))
+	for _, k := range cfg.TerminationTaints {
+		taints[k] = true
+	}
+	return &terminationTags{tag: cfg.TerminationTag, timeTag: cfg.TerminationTimeTag, taints: taints, now: time.Now}
+}
+
+// added returns the key of a termination taint newNode carries and oldNode
+// did not, or "" when there is none. Nodes tainted before the controller
+// started are not stamped, so a restart does not move the timestamp.
+func (s *terminationTags) added(oldNode, newNode *corev1.Node) string {
+	if s == nil {
+		return ""
+	}
+	had := make(map[string]bool, len(oldNode.Spec.Taints))
+	for _, taint := range oldNode.Spec.Taints {
+		had[taint.Key] = true
+	}
+	for _, taint := range newNode.Spec.Taints {
+		if s.taints[taint.Key] && !had[taint.Key] {
+			return taint.Key
+		}
+	}
+	return ""
+}
+
+// tags returns the tags stamped at now.
+func (s *terminationTags) tags(now time.Time) map[string]string {
+	tags := make(map[string]string, 2)
+	if s.tag != "" {
+		tags[s.tag] = "true"
+	}
+	if s.timeTag != "" {
+		tags[s.timeTag] = now.UTC().Format(time.RFC3339)
+	}
+	return tags
+}
+
+// tagTermination stamps the termination tags on the instance of a node that
+// got a termination taint. It is a final reconcile: only nodes the
+// controller tags are stamped, whatever their tagged annotation, and the
+// instance alone, since its volumes may be reattached elsewhere.
+func (t *Tagger) tagTermination(ctx context.Context, node *corev1.Node, taint string) error {
+	log := t.logger.With("node", node.Name, "taint", taint)
+	ctx, span := startSpan(ctx, "tag termination", attribute.String("k8s.node.name", node.Name))
+	defer span.End()
+
+	d := t.resolveNode(ctx, node, true)
+	if d.Action != actionTag || d.VolumesOnly {
+		log.Debug("terminating node's instance is not tagged by this controller", "reason", d.Reason)
+		return d.err
+	}
+	log = log.With("instanceID", d.InstanceID, "region", d.Region)
+	tags := t.termination.tags(t.termination.now())
+	if err := t.applyTags(ctx, d.Region, []string{d.InstanceID}, tags); err != nil {
+		log.Error("failed to tag terminating instance", "error", err)
+		t.metrics.failed(kindNode)
+		return err
+	}
+	// A dry run or a blocked write only logged the tags.
+	if t.writeBlocked() == "" {
+		t.metrics.terminationTagged.WithLabelValues(taint).Inc()
+		t.recorder.Eventf(node, corev1.EventTypeNormal, reasonTerminationTagged,
+			"Tagged instance %s as terminating after taint %s", d.InstanceID, taint)
+		log.Info("tagged terminating instance", "tags", tags)
+	}
+	return nil
+}
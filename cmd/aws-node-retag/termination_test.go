@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+const spotTaint = "aws-node-termination-handler/spot-itn"
+
+func TestTerminationTagsAdded(t *testing.T) {
+	s := newTerminationTags(&Config{TerminationTag: "Terminating", TerminationTaints: defaultTerminationTaints})
+	node := taintedNode(nil)
+	interrupted := taintedNode(nil)
+	interrupted.Spec.Taints = append(interrupted.Spec.Taints, corev1.Taint{Key: spotTaint, Effect: corev1.TaintEffectNoSchedule})
+
+	if got := s.added(node, interrupted); got != spotTaint {
+		t.Errorf("added() = %q, want %q", got, spotTaint)
+	}
+	if got := s.added(interrupted, interrupted); got != "" {
+		t.Errorf("added() = %q for a taint already present, want none", got)
+	}
+	rebalance := taintedNode(nil)
+	rebalance.Spec.Taints = append(rebalance.Spec.Taints, corev1.Taint{Key: "aws-node-termination-handler/rebalance-recommendation"})
+	if got := s.added(node, rebalance); got != "" {
+		t.Errorf("added() = %q for a rebalance recommendation, want none by default", got)
+	}
+
+	var disabled *terminationTags
+	if disabled = newTerminationTags(&Config{TerminationTaints: defaultTerminationTaints}); disabled != nil {
+		t.Fatal("enabled without a tag key")
+	}
+	if got := disabled.added(node, interrupted); got != "" {
+		t.Errorf("disabled added() = %q", got)
+	}
+}
+
+func TestTagTermination(t *testing.T) {
+	api := &instanceEC2{}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), api)
+	recorder := record.NewFakeRecorder(10)
+	tagger.recorder = recorder
+	tagger.termination = newTerminationTags(&Config{TerminationTag: "Terminating", TerminationTimeTag: "TerminatingAt", TerminationTaints: defaultTerminationTaints})
+	tagger.termination.now = func() time.Time { return time.Date(2026, 10, 15, 12, 30, 0, 0, time.FixedZone("CEST", 2*3600)) }
+
+	tagger.tagTermination(context.Background(), taintedNode(map[string]string{annotationKey: annotationValue}), spotTaint)
+
+	if len(api.createTags) != 1 {
+		t.Fatalf("CreateTags calls = %d, want 1", len(api.createTags))
+	}
+	call := api.createTags[0]
+	if !reflect.DeepEqual(call.Resources, []string{"i-0123456789abcdef0"}) {
+		t.Errorf("resources = %v, want the instance alone", call.Resources)
+	}
+	got := map[string]string{}
+	for _, tag := range call.Tags {
+		got[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	if want := map[string]string{"Terminating": "true", "TerminatingAt": "2026-10-15T10:30:00Z"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tags = %v, want %v", got, want)
+	}
+	if got := testutil.ToFloat64(tagger.metrics.terminationTagged.WithLabelValues(spotTaint)); got != 1 {
+		t.Errorf("termination_tagged_total = %v, want 1", got)
+	}
+	select {
+	case e := <-recorder.Events:
+		if e != "Normal TerminationTagged Tagged instance i-0123456789abcdef0 as terminating after taint "+spotTaint {
+			t.Errorf("event = %q", e)
+		}
+	default:
+		t.Error("no event recorded")
+	}
+}
+
+func TestTagTerminationDryRun(t *testing.T) {
+	api := &instanceEC2{}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), api)
+	recorder := record.NewFakeRecorder(10)
+	tagger.recorder = recorder
+	tagger.dryRun = true
+	tagger.termination = newTerminationTags(&Config{TerminationTag: "Terminating", TerminationTaints: defaultTerminationTaints})
+
+	tagger.tagTermination(context.Background(), taintedNode(map[string]string{annotationKey: annotationValue}), spotTaint)
+	if len(api.createTags) != 0 {
+		t.Errorf("CreateTags calls = %d in a dry run, want none", len(api.createTags))
+	}
+	if got := testutil.ToFloat64(tagger.metrics.terminationTagged.WithLabelValues(spotTaint)); got != 0 {
+		t.Errorf("termination_tagged_total = %v in a dry run, want 0", got)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("event %q recorded in a dry run", <-recorder.Events)
+	}
+}
+
+func TestTerminationQueuedUrgent(t *testing.T) {
+	tagger := newStartupTagger(fake.NewSimpleClientset(), &instanceEC2{})
+	tagger.termination = newTerminationTags(&Config{TerminationTag: "Terminating", TerminationTaints: defaultTerminationTaints})
+	p := newWorkPool(1, func(fn func()) { fn() })
+	node := taintedNode(map[string]string{annotationKey: annotationValue})
+	interrupted := node.DeepCopy()
+	interrupted.Spec.Taints = append(interrupted.Spec.Taints, corev1.Taint{Key: spotTaint, Effect: corev1.TaintEffectNoSchedule})
+
+	tagger.nodeEventHandler(context.Background(), p).OnUpdate(node, interrupted)
+	item, ok := p.queued["node-terminating/"+node.Name]
+	if !ok || !item.urgent {
+		t.Errorf("termination item = %+v, %v; want it queued as urgent", item, ok)
+	}
+}
+
+func TestTagTerminationSkipsForeignNodes(t *testing.T) {
+	api := &instanceEC2{}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), api)
+	tagger.recorder = record.NewFakeRecorder(10)
+	tagger.termination = newTerminationTags(&Config{TerminationTag: "Terminating", TerminationTaints: defaultTerminationTaints})
+	node := taintedNode(nil)
+	node.Spec.ProviderID = "kind://docker/kind/kind-control-plane"
+
+	tagger.tagTermination(context.Background(), node, spotTaint)
+	if len(api.createTags) != 0 {
+		t.Errorf("CreateTags calls = %v, want none for a node not on AWS", api.createTags)
+	}
+}
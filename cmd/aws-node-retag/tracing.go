@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/resourcegroupstaggingapi"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the controller's spans. Until setupTracing installs a
+// provider it is a no-op.
+var tracer = otel.Tracer("github.com/obezpalko/aws-node-retag")
+
+// setupTracing installs an OTLP/HTTP trace exporter when an endpoint is
+// configured. The exporter, sampler and resource honour the standard
+// OTEL_EXPORTER_OTLP_*, OTEL_TRACES_SAMPLER* and OTEL_RESOURCE_ATTRIBUTES
+// variables. The returned function flushes and stops the exporter.
+func setupTracing(ctx context.Context, cfg *Config) (func(context.Context) error, error) {
+	if cfg.TracingEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("create OTLP exporter: %w", err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "aws-node-retag")),
+		// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence.
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("build trace resource: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// startSpan starts a span as a child of the span in ctx, if any.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan marks the span as failed when err is set, then ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedEC2 records a span for every EC2 call, so a reconcile's trace shows
+// the latency of each DescribeInstances, DescribeTags and CreateTags.
+type tracedEC2 struct {
+	ec2API
+	region string
+}
+
+func (c *tracedEC2) start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs,
+		attribute.String("rpc.system", "aws-api"),
+		attribute.String("rpc.service", "EC2"),
+		attribute.String("rpc.method", op),
+		attribute.String("cloud.region", c.region),
+	)
+	return tracer.Start(ctx, "EC2."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func (c *tracedEC2) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	ctx, span := c.start(ctx, "DescribeInstances", attribute.StringSlice("aws.ec2.instance_ids", params.InstanceIds))
+	out, err := c.ec2API.DescribeInstances(ctx, params, optFns...)
+	endSpan(span, err)
+	return out, err
+}
+
+func (c *tracedEC2) DescribeTags(ctx context.Context, params *ec2.DescribeTagsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeTagsOutput, error) {
+	ctx, span := c.start(ctx, "DescribeTags")
+	out, err := c.ec2API.DescribeTags(ctx, params, optFns...)
+	endSpan(span, err)
+	return out, err
+}
+
+func (c *tracedEC2) CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	ctx, span := c.start(ctx, "CreateTags",
+		attribute.StringSlice("aws.ec2.resource_ids", params.Resources),
+		attribute.Int("aws.ec2.tag_count", len(params.Tags)))
+	out, err := c.ec2API.CreateTags(ctx, params, optFns...)
+	endSpan(span, err)
+	return out, err
+}
+
+func (c *tracedEC2) DescribeVolumes(ctx context.Context, params *ec2.DescribeVolumesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error) {
+	ctx, span := c.start(ctx, "DescribeVolumes")
+	out, err := c.ec2API.DescribeVolumes(ctx, params, optFns...)
+	endSpan(span, err)
+	return out, err
+}
+
+func (c *tracedEC2) DescribeSnapshots(ctx context.Context, params *ec2.DescribeSnapshotsInput, optFns ...func(*ec2.Options)) (*ec2.DescribeSnapshotsOutput, error) {
+	ctx, span := c.start(ctx, "DescribeSnapshots")
+	out, err := c.ec2API.DescribeSnapshots(ctx, params, optFns...)
+	endSpan(span, err)
+	return out, err
+}
+
+func (c *tracedEC2) DeleteTags(ctx context.Context, params *ec2.DeleteTagsInput, optFns ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error) {
+	ctx, span := c.start(ctx, "DeleteTags",
+		attribute.StringSlice("aws.ec2.resource_ids", params.Resources),
+		attribute.Int("aws.ec2.tag_count", len(params.Tags)))
+	out, err := c.ec2API.DeleteTags(ctx, params, optFns...)
+	endSpan(span, err)
+	return out, err
+}
+
+func (c *tracedEC2) DescribeAddresses(ctx context.Context, params *ec2.DescribeAddressesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeAddressesOutput, error) {
+	ctx, span := c.start(ctx, "DescribeAddresses")
+	out, err := c.ec2API.DescribeAddresses(ctx, params, optFns...)
+	endSpan(span, err)
+	return out, err
+}
+
+// tracedTaggingAPI records a span for every Resource Groups Tagging API call.
+type tracedTaggingAPI struct {
+	taggingAPI
+	region string
+}
+
+func (c *tracedTaggingAPI) TagResources(ctx context.Context, params *resourcegroupstaggingapi.TagResourcesInput, optFns ...func(*resourcegroupstaggingapi.Options)) (*resourcegroupstaggingapi.TagResourcesOutput, error) {
+	ctx, span := tracer.Start(ctx, "TaggingAPI.TagResources", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("rpc.system", "aws-api"),
+		attribute.String("rpc.service", "ResourceGroupsTaggingAPI"),
+		attribute.String("rpc.method", "TagResources"),
+		attribute.String("cloud.region", c.region),
+		attribute.StringSlice("aws.resource_arns", params.ResourceARNList),
+		attribute.Int("aws.tag_count", len(params.Tags)),
+	))
+	out, err := c.taggingAPI.TagResources(ctx, params, optFns...)
+	endSpan(span, err)
+	return out, err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReconcileSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+		_ = tp.Shutdown(context.Background())
+	})
+
+	k8s := fake.NewSimpleClientset(taintedNode(nil))
+	tagger := newStartupTagger(k8s, &tracedEC2{ec2API: &instanceEC2{}, region: "us-east-1"})
+	if err := tagger.tagLocalNode(context.Background(), "n1", time.Millisecond, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+	root, ok := spans["tag-node"]
+	if !ok {
+		t.Fatalf("no tag-node span, got %v", spanNames(recorder.Ended()))
+	}
+	for _, name := range []string{"EC2.DescribeInstances", "EC2.CreateTags", "patch node", "remove startup taint"} {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("missing %s span, got %v", name, spanNames(recorder.Ended()))
+			continue
+		}
+		if s.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("%s span is not a child of the tag-node span", name)
+		}
+	}
+}
+
+func spanNames(spans []sdktrace.ReadOnlySpan) []string {
+	names := make([]string, 0, len(spans))
+	for _, s := range spans {
+		names = append(names, s.Name())
+	}
+	return names
+}
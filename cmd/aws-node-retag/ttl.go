@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ttlStart is when the controller first saw a generation of a TagPolicy with
+// a TTL. Editing the policy's spec starts a new TTL.
+type ttlStart struct {
+	Generation int64     `json:"generation"`
+	Start      time.Time `json:"start"`
+	// Expired is set once the policy's tags were handed over for removal, so
+	// a policy that expired while the controller was down is still untagged
+	// once, and only once, after a restart.
+	Expired bool `json:"expired,omitempty"`
+}
+
+// expiresAt returns when a policy with the given TTL expires.
+func (s ttlStart) expiresAt(ttl time.Duration) time.Time {
+	return s.Start.Add(ttl)
+}
+
+// ttlState persists the ttlStarts in a ConfigMap keyed by policy name, so a
+// restart neither extends a TTL nor forgets an expiry. A nil state keeps no
+// state.
+type ttlState struct {
+	k8s       kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// load returns the persisted starts. Entries that cannot be decoded are
+// skipped; their policies start a new TTL.
+func (s *ttlState) load(ctx context.Context) (map[string]ttlStart, error) {
+	starts := map[string]ttlStart{}
+	if s == nil {
+		return starts, nil
+	}
+	cm, err := s.k8s.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return starts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for name, raw := range cm.Data {
+		var st ttlStart
+		if err := json.Unmarshal([]byte(raw), &st); err != nil {
+			continue
+		}
+		starts[name] = st
+	}
+	return starts, nil
+}
+
+// save writes the changed starts; a nil start removes the policy's entry.
+func (s *ttlState) save(ctx context.Context, changed map[string]*ttlStart) error {
+	if s == nil || len(changed) == 0 {
+		return nil
+	}
+	encoded := make(map[string]string, len(changed))
+	for name, st := range changed {
+		if st == nil {
+			continue
+		}
+		data, err := json.Marshal(st)
+		if err != nil {
+			return fmt.Errorf("encode TTL of TagPolicy %s: %w", name, err)
+		}
+		encoded[name] = string(data)
+	}
+	return updateConfigMapData(ctx, s.k8s, s.namespace, s.name, func(data map[string]string) map[string]string {
+		for name := range changed {
+			if v, ok := encoded[name]; ok {
+				data[name] = v
+			} else {
+				delete(data, name)
+			}
+		}
+		return data
+	})
+}
+
+// restoreTTLs seeds the store with persisted starts. It must be called before
+// the first policy is set.
+func (s *policyStore) restoreTTLs(starts map[string]ttlStart) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, st := range starts {
+		s.ttlStarts[name] = st
+	}
+}
+
+// pruneTTLs drops the starts of policies deleted while the controller was
+// down. It is called once the policy informer has synced.
+func (s *policyStore) pruneTTLs() {
+	s.mu.Lock()
+	for name := range s.ttlStarts {
+		if s.progress[name] == nil {
+			delete(s.ttlStarts, name)
+			s.ttlDirty[name] = true
+		}
+	}
+	s.mu.Unlock()
+	s.flushTTLs()
+}
+
+// flushTTLs hands the starts changed since the last flush to saveTTL. Flushes
+// are serialized so that an older state never overwrites a newer one.
+func (s *policyStore) flushTTLs() {
+	s.ttlSaveMu.Lock()
+	defer s.ttlSaveMu.Unlock()
+	s.mu.Lock()
+	if len(s.ttlDirty) == 0 || s.saveTTL == nil {
+		s.ttlDirty = map[string]bool{}
+		s.mu.Unlock()
+		return
+	}
+	changed := make(map[string]*ttlStart, len(s.ttlDirty))
+	for name := range s.ttlDirty {
+		if st, ok := s.ttlStarts[name]; ok {
+			changed[name] = &st
+		} else {
+			changed[name] = nil
+		}
+	}
+	s.ttlDirty = map[string]bool{}
+	s.mu.Unlock()
+	s.saveTTL(changed)
+}
+
+// trackTTL starts the TTL of a new generation of p, or forgets it when p has
+// no TTL. The caller holds s.mu.
+func (s *policyStore) trackTTL(p *compiledPolicy) {
+	st, ok := s.ttlStarts[p.name]
+	switch {
+	case p.ttl <= 0:
+		if ok {
+			delete(s.ttlStarts, p.name)
+			s.ttlDirty[p.name] = true
+		}
+	case !ok || st.Generation != p.generation:
+		s.ttlStarts[p.name] = ttlStart{Generation: p.generation, Start: s.now().UTC().Truncate(time.Second)}
+		s.ttlDirty[p.name] = true
+	}
+}
+
+// expired reports whether p's TTL has run out at now. The caller holds s.mu.
+func (s *policyStore) expired(p *compiledPolicy, now time.Time) bool {
+	if p.ttl <= 0 {
+		return false
+	}
+	st, ok := s.ttlStarts[p.name]
+	return ok && st.Generation == p.generation && !now.Before(st.expiresAt(p.ttl))
+}
+
+// expiredUnhandled returns the expired policies whose tags were not yet handed
+// over for removal, e.g. because the controller was down when they expired,
+// and marks them as handled. The caller holds s.mu.
+func (s *policyStore) expiredUnhandled(now time.Time) []*compiledPolicy {
+	var out []*compiledPolicy
+	for name, p := range s.policies {
+		st, ok := s.ttlStarts[name]
+		if !ok || st.Expired || !s.expired(p, now) {
+			continue
+		}
+		st.Expired = true
+		s.ttlStarts[name] = st
+		s.ttlDirty[name] = true
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
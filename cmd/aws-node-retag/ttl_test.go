@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func emptyNodeLister() corelisters.NodeLister {
+	return corelisters.NewNodeLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+}
+
+func newTTLStore(now *time.Time, state *ttlState) (*policyStore, *[]*compiledPolicy) {
+	var published []*compiledPolicy
+	store := newPolicyStore(func(p []*compiledPolicy) { published = p })
+	store.now = func() time.Time { return *now }
+	store.saveTTL = func(changed map[string]*ttlStart) {
+		if err := state.save(context.Background(), changed); err != nil {
+			panic(err)
+		}
+	}
+	return store, &published
+}
+
+func TestPolicyStoreTTL(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	state := &ttlState{k8s: fake.NewSimpleClientset(), namespace: "kube-system", name: "ttl"}
+	store, published := newTTLStore(&now, state)
+
+	incident := newTestPolicy("incident", tagPolicySpec{Tags: map[string]string{"Incident": "sev1"}, TTL: "72h"})
+	if _, err := store.set(incident); err != nil {
+		t.Fatal(err)
+	}
+	if len(*published) != 1 {
+		t.Fatalf("published = %v, want the policy until it expires", *published)
+	}
+	st := store.status("incident", 1, emptyNodeLister())
+	if st.Active == nil || !*st.Active || st.ExpiresAt == nil || !st.ExpiresAt.Time.Equal(now.Add(72*time.Hour)) {
+		t.Fatalf("status = %+v, want active until %s", st, now.Add(72*time.Hour))
+	}
+
+	// A resync of the same generation keeps the start.
+	now = now.Add(71 * time.Hour)
+	if _, err := store.set(incident); err != nil {
+		t.Fatal(err)
+	}
+	opened, closed, expired := store.tick()
+	if len(opened) != 0 || len(closed) != 0 || len(expired) != 0 || len(*published) != 1 {
+		t.Fatalf("before expiry: opened %v, closed %v, expired %v", opened, closed, expired)
+	}
+
+	now = now.Add(time.Hour)
+	_, closed, expired = store.tick()
+	if len(closed) != 1 || closed[0].name != "incident" || !expired["incident"] || len(*published) != 0 {
+		t.Fatalf("at expiry: closed %v, expired %v, published %v", closed, expired, *published)
+	}
+	if st := store.status("incident", 1, emptyNodeLister()); st.Active == nil || *st.Active {
+		t.Errorf("status.active = %v after expiry, want false", st.Active)
+	}
+	if _, closed, _ = store.tick(); len(closed) != 0 {
+		t.Errorf("closed again: %v", closed)
+	}
+
+	// A new generation starts a new TTL.
+	incident.Generation = 2
+	if _, err := store.set(incident); err != nil {
+		t.Fatal(err)
+	}
+	if len(*published) != 1 {
+		t.Errorf("published = %v after an edit, want the policy again", *published)
+	}
+
+	// Deleting the policy forgets its start.
+	store.remove("incident")
+	starts, err := state.load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(starts) != 0 {
+		t.Errorf("persisted starts = %v after delete, want none", starts)
+	}
+}
+
+func TestPolicyStoreTTLRestart(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	state := &ttlState{k8s: fake.NewSimpleClientset(), namespace: "kube-system", name: "ttl"}
+	incident := newTestPolicy("incident", tagPolicySpec{Tags: map[string]string{"Incident": "sev1"}, TTL: "1h"})
+	first, _ := newTTLStore(&now, state)
+	if _, err := first.set(incident); err != nil {
+		t.Fatal(err)
+	}
+
+	// The controller restarts after 30 minutes: the TTL is not extended.
+	now = now.Add(30 * time.Minute)
+	restart := func() (*policyStore, *[]*compiledPolicy) {
+		starts, err := state.load(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		store, published := newTTLStore(&now, state)
+		store.restoreTTLs(starts)
+		if _, err := store.set(incident); err != nil {
+			t.Fatal(err)
+		}
+		store.pruneTTLs()
+		return store, published
+	}
+	second, _ := restart()
+	if st := second.status("incident", 1, emptyNodeLister()); st.ExpiresAt == nil || !st.ExpiresAt.Time.Equal(now.Add(30*time.Minute)) {
+		t.Fatalf("expiresAt = %v, want the original expiry", st.ExpiresAt)
+	}
+
+	// It is down when the policy expires: the next start does not apply the
+	// policy, and hands it over for untagging on the first tick only.
+	now = now.Add(time.Hour)
+	third, published := restart()
+	if len(*published) != 0 {
+		t.Fatalf("published = %v, want the expired policy left out", *published)
+	}
+	_, closed, expired := third.tick()
+	if len(closed) != 1 || !expired["incident"] {
+		t.Fatalf("closed %v, expired %v, want the policy expired while down", closed, expired)
+	}
+	fourth, _ := restart()
+	if _, closed, _ := fourth.tick(); len(closed) != 0 {
+		t.Errorf("closed %v after another restart, want it untagged once", closed)
+	}
+}
+
+func TestPruneTTLs(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	state := &ttlState{k8s: fake.NewSimpleClientset(), namespace: "kube-system", name: "ttl"}
+	if err := state.save(context.Background(), map[string]*ttlStart{"gone": {Generation: 3, Start: now}}); err != nil {
+		t.Fatal(err)
+	}
+	starts, err := state.load(context.Background())
+	if err != nil || len(starts) != 1 {
+		t.Fatalf("load = %v, %v", starts, err)
+	}
+	store, _ := newTTLStore(&now, state)
+	store.restoreTTLs(starts)
+	store.pruneTTLs()
+	if starts, _ := state.load(context.Background()); len(starts) != 0 {
+		t.Errorf("starts = %v, want the deleted policy's start pruned", starts)
+	}
+}
+
+func TestNilTTLState(t *testing.T) {
+	var state *ttlState
+	starts, err := state.load(context.Background())
+	if err != nil || len(starts) != 0 {
+		t.Errorf("load = %v, %v", starts, err)
+	}
+	if err := state.save(context.Background(), map[string]*ttlStart{"p": {}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReportedExpired(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	p := newTestPolicy("incident", tagPolicySpec{Tags: map[string]string{"Incident": "sev1"}, TTL: "1h"})
+	if reportedExpired(p, now) {
+		t.Error("expired without a status")
+	}
+	p.Status = tagPolicyStatus{ObservedGeneration: 1, ExpiresAt: &metav1.Time{Time: now.Add(-time.Minute)}}
+	if !reportedExpired(p, now) {
+		t.Error("not expired after expiresAt")
+	}
+	p.Generation = 2
+	if reportedExpired(p, now) {
+		t.Error("an edited policy is expired")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	awstags "github.com/obezpalko/aws-node-retag/pkg/tags"
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// handleNodeDelete removes the controller-managed tags from the EBS volumes of
+// PVs with the Retain reclaim policy that are still attached to the deleted
+// node's instance, so retained volumes don't keep the tags of a node that no
+// longer exists (UNTAG_ON_NODE_DELETE). Volumes already detached when the
+// node object is deleted are not found and keep their tags.
+func (t *Tagger) handleNodeDelete(ctx context.Context, obj interface{}, pvs corelisters.PersistentVolumeLister) {
+	node, ok := deletedNode(obj)
+	if !ok {
+		return
+	}
+	log := t.logger.With("node", node.Name)
+
+	ctx, span := startSpan(ctx, "untag node", attribute.String("k8s.node.name", node.Name))
+	defer span.End()
+
+	// Evaluate the node as if it were new: only nodes we would tag are untagged.
+	d := t.resolveNode(ctx, node, true)
+	if d.Action != actionTag {
+		log.Debug("deleted node was not tagged by this controller, nothing to untag", "reason", d.Reason)
+		return
+	}
+	log = log.With("instanceID", d.InstanceID, "region", d.Region)
+	if !t.features.enabled(featureUntagOnDelete, d.Region) {
+		return
+	}
+
+	retained, err := retainedPVsByVolume(pvs)
+	if err != nil {
+		log.Error("failed to list persistent volumes from cache", "error", err)
+		return
+	}
+	if len(retained) == 0 {
+		return
+	}
+
+	attached, err := t.describeAttachedVolumes(ctx, d.Region, d.InstanceID)
+	if err != nil {
+		if t.features.denied(featureUntagOnDelete, d.Region, err) {
+			return
+		}
+		log.Error("failed to list volumes of deleted node", "error", err)
+		t.metrics.failed(kindPV)
+		return
+	}
+
+	for _, volumeID := range attached {
+		pv := retained[volumeID]
+		if pv == nil {
+			continue
+		}
+		pvLog := log.With("pv", pv.Name, "volumeID", volumeID)
+		tags, roles := managedVolumeTags(d.snapshot, node, pv)
+		if err := t.deleteTagsByRole(ctx, d.Region, volumeID, tags, roles); err != nil {
+			if t.features.denied(featureUntagOnDelete, d.Region, err) {
+				return
+			}
+			pvLog.Error("failed to remove managed tags from retained volume", "error", err)
+			t.metrics.failed(kindPV)
+			continue
+		}
+		if err := t.unannotatePV(ctx, pv.Name); err != nil {
+			pvLog.Error("failed to remove tagged annotation from PV (tags were removed)", "error", err)
+			t.metrics.failed(kindPV)
+			continue
+		}
+		t.recorder.Eventf(pv, corev1.EventTypeNormal, reasonUntagged,
+			"Removed %d managed tags from retained volume %s after node %s was deleted", len(tags), volumeID, node.Name)
+		t.metrics.untagged.WithLabelValues(kindPV).Inc()
+		pvLog.Info("removed managed tags from retained volume", "keys", len(tags))
+	}
+}
+
+// deletedNode returns the node of a delete event, which may carry a
+// tombstone when the deletion was missed by the watch.
+func deletedNode(obj interface{}) (*corev1.Node, bool) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	node, ok := obj.(*corev1.Node)
+	return node, ok
+}
+
+// deletedPV is deletedNode for PVs.
+func deletedPV(obj interface{}) (*corev1.PersistentVolume, bool) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	pv, ok := obj.(*corev1.PersistentVolume)
+	return pv, ok
+}
+
+// retainedPVsByVolume indexes the EBS-backed PVs with the Retain reclaim
+// policy by volume ID.
+func retainedPVsByVolume(pvs corelisters.PersistentVolumeLister) (map[string]*corev1.PersistentVolume, error) {
+	list, err := pvs.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]*corev1.PersistentVolume{}
+	for _, pv := range list {
+		if pv.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimRetain {
+			continue
+		}
+		if id := ebsVolumeID(pv); id != "" {
+			out[id] = pv
+		}
+	}
+	return out, nil
+}
+
+// managedVolumeTags returns the tags the controller manages on a PV's volume
+// that was attached to node: the PV's own tag set plus the data volume tags of
+// the node. Values are nil for instance attribute tags, whose value depends on the
+// instance and is removed whatever it is. The roles are the keyRoles of the tags.
+func managedVolumeTags(snap *tagSnapshot, node *corev1.Node, pv *corev1.PersistentVolume) (map[string]*string, map[string]string) {
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tags := map[string]*string{}
+	for _, key := range snap.attributeTags {
+		tags[key] = nil
+	}
+	for _, key := range snap.inventoryTags {
+		tags[key] = nil
+	}
+	pvTags, _ := snap.resourceTags(snap.tags, resourcePersistentVolume, pv.Labels, quiet)
+	nodeTags, _ := snap.resourceTags(awstags.Merge(snap.tags, snap.dataVolumeTags), resourceVolume, node.Labels, quiet)
+	pvRoles := snap.keyRoles(resourcePersistentVolume, pv.Labels)
+	nodeRoles := snap.keyRoles(resourceVolume, node.Labels)
+	roles := map[string]string{}
+	for _, set := range []struct {
+		tags  map[string]string
+		roles map[string]string
+	}{{pvTags, pvRoles}, {nodeTags, nodeRoles}} {
+		for k, v := range set.tags {
+			tags[k] = aws.String(v)
+			if role := set.roles[k]; role != "" {
+				roles[k] = role
+			} else {
+				delete(roles, k)
+			}
+		}
+	}
+	return tags, roles
+}
+
+// describeAttachedVolumes returns the IDs of the volumes attached to the instance.
+func (t *Tagger) describeAttachedVolumes(ctx context.Context, region, instanceID string) ([]string, error) {
+	var ids []string
+	p := ec2.NewDescribeVolumesPaginator(t.ec2.forRegion(region), &ec2.DescribeVolumesInput{
+		Filters: []ec2types.Filter{{
+			Name:   aws.String("attachment.instance-id"),
+			Values: []string{instanceID},
+		}},
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("DescribeVolumes: %w", err)
+		}
+		for _, v := range page.Volumes {
+			ids = append(ids, aws.ToString(v.VolumeId))
+		}
+	}
+	return ids, nil
+}
+
+// deleteTagsByRole removes tags like deleteTags, each key with the
+// credentials of its role in roles (see keyRoles).
+func (t *Tagger) deleteTagsByRole(ctx context.Context, region, resourceID string, tags map[string]*string, roles map[string]string) error {
+	split := splitByRole(tags, roles)
+	for _, role := range sortedRoles(split) {
+		if err := t.deleteTags(ctx, role, region, resourceID, split[role]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteTags calls ec2:DeleteTags on the resource, as roleARN when set. A tag
+// with a value is only removed while it still carries that value, so values
+// changed by other systems since they were written are left alone. Keys are
+// under the cluster tag prefix, if any; protected keys are dropped with a
+// warning.
+func (t *Tagger) deleteTags(ctx context.Context, roleARN, region, resourceID string, tags map[string]*string) error {
+	allowed, err := t.unquarantined(ctx, region, []string{resourceID})
+	if err != nil || len(allowed) == 0 {
+		return err
+	}
+
+	var keys, dropped []string
+	ec2Tags := make([]ec2types.Tag, 0, len(tags))
+	for _, k := range sortedTagKeys(tags) {
+		key := t.clusterKey(k)
+		if t.protected.protects(key) {
+			dropped = append(dropped, key)
+			continue
+		}
+		keys = append(keys, key)
+		// Values are written normalized, so they are matched normalized.
+		value := tags[k]
+		if value != nil {
+			value = aws.String(awstags.Normalize(*value))
+		}
+		ec2Tags = append(ec2Tags, ec2types.Tag{Key: aws.String(key), Value: value})
+	}
+	if len(dropped) > 0 {
+		t.logger.Warn("not removing protected tag keys", "resource", resourceID, "keys", dropped)
+		if len(keys) == 0 {
+			return nil
+		}
+	}
+
+	if reason := t.writeBlocked(); reason != "" {
+		t.logger.Info(reason+": would remove tags", "resource", resourceID, "keys", keys)
+		return nil
+	}
+
+	_, err = t.ec2.as(roleARN).forRegion(region).DeleteTags(ctx, &ec2.DeleteTagsInput{
+		Resources: []string{resourceID},
+		Tags:      ec2Tags,
+	})
+	if err != nil {
+		return fmt.Errorf("DeleteTags: %w", err)
+	}
+	return nil
+}
+
+// unannotatePV removes the idempotency annotation, so the volume is tagged
+// again if the PV is bound again.
+func (t *Tagger) unannotatePV(ctx context.Context, pvName string) (err error) {
+	ctx, span := startSpan(ctx, "patch pv", attribute.String("k8s.persistentvolume.name", pvName))
+	defer func() { endSpan(span, err) }()
+
+	if reason := t.writeBlocked(); reason != "" {
+		t.logger.Info(reason+": would remove PV annotation", "pv", pvName, "annotation", t.taggedKey())
+		return nil
+	}
+
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:null}}}`, t.taggedKey())
+	_, err = t.k8s.CoreV1().PersistentVolumes().Patch(
+		ctx,
+		pvName,
+		types.MergePatchType,
+		[]byte(patch),
+		metav1.PatchOptions{},
+	)
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// fakeEC2 records mutating calls and serves canned volume attachments.
+type fakeEC2 struct {
+	ec2API
+	attached   []string
+	deleteTags []*ec2.DeleteTagsInput
+}
+
+func (f *fakeEC2) DescribeVolumes(_ context.Context, in *ec2.DescribeVolumesInput, _ ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error) {
+	out := &ec2.DescribeVolumesOutput{}
+	for _, id := range f.attached {
+		out.Volumes = append(out.Volumes, ec2types.Volume{VolumeId: aws.String(id)})
+	}
+	return out, nil
+}
+
+func (f *fakeEC2) DeleteTags(_ context.Context, in *ec2.DeleteTagsInput, _ ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error) {
+	f.deleteTags = append(f.deleteTags, in)
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
+func fakeClients(api ec2API) *ec2Clients {
+	return &ec2Clients{newClient: func(string) ec2API { return api }}
+}
+
+func TestHandleNodeDelete(t *testing.T) {
+	pv := func(name, volumeID string, policy corev1.PersistentVolumeReclaimPolicy) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{annotationKey: annotationValue}},
+			Spec: corev1.PersistentVolumeSpec{
+				PersistentVolumeReclaimPolicy: policy,
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: volumeID},
+				},
+			},
+		}
+	}
+	retained := pv("retained", "vol-1", corev1.PersistentVolumeReclaimRetain)
+	deleted := pv("deleted", "vol-2", corev1.PersistentVolumeReclaimDelete)
+	elsewhere := pv("elsewhere", "vol-3", corev1.PersistentVolumeReclaimRetain)
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, p := range []*corev1.PersistentVolume{retained, deleted, elsewhere} {
+		_ = indexer.Add(p)
+	}
+	k8s := fake.NewSimpleClientset(retained, deleted, elsewhere)
+	api := &fakeEC2{attached: []string{"vol-root", "vol-1", "vol-2"}}
+	tagger := &Tagger{
+		k8s:      k8s,
+		ec2:      fakeClients(api),
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		recorder: record.NewFakeRecorder(10),
+		metrics:  newMetrics(""),
+	}
+	tagger.snapshot.Store(&tagSnapshot{
+		tags:          map[string]string{"Env": "prod"},
+		attributeTags: map[string]string{"InstanceType": "node/instance-type"},
+	})
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "n1", Annotations: map[string]string{annotationKey: annotationValue}},
+		Spec:       corev1.NodeSpec{ProviderID: "aws:///us-east-1a/i-0123456789abcdef0"},
+	}
+	tagger.handleNodeDelete(context.Background(), cache.DeletedFinalStateUnknown{Key: "n1", Obj: node}, corelisters.NewPersistentVolumeLister(indexer))
+
+	if len(api.deleteTags) != 1 {
+		t.Fatalf("DeleteTags called %d times, want 1", len(api.deleteTags))
+	}
+	in := api.deleteTags[0]
+	if len(in.Resources) != 1 || in.Resources[0] != "vol-1" {
+		t.Errorf("DeleteTags resources = %v, want [vol-1]", in.Resources)
+	}
+	got := map[string]*string{}
+	for _, tag := range in.Tags {
+		got[aws.ToString(tag.Key)] = tag.Value
+	}
+	if aws.ToString(got["Env"]) != "prod" {
+		t.Errorf("Env tag should be removed only with its value, got %v", got["Env"])
+	}
+	if v, ok := got["node/instance-type"]; !ok || v != nil {
+		t.Errorf("attribute tag should be removed by key, got %v (present %v)", v, ok)
+	}
+
+	updated, err := k8s.CoreV1().PersistentVolumes().Get(context.Background(), "retained", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := updated.Annotations[annotationKey]; ok {
+		t.Error("tagged annotation should be removed from the retained PV")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// attachedVolumeID returns the EBS volume ID of a VolumeAttachment of the EBS
+// CSI driver, resolved through its PV or, for migrated in-tree volumes, its
+// inline volume spec; "" when the attachment is not for an EBS volume.
+func attachedVolumeID(va *storagev1.VolumeAttachment, pvs corelisters.PersistentVolumeLister) (string, error) {
+	if va.Spec.Attacher != "ebs.csi.aws.com" {
+		return "", nil
+	}
+	switch src := va.Spec.Source; {
+	case src.PersistentVolumeName != nil:
+		pv, err := pvs.Get(*src.PersistentVolumeName)
+		if err != nil {
+			return "", fmt.Errorf("get PV %s: %w", *src.PersistentVolumeName, err)
+		}
+		return ebsVolumeID(pv), nil
+	case src.InlineVolumeSpec != nil:
+		return ebsVolumeID(&corev1.PersistentVolume{Spec: *src.InlineVolumeSpec}), nil
+	}
+	return "", nil
+}
+
+// handleVolumeAttachment tags a volume as soon as it is attached to a node,
+// with the tags the node's data volumes get. Unlike handleNode it ignores the
+// node's tagged annotation, so volumes hot-attached to an already tagged node
+// are covered too (WATCH_VOLUME_ATTACHMENTS). Volumes backing a PV are left
+// to the PV reconcile.
+func (t *Tagger) handleVolumeAttachment(ctx context.Context, va *storagev1.VolumeAttachment, nodes corelisters.NodeLister, pvs corelisters.PersistentVolumeLister) {
+	log := t.logger.With("volumeAttachment", va.Name, "node", va.Spec.NodeName)
+
+	var err error
+	ctx, span := startSpan(ctx, "reconcile volume attachment",
+		attribute.String("k8s.volumeattachment.name", va.Name), attribute.String("k8s.node.name", va.Spec.NodeName))
+	defer func() { endSpan(span, err) }()
+
+	volumeID, err := attachedVolumeID(va, pvs)
+	if err != nil {
+		log.Error("failed to resolve attached volume", "error", err)
+		t.metrics.failed(kindVolume)
+		return
+	}
+	if volumeID == "" {
+		log.Debug("attachment is not for an EBS volume, skipping")
+		return
+	}
+	log = log.With("volumeID", volumeID)
+	if va.Spec.Source.PersistentVolumeName != nil {
+		// The PV reconcile tags it; data-volume tags would add the node's tags.
+		log.Debug("attached volume backs a PV, leaving it to the PV reconcile")
+		t.metrics.skip(kindVolume, "persistent_volume")
+		return
+	}
+
+	node, err := nodes.Get(va.Spec.NodeName)
+	if err != nil {
+		log.Error("failed to get node of volume attachment", "error", err)
+		t.metrics.failed(kindVolume)
+		return
+	}
+	d := t.resolveNode(ctx, node, true)
+	if d.Action != actionTag {
+		log.Debug("node would not be tagged, skipping attached volume", "reason", d.Reason)
+		t.metrics.skip(kindVolume, d.Reason)
+		return
+	}
+	log = log.With("instanceID", d.InstanceID, "region", d.Region)
+
+	inst, err := t.describeInstance(ctx, d.Region, d.InstanceID)
+	if err != nil {
+		log.Error("failed to describe instance", "error", err)
+		t.metrics.failed(kindVolume)
+		return
+	}
+	tags := t.nodeResourceTags(node, d, inst, []string{volumeID}, log)[volumeID]
+	if len(tags) == 0 {
+		t.metrics.skip(kindVolume, "no_matching_policy")
+		return
+	}
+
+	log.Info("tagging attached volume")
+	roles := d.snapshot.keyRoles(resourceVolume, node.Labels)
+	if err = t.applyTagsByRole(ctx, d.Region, []string{volumeID}, tags, roles); err != nil {
+		log.Error("failed to apply tags", "error", err)
+		t.metrics.failed(kindVolume)
+		return
+	}
+	if t.writeBlocked() == "" {
+		t.metrics.succeeded(kindVolume)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestHandleVolumeAttachment(t *testing.T) {
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	_ = nodeIndexer.Add(taintedNode(map[string]string{annotationKey: annotationValue}))
+	pvIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	_ = pvIndexer.Add(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+			CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: "vol-data"},
+		}},
+	})
+	nodes, pvs := corelisters.NewNodeLister(nodeIndexer), corelisters.NewPersistentVolumeLister(pvIndexer)
+
+	attachment := func(attacher string, source storagev1.VolumeAttachmentSource) *storagev1.VolumeAttachment {
+		return &storagev1.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: "csi-1"},
+			Spec: storagev1.VolumeAttachmentSpec{
+				Attacher: attacher,
+				NodeName: "n1",
+				Source:   source,
+			},
+			Status: storagev1.VolumeAttachmentStatus{Attached: true},
+		}
+	}
+	inline := storagev1.VolumeAttachmentSource{InlineVolumeSpec: &corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+		CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com", VolumeHandle: "vol-inline"},
+	}}}
+
+	api := &instanceEC2{}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), api)
+	tagger.handleVolumeAttachment(context.Background(), attachment("ebs.csi.aws.com", inline), nodes, pvs)
+	if len(api.createTags) != 1 || len(api.createTags[0].Resources) != 1 || api.createTags[0].Resources[0] != "vol-inline" {
+		t.Fatalf("CreateTags calls = %v, want one for vol-inline despite the node's tagged annotation", api.createTags)
+	}
+
+	api.createTags = nil
+	tagger.handleVolumeAttachment(context.Background(), attachment("ebs.csi.aws.com", storagev1.VolumeAttachmentSource{PersistentVolumeName: aws.String("pv-1")}), nodes, pvs)
+	if len(api.createTags) != 0 {
+		t.Errorf("CreateTags calls = %v for a volume backing a PV, want none", api.createTags)
+	}
+	if got := testutil.ToFloat64(tagger.metrics.skipped.WithLabelValues(kindVolume, "persistent_volume")); got != 1 {
+		t.Errorf("skipped_total{kind=volume,reason=persistent_volume} = %v, want 1", got)
+	}
+
+	tagger.handleVolumeAttachment(context.Background(), attachment("efs.csi.aws.com", inline), nodes, pvs)
+	if len(api.createTags) != 0 {
+		t.Errorf("CreateTags calls = %v for another driver's attachment, want none", api.createTags)
+	}
+}
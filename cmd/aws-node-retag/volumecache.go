@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// volumeCacheTTL is how long the warm cache serves reconciles after it
+	// was built: the cold-start backfill. Volumes attached later are found
+	// by the regular discovery.
+	volumeCacheTTL = 10 * time.Minute
+	// volumeCacheWarmTimeout bounds the startup describes; reconciles wait
+	// for them at most that long.
+	volumeCacheWarmTimeout = 2 * time.Minute
+)
+
+// volumeCache maps the cluster's instances to their attached volumes, from
+// one paginated DescribeVolumes per region filtered by the cluster ownership
+// tag at startup, so that the reconciles of a cold start need no
+// DescribeVolumes of their own. An instance missing from it, e.g. because
+// none of its volumes carries the tag, is discovered as usual.
+type volumeCache struct {
+	// tagKey is kubernetes.io/cluster/<name>.
+	tagKey string
+	now    func() time.Time
+	// ready is closed once the cache was built, or failed to be.
+	ready chan struct{}
+
+	mu     sync.Mutex
+	warmed time.Time
+	// volumes maps region and instance ID to the IDs of the attached volumes
+	// carrying the tag; an entry is removed once used.
+	volumes map[[2]string][]string
+}
+
+// newVolumeCache returns the cache of cfg, or nil when VOLUME_CACHE is off.
+func newVolumeCache(cfg *Config) *volumeCache {
+	if !cfg.VolumeCache {
+		return nil
+	}
+	return &volumeCache{
+		tagKey:  clusterOwnershipTagPrefix + cfg.ClusterName,
+		now:     time.Now,
+		ready:   make(chan struct{}),
+		volumes: map[[2]string][]string{},
+	}
+}
+
+// Results of a volume cache lookup.
+const (
+	volumeCacheHit  = "hit"
+	volumeCacheMiss = "miss"
+)
+
+// take returns the cached volumes of the instance, waiting for the cache to
+// be built, and volumeCacheHit or volumeCacheMiss; "" once the cache expired.
+// Each entry is used once: a later reconcile of the instance describes it
+// again.
+func (c *volumeCache) take(ctx context.Context, region, instanceID string) ([]string, string) {
+	select {
+	case <-c.ready:
+	case <-ctx.Done():
+		return nil, volumeCacheMiss
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.now().Sub(c.warmed) >= volumeCacheTTL {
+		clear(c.volumes)
+		return nil, ""
+	}
+	key := [2]string{region, instanceID}
+	ids, ok := c.volumes[key]
+	if !ok {
+		return nil, volumeCacheMiss
+	}
+	delete(c.volumes, key)
+	return ids, volumeCacheHit
+}
+
+// cachedVolumes is volumeCache.take, counting hits and misses.
+func (t *Tagger) cachedVolumes(ctx context.Context, region, instanceID string) ([]string, bool) {
+	if t.volumeCache == nil {
+		return nil, false
+	}
+	ids, result := t.volumeCache.take(ctx, region, instanceID)
+	if result != "" {
+		t.metrics.volumeCache.WithLabelValues(result).Inc()
+	}
+	return ids, result == volumeCacheHit
+}
+
+// nodeRegions returns the allowed regions of the nodes, in order.
+func (t *Tagger) nodeRegions(nodes []*corev1.Node) []string {
+	seen := map[string]bool{}
+	for _, node := range nodes {
+		info, err := parseProviderID(node.Spec.ProviderID)
+		if err != nil || info.Fargate {
+			continue
+		}
+		if region, err := regionFromZone(info.Zone); err == nil && t.regionAllowed(region) && t.inPartition(region) {
+			seen[region] = true
+		}
+	}
+	regions := make([]string, 0, len(seen))
+	for r := range seen {
+		regions = append(regions, r)
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// warmVolumeCache builds t.volumeCache for the regions of nodes and releases
+// the reconciles waiting for it. A region that fails is left out, its
+// instances being discovered as usual.
+func (t *Tagger) warmVolumeCache(ctx context.Context, nodes []*corev1.Node) {
+	c := t.volumeCache
+	defer close(c.ready)
+	ctx, cancel := context.WithTimeout(ctx, volumeCacheWarmTimeout)
+	defer cancel()
+	volumes := map[[2]string][]string{}
+	for _, region := range t.nodeRegions(nodes) {
+		byInstance, err := t.describeTaggedVolumes(ctx, region, c.tagKey)
+		if err != nil {
+			t.logger.Warn("failed to warm the volume cache, discovering the region's volumes per node", "region", region, "error", err)
+			continue
+		}
+		for id, vols := range byInstance {
+			volumes[[2]string{region, id}] = vols
+		}
+		t.logger.Info("warmed the volume cache", "region", region, "instances", len(byInstance))
+	}
+	c.mu.Lock()
+	c.volumes, c.warmed = volumes, c.now()
+	c.mu.Unlock()
+}
+
+// describeTaggedVolumes returns the IDs of the volumes carrying tagKey,
+// attached or attaching, by instance ID.
+func (t *Tagger) describeTaggedVolumes(ctx context.Context, region, tagKey string) (map[string][]string, error) {
+	out := map[string][]string{}
+	p := ec2.NewDescribeVolumesPaginator(t.ec2.forRegion(region), &ec2.DescribeVolumesInput{
+		Filters: []ec2types.Filter{
+			{Name: aws.String("tag-key"), Values: []string{tagKey}},
+			{Name: aws.String("attachment.status"), Values: []string{string(ec2types.VolumeAttachmentStateAttached), string(ec2types.VolumeAttachmentStateAttaching)}},
+		},
+		MaxResults: aws.Int32(500),
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("DescribeVolumes: %w", err)
+		}
+		for _, vol := range page.Volumes {
+			for _, a := range vol.Attachments {
+				if a.State != ec2types.VolumeAttachmentStateAttached && a.State != ec2types.VolumeAttachmentStateAttaching {
+					continue
+				}
+				id := aws.ToString(a.InstanceId)
+				out[id] = append(out[id], aws.ToString(vol.VolumeId))
+			}
+		}
+	}
+	return out, nil
+}
+
+// withCachedVolumes returns the volumes of the instance's block device
+// mappings with the cached ones, which include those still attaching.
+func withCachedVolumes(inst *ec2types.Instance, cached []string) []string {
+	ids := attachedVolumes(inst)
+	for _, id := range cached {
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// cacheEC2 answers the DescribeVolumes filtered by tag key with a data volume
+// carrying the ownership tag for each instance in tagged, and counts those
+// calls in warms.
+type cacheEC2 struct {
+	*discoveryEC2
+	tagged []string
+	warms  int
+}
+
+func (f *cacheEC2) DescribeVolumes(ctx context.Context, in *ec2.DescribeVolumesInput, opts ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error) {
+	if aws.ToString(in.Filters[0].Name) != "tag-key" {
+		return f.discoveryEC2.DescribeVolumes(ctx, in, opts...)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.warms++
+	out := &ec2.DescribeVolumesOutput{}
+	for _, id := range f.tagged {
+		out.Volumes = append(out.Volumes, ec2types.Volume{
+			VolumeId:    aws.String("vol-" + id + "-data"),
+			Attachments: []ec2types.VolumeAttachment{{InstanceId: aws.String(id), State: ec2types.VolumeAttachmentStateAttaching}},
+		})
+	}
+	return out, nil
+}
+
+// cacheNodes returns a node in each of zones.
+func cacheNodes(zones ...string) []*corev1.Node {
+	nodes := make([]*corev1.Node, len(zones))
+	for i, zone := range zones {
+		nodes[i] = &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: zone},
+			Spec:       corev1.NodeSpec{ProviderID: "aws:///" + zone + "/i-0123456789abcdef0"},
+		}
+	}
+	return nodes
+}
+
+func cacheTagger(api ec2API, mode string, b backlog) *Tagger {
+	tagger := discoveryTagger(api, mode, b)
+	tagger.volumeCache = newVolumeCache(&Config{VolumeCache: true, ClusterName: "prod"})
+	return tagger
+}
+
+func TestVolumeCacheInstance(t *testing.T) {
+	api := &cacheEC2{discoveryEC2: &discoveryEC2{running: map[string]bool{"i-a": true, "i-b": true}}, tagged: []string{"i-a"}}
+	tagger := cacheTagger(api, discoveryInstance, nil)
+	now := time.Now()
+	tagger.volumeCache.now = func() time.Time { return now }
+	ctx := context.Background()
+	tagger.warmVolumeCache(ctx, cacheNodes("us-east-1a", "us-east-1b", "fargate"))
+	if api.warms != 1 {
+		t.Fatalf("%d warming describes, want one for the region", api.warms)
+	}
+
+	// A hit adds the cached volume still attaching to the mappings.
+	_, volumes, err := tagger.discoverInstance(ctx, "us-east-1", "i-a")
+	if err != nil || !reflect.DeepEqual(volumes, []string{"vol-i-a-root", "vol-i-a-data"}) {
+		t.Errorf("discoverInstance(i-a) = %v, %v", volumes, err)
+	}
+	// A miss falls back to the block device mappings, as an entry used once.
+	for _, id := range []string{"i-b", "i-a"} {
+		if _, volumes, err = tagger.discoverInstance(ctx, "us-east-1", id); err != nil || !reflect.DeepEqual(volumes, []string{"vol-" + id + "-root"}) {
+			t.Errorf("discoverInstance(%s) = %v, %v", id, volumes, err)
+		}
+	}
+	if got := testutil.ToFloat64(tagger.metrics.volumeCache.WithLabelValues(volumeCacheHit)); got != 1 {
+		t.Errorf("hits = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(tagger.metrics.volumeCache.WithLabelValues(volumeCacheMiss)); got != 2 {
+		t.Errorf("misses = %v, want 2", got)
+	}
+
+	// Once expired the cache is neither used nor counted.
+	tagger.volumeCache.volumes[[2]string{"us-east-1", "i-b"}] = []string{"vol-i-b-data"}
+	now = now.Add(volumeCacheTTL)
+	if _, volumes, _ = tagger.discoverInstance(ctx, "us-east-1", "i-b"); len(volumes) != 1 {
+		t.Errorf("volumes = %v after the TTL, want the mappings alone", volumes)
+	}
+	if got := testutil.ToFloat64(tagger.metrics.volumeCache.WithLabelValues(volumeCacheMiss)); got != 2 {
+		t.Errorf("misses = %v after the TTL, want 2", got)
+	}
+}
+
+func TestVolumeCacheBulk(t *testing.T) {
+	api := &cacheEC2{discoveryEC2: &discoveryEC2{running: map[string]bool{"i-a": true, "i-b": true}}, tagged: []string{"i-a", "i-b"}}
+	b := &fakeBacklog{queued: map[string][]string{"us-east-1": {"i-b"}}}
+	tagger := cacheTagger(api, discoveryBulk, b)
+	ctx := context.Background()
+	tagger.warmVolumeCache(ctx, cacheNodes("us-east-1a"))
+
+	_, volumes, err := tagger.discoverInstance(ctx, "us-east-1", "i-a")
+	if err != nil || !reflect.DeepEqual(volumes, []string{"vol-i-a-root", "vol-i-a-data"}) {
+		t.Fatalf("discoverInstance(i-a) = %v, %v", volumes, err)
+	}
+	if len(api.bulk) != 1 || len(api.volumes) != 0 {
+		t.Errorf("bulk = %v, volumes = %v; want the round's volumes from the cache", api.bulk, api.volumes)
+	}
+
+	// Entries are used once: the next round describes the volumes.
+	if _, _, err = tagger.discoverInstance(ctx, "us-east-1", "i-a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(api.volumes) != 1 || !reflect.DeepEqual(api.volumes[0], []string{"i-a"}) {
+		t.Errorf("volumes = %v, want i-a alone described", api.volumes)
+	}
+}
+
+func TestVolumeCacheWaitsForWarming(t *testing.T) {
+	tagger := cacheTagger(&cacheEC2{discoveryEC2: &discoveryEC2{}}, discoveryInstance, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := tagger.cachedVolumes(ctx, "us-east-1", "i-a"); ok {
+		t.Error("cachedVolumes hit before the cache was warmed")
+	}
+}
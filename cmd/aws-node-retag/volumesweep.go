@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	smithy "github.com/aws/smithy-go"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// sweepCursor persists the pagination token of an unfinished volume sweep per
+// region, so a restarted controller resumes the sweep instead of starting
+// over. A nil cursor keeps no state.
+type sweepCursor struct {
+	k8s       kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// load returns the token to resume the region's sweep from; empty starts a
+// new sweep.
+func (c *sweepCursor) load(ctx context.Context, region string) (string, error) {
+	if c == nil {
+		return "", nil
+	}
+	cm, err := c.k8s.CoreV1().ConfigMaps(c.namespace).Get(ctx, c.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return cm.Data[region], nil
+}
+
+// save records the token of the next page; an empty token marks the region's
+// sweep as complete.
+func (c *sweepCursor) save(ctx context.Context, region, token string) error {
+	if c == nil {
+		return nil
+	}
+	return updateConfigMapData(ctx, c.k8s, c.namespace, c.name, func(data map[string]string) map[string]string {
+		if token == "" {
+			delete(data, region)
+		} else {
+			data[region] = token
+		}
+		return data
+	})
+}
+
+// volumeSweepFilter turns a "key" or "key=value" ownership tag into the
+// DescribeVolumes filter selecting the volumes that carry it.
+func volumeSweepFilter(ownershipTag string) ec2types.Filter {
+	key, value, ok := strings.Cut(ownershipTag, "=")
+	if !ok {
+		return ec2types.Filter{Name: aws.String("tag-key"), Values: []string{key}}
+	}
+	return ec2types.Filter{Name: aws.String("tag:" + key), Values: []string{value}}
+}
+
+// isInvalidPaginationToken reports whether EC2 rejected a resumed token,
+// e.g. because it expired while the controller was down.
+func isInvalidPaginationToken(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidPaginationToken"
+}
+
+// sweepVolumes tags every EBS volume in region that carries the ownership
+// tag, whether or not a node or PV still references it, one page of
+// pageSize volumes at a time. Volumes already carrying the tags are skipped,
+// and so are attached volumes: a node's root and data volumes get the
+// ROOT_VOLUME_TAGS and DATA_VOLUME_TAGS of its reconcile, and a PV's volume
+// those of the PV's, which the sweep's tags would overwrite. The token of the next page is saved after each page, so an interrupted
+// sweep resumes where it stopped.
+func (t *Tagger) sweepVolumes(ctx context.Context, region, ownershipTag string, pageSize int, cursor *sweepCursor, log *slog.Logger) error {
+	snap := t.current()
+	// Unreferenced volumes have no labels to select policies by, so only
+	// policies whose selector matches an empty label set apply.
+	quiet := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tags, _ := snap.resourceTags(snap.tags, resourcePersistentVolume, nil, quiet)
+	roles := snap.keyRoles(resourcePersistentVolume, nil)
+	if len(tags) == 0 {
+		return nil
+	}
+	written := t.clusterKeys(tags)
+
+	token, err := cursor.load(ctx, region)
+	if err != nil {
+		return fmt.Errorf("load sweep cursor: %w", err)
+	}
+	if token != "" {
+		log.Info("resuming interrupted volume sweep")
+	}
+
+	var seen, tagged int
+	for {
+		in := &ec2.DescribeVolumesInput{
+			Filters:    []ec2types.Filter{volumeSweepFilter(ownershipTag)},
+			MaxResults: aws.Int32(int32(pageSize)),
+		}
+		if token != "" {
+			in.NextToken = aws.String(token)
+		}
+		out, err := t.ec2.forRegion(region).DescribeVolumes(ctx, in)
+		if err != nil && token != "" && isInvalidPaginationToken(err) {
+			log.Warn("saved sweep position expired, restarting the sweep", "error", err)
+			token = ""
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("DescribeVolumes: %w", err)
+		}
+
+		var ids []string
+		for _, v := range out.Volumes {
+			if len(v.Attachments) == 0 && !hasTags(v.Tags, written) {
+				ids = append(ids, aws.ToString(v.VolumeId))
+			}
+		}
+		seen += len(out.Volumes)
+		if len(ids) > 0 {
+			if err := t.applyTagsByRole(ctx, region, ids, tags, roles); err != nil {
+				return err
+			}
+			tagged += len(ids)
+			t.metrics.tagged.WithLabelValues(kindVolume).Add(float64(len(ids)))
+		}
+
+		token = aws.ToString(out.NextToken)
+		if err := cursor.save(ctx, region, token); err != nil {
+			log.Warn("failed to save sweep position", "error", err)
+		}
+		if token == "" {
+			log.Info("volume sweep complete", "volumes", seen, "tagged", tagged)
+			return nil
+		}
+	}
+}
+
+// hasTags reports whether every tag in want is set to its value in have.
+func hasTags(have []ec2types.Tag, want map[string]string) bool {
+	n := 0
+	for _, tag := range have {
+		if v, ok := want[aws.ToString(tag.Key)]; ok && v == aws.ToString(tag.Value) {
+			n++
+		}
+	}
+	return n == len(want)
+}
+
+// runVolumeSweeps sweeps the volumes of each region every interval, starting
+// right away so an interrupted sweep is resumed after a restart.
+func (t *Tagger) runVolumeSweeps(ctx context.Context, cfg *Config, regions []string, cursor *sweepCursor, logger *slog.Logger) {
+	sweep := func() {
+		if t.rollout.active() {
+			logger.Info("node pool rollout in progress, skipping this volume sweep")
+			return
+		}
+		for _, region := range regions {
+			log := logger.With("region", region)
+			if !t.regionAllowed(region) {
+				log.Warn("region not in allowed list, not sweeping its volumes")
+				continue
+			}
+			if !t.features.enabled(featureVolumeSweep, region) {
+				continue
+			}
+			if err := t.sweepVolumes(ctx, region, cfg.VolumeSweepTag, cfg.VolumeSweepPageSize, cursor, log); err != nil && ctx.Err() == nil {
+				if t.features.denied(featureVolumeSweep, region, err) {
+					continue
+				}
+				log.Error("volume sweep failed", "error", err)
+				t.metrics.failed(kindVolume)
+			}
+		}
+	}
+
+	sweep()
+	ticker := time.NewTicker(cfg.VolumeSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sweep()
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// pagedVolumesEC2 serves volumes two per page, using the index of the next
+// volume as the pagination token, and can fail CreateTags once.
+type pagedVolumesEC2 struct {
+	taggingEC2
+	volumes   []ec2types.Volume
+	tokens    []string
+	failTags  bool
+	lastInput *ec2.DescribeVolumesInput
+}
+
+func (f *pagedVolumesEC2) DescribeVolumes(_ context.Context, in *ec2.DescribeVolumesInput, _ ...func(*ec2.Options)) (*ec2.DescribeVolumesOutput, error) {
+	f.lastInput = in
+	f.tokens = append(f.tokens, aws.ToString(in.NextToken))
+	start, _ := strconv.Atoi(aws.ToString(in.NextToken))
+	end := min(start+2, len(f.volumes))
+	out := &ec2.DescribeVolumesOutput{Volumes: f.volumes[start:end]}
+	if end < len(f.volumes) {
+		out.NextToken = aws.String(strconv.Itoa(end))
+	}
+	return out, nil
+}
+
+func (f *pagedVolumesEC2) CreateTags(ctx context.Context, in *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	if f.failTags {
+		f.failTags = false
+		return nil, errors.New("boom")
+	}
+	return f.taggingEC2.CreateTags(ctx, in, optFns...)
+}
+
+func TestSweepVolumesResumes(t *testing.T) {
+	volume := func(id string, tags ...ec2types.Tag) ec2types.Volume {
+		return ec2types.Volume{VolumeId: aws.String(id), Tags: tags}
+	}
+	tagged := ec2types.Tag{Key: aws.String("Env"), Value: aws.String("prod")}
+	api := &pagedVolumesEC2{volumes: []ec2types.Volume{
+		volume("vol-1"), volume("vol-2", tagged),
+		volume("vol-3"), volume("vol-4"),
+		volume("vol-5"),
+	}}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), api)
+	cursor := &sweepCursor{k8s: fake.NewSimpleClientset(), namespace: "kube-system", name: "sweep"}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	if err := tagger.sweepVolumes(ctx, "us-east-1", "kubernetes.io/cluster/prod=owned", 5, cursor, log); err != nil {
+		t.Fatal(err)
+	}
+	if f := api.lastInput.Filters[0]; aws.ToString(f.Name) != "tag:kubernetes.io/cluster/prod" || f.Values[0] != "owned" {
+		t.Errorf("filter = %s=%v", aws.ToString(f.Name), f.Values)
+	}
+	var ids []string
+	for _, in := range api.createTags {
+		ids = append(ids, in.Resources...)
+	}
+	if len(ids) != 4 {
+		t.Errorf("tagged %v, want every volume except the already tagged vol-2", ids)
+	}
+	if token, _ := cursor.load(ctx, "us-east-1"); token != "" {
+		t.Errorf("cursor = %q after a complete sweep, want empty", token)
+	}
+
+	// An interrupted sweep resumes from the saved page.
+	api.createTags, api.tokens = nil, nil
+	api.failTags = true
+	if err := cursor.save(ctx, "us-east-1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tagger.sweepVolumes(ctx, "us-east-1", "kubernetes.io/cluster/prod", 5, cursor, log); err == nil {
+		t.Fatal("expected the CreateTags failure")
+	}
+	if token, _ := cursor.load(ctx, "us-east-1"); token != "2" {
+		t.Errorf("cursor = %q after a failed page, want it kept at 2", token)
+	}
+	if err := tagger.sweepVolumes(ctx, "us-east-1", "kubernetes.io/cluster/prod", 5, cursor, log); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"2", "2", "4"}; !reflect.DeepEqual(api.tokens, want) {
+		t.Errorf("page tokens = %v, want %v", api.tokens, want)
+	}
+	if f := api.lastInput.Filters[0]; aws.ToString(f.Name) != "tag-key" {
+		t.Errorf("filter name = %s, want tag-key for a key-only ownership tag", aws.ToString(f.Name))
+	}
+}
+
+func TestSweepVolumesSkipsAttached(t *testing.T) {
+	root := ec2types.Volume{
+		VolumeId:    aws.String("vol-root"),
+		Attachments: []ec2types.VolumeAttachment{{InstanceId: aws.String("i-0123456789abcdef0"), Device: aws.String("/dev/xvda")}},
+		Tags:        []ec2types.Tag{{Key: aws.String("Env"), Value: aws.String("root")}},
+	}
+	api := &pagedVolumesEC2{volumes: []ec2types.Volume{root, {VolumeId: aws.String("vol-orphan")}}}
+	tagger := newStartupTagger(fake.NewSimpleClientset(), api)
+	tagger.snapshot.Store(&tagSnapshot{tags: map[string]string{"Env": "prod"}, rootVolumeTags: map[string]string{"Env": "root"}})
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	if err := tagger.sweepVolumes(context.Background(), "us-east-1", "kubernetes.io/cluster/prod", 5, nil, log); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, in := range api.createTags {
+		ids = append(ids, in.Resources...)
+	}
+	// The root volume keeps its ROOT_VOLUME_TAGS value.
+	if !reflect.DeepEqual(ids, []string{"vol-orphan"}) {
+		t.Errorf("tagged %v, want only the detached vol-orphan", ids)
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// workItem is a reconcile of one object. key identifies the object; region
+// is the AWS region its calls go to, "" when unknown. instanceID is the EC2
+// instance a node reconcile describes, when known, so a backlog of nodes can
+// be described in bulk (see discovery.go).
+type workItem struct {
+	key        string
+	region     string
+	instanceID string
+	fn         func()
+	// urgent items run ahead of the other items of their region, e.g. new
+	// nodes during a rollout (see rollout.go).
+	urgent bool
+	// queued is when the item was queued, set by the pool.
+	queued time.Time
+}
+
+// workPool runs informer events on a fixed number of workers (WORKERS), so a
+// burst of nodes is not serialized behind slow AWS calls.
+//
+// Items are queued per region and the workers take them from the regions in
+// turn, each region holding at most its fair share of the workers, so a
+// throttled region cannot starve the others. Urgent items go ahead of the
+// others in their region's queue, and regions with urgent items are served
+// first. An item added while the same key is queued replaces the queued one;
+// while the key is running it is queued again once the running item
+// finishes, so an object is never reconciled twice at the same time.
+type workPool struct {
+	workers int
+	// track wraps each item, see health.track.
+	track func(func())
+	// observeWait, when set, receives the time each item spent queued.
+	observeWait func(time.Duration)
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	regions  []string // round-robin order
+	next     int
+	queues   map[string][]string // region -> keys, urgent then oldest first
+	urgent   map[string]int      // region -> urgent keys at the head of its queue
+	queued   map[string]workItem
+	running  map[string]bool
+	requeued map[string]workItem    // added while running
+	retries  map[string]*time.Timer // pending retries, see retry
+	// forgotten holds the running keys whose retries forget dropped.
+	forgotten map[string]bool
+	active    map[string]int // region -> running items
+	closed    bool
+	// draining is set by drain; drained is closed once nothing is queued or
+	// running after that.
+	draining bool
+	drained  chan struct{}
+}
+
+func newWorkPool(workers int, track func(func())) *workPool {
+	p := &workPool{
+		workers:   workers,
+		track:     track,
+		queues:    map[string][]string{},
+		urgent:    map[string]int{},
+		queued:    map[string]workItem{},
+		running:   map[string]bool{},
+		requeued:  map[string]workItem{},
+		retries:   map[string]*time.Timer{},
+		forgotten: map[string]bool{},
+		active:    map[string]int{},
+		drained:   make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// add queues item. Items added after the pool stopped or started draining
+// are dropped.
+func (p *workPool) add(item workItem) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.draining {
+		return
+	}
+	p.enqueue(item)
+}
+
+// retry queues a running item again delay after now, unless an item for its
+// key is added meanwhile: that one carries a newer version of the object.
+// Retries still pending when the pool stops or starts draining are dropped.
+func (p *workPool) retry(item workItem, delay time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.draining {
+		return
+	}
+	if _, ok := p.requeued[item.key]; ok || p.forgotten[item.key] {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.retries[item.key] != timer {
+			return
+		}
+		delete(p.retries, item.key)
+		if !p.closed && !p.draining {
+			p.enqueue(item)
+		}
+	})
+	p.retries[item.key] = timer
+}
+
+// forget drops the pending retries of keys and the items added for them while
+// running, e.g. once their object is deleted, so a retry does not reconcile
+// the deleted object again. A running item of a key is not retried either.
+func (p *workPool) forget(keys ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, key := range keys {
+		if timer, ok := p.retries[key]; ok {
+			timer.Stop()
+			delete(p.retries, key)
+		}
+		delete(p.requeued, key)
+		if p.running[key] {
+			p.forgotten[key] = true
+		}
+	}
+}
+
+func (p *workPool) enqueue(item workItem) {
+	if timer, ok := p.retries[item.key]; ok {
+		timer.Stop()
+		delete(p.retries, item.key)
+	}
+	if p.running[item.key] {
+		p.requeued[item.key] = item
+		return
+	}
+	if prev, ok := p.queued[item.key]; ok {
+		// Keep the queue position, run the latest version of the object.
+		item.region, item.queued = prev.region, prev.queued
+		p.queued[item.key] = item
+		return
+	}
+	if _, ok := p.queues[item.region]; !ok {
+		p.regions = append(p.regions, item.region)
+	}
+	item.queued = time.Now()
+	if q := p.queues[item.region]; item.urgent {
+		n := p.urgent[item.region]
+		p.queues[item.region] = append(q[:n:n], append([]string{item.key}, q[n:]...)...)
+		p.urgent[item.region]++
+	} else {
+		p.queues[item.region] = append(q, item.key)
+	}
+	p.queued[item.key] = item
+	p.cond.Signal()
+}
+
+// fairShare is the number of workers a region may hold: every worker while
+// only one region has queued or running items, as in a single-region
+// cluster; otherwise the workers split evenly, rounded up, between those
+// regions, one always being kept for the others.
+func (p *workPool) fairShare() int {
+	busy := 0
+	for _, r := range p.regions {
+		if len(p.queues[r]) > 0 || p.active[r] > 0 {
+			busy++
+		}
+	}
+	if busy <= 1 {
+		return p.workers
+	}
+	return min(max(p.workers-1, 1), (p.workers+busy-1)/busy)
+}
+
+// get blocks until an item may run and marks it running. It returns false
+// once the pool is stopped.
+func (p *workPool) get() (workItem, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.closed {
+		share := p.fairShare()
+		for i := range 2 * len(p.regions) {
+			r := p.regions[(p.next+i)%len(p.regions)]
+			// The first round only serves the regions with urgent items.
+			if len(p.queues[r]) == 0 || p.active[r] >= share || (i < len(p.regions) && p.urgent[r] == 0) {
+				continue
+			}
+			key := p.queues[r][0]
+			p.queues[r] = p.queues[r][1:]
+			if p.urgent[r] > 0 {
+				p.urgent[r]--
+			}
+			item := p.queued[key]
+			delete(p.queued, key)
+			p.running[key] = true
+			p.active[r]++
+			p.next = (p.next + i + 1) % len(p.regions)
+			return item, true
+		}
+		p.cond.Wait()
+	}
+	return workItem{}, false
+}
+
+// done releases a running item and queues the item added meanwhile, if any.
+func (p *workPool) done(item workItem) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.running, item.key)
+	delete(p.forgotten, item.key)
+	p.active[item.region]--
+	if again, ok := p.requeued[item.key]; ok {
+		delete(p.requeued, item.key)
+		if !p.closed {
+			p.enqueue(again)
+		}
+	}
+	p.checkDrained()
+	// The fair share may have grown for regions waiting on it.
+	p.cond.Broadcast()
+}
+
+// queuedInstances returns the instance IDs of the items queued in region,
+// oldest first.
+func (p *workPool) queuedInstances(region string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var ids []string
+	for _, key := range p.queues[region] {
+		if id := p.queued[key].instanceID; id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// checkDrained closes drained once the pool is draining and idle.
+func (p *workPool) checkDrained() {
+	if !p.draining || len(p.queued) > 0 || len(p.running) > 0 {
+		return
+	}
+	select {
+	case <-p.drained:
+	default:
+		close(p.drained)
+	}
+}
+
+// drain stops the pool accepting items and waits until the queued and
+// running items, including those re-queued while running, have finished or
+// ctx is done. It returns the number of items still queued or running then.
+// The workers keep running until run's context is cancelled.
+func (p *workPool) drain(ctx context.Context) int {
+	p.mu.Lock()
+	p.draining = true
+	p.checkDrained()
+	p.mu.Unlock()
+	select {
+	case <-p.drained:
+		return 0
+	case <-ctx.Done():
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return len(p.queued) + len(p.running) + len(p.requeued)
+	}
+}
+
+// run starts the workers and blocks until ctx is cancelled and the running
+// items have finished. Queued items are dropped; the informers list them
+// again on the next start. Call drain first to finish them.
+func (p *workPool) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range p.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				item, ok := p.get()
+				if !ok {
+					return
+				}
+				if p.observeWait != nil {
+					p.observeWait(time.Since(item.queued))
+				}
+				p.track(item.fn)
+				p.done(item)
+			}
+		}()
+	}
+	<-ctx.Done()
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	wg.Wait()
+}
+
+// nodeEventHandler queues a reconcile when a node is added, when its
+// providerID is set, or when a re-tag is requested with the force annotation,
+// and stamps the instance of a node that gets a termination taint. During a
+// rollout, untagged nodes are queued as urgent (see rollout.go).
+func (t *Tagger) nodeEventHandler(ctx context.Context, pool *workPool) cache.ResourceEventHandlerFuncs {
+	queue := func(node *corev1.Node) {
+		pool.add(t.nodeItem(ctx, pool, node, t.urgent(node), func(ctx context.Context) error { return t.handleNode(ctx, node) }))
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if node, ok := obj.(*corev1.Node); ok {
+				t.rollout.observe(node)
+				queue(node)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode, ok1 := oldObj.(*corev1.Node)
+			newNode, ok2 := newObj.(*corev1.Node)
+			if !ok1 || !ok2 {
+				return
+			}
+			t.rollout.observe(newNode)
+			// A node about to be terminated gets a final reconcile that
+			// stamps its instance, ahead of the queue: the instance may be
+			// gone soon.
+			if taint := t.termination.added(oldNode, newNode); taint != "" {
+				item := workItem{key: "node-terminating/" + newNode.Name, region: nodeRegionHint(newNode), instanceID: nodeInstanceHint(newNode), urgent: true}
+				pool.add(t.budgeted(ctx, pool, item, func(ctx context.Context) error { return t.tagTermination(ctx, newNode, taint) }))
+			}
+			// Only act when ProviderID transitions from empty to set, or a
+			// re-tag is requested with the force annotation.
+			// This handles the case where cloud-controller-manager sets the
+			// ProviderID after the node first appears in the API.
+			if (oldNode.Spec.ProviderID == "" && newNode.Spec.ProviderID != "") || t.forceRequested(newNode.Annotations) {
+				queue(newNode)
+				return
+			}
+			// A tagged node is re-tagged when an in-place update changes its
+			// inventory tags.
+			if t.isTagged(newNode.Annotations) && t.inventoryChanged(oldNode, newNode) {
+				pool.add(t.nodeItem(ctx, pool, newNode, false, func(ctx context.Context) error { return t.tagNode(ctx, newNode, true) }))
+			}
+		},
+	}
+}
+
+// budgetRetryMaxBackoff caps the backoff of the retries of a reconcile that
+// keeps running out of its budget.
+const budgetRetryMaxBackoff = 30 * time.Minute
+
+// nodeItem returns the work item running reconcile for node under the
+// reconcile budget (see budgeted).
+func (t *Tagger) nodeItem(ctx context.Context, pool *workPool, node *corev1.Node, urgent bool, reconcile func(ctx context.Context) error) workItem {
+	return t.budgeted(ctx, pool, workItem{key: "node/" + node.Name, region: nodeRegionHint(node), instanceID: nodeInstanceHint(node), urgent: urgent}, reconcile)
+}
+
+// budgeted returns item running reconcile under the NODE_RECONCILE_TIMEOUT
+// budget, so an object whose AWS calls are slow holds a worker for a bounded
+// time. Once the budget runs out the reconcile's context is cancelled,
+// failing its in-flight calls, and a reconcile that returns the deadline
+// error is queued again behind the others of its region, after a backoff of
+// the budget itself, doubling with each retry up to budgetRetryMaxBackoff. A
+// cancelled ctx, as on shutdown, does not requeue it.
+func (t *Tagger) budgeted(ctx context.Context, pool *workPool, item workItem, reconcile func(ctx context.Context) error) workItem {
+	// Retries reuse the item, so the count carries over; an event for the
+	// object queues a new item, starting over.
+	var retries int
+	item.fn = func() {
+		if t.nodeTimeout <= 0 {
+			_ = reconcile(ctx)
+			return
+		}
+		budget, cancel := context.WithTimeout(ctx, t.nodeTimeout)
+		defer cancel()
+		err := reconcile(budget)
+		if ctx.Err() != nil || !errors.Is(err, context.DeadlineExceeded) {
+			return
+		}
+		delay := min(t.nodeTimeout<<min(retries, 16), budgetRetryMaxBackoff)
+		retries++
+		t.logger.Warn("reconcile ran out of time, queued again", "item", item.key, "timeout", t.nodeTimeout, "retryIn", delay)
+		t.metrics.nodeReconcileTimeouts.WithLabelValues(item.region).Inc()
+		pool.retry(item, delay)
+	}
+	return item
+}
+
+// nodeDeleteFunc forgets the per-node series, rollout annotation, tag writes,
+// policy conflicts and failure streak of a deleted node and, with untag,
+// queues the removal of the managed tags from its retained volumes.
+func (t *Tagger) nodeDeleteFunc(ctx context.Context, pool *workPool, pvs corelisters.PersistentVolumeLister, untag bool) func(obj interface{}) {
+	return func(obj interface{}) {
+		node, ok := deletedNode(obj)
+		if !ok {
+			return
+		}
+		pool.forget("node/"+node.Name, "node-terminating/"+node.Name)
+		t.metrics.forgetNode(node.Name)
+		t.rollout.forget(node.Name)
+		t.forgetNodeWrites(node)
+		t.forgetPolicyConflicts("node/" + node.Name)
+		if t.notifier != nil {
+			t.notifier.forgetNode(node.Name)
+		}
+		if !untag {
+			return
+		}
+		pool.add(workItem{key: "node-delete/" + node.Name, region: nodeRegionHint(node), fn: func() {
+			t.handleNodeDelete(ctx, obj, pvs)
+		}})
+	}
+}
+
+// pvEventHandler queues a reconcile when a bound PV is added, when a PV
+// becomes bound (dynamic provisioning completed), or when a re-tag of a bound
+// PV is requested with the force annotation. It forgets the tag writes of a
+// deleted PV's volume and the policy conflicts found on the PV.
+func (t *Tagger) pvEventHandler(ctx context.Context, pool *workPool) cache.ResourceEventHandlerFuncs {
+	queue := func(pv *corev1.PersistentVolume) {
+		item := workItem{key: "pv/" + pv.Name, region: pvRegionHint(pv)}
+		pool.add(t.budgeted(ctx, pool, item, func(ctx context.Context) error { return t.handlePV(ctx, pv) }))
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			pv, ok := obj.(*corev1.PersistentVolume)
+			if !ok {
+				return
+			}
+			// Only handle Bound PVs — skip Released/Available/Failed volumes,
+			// whose backing EBS volumes may no longer exist.
+			if pv.Status.Phase == corev1.VolumeBound {
+				queue(pv)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPV, ok1 := oldObj.(*corev1.PersistentVolume)
+			newPV, ok2 := newObj.(*corev1.PersistentVolume)
+			if !ok1 || !ok2 {
+				return
+			}
+			if newPV.Status.Phase == corev1.VolumeBound &&
+				(oldPV.Status.Phase != corev1.VolumeBound || t.forceRequested(newPV.Annotations)) {
+				queue(newPV)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			pv, ok := deletedPV(obj)
+			if !ok {
+				return
+			}
+			pool.forget("pv/" + pv.Name)
+			t.writes.forget(ebsVolumeID(pv))
+			t.forgetPolicyConflicts("pv/" + pv.Name)
+		},
+	}
+}
+
+// nodeRegionHint returns the region of the node from its providerID or
+// region label, "" when neither gives one. It only groups work by region;
+// decideNode resolves the region for tagging.
+func nodeRegionHint(node *corev1.Node) string {
+	if info, err := parseProviderID(node.Spec.ProviderID); err == nil && info.Zone != "" {
+		if region, err := regionFromZone(info.Zone); err == nil {
+			return region
+		}
+	}
+	return node.Labels[corev1.LabelTopologyRegion]
+}
+
+// nodeInstanceHint returns the instance ID from the node's providerID, ""
+// when it has none.
+func nodeInstanceHint(node *corev1.Node) string {
+	if info, err := parseProviderID(node.Spec.ProviderID); err == nil {
+		return info.InstanceID
+	}
+	return ""
+}
+
+// pvRegionHint is nodeRegionHint for a PV, from its node affinity.
+func pvRegionHint(pv *corev1.PersistentVolume) string {
+	region, _ := parseRegionFromPV(pv)
+	return region
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func runPool(t *testing.T, workers int) *workPool {
+	t.Helper()
+	p := newWorkPool(workers, func(fn func()) { fn() })
+	startPool(t, p)
+	return p
+}
+
+// startPool runs p's workers until the test ends.
+func startPool(t *testing.T, p *workPool) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { p.run(ctx); close(done) }()
+	t.Cleanup(func() { cancel(); <-done })
+}
+
+func TestWorkPoolRegionFairness(t *testing.T) {
+	// The workers start once both regions have items queued.
+	p := newWorkPool(4, func(fn func()) { fn() })
+
+	// A throttled region: its items block until released.
+	release := make(chan struct{})
+	defer close(release)
+	var throttled atomic.Int32
+	for _, key := range []string{"a1", "a2", "a3", "a4", "a5", "a6"} {
+		p.add(workItem{key: key, region: "us-east-1", fn: func() { throttled.Add(1); <-release }})
+	}
+
+	// Other regions still get workers. Each records the workers the
+	// throttled region holds meanwhile.
+	var wg sync.WaitGroup
+	var held atomic.Int32
+	for _, key := range []string{"b1", "b2", "b3"} {
+		wg.Add(1)
+		p.add(workItem{key: key, region: "eu-west-1", fn: func() {
+			if n := throttled.Load(); n > held.Load() {
+				held.Store(n)
+			}
+			wg.Done()
+		}})
+	}
+	startPool(t, p)
+	finished := make(chan struct{})
+	go func() { wg.Wait(); close(finished) }()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("items of eu-west-1 starved behind the throttled region")
+	}
+	if n := held.Load(); n > 3 {
+		t.Errorf("throttled region holds %d workers while another region has work, want at most 3", n)
+	}
+}
+
+func TestWorkPoolSingleRegionUsesEveryWorker(t *testing.T) {
+	p := runPool(t, 2)
+	var running atomic.Int32
+	all, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	for _, key := range []string{"a1", "a2", "a3"} {
+		p.add(workItem{key: key, region: "us-east-1", fn: func() {
+			if running.Add(1) == 2 {
+				close(all)
+			}
+			<-release
+		}})
+	}
+	select {
+	case <-all:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%d of 2 workers busy with a single region", running.Load())
+	}
+}
+
+func TestWorkPoolKeySerialized(t *testing.T) {
+	p := runPool(t, 4)
+
+	var running, overlaps, runs atomic.Int32
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	item := func() workItem {
+		return workItem{key: "node/n1", region: "us-east-1", fn: func() {
+			if running.Add(1) > 1 {
+				overlaps.Add(1)
+			}
+			runs.Add(1)
+			started <- struct{}{}
+			<-release
+			running.Add(-1)
+		}}
+	}
+	p.add(item())
+	<-started
+	// Added while running: collapsed into one more run after the first.
+	p.add(item())
+	p.add(item())
+	close(release)
+	<-started
+
+	deadline := time.Now().Add(5 * time.Second)
+	for running.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if overlaps.Load() != 0 {
+		t.Error("the same key ran on two workers at once")
+	}
+	if n := runs.Load(); n != 2 {
+		t.Errorf("runs = %d, want 2", n)
+	}
+}
+
+func TestWorkPoolDrain(t *testing.T) {
+	p := runPool(t, 2)
+
+	var runs atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	p.add(workItem{key: "node/n1", fn: func() { close(started); <-release; runs.Add(1) }})
+	<-started
+	for _, key := range []string{"node/n2", "node/n3"} {
+		p.add(workItem{key: key, fn: func() { runs.Add(1) }})
+	}
+	// Re-queued while running: still run by the drain.
+	p.add(workItem{key: "node/n1", fn: func() { runs.Add(1) }})
+
+	// The grace period expires while n1 runs.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if left := p.drain(ctx); left == 0 {
+		t.Error("drain returned 0 while an item was still running")
+	}
+
+	p.add(workItem{key: "node/n4", fn: func() { runs.Add(100) }})
+	close(release)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if left := p.drain(ctx); left != 0 {
+		t.Fatalf("drain left %d items", left)
+	}
+	if n := runs.Load(); n != 4 {
+		t.Errorf("runs = %d, want 4: the queued and re-queued items, not the one added while draining", n)
+	}
+}
+
+func TestWorkPoolDrainIdle(t *testing.T) {
+	p := runPool(t, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if left := p.drain(ctx); left != 0 {
+		t.Errorf("drain of an idle pool left %d items", left)
+	}
+}
+
+func TestNodeRegionHint(t *testing.T) {
+	cases := []struct {
+		node *corev1.Node
+		want string
+	}{
+		{&corev1.Node{Spec: corev1.NodeSpec{ProviderID: "aws:///eu-west-1b/i-0123456789abcdef0"}}, "eu-west-1"},
+		{&corev1.Node{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{corev1.LabelTopologyRegion: "us-west-2"}}}, "us-west-2"},
+		{&corev1.Node{}, ""},
+	}
+	for _, tc := range cases {
+		if got := nodeRegionHint(tc.node); got != tc.want {
+			t.Errorf("nodeRegionHint(%q) = %q, want %q", tc.node.Spec.ProviderID, got, tc.want)
+		}
+	}
+}
+
+func TestWorkPoolQueuedInstances(t *testing.T) {
+	// No workers run, so every item stays queued.
+	p := newWorkPool(1, func(fn func()) { fn() })
+	p.add(workItem{key: "node/a", region: "us-east-1", instanceID: "i-a"})
+	p.add(workItem{key: "pv/a", region: "us-east-1"})
+	p.add(workItem{key: "node/b", region: "us-east-1", instanceID: "i-b"})
+	p.add(workItem{key: "node/c", region: "eu-west-1", instanceID: "i-c"})
+
+	if got := p.queuedInstances("us-east-1"); len(got) != 2 || got[0] != "i-a" || got[1] != "i-b" {
+		t.Errorf("queuedInstances(us-east-1) = %v, want [i-a i-b]", got)
+	}
+	if got := p.queuedInstances("ap-south-1"); len(got) != 0 {
+		t.Errorf("queuedInstances(ap-south-1) = %v", got)
+	}
+	if id := nodeInstanceHint(&corev1.Node{Spec: corev1.NodeSpec{ProviderID: "aws:///eu-west-1b/i-0123456789abcdef0"}}); id != "i-0123456789abcdef0" {
+		t.Errorf("nodeInstanceHint = %q", id)
+	}
+}
+
+func TestWorkPoolUrgentFirst(t *testing.T) {
+	// No workers run: items are taken with get.
+	p := newWorkPool(4, func(fn func()) { fn() })
+	p.add(workItem{key: "a1", region: "us-east-1"})
+	p.add(workItem{key: "a2", region: "us-east-1"})
+	p.add(workItem{key: "u1", region: "us-east-1", urgent: true})
+	p.add(workItem{key: "b1", region: "eu-west-1"})
+	p.add(workItem{key: "u2", region: "eu-west-1", urgent: true})
+	p.add(workItem{key: "u3", region: "us-east-1", urgent: true})
+
+	var got []string
+	for range 6 {
+		item, _ := p.get()
+		got = append(got, item.key)
+		p.done(item)
+	}
+	// Urgent items in order of arrival, across regions in turn, then the others.
+	if want := []string{"u1", "u2", "u3", "b1", "a1", "a2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+}
+
+func TestNodeItemTimeout(t *testing.T) {
+	tagger := &Tagger{logger: slog.New(slog.NewTextHandler(io.Discard, nil)), metrics: newMetrics(""), nodeTimeout: 10 * time.Millisecond}
+	p := runPool(t, 2)
+	node := rolloutNode("n1", nil)
+
+	// The first attempt waits on AWS past the budget; it is cancelled and
+	// the node queued again.
+	var runs atomic.Int32
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	p.add(tagger.nodeItem(context.Background(), p, node, false, func(ctx context.Context) error {
+		if runs.Add(1) == 1 {
+			<-ctx.Done()
+			errs <- ctx.Err()
+			return ctx.Err()
+		}
+		close(done)
+		return nil
+	}))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("node not reconciled again after running out of time")
+	}
+	if err := <-errs; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("first attempt's context error = %v, want deadline exceeded", err)
+	}
+	if got := testutil.ToFloat64(tagger.metrics.nodeReconcileTimeouts.WithLabelValues("us-east-1")); got != 1 {
+		t.Errorf("node_reconcile_timeouts_total{us-east-1} = %v, want 1", got)
+	}
+
+	// An event for the node while it ran wins over the requeue.
+	started, release := make(chan struct{}), make(chan struct{})
+	var newer atomic.Bool
+	finished := make(chan struct{})
+	p.add(tagger.nodeItem(context.Background(), p, node, false, func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		<-release
+		return ctx.Err()
+	}))
+	<-started
+	p.add(tagger.nodeItem(context.Background(), p, node, false, func(context.Context) error {
+		newer.Store(true)
+		close(finished)
+		return nil
+	}))
+	close(release)
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("newer item not run")
+	}
+	if !newer.Load() {
+		t.Error("requeue replaced the newer item")
+	}
+
+	// A cancelled parent context, as on shutdown, is not a timeout.
+	parent, cancel := context.WithCancel(context.Background())
+	cancel()
+	var again atomic.Int32
+	tagger.nodeItem(parent, p, node, false, func(ctx context.Context) error { again.Add(1); return ctx.Err() }).fn()
+	time.Sleep(20 * time.Millisecond)
+	if again.Load() != 1 {
+		t.Errorf("reconcile ran %d times after a shutdown, want 1", again.Load())
+	}
+
+	// A reconcile that finished as the budget ran out is not retried.
+	var late atomic.Int32
+	tagger.nodeItem(context.Background(), p, node, false, func(ctx context.Context) error {
+		late.Add(1)
+		<-ctx.Done()
+		return nil
+	}).fn()
+	time.Sleep(50 * time.Millisecond)
+	if late.Load() != 1 {
+		t.Errorf("reconcile that did not report running out of time ran %d times, want 1", late.Load())
+	}
+}
+
+func TestNodeItemRetryBackoff(t *testing.T) {
+	tagger := &Tagger{logger: slog.New(slog.NewTextHandler(io.Discard, nil)), metrics: newMetrics(""), nodeTimeout: 20 * time.Millisecond}
+	p := runPool(t, 1)
+	node := rolloutNode("n1", nil)
+
+	// Each retry of a reconcile that keeps running out of time waits twice
+	// as long as the one before.
+	var ends []time.Time
+	done := make(chan struct{})
+	p.add(tagger.nodeItem(context.Background(), p, node, false, func(ctx context.Context) error {
+		<-ctx.Done()
+		if ends = append(ends, time.Now()); len(ends) == 3 {
+			close(done)
+			return nil
+		}
+		return ctx.Err()
+	}))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reconcile not retried")
+	}
+	// Between two ends lie the backoff and the next attempt's budget.
+	if first, second := ends[1].Sub(ends[0]), ends[2].Sub(ends[1]); first < 40*time.Millisecond || second < 60*time.Millisecond {
+		t.Errorf("attempts %v and %v apart, want at least 40ms and 60ms", first, second)
+	}
+
+	// An event for the node while a retry is pending replaces the retry.
+	var retried, newer atomic.Int32
+	finished := make(chan struct{})
+	p.add(tagger.nodeItem(context.Background(), p, node, false, func(ctx context.Context) error {
+		retried.Add(1)
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	// Wait for the retry to be scheduled: the first two attempts above
+	// counted two timeouts.
+	for testutil.ToFloat64(tagger.metrics.nodeReconcileTimeouts.WithLabelValues("us-east-1")) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	p.add(tagger.nodeItem(context.Background(), p, node, false, func(context.Context) error {
+		newer.Add(1)
+		close(finished)
+		return nil
+	}))
+	<-finished
+	time.Sleep(50 * time.Millisecond)
+	if retried.Load() != 1 || newer.Load() != 1 {
+		t.Errorf("timed out item ran %d times and the newer one %d, want once each", retried.Load(), newer.Load())
+	}
+}
+
+func TestRetryForgottenOnDelete(t *testing.T) {
+	tagger := &Tagger{logger: slog.New(slog.NewTextHandler(io.Discard, nil)), metrics: newMetrics(""), nodeTimeout: 100 * time.Millisecond}
+	p := runPool(t, 2)
+	node := rolloutNode("n1", nil)
+	pv := &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "data"}}
+
+	// Both reconciles run out of time once; their objects are deleted while
+	// the retries are pending.
+	var nodeRuns, pvRuns atomic.Int32
+	p.add(tagger.nodeItem(context.Background(), p, node, false, func(ctx context.Context) error {
+		nodeRuns.Add(1)
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	p.add(tagger.budgeted(context.Background(), p, workItem{key: "pv/data", region: "us-east-1"}, func(ctx context.Context) error {
+		pvRuns.Add(1)
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	for testutil.ToFloat64(tagger.metrics.nodeReconcileTimeouts.WithLabelValues("us-east-1")) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	tagger.nodeDeleteFunc(context.Background(), p, nil, false)(node)
+	tagger.pvEventHandler(context.Background(), p).OnDelete(pv)
+
+	p.mu.Lock()
+	pending := len(p.retries)
+	p.mu.Unlock()
+	if pending != 0 {
+		t.Errorf("%d retries pending after the deletes, want none", pending)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if nodeRuns.Load() != 1 || pvRuns.Load() != 1 {
+		t.Errorf("node reconciled %d times and PV %d, want once each", nodeRuns.Load(), pvRuns.Load())
+	}
+}
+
+func TestForgetRunningItem(t *testing.T) {
+	tagger := &Tagger{logger: slog.New(slog.NewTextHandler(io.Discard, nil)), metrics: newMetrics(""), nodeTimeout: 20 * time.Millisecond}
+	p := runPool(t, 1)
+	node := rolloutNode("n1", nil)
+
+	// The node is deleted while its reconcile runs out of time: it is not
+	// retried.
+	started := make(chan struct{})
+	var runs atomic.Int32
+	p.add(tagger.nodeItem(context.Background(), p, node, false, func(ctx context.Context) error {
+		if runs.Add(1) == 1 {
+			close(started)
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+	<-started
+	p.forget("node/n1")
+	time.Sleep(150 * time.Millisecond)
+	if n := runs.Load(); n != 1 {
+		t.Errorf("reconcile ran %d times, want once", n)
+	}
+}
@@ -59,3 +59,184 @@ Fully-qualified image reference.
 {{- define "aws-node-retag.image" -}}
 {{ .Values.image.repository }}:{{ .Values.image.tag | default .Chart.AppVersion }}
 {{- end }}
+
+{{/*
+OpenTelemetry exporter settings, shared by the controller and the node-init DaemonSet.
+*/}}
+{{- define "aws-node-retag.tracingEnv" -}}
+{{- with .Values.tracing.endpoint }}
+- name: OTEL_EXPORTER_OTLP_ENDPOINT
+  value: {{ . | quote }}
+- name: OTEL_TRACES_SAMPLER
+  value: parentbased_traceidratio
+- name: OTEL_TRACES_SAMPLER_ARG
+  value: {{ $.Values.tracing.samplingRatio | quote }}
+{{- end }}
+{{- end }}
+
+{{/*
+Log settings, shared by the controller and the node-init DaemonSet.
+*/}}
+{{- define "aws-node-retag.loggingEnv" -}}
+- name: LOG_FORMAT
+  value: {{ .Values.logging.format | quote }}
+- name: LOG_LEVEL
+  value: {{ .Values.logging.level | quote }}
+{{- with .Values.logging.levels }}
+- name: LOG_LEVELS
+  value: {{ include "aws-node-retag.logLevels" . | quote }}
+{{- end }}
+{{- with .Values.logging.redactTagKeys }}
+- name: LOG_REDACT_TAG_KEYS
+  value: {{ join "," . | quote }}
+{{- end }}
+- name: LOG_SAMPLE_RATE
+  value: {{ .Values.logging.sampleRate | quote }}
+{{- end }}
+
+{{- define "aws-node-retag.logLevels" -}}
+{{- $entries := list }}
+{{- range $component, $level := . }}
+{{- $entries = append $entries (printf "%s=%s" $component $level) }}
+{{- end }}
+{{- join "," $entries }}
+{{- end }}
+
+{{/*
+Environment shared by the controller and the node-init DaemonSet: everything
+that decides which tags are written to which resources.
+*/}}
+{{- define "aws-node-retag.taggingEnv" -}}
+- name: TAGS
+  value: {{ .Values.tags | toJson | quote }}
+- name: DRY_RUN
+  value: {{ .Values.dryRun | quote }}
+{{- with .Values.controllerId }}
+- name: CONTROLLER_ID
+  value: {{ . | quote }}
+{{- end }}
+{{- if .Values.readOnly }}
+- name: READ_ONLY
+  value: "true"
+{{- end }}
+{{- if .Values.tagPolicies.enabled }}
+- name: TAG_POLICIES
+  value: "true"
+{{- with .Values.tagPolicies.authority }}
+- name: CONFIG_AUTHORITY
+  value: {{ . | quote }}
+{{- end }}
+{{- end }}
+{{- with .Values.instanceAttributeTags }}
+- name: INSTANCE_ATTRIBUTE_TAGS
+  value: {{ . | toJson | quote }}
+{{- end }}
+{{- with .Values.nodeInventoryTags }}
+- name: NODE_INVENTORY_TAGS
+  value: {{ . | toJson | quote }}
+{{- end }}
+{{- with .Values.rootVolumeTags }}
+- name: ROOT_VOLUME_TAGS
+  value: {{ . | toJson | quote }}
+{{- end }}
+{{- with .Values.dataVolumeTags }}
+- name: DATA_VOLUME_TAGS
+  value: {{ . | toJson | quote }}
+{{- end }}
+{{- with .Values.cluster.name }}
+- name: CLUSTER_NAME
+  value: {{ . | quote }}
+{{- end }}
+{{- if .Values.cluster.ownershipTag }}
+- name: CLUSTER_OWNERSHIP_TAG
+  value: "true"
+{{- end }}
+{{- if .Values.preserveExisting.enabled }}
+- name: PRESERVE_EXISTING
+  value: "true"
+{{- with .Values.preserveExisting.overwriteKeys }}
+- name: PRESERVE_OVERWRITE_KEYS
+  value: {{ join "," . | quote }}
+{{- end }}
+{{- with .Values.preserveExisting.protectedPrefixes }}
+- name: PRESERVE_PROTECTED_PREFIXES
+  value: {{ join "," . | quote }}
+{{- end }}
+{{- end }}
+{{- if .Values.sharedInstances.enabled }}
+- name: SHARED_INSTANCES
+  value: "true"
+{{- end }}
+{{- with .Values.sharedInstances.clusterTagPrefix }}
+- name: CLUSTER_TAG_PREFIX
+  value: {{ . | quote }}
+{{- end }}
+{{- if .Values.untagOnNodeDelete }}
+- name: UNTAG_ON_NODE_DELETE
+  value: "true"
+{{- end }}
+- name: MANAGED_NODEGROUP_MODE
+  value: {{ .Values.managedNodegroupMode | quote }}
+- name: PROVIDER_ID_FALLBACK
+  value: {{ .Values.providerIdFallback | quote }}
+{{- with .Values.asgTagKeys }}
+- name: ASG_TAG_KEYS
+  value: {{ join "," . | quote }}
+{{- end }}
+{{- with .Values.protectedTags.keys }}
+- name: PROTECTED_TAG_KEYS
+  value: {{ join "," . | quote }}
+{{- end }}
+{{- with .Values.protectedTags.prefixes }}
+- name: PROTECTED_TAG_PREFIXES
+  value: {{ join "," . | quote }}
+{{- end }}
+{{- with .Values.allowedRegions }}
+- name: ALLOWED_REGIONS
+  value: {{ join "," . | quote }}
+{{- end }}
+{{- with .Values.quarantine.ids }}
+- name: QUARANTINE_IDS
+  value: {{ join "," . | quote }}
+{{- end }}
+{{- with .Values.quarantine.tags }}
+- name: QUARANTINE_TAGS
+  value: {{ join "," . | quote }}
+{{- end }}
+{{- with .Values.ec2.maxAttempts }}
+- name: EC2_MAX_ATTEMPTS
+  value: {{ . | quote }}
+{{- end }}
+{{- with .Values.ec2.retryMode }}
+- name: EC2_RETRY_MODE
+  value: {{ . | quote }}
+{{- end }}
+{{- with .Values.ec2.tps }}
+- name: EC2_TPS
+  value: {{ . | quote }}
+{{- end }}
+{{- with .Values.ec2.burst }}
+- name: EC2_BURST
+  value: {{ . | quote }}
+{{- end }}
+{{- with .Values.ec2.retryPolicy }}
+- name: EC2_RETRY_POLICY
+  value: {{ . | toJson | quote }}
+{{- end }}
+{{- with .Values.ec2RegionOptions }}
+- name: EC2_REGION_OPTIONS
+  value: {{ . | toJson | quote }}
+{{- end }}
+{{- with .Values.taggingBackends }}
+- name: TAGGING_BACKENDS
+  value: {{ . | toJson | quote }}
+{{- end }}
+{{- with .Values.taggingAccountId }}
+- name: TAGGING_ACCOUNT_ID
+  value: {{ . | quote }}
+{{- end }}
+{{- with .Values.startupTaint }}
+- name: STARTUP_TAINT
+  value: {{ . | quote }}
+{{- end }}
+{{- end }}
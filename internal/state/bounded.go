@@ -0,0 +1,77 @@
+package state
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Bounded is a set admitting members up to a maximum, e.g. the label values
+// of a metric given series of their own. Members stay until forgotten, also
+// when the maximum is lowered below their number.
+type Bounded[K comparable] struct {
+	mu      sync.Mutex
+	max     int
+	members map[K]struct{}
+	// highest is the highest maximum set, which bounds the members.
+	highest int
+}
+
+// NewBounded returns an empty set admitting up to n members.
+func NewBounded[K comparable](n int) *Bounded[K] {
+	return &Bounded[K]{max: n, members: map[K]struct{}{}, highest: n}
+}
+
+// Admit reports whether k is a member, adding it when there is room.
+func (b *Bounded[K]) Admit(k K) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.members[k]; ok {
+		return true
+	}
+	if len(b.members) >= b.max {
+		return false
+	}
+	b.members[k] = struct{}{}
+	return true
+}
+
+// Forget removes k, making room for another member. When k was a member,
+// onForget is called with it before the lock is released, so no concurrent
+// Admit of k can come in between.
+func (b *Bounded[K]) Forget(k K, onForget func(K)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.members[k]; !ok {
+		return
+	}
+	delete(b.members, k)
+	if onForget != nil {
+		onForget(k)
+	}
+}
+
+// SetMax changes the maximum; members already admitted stay.
+func (b *Bounded[K]) SetMax(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.max = n
+	b.highest = max(b.highest, n)
+}
+
+// Len returns the number of members.
+func (b *Bounded[K]) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.members)
+}
+
+// CheckInvariants reports an error when there are more members than any
+// maximum ever allowed.
+func (b *Bounded[K]) CheckInvariants() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.members) > b.highest {
+		return fmt.Errorf("%d members, at most %d allowed", len(b.members), b.highest)
+	}
+	return nil
+}
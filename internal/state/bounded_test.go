@@ -0,0 +1,54 @@
+package state
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestBoundedConcurrentAdmit(t *testing.T) {
+	b := NewBounded[string](10)
+	var wg sync.WaitGroup
+	for i := range 100 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.Admit(fmt.Sprintf("node-%d", i))
+		}()
+	}
+	wg.Wait()
+	if b.Len() != 10 {
+		t.Errorf("Len() = %d, want 10", b.Len())
+	}
+	if err := b.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBoundedForgetAndSetMax(t *testing.T) {
+	b := NewBounded[string](2)
+	b.Admit("a")
+	b.Admit("b")
+	if b.Admit("c") {
+		t.Error("c should not fit")
+	}
+
+	var forgotten []string
+	b.Forget("a", func(k string) { forgotten = append(forgotten, k) })
+	b.Forget("a", func(k string) { forgotten = append(forgotten, k) })
+	if len(forgotten) != 1 || forgotten[0] != "a" {
+		t.Errorf("forgotten = %v, want [a] once", forgotten)
+	}
+	if !b.Admit("c") {
+		t.Error("c should fit once a is forgotten")
+	}
+
+	// Lowering the maximum keeps the members.
+	b.SetMax(1)
+	if b.Len() != 2 || b.Admit("d") {
+		t.Errorf("Len() = %d after lowering the maximum", b.Len())
+	}
+	if err := b.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,77 @@
+package state
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Claims records which keys were handled at which version, so concurrent
+// workers handle each key once per version, e.g. an Auto Scaling group
+// shared by many nodes once per configuration. A key being handled is
+// already claimed; a worker that fails releases its claim for the next one to
+// retry. The zero Claims is ready to use.
+type Claims[K comparable, V comparable] struct {
+	mu       sync.Mutex
+	versions map[K]V
+	// claimed and released count the claims taken and given back since the
+	// last Reset.
+	claimed, released int
+}
+
+// Claim reports whether key still needs handling at version and, if so,
+// claims it.
+func (c *Claims[K, V]) Claim(key K, version V) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.versions[key]
+	if ok && v == version {
+		return false
+	}
+	if c.versions == nil {
+		c.versions = map[K]V{}
+	}
+	if ok {
+		// Superseded by the newer version.
+		c.released++
+	}
+	c.versions[key] = version
+	c.claimed++
+	return true
+}
+
+// Release gives back the claim on key at version, unless it was claimed
+// again at another version since.
+func (c *Claims[K, V]) Release(key K, version V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, ok := c.versions[key]; ok && v == version {
+		delete(c.versions, key)
+		c.released++
+	}
+}
+
+// Reset forgets every claim, e.g. for a full re-tag.
+func (c *Claims[K, V]) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.versions = nil
+	c.claimed, c.released = 0, 0
+}
+
+// Len returns the number of keys claimed.
+func (c *Claims[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.versions)
+}
+
+// CheckInvariants reports an error when the claims held do not match the
+// claims taken and given back, i.e. one was lost or released twice.
+func (c *Claims[K, V]) CheckInvariants() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if held := c.claimed - c.released; held != len(c.versions) {
+		return fmt.Errorf("%d claims taken and %d given back, but %d held", c.claimed, c.released, len(c.versions))
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package state
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClaimsOncePerVersion(t *testing.T) {
+	var c Claims[string, uint64]
+	var won atomic.Int32
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c.Claim("asg-a", 1) {
+				won.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if won.Load() != 1 {
+		t.Errorf("%d workers claimed asg-a, want 1", won.Load())
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	if !c.Claim("asg-a", 2) {
+		t.Error("a new version should be claimable")
+	}
+	// The release of the superseded version leaves the new claim.
+	c.Release("asg-a", 1)
+	if c.Claim("asg-a", 2) {
+		t.Error("the claim at version 2 should be held")
+	}
+	c.Release("asg-a", 2)
+	if !c.Claim("asg-a", 2) {
+		t.Error("a released claim should be claimable again")
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	c.Reset()
+	if c.Len() != 0 || !c.Claim("asg-a", 2) {
+		t.Error("Reset should forget every claim")
+	}
+	if err := c.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,71 @@
+package state
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// InFlight tracks the start times of running work items, so a hung item can
+// be detected. The zero InFlight is ready to use.
+type InFlight struct {
+	mu    sync.Mutex
+	items map[*time.Time]struct{}
+	// started and finished count the items since the InFlight was created.
+	started, finished int
+}
+
+// Start records an item started at the given time and returns the function
+// to call once it finishes. Calling it more than once has no further effect.
+func (f *InFlight) Start(at time.Time) (done func()) {
+	started := &at
+	f.mu.Lock()
+	if f.items == nil {
+		f.items = map[*time.Time]struct{}{}
+	}
+	f.items[started] = struct{}{}
+	f.started++
+	f.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			delete(f.items, started)
+			f.finished++
+		})
+	}
+}
+
+// Oldest returns the start time of the longest-running item, the zero time
+// when idle.
+func (f *InFlight) Oldest() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var oldest time.Time
+	for started := range f.items {
+		if oldest.IsZero() || started.Before(oldest) {
+			oldest = *started
+		}
+	}
+	return oldest
+}
+
+// Len returns the number of running items.
+func (f *InFlight) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.items)
+}
+
+// CheckInvariants reports an error when the running items do not match the
+// items started and finished.
+func (f *InFlight) CheckInvariants() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if running := f.started - f.finished; running != len(f.items) {
+		return fmt.Errorf("%d items started and %d finished, but %d running", f.started, f.finished, len(f.items))
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package state
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInFlight(t *testing.T) {
+	var f InFlight
+	if !f.Oldest().IsZero() {
+		t.Error("Oldest() should be zero when idle")
+	}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done := f.Start(start.Add(time.Duration(i+1) * time.Second))
+			done()
+			done()
+		}()
+	}
+	wg.Wait()
+	if f.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", f.Len())
+	}
+	if err := f.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	late := f.Start(start.Add(time.Minute))
+	early := f.Start(start)
+	if got := f.Oldest(); !got.Equal(start) {
+		t.Errorf("Oldest() = %v, want %v", got, start)
+	}
+	early()
+	if got := f.Oldest(); !got.Equal(start.Add(time.Minute)) {
+		t.Errorf("Oldest() = %v after the oldest finished", got)
+	}
+	late()
+	if err := f.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,70 @@
+// Package state holds the controller state shared between goroutines —
+// client caches, claims, in-flight work and capped sets — behind explicit
+// synchronization. Each type is safe for concurrent use and has a
+// CheckInvariants method that tests call, typically after hammering it from
+// several goroutines under the race detector.
+package state
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Lazy holds one value per key, created on first use and kept until Reset,
+// e.g. an AWS client per region. The zero Lazy is ready to use.
+type Lazy[K comparable, V any] struct {
+	mu     sync.Mutex
+	values map[K]V
+	// created counts the values created since the last Reset.
+	created int
+}
+
+// Get returns the value of key, calling create to make it on first use.
+// create runs with the lock held, so a key's value is created once however
+// many goroutines ask for it; it must not use the Lazy itself.
+func (l *Lazy[K, V]) Get(key K, create func(K) V) V {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if v, ok := l.values[key]; ok {
+		return v
+	}
+	if l.values == nil {
+		l.values = map[K]V{}
+	}
+	v := create(key)
+	l.values[key] = v
+	l.created++
+	return v
+}
+
+// Reset drops every value; they are created again on next use.
+func (l *Lazy[K, V]) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.values = nil
+	l.created = 0
+}
+
+// Len returns the number of values held.
+func (l *Lazy[K, V]) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.values)
+}
+
+// CheckInvariants reports an error when a key's value was created more than
+// once or a value is the zero value, e.g. a nil client.
+func (l *Lazy[K, V]) CheckInvariants() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.created != len(l.values) {
+		return fmt.Errorf("%d values created for %d keys", l.created, len(l.values))
+	}
+	for k, v := range l.values {
+		if reflect.ValueOf(&v).Elem().IsZero() {
+			return fmt.Errorf("key %v holds the zero value", k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package state
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestLazyConcurrentGet(t *testing.T) {
+	var l Lazy[string, *int]
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := []string{"us-east-1", "eu-west-1"}[i%2]
+			l.Get(key, func(string) *int { return new(int) })
+		}()
+	}
+	wg.Wait()
+
+	if l.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", l.Len())
+	}
+	if err := l.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+	a := l.Get("us-east-1", func(string) *int { t.Error("created again"); return nil })
+	if a == nil {
+		t.Error("Get() returned nil")
+	}
+
+	l.Reset()
+	if l.Len() != 0 {
+		t.Errorf("Len() after Reset = %d", l.Len())
+	}
+	if b := l.Get("us-east-1", func(string) *int { return new(int) }); b == a {
+		t.Error("Reset should drop the values")
+	}
+}
+
+func TestLazyInvariantZeroValue(t *testing.T) {
+	var l Lazy[string, *int]
+	l.Get("us-east-1", func(string) *int { return nil })
+	if err := l.CheckInvariants(); err == nil {
+		t.Error("expected an error for a nil value")
+	}
+}
@@ -0,0 +1,167 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Task is the work on one key at one version, e.g. writing one tag set to
+// one resource. Its outcome is published once, when done is closed.
+type Task[V comparable] struct {
+	version V
+	done    chan struct{}
+	// err and finished are written before done is closed.
+	err      error
+	finished time.Time
+}
+
+// Version returns the version the task works on.
+func (t *Task[V]) Version() V { return t.version }
+
+// Wait blocks until the task is done and returns its error, or ctx's error
+// when ctx is done first.
+func (t *Task[V]) Wait(ctx context.Context) error {
+	select {
+	case <-t.done:
+		return t.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reusable reports whether the task can stand in for new work at version at
+// now: it is running, or it succeeded less than maxAge before now.
+func (t *Task[V]) reusable(version V, now time.Time, maxAge time.Duration) bool {
+	if t.version != version {
+		return false
+	}
+	select {
+	case <-t.done:
+		return t.err == nil && now.Sub(t.finished) < maxAge
+	default:
+		return true
+	}
+}
+
+// Results deduplicates work by key without locks: the first worker to start
+// a key at a version owns the task and runs it, and workers starting the same
+// key and version meanwhile wait for its outcome instead of repeating it. A
+// successful outcome keeps standing in for the same work for a while; a
+// failed one is dropped so the next worker retries, and starting another
+// version supersedes the task. The zero Results is ready to use.
+type Results[K comparable, V comparable] struct {
+	tasks sync.Map // K → *Task[V]
+	// started and finished count the tasks owned and finished since the
+	// Results was created.
+	started, finished atomic.Int64
+}
+
+// Start returns the task for key at version and whether the caller owns it.
+// The owner runs the work and must call Finish. Otherwise the task is running
+// or succeeded less than maxAge before now, and its outcome is to be waited
+// for; with maxAge zero only running tasks are shared.
+func (r *Results[K, V]) Start(key K, version V, now time.Time, maxAge time.Duration) (*Task[V], bool) {
+	for {
+		cur, loaded := r.tasks.Load(key)
+		if loaded {
+			t := cur.(*Task[V])
+			if t.reusable(version, now, maxAge) {
+				return t, false
+			}
+			n := &Task[V]{version: version, done: make(chan struct{})}
+			if r.tasks.CompareAndSwap(key, t, n) {
+				r.started.Add(1)
+				return n, true
+			}
+			continue
+		}
+		n := &Task[V]{version: version, done: make(chan struct{})}
+		if _, loaded := r.tasks.LoadOrStore(key, n); !loaded {
+			r.started.Add(1)
+			return n, true
+		}
+	}
+}
+
+// Finish publishes the outcome of an owned task. A failed task is removed,
+// unless it was superseded already.
+func (r *Results[K, V]) Finish(key K, t *Task[V], err error, now time.Time) {
+	t.err, t.finished = err, now
+	close(t.done)
+	r.finished.Add(1)
+	if err != nil {
+		r.tasks.CompareAndDelete(key, t)
+	}
+}
+
+// Sweep removes the tasks that finished at least maxAge before now, which no
+// longer stand in for any work, and returns how many it removed. Without it
+// the keys that are never started again, e.g. of deleted resources, are kept
+// forever.
+func (r *Results[K, V]) Sweep(now time.Time, maxAge time.Duration) int {
+	n := 0
+	r.tasks.Range(func(key, v any) bool {
+		t := v.(*Task[V])
+		select {
+		case <-t.done:
+			if now.Sub(t.finished) >= maxAge && r.tasks.CompareAndDelete(key, t) {
+				n++
+			}
+		default:
+		}
+		return true
+	})
+	return n
+}
+
+// Forget removes the task of key, e.g. of a deleted resource. A running task
+// still finishes, but new work no longer waits for it.
+func (r *Results[K, V]) Forget(key K) {
+	r.tasks.Delete(key)
+}
+
+// Reset forgets every task, e.g. for a full re-tag. Running tasks still
+// finish, but new work no longer waits for them.
+func (r *Results[K, V]) Reset() {
+	r.tasks.Clear()
+}
+
+// Len returns the number of keys with a task.
+func (r *Results[K, V]) Len() int {
+	n := 0
+	r.tasks.Range(func(any, any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// CheckInvariants reports an error when more tasks are running than were
+// started and not finished, or when a failed task was kept.
+func (r *Results[K, V]) CheckInvariants() error {
+	running := 0
+	var err error
+	r.tasks.Range(func(key, v any) bool {
+		t := v.(*Task[V])
+		select {
+		case <-t.done:
+			if t.err != nil {
+				err = fmt.Errorf("failed task of %v kept", key)
+				return false
+			}
+		default:
+			running++
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if pending := r.started.Load() - r.finished.Load(); int64(running) > pending {
+		return fmt.Errorf("%d tasks running, but %d started and %d finished", running, r.started.Load(), r.finished.Load())
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResultsOwnerPerVersion(t *testing.T) {
+	var r Results[string, string]
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var owners atomic.Int32
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			task, owner := r.Start("vol-a", "tags-1", now, time.Minute)
+			if owner {
+				owners.Add(1)
+				<-release
+				r.Finish("vol-a", task, nil, now)
+				return
+			}
+			if err := task.Wait(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	close(release)
+	wg.Wait()
+	if owners.Load() != 1 {
+		t.Errorf("%d workers owned vol-a, want 1", owners.Load())
+	}
+	if err := r.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	// A success stands in for the same version until it is maxAge old.
+	if _, owner := r.Start("vol-a", "tags-1", now.Add(59*time.Second), time.Minute); owner {
+		t.Error("a recent success should be reused")
+	}
+	if _, owner := r.Start("vol-a", "tags-1", now.Add(time.Second), 0); !owner {
+		t.Error("with maxAge zero a finished task should not be reused")
+	}
+}
+
+func TestResultsSupersedeAndRetry(t *testing.T) {
+	var r Results[string, string]
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	old, owner := r.Start("vol-a", "tags-1", now, time.Minute)
+	if !owner {
+		t.Fatal("the first start should own the task")
+	}
+	// Another version supersedes the running task; the superseded task's
+	// failure leaves the new one in place.
+	cur, owner := r.Start("vol-a", "tags-2", now, time.Minute)
+	if !owner || cur.Version() != "tags-2" {
+		t.Fatal("a new version should get its own task")
+	}
+	r.Finish("vol-a", old, errors.New("throttled"), now)
+	if waited, owner := r.Start("vol-a", "tags-2", now, time.Minute); owner || waited != cur {
+		t.Error("the running task of tags-2 should be shared")
+	}
+
+	// A failure is dropped, so the next worker retries.
+	r.Finish("vol-a", cur, errors.New("throttled"), now)
+	if err := cur.Wait(context.Background()); err == nil {
+		t.Error("Wait() should return the task's error")
+	}
+	if _, owner := r.Start("vol-a", "tags-2", now, time.Minute); !owner {
+		t.Error("a failed task should be retried")
+	}
+	if err := r.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+
+	r.Reset()
+	if r.Len() != 0 {
+		t.Errorf("Len() = %d after Reset, want 0", r.Len())
+	}
+	if err := r.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResultsWaitCanceled(t *testing.T) {
+	var r Results[string, int]
+	task, _ := r.Start("vol-a", 1, time.Now(), time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := task.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait() = %v, want context.Canceled", err)
+	}
+}
+
+func TestResultsSweepAndForget(t *testing.T) {
+	var r Results[string, string]
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, key := range []string{"vol-old", "vol-new"} {
+		task, _ := r.Start(key, "tags-1", now, time.Minute)
+		finished := now
+		if key == "vol-new" {
+			finished = now.Add(30 * time.Second)
+		}
+		r.Finish(key, task, nil, finished)
+	}
+	running, _ := r.Start("vol-running", "tags-1", now, time.Minute)
+
+	if n := r.Sweep(now.Add(time.Minute), time.Minute); n != 1 {
+		t.Errorf("Sweep removed %d tasks, want only vol-old", n)
+	}
+	if _, owner := r.Start("vol-new", "tags-1", now.Add(time.Minute), time.Minute); owner {
+		t.Error("a success younger than maxAge should be kept")
+	}
+	if _, owner := r.Start("vol-running", "tags-1", now.Add(time.Hour), time.Minute); owner {
+		t.Error("a running task should never be swept")
+	}
+
+	r.Forget("vol-running")
+	if r.Len() != 1 {
+		t.Errorf("Len = %d, want only vol-new left", r.Len())
+	}
+	// The forgotten task still finishes for its waiters.
+	r.Finish("vol-running", running, nil, now)
+	if err := running.Wait(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if err := r.CheckInvariants(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,68 @@
+package tags
+
+import "slices"
+
+// ChangeKind is how a tag differs between a desired and an actual set.
+type ChangeKind int
+
+const (
+	// Missing tags are desired but absent.
+	Missing ChangeKind = iota
+	// Mismatch tags are present with another value.
+	Mismatch
+	// Extra tags are present but not desired.
+	Extra
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Missing:
+		return "missing"
+	case Mismatch:
+		return "mismatch"
+	case Extra:
+		return "extra"
+	}
+	return "unknown"
+}
+
+// Change is a difference between two tag sets. Desired is normalized;
+// Actual is as found. Each is empty when the key is absent from its set.
+type Change struct {
+	Key     string
+	Kind    ChangeKind
+	Desired string
+	Actual  string
+}
+
+// Diff compares desired with actual, e.g. the tags a resource should carry
+// with those it does, and returns their differences in key order. Values
+// are compared normalized (see SameValue), so a tag carrying the desired
+// value in another Unicode composition is not a difference.
+func Diff(desired, actual map[string]string) []Change {
+	keys := make([]string, 0, len(desired)+len(actual))
+	for k := range desired {
+		keys = append(keys, k)
+	}
+	for k := range actual {
+		if _, ok := desired[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	var changes []Change
+	for _, k := range keys {
+		want, inDesired := desired[k]
+		got, inActual := actual[k]
+		switch {
+		case !inActual:
+			changes = append(changes, Change{Key: k, Kind: Missing, Desired: Normalize(want)})
+		case !inDesired:
+			changes = append(changes, Change{Key: k, Kind: Extra, Actual: got})
+		case !SameValue(want, got):
+			changes = append(changes, Change{Key: k, Kind: Mismatch, Desired: Normalize(want), Actual: got})
+		}
+	}
+	return changes
+}
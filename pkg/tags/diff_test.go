@@ -0,0 +1,83 @@
+package tags
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name            string
+		desired, actual map[string]string
+		want            []Change
+	}{
+		{name: "both empty"},
+		{name: "equal", desired: map[string]string{"Team": "a"}, actual: map[string]string{"Team": "a"}},
+		{
+			name:    "missing",
+			desired: map[string]string{"Team": "a"},
+			want:    []Change{{Key: "Team", Kind: Missing, Desired: "a"}},
+		},
+		{
+			name:   "extra",
+			actual: map[string]string{"Team": "a"},
+			want:   []Change{{Key: "Team", Kind: Extra, Actual: "a"}},
+		},
+		{
+			name:    "mismatch",
+			desired: map[string]string{"Team": "a"},
+			actual:  map[string]string{"Team": "b"},
+			want:    []Change{{Key: "Team", Kind: Mismatch, Desired: "a", Actual: "b"}},
+		},
+		{
+			name:    "values compare normalized",
+			desired: map[string]string{"City": "cafe\u0301"},
+			actual:  map[string]string{"City": "café"},
+		},
+		{
+			name:    "desired is reported normalized, actual as found",
+			desired: map[string]string{"City": "cafe\u0301"},
+			actual:  map[string]string{"City": "cafe"},
+			want:    []Change{{Key: "City", Kind: Mismatch, Desired: "café", Actual: "cafe"}},
+		},
+		{
+			name:    "empty values are present",
+			desired: map[string]string{"Team": ""},
+			actual:  map[string]string{"Env": ""},
+			want:    []Change{{Key: "Env", Kind: Extra}, {Key: "Team", Kind: Missing}},
+		},
+		// Keys are case-sensitive, as in EC2.
+		{
+			name:    "keys differing in case",
+			desired: map[string]string{"team": "a"},
+			actual:  map[string]string{"Team": "a"},
+			want:    []Change{{Key: "Team", Kind: Extra, Actual: "a"}, {Key: "team", Kind: Missing, Desired: "a"}},
+		},
+		{
+			name:    "key order",
+			desired: map[string]string{"c": "1", "a": "1", "b": "1"},
+			actual:  map[string]string{"b": "2", "d": "1"},
+			want: []Change{
+				{Key: "a", Kind: Missing, Desired: "1"},
+				{Key: "b", Kind: Mismatch, Desired: "1", Actual: "2"},
+				{Key: "c", Kind: Missing, Desired: "1"},
+				{Key: "d", Kind: Extra, Actual: "1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Diff(tt.desired, tt.actual); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChangeKindString(t *testing.T) {
+	for k, want := range map[ChangeKind]string{Missing: "missing", Mismatch: "mismatch", Extra: "extra", ChangeKind(9): "unknown"} {
+		if got := k.String(); got != want {
+			t.Errorf("ChangeKind(%d).String() = %q, want %q", int(k), got, want)
+		}
+	}
+}
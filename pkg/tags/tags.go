@@ -0,0 +1,87 @@
+// Package tags implements the semantics of AWS resource tags shared by the
+// controller and its subcommands: how values are normalized and compared,
+// how tag sets merge and differ, and the EC2 tag restrictions. Tag sets are
+// plain maps from key to value; functions returning one never modify their
+// arguments.
+package tags
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalize returns v as it is written and compared: valid UTF-8 in Unicode
+// normalization form C, so values that render the same but were composed
+// differently (e.g. "é" as one or two code points, depending on the editor
+// that produced the configuration) are equal. Invalid bytes become U+FFFD.
+func Normalize(v string) string {
+	// Almost every value is already normalized, most are ASCII: return
+	// those without copying.
+	if isASCII(v) || utf8.ValidString(v) && norm.NFC.QuickSpanString(v) == len(v) {
+		return v
+	}
+	return norm.NFC.String(strings.ToValidUTF8(v, "\uFFFD"))
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// SameValue reports whether two tag values are equal once normalized.
+func SameValue(a, b string) bool {
+	return a == b || Normalize(a) == Normalize(b)
+}
+
+// Sanitize returns tags with every value normalized, or tags itself when
+// they all are. Keys are left alone: an invalid key is an error (see
+// Validate), not something to repair.
+func Sanitize(tags map[string]string) map[string]string {
+	var out map[string]string
+	for k, v := range tags {
+		n := Normalize(v)
+		if n == v {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]string, len(tags))
+			for k, v := range tags {
+				out[k] = v
+			}
+		}
+		out[k] = n
+	}
+	if out == nil {
+		return tags
+	}
+	return out
+}
+
+// Merge returns base with each of overrides applied in turn, later ones
+// winning, or base itself when they are all empty. The result must not be
+// modified.
+func Merge(base map[string]string, overrides ...map[string]string) map[string]string {
+	n := len(base)
+	for _, o := range overrides {
+		n += len(o)
+	}
+	if n == len(base) {
+		return base
+	}
+	out := make(map[string]string, n)
+	for k, v := range base {
+		out[k] = v
+	}
+	for _, o := range overrides {
+		for k, v := range o {
+			out[k] = v
+		}
+	}
+	return out
+}
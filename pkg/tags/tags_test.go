@@ -0,0 +1,148 @@
+package tags
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "empty", in: "", want: ""},
+		{name: "ascii", in: "team-a", want: "team-a"},
+		{name: "composed", in: "café", want: "café"},
+		{name: "decomposed", in: "cafe\u0301", want: "café"},
+		{name: "invalid UTF-8", in: "a\xffb", want: "a\uFFFDb"},
+		{name: "invalid and decomposed", in: "e\u0301\xff", want: "é\uFFFD"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Normalize(tt.in); got != tt.want {
+				t.Errorf("Normalize(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSameValue(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "", b: "", want: true},
+		{a: "a", b: "a", want: true},
+		{a: "a", b: "A", want: false},
+		{a: "café", b: "cafe\u0301", want: true},
+		{a: "a\xffb", b: "a\uFFFDb", want: true},
+		{a: "a ", b: "a", want: false},
+	}
+	for _, tt := range tests {
+		if got := SameValue(tt.a, tt.b); got != tt.want {
+			t.Errorf("SameValue(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name string
+		in   map[string]string
+		want map[string]string
+		same bool // the input itself is returned
+	}{
+		{name: "nil", in: nil, want: nil, same: true},
+		{name: "normalized", in: map[string]string{"Team": "a", "City": "café"}, want: map[string]string{"Team": "a", "City": "café"}, same: true},
+		{
+			name: "decomposed value",
+			in:   map[string]string{"Team": "a", "City": "cafe\u0301"},
+			want: map[string]string{"Team": "a", "City": "café"},
+		},
+		{name: "invalid value", in: map[string]string{"k": "\xff"}, want: map[string]string{"k": "\uFFFD"}},
+		// Keys are validated, not repaired.
+		{name: "decomposed key", in: map[string]string{"cafe\u0301": "a"}, want: map[string]string{"cafe\u0301": "a"}, same: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := maps.Clone(tt.in)
+			got := Sanitize(tt.in)
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("Sanitize() = %q, want %q", got, tt.want)
+			}
+			if !maps.Equal(tt.in, orig) {
+				t.Errorf("Sanitize() modified its argument: %q", tt.in)
+			}
+			if len(tt.in) > 0 && sameMap(got, tt.in) != tt.same {
+				t.Errorf("Sanitize() returned its argument = %v, want %v", !tt.same, tt.same)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base := map[string]string{"Team": "a", "Env": "prod"}
+	tests := []struct {
+		name      string
+		base      map[string]string
+		overrides []map[string]string
+		want      map[string]string
+		same      bool
+	}{
+		{name: "nothing", want: nil, same: true},
+		{name: "no overrides", base: base, want: base, same: true},
+		{name: "empty overrides", base: base, overrides: []map[string]string{nil, {}}, want: base, same: true},
+		{
+			name:      "nil base",
+			overrides: []map[string]string{{"Team": "b"}},
+			want:      map[string]string{"Team": "b"},
+		},
+		{
+			name:      "override wins",
+			base:      base,
+			overrides: []map[string]string{{"Team": "b", "Owner": "x"}},
+			want:      map[string]string{"Team": "b", "Env": "prod", "Owner": "x"},
+		},
+		{
+			name:      "later override wins",
+			base:      base,
+			overrides: []map[string]string{{"Team": "b"}, nil, {"Team": "c"}},
+			want:      map[string]string{"Team": "c", "Env": "prod"},
+		},
+		// Overriding with an empty value keeps the key.
+		{
+			name:      "empty value",
+			base:      base,
+			overrides: []map[string]string{{"Env": ""}},
+			want:      map[string]string{"Team": "a", "Env": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := maps.Clone(tt.base)
+			got := Merge(tt.base, tt.overrides...)
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("Merge() = %q, want %q", got, tt.want)
+			}
+			if !maps.Equal(tt.base, orig) {
+				t.Errorf("Merge() modified base: %q", tt.base)
+			}
+			if len(tt.base) > 0 && sameMap(got, tt.base) != tt.same {
+				t.Errorf("Merge() returned base = %v, want %v", !tt.same, tt.same)
+			}
+		})
+	}
+}
+
+// sameMap reports whether a and b are the same map, not merely equal ones.
+func sameMap(a, b map[string]string) bool {
+	const probe = "\x00probe"
+	if _, ok := a[probe]; ok {
+		return false
+	}
+	b[probe] = ""
+	_, ok := a[probe]
+	delete(b, probe)
+	return ok
+}
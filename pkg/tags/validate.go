@@ -0,0 +1,57 @@
+package tags
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// EC2 tag restrictions. CreateTags rejects the whole call when any tag
+// violates them, so they are checked before anything is written. Lengths
+// count characters, not bytes.
+const (
+	MaxKeyLength   = 128
+	MaxValueLength = 256
+	MaxPerResource = 50
+	// ReservedPrefix is reserved for AWS in any letter case.
+	ReservedPrefix = "aws:"
+)
+
+// Validate checks every tag of the set against the EC2 tag restrictions and
+// returns all violations joined with errors.Join, in key order.
+func Validate(tags map[string]string) error {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var errs []error
+	if len(tags) > MaxPerResource {
+		errs = append(errs, fmt.Errorf("%d tags exceed the limit of %d per resource", len(tags), MaxPerResource))
+	}
+	for _, k := range keys {
+		if err := ValidateKey(k); err != nil {
+			errs = append(errs, err)
+		}
+		if n := utf8.RuneCountInString(tags[k]); n > MaxValueLength {
+			errs = append(errs, fmt.Errorf("value of tag %q is %d characters long, the limit is %d", k, n, MaxValueLength))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ValidateKey checks a tag key against the EC2 tag restrictions.
+func ValidateKey(key string) error {
+	switch {
+	case key == "":
+		return errors.New("tag key must not be empty")
+	case strings.HasPrefix(strings.ToLower(key), ReservedPrefix):
+		return fmt.Errorf("tag key %q uses the reserved %q prefix", key, ReservedPrefix)
+	case utf8.RuneCountInString(key) > MaxKeyLength:
+		return fmt.Errorf("tag key %q is %d characters long, the limit is %d", key, utf8.RuneCountInString(key), MaxKeyLength)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package tags
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	many := map[string]string{}
+	for i := 0; i < MaxPerResource+1; i++ {
+		many[fmt.Sprintf("k%02d", i)] = "v"
+	}
+
+	tests := []struct {
+		name string
+		tags map[string]string
+		want []string // substrings, one per expected violation
+	}{
+		{name: "valid", tags: map[string]string{"Team": "a", strings.Repeat("k", 128): strings.Repeat("v", 256)}},
+		{name: "reserved prefix in any case", tags: map[string]string{"AWS:team": "a"}, want: []string{"reserved"}},
+		{name: "empty key", tags: map[string]string{"": "a"}, want: []string{"empty"}},
+		{name: "long key", tags: map[string]string{strings.Repeat("k", 129): "a"}, want: []string{"129 characters"}},
+		// Lengths count characters, not bytes.
+		{name: "multibyte value at the limit", tags: map[string]string{"k": strings.Repeat("é", 256)}},
+		{name: "long value", tags: map[string]string{"k": strings.Repeat("v", 257)}, want: []string{"257 characters"}},
+		{name: "too many tags", tags: many, want: []string{"51 tags"}},
+		{
+			name: "every violation is reported",
+			tags: map[string]string{"aws:a": "x", "b": strings.Repeat("v", 300)},
+			want: []string{"reserved", "300 characters"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.tags)
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Validate() = nil, want an error")
+			}
+			var joined interface{ Unwrap() []error }
+			if !errors.As(err, &joined) || len(joined.Unwrap()) != len(tt.want) {
+				t.Fatalf("Validate() = %v, want %d violations", err, len(tt.want))
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(err.Error(), w) {
+					t.Errorf("Validate() = %v, want it to mention %q", err, w)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string // substring of the error, "" for a valid key
+	}{
+		{key: "Team"},
+		{key: "kubernetes.io/cluster/prod"},
+		{key: "awsome"},
+		{key: strings.Repeat("é", MaxKeyLength)},
+		{key: "", want: "empty"},
+		{key: "aws:cloudformation:stack-name", want: "reserved"},
+		{key: "Aws:Team", want: "reserved"},
+		{key: strings.Repeat("é", MaxKeyLength+1), want: "129 characters"},
+	}
+	for _, tt := range tests {
+		err := ValidateKey(tt.key)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("ValidateKey(%q) = %v, want nil", tt.key, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("ValidateKey(%q) = %v, want it to mention %q", tt.key, err, tt.want)
+		}
+	}
+}